@@ -0,0 +1,140 @@
+package client
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	"imessage-client/messaging"
+)
+
+// bridgeNamespace is the UUID namespace bridge event IDs are hashed in to
+// get message IDs.
+var bridgeNamespace = uuid.MustParse("6D1E3A52-3C1B-4C55-9B0E-2F4C1A9D7E08")
+
+// BridgeEchoWindow is how long a Bridge remembers the messages it sent, to
+// drop them when our other devices echo them back.
+const BridgeEchoWindow = time.Hour
+
+// Bridge adapts a Client for bridges to other chat networks, such as
+// mautrix-style Matrix bridges, that drive it as their iMessage backend:
+// messages get IDs derived from the bridge's own event IDs, the bridge's
+// messages aren't streamed back to it, and typing and read markers map onto
+// single calls.
+type Bridge struct {
+	c *Client
+
+	mu   sync.Mutex
+	sent map[string]time.Time
+}
+
+// Bridge returns an adapter for driving c from a bridge.
+func (c *Client) Bridge() *Bridge {
+	return &Bridge{c: c, sent: make(map[string]time.Time)}
+}
+
+// MessageID returns the ID a message sent for the bridge event eventID
+// gets. The same event always gets the same ID, so a bridge that retries an
+// event, even after a restart, doesn't send it twice.
+func MessageID(eventID string) string {
+	return strings.ToUpper(uuid.NewSHA1(bridgeNamespace, []byte(eventID)).String())
+}
+
+// Send sends text to chat for the bridge event eventID, with the message ID
+// MessageID(eventID). Sending an event again doesn't send a second copy.
+func (b *Bridge) Send(ctx context.Context, chat, eventID, text string) (SentMessage, error) {
+	id, err := messaging.ParseChatID(chat)
+	if err != nil {
+		return SentMessage{}, err
+	}
+	result, err := b.c.inner.SendWithOptions(ctx, id.String(), text, messaging.SendOptions{MessageUUID: MessageID(eventID)})
+	if err != nil {
+		return SentMessage{}, err
+	}
+	ids := []string{result.MessageUUID}
+	for _, part := range result.Parts {
+		ids = append(ids, part.MessageUUID)
+	}
+	b.remember(time.Now(), ids...)
+	return SentMessage{ID: result.MessageUUID, Chat: id.String(), Queued: result.Queued}, nil
+}
+
+// Stream is Client.Stream without the bridge's own messages, which come
+// back from our other devices. Messages sent from the other devices
+// themselves are still delivered, with FromMe set.
+func (b *Bridge) Stream(ctx context.Context) (<-chan Message, error) {
+	messages, err := b.c.Stream(ctx)
+	if err != nil {
+		return nil, err
+	}
+	out := make(chan Message)
+	go func() {
+		defer close(out)
+		for msg := range messages {
+			if b.isEcho(msg, time.Now()) {
+				continue
+			}
+			select {
+			case out <- msg:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out, nil
+}
+
+// SetTyping shows or takes down the typing indicator in chat, as a bridge
+// gets typing notifications. The indicator is taken down after timeout
+// without a new notification, like a Matrix typing timeout, or when a
+// message is sent to the chat.
+func (b *Bridge) SetTyping(ctx context.Context, chat string, typing bool, timeout time.Duration) error {
+	id, err := messaging.ParseChatID(chat)
+	if err != nil {
+		return err
+	}
+	if !typing {
+		return b.c.inner.StopTyping(ctx, id.String())
+	}
+	return b.c.inner.StartTyping(ctx, id.String(), timeout)
+}
+
+// MarkRead marks chat read up to and including messageID, as a bridge gets
+// read receipts, and sends a read receipt to the chat and our other devices.
+func (b *Bridge) MarkRead(ctx context.Context, chat, messageID string) error {
+	id, err := messaging.ParseChatID(chat)
+	if err != nil {
+		return err
+	}
+	_, err = b.c.inner.MarkRead(ctx, id.String(), messageID, messaging.ReadOptions{})
+	return err
+}
+
+// remember records ids as sent by the bridge at now, forgetting those older
+// than BridgeEchoWindow.
+func (b *Bridge) remember(now time.Time, ids ...string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for id, at := range b.sent {
+		if now.Sub(at) > BridgeEchoWindow {
+			delete(b.sent, id)
+		}
+	}
+	for _, id := range ids {
+		b.sent[strings.ToUpper(id)] = now
+	}
+}
+
+// isEcho reports whether msg is a copy of a message the bridge sent.
+func (b *Bridge) isEcho(msg Message, now time.Time) bool {
+	if !msg.FromMe {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	at, ok := b.sent[strings.ToUpper(msg.ID)]
+	return ok && now.Sub(at) <= BridgeEchoWindow
+}
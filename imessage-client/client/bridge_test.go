@@ -0,0 +1,36 @@
+package client
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMessageIDStable(t *testing.T) {
+	id := MessageID("$event:example.org")
+	if id != MessageID("$event:example.org") {
+		t.Error("same event got different message IDs")
+	}
+	if id == MessageID("$other:example.org") {
+		t.Error("different events got the same message ID")
+	}
+}
+
+func TestBridgeEchoSuppression(t *testing.T) {
+	b := (&Client{}).Bridge()
+	now := time.Now()
+	id := MessageID("$event:example.org")
+	b.remember(now, id)
+
+	if !b.isEcho(Message{ID: id, FromMe: true}, now) {
+		t.Error("bridge's own message not suppressed")
+	}
+	if b.isEcho(Message{ID: "OTHER", FromMe: true}, now) {
+		t.Error("message from another device suppressed")
+	}
+	if b.isEcho(Message{ID: id}, now) {
+		t.Error("incoming message suppressed")
+	}
+	if b.isEcho(Message{ID: id, FromMe: true}, now.Add(BridgeEchoWindow+time.Second)) {
+		t.Error("echo still suppressed after the window")
+	}
+}
@@ -0,0 +1,232 @@
+// Package client is the API for embedding the iMessage client in other Go
+// programs. It wraps the messaging, ids and apns packages, whose types change
+// as the protocol work goes on; the types here only gain fields.
+//
+//	c, err := client.Login(ctx, client.Options{RegistrationPath: "registration-data.json"})
+//	if err != nil {
+//		return err
+//	}
+//	defer c.Close()
+//	messages, err := c.Stream(ctx)
+//	...
+//	for msg := range messages {
+//		c.Send(ctx, msg.Chat, "got it")
+//	}
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"imessage-client/config"
+	"imessage-client/messaging"
+	"imessage-client/messaging/ids"
+)
+
+var (
+	// ErrMissingRegistration is returned by Login when the registration
+	// file doesn't exist.
+	ErrMissingRegistration = config.ErrMissingRegistration
+	// ErrRegistrationExpired is returned when the registration data is too
+	// old to register with; regenerate it with mac-registration-provider.
+	ErrRegistrationExpired = messaging.ErrRegistrationExpired
+)
+
+// Options configures Login.
+type Options struct {
+	// RegistrationPath is the registration-data.json written by
+	// mac-registration-provider. Ignored if Registration is set.
+	RegistrationPath string
+	// Registration is the contents of a registration file, for callers that
+	// keep it somewhere other than on disk.
+	Registration []byte
+	// StorePath is where chat state and device keys are kept between runs.
+	// If empty, state is kept in memory and a new device registers on every
+	// Login.
+	StorePath string
+	// DeviceName is the name shown to other devices on the account.
+	DeviceName string
+}
+
+// Client is a logged in iMessage client. Its methods are safe for concurrent
+// use.
+type Client struct {
+	inner *messaging.Client
+	store messaging.Store
+}
+
+// Login loads the registration data, registers with Apple and connects to
+// the push courier.
+func Login(ctx context.Context, opts Options) (*Client, error) {
+	reg, err := loadRegistration(opts)
+	if err != nil {
+		return nil, err
+	}
+	if reg.IsExpired() {
+		return nil, ErrRegistrationExpired
+	}
+	if opts.DeviceName != "" {
+		reg.DeviceInfo.DeviceName = opts.DeviceName
+	}
+
+	var store messaging.Store
+	if opts.StorePath != "" {
+		fileStore, err := messaging.NewFileStore(opts.StorePath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open store: %w", err)
+		}
+		store = fileStore
+	} else {
+		store = messaging.NewMemoryStore()
+	}
+
+	c := &Client{inner: messaging.NewClientWithStore(reg, store), store: store}
+	if err := c.inner.Handshake(ctx); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func loadRegistration(opts Options) (*config.RegistrationData, error) {
+	if opts.Registration != nil {
+		reg, _, err := config.ParseRegistration(opts.Registration)
+		return reg, err
+	}
+	if opts.RegistrationPath == "" {
+		return nil, errors.New("no registration data given")
+	}
+	return config.LoadRegistration(opts.RegistrationPath)
+}
+
+// Close disconnects and saves the store. A closed client can't be reused.
+func (c *Client) Close() error {
+	err := c.inner.Close()
+	if closer, ok := c.store.(io.Closer); ok {
+		if closeErr := closer.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// SentMessage describes a message accepted by Send.
+type SentMessage struct {
+	// ID is the message's UUID, as seen by the recipient.
+	ID string
+	// Chat is the canonical form of the chat it was sent to.
+	Chat string
+	// Queued is set when the courier was unreachable, so the message will be
+	// sent once it's back.
+	Queued bool
+}
+
+// Send sends text to chat, which is a phone number, email address, handle
+// URI like "tel:+15555550123" or group chat GUID.
+func (c *Client) Send(ctx context.Context, chat, text string) (SentMessage, error) {
+	id, err := messaging.ParseChatID(chat)
+	if err != nil {
+		return SentMessage{}, err
+	}
+	result, err := c.inner.Send(ctx, id.String(), text)
+	if err != nil {
+		return SentMessage{}, err
+	}
+	return SentMessage{ID: result.MessageUUID, Chat: id.String(), Queued: result.Queued}, nil
+}
+
+// Message is an incoming message.
+type Message struct {
+	ID     string
+	Chat   string
+	Sender string
+	Text   string
+	Time   time.Time
+	// Service is "iMessage" or "SMS".
+	Service string
+	// GroupName and Participants are set for group chats. Participants
+	// includes our own handle.
+	GroupName    string
+	Participants []string
+	// FromMe is set for messages sent from our other devices.
+	FromMe bool
+	// ReplyTo is the ID of the message this one replies to.
+	ReplyTo string
+}
+
+func newMessage(msg messaging.Message) Message {
+	return Message{
+		ID:           msg.ID,
+		Chat:         msg.Chat,
+		Sender:       msg.Sender,
+		Text:         msg.Text,
+		Time:         msg.Timestamp,
+		Service:      msg.Service,
+		GroupName:    msg.GroupName,
+		Participants: msg.Participants,
+		FromMe:       msg.IsFromMe,
+		ReplyTo:      msg.ReplyToID,
+	}
+}
+
+// Stream delivers incoming messages until ctx is done, then closes the
+// channel. Messages are dropped, oldest first, if the caller falls behind.
+func (c *Client) Stream(ctx context.Context) (<-chan Message, error) {
+	sub, err := c.inner.Subscribe(ctx, messaging.SubscribeOptions{})
+	if err != nil {
+		return nil, err
+	}
+	out := make(chan Message)
+	go func() {
+		defer close(out)
+		defer sub.Close()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case msg, ok := <-sub.Messages():
+				if !ok {
+					return
+				}
+				select {
+				case out <- newMessage(msg):
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return out, nil
+}
+
+// Handle is the result of looking up one handle.
+type Handle struct {
+	// IMessage is set when the handle can receive iMessages.
+	IMessage bool
+	// Devices is how many devices are registered to the handle.
+	Devices int
+}
+
+// Lookup reports which handles can receive iMessages. Results are cached
+// for a while, so repeated lookups are cheap.
+func (c *Client) Lookup(ctx context.Context, handles ...string) (map[string]Handle, error) {
+	results, err := c.inner.Lookup(ctx, handles)
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[string]Handle, len(results))
+	for handle, result := range results {
+		out[handle] = newHandle(result)
+	}
+	return out, nil
+}
+
+func newHandle(result *ids.LookupResult) Handle {
+	if result == nil || result.Status != ids.IDSStatusSuccess {
+		return Handle{}
+	}
+	return Handle{IMessage: len(result.Identities) > 0, Devices: len(result.Identities)}
+}
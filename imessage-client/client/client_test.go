@@ -0,0 +1,31 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"imessage-client/messaging/ids"
+)
+
+func TestLoginMissingRegistration(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "registration-data.json")
+	if _, err := Login(context.Background(), Options{RegistrationPath: path}); !errors.Is(err, ErrMissingRegistration) {
+		t.Fatalf("err = %v, want ErrMissingRegistration", err)
+	}
+}
+
+func TestNewHandle(t *testing.T) {
+	registered := &ids.LookupResult{Identities: make([]ids.LookupIdentity, 2)}
+	if got := newHandle(registered); !got.IMessage || got.Devices != 2 {
+		t.Errorf("registered handle = %+v", got)
+	}
+	if got := newHandle(&ids.LookupResult{}); got.IMessage {
+		t.Errorf("handle without devices = %+v", got)
+	}
+	failed := &ids.LookupResult{Identities: make([]ids.LookupIdentity, 1), Status: ids.IDSStatusUnauthenticated}
+	if got := newHandle(failed); got.IMessage {
+		t.Errorf("failed lookup = %+v", got)
+	}
+}
@@ -0,0 +1,93 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"imessage-client/messaging"
+)
+
+func newBenchHandshakeCmd() *cobra.Command {
+	var iterations int
+	cmd := &cobra.Command{
+		Use:   "bench-handshake",
+		Short: "Time each phase of the handshake",
+		Long: "Run the handshake and courier connect --iterations times and print how long key generation, the IDS\n" +
+			"register request and the APNS connect took. State is kept in memory rather than --store, so the first run\n" +
+			"generates keys and later runs reuse them. There is no Albert phase: the push key is used without activation.",
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if iterations < 1 {
+				return fmt.Errorf("--iterations must be at least 1")
+			}
+			reg, err := loadRegistration(cmd.Context())
+			if err != nil {
+				return err
+			}
+			client := newClient(cmd, reg, messaging.NewMemoryStore())
+			defer client.Close()
+
+			var runs []messaging.HandshakeTimings
+			w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 4, 2, ' ', tabwriter.AlignRight)
+			fmt.Fprintln(w, "RUN\tKEYGEN\tREGISTER\tAPNS CONNECT\tTOTAL\t")
+			for i := 1; i <= iterations; i++ {
+				timings, err := client.TimeHandshake(cmd.Context())
+				if errors.Is(err, messaging.ErrHandshakeNotImplemented) {
+					w.Flush()
+					fmt.Fprintln(cmd.OutOrStdout(), "Handshake not implemented yet.")
+					return nil
+				} else if err != nil {
+					w.Flush()
+					return fmt.Errorf("run %d failed: %w", i, err)
+				}
+				runs = append(runs, timings)
+				printTimings(w, fmt.Sprint(i), timings)
+			}
+			if iterations > 1 {
+				lo, mean, hi := summarizeTimings(runs)
+				printTimings(w, "min", lo)
+				printTimings(w, "avg", mean)
+				printTimings(w, "max", hi)
+			}
+			return w.Flush()
+		},
+	}
+
+	cmd.Flags().IntVar(&iterations, "iterations", 3, "How many handshakes to run")
+	return cmd
+}
+
+func printTimings(w *tabwriter.Writer, label string, t messaging.HandshakeTimings) {
+	ms := func(d time.Duration) string {
+		return d.Round(time.Millisecond).String()
+	}
+	fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t\n", label, ms(t.Keygen), ms(t.Register), ms(t.APNSConnect), ms(t.Total))
+}
+
+// summarizeTimings returns the per-phase minimum, mean and maximum of runs.
+func summarizeTimings(runs []messaging.HandshakeTimings) (lo, mean, hi messaging.HandshakeTimings) {
+	phases := func(t *messaging.HandshakeTimings) []*time.Duration {
+		return []*time.Duration{&t.Keygen, &t.Register, &t.APNSConnect, &t.Total}
+	}
+	lo, hi = runs[0], runs[0]
+	for _, run := range runs {
+		r, l, h, sum := phases(&run), phases(&lo), phases(&hi), phases(&mean)
+		for i := range r {
+			if *r[i] < *l[i] {
+				*l[i] = *r[i]
+			}
+			if *r[i] > *h[i] {
+				*h[i] = *r[i]
+			}
+			*sum[i] += *r[i]
+		}
+	}
+	for _, d := range phases(&mean) {
+		*d /= time.Duration(len(runs))
+	}
+	return lo, mean, hi
+}
@@ -3,10 +3,10 @@ package cmd
 import (
 	"errors"
 	"fmt"
+	"time"
 
 	"github.com/spf13/cobra"
 
-	"imessage-client/config"
 	"imessage-client/messaging"
 	"imessage-client/notifier"
 )
@@ -16,26 +16,7 @@ func newCheckMessagesCmd() *cobra.Command {
 		Use:   "check-messages",
 		Short: "Poll for unread iMessage messages",
 		RunE: func(cmd *cobra.Command, args []string) error {
-			reg, err := config.LoadRegistration(configPath)
-			if err != nil {
-				return err
-			}
-			if reg.IsExpired() {
-				return fmt.Errorf("registration data expired; regenerate with mac-registration-provider")
-			}
-
-			var store messaging.Store
-			if storePath != "" {
-				store, err = messaging.NewFileStore(storePath)
-				if err != nil {
-					return fmt.Errorf("failed to initialize store: %w", err)
-				}
-			} else {
-				store = messaging.NewMemoryStore()
-			}
-
-			client := messaging.NewClientWithStore(reg, store)
-			summaries, err := client.PollUnread(cmd.Context())
+			summaries, err := pollUnread(cmd)
 			if errors.Is(err, messaging.ErrHandshakeNotImplemented) {
 				fmt.Fprintln(cmd.OutOrStdout(), "Handshake not implemented yet.")
 				return nil
@@ -48,10 +29,65 @@ func newCheckMessagesCmd() *cobra.Command {
 				return err
 			}
 
-			notifier.PrintSummaries(cmd.OutOrStdout(), summaries)
-			return nil
+			return printSummaries(cmd, summaries)
 		},
 	}
 
 	return cmd
 }
+
+// printSummaries prints new messages, with --output-template if given,
+// leaving out the ones muted by --quiet-hours, and chimes if any are left.
+func printSummaries(cmd *cobra.Command, summaries []messaging.MessageSummary) error {
+	summaries, chatMuted := notifier.FilterMuted(summaries)
+	summaries, muted := notifier.FilterQuiet(summaries, quietHours, time.Now())
+	if chime := newChime(cmd); chime != nil && len(summaries) > 0 {
+		if err := chime.Ring(cmd.Context()); err != nil {
+			fmt.Fprintf(cmd.ErrOrStderr(), "Failed to chime: %v\n", err)
+		}
+	}
+	if summaryTemplate != nil {
+		return notifier.PrintSummariesTemplate(cmd.OutOrStdout(), summaries, summaryTemplate)
+	}
+	if len(summaries) == 0 && (muted > 0 || chatMuted > 0) {
+		if muted > 0 {
+			fmt.Fprintf(cmd.OutOrStdout(), "%d new message(s) muted by quiet hours.\n", muted)
+		}
+		if chatMuted > 0 {
+			fmt.Fprintf(cmd.OutOrStdout(), "%d new message(s) in muted chats.\n", chatMuted)
+		}
+		return nil
+	}
+	notifier.PrintSummaries(cmd.OutOrStdout(), summaries)
+	if muted > 0 {
+		fmt.Fprintf(cmd.OutOrStdout(), "%d more muted by quiet hours.\n", muted)
+	}
+	if chatMuted > 0 {
+		fmt.Fprintf(cmd.OutOrStdout(), "%d more in muted chats.\n", chatMuted)
+	}
+	return nil
+}
+
+// pollUnread fetches unread messages through a running daemon, or from a
+// standalone session if there is none.
+func pollUnread(cmd *cobra.Command) ([]messaging.MessageSummary, error) {
+	if dc := dialDaemon(); dc != nil {
+		defer dc.Close()
+		return dc.PollUnread(cmd.Context())
+	}
+
+	reg, err := loadRegistration(cmd.Context())
+	if err != nil {
+		return nil, err
+	}
+
+	store, err := openStore()
+	if err != nil {
+		return nil, err
+	}
+	defer closeStore(cmd, store)
+
+	client := newClient(cmd, reg, store)
+	defer client.Close()
+	return client.PollUnread(cmd.Context())
+}
@@ -0,0 +1,191 @@
+package cmd
+
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"imessage-client/daemon"
+	"imessage-client/messaging"
+	"imessage-client/messaging/nacserv"
+	"imessage-client/messaging/netwatch"
+	"imessage-client/notifier"
+)
+
+func newDaemonCmd() *cobra.Command {
+	var networkCheckInterval time.Duration
+	var pollInterval time.Duration
+	var autoReplyPath string
+	var botPrefix, botCommand, botURL string
+	var botTimeout time.Duration
+	var listenAddr, tokensPath, tlsCert, tlsKey, tlsClientCA string
+	var rateLimit int
+	cmd := &cobra.Command{
+		Use:   "daemon",
+		Short: "Keep one session open and serve other commands over --socket",
+		Long: "Keep one session open and serve send, typing and check-messages over the unix socket given by --socket.\n" +
+			"While the daemon runs, those commands reuse its session instead of each performing a new handshake.\n" +
+			"--listen also serves them on a TCP address for other machines, which use --daemon-addr. Each request\n" +
+			"there needs an API token from --api-tokens; read tokens can only poll, send tokens can do everything.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if socketPath == "" {
+				return fmt.Errorf("socket path is required (use --socket)")
+			}
+			var tokens []daemon.Token
+			var tlsConfig *tls.Config
+			if listenAddr != "" {
+				if tokensPath == "" {
+					return fmt.Errorf("--listen needs --api-tokens")
+				}
+				var err error
+				if tokens, err = daemon.LoadTokens(tokensPath); err != nil {
+					return err
+				}
+				if tlsCert != "" {
+					if tlsConfig, err = daemon.ServerTLSConfig(tlsCert, tlsKey, tlsClientCA); err != nil {
+						return err
+					}
+				} else if tlsClientCA != "" {
+					return fmt.Errorf("--tls-client-ca needs --tls-cert")
+				}
+			}
+			var responder *daemon.AutoResponder
+			if autoReplyPath != "" {
+				rules, err := daemon.LoadAutoReplyRules(autoReplyPath)
+				if err != nil {
+					return err
+				}
+				responder = daemon.NewAutoResponder(rules)
+			}
+			var bot *daemon.Bot
+			switch {
+			case botCommand != "" && botURL != "":
+				return fmt.Errorf("--bot-command and --bot-url can't be used together")
+			case botCommand != "":
+				bot = &daemon.Bot{Handler: daemon.CommandBot{Command: botCommand}}
+			case botURL != "":
+				bot = &daemon.Bot{Handler: daemon.HTTPBot{URL: botURL}}
+			}
+			if bot != nil {
+				if botPrefix == "" {
+					return fmt.Errorf("--bot-prefix can't be empty")
+				}
+				bot.Prefix, bot.Timeout = botPrefix, botTimeout
+			}
+
+			reg, err := loadRegistration(cmd.Context())
+			if err != nil {
+				return err
+			}
+
+			store, err := openStore()
+			if err != nil {
+				return err
+			}
+			defer closeStore(cmd, store)
+
+			ctx, stop := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+
+			session, err := messaging.Connect(ctx, reg, store)
+			if err != nil {
+				return err
+			}
+			defer session.Close()
+			session.OnEvent(newEventPrinter(cmd))
+			session.SetTracer(tracer)
+			session.SetIdentityPolicy(identityPolicy)
+			session.SetDeliveryTimeout(deliveryTimeout)
+			session.SetSMSFallback(newSMSFallback())
+			session.SetPowerProfile(powerProfile)
+			session.SetCourierPorts(courierPorts)
+			session.SetRegistrationRefresher(registrationRefresher())
+			session.SetValidationMargin(validationMargin)
+
+			if err := os.MkdirAll(filepath.Dir(socketPath), 0o700); err != nil {
+				return fmt.Errorf("failed to create socket directory: %w", err)
+			}
+			server, err := daemon.Listen(socketPath, session)
+			if err != nil {
+				return err
+			}
+			if pollInterval > 0 {
+				go session.RunPolling(ctx, pollInterval, messaging.DefaultPollQuiet)
+			} else if networkCheckInterval > 0 {
+				go session.WatchNetwork(ctx, &netwatch.Watcher{Interval: networkCheckInterval})
+			}
+			if relayPool != nil {
+				go relayPool.MonitorHealth(ctx, nacserv.DefaultHealthInterval)
+			}
+			if chime := newChime(cmd); chime != nil {
+				go chimeOnMessages(cmd, session, chime)
+			}
+			if responder != nil {
+				go responder.Run(ctx, session)
+			}
+			if bot != nil {
+				go bot.Run(ctx, session)
+			}
+			remoteDone := make(chan struct{})
+			if listenAddr != "" {
+				remote, err := daemon.ListenTCP(listenAddr, tlsConfig, tokens, session)
+				if err != nil {
+					return err
+				}
+				limiter := daemon.NewRateLimiter(rateLimit)
+				remote.SetRateLimiter(limiter)
+				server.SetRateLimiter(limiter)
+				go func() {
+					defer close(remoteDone)
+					if err := remote.Serve(ctx); err != nil {
+						fmt.Fprintf(cmd.ErrOrStderr(), "Stopped listening on %s: %v\n", listenAddr, err)
+					}
+				}()
+				fmt.Fprintf(cmd.ErrOrStderr(), "Listening on %s\n", remote.Addr())
+			} else {
+				close(remoteDone)
+			}
+			fmt.Fprintf(cmd.ErrOrStderr(), "Listening on %s\n", socketPath)
+			err = server.Serve(ctx)
+			stop()
+			<-remoteDone
+			return err
+		},
+	}
+	cmd.Flags().DurationVar(&pollInterval, "poll", 0, "Connect every interval to fetch queued messages instead of staying connected (0 to stay connected)")
+	cmd.Flags().DurationVar(&networkCheckInterval, "network-check-interval", netwatch.DefaultInterval, "How often to check for network changes that need a reconnect (0 to disable)")
+	cmd.Flags().StringVar(&autoReplyPath, "auto-reply", "", "JSON file of rules for answering incoming messages automatically")
+	cmd.Flags().StringVar(&listenAddr, "listen", "", "Also serve commands on this TCP host:port, for clients on other machines (needs --api-tokens; TLS unless it's a loopback address)")
+	cmd.Flags().StringVar(&tokensPath, "api-tokens", "", "JSON file of the API tokens --listen accepts, each with a read or send scope")
+	cmd.Flags().IntVar(&rateLimit, "api-rate-limit", daemon.DefaultRateLimit, "Messages a minute each API token may send, unless it sets its own rate_limit (0 for no limit)")
+	cmd.Flags().StringVar(&tlsCert, "tls-cert", "", "TLS certificate for --listen")
+	cmd.Flags().StringVar(&tlsKey, "tls-key", "", "Key of --tls-cert")
+	cmd.Flags().StringVar(&tlsClientCA, "tls-client-ca", "", "Require --listen clients to present a certificate signed by this CA; its common name picks the API token")
+	cmd.Flags().StringVar(&botPrefix, "bot-prefix", "!", "Prefix that marks an incoming message as a bot command")
+	cmd.Flags().StringVar(&botCommand, "bot-command", "", "Shell command that answers bot commands; its output is sent back to the chat")
+	cmd.Flags().StringVar(&botURL, "bot-url", "", "URL that bot commands are POSTed to as JSON; the response is sent back to the chat")
+	cmd.Flags().DurationVar(&botTimeout, "bot-timeout", daemon.DefaultBotTimeout, "How long a bot command may take to answer")
+	return cmd
+}
+
+// chimeOnMessages rings chime for each incoming message that quiet hours
+// don't mute, isn't in a muted chat and wasn't sent from our other devices,
+// until the session closes.
+func chimeOnMessages(cmd *cobra.Command, session *messaging.Session, chime *notifier.Chime) {
+	sub := session.Subscribe(messaging.SubscribeOptions{Overflow: messaging.OverflowDropOldest})
+	defer sub.Close()
+	for msg := range sub.Messages() {
+		if msg.IsFromMe || quietHours.Mutes(msg.Chat, msg.Sender, time.Now()) || session.IsMuted(msg.Chat) {
+			continue
+		}
+		if err := chime.Ring(cmd.Context()); err != nil {
+			fmt.Fprintf(cmd.ErrOrStderr(), "Failed to chime: %v\n", err)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+
+	"imessage-client/notifier"
+)
+
+func newReplayDeadLettersCmd() *cobra.Command {
+	var list bool
+	cmd := &cobra.Command{
+		Use:   "replay-dead-letters",
+		Short: "Send alert webhooks that failed after retries again",
+		Long: "Send the alert webhooks kept in --alert-dead-letters again, once each, to the URL they were meant for.\n" +
+			"Delivered ones are removed; ones that fail again stay queued for the next replay.",
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if alertDeadLetters == "" {
+				return fmt.Errorf("dead-letter file is required (use --alert-dead-letters)")
+			}
+			queue := &notifier.DeadLetterQueue{Path: alertDeadLetters}
+			out := cmd.OutOrStdout()
+			if list {
+				letters, err := queue.Load()
+				if err != nil {
+					return err
+				}
+				for _, letter := range letters {
+					fmt.Fprintf(out, "%s %s: %s (%s)\n", letter.Time.Local().Format("2006-01-02 15:04:05"), letter.URL, letter.Body, letter.Error)
+				}
+				fmt.Fprintf(out, "%d queued\n", len(letters))
+				return nil
+			}
+			sent, err := queue.Replay(cmd.Context(), nil)
+			fmt.Fprintf(out, "Delivered %d webhook(s)\n", sent)
+			return err
+		},
+	}
+	cmd.Flags().BoolVar(&list, "list", false, "Only list the queued webhooks")
+	return cmd
+}
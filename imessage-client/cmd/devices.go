@@ -0,0 +1,55 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+
+	"imessage-client/messaging"
+)
+
+func newDevicesCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "devices",
+		Short: "List devices registered to the account",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			reg, err := loadRegistration(cmd.Context())
+			if err != nil {
+				return err
+			}
+
+			store, err := openStore()
+			if err != nil {
+				return err
+			}
+			defer closeStore(cmd, store)
+
+			client := newClient(cmd, reg, store)
+			defer client.Close()
+			devices, err := client.Devices(cmd.Context())
+			if errors.Is(err, messaging.ErrHandshakeNotImplemented) {
+				fmt.Fprintln(cmd.OutOrStdout(), "Handshake not implemented yet.")
+				return nil
+			} else if errors.Is(err, messaging.ErrInvalidRegistrationData) {
+				return fmt.Errorf("registration data missing required fields")
+			} else if err != nil {
+				return err
+			}
+
+			if len(devices) == 0 {
+				fmt.Fprintln(cmd.OutOrStdout(), "No devices registered.")
+				return nil
+			}
+			w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 4, 2, ' ', 0)
+			fmt.Fprintln(w, "NAME\tMODEL\tPUSH TOKEN")
+			for _, device := range devices {
+				fmt.Fprintf(w, "%s\t%s\t%s\n", device.Name, device.Model, device.PushTokenFingerprint)
+			}
+			return w.Flush()
+		},
+	}
+
+	return cmd
+}
@@ -0,0 +1,63 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/skip2/go-qrcode"
+	"github.com/spf13/cobra"
+
+	"imessage-client/messaging"
+)
+
+func newIdentityCmd() *cobra.Command {
+	var showQR bool
+	cmd := &cobra.Command{
+		Use:   "identity",
+		Short: "Print this client's identity fingerprint for correspondents to verify",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			reg, err := loadRegistration(cmd.Context())
+			if err != nil {
+				return err
+			}
+
+			store, err := openStore()
+			if err != nil {
+				return err
+			}
+			defer closeStore(cmd, store)
+
+			client := newClient(cmd, reg, store)
+			defer client.Close()
+			identity, err := client.OwnIdentity(cmd.Context())
+			if errors.Is(err, messaging.ErrHandshakeNotImplemented) {
+				fmt.Fprintln(cmd.OutOrStdout(), "Handshake not implemented yet.")
+				return nil
+			} else if errors.Is(err, messaging.ErrInvalidRegistrationData) {
+				return fmt.Errorf("registration data missing required fields")
+			} else if err != nil {
+				return err
+			}
+
+			out := cmd.OutOrStdout()
+			fmt.Fprintf(out, "Handle: %s\n", identity.Handle)
+			fmt.Fprintf(out, "Push token: %s\n", identity.PushTokenFingerprint)
+			fmt.Fprintf(out, "Fingerprint:\n  %s\n", identity.Fingerprint)
+			fmt.Fprintf(out, "Key hash: %s\n", identity.KeyHash)
+			fmt.Fprintf(out, "Text: %s\n", identity.Text())
+			if !showQR {
+				return nil
+			}
+			qr, err := qrcode.New(identity.Text(), qrcode.Low)
+			if err != nil {
+				return fmt.Errorf("failed to encode QR code: %w", err)
+			}
+			fmt.Fprintln(out)
+			fmt.Fprint(out, qr.ToSmallString(false))
+			return nil
+		},
+	}
+
+	cmd.Flags().BoolVar(&showQR, "qr", false, "Also print the text encoding as a QR code")
+	return cmd
+}
@@ -0,0 +1,93 @@
+package cmd
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"imessage-client/messaging"
+)
+
+func newMuteCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "mute <chat> [duration]",
+		Short: "Silence notifications for a chat, for a while or until unmute",
+		Long: "Silence notifications for a chat for a duration such as 8h, or until unmute without one. Its\n" +
+			"messages are still received and marked unread, but check-messages only counts them, the daemon\n" +
+			"doesn't chime for them and unread-count leaves them out.",
+		Args: cobra.RangeArgs(1, 2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			chat, err := parseChat(args[0])
+			if err != nil {
+				return err
+			}
+			var duration time.Duration
+			until := messaging.MuteForever
+			if len(args) == 2 {
+				if duration, err = time.ParseDuration(args[1]); err != nil {
+					return fmt.Errorf("invalid duration: %w", err)
+				} else if duration <= 0 {
+					return fmt.Errorf("duration must be positive")
+				}
+				until = time.Now().Add(duration)
+			}
+
+			if dc := dialDaemon(); dc != nil {
+				defer dc.Close()
+				if err := dc.Mute(cmd.Context(), chat, duration); err != nil {
+					return err
+				}
+			} else {
+				store, err := openStore()
+				if err != nil {
+					return err
+				}
+				defer closeStore(cmd, store)
+				if err := messaging.Mute(store, chat, until); err != nil {
+					return err
+				}
+			}
+			if duration == 0 {
+				fmt.Fprintf(cmd.OutOrStdout(), "Muted %s until unmuted\n", chat)
+			} else {
+				fmt.Fprintf(cmd.OutOrStdout(), "Muted %s until %s\n", chat, until.Local().Format(time.RFC1123))
+			}
+			return nil
+		},
+	}
+	return cmd
+}
+
+func newUnmuteCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "unmute <chat>",
+		Short: "Notify about a muted chat again",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			chat, err := parseChat(args[0])
+			if err != nil {
+				return err
+			}
+
+			if dc := dialDaemon(); dc != nil {
+				defer dc.Close()
+				if err := dc.Unmute(cmd.Context(), chat); err != nil {
+					return err
+				}
+			} else {
+				store, err := openStore()
+				if err != nil {
+					return err
+				}
+				defer closeStore(cmd, store)
+				if err := messaging.Unmute(store, chat); err != nil {
+					return err
+				}
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "Unmuted %s\n", chat)
+			return nil
+		},
+	}
+	return cmd
+}
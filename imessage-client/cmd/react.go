@@ -0,0 +1,66 @@
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+
+	"imessage-client/messaging"
+)
+
+func newReactCmd() *cobra.Command {
+	var messageUUID string
+	var remove bool
+	cmd := &cobra.Command{
+		Use:   "react <messageID> <love|like|dislike|laugh|emphasize|question|emoji>",
+		Short: "Send a tapback on a message",
+		Args:  cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			reaction, err := messaging.ParseReaction(args[0], args[1])
+			if err != nil {
+				return err
+			}
+			reaction.Remove = remove
+			opts := messaging.SendOptions{MessageUUID: messageUUID}
+			if dc := dialDaemon(); dc != nil {
+				defer dc.Close()
+				resp, err := dc.React(cmd.Context(), reaction, opts)
+				if err != nil {
+					var id string
+					if resp != nil {
+						id = resp.MessageUUID
+					}
+					return reportSendError(cmd, id, err)
+				}
+				reportSent(cmd, resp.MessageUUID, resp.Duplicate, resp.Queued, "", nil)
+				return nil
+			}
+
+			reg, err := loadRegistration(cmd.Context())
+			if err != nil {
+				return err
+			}
+
+			store, err := openStore()
+			if err != nil {
+				return err
+			}
+			defer closeStore(cmd, store)
+
+			client := newClient(cmd, reg, store)
+			defer client.Close()
+			result, err := client.React(cmd.Context(), reaction, opts)
+			if err != nil {
+				var id string
+				if result != nil {
+					id = result.MessageUUID
+				}
+				return reportSendError(cmd, id, err)
+			}
+			reportSent(cmd, result.MessageUUID, result.Duplicate, result.Queued, "", nil)
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&messageUUID, "uuid", "", "Message UUID of the tapback; resending with the same UUID won't send a duplicate")
+	cmd.Flags().BoolVar(&remove, "remove", false, "Take back an earlier tapback of this kind")
+	return cmd
+}
@@ -0,0 +1,85 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/spf13/cobra"
+
+	"imessage-client/messaging"
+)
+
+func newReadCmd() *cobra.Command {
+	var all bool
+	var noReceipt bool
+	cmd := &cobra.Command{
+		Use:     "read <chat> [messageID]",
+		Aliases: []string{"mark-read"},
+		Short:   "Mark a chat's messages read and send a read receipt",
+		Long: "Mark a chat's incoming messages read, up to messageID or all of them, and send a read receipt to the\n" +
+			"chat and our other devices. --all marks every chat read.",
+		Args: func(cmd *cobra.Command, args []string) error {
+			if all {
+				return cobra.NoArgs(cmd, args)
+			}
+			return cobra.RangeArgs(1, 2)(cmd, args)
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var chat, messageID string
+			if len(args) > 0 {
+				var err error
+				if chat, err = parseChat(args[0]); err != nil {
+					return err
+				}
+			}
+			if len(args) > 1 {
+				messageID = args[1]
+			}
+			opts := messaging.ReadOptions{NoReceipt: noReceipt}
+			if dc := dialDaemon(); dc != nil {
+				defer dc.Close()
+				marked, err := dc.MarkRead(cmd.Context(), chat, messageID, opts)
+				return reportRead(cmd, marked, err)
+			}
+
+			reg, err := loadRegistration(cmd.Context())
+			if err != nil {
+				return err
+			}
+
+			store, err := openStore()
+			if err != nil {
+				return err
+			}
+			defer closeStore(cmd, store)
+
+			client := newClient(cmd, reg, store)
+			defer client.Close()
+			var marked int
+			if all {
+				marked, err = client.MarkAllRead(cmd.Context(), opts)
+			} else {
+				marked, err = client.MarkRead(cmd.Context(), chat, messageID, opts)
+			}
+			return reportRead(cmd, marked, err)
+		},
+	}
+
+	cmd.Flags().BoolVar(&all, "all", false, "Mark every chat read")
+	cmd.Flags().BoolVar(&noReceipt, "no-receipt", false, "Only update local state, without sending read receipts")
+	return cmd
+}
+
+// reportRead prints how many messages were marked read. An unfinished
+// handshake only means the receipt wasn't sent.
+func reportRead(cmd *cobra.Command, marked int, err error) error {
+	if errors.Is(err, messaging.ErrHandshakeNotImplemented) {
+		fmt.Fprintf(cmd.OutOrStdout(), "Marked %d message(s) read; handshake not implemented yet, so no receipt was sent.\n", marked)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(cmd.OutOrStdout(), "Marked %d message(s) read.\n", marked)
+	return nil
+}
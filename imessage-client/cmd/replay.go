@@ -0,0 +1,92 @@
+package cmd
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"imessage-client/messaging"
+)
+
+func newReplayCmd() *cobra.Command {
+	var keyPath string
+	cmd := &cobra.Command{
+		Use:   "replay <trace-file>",
+		Short: "Run a recorded trace through the parsing and decryption pipeline offline",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var key *rsa.PrivateKey
+			if keyPath != "" {
+				var err error
+				if key, err = loadRSAKey(keyPath); err != nil {
+					return err
+				}
+			}
+
+			file, err := os.Open(args[0])
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+
+			out := cmd.OutOrStdout()
+			failures := 0
+			err = messaging.ReplayTrace(file, key, func(res messaging.ReplayResult) {
+				label := fmt.Sprintf("#%d %s %s", res.Index, res.Entry.Source, res.Entry.Time.Format("15:04:05.000"))
+				if len(res.Entry.Topics) > 0 {
+					label += " " + strings.Join(res.Entry.Topics, ",")
+				}
+				switch {
+				case res.Err != nil:
+					failures++
+					fmt.Fprintf(out, "%s: error: %v\n", label, res.Err)
+				case res.Message != nil:
+					fmt.Fprintf(out, "%s: message %s from %s: %q\n", label, res.Message.ID, res.Message.Sender, res.Message.Text)
+				case res.Madrid != nil:
+					fmt.Fprintf(out, "%s: %s (not decrypted)\n", label, res.Madrid.Command)
+				default:
+					fmt.Fprintf(out, "%s: %s ok\n", label, res.Entry.URL)
+				}
+			})
+			if err != nil {
+				return err
+			}
+			if failures > 0 {
+				return fmt.Errorf("%d entries failed to replay", failures)
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&keyPath, "key", "", "PEM file with the IDS encryption private key")
+	return cmd
+}
+
+func loadRSAKey(path string) (*rsa.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data in key file")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key: %w", err)
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("key is not an RSA private key")
+	}
+	return key, nil
+}
@@ -1,15 +1,80 @@
 package cmd
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/spf13/cobra"
+
+	"imessage-client/config"
+	"imessage-client/daemon"
+	"imessage-client/messaging"
+	"imessage-client/messaging/apns"
+	"imessage-client/messaging/nacserv"
+	"imessage-client/messaging/trace"
+	"imessage-client/messaging/transport"
+	"imessage-client/notifier"
 )
 
 var configPath string
 var storePath string
+var storeBackend string
+var storeCache time.Duration
+var storePassphraseFile string
+var deviceName string
+var deviceProfile string
+var alertWebhook string
+var alertCommand string
+var alertDeadLetters string
+var traceFile string
+var extraTopics []string
+var debugHTTP bool
+var verbose bool
+var logFile string
+var logOutput io.WriteCloser
+var socketPath string
+var daemonAddr string
+var daemonCA string
+var daemonCert string
+var daemonKey string
+var httpMaxIdleConns int
+var httpDialTimeout time.Duration
+var identityChange string
+var identityPolicy messaging.IdentityPolicy
+var deliveryTimeout time.Duration
+var smsFallbackCommand string
+var powerProfileName string
+var keepAliveInterval time.Duration
+var powerProfile config.PowerProfile
+var courierPort string
+var courierPorts apns.PortPolicy
+var outputTemplate string
+var summaryTemplate *notifier.Template
+var quietHoursSpec string
+var quietExcept []string
+var quietHours *config.QuietHours
+var bell bool
+var soundFile string
+var soundPlayer string
+var tracer *trace.Recorder
+var relaysFile string
+var relayPool *nacserv.Pool
+var validationMargin time.Duration
+
+// relayFetchTimeout bounds a fetch from the relays, which waits for the
+// provider's Mac to generate validation data.
+const relayFetchTimeout = time.Minute
 
 func defaultStorePath() string {
 	base, err := os.UserConfigDir()
@@ -19,10 +84,462 @@ func defaultStorePath() string {
 	return filepath.Join(base, "imessage-client", "state.json")
 }
 
+func defaultSocketPath() string {
+	base, err := os.UserConfigDir()
+	if err != nil || base == "" {
+		return ""
+	}
+	return filepath.Join(base, "imessage-client", "daemon.sock")
+}
+
+// defaultDeadLetterPath is where alert webhooks that failed for good are
+// kept for replay-dead-letters.
+func defaultDeadLetterPath() string {
+	base, err := os.UserConfigDir()
+	if err != nil || base == "" {
+		return ""
+	}
+	return filepath.Join(base, "imessage-client", "dead-letters.jsonl")
+}
+
+// dialDaemon connects to the daemon on --socket, or returns nil if none is
+// running so the caller falls back to a standalone session.
+func dialDaemon() *daemon.Client {
+	if daemonAddr != "" {
+		return dialRemoteDaemon()
+	}
+	if socketPath == "" {
+		return nil
+	}
+	client, err := daemon.Dial(socketPath)
+	if err != nil {
+		return nil
+	}
+	return client
+}
+
+// dialRemoteDaemon connects to the daemon at --daemon-addr, a host:port
+// reached over TLS unless it's prefixed with tcp://, with the API token in
+// $IMESSAGE_DAEMON_TOKEN. Unlike a missing local daemon, failing to reach
+// it is worth a warning, since it was asked for by name.
+func dialRemoteDaemon() *daemon.Client {
+	addr := daemonAddr
+	var tlsConfig *tls.Config
+	if plain, ok := strings.CutPrefix(addr, "tcp://"); ok {
+		addr = plain
+	} else {
+		addr = strings.TrimPrefix(addr, "tls://")
+		var err error
+		if tlsConfig, err = daemon.ClientTLSConfig(daemonCA, daemonCert, daemonKey); err != nil {
+			slog.Warn("Failed to set up TLS for the daemon", "err", err)
+			return nil
+		}
+	}
+	client, err := daemon.DialTCP(addr, tlsConfig, os.Getenv("IMESSAGE_DAEMON_TOKEN"))
+	if err != nil {
+		slog.Warn("Failed to reach daemon", "addr", addr, "err", err)
+		return nil
+	}
+	return client
+}
+
+// loadRegistration reads the registration file selected by --registration
+// and applies the --device-profile and --device-name overrides. If the file
+// is missing or expires within --validation-margin, validation data is
+// fetched from the --nacserv-relays instead.
+func loadRegistration(ctx context.Context) (*config.RegistrationData, error) {
+	reg, err := config.LoadRegistration(configPath)
+	if relayPool != nil && (errors.Is(err, config.ErrMissingRegistration) || (err == nil && time.Until(reg.ValidUntil) < validationMargin)) {
+		reg, err = fetchRegistration(ctx, reg)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if reg.IsExpired() {
+		return nil, fmt.Errorf("registration data expired; regenerate with mac-registration-provider")
+	}
+	if deviceProfile != "" {
+		if err = reg.ApplyDeviceProfile(deviceProfile); err != nil {
+			return nil, err
+		}
+	}
+	if deviceName != "" {
+		reg.DeviceInfo.DeviceName = deviceName
+	}
+	return reg, nil
+}
+
+// fetchRegistration returns a copy of reg, or a new registration if it's
+// nil, with validation data from --nacserv-relays. The device info is
+// replaced with the Mac the data was generated on, since IDS rejects it for
+// any other.
+func fetchRegistration(ctx context.Context, reg *config.RegistrationData) (*config.RegistrationData, error) {
+	ctx, cancel := context.WithTimeout(ctx, relayFetchTimeout)
+	defer cancel()
+	resp, err := relayPool.Fetch(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if reg == nil {
+		reg = &config.RegistrationData{Version: config.RegistrationVersion}
+	} else {
+		fresh := *reg
+		reg = &fresh
+	}
+	reg.ValidationData = resp.Data
+	reg.ValidUntil = resp.ValidUntil
+	reg.DeviceInfo.HardwareVersion = resp.Versions.HardwareVersion
+	reg.DeviceInfo.SoftwareName = resp.Versions.SoftwareName
+	reg.DeviceInfo.SoftwareVersion = resp.Versions.SoftwareVersion
+	reg.DeviceInfo.SoftwareBuildID = resp.Versions.SoftwareBuildID
+	reg.DeviceInfo.SerialNumber = resp.Versions.SerialNumber
+	reg.DeviceInfo.UniqueDeviceID = resp.Versions.UniqueDeviceID
+	return reg, nil
+}
+
+// registrationRefresher fetches fresh validation data for sessions from
+// --nacserv-relays, or returns nil if there are none.
+func registrationRefresher() messaging.RegistrationRefresher {
+	if relayPool == nil {
+		return nil
+	}
+	return fetchRegistration
+}
+
+// parseChat canonicalizes a chat given on the command line, so "+1 555
+// 555 0123" and "tel:+15555550123" name the same chat.
+func parseChat(chat string) (string, error) {
+	id, err := messaging.ParseChatID(chat)
+	if err != nil {
+		return "", err
+	}
+	return id.String(), nil
+}
+
+// Store backends for --store-backend.
+const (
+	storeBackendJSON = "json"
+	storeBackendBolt = "bolt"
+)
+
+// openStore opens the state store selected by --store and --store-backend.
+func openStore() (messaging.Store, error) {
+	if storePath == "" {
+		return messaging.NewMemoryStore(), nil
+	}
+	key, err := storeKey()
+	if err != nil {
+		return nil, err
+	}
+	var store messaging.Store
+	switch storeBackend {
+	case storeBackendBolt:
+		store, err = messaging.NewBoltStore(storePath)
+	default:
+		store, err = messaging.NewFileStore(storePath)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize store: %w", err)
+	}
+	if key != nil {
+		if store, err = messaging.NewEncryptedStore(store, key); err != nil {
+			return nil, err
+		}
+	}
+	if storeCache > 0 {
+		store = messaging.NewCachedStore(store, storeCache)
+	}
+	return store, nil
+}
+
+// storeKey derives the store encryption key from the passphrase in
+// --store-passphrase-file or $IMESSAGE_STORE_PASSPHRASE, or returns nil if
+// neither is set.
+func storeKey() ([]byte, error) {
+	passphrase := os.Getenv("IMESSAGE_STORE_PASSPHRASE")
+	if storePassphraseFile != "" {
+		data, err := os.ReadFile(storePassphraseFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read store passphrase: %w", err)
+		}
+		passphrase = strings.TrimRight(string(data), "\r\n")
+	}
+	if passphrase == "" {
+		return nil, nil
+	}
+	key, err := messaging.OpenStoreKey(storePath+".key", passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unlock store: %w", err)
+	}
+	return key, nil
+}
+
+// newClient creates a messaging client that reports session events on stderr.
+func newClient(cmd *cobra.Command, reg *config.RegistrationData, store messaging.Store) *messaging.Client {
+	client := messaging.NewClientWithStore(reg, store)
+	client.SetTracer(tracer)
+	client.SetIdentityPolicy(identityPolicy)
+	client.SetDeliveryTimeout(deliveryTimeout)
+	client.SetSMSFallback(newSMSFallback())
+	client.SetPowerProfile(powerProfile)
+	client.SetCourierPorts(courierPorts)
+	client.SetRegistrationRefresher(registrationRefresher())
+	client.SetValidationMargin(validationMargin)
+	client.OnEvent(newEventPrinter(cmd))
+	return client
+}
+
+// newEventPrinter returns an event handler that reports session events on
+// stderr and forwards alerts to the configured alerter.
+func newEventPrinter(cmd *cobra.Command) messaging.EventHandler {
+	if alertQueue == nil {
+		if alerter := newAlerter(); alerter != nil {
+			alertQueue = notifier.NewQueuedAlerter(alerter, alertQueueSize, alertTimeout, func(_ messaging.AlertEvent, err error) {
+				fmt.Fprintf(cmd.ErrOrStderr(), "Failed to deliver alert: %v\n", err)
+			})
+		}
+	}
+	return func(evt messaging.Event) {
+		switch evt := evt.(type) {
+		case messaging.AlertEvent:
+			fmt.Fprintf(cmd.ErrOrStderr(), "Alert: %s\n", evt)
+			if alertQueue != nil {
+				// The handler runs on the APNS read loop, so don't wait for delivery
+				if err := alertQueue.Alert(context.Background(), evt); err != nil {
+					fmt.Fprintf(cmd.ErrOrStderr(), "Failed to deliver alert: %v\n", err)
+				}
+			}
+		case messaging.CertExpiringEvent:
+			fmt.Fprintf(cmd.ErrOrStderr(), "Warning: ID certificate expires in %s\n", evt.Remaining.Round(time.Minute))
+		case messaging.HandleChangedEvent:
+			for _, handle := range evt.Added {
+				fmt.Fprintf(cmd.ErrOrStderr(), "Handle added: %s\n", handle)
+			}
+			for _, handle := range evt.Removed {
+				fmt.Fprintf(cmd.ErrOrStderr(), "Handle removed: %s\n", handle)
+			}
+			for handle, status := range evt.Inactive {
+				fmt.Fprintf(cmd.ErrOrStderr(), "Handle %s is not registered: %s\n", handle, status)
+			}
+		case messaging.IdentityChangedEvent:
+			for _, device := range evt.Changed {
+				fmt.Fprintf(cmd.ErrOrStderr(), "Warning: identity keys of %s changed on device %s\n", evt.Handle, device)
+			}
+			for _, device := range evt.Added {
+				fmt.Fprintf(cmd.ErrOrStderr(), "Warning: %s has a new device %s\n", evt.Handle, device)
+			}
+			if !evt.Refused {
+				fmt.Fprintf(cmd.ErrOrStderr(), "Trusting the new keys; run \"verify %s\" to compare fingerprints\n", evt.Handle)
+			}
+		case messaging.NetworkChangedEvent:
+			if evt.Err != nil {
+				fmt.Fprintf(cmd.ErrOrStderr(), "Network changed (%s); reconnect failed: %v\n", evt.Reason, evt.Err)
+			} else {
+				fmt.Fprintf(cmd.ErrOrStderr(), "Network changed (%s); reconnected\n", evt.Reason)
+			}
+		case messaging.DeliveryTimeoutEvent:
+			fmt.Fprintf(cmd.ErrOrStderr(), "Warning: no delivery receipt for %s to %s; it was possibly not delivered\n", evt.MessageUUID, evt.Chat)
+			if evt.SMSErr != nil {
+				fmt.Fprintf(cmd.ErrOrStderr(), "SMS fallback for %s failed: %v\n", evt.MessageUUID, evt.SMSErr)
+			} else if evt.SMSFallback {
+				fmt.Fprintf(cmd.ErrOrStderr(), "Sent %s again by SMS\n", evt.MessageUUID)
+			}
+		}
+	}
+}
+
+// alertQueue delivers alerts for the whole run off the session's event
+// handler; it's drained before exiting.
+var alertQueue *notifier.QueuedAlerter
+
+// alertQueueSize is how many alerts may wait for delivery before more are
+// dropped, and alertDrainTimeout how long exiting waits for them. Each
+// webhook attempt gives up after webhookAttemptTimeout, and a whole alert
+// gets long enough for every retry.
+const (
+	alertQueueSize        = 16
+	alertDrainTimeout     = 30 * time.Second
+	webhookAttemptTimeout = 10 * time.Second
+)
+
+var alertTimeout = notifier.DefaultRetryPolicy.Budget(webhookAttemptTimeout)
+
+// drainAlerts waits for queued alerts to be delivered before exiting.
+func drainAlerts(cmd *cobra.Command) {
+	if alertQueue == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), alertDrainTimeout)
+	defer cancel()
+	if err := alertQueue.Shutdown(ctx); err != nil {
+		fmt.Fprintf(cmd.ErrOrStderr(), "Gave up delivering alerts: %v\n", err)
+	}
+	alertQueue = nil
+}
+
+// newAlerter builds the alerter selected by --alert-webhook and --alert-command.
+func newAlerter() notifier.Alerter {
+	var alerters notifier.MultiAlerter
+	if alertWebhook != "" {
+		alerter := notifier.WebhookAlerter{
+			URL:    alertWebhook,
+			Client: &http.Client{Timeout: webhookAttemptTimeout},
+			Retry:  notifier.DefaultRetryPolicy,
+		}
+		if alertDeadLetters != "" {
+			alerter.DeadLetters = &notifier.DeadLetterQueue{Path: alertDeadLetters}
+		}
+		alerters = append(alerters, alerter)
+	}
+	if alertCommand != "" {
+		alerters = append(alerters, notifier.CommandAlerter{Command: alertCommand})
+	}
+	if len(alerters) == 0 {
+		return nil
+	}
+	return alerters
+}
+
+// newChime builds the chime selected by --bell and --sound, or returns nil
+// if neither is set. The bell goes to stderr so it doesn't end up in piped
+// output.
+func newChime(cmd *cobra.Command) *notifier.Chime {
+	if !bell && soundFile == "" {
+		return nil
+	}
+	return &notifier.Chime{Bell: bell, Terminal: cmd.ErrOrStderr(), Sound: soundFile, Player: soundPlayer}
+}
+
+// newSMSFallback runs --sms-fallback-command for messages whose delivery
+// timed out. The phone number and text are passed in the IMESSAGE_SMS_TO and
+// IMESSAGE_SMS_TEXT environment variables.
+func newSMSFallback() messaging.SMSFallback {
+	if smsFallbackCommand == "" {
+		return nil
+	}
+	return func(ctx context.Context, phone, text string) error {
+		cmd := exec.CommandContext(ctx, "sh", "-c", smsFallbackCommand)
+		cmd.Env = append(os.Environ(), "IMESSAGE_SMS_TO="+phone, "IMESSAGE_SMS_TEXT="+text)
+		if output, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("sms fallback command failed: %w (output: %s)", err, bytes.TrimSpace(output))
+		}
+		return nil
+	}
+}
+
+// setupLogging sends diagnostics from every package to --log-file, or
+// stderr, at debug level with --verbose.
+func setupLogging(cmd *cobra.Command) error {
+	if logFile != "" {
+		file, err := os.OpenFile(logFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+		if err != nil {
+			return fmt.Errorf("failed to open log file: %w", err)
+		}
+		logOutput = file
+	}
+	level := slog.LevelInfo
+	if verbose {
+		level = slog.LevelDebug
+	}
+	slog.SetDefault(slog.New(slog.NewTextHandler(logWriter(cmd), &slog.HandlerOptions{Level: level})))
+	return nil
+}
+
+// logWriter returns where diagnostics go.
+func logWriter(cmd *cobra.Command) io.Writer {
+	if logOutput != nil {
+		return logOutput
+	}
+	return cmd.ErrOrStderr()
+}
+
+// closeStore flushes pending store writes, reporting failures on stderr.
+func closeStore(cmd *cobra.Command, store messaging.Store) {
+	closer, ok := store.(io.Closer)
+	if !ok {
+		return
+	}
+	if err := closer.Close(); err != nil {
+		fmt.Fprintf(cmd.ErrOrStderr(), "failed to save store: %v\n", err)
+	}
+}
+
 func NewRootCmd() *cobra.Command {
 	cmd := &cobra.Command{
 		Use:   "imessage-client",
 		Short: "Lightweight iMessage CLI client",
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			if err := setupLogging(cmd); err != nil {
+				return err
+			}
+
+			opts := transport.DefaultOptions
+			opts.MaxIdleConns = httpMaxIdleConns
+			opts.DialTimeout = httpDialTimeout
+			transport.Configure(opts)
+			if debugHTTP {
+				transport.SetDebugOutput(logWriter(cmd))
+			}
+
+			switch storeBackend {
+			case storeBackendJSON:
+			case storeBackendBolt:
+				if !cmd.Flags().Changed("store") && storePath != "" {
+					storePath = strings.TrimSuffix(storePath, filepath.Ext(storePath)) + ".db"
+				}
+			default:
+				return fmt.Errorf("invalid store backend %q (want %s or %s)", storeBackend, storeBackendJSON, storeBackendBolt)
+			}
+
+			var err error
+			if identityPolicy, err = messaging.ParseIdentityPolicy(identityChange); err != nil {
+				return err
+			}
+			if powerProfile, err = config.LookupPowerProfile(powerProfileName); err != nil {
+				return err
+			}
+			if courierPorts, err = apns.ParsePortPolicy(courierPort); err != nil {
+				return err
+			}
+			if quietHours, err = config.ParseQuietHours(quietHoursSpec, quietExcept); err != nil {
+				return err
+			}
+			if outputTemplate != "" {
+				if summaryTemplate, err = notifier.ParseTemplate(outputTemplate); err != nil {
+					return err
+				}
+			}
+			if relaysFile != "" {
+				relays, err := nacserv.LoadRelays(relaysFile)
+				if err != nil {
+					return err
+				}
+				relayPool = nacserv.NewPool(relays)
+			}
+			if keepAliveInterval > 0 {
+				// Leave a minute for the keep-alive's ack to come back
+				powerProfile.KeepAlive = keepAliveInterval
+				powerProfile.ReadTimeout = keepAliveInterval + time.Minute
+			}
+			for _, topic := range extraTopics {
+				apns.RegisterTopics(apns.Topic(topic))
+			}
+			if traceFile == "" {
+				return nil
+			}
+			tracer, err = trace.OpenFile(traceFile)
+			return err
+		},
+		PersistentPostRunE: func(cmd *cobra.Command, args []string) error {
+			drainAlerts(cmd)
+			if err := tracer.Close(); err != nil {
+				return fmt.Errorf("failed to write trace: %w", err)
+			}
+			if logOutput != nil {
+				return logOutput.Close()
+			}
+			return nil
+		},
 		RunE: func(cmd *cobra.Command, args []string) error {
 			// Placeholder interactive mode until real-time session is wired up.
 			fmt.Fprintln(cmd.OutOrStdout(), "Interactive mode is not implemented yet.")
@@ -31,9 +548,61 @@ func NewRootCmd() *cobra.Command {
 	}
 
 	cmd.PersistentFlags().StringVar(&configPath, "registration", "registration-data.json", "Path to registration data JSON")
-	cmd.PersistentFlags().StringVar(&storePath, "store", defaultStorePath(), "Path to state store for unread tracking (\"\" for in-memory)")
+	cmd.PersistentFlags().StringVar(&storePath, "store", defaultStorePath(), "Path to state store for unread tracking (\"\" for in-memory). Holds this device's private keys in plain text unless a store passphrase is set")
+	cmd.PersistentFlags().StringVar(&storeBackend, "store-backend", storeBackendJSON, "State store format: json (rewritten on save) or bolt (single-file transactional database; default path ends in .db)")
+	cmd.PersistentFlags().DurationVar(&storeCache, "store-cache", 0, "Keep message state in memory and write it to the store in batches this often (0 for no cache)")
+	cmd.PersistentFlags().StringVar(&storePassphraseFile, "store-passphrase-file", "", "File holding a passphrase to encrypt contacts, queued messages and device keys in the store with; without one, private keys are stored in plain text (default: $IMESSAGE_STORE_PASSPHRASE)")
+	cmd.PersistentFlags().StringVar(&relaysFile, "nacserv-relays", "", "JSON list of registration relays ([{\"url\": ..., \"token\": ...}]) to fetch validation data from when --registration is missing or expired, tried in order")
+	cmd.PersistentFlags().DurationVar(&validationMargin, "validation-margin", messaging.DefaultValidationMargin, "Fetch fresh validation data from --nacserv-relays, or refuse to register, when the current data expires within this duration")
+	cmd.PersistentFlags().StringVar(&deviceName, "device-name", "", "Device name shown to other devices on the account")
+	cmd.PersistentFlags().StringVar(&deviceProfile, "device-profile", "", "Preset hardware profile to register as ("+strings.Join(config.DeviceProfileNames(), ", ")+")")
+	cmd.PersistentFlags().StringVar(&alertWebhook, "alert-webhook", "", "URL to POST critical failure alerts to")
+	cmd.PersistentFlags().StringVar(&alertCommand, "alert-command", "", "Shell command to run on critical failures")
+	cmd.PersistentFlags().StringVar(&alertDeadLetters, "alert-dead-letters", defaultDeadLetterPath(), "File keeping --alert-webhook alerts that failed after retries, for replay-dead-letters (\"\" to drop them)")
+	cmd.PersistentFlags().IntVar(&httpMaxIdleConns, "http-max-idle-conns", transport.DefaultOptions.MaxIdleConns, "Idle HTTPS connections kept open for reuse (0 for no limit)")
+	cmd.PersistentFlags().DurationVar(&httpDialTimeout, "http-dial-timeout", transport.DefaultOptions.DialTimeout, "Timeout for opening HTTPS connections")
+	cmd.PersistentFlags().StringVar(&socketPath, "socket", defaultSocketPath(), "Unix socket of a running daemon to send commands through (\"\" to always run standalone)")
+	cmd.PersistentFlags().StringVar(&daemonAddr, "daemon-addr", "", "host:port of a daemon started with --listen to send commands through instead of --socket (TLS unless prefixed with tcp://; token in $IMESSAGE_DAEMON_TOKEN)")
+	cmd.PersistentFlags().StringVar(&daemonCA, "daemon-ca", "", "CA certificate to trust for --daemon-addr, besides the system's")
+	cmd.PersistentFlags().StringVar(&daemonCert, "daemon-cert", "", "Client certificate to present to --daemon-addr")
+	cmd.PersistentFlags().StringVar(&daemonKey, "daemon-key", "", "Key of --daemon-cert")
+	cmd.PersistentFlags().StringVar(&identityChange, "identity-change", "warn", "What to do when a recipient's identity keys change: warn (and trust the new keys) or refuse to send")
+	cmd.PersistentFlags().DurationVar(&deliveryTimeout, "delivery-timeout", messaging.DefaultDeliveryTimeout, "Report sent messages as possibly undelivered when no receipt arrives within this duration (0 to wait forever)")
+	cmd.PersistentFlags().StringVar(&smsFallbackCommand, "sms-fallback-command", "", "Shell command that sends $IMESSAGE_SMS_TEXT to $IMESSAGE_SMS_TO by SMS when a message to a phone number times out")
+	cmd.PersistentFlags().StringVar(&powerProfileName, "power-profile", config.DefaultPowerProfile, "APNS keep-alive and reconnect behavior ("+strings.Join(config.PowerProfileNames(), ", ")+")")
+	cmd.PersistentFlags().DurationVar(&keepAliveInterval, "keepalive", 0, "Override the power profile's APNS keep-alive interval")
+	cmd.PersistentFlags().StringVar(&courierPort, "apns-port", apns.PortAuto.String(), fmt.Sprintf("APNS courier port: %d, %d, or auto to fall back to %d when %d is blocked", apns.CourierPort, apns.CourierFallbackPort, apns.CourierFallbackPort, apns.CourierPort))
+	cmd.PersistentFlags().StringVar(&outputTemplate, "output-template", "", "Print each new message with this Go template (\"{{.sender}}: {{.preview}}\") or format string (\"{sender}: {preview}\"); fields: sender, chat, preview, time, service")
+	cmd.PersistentFlags().StringVar(&quietHoursSpec, "quiet-hours", "", "Daily window like 22:00-07:00 during which new messages are recorded but not shown")
+	cmd.PersistentFlags().StringArrayVar(&quietExcept, "quiet-except", nil, "Chat or sender that is shown even during quiet hours (repeatable)")
+	cmd.PersistentFlags().BoolVar(&bell, "bell", false, "Ring the terminal bell when new messages arrive")
+	cmd.PersistentFlags().StringVar(&soundFile, "sound", "", "Sound file to play when new messages arrive")
+	cmd.PersistentFlags().StringVar(&soundPlayer, "sound-player", "", "Command that plays --sound, given the file as its last argument (default: afplay, paplay, pw-play or aplay)")
+	cmd.PersistentFlags().StringVar(&traceFile, "trace-file", "", "Record APNS frames and IDS requests (secrets redacted) to this file")
+	cmd.PersistentFlags().StringArrayVar(&extraTopics, "extra-topic", nil, "APNS topic to show by name rather than hash in logs and traces, besides the iMessage ones (repeatable)")
+	cmd.PersistentFlags().BoolVarP(&verbose, "verbose", "v", false, "Log debug diagnostics too")
+	cmd.PersistentFlags().StringVar(&logFile, "log-file", "", "Append diagnostics to this file instead of stderr")
+	cmd.PersistentFlags().BoolVar(&debugHTTP, "debug-http", false, "Dump IDS and MMCS HTTP requests and responses (signatures, tokens and validation data redacted) to the log")
 	cmd.AddCommand(newCheckMessagesCmd())
 	cmd.AddCommand(newSendMessageCmd())
+	cmd.AddCommand(newDevicesCmd())
+	cmd.AddCommand(newStatusCmd())
+	cmd.AddCommand(newReplayCmd())
+	cmd.AddCommand(newDaemonCmd())
+	cmd.AddCommand(newVerifyCmd())
+	cmd.AddCommand(newIdentityCmd())
+	cmd.AddCommand(newReactCmd())
+	cmd.AddCommand(newTypingCmd())
+	cmd.AddCommand(newReadCmd())
+	cmd.AddCommand(newUnreadCountCmd())
+	cmd.AddCommand(newUpgradeRegistrationCmd())
+	cmd.AddCommand(newBenchHandshakeCmd())
+	cmd.AddCommand(newSnoozeCmd())
+	cmd.AddCommand(newMuteCmd())
+	cmd.AddCommand(newUnmuteCmd())
+	cmd.AddCommand(newServiceCmd())
+	cmd.AddCommand(newStatsCmd())
+	cmd.AddCommand(newReplayDeadLettersCmd())
 
 	return cmd
 }
@@ -1,61 +1,266 @@
 package cmd
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/spf13/cobra"
 
-	"imessage-client/config"
+	"imessage-client/daemon"
 	"imessage-client/messaging"
+	"imessage-client/messaging/media"
 )
 
 func newSendMessageCmd() *cobra.Command {
 	var chat string
+	var messageUUID string
+	var wait time.Duration
+	var noSplit bool
+	var markdown bool
+	var files []string
+	var stdinFile string
+	var transcode media.TranscodeOptions
 	cmd := &cobra.Command{
-		Use:   "send",
+		Use:   "send [text|-]",
 		Short: "Send a message to a chat/recipient",
-		Args:  cobra.MinimumNArgs(1),
+		Long: "Send a message to a chat/recipient. A text of \"-\" is read from stdin, so multi-line texts and program\n" +
+			"output can be piped in; --stdin-file instead attaches stdin as a file with the given name.\n" +
+			"--markdown formats **bold**, *italic*, __underline__ and [links](https://example.com); recipients that\n" +
+			"can't show formatting get the text without the markers. --max-dimension downscales attached images and\n" +
+			"--convert-heic turns HEIC photos into JPEGs, for recipients on other platforms.",
+		Args: cobra.MaximumNArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
-			text := args[0]
+			var text string
+			if len(args) > 0 {
+				text = args[0]
+			}
+			if text == "-" {
+				if stdinFile != "" {
+					return fmt.Errorf("stdin can't be both the text and --stdin-file")
+				}
+				data, err := io.ReadAll(cmd.InOrStdin())
+				if err != nil {
+					return fmt.Errorf("failed to read text from stdin: %w", err)
+				}
+				// Drop the trailing newline that echo and most programs end their output with
+				text = strings.TrimSuffix(strings.TrimSuffix(string(data), "\n"), "\r")
+			}
 
-			reg, err := config.LoadRegistration(configPath)
+			if chat == "" {
+				return fmt.Errorf("recipient/chat is required (use --chat)")
+			}
+			target, err := parseChat(chat)
 			if err != nil {
 				return err
 			}
-			if reg.IsExpired() {
-				return fmt.Errorf("registration data expired; regenerate with mac-registration-provider")
+			if text == "" && len(files) == 0 && stdinFile == "" {
+				return fmt.Errorf("nothing to send (give a text or --file)")
 			}
-
-			var store messaging.Store
-			if storePath != "" {
-				store, err = messaging.NewFileStore(storePath)
+			if transcode.ConvertHEIC && !media.CanConvertHEIF {
+				return fmt.Errorf("--convert-heic needs a build with the libheif tag")
+			}
+			opts := messaging.SendOptions{MessageUUID: messageUUID, NoSplit: noSplit, Markdown: markdown}
+			for _, path := range files {
+				att, err := loadAttachment(path, transcode)
+				if err != nil {
+					return err
+				}
+				opts.Attachments = append(opts.Attachments, att)
+			}
+			if stdinFile != "" {
+				data, err := io.ReadAll(cmd.InOrStdin())
+				if err != nil {
+					return fmt.Errorf("failed to read attachment from stdin: %w", err)
+				}
+				att, err := newAttachment(stdinFile, data, transcode)
 				if err != nil {
-					return fmt.Errorf("failed to initialize store: %w", err)
+					return err
 				}
-			} else {
-				store = messaging.NewMemoryStore()
+				opts.Attachments = append(opts.Attachments, att)
+			}
+			if dc := dialDaemon(); dc != nil {
+				defer dc.Close()
+				return sendViaDaemon(cmd, dc, target, text, opts, wait)
 			}
 
-			client := messaging.NewClientWithStore(reg, store)
-			if chat == "" {
-				return fmt.Errorf("recipient/chat is required (use --chat)")
+			reg, err := loadRegistration(cmd.Context())
+			if err != nil {
+				return err
 			}
-			if err := client.Send(cmd.Context(), chat, text); err != nil {
-				if errors.Is(err, messaging.ErrHandshakeNotImplemented) {
-					fmt.Fprintln(cmd.OutOrStdout(), "Handshake not implemented yet.")
-					return nil
-				} else if errors.Is(err, messaging.ErrNotImplemented) {
-					fmt.Fprintln(cmd.OutOrStdout(), "Send not implemented yet.")
-					return nil
-				}
+
+			store, err := openStore()
+			if err != nil {
 				return err
 			}
-			fmt.Fprintln(cmd.OutOrStdout(), "Sent (stub).")
+			defer closeStore(cmd, store)
+
+			client := newClient(cmd, reg, store)
+			defer client.Close()
+			result, err := client.SendWithOptions(cmd.Context(), target, text, opts)
+			if err != nil {
+				var id string
+				if result != nil {
+					id = result.MessageUUID
+				}
+				return reportSendError(cmd, id, err)
+			}
+			var parts []string
+			for _, part := range result.Parts {
+				parts = append(parts, part.MessageUUID)
+			}
+			reportSent(cmd, result.MessageUUID, result.Duplicate, result.Queued, result.Service, parts)
+			if wait <= 0 || result.Service == messaging.ServiceSMS {
+				return nil
+			}
+			ctx, cancel := context.WithTimeout(cmd.Context(), wait)
+			defer cancel()
+			delivery, err := result.Wait(ctx)
+			if err != nil {
+				fmt.Fprintln(cmd.OutOrStdout(), "No delivery receipt yet.")
+				return nil
+			}
+			switch delivery.State {
+			case messaging.DeliveryFailed:
+				return delivery.Err
+			case messaging.DeliveryUnconfirmed:
+				reportUnconfirmed(cmd, delivery.SMSFallback)
+			default:
+				fmt.Fprintf(cmd.OutOrStdout(), "Delivered at %s.\n", delivery.At.Format(time.RFC3339))
+			}
 			return nil
 		},
 	}
 
 	cmd.Flags().StringVar(&chat, "chat", "", "Chat/recipient identifier")
+	cmd.Flags().StringVar(&messageUUID, "uuid", "", "Message UUID; resending with the same UUID won't send a duplicate")
+	cmd.Flags().DurationVar(&wait, "wait", 0, "Wait this long for a delivery receipt")
+	cmd.Flags().BoolVar(&noSplit, "no-split", false, "Fail instead of splitting a text too long for one message")
+	cmd.Flags().BoolVar(&markdown, "markdown", false, "Format the text with a markdown subset (bold, italic, underline, links)")
+	cmd.Flags().StringArrayVar(&files, "file", nil, "Attach a file, with the text as its caption (repeatable)")
+	cmd.Flags().StringVar(&stdinFile, "stdin-file", "", "Attach stdin as a file with this name")
+	cmd.Flags().IntVar(&transcode.MaxDimension, "max-dimension", 0, "Downscale attached images to at most this many pixels wide and high, as JPEG (transparent PNGs stay PNG; GIFs are not touched)")
+	cmd.Flags().BoolVar(&transcode.ConvertHEIC, "convert-heic", false, "Convert attached HEIC/HEIF images to JPEG")
+	cmd.Flags().IntVar(&transcode.JPEGQuality, "jpeg-quality", media.DefaultJPEGQuality, "Quality (1-100) of converted or downscaled images")
 	return cmd
 }
+
+// loadAttachment reads a file to attach and detects its type and size.
+func loadAttachment(path string, transcode media.TranscodeOptions) (messaging.Attachment, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return messaging.Attachment{}, fmt.Errorf("failed to read attachment: %w", err)
+	}
+	return newAttachment(filepath.Base(path), data, transcode)
+}
+
+// newAttachment wraps data as an attachment called name, converting or
+// downscaling images as transcode asks. A converted image is renamed to
+// match its new type.
+func newAttachment(name string, data []byte, transcode media.TranscodeOptions) (messaging.Attachment, error) {
+	if transcode.Enabled() {
+		mimeType := media.Detect(name, data).MimeType
+		converted, newType, err := media.Transcode(data, mimeType, transcode)
+		if err != nil {
+			return messaging.Attachment{}, fmt.Errorf("failed to convert %s: %w", name, err)
+		}
+		if newType != mimeType {
+			name = strings.TrimSuffix(name, filepath.Ext(name)) + ".jpg"
+		}
+		data = converted
+	}
+	info := media.Detect(name, data)
+	return messaging.Attachment{
+		FileName:   name,
+		MimeType:   info.MimeType,
+		UTIType:    info.UTIType,
+		FileSize:   len(data),
+		Width:      info.Width,
+		Height:     info.Height,
+		InlineData: data,
+	}, nil
+}
+
+// sendViaDaemon sends through a running daemon's session. The daemon does the
+// waiting for a delivery receipt.
+func sendViaDaemon(cmd *cobra.Command, dc *daemon.Client, chat, text string, opts messaging.SendOptions, wait time.Duration) error {
+	ctx := cmd.Context()
+	if wait > 0 {
+		// Leave the daemon time to answer after its own wait runs out
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, wait+daemon.DialTimeout)
+		defer cancel()
+	}
+	resp, err := dc.Send(ctx, chat, text, opts, wait)
+	if err != nil {
+		var id string
+		if resp != nil {
+			id = resp.MessageUUID
+		}
+		return reportSendError(cmd, id, err)
+	}
+	reportSent(cmd, resp.MessageUUID, resp.Duplicate, resp.Queued, resp.Service, resp.Parts)
+	if wait <= 0 || resp.Service == messaging.ServiceSMS {
+		return nil
+	}
+	switch {
+	case resp.Delivery == nil:
+		fmt.Fprintln(cmd.OutOrStdout(), "No delivery receipt yet.")
+	case resp.Delivery.State == messaging.DeliveryFailed.String():
+		return errors.New(resp.Delivery.Error)
+	case resp.Delivery.State == messaging.DeliveryUnconfirmed.String():
+		reportUnconfirmed(cmd, resp.Delivery.SMSFallback)
+	default:
+		fmt.Fprintf(cmd.OutOrStdout(), "Delivered at %s.\n", resp.Delivery.At.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// reportSent prints the UUID of a sent message, numbering the parts of a
+// text that was split.
+func reportSent(cmd *cobra.Command, id string, duplicate, queued bool, service string, parts []string) {
+	verb := "Sent"
+	switch {
+	case duplicate:
+		verb = "Already sent"
+	case queued:
+		verb = "Offline; queued"
+	case service == messaging.ServiceSMS:
+		verb = "Sent by SMS"
+	}
+	if len(parts) == 0 {
+		fmt.Fprintf(cmd.OutOrStdout(), "%s %s.\n", verb, id)
+		return
+	}
+	fmt.Fprintf(cmd.OutOrStdout(), "%s %s in %d parts:\n", verb, id, len(parts))
+	for i, part := range parts {
+		fmt.Fprintf(cmd.OutOrStdout(), "  (%d/%d) %s\n", i+1, len(parts), part)
+	}
+}
+
+// reportUnconfirmed notes a message whose delivery receipt never came.
+func reportUnconfirmed(cmd *cobra.Command, smsFallback bool) {
+	if smsFallback {
+		fmt.Fprintln(cmd.OutOrStdout(), "No delivery receipt; sent again by SMS.")
+		return
+	}
+	fmt.Fprintln(cmd.OutOrStdout(), "No delivery receipt; possibly not delivered.")
+}
+
+// reportSendError turns an unfinished handshake into a note, and tags
+// everything else with the message UUID to retry with.
+func reportSendError(cmd *cobra.Command, id string, err error) error {
+	if errors.Is(err, messaging.ErrHandshakeNotImplemented) {
+		fmt.Fprintln(cmd.OutOrStdout(), "Handshake not implemented yet.")
+		return nil
+	}
+	if id != "" {
+		return fmt.Errorf("send %s: %w", id, err)
+	}
+	return err
+}
@@ -0,0 +1,67 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+
+	"imessage-client/messaging"
+)
+
+func newServiceCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "service <chat> [imessage|sms|auto]",
+		Short: "Show or set whether a chat is sent by iMessage or SMS",
+		Long: "Show or set the service messages to a chat are sent with. auto (the default) sends by iMessage\n" +
+			"and, when the recipient isn't on iMessage, by SMS through --sms-fallback-command instead. imessage\n" +
+			"never falls back; sms always sends through the command.",
+		Args: cobra.RangeArgs(1, 2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			chat, err := parseChat(args[0])
+			if err != nil {
+				return err
+			}
+			out := cmd.OutOrStdout()
+			if len(args) == 1 {
+				store, err := openStore()
+				if err != nil {
+					return err
+				}
+				defer closeStore(cmd, store)
+				fmt.Fprintf(out, "%s: %s\n", chat, serviceName(messaging.ChatService(store, chat)))
+				return nil
+			}
+			service, err := messaging.ParseService(args[1])
+			if err != nil {
+				return err
+			}
+
+			if dc := dialDaemon(); dc != nil {
+				defer dc.Close()
+				if err := dc.SetService(cmd.Context(), chat, service); err != nil {
+					return err
+				}
+			} else {
+				store, err := openStore()
+				if err != nil {
+					return err
+				}
+				defer closeStore(cmd, store)
+				if err := messaging.SetChatService(store, chat, service); err != nil {
+					return err
+				}
+			}
+			fmt.Fprintf(out, "Sending to %s by %s\n", chat, serviceName(service))
+			return nil
+		},
+	}
+	return cmd
+}
+
+// serviceName describes a chat's service, where "" means automatic.
+func serviceName(service string) string {
+	if service == "" {
+		return "iMessage, or SMS if they're not on iMessage"
+	}
+	return service
+}
@@ -0,0 +1,53 @@
+package cmd
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"imessage-client/messaging"
+)
+
+func newSnoozeCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "snooze <chat> <duration>",
+		Short: "Hide a chat until later, then show it in check-messages again",
+		Long: "Hide a chat from check-messages and unread-count for a while, such as 2h. Once it's over the\n" +
+			"next check-messages lists how many unread messages are waiting in it. If everything in the chat\n" +
+			"was read, its newest message is marked unread so it comes back too.",
+		Args: cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			chat, err := parseChat(args[0])
+			if err != nil {
+				return err
+			}
+			duration, err := time.ParseDuration(args[1])
+			if err != nil {
+				return fmt.Errorf("invalid duration: %w", err)
+			} else if duration <= 0 {
+				return fmt.Errorf("duration must be positive")
+			}
+
+			until := time.Now().Add(duration)
+			if dc := dialDaemon(); dc != nil {
+				defer dc.Close()
+				if _, err := dc.Snooze(cmd.Context(), chat, duration); err != nil {
+					return err
+				}
+			} else {
+				store, err := openStore()
+				if err != nil {
+					return err
+				}
+				defer closeStore(cmd, store)
+				if _, err := messaging.Snooze(store, chat, until); err != nil {
+					return err
+				}
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "Snoozed %s until %s\n", chat, until.Local().Format(time.RFC1123))
+			return nil
+		},
+	}
+	return cmd
+}
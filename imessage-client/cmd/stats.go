@@ -0,0 +1,107 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"imessage-client/messaging"
+)
+
+func newStatsCmd() *cobra.Command {
+	var format string
+	var since time.Duration
+	var top int
+	cmd := &cobra.Command{
+		Use:   "stats",
+		Short: "Summarize the messages recorded in the store",
+		Long: "Summarize the messages recorded in --store, without connecting: messages per chat, the busiest\n" +
+			"hours of the day, the top senders and how many attachments were sent and received. --format json\n" +
+			"prints every chat, sender and hour for dashboards. Message text isn't stored, so it isn't counted.",
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			store, err := openStore()
+			if err != nil {
+				return err
+			}
+			defer closeStore(cmd, store)
+
+			var from time.Time
+			if since > 0 {
+				from = time.Now().Add(-since)
+			}
+			stats := messaging.ComputeStats(store, from, time.Local)
+			switch format {
+			case "text":
+				printStats(cmd.OutOrStdout(), stats, top)
+				return nil
+			case "json":
+				enc := json.NewEncoder(cmd.OutOrStdout())
+				enc.SetIndent("", "  ")
+				return enc.Encode(stats)
+			default:
+				return fmt.Errorf("unknown format %q (want text or json)", format)
+			}
+		},
+	}
+
+	cmd.Flags().StringVar(&format, "format", "text", "Output format (text or json)")
+	cmd.Flags().DurationVar(&since, "since", 0, "Only count messages from this long ago, such as 720h (0 for all)")
+	cmd.Flags().IntVar(&top, "top", 5, "How many chats, senders and hours the text output lists")
+	return cmd
+}
+
+func printStats(w io.Writer, stats *messaging.Stats, top int) {
+	fmt.Fprintf(w, "Messages: %d sent, %d received in %d chat(s)\n", stats.Sent, stats.Received, len(stats.Chats))
+	fmt.Fprintf(w, "Attachments: %d (%s)\n", stats.Attachments, formatBytes(stats.AttachmentBytes))
+	if len(stats.Chats) == 0 {
+		return
+	}
+
+	fmt.Fprintln(w, "\nBusiest chats:")
+	for i, chat := range stats.Chats {
+		if i == top {
+			break
+		}
+		fmt.Fprintf(w, "  %s: %d sent, %d received", chat.Chat, chat.Sent, chat.Received)
+		if chat.Attachments > 0 {
+			fmt.Fprintf(w, ", %d attachment(s) (%s)", chat.Attachments, formatBytes(chat.AttachmentBytes))
+		}
+		fmt.Fprintln(w)
+	}
+
+	if len(stats.Senders) > 0 {
+		fmt.Fprintln(w, "\nTop senders:")
+		for i, sender := range stats.Senders {
+			if i == top {
+				break
+			}
+			fmt.Fprintf(w, "  %s: %d\n", sender.Sender, sender.Messages)
+		}
+	}
+
+	fmt.Fprintln(w, "\nBusiest hours:")
+	for i, hour := range stats.BusiestHours() {
+		if i == top {
+			break
+		}
+		fmt.Fprintf(w, "  %02d:00-%02d:59: %d\n", hour, hour, stats.Hours[hour])
+	}
+}
+
+// formatBytes renders a size like 1.5 MB.
+func formatBytes(n int64) string {
+	const unit = 1000
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "kMGTPE"[exp])
+}
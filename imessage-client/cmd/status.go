@@ -0,0 +1,87 @@
+package cmd
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"imessage-client/config"
+	"imessage-client/messaging"
+)
+
+func newStatusCmd() *cobra.Command {
+	var warnWithin time.Duration
+	cmd := &cobra.Command{
+		Use:   "status",
+		Short: "Show registration and certificate status",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			out := cmd.OutOrStdout()
+
+			reg, err := config.LoadRegistration(configPath)
+			if err != nil {
+				return err
+			}
+			if reg.IsExpired() {
+				fmt.Fprintf(out, "Registration data: expired at %s\n", reg.ValidUntil.Local().Format(time.RFC1123))
+			} else {
+				fmt.Fprintf(out, "Registration data: valid until %s\n", reg.ValidUntil.Local().Format(time.RFC1123))
+			}
+			name := reg.DeviceInfo.DeviceName
+			if name == "" {
+				name = "(default name)"
+			}
+			fmt.Fprintf(out, "Device: %s (%s, %s %s %s)\n", name, reg.DeviceInfo.HardwareVersion,
+				reg.DeviceInfo.SoftwareName, reg.DeviceInfo.SoftwareVersion, reg.DeviceInfo.SoftwareBuildID)
+
+			if relayPool != nil {
+				relayPool.CheckHealth(cmd.Context())
+				for _, relay := range relayPool.Status() {
+					if relay.Err != nil {
+						fmt.Fprintf(out, "Relay %s: down (%v)\n", relay.URL, relay.Err)
+					} else {
+						fmt.Fprintf(out, "Relay %s: ok\n", relay.URL)
+					}
+				}
+			}
+
+			if dc := dialDaemon(); dc != nil {
+				metrics, err := dc.Metrics(cmd.Context())
+				dc.Close()
+				if err != nil {
+					fmt.Fprintf(out, "Daemon: running (metrics unavailable: %v)\n", err)
+				} else {
+					fmt.Fprintln(out, "Daemon: running")
+					for _, m := range metrics {
+						fmt.Fprintf(out, "API token %s: %d request(s), %d sent, %d rate limited\n", m.Name, m.Requests, m.Sent, m.RateLimited)
+					}
+				}
+			}
+
+			store, err := openStore()
+			if err != nil {
+				return err
+			}
+			defer closeStore(cmd, store)
+
+			expiry := store.IDCertExpiry()
+			if expiry.IsZero() {
+				fmt.Fprintln(out, "ID certificate: unknown (not registered yet)")
+				return nil
+			}
+			remaining := time.Until(expiry)
+			switch {
+			case remaining <= 0:
+				fmt.Fprintf(out, "ID certificate: expired at %s\n", expiry.Local().Format(time.RFC1123))
+			case remaining < warnWithin:
+				fmt.Fprintf(out, "ID certificate: expires at %s (warning: only %s left)\n", expiry.Local().Format(time.RFC1123), remaining.Round(time.Minute))
+			default:
+				fmt.Fprintf(out, "ID certificate: valid until %s\n", expiry.Local().Format(time.RFC1123))
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().DurationVar(&warnWithin, "warn-within", messaging.DefaultCertWarningThreshold, "Warn when the ID certificate expires within this duration")
+	return cmd
+}
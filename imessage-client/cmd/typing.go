@@ -0,0 +1,73 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"imessage-client/messaging"
+)
+
+func newTypingCmd() *cobra.Command {
+	var duration time.Duration
+	var stop bool
+	cmd := &cobra.Command{
+		Use:   "typing <chat>",
+		Short: "Show a typing indicator in a chat",
+		Long: "Show a typing indicator in a chat, e.g. while a bot prepares its reply. It is taken down after --duration,\n" +
+			"or as soon as a message is sent to the chat. Through a running daemon the command returns right away;\n" +
+			"standalone it stays connected for the duration.",
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			chat, err := parseChat(args[0])
+			if err != nil {
+				return err
+			}
+			if dc := dialDaemon(); dc != nil {
+				defer dc.Close()
+				return reportTypingError(cmd, dc.Typing(cmd.Context(), chat, duration, stop))
+			}
+
+			reg, err := loadRegistration(cmd.Context())
+			if err != nil {
+				return err
+			}
+
+			store, err := openStore()
+			if err != nil {
+				return err
+			}
+			defer closeStore(cmd, store)
+
+			client := newClient(cmd, reg, store)
+			defer client.Close()
+			if stop {
+				return reportTypingError(cmd, client.StopTyping(cmd.Context(), chat))
+			}
+			if err := client.StartTyping(cmd.Context(), chat, duration); err != nil {
+				return reportTypingError(cmd, err)
+			}
+			select {
+			case <-time.After(duration):
+			case <-cmd.Context().Done():
+				return nil
+			}
+			return reportTypingError(cmd, client.StopTyping(cmd.Context(), chat))
+		},
+	}
+
+	cmd.Flags().DurationVar(&duration, "duration", messaging.DefaultTypingDuration, "How long to show the indicator")
+	cmd.Flags().BoolVar(&stop, "stop", false, "Take the indicator down now")
+	return cmd
+}
+
+// reportTypingError turns an unfinished handshake into a note.
+func reportTypingError(cmd *cobra.Command, err error) error {
+	if errors.Is(err, messaging.ErrHandshakeNotImplemented) {
+		fmt.Fprintln(cmd.OutOrStdout(), "Handshake not implemented yet.")
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,35 @@
+package cmd
+
+import (
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"imessage-client/messaging"
+	"imessage-client/notifier"
+)
+
+func newUnreadCountCmd() *cobra.Command {
+	var format string
+	var tooltipChats int
+	cmd := &cobra.Command{
+		Use:   "unread-count",
+		Short: "Print the number of unread messages for a status bar",
+		Long: "Print the number of unread messages recorded in --store, without connecting.\n" +
+			"--format waybar prints JSON for a waybar custom module (\"return-type\": \"json\") with a tooltip of\n" +
+			"the most recent chats; --format i3blocks prints the full_text and short_text lines of a block.",
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			store, err := openStore()
+			if err != nil {
+				return err
+			}
+			defer closeStore(cmd, store)
+			return notifier.PrintUnreadCount(cmd.OutOrStdout(), messaging.Unread(store), format, tooltipChats)
+		},
+	}
+
+	cmd.Flags().StringVar(&format, "format", "text", "Output format ("+strings.Join(notifier.StatusBarFormats, ", ")+")")
+	cmd.Flags().IntVar(&tooltipChats, "tooltip-chats", notifier.DefaultTooltipChats, "How many chats the waybar tooltip lists")
+	return cmd
+}
@@ -0,0 +1,31 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+
+	"imessage-client/config"
+)
+
+func newUpgradeRegistrationCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "upgrade-registration",
+		Short: "Rewrite --registration in the current format",
+		Long: "Rewrite the registration data file in the current format version, keeping the original as .bak.\n" +
+			"Older files are read without upgrading them, so this is only needed to share a file with newer tools.",
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			from, err := config.UpgradeRegistrationFile(configPath)
+			if err != nil {
+				return err
+			}
+			if from == config.RegistrationVersion {
+				fmt.Fprintf(cmd.OutOrStdout(), "Registration data is already version %d\n", from)
+				return nil
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "Upgraded registration data from version %d to %d (original kept in %s.bak)\n", from, config.RegistrationVersion, configPath)
+			return nil
+		},
+	}
+}
@@ -0,0 +1,77 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"imessage-client/messaging"
+)
+
+func newVerifyCmd() *cobra.Command {
+	var trust bool
+	cmd := &cobra.Command{
+		Use:   "verify <handle>",
+		Short: "Show a handle's identity fingerprint and compare it with the pinned keys",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			handle := args[0]
+			reg, err := loadRegistration(cmd.Context())
+			if err != nil {
+				return err
+			}
+
+			store, err := openStore()
+			if err != nil {
+				return err
+			}
+			defer closeStore(cmd, store)
+
+			client := newClient(cmd, reg, store)
+			defer client.Close()
+			verification, err := client.VerifyIdentity(cmd.Context(), handle)
+			if errors.Is(err, messaging.ErrHandshakeNotImplemented) {
+				fmt.Fprintln(cmd.OutOrStdout(), "Handshake not implemented yet.")
+				return nil
+			} else if errors.Is(err, messaging.ErrInvalidRegistrationData) {
+				return fmt.Errorf("registration data missing required fields")
+			} else if err != nil {
+				return err
+			}
+
+			out := cmd.OutOrStdout()
+			fmt.Fprintf(out, "Fingerprint for %s:\n  %s\n\n", verification.Handle, verification.Fingerprint)
+			w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(w, "PUSH TOKEN\tSTATUS\tFIRST SEEN")
+			for _, device := range verification.Devices {
+				firstSeen := "-"
+				if !device.FirstSeen.IsZero() {
+					firstSeen = device.FirstSeen.Local().Format(time.RFC1123)
+				}
+				fmt.Fprintf(w, "%s\t%s\t%s\n", device.PushTokenFingerprint, device.Status, firstSeen)
+			}
+			if err := w.Flush(); err != nil {
+				return err
+			}
+
+			if !verification.Changed() {
+				return nil
+			}
+			if !trust {
+				fmt.Fprintf(out, "\nKeys differ from the pinned ones. Compare the fingerprint with %s, then run \"verify --trust %s\".\n", handle, handle)
+				return nil
+			}
+			if err := client.TrustIdentity(cmd.Context(), handle); err != nil {
+				return err
+			}
+			fmt.Fprintf(out, "\nPinned the current keys of %s.\n", handle)
+			return nil
+		},
+	}
+
+	cmd.Flags().BoolVar(&trust, "trust", false, "Pin the handle's current keys after comparing the fingerprint")
+	return cmd
+}
@@ -0,0 +1,70 @@
+package config
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// PowerProfile trades how quickly a dead courier connection is noticed and
+// replaced against how often the radio has to wake up.
+type PowerProfile struct {
+	Name string
+	// KeepAlive is how often a keep-alive is sent to the courier.
+	KeepAlive time.Duration
+	// ReadTimeout is how long the connection may stay silent before it's
+	// considered dead.
+	ReadTimeout time.Duration
+	// ReconnectMin and ReconnectMax bound the backoff between attempts to
+	// reach the courier while it's unreachable.
+	ReconnectMin time.Duration
+	ReconnectMax time.Duration
+}
+
+// DefaultPowerProfile is used unless --power-profile says otherwise.
+const DefaultPowerProfile = "balanced"
+
+// PowerProfiles are the presets selectable with --power-profile.
+var PowerProfiles = map[string]PowerProfile{
+	"aggressive": {
+		Name:         "aggressive",
+		KeepAlive:    time.Minute,
+		ReadTimeout:  2 * time.Minute,
+		ReconnectMin: time.Second,
+		ReconnectMax: 30 * time.Second,
+	},
+	"balanced": {
+		Name:         "balanced",
+		KeepAlive:    5 * time.Minute,
+		ReadTimeout:  6 * time.Minute,
+		ReconnectMin: 5 * time.Second,
+		ReconnectMax: 5 * time.Minute,
+	},
+	"low-power": {
+		Name:         "low-power",
+		KeepAlive:    28 * time.Minute,
+		ReadTimeout:  30 * time.Minute,
+		ReconnectMin: 30 * time.Second,
+		ReconnectMax: 30 * time.Minute,
+	},
+}
+
+// PowerProfileNames returns the preset power profile names in sorted order.
+func PowerProfileNames() []string {
+	names := make([]string, 0, len(PowerProfiles))
+	for name := range PowerProfiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// LookupPowerProfile returns the named power profile.
+func LookupPowerProfile(name string) (PowerProfile, error) {
+	profile, ok := PowerProfiles[strings.ToLower(name)]
+	if !ok {
+		return PowerProfile{}, fmt.Errorf("unknown power profile %q (available: %s)", name, strings.Join(PowerProfileNames(), ", "))
+	}
+	return profile, nil
+}
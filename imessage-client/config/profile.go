@@ -0,0 +1,70 @@
+package config
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// DeviceProfile is a known-good combination of hardware and software
+// versions to present during registration.
+type DeviceProfile struct {
+	Name            string
+	HardwareVersion string
+	SoftwareName    string
+	SoftwareVersion string
+	SoftwareBuildID string
+}
+
+// DeviceProfiles are the preset profiles selectable with --device-profile.
+var DeviceProfiles = map[string]DeviceProfile{
+	"macbook": {
+		Name:            "MacBook Pro",
+		HardwareVersion: "MacBookPro18,1",
+		SoftwareName:    "macOS",
+		SoftwareVersion: "13.4.1",
+		SoftwareBuildID: "22F82",
+	},
+	"mac-mini": {
+		Name:            "Mac mini",
+		HardwareVersion: "Macmini9,1",
+		SoftwareName:    "macOS",
+		SoftwareVersion: "13.4.1",
+		SoftwareBuildID: "22F82",
+	},
+	"imac": {
+		Name:            "iMac",
+		HardwareVersion: "iMac21,1",
+		SoftwareName:    "macOS",
+		SoftwareVersion: "13.4.1",
+		SoftwareBuildID: "22F82",
+	},
+}
+
+// DeviceProfileNames returns the preset profile keys in sorted order.
+func DeviceProfileNames() []string {
+	names := make([]string, 0, len(DeviceProfiles))
+	for name := range DeviceProfiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ApplyDeviceProfile overwrites the hardware and software fields of the
+// device info with the named preset. The device name is only set if the
+// registration doesn't already have one.
+func (r *RegistrationData) ApplyDeviceProfile(name string) error {
+	profile, ok := DeviceProfiles[strings.ToLower(name)]
+	if !ok {
+		return fmt.Errorf("unknown device profile %q (available: %s)", name, strings.Join(DeviceProfileNames(), ", "))
+	}
+	r.DeviceInfo.HardwareVersion = profile.HardwareVersion
+	r.DeviceInfo.SoftwareName = profile.SoftwareName
+	r.DeviceInfo.SoftwareVersion = profile.SoftwareVersion
+	r.DeviceInfo.SoftwareBuildID = profile.SoftwareBuildID
+	if r.DeviceInfo.DeviceName == "" {
+		r.DeviceInfo.DeviceName = profile.Name
+	}
+	return nil
+}
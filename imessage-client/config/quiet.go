@@ -0,0 +1,86 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// QuietHours is a daily do-not-disturb window during which notifications
+// are muted, except for messages from priority contacts.
+type QuietHours struct {
+	// Start and End are offsets from local midnight. A window with End
+	// before Start runs past midnight.
+	Start time.Duration
+	End   time.Duration
+	// Except lists the chats or senders that are never muted.
+	Except []string
+}
+
+// ParseQuietHours parses a window like "22:00-07:00". An empty spec is no
+// window at all.
+func ParseQuietHours(spec string, except []string) (*QuietHours, error) {
+	if spec == "" {
+		return nil, nil
+	}
+	from, to, ok := strings.Cut(spec, "-")
+	if !ok {
+		return nil, fmt.Errorf("invalid quiet hours %q (want HH:MM-HH:MM)", spec)
+	}
+	start, err := parseClock(from)
+	if err != nil {
+		return nil, fmt.Errorf("invalid quiet hours %q: %w", spec, err)
+	}
+	end, err := parseClock(to)
+	if err != nil {
+		return nil, fmt.Errorf("invalid quiet hours %q: %w", spec, err)
+	}
+	if start == end {
+		return nil, fmt.Errorf("invalid quiet hours %q: window is empty", spec)
+	}
+	return &QuietHours{Start: start, End: end, Except: except}, nil
+}
+
+func parseClock(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("bad time %q", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// Active reports whether t falls in the window, in t's location.
+func (q *QuietHours) Active(t time.Time) bool {
+	if q == nil {
+		return false
+	}
+	now := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	if q.Start < q.End {
+		return now >= q.Start && now < q.End
+	}
+	return now >= q.Start || now < q.End
+}
+
+// Mutes reports whether a message in chat from sender should be kept quiet
+// at t.
+func (q *QuietHours) Mutes(chat, sender string, t time.Time) bool {
+	if !q.Active(t) {
+		return false
+	}
+	for _, except := range q.Except {
+		if sameHandle(except, chat) || sameHandle(except, sender) {
+			return false
+		}
+	}
+	return true
+}
+
+// sameHandle compares handles ignoring case and the tel:/mailto: prefix.
+func sameHandle(a, b string) bool {
+	trim := func(s string) string {
+		s = strings.ToLower(strings.TrimSpace(s))
+		s = strings.TrimPrefix(s, "tel:")
+		return strings.TrimPrefix(s, "mailto:")
+	}
+	return a != "" && b != "" && trim(a) == trim(b)
+}
@@ -0,0 +1,56 @@
+package config
+
+import (
+	"testing"
+	"time"
+)
+
+func TestQuietHours(t *testing.T) {
+	at := func(hour, minute int) time.Time {
+		return time.Date(2024, 5, 1, hour, minute, 0, 0, time.Local)
+	}
+	overnight, err := ParseQuietHours("22:00-07:30", []string{"tel:+15555550123"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		at   time.Time
+		want bool
+	}{
+		{at(21, 59), false},
+		{at(22, 0), true},
+		{at(3, 0), true},
+		{at(7, 29), true},
+		{at(7, 30), false},
+	} {
+		if got := overnight.Active(tt.at); got != tt.want {
+			t.Errorf("Active(%s) = %v, want %v", tt.at.Format("15:04"), got, tt.want)
+		}
+	}
+	if overnight.Mutes("+15555550123", "+15555550123", at(23, 0)) {
+		t.Error("priority contact muted")
+	}
+	if !overnight.Mutes("mailto:a@example.com", "mailto:a@example.com", at(23, 0)) {
+		t.Error("other chat not muted")
+	}
+
+	daytime, err := ParseQuietHours("09:00-17:00", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !daytime.Active(at(12, 0)) || daytime.Active(at(18, 0)) {
+		t.Error("same-day window misreported")
+	}
+
+	if q, err := ParseQuietHours("", nil); q != nil || err != nil {
+		t.Errorf("empty spec = %v, %v", q, err)
+	}
+	if q := (*QuietHours)(nil); q.Mutes("a", "a", at(0, 0)) {
+		t.Error("nil quiet hours muted a message")
+	}
+	for _, bad := range []string{"22:00", "25:00-07:00", "07:00-07:00"} {
+		if _, err := ParseQuietHours(bad, nil); err == nil {
+			t.Errorf("%q accepted", bad)
+		}
+	}
+}
@@ -5,11 +5,19 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"strconv"
 	"time"
 )
 
+// RegistrationVersion is the registration data format this client reads and
+// writes. mac-registration-provider stamps the same number on its output.
+const RegistrationVersion = 1
+
 // RegistrationData mirrors the output of mac-registration-provider.
 type RegistrationData struct {
+	// Version is the format version. Files written before versioning have
+	// none and are read as version 0.
+	Version        int        `json:"version"`
 	ValidationData []byte     `json:"validation_data"`
 	ValidUntil     time.Time  `json:"valid_until"`
 	NacservCommit  string     `json:"nacserv_commit"`
@@ -24,23 +32,89 @@ type DeviceInfo struct {
 	SerialNumber    string `json:"serial_number"`
 	UniqueDeviceID  string `json:"unique_device_id,omitempty"`
 	Hostname        string `json:"hostname"`
+
+	// DeviceName is the name shown to other devices on the account.
+	DeviceName string `json:"device_name,omitempty"`
 }
 
 var ErrMissingRegistration = errors.New("registration data not found")
+var ErrUnsupportedRegistration = errors.New("unsupported registration data version")
 
+// registrationUpgrades[v] converts the raw fields of a version v file to
+// version v+1.
+var registrationUpgrades = []func(fields map[string]json.RawMessage) error{
+	// 0 -> 1: the format is unchanged, only the version field is added.
+	func(fields map[string]json.RawMessage) error { return nil },
+}
+
+// LoadRegistration reads registration data, upgrading older formats in
+// memory. Use UpgradeRegistrationFile to rewrite the file itself.
 func LoadRegistration(path string) (*RegistrationData, error) {
+	reg, _, err := loadRegistration(path)
+	return reg, err
+}
+
+func loadRegistration(path string) (reg *RegistrationData, from int, err error) {
 	data, err := os.ReadFile(path)
 	if errors.Is(err, os.ErrNotExist) {
-		return nil, fmt.Errorf("%w: %s", ErrMissingRegistration, path)
+		return nil, 0, fmt.Errorf("%w: %s", ErrMissingRegistration, path)
 	} else if err != nil {
-		return nil, fmt.Errorf("failed to read registration data: %w", err)
+		return nil, 0, fmt.Errorf("failed to read registration data: %w", err)
+	}
+	return ParseRegistration(data)
+}
+
+// ParseRegistration decodes registration data in any supported format
+// version, upgrading it to RegistrationVersion. It also returns the version
+// the data was in.
+func ParseRegistration(data []byte) (reg *RegistrationData, from int, err error) {
+	var fields map[string]json.RawMessage
+	if err = json.Unmarshal(data, &fields); err != nil {
+		return nil, 0, fmt.Errorf("failed to parse registration data: %w", err)
 	}
+	if raw, ok := fields["version"]; ok {
+		if err = json.Unmarshal(raw, &from); err != nil {
+			return nil, 0, fmt.Errorf("failed to parse registration data version: %w", err)
+		}
+	}
+	if from < 0 || from > RegistrationVersion {
+		return nil, from, fmt.Errorf("%w %d (this client supports up to %d; update it)", ErrUnsupportedRegistration, from, RegistrationVersion)
+	}
+	for v := from; v < RegistrationVersion; v++ {
+		if err = registrationUpgrades[v](fields); err != nil {
+			return nil, from, fmt.Errorf("failed to upgrade registration data from version %d: %w", v, err)
+		}
+	}
+	fields["version"] = json.RawMessage(strconv.Itoa(RegistrationVersion))
+	if data, err = json.Marshal(fields); err != nil {
+		return nil, from, err
+	}
+	reg = &RegistrationData{}
+	if err = json.Unmarshal(data, reg); err != nil {
+		return nil, from, fmt.Errorf("failed to parse registration data: %w", err)
+	}
+	return reg, from, nil
+}
 
-	var reg RegistrationData
-	if err = json.Unmarshal(data, &reg); err != nil {
-		return nil, fmt.Errorf("failed to parse registration data: %w", err)
+// UpgradeRegistrationFile rewrites the registration file at path in the
+// current format version, keeping the original as path.bak. It returns the
+// version the file was in, and does nothing if that's already current.
+func UpgradeRegistrationFile(path string) (from int, err error) {
+	reg, from, err := loadRegistration(path)
+	if err != nil || from == RegistrationVersion {
+		return from, err
+	}
+	data, err := json.MarshalIndent(reg, "", "  ")
+	if err != nil {
+		return from, err
+	}
+	if err = os.Rename(path, path+".bak"); err != nil {
+		return from, fmt.Errorf("failed to back up registration data: %w", err)
+	}
+	if err = os.WriteFile(path, append(data, '\n'), 0o600); err != nil {
+		return from, fmt.Errorf("failed to write registration data: %w", err)
 	}
-	return &reg, nil
+	return from, nil
 }
 
 // IsExpired reports whether the validation data is no longer fresh enough to use.
@@ -0,0 +1,39 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUpgradeRegistrationFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "registration-data.json")
+	old := `{"validation_data":"AQID","valid_until":"2030-01-01T00:00:00Z","device_info":{"hardware_version":"Mac14,2"}}`
+	if err := os.WriteFile(path, []byte(old), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	reg, err := LoadRegistration(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reg.Version != RegistrationVersion || string(reg.ValidationData) != "\x01\x02\x03" || reg.DeviceInfo.HardwareVersion != "Mac14,2" {
+		t.Errorf("loaded %+v", reg)
+	}
+
+	from, err := UpgradeRegistrationFile(path)
+	if err != nil || from != 0 {
+		t.Fatalf("upgrade from %d: %v", from, err)
+	}
+	if backup, _ := os.ReadFile(path + ".bak"); string(backup) != old {
+		t.Errorf("backup = %s", backup)
+	}
+	if from, err = UpgradeRegistrationFile(path); err != nil || from != RegistrationVersion {
+		t.Errorf("second upgrade from %d: %v", from, err)
+	}
+
+	if _, _, err := ParseRegistration([]byte(`{"version":99}`)); !errors.Is(err, ErrUnsupportedRegistration) {
+		t.Errorf("future version: err = %v", err)
+	}
+}
@@ -0,0 +1,134 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var ErrInconsistentDeviceInfo = errors.New("inconsistent device info")
+
+var (
+	hardwareVersionPattern = regexp.MustCompile(`^([A-Za-z]+)(\d+),(\d+)$`)
+	buildIDPattern         = regexp.MustCompile(`^(\d{2})[A-Z]\d{1,4}[a-z]?$`)
+)
+
+// macFamilies are the model identifier prefixes IDS accepts for Mac registrations.
+var macFamilies = map[string]bool{
+	"MacBookPro": true,
+	"MacBookAir": true,
+	"MacBook":    true,
+	"Macmini":    true,
+	"iMac":       true,
+	"iMacPro":    true,
+	"MacPro":     true,
+	"Mac":        true,
+}
+
+// minimumMacOS lists the model generation from which a family requires a
+// newer macOS release, e.g. Apple silicon MacBook Pros can't run Catalina.
+var minimumMacOS = []struct {
+	family     string
+	generation int
+	major      int
+}{
+	{"MacBookPro", 18, 12},
+	{"MacBookPro", 17, 11},
+	{"MacBookAir", 10, 11},
+	{"Macmini", 9, 11},
+	{"iMac", 21, 11},
+	{"Mac", 13, 12},
+}
+
+// Validate cross-checks the hardware version, OS version and build ID.
+// IDS silently drops registrations from combinations that can't exist, so
+// these are rejected up front. Empty fields are not checked.
+func (d DeviceInfo) Validate() error {
+	var problems []string
+
+	family, generation := "", 0
+	if d.HardwareVersion != "" {
+		match := hardwareVersionPattern.FindStringSubmatch(d.HardwareVersion)
+		if match == nil {
+			problems = append(problems, fmt.Sprintf("hardware version %q is not a model identifier", d.HardwareVersion))
+		} else if !macFamilies[match[1]] {
+			problems = append(problems, fmt.Sprintf("hardware version %q is not a Mac", d.HardwareVersion))
+		} else {
+			family = match[1]
+			generation, _ = strconv.Atoi(match[2])
+		}
+	}
+
+	if d.SoftwareName != "" && d.SoftwareName != "macOS" && d.SoftwareName != "Mac OS X" {
+		problems = append(problems, fmt.Sprintf("software name %q is not macOS", d.SoftwareName))
+	}
+
+	major, minor, versionOK := 0, 0, true
+	if d.SoftwareVersion != "" {
+		major, minor, versionOK = parseMacOSVersion(d.SoftwareVersion)
+		if !versionOK {
+			problems = append(problems, fmt.Sprintf("software version %q is not a macOS version", d.SoftwareVersion))
+		}
+	}
+
+	if d.SoftwareBuildID != "" {
+		match := buildIDPattern.FindStringSubmatch(d.SoftwareBuildID)
+		if match == nil {
+			problems = append(problems, fmt.Sprintf("build ID %q is malformed", d.SoftwareBuildID))
+		} else if d.SoftwareVersion != "" && versionOK {
+			darwin, _ := strconv.Atoi(match[1])
+			if expected := darwinMajor(major, minor); darwin != expected {
+				problems = append(problems, fmt.Sprintf("build ID %s belongs to Darwin %d, but macOS %s is Darwin %d", d.SoftwareBuildID, darwin, d.SoftwareVersion, expected))
+			}
+		}
+	}
+
+	if family != "" && d.SoftwareVersion != "" && versionOK {
+		for _, min := range minimumMacOS {
+			if min.family == family && generation >= min.generation {
+				if major < min.major {
+					problems = append(problems, fmt.Sprintf("%s requires macOS %d or newer, got %s", d.HardwareVersion, min.major, d.SoftwareVersion))
+				}
+				break
+			}
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("%w: %s", ErrInconsistentDeviceInfo, strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+func parseMacOSVersion(version string) (major, minor int, ok bool) {
+	parts := strings.Split(version, ".")
+	if len(parts) < 1 || len(parts) > 3 {
+		return 0, 0, false
+	}
+	var err error
+	if major, err = strconv.Atoi(parts[0]); err != nil || major < 10 {
+		return 0, 0, false
+	}
+	if len(parts) > 1 {
+		if minor, err = strconv.Atoi(parts[1]); err != nil {
+			return 0, 0, false
+		}
+	}
+	return major, minor, true
+}
+
+// darwinMajor maps a macOS version to the Darwin major version used as the
+// build ID prefix.
+func darwinMajor(major, minor int) int {
+	switch {
+	case major == 10:
+		return minor + 4
+	case major >= 26:
+		// macOS jumped from 15 to 26 while Darwin kept counting.
+		return major - 1
+	default:
+		return major + 9
+	}
+}
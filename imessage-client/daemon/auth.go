@@ -0,0 +1,173 @@
+package daemon
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+)
+
+// Scope is what an API token may do. ScopeSend includes ScopeRead.
+type Scope string
+
+const (
+	// ScopeRead allows polling for unread messages.
+	ScopeRead Scope = "read"
+	// ScopeSend also allows sending, typing indicators and changing chat
+	// state such as read markers, snoozes and mutes.
+	ScopeSend Scope = "send"
+)
+
+// Allows reports whether s covers required.
+func (s Scope) Allows(required Scope) bool {
+	return required == "" || s == required || s == ScopeSend
+}
+
+// methodScopes are the scopes the methods need. Methods not listed need
+// ScopeSend, so a new method isn't readable with a read-only token by
+// accident.
+var methodScopes = map[string]Scope{
+	MethodPing:       "",
+	MethodPollUnread: ScopeRead,
+	MethodMetrics:    ScopeRead,
+	MethodSubscribe:  ScopeRead,
+}
+
+func methodScope(method string) Scope {
+	if scope, ok := methodScopes[method]; ok {
+		return scope
+	}
+	return ScopeSend
+}
+
+var (
+	ErrUnauthorized = errors.New("missing or unknown API token")
+	ErrForbidden    = errors.New("API token doesn't allow this method")
+)
+
+// Token is an API token accepted by a listener started with ListenTCP.
+type Token struct {
+	// Name identifies the token in logs. A client certificate whose common
+	// name matches it gets the token's scope without sending the token.
+	Name  string `json:"name"`
+	Token string `json:"token"`
+	Scope Scope  `json:"scope"`
+	// RateLimit is how many messages a minute the token may send, if it
+	// differs from the listener's.
+	RateLimit int `json:"rate_limit,omitempty"`
+}
+
+// LoadTokens reads a JSON array of tokens like
+// {"name": "dashboard", "token": "...", "scope": "read"}.
+func LoadTokens(path string) ([]Token, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read API tokens: %w", err)
+	}
+	var tokens []Token
+	if err := json.Unmarshal(data, &tokens); err != nil {
+		return nil, fmt.Errorf("failed to parse API tokens: %w", err)
+	}
+	for i, token := range tokens {
+		if token.Token == "" && token.Name == "" {
+			return nil, fmt.Errorf("API token %d needs a token or a name", i+1)
+		}
+		if token.Scope != ScopeRead && token.Scope != ScopeSend {
+			return nil, fmt.Errorf("API token %d has unknown scope %q (want read or send)", i+1, token.Scope)
+		}
+		if token.RateLimit < 0 {
+			return nil, fmt.Errorf("API token %d has a negative rate limit", i+1)
+		}
+	}
+	return tokens, nil
+}
+
+// findToken returns the token whose secret is secret.
+func findToken(tokens []Token, secret string) (Token, bool) {
+	var found Token
+	ok := false
+	for _, token := range tokens {
+		// Compare against every token so timing doesn't give one away
+		if token.Token != "" && subtle.ConstantTimeCompare([]byte(token.Token), []byte(secret)) == 1 {
+			found, ok = token, true
+		}
+	}
+	return found, ok
+}
+
+// certToken returns the token named by the common name of a verified client
+// certificate on conn.
+func certToken(tokens []Token, conn net.Conn) (Token, bool) {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return Token{}, false
+	}
+	state := tlsConn.ConnectionState()
+	if len(state.VerifiedChains) == 0 {
+		return Token{}, false
+	}
+	name := state.VerifiedChains[0][0].Subject.CommonName
+	for _, token := range tokens {
+		if token.Name != "" && token.Name == name {
+			return token, true
+		}
+	}
+	return Token{}, false
+}
+
+// ServerTLSConfig loads the listener's certificate, and if clientCAFile is
+// set, requires clients to present a certificate signed by one of its CAs.
+func ServerTLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+	cfg := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if clientCAFile != "" {
+		cfg.ClientCAs = x509.NewCertPool()
+		if err := appendCertsFromFile(cfg.ClientCAs, clientCAFile); err != nil {
+			return nil, err
+		}
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
+
+// ClientTLSConfig trusts the CAs in caFile as well as the system's, and
+// presents the certificate in certFile and keyFile if they're set.
+func ClientTLSConfig(caFile, certFile, keyFile string) (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if err := appendCertsFromFile(pool, caFile); err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = pool
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+func appendCertsFromFile(pool *x509.CertPool, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read CA file: %w", err)
+	}
+	if !pool.AppendCertsFromPEM(data) {
+		return fmt.Errorf("no certificates in %s", path)
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package daemon
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"imessage-client/config"
+	"imessage-client/messaging"
+)
+
+func TestListenTCPAuth(t *testing.T) {
+	store := messaging.NewMemoryStore()
+	reg := &config.RegistrationData{ValidationData: []byte("v"), ValidUntil: time.Now().Add(time.Hour)}
+	session, err := messaging.Connect(context.Background(), reg, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+
+	tokens := []Token{
+		{Name: "dashboard", Token: "read-secret", Scope: ScopeRead},
+		{Name: "bot", Token: "send-secret", Scope: ScopeSend},
+	}
+	if _, err := ListenTCP("0.0.0.0:0", nil, tokens, session); err == nil {
+		t.Error("plain TCP on a public address was allowed")
+	}
+	if _, err := ListenTCP("127.0.0.1:0", nil, nil, session); err == nil {
+		t.Error("TCP without tokens was allowed")
+	}
+	server, err := ListenTCP("127.0.0.1:0", nil, tokens, session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go server.Serve(ctx)
+
+	const chat = "tel:+15555550123"
+	dial := func(token string) *Client {
+		client, err := DialTCP(server.Addr().String(), nil, token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { client.Close() })
+		return client
+	}
+
+	if err := dial("").Ping(ctx); !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("ping without a token err = %v, want ErrUnauthorized", err)
+	}
+	if err := dial("wrong").Ping(ctx); !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("ping with a wrong token err = %v, want ErrUnauthorized", err)
+	}
+
+	reader := dial("read-secret")
+	if err := reader.Ping(ctx); err != nil {
+		t.Errorf("ping with a read token: %v", err)
+	}
+	if err := reader.Mute(ctx, chat, 0); !errors.Is(err, ErrForbidden) {
+		t.Errorf("mute with a read token err = %v, want ErrForbidden", err)
+	}
+	if !store.Cursor(chat).MutedUntil.IsZero() {
+		t.Error("forbidden mute was applied")
+	}
+
+	if err := dial("send-secret").Mute(ctx, chat, 0); err != nil {
+		t.Errorf("mute with a send token: %v", err)
+	}
+}
+
+func TestOversizedRequestDropsConnection(t *testing.T) {
+	session, err := messaging.Connect(context.Background(), &config.RegistrationData{ValidationData: []byte("v"), ValidUntil: time.Now().Add(time.Hour)}, messaging.NewMemoryStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	server, err := ListenTCP("127.0.0.1:0", nil, []Token{{Name: "bot", Token: "secret", Scope: ScopeSend}}, session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go server.Serve(ctx)
+
+	conn, err := net.Dial("tcp", server.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go func() {
+		// Never finishes the line, so only the size limit can end it
+		_, _ = conn.Write([]byte(`{"method": "ping", "token": "`))
+		_, _ = conn.Write(bytes.Repeat([]byte("a"), MaxRequestSize+1))
+	}()
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, err := conn.Read(make([]byte, 1)); n != 0 || errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("read %d bytes, err %v; want the connection closed", n, err)
+	}
+}
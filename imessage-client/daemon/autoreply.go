@@ -0,0 +1,211 @@
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+
+	"imessage-client/messaging"
+)
+
+// DefaultAutoReplyCooldown is how long a rule waits before answering the
+// same sender again when its cooldown isn't set.
+const DefaultAutoReplyCooldown = time.Hour
+
+// AutoReplyRule answers incoming messages that match it. An empty Chats,
+// Senders or Keywords matches anything, except that a rule without Chats
+// only answers DMs, so an out-of-office reply doesn't go to every group.
+type AutoReplyRule struct {
+	Name    string
+	Chats   []string
+	Senders []string
+	// Keywords match anywhere in the text, ignoring case.
+	Keywords []string
+	// Reply is a Go template with the fields sender, chat, text and time
+	// (RFC 3339).
+	Reply *template.Template
+	// Cooldown is how long the rule stays quiet for a sender after
+	// answering them.
+	Cooldown time.Duration
+}
+
+type autoReplyRuleJSON struct {
+	Name     string   `json:"name"`
+	Chats    []string `json:"chats"`
+	Senders  []string `json:"senders"`
+	Keywords []string `json:"keywords"`
+	Reply    string   `json:"reply"`
+	Cooldown string   `json:"cooldown"`
+}
+
+// LoadAutoReplyRules reads a JSON array of rules like
+// {"senders": ["+15555550123"], "keywords": ["urgent"], "reply": "Away
+// until Monday", "cooldown": "4h"}.
+func LoadAutoReplyRules(path string) ([]*AutoReplyRule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read auto-reply rules: %w", err)
+	}
+	var raw []autoReplyRuleJSON
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("failed to parse auto-reply rules: %w", err)
+	}
+	rules := make([]*AutoReplyRule, len(raw))
+	for i, r := range raw {
+		name := r.Name
+		if name == "" {
+			name = fmt.Sprintf("rule %d", i+1)
+		}
+		if r.Reply == "" {
+			return nil, fmt.Errorf("auto-reply %s has no reply", name)
+		}
+		rule := &AutoReplyRule{Name: name, Keywords: r.Keywords, Cooldown: DefaultAutoReplyCooldown}
+		if rule.Chats, err = canonicalHandles(r.Chats); err != nil {
+			return nil, fmt.Errorf("auto-reply %s: %w", name, err)
+		}
+		if rule.Senders, err = canonicalHandles(r.Senders); err != nil {
+			return nil, fmt.Errorf("auto-reply %s: %w", name, err)
+		}
+		if rule.Reply, err = template.New(name).Option("missingkey=error").Parse(r.Reply); err != nil {
+			return nil, fmt.Errorf("auto-reply %s has an invalid reply: %w", name, err)
+		}
+		if r.Cooldown != "" {
+			if rule.Cooldown, err = time.ParseDuration(r.Cooldown); err != nil {
+				return nil, fmt.Errorf("auto-reply %s has an invalid cooldown: %w", name, err)
+			}
+		}
+		rules[i] = rule
+	}
+	return rules, nil
+}
+
+func canonicalHandles(handles []string) ([]string, error) {
+	out := make([]string, len(handles))
+	for i, handle := range handles {
+		id, err := messaging.ParseChatID(handle)
+		if err != nil {
+			return nil, err
+		}
+		out[i] = id.String()
+	}
+	return out, nil
+}
+
+// canonicalHandle is like canonicalHandles for a handle off the wire, which
+// is compared as is if it can't be parsed.
+func canonicalHandle(handle string) string {
+	if id, err := messaging.ParseChatID(handle); err == nil {
+		return id.String()
+	}
+	return handle
+}
+
+// Matches reports whether msg is one the rule answers, ignoring cooldown.
+func (r *AutoReplyRule) Matches(msg messaging.Message) bool {
+	chat := canonicalHandle(msg.Chat)
+	if len(r.Chats) == 0 {
+		if messaging.ChatID(chat).IsGroup() {
+			return false
+		}
+	} else if !contains(r.Chats, chat) {
+		return false
+	}
+	if len(r.Senders) > 0 && !contains(r.Senders, canonicalHandle(msg.Sender)) {
+		return false
+	}
+	if len(r.Keywords) == 0 {
+		return true
+	}
+	text := strings.ToLower(msg.Text)
+	for _, keyword := range r.Keywords {
+		if strings.Contains(text, strings.ToLower(keyword)) {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// AutoResponder answers incoming messages with the first rule that matches.
+type AutoResponder struct {
+	rules []*AutoReplyRule
+	// lastReply is when each rule last answered each sender, by rule index
+	// and sender.
+	lastReply map[autoReplyKey]time.Time
+}
+
+type autoReplyKey struct {
+	rule   int
+	sender string
+}
+
+// NewAutoResponder returns a responder for rules, tried in order.
+func NewAutoResponder(rules []*AutoReplyRule) *AutoResponder {
+	return &AutoResponder{rules: rules, lastReply: make(map[autoReplyKey]time.Time)}
+}
+
+// Reply returns the reply to msg received at now, if a rule matches and the
+// sender isn't in its cooldown. Messages from our own devices are never
+// answered. The cooldown starts as soon as a reply is returned.
+func (a *AutoResponder) Reply(msg messaging.Message, now time.Time) (string, *AutoReplyRule, error) {
+	if msg.IsFromMe {
+		return "", nil, nil
+	}
+	for i, rule := range a.rules {
+		if !rule.Matches(msg) {
+			continue
+		}
+		key := autoReplyKey{rule: i, sender: canonicalHandle(msg.Sender)}
+		if last, ok := a.lastReply[key]; ok && now.Sub(last) < rule.Cooldown {
+			// A sender in one rule's cooldown doesn't fall through to the next
+			return "", nil, nil
+		}
+		var out strings.Builder
+		err := rule.Reply.Execute(&out, map[string]string{
+			"sender": msg.Sender,
+			"chat":   msg.Chat,
+			"text":   msg.Text,
+			"time":   msg.Timestamp.Format(time.RFC3339),
+		})
+		if err != nil {
+			return "", rule, fmt.Errorf("failed to render auto-reply %s: %w", rule.Name, err)
+		}
+		a.lastReply[key] = now
+		return out.String(), rule, nil
+	}
+	return "", nil, nil
+}
+
+// Run answers the session's incoming messages until the session closes.
+func (a *AutoResponder) Run(ctx context.Context, session *messaging.Session) {
+	sub := session.Subscribe(messaging.SubscribeOptions{Overflow: messaging.OverflowDropOldest})
+	defer sub.Close()
+	for msg := range sub.Messages() {
+		reply, rule, err := a.Reply(msg, time.Now())
+		if err != nil {
+			slog.Warn("Auto-reply failed", "err", err)
+			continue
+		}
+		if reply == "" {
+			continue
+		}
+		if _, err := session.Send(ctx, msg.Chat, reply, messaging.SendOptions{}); err != nil {
+			slog.Warn("Failed to send auto-reply", "rule", rule.Name, "chat", msg.Chat, "err", err)
+			continue
+		}
+		slog.Info("Sent auto-reply", "rule", rule.Name, "chat", msg.Chat)
+	}
+}
@@ -0,0 +1,70 @@
+package daemon
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"imessage-client/messaging"
+)
+
+func TestAutoResponder(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.json")
+	rules := `[
+		{"name": "ping", "keywords": ["PING"], "reply": "pong, {{.sender}}", "cooldown": "0s"},
+		{"name": "away", "senders": ["+1 555 555 0123"], "reply": "Away", "cooldown": "1h"}
+	]`
+	if err := os.WriteFile(path, []byte(rules), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadAutoReplyRules(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	responder := NewAutoResponder(loaded)
+
+	now := time.Now()
+	dm := messaging.Message{Chat: "tel:+15555550123", Sender: "tel:+15555550123", Text: "hello"}
+	tests := []struct {
+		name string
+		msg  messaging.Message
+		at   time.Time
+		want string
+	}{
+		{"sender rule", dm, now, "Away"},
+		{"cooldown", dm, now.Add(time.Minute), ""},
+		{"cooldown over", dm, now.Add(2 * time.Hour), "Away"},
+		{"keyword", messaging.Message{Chat: "mailto:a@example.com", Sender: "mailto:a@example.com", Text: "ping?"}, now, "pong, mailto:a@example.com"},
+		{"no cooldown", messaging.Message{Chat: "mailto:a@example.com", Sender: "mailto:a@example.com", Text: "ping"}, now, "pong, mailto:a@example.com"},
+		{"group", messaging.Message{Chat: "chat123", Sender: "mailto:a@example.com", Text: "ping"}, now, ""},
+		{"from me", messaging.Message{Chat: "mailto:a@example.com", Sender: "mailto:a@example.com", Text: "ping", IsFromMe: true}, now, ""},
+		{"no match", messaging.Message{Chat: "mailto:b@example.com", Sender: "mailto:b@example.com", Text: "hi"}, now, ""},
+	}
+	for _, tt := range tests {
+		got, _, err := responder.Reply(tt.msg, tt.at)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if got != tt.want {
+			t.Errorf("%s: reply %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestLoadAutoReplyRulesInvalid(t *testing.T) {
+	for _, rules := range []string{
+		`[{"senders": ["+15555550123"]}]`,
+		`[{"reply": "{{.sender"}]`,
+		`[{"reply": "hi", "cooldown": "soon"}]`,
+		`[{"reply": "hi", "chats": ["not a chat"]}]`,
+	} {
+		path := filepath.Join(t.TempDir(), "rules.json")
+		if err := os.WriteFile(path, []byte(rules), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadAutoReplyRules(path); err == nil {
+			t.Errorf("rules %s loaded", rules)
+		}
+	}
+}
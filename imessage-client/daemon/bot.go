@@ -0,0 +1,190 @@
+package daemon
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"imessage-client/messaging"
+)
+
+// DefaultBotTimeout is how long a bot handler gets to answer a command.
+const DefaultBotTimeout = 30 * time.Second
+
+// maxBotReply caps how much of a handler's output is read as the reply.
+const maxBotReply = 64 << 10
+
+// BotRequest is a command sent to a bot: "!weather tokyo" is the command
+// "weather" with the args "tokyo".
+type BotRequest struct {
+	Command string    `json:"command"`
+	Args    string    `json:"args"`
+	Chat    string    `json:"chat"`
+	Sender  string    `json:"sender"`
+	Text    string    `json:"text"`
+	Time    time.Time `json:"time"`
+}
+
+// BotHandler answers bot commands. An empty reply sends nothing back.
+type BotHandler interface {
+	Handle(ctx context.Context, req BotRequest) (string, error)
+}
+
+// CommandBot runs a shell command for each bot command. The request is
+// passed as JSON on stdin and in the IMESSAGE_BOT_COMMAND, IMESSAGE_BOT_ARGS,
+// IMESSAGE_BOT_CHAT and IMESSAGE_BOT_SENDER environment variables; whatever
+// it prints is the reply.
+type CommandBot struct {
+	Command string
+}
+
+func (c CommandBot) Handle(ctx context.Context, req BotRequest) (string, error) {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return "", err
+	}
+	cmd := exec.CommandContext(ctx, "sh", "-c", c.Command)
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Env = append(os.Environ(),
+		"IMESSAGE_BOT_COMMAND="+req.Command,
+		"IMESSAGE_BOT_ARGS="+req.Args,
+		"IMESSAGE_BOT_CHAT="+req.Chat,
+		"IMESSAGE_BOT_SENDER="+req.Sender,
+	)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("bot command failed: %w (output: %s)", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	if len(output) > maxBotReply {
+		output = output[:maxBotReply]
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// HTTPBot POSTs each bot command as JSON to a URL. The reply is the response
+// body, or its "reply" field if the response is JSON.
+type HTTPBot struct {
+	URL    string
+	Client *http.Client
+}
+
+func (h HTTPBot) Handle(ctx context.Context, req BotRequest) (string, error) {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return "", err
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, h.URL, bytes.NewReader(data))
+	if err != nil {
+		return "", fmt.Errorf("failed to create bot request: %w", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	client := h.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(httpReq)
+	if err != nil {
+		return "", fmt.Errorf("failed to reach bot: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxBotReply))
+	if err != nil {
+		return "", fmt.Errorf("failed to read bot response: %w", err)
+	}
+	if resp.StatusCode >= 300 {
+		return "", fmt.Errorf("bot returned status %d", resp.StatusCode)
+	}
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType == "application/json" {
+		var reply struct {
+			Reply string `json:"reply"`
+		}
+		if err := json.Unmarshal(body, &reply); err != nil {
+			return "", fmt.Errorf("failed to parse bot response: %w", err)
+		}
+		return reply.Reply, nil
+	}
+	return strings.TrimSpace(string(body)), nil
+}
+
+// Bot forwards incoming messages that start with Prefix to Handler and sends
+// its reply back to the chat.
+type Bot struct {
+	Prefix  string
+	Handler BotHandler
+	// Timeout limits each command; DefaultBotTimeout if zero.
+	Timeout time.Duration
+}
+
+// Parse returns the command in msg, if it is one. Messages from our own
+// devices are never commands, so the bot doesn't answer in other people's
+// chats on our behalf.
+func (b *Bot) Parse(msg messaging.Message) (BotRequest, bool) {
+	if msg.IsFromMe || b.Prefix == "" {
+		return BotRequest{}, false
+	}
+	text := strings.TrimSpace(msg.Text)
+	rest, ok := strings.CutPrefix(text, b.Prefix)
+	if !ok {
+		return BotRequest{}, false
+	}
+	command, args, _ := strings.Cut(strings.TrimSpace(rest), " ")
+	if command == "" {
+		return BotRequest{}, false
+	}
+	return BotRequest{
+		Command: command,
+		Args:    strings.TrimSpace(args),
+		Chat:    msg.Chat,
+		Sender:  msg.Sender,
+		Text:    msg.Text,
+		Time:    msg.Timestamp,
+	}, true
+}
+
+// Run answers commands in the session's incoming messages until the session
+// closes. Each command is handled on its own, so a slow one doesn't hold up
+// the rest.
+func (b *Bot) Run(ctx context.Context, session *messaging.Session) {
+	sub := session.Subscribe(messaging.SubscribeOptions{Overflow: messaging.OverflowDropOldest})
+	defer sub.Close()
+	for msg := range sub.Messages() {
+		req, ok := b.Parse(msg)
+		if !ok {
+			continue
+		}
+		go b.handle(ctx, session, req)
+	}
+}
+
+func (b *Bot) handle(ctx context.Context, session *messaging.Session, req BotRequest) {
+	timeout := b.Timeout
+	if timeout <= 0 {
+		timeout = DefaultBotTimeout
+	}
+	handleCtx, cancel := context.WithTimeout(ctx, timeout)
+	reply, err := b.Handler.Handle(handleCtx, req)
+	cancel()
+	if err != nil {
+		slog.Warn("Bot command failed", "command", req.Command, "chat", req.Chat, "err", err)
+		return
+	}
+	if reply == "" {
+		return
+	}
+	if _, err := session.Send(ctx, req.Chat, reply, messaging.SendOptions{}); err != nil {
+		slog.Warn("Failed to send bot reply", "command", req.Command, "chat", req.Chat, "err", err)
+		return
+	}
+	slog.Debug("Sent bot reply", "command", req.Command, "chat", req.Chat)
+}
@@ -0,0 +1,82 @@
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"imessage-client/messaging"
+)
+
+func TestBotParse(t *testing.T) {
+	bot := &Bot{Prefix: "!"}
+	tests := []struct {
+		msg     messaging.Message
+		command string
+		args    string
+		ok      bool
+	}{
+		{messaging.Message{Text: "!weather  tokyo "}, "weather", "tokyo", true},
+		{messaging.Message{Text: " !ping"}, "ping", "", true},
+		{messaging.Message{Text: "!"}, "", "", false},
+		{messaging.Message{Text: "hi !ping"}, "", "", false},
+		{messaging.Message{Text: "!ping", IsFromMe: true}, "", "", false},
+	}
+	for _, tt := range tests {
+		req, ok := bot.Parse(tt.msg)
+		if ok != tt.ok || req.Command != tt.command || req.Args != tt.args {
+			t.Errorf("Parse(%q) = %q %q %v, want %q %q %v", tt.msg.Text, req.Command, req.Args, ok, tt.command, tt.args, tt.ok)
+		}
+	}
+}
+
+func TestCommandBot(t *testing.T) {
+	bot := CommandBot{Command: `echo "$IMESSAGE_BOT_COMMAND: $IMESSAGE_BOT_ARGS"`}
+	reply, err := bot.Handle(context.Background(), BotRequest{Command: "echo", Args: "hi there"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply != "echo: hi there" {
+		t.Errorf("reply = %q", reply)
+	}
+
+	if _, err := (CommandBot{Command: "exit 1"}).Handle(context.Background(), BotRequest{}); err == nil {
+		t.Error("failing command succeeded")
+	}
+}
+
+func TestHTTPBot(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req BotRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Command == "json" {
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.Write([]byte(`{"reply": "from json"}`))
+			return
+		}
+		w.Write([]byte(req.Args + "\n"))
+	}))
+	defer srv.Close()
+
+	bot := HTTPBot{URL: srv.URL}
+	for _, tt := range []struct {
+		req  BotRequest
+		want string
+	}{
+		{BotRequest{Command: "echo", Args: "plain"}, "plain"},
+		{BotRequest{Command: "json"}, "from json"},
+	} {
+		reply, err := bot.Handle(context.Background(), tt.req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reply != tt.want {
+			t.Errorf("%s: reply = %q, want %q", tt.req.Command, reply, tt.want)
+		}
+	}
+}
@@ -0,0 +1,247 @@
+package daemon
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"imessage-client/messaging"
+)
+
+// DialTimeout bounds connecting to the daemon socket. It's short because a
+// missing daemon just means falling back to a standalone session.
+const DialTimeout = time.Second
+
+// Client talks to a running daemon.
+type Client struct {
+	conn  net.Conn
+	dec   *json.Decoder
+	enc   *json.Encoder
+	token string
+	mu    sync.Mutex
+	// streaming is set once Subscribe has taken over the connection
+	streaming bool
+}
+
+var errStreaming = errors.New("daemon connection is streaming messages")
+
+// Dial connects to the daemon listening on path.
+func Dial(path string) (*Client, error) {
+	conn, err := net.DialTimeout("unix", path, DialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return newClient(conn, ""), nil
+}
+
+// DialTCP connects to a daemon listening on addr with ListenTCP, over TLS if
+// tlsConfig is set, and authenticates each request with token.
+func DialTCP(addr string, tlsConfig *tls.Config, token string) (*Client, error) {
+	dialer := &net.Dialer{Timeout: DialTimeout}
+	var conn net.Conn
+	var err error
+	if tlsConfig != nil {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return newClient(conn, token), nil
+}
+
+func newClient(conn net.Conn, token string) *Client {
+	return &Client{
+		conn:  conn,
+		dec:   json.NewDecoder(bufio.NewReader(conn)),
+		enc:   json.NewEncoder(conn),
+		token: token,
+	}
+}
+
+// Close closes the connection to the daemon.
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+func (c *Client) call(ctx context.Context, req *Request) (*Response, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.callLocked(ctx, req)
+}
+
+func (c *Client) callLocked(ctx context.Context, req *Request) (*Response, error) {
+	if c.streaming {
+		return nil, errStreaming
+	}
+	deadline, _ := ctx.Deadline()
+	if err := c.conn.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+	req.Token = c.token
+	if err := c.enc.Encode(req); err != nil {
+		return nil, fmt.Errorf("failed to send request to daemon: %w", err)
+	}
+	var resp Response
+	if err := c.dec.Decode(&resp); err != nil {
+		return nil, fmt.Errorf("failed to read daemon response: %w", err)
+	}
+	if resp.Error != "" {
+		return &resp, RemoteError{Code: resp.ErrorCode, Message: resp.Error}
+	}
+	return &resp, nil
+}
+
+// Ping checks that the daemon is answering.
+func (c *Client) Ping(ctx context.Context) error {
+	_, err := c.call(ctx, &Request{Method: MethodPing})
+	return err
+}
+
+// Send sends a message through the daemon's session. If wait is positive,
+// the daemon waits up to that long for a delivery receipt, which is returned
+// if one arrived. Like Session.Send, the response is returned alongside
+// errors so the message UUID can be retried.
+func (c *Client) Send(ctx context.Context, chat, text string, opts messaging.SendOptions, wait time.Duration) (*Response, error) {
+	return c.call(ctx, &Request{
+		Method:      MethodSend,
+		Chat:        chat,
+		Text:        text,
+		MessageUUID: opts.MessageUUID,
+		NoSplit:     opts.NoSplit,
+		Markdown:    opts.Markdown,
+		Attachments: opts.Attachments,
+		WaitMillis:  wait.Milliseconds(),
+	})
+}
+
+// React sends a tapback through the daemon's session. Like Send, the
+// response is returned alongside errors so the tapback's UUID can be
+// retried.
+func (c *Client) React(ctx context.Context, reaction messaging.Reaction, opts messaging.SendOptions) (*Response, error) {
+	return c.call(ctx, &Request{Method: MethodReact, MessageUUID: opts.MessageUUID, Reaction: &reaction})
+}
+
+// Typing shows a typing indicator in chat for duration, or takes it down if
+// stop is set. The daemon takes the indicator down itself once duration
+// passes or a message is sent to the chat.
+func (c *Client) Typing(ctx context.Context, chat string, duration time.Duration, stop bool) error {
+	_, err := c.call(ctx, &Request{
+		Method:         MethodTyping,
+		Chat:           chat,
+		DurationMillis: duration.Milliseconds(),
+		StopTyping:     stop,
+	})
+	return err
+}
+
+// MarkRead marks chat read up to messageID (all of it if empty), or every
+// chat if chat is empty, through the daemon's session. It returns how many
+// messages were newly marked read.
+func (c *Client) MarkRead(ctx context.Context, chat, messageID string, opts messaging.ReadOptions) (int, error) {
+	resp, err := c.call(ctx, &Request{
+		Method:      MethodMarkRead,
+		Chat:        chat,
+		MessageUUID: messageID,
+		AllChats:    chat == "",
+		NoReceipt:   opts.NoReceipt,
+	})
+	if resp == nil {
+		return 0, err
+	}
+	return resp.Marked, err
+}
+
+// Snooze hides chat for duration in the daemon's store. It returns how many
+// messages were marked unread.
+func (c *Client) Snooze(ctx context.Context, chat string, duration time.Duration) (int, error) {
+	resp, err := c.call(ctx, &Request{Method: MethodSnooze, Chat: chat, DurationMillis: duration.Milliseconds()})
+	if err != nil {
+		return 0, err
+	}
+	return resp.Marked, nil
+}
+
+// Mute silences notifications for chat for duration in the daemon's store,
+// or until Unmute if duration is 0.
+func (c *Client) Mute(ctx context.Context, chat string, duration time.Duration) error {
+	_, err := c.call(ctx, &Request{Method: MethodMute, Chat: chat, DurationMillis: duration.Milliseconds()})
+	return err
+}
+
+// Unmute ends a mute of chat in the daemon's store.
+func (c *Client) Unmute(ctx context.Context, chat string) error {
+	_, err := c.call(ctx, &Request{Method: MethodUnmute, Chat: chat})
+	return err
+}
+
+// SetService sets the service messages to chat are sent with in the
+// daemon's store: messaging.ServiceIMessage, messaging.ServiceSMS, or "" to
+// pick automatically.
+func (c *Client) SetService(ctx context.Context, chat, service string) error {
+	_, err := c.call(ctx, &Request{Method: MethodSetService, Chat: chat, Service: service})
+	return err
+}
+
+// Metrics fetches the request counters of the daemon's API tokens.
+func (c *Client) Metrics(ctx context.Context) ([]TokenMetrics, error) {
+	resp, err := c.call(ctx, &Request{Method: MethodMetrics})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Metrics, nil
+}
+
+// Subscribe turns the connection into a stream of incoming messages, so it
+// can't be used for other requests afterwards. If after is the Sequence of
+// the last message handled, messages since are delivered first; gap reports
+// that some may have been missed anyway. The channel is closed when ctx is
+// done or the daemon ends the stream, after which the caller reconnects and
+// subscribes again from the last sequence it handled.
+func (c *Client) Subscribe(ctx context.Context, after uint64) (messages <-chan messaging.Message, gap bool, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	resp, err := c.callLocked(ctx, &Request{Method: MethodSubscribe, AfterSequence: after})
+	if err != nil {
+		return nil, false, err
+	}
+	c.streaming = true
+	// The stream runs until ctx is done, not until its deadline
+	if err := c.conn.SetDeadline(time.Time{}); err != nil {
+		return nil, false, err
+	}
+	out := make(chan messaging.Message)
+	stop := context.AfterFunc(ctx, func() { c.conn.Close() })
+	go func() {
+		defer close(out)
+		defer stop()
+		for {
+			var resp Response
+			if err := c.dec.Decode(&resp); err != nil || resp.Message == nil {
+				return
+			}
+			select {
+			case out <- *resp.Message:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out, resp.Gap, nil
+}
+
+// PollUnread fetches unread messages from the daemon's session.
+func (c *Client) PollUnread(ctx context.Context) ([]messaging.MessageSummary, error) {
+	resp, err := c.call(ctx, &Request{Method: MethodPollUnread})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Messages, nil
+}
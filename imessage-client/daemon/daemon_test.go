@@ -0,0 +1,154 @@
+package daemon
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"imessage-client/config"
+	"imessage-client/messaging"
+)
+
+func TestDaemonRoundTrip(t *testing.T) {
+	store := messaging.NewMemoryStore()
+	reg := &config.RegistrationData{ValidationData: []byte("v"), ValidUntil: time.Now().Add(time.Hour)}
+	session, err := messaging.Connect(context.Background(), reg, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+
+	path := filepath.Join(t.TempDir(), "daemon.sock")
+	server, err := Listen(path, session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() { served <- server.Serve(ctx) }()
+
+	if _, err := Listen(path, session); err == nil {
+		t.Error("second Listen on a live socket succeeded")
+	}
+	if info, err := os.Stat(path); err != nil {
+		t.Fatal(err)
+	} else if perm := info.Mode().Perm(); perm != 0o600 {
+		t.Errorf("socket mode %o, want 600", perm)
+	}
+
+	client, err := Dial(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if err := client.Ping(context.Background()); err != nil {
+		t.Fatalf("ping: %v", err)
+	}
+
+	// Already sent, so the daemon answers without attempting a handshake
+	const id = "0F8E6A52-3C1D-4B7E-9A2F-5D6C7B8A9E01"
+	if err := messaging.MarkSent(store, id, "tel:+15555550123", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Send(context.Background(), "tel:+15555550123", "hi", messaging.SendOptions{MessageUUID: id}, 0)
+	if err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	if resp.MessageUUID != id || !resp.Duplicate {
+		t.Errorf("send response = %+v, want duplicate %s", resp, id)
+	}
+
+	_, err = client.Send(context.Background(), "tel:+15555550123", "hi", messaging.SendOptions{MessageUUID: "nope"}, 0)
+	if !errors.Is(err, messaging.ErrInvalidMessageUUID) {
+		t.Errorf("send with bad UUID err = %v, want ErrInvalidMessageUUID", err)
+	}
+
+	reaction, err := messaging.ParseReaction(id, "love")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err = client.React(context.Background(), reaction, messaging.SendOptions{MessageUUID: id})
+	if err != nil {
+		t.Fatalf("react: %v", err)
+	}
+	if resp.MessageUUID != id || !resp.Duplicate {
+		t.Errorf("react response = %+v, want duplicate %s", resp, id)
+	}
+	reaction.Target = "1A2B3C4D-3C1D-4B7E-9A2F-5D6C7B8A9E01"
+	if _, err = client.React(context.Background(), reaction, messaging.SendOptions{}); !errors.Is(err, messaging.ErrUnknownMessage) {
+		t.Errorf("react to a message not in the store err = %v, want ErrUnknownMessage", err)
+	}
+	if _, err = client.React(context.Background(), messaging.Reaction{Target: "nope"}, messaging.SendOptions{}); !errors.Is(err, messaging.ErrInvalidMessageUUID) {
+		t.Errorf("react with bad target err = %v, want ErrInvalidMessageUUID", err)
+	}
+
+	if _, err := client.Snooze(context.Background(), "tel:+15555550123", time.Hour); err != nil {
+		t.Fatalf("snooze: %v", err)
+	}
+	if cursor := store.Cursor("tel:+15555550123"); cursor.SnoozedUntil.Before(time.Now().Add(59 * time.Minute)) {
+		t.Errorf("snoozed until %s, want an hour from now", cursor.SnoozedUntil)
+	}
+
+	if err := client.Mute(context.Background(), "tel:+15555550123", 0); err != nil {
+		t.Fatalf("mute: %v", err)
+	}
+	if cursor := store.Cursor("tel:+15555550123"); !cursor.MutedUntil.Equal(messaging.MuteForever) {
+		t.Errorf("muted until %s, want forever", cursor.MutedUntil)
+	}
+	if err := client.Unmute(context.Background(), "tel:+15555550123"); err != nil {
+		t.Fatalf("unmute: %v", err)
+	}
+	if cursor := store.Cursor("tel:+15555550123"); !cursor.MutedUntil.IsZero() {
+		t.Errorf("still muted until %s", cursor.MutedUntil)
+	}
+
+	stream, err := Dial(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	streamCtx, stopStream := context.WithCancel(context.Background())
+	messages, gap, err := stream.Subscribe(streamCtx, 1)
+	if err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+	if !gap {
+		t.Error("resuming from before the session started reported no gap")
+	}
+	if err := stream.Ping(context.Background()); err == nil {
+		t.Error("ping on a streaming connection succeeded")
+	}
+	stopStream()
+	if _, ok := <-messages; ok {
+		t.Error("stream still open after its context was canceled")
+	}
+
+	cancel()
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Errorf("serve: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("server didn't shut down")
+	}
+	if _, err := Dial(path); err == nil {
+		t.Error("socket still accepting after shutdown")
+	}
+}
+
+func TestErrorCodeIsStable(t *testing.T) {
+	err := errors.Join(messaging.ErrIdentityChanged, messaging.ErrOffline)
+	for i := 0; i < 20; i++ {
+		if code := errorCode(err); code != "offline" {
+			t.Fatalf("code = %q, want the first matching code every time", code)
+		}
+	}
+	remote := RemoteError{Code: "handshake_not_implemented"}
+	if !errors.Is(remote, messaging.ErrHandshakeNotImplemented) || errors.Is(remote, messaging.ErrNotImplemented) {
+		t.Error("remote error matches the wrong sentinel")
+	}
+}
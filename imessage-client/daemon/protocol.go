@@ -0,0 +1,156 @@
+// Package daemon lets CLI invocations share one long-running session over a
+// unix socket instead of each performing its own handshake (and registering
+// a new identity).
+package daemon
+
+import (
+	"errors"
+	"time"
+
+	"imessage-client/messaging"
+	"imessage-client/messaging/apns"
+)
+
+// Methods understood by the daemon.
+const (
+	MethodPing       = "ping"
+	MethodSend       = "send"
+	MethodReact      = "react"
+	MethodPollUnread = "poll_unread"
+	MethodTyping     = "typing"
+	MethodMarkRead   = "mark_read"
+	MethodSnooze     = "snooze"
+	MethodMute       = "mute"
+	MethodUnmute     = "unmute"
+	MethodSetService = "set_service"
+	MethodMetrics    = "metrics"
+	MethodSubscribe  = "subscribe"
+)
+
+// Request is one line of JSON sent to the daemon.
+type Request struct {
+	Method      string `json:"method"`
+	Chat        string `json:"chat,omitempty"`
+	Text        string `json:"text,omitempty"`
+	MessageUUID string `json:"message_uuid,omitempty"`
+	NoSplit     bool   `json:"no_split,omitempty"`
+	Markdown    bool   `json:"markdown,omitempty"`
+
+	Attachments []messaging.Attachment `json:"attachments,omitempty"`
+	// Reaction is the tapback a react sends, with MessageUUID as its own ID.
+	Reaction *messaging.Reaction `json:"reaction,omitempty"`
+	// WaitMillis asks a send to wait this long for a delivery receipt.
+	WaitMillis int64 `json:"wait_ms,omitempty"`
+	// DurationMillis is how long a typing indicator is shown, or a chat
+	// snoozed or muted; a mute without one lasts until unmute. StopTyping
+	// takes the typing indicator down instead.
+	DurationMillis int64 `json:"duration_ms,omitempty"`
+	StopTyping     bool  `json:"stop_typing,omitempty"`
+	// AllChats marks every chat read; NoReceipt skips the read receipts.
+	AllChats  bool `json:"all_chats,omitempty"`
+	NoReceipt bool `json:"no_receipt,omitempty"`
+	// AfterSequence resumes a subscribe after the last message the client
+	// handled.
+	AfterSequence uint64 `json:"after_sequence,omitempty"`
+	// Service is what a set_service sends the chat with: "iMessage", "SMS",
+	// or empty to pick automatically.
+	Service string `json:"service,omitempty"`
+
+	// Token authenticates requests to a listener started with ListenTCP.
+	Token string `json:"token,omitempty"`
+}
+
+// Response is one line of JSON sent back for each Request.
+type Response struct {
+	Error     string `json:"error,omitempty"`
+	ErrorCode string `json:"error_code,omitempty"`
+
+	MessageUUID string `json:"message_uuid,omitempty"`
+	Duplicate   bool   `json:"duplicate,omitempty"`
+	// Queued is set when the send was queued until APNS is reachable again.
+	Queued bool `json:"queued,omitempty"`
+	// Service is the service a message was sent with.
+	Service string `json:"service,omitempty"`
+	// Parts are the UUIDs of the messages a long text was split into.
+	Parts    []string  `json:"parts,omitempty"`
+	Delivery *Delivery `json:"delivery,omitempty"`
+
+	Messages []messaging.MessageSummary `json:"messages,omitempty"`
+	// Marked is how many messages a mark_read newly marked read, or a
+	// snooze marked unread.
+	Marked int `json:"marked,omitempty"`
+	// RetryAfterMillis is how long to wait before retrying a send refused
+	// as rate_limited.
+	RetryAfterMillis int64 `json:"retry_after_ms,omitempty"`
+	// Metrics are the request counters of each API token.
+	Metrics []TokenMetrics `json:"metrics,omitempty"`
+
+	// A subscribe is answered with the newest Sequence, and Gap if messages
+	// after AfterSequence may have been missed, followed by one Message per
+	// line.
+	Sequence uint64             `json:"sequence,omitempty"`
+	Gap      bool               `json:"gap,omitempty"`
+	Message  *messaging.Message `json:"message,omitempty"`
+}
+
+// Delivery is the wire form of messaging.Delivery.
+type Delivery struct {
+	State       string    `json:"state"`
+	At          time.Time `json:"at"`
+	Error       string    `json:"error,omitempty"`
+	SMSFallback bool      `json:"sms_fallback,omitempty"`
+}
+
+// errorCodes maps sentinel errors to the codes they cross the socket as, so
+// callers can keep using errors.Is. It's ordered, so an error matching
+// several sentinels always gets the first one's code.
+var errorCodes = []struct {
+	code     string
+	sentinel error
+}{
+	{"handshake_not_implemented", messaging.ErrHandshakeNotImplemented},
+	{"not_implemented", messaging.ErrNotImplemented},
+	{"invalid_registration_data", messaging.ErrInvalidRegistrationData},
+	{"registration_expired", messaging.ErrRegistrationExpired},
+	{"invalid_message_uuid", messaging.ErrInvalidMessageUUID},
+	{"not_on_imessage", messaging.ErrNotOnIMessage},
+	{"payload_too_large", apns.ErrPayloadTooLarge},
+	{"attachment_too_large", messaging.ErrAttachmentTooLargeForInline},
+	{"too_many_attachments", messaging.ErrTooManyInlineAttachments},
+	{"offline", messaging.ErrOffline},
+	{"identity_changed", messaging.ErrIdentityChanged},
+	{"unknown_message", messaging.ErrUnknownMessage},
+	{"unknown_service", messaging.ErrUnknownService},
+	{"sms_unavailable", messaging.ErrSMSUnavailable},
+	{"unauthorized", ErrUnauthorized},
+	{"forbidden", ErrForbidden},
+	{"rate_limited", ErrRateLimited},
+}
+
+func errorCode(err error) string {
+	for _, c := range errorCodes {
+		if errors.Is(err, c.sentinel) {
+			return c.code
+		}
+	}
+	return ""
+}
+
+// RemoteError is an error returned by the daemon.
+type RemoteError struct {
+	Code    string
+	Message string
+}
+
+func (e RemoteError) Error() string {
+	return e.Message
+}
+
+func (e RemoteError) Is(other error) bool {
+	for _, c := range errorCodes {
+		if c.code == e.Code {
+			return c.sentinel == other
+		}
+	}
+	return false
+}
@@ -0,0 +1,118 @@
+package daemon
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultRateLimit is how many messages a minute an API token may send when
+// neither it nor the listener sets a limit. Bursts of sends from one account
+// are what gets it flagged as spam, so the default is low.
+const DefaultRateLimit = 20
+
+var ErrRateLimited = errors.New("API token sent too many messages; retry later")
+
+// TokenMetrics counts the requests made with one API token.
+type TokenMetrics struct {
+	Name     string `json:"name"`
+	Requests int64  `json:"requests"`
+	Sent     int64  `json:"sent"`
+	// RateLimited counts the sends refused for going over the limit.
+	RateLimited int64 `json:"rate_limited"`
+}
+
+// RateLimiter limits how fast each API token sends messages, as a token
+// bucket holding a minute's worth of sends, and counts each token's
+// requests. Only sends are limited; polling and the like only count.
+type RateLimiter struct {
+	perMinute int
+
+	mu      sync.Mutex
+	buckets map[string]*sendBucket
+	metrics map[string]*TokenMetrics
+}
+
+type sendBucket struct {
+	level float64
+	last  time.Time
+}
+
+// NewRateLimiter returns a limiter allowing perMinute sends a minute for
+// tokens that don't set their own limit, or any number if it's 0.
+func NewRateLimiter(perMinute int) *RateLimiter {
+	return &RateLimiter{
+		perMinute: perMinute,
+		buckets:   make(map[string]*sendBucket),
+		metrics:   make(map[string]*TokenMetrics),
+	}
+}
+
+// allow counts a request made with token at now, returning false and how
+// long to wait if it's a send over the token's limit.
+func (l *RateLimiter) allow(token Token, method string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	key := tokenKey(token)
+	m := l.metrics[key]
+	if m == nil {
+		m = &TokenMetrics{Name: token.Name}
+		l.metrics[key] = m
+	}
+	m.Requests++
+	if method != MethodSend && method != MethodReact {
+		return true, 0
+	}
+
+	limit := l.perMinute
+	if token.RateLimit > 0 {
+		limit = token.RateLimit
+	}
+	if limit <= 0 {
+		m.Sent++
+		return true, 0
+	}
+	rate := float64(limit) / float64(time.Minute)
+	b := l.buckets[key]
+	if b == nil {
+		b = &sendBucket{level: float64(limit), last: now}
+		l.buckets[key] = b
+	}
+	b.level += float64(now.Sub(b.last)) * rate
+	if b.level > float64(limit) {
+		b.level = float64(limit)
+	}
+	b.last = now
+	if b.level < 1 {
+		m.RateLimited++
+		return false, time.Duration((1 - b.level) / rate)
+	}
+	b.level--
+	m.Sent++
+	return true, 0
+}
+
+// tokenKey identifies a token. Tokens only used with client certificates
+// have no secret, so fall back to the name.
+func tokenKey(token Token) string {
+	if token.Token != "" {
+		return "token:" + token.Token
+	}
+	return "name:" + token.Name
+}
+
+// Metrics returns the counters of every token that has made a request,
+// sorted by name.
+func (l *RateLimiter) Metrics() []TokenMetrics {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	metrics := make([]TokenMetrics, 0, len(l.metrics))
+	for _, m := range l.metrics {
+		metrics = append(metrics, *m)
+	}
+	sort.Slice(metrics, func(i, j int) bool {
+		return metrics[i].Name < metrics[j].Name
+	})
+	return metrics
+}
@@ -0,0 +1,46 @@
+package daemon
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	limiter := NewRateLimiter(2)
+	bot := Token{Name: "bot", Token: "b", Scope: ScopeSend}
+	fast := Token{Name: "fast", Token: "f", Scope: ScopeSend, RateLimit: 60}
+	now := time.Now()
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := limiter.allow(bot, MethodSend, now); !ok {
+			t.Fatalf("send %d refused", i+1)
+		}
+	}
+	ok, wait := limiter.allow(bot, MethodSend, now)
+	if ok || wait != 30*time.Second {
+		t.Errorf("third send = %v, wait %s; want refused for 30s", ok, wait)
+	}
+	if ok, _ := limiter.allow(bot, MethodPollUnread, now); !ok {
+		t.Error("poll refused while sends are limited")
+	}
+	if ok, _ := limiter.allow(bot, MethodSend, now.Add(30*time.Second)); !ok {
+		t.Error("send refused after the bucket refilled")
+	}
+	for i := 0; i < 60; i++ {
+		if ok, _ := limiter.allow(fast, MethodSend, now); !ok {
+			t.Fatalf("send %d with the token's own limit refused", i+1)
+		}
+	}
+
+	metrics := limiter.Metrics()
+	if len(metrics) != 2 {
+		t.Fatalf("metrics = %+v", metrics)
+	}
+	want := TokenMetrics{Name: "bot", Requests: 5, Sent: 3, RateLimited: 1}
+	if metrics[0] != want {
+		t.Errorf("bot metrics = %+v, want %+v", metrics[0], want)
+	}
+	if metrics[1].Sent != 60 {
+		t.Errorf("fast metrics = %+v", metrics[1])
+	}
+}
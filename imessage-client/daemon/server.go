@@ -0,0 +1,387 @@
+package daemon
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"imessage-client/messaging"
+)
+
+// Limits on what a connection may send, which a TCP listener takes from
+// anyone who can reach it before they've authenticated.
+const (
+	// MaxRequestSize bounds one request line. It fits a send with the most
+	// inline attachments with room to spare.
+	MaxRequestSize = 1 << 20
+	// firstRequestTimeout is how long a new connection has to finish any
+	// TLS handshake and send its first request.
+	firstRequestTimeout = 10 * time.Second
+	// idleTimeout is how long a connection may wait between requests.
+	idleTimeout = 5 * time.Minute
+)
+
+// Server serves requests for a session on a unix socket, or on a TCP
+// address for clients on other machines.
+type Server struct {
+	session  *messaging.Session
+	path     string
+	listener net.Listener
+	// tokens authenticate requests when auth is set. The unix socket
+	// doesn't need them; its file permissions keep it private.
+	tokens  []Token
+	auth    bool
+	limiter *RateLimiter
+
+	wg sync.WaitGroup
+}
+
+// Listen creates the socket at path. A stale socket left by a daemon that
+// didn't shut down cleanly is replaced; a live one is an error.
+func Listen(path string, session *messaging.Session) (*Server, error) {
+	if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+		conn.Close()
+		return nil, fmt.Errorf("a daemon is already listening on %s", path)
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to remove stale socket: %w", err)
+	}
+	// The socket gives full access to the account, so create it private
+	// rather than tightening it afterwards, when someone could already have
+	// connected. The umask is process-wide, but only ever narrowed here.
+	oldMask := syscall.Umask(0o177)
+	listener, err := net.Listen("unix", path)
+	syscall.Umask(oldMask)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", path, err)
+	}
+	return &Server{session: session, path: path, listener: listener}, nil
+}
+
+// ListenTCP listens on addr, with TLS if tlsConfig is set. Every request
+// needs one of tokens, or a client certificate named by one. Without TLS
+// the tokens would cross the network in the clear, so addr must then be a
+// loopback address.
+func ListenTCP(addr string, tlsConfig *tls.Config, tokens []Token, session *messaging.Session) (*Server, error) {
+	if len(tokens) == 0 {
+		return nil, errors.New("listening on TCP needs API tokens")
+	}
+	if tlsConfig == nil && !isLoopback(addr) {
+		return nil, fmt.Errorf("%s isn't a loopback address, so it needs TLS", addr)
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", addr, err)
+	}
+	if tlsConfig != nil {
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+	return &Server{session: session, listener: listener, tokens: tokens, auth: true}, nil
+}
+
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// SetRateLimiter limits how fast each API token sends messages, and serves
+// the limiter's metrics. Servers can share a limiter, so the unix socket can
+// report on a TCP listener; requests without a token aren't limited.
+func (s *Server) SetRateLimiter(limiter *RateLimiter) {
+	s.limiter = limiter
+}
+
+// Addr returns the address the server listens on.
+func (s *Server) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// Serve accepts connections until ctx is done, then closes the socket and
+// waits for open connections to finish their current request.
+func (s *Server) Serve(ctx context.Context) error {
+	go func() {
+		<-ctx.Done()
+		s.listener.Close()
+	}()
+	if s.path != "" {
+		defer os.Remove(s.path)
+	}
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			s.wg.Wait()
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("failed to accept connection: %w", err)
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.serveConn(ctx, conn)
+		}()
+	}
+}
+
+func (s *Server) serveConn(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+	go func() {
+		// Unblock the decoder when shutting down
+		<-ctx.Done()
+		conn.Close()
+	}()
+	var certAuth Token
+	var hasCert bool
+	if err := conn.SetReadDeadline(time.Now().Add(firstRequestTimeout)); err != nil {
+		return
+	}
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			slog.Debug("TLS handshake with daemon client failed", "addr", conn.RemoteAddr(), "err", err)
+			return
+		}
+		certAuth, hasCert = certToken(s.tokens, conn)
+	}
+	// Requests are read a line at a time so a peer can't make us buffer
+	// more than MaxRequestSize
+	lines := bufio.NewScanner(conn)
+	lines.Buffer(make([]byte, 0, 4096), MaxRequestSize)
+	enc := json.NewEncoder(conn)
+	for lines.Scan() {
+		if len(bytes.TrimSpace(lines.Bytes())) == 0 {
+			continue
+		}
+		var req Request
+		if err := json.Unmarshal(lines.Bytes(), &req); err != nil {
+			return
+		}
+		resp := s.authorize(&req, certAuth, hasCert)
+		if resp == nil && req.Method == MethodSubscribe {
+			s.stream(ctx, enc, &req)
+			return
+		}
+		if resp == nil {
+			resp = s.handle(ctx, &req)
+		}
+		if err := enc.Encode(resp); err != nil {
+			return
+		}
+		if err := conn.SetReadDeadline(time.Now().Add(idleTimeout)); err != nil {
+			return
+		}
+	}
+	if err := lines.Err(); err != nil {
+		slog.Debug("Dropping daemon client", "addr", conn.RemoteAddr(), "err", err)
+	}
+}
+
+// stream sends incoming messages on the connection until it or the session
+// is closed. Messages after req.AfterSequence that the session still has are
+// sent first, so a client that reconnects with the sequence of the last
+// message it handled gets every message at least once, in order. A client
+// too slow to keep up is disconnected rather than holding up the session;
+// it resumes from the history when it reconnects.
+func (s *Server) stream(ctx context.Context, enc *json.Encoder, req *Request) {
+	sub := s.session.Subscribe(messaging.SubscribeOptions{
+		Overflow: messaging.OverflowDropNewest,
+		After:    req.AfterSequence,
+	})
+	defer sub.Close()
+	if err := enc.Encode(&Response{Sequence: s.session.Sequence(), Gap: sub.Gap()}); err != nil {
+		return
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg, ok := <-sub.Messages():
+			if !ok || sub.Dropped() > 0 {
+				return
+			}
+			if err := enc.Encode(&Response{Message: &msg}); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// authorize returns an error response if req may not be served. A token in
+// the request takes precedence over the connection's client certificate.
+func (s *Server) authorize(req *Request, certAuth Token, hasCert bool) *Response {
+	if !s.auth {
+		return nil
+	}
+	token, ok := certAuth, hasCert
+	if req.Token != "" {
+		token, ok = findToken(s.tokens, req.Token)
+	}
+	if !ok {
+		return errorResponse(ErrUnauthorized)
+	}
+	if !token.Scope.Allows(methodScope(req.Method)) {
+		slog.Debug("Daemon request refused", "token", token.Name, "method", req.Method)
+		return errorResponse(ErrForbidden)
+	}
+	if s.limiter != nil {
+		if ok, wait := s.limiter.allow(token, req.Method, time.Now()); !ok {
+			slog.Warn("Daemon send rate limited", "token", token.Name, "retry_after", wait)
+			resp := errorResponse(ErrRateLimited)
+			resp.RetryAfterMillis = int64((wait + time.Millisecond - 1) / time.Millisecond)
+			return resp
+		}
+	}
+	return nil
+}
+
+func (s *Server) handle(ctx context.Context, req *Request) *Response {
+	switch req.Method {
+	case MethodPing:
+		return &Response{}
+	case MethodSend:
+		return s.handleSend(ctx, req)
+	case MethodReact:
+		return s.handleReact(ctx, req)
+	case MethodTyping:
+		var err error
+		if req.StopTyping {
+			err = s.session.StopTyping(ctx, req.Chat)
+		} else {
+			err = s.session.StartTyping(ctx, req.Chat, time.Duration(req.DurationMillis)*time.Millisecond)
+		}
+		if err != nil {
+			return errorResponse(err)
+		}
+		return &Response{}
+	case MethodMarkRead:
+		opts := messaging.ReadOptions{NoReceipt: req.NoReceipt}
+		var marked int
+		var err error
+		if req.AllChats {
+			marked, err = s.session.MarkAllRead(ctx, opts)
+		} else {
+			marked, err = s.session.MarkRead(ctx, req.Chat, req.MessageUUID, opts)
+		}
+		resp := &Response{}
+		if err != nil {
+			resp = errorResponse(err)
+		}
+		resp.Marked = marked
+		return resp
+	case MethodSnooze:
+		until := time.Now().Add(time.Duration(req.DurationMillis) * time.Millisecond)
+		marked, err := s.session.Snooze(req.Chat, until)
+		if err != nil {
+			return errorResponse(err)
+		}
+		return &Response{Marked: marked}
+	case MethodMute:
+		until := messaging.MuteForever
+		if req.DurationMillis > 0 {
+			until = time.Now().Add(time.Duration(req.DurationMillis) * time.Millisecond)
+		}
+		if err := s.session.Mute(req.Chat, until); err != nil {
+			return errorResponse(err)
+		}
+		return &Response{}
+	case MethodUnmute:
+		if err := s.session.Unmute(req.Chat); err != nil {
+			return errorResponse(err)
+		}
+		return &Response{}
+	case MethodSetService:
+		if err := s.session.SetChatService(req.Chat, req.Service); err != nil {
+			return errorResponse(err)
+		}
+		return &Response{}
+	case MethodMetrics:
+		if s.limiter == nil {
+			return &Response{}
+		}
+		return &Response{Metrics: s.limiter.Metrics()}
+	case MethodPollUnread:
+		summaries, err := s.session.FetchUnread(ctx)
+		if err != nil {
+			return errorResponse(err)
+		}
+		return &Response{Messages: summaries}
+	default:
+		return &Response{Error: fmt.Sprintf("unknown method %q", req.Method)}
+	}
+}
+
+func (s *Server) handleSend(ctx context.Context, req *Request) *Response {
+	result, err := s.session.Send(ctx, req.Chat, req.Text, messaging.SendOptions{
+		MessageUUID: req.MessageUUID,
+		NoSplit:     req.NoSplit,
+		Markdown:    req.Markdown,
+		Attachments: req.Attachments,
+	})
+	var resp *Response
+	if err != nil {
+		resp = errorResponse(err)
+	} else {
+		resp = &Response{}
+	}
+	if result == nil {
+		return resp
+	}
+	resp.MessageUUID = result.MessageUUID
+	resp.Duplicate = result.Duplicate
+	resp.Queued = result.Queued
+	resp.Service = result.Service
+	for _, part := range result.Parts {
+		resp.Parts = append(resp.Parts, part.MessageUUID)
+	}
+	if err != nil || req.WaitMillis <= 0 || result.Service == messaging.ServiceSMS {
+		// No delivery receipt comes back for an SMS
+		return resp
+	}
+
+	waitCtx, cancel := context.WithTimeout(ctx, time.Duration(req.WaitMillis)*time.Millisecond)
+	defer cancel()
+	if d, err := result.Wait(waitCtx); err == nil {
+		resp.Delivery = &Delivery{State: d.State.String(), At: d.At, SMSFallback: d.SMSFallback}
+		if d.Err != nil {
+			resp.Delivery.Error = d.Err.Error()
+		}
+	}
+	return resp
+}
+
+func (s *Server) handleReact(ctx context.Context, req *Request) *Response {
+	if req.Reaction == nil {
+		return &Response{Error: "react needs a reaction"}
+	}
+	result, err := s.session.React(ctx, *req.Reaction, messaging.SendOptions{MessageUUID: req.MessageUUID})
+	resp := &Response{}
+	if err != nil {
+		resp = errorResponse(err)
+	}
+	if result != nil {
+		resp.MessageUUID = result.MessageUUID
+		resp.Duplicate = result.Duplicate
+		resp.Queued = result.Queued
+	}
+	return resp
+}
+
+func errorResponse(err error) *Response {
+	return &Response{Error: err.Error(), ErrorCode: errorCode(err)}
+}
@@ -4,11 +4,17 @@ go 1.21
 
 require (
 	github.com/google/uuid v1.6.0
+	github.com/skip2/go-qrcode v0.0.0-20200617195104-da1b6568686e
 	github.com/spf13/cobra v1.8.0
+	github.com/strukturag/libheif v1.17.6
+	go.etcd.io/bbolt v1.3.10
+	golang.org/x/crypto v0.21.0
+	golang.org/x/image v0.14.0
+	howett.net/plist v1.0.1
 )
 
 require (
 	github.com/inconshreveable/mousetrap v1.1.0 // indirect
 	github.com/spf13/pflag v1.0.5 // indirect
-	howett.net/plist v1.0.1 // indirect
+	golang.org/x/sys v0.18.0 // indirect
 )
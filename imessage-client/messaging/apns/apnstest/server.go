@@ -0,0 +1,330 @@
+// Package apnstest provides an in-process APNS courier for integration
+// tests. It speaks just enough of the protocol for a Connection to connect,
+// filter topics, exchange keep-alives and send and receive messages.
+package apnstest
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"sync"
+	"time"
+
+	"imessage-client/messaging/apns"
+)
+
+// Server is a mock courier listening on a local TLS socket.
+type Server struct {
+	// Token is returned to clients in the ConnectAck.
+	Token []byte
+	// MaxMessageSize and LargeMessageSize are advertised in the ConnectAck.
+	MaxMessageSize   uint16
+	LargeMessageSize uint16
+	// ConnectAckStatus makes the courier reject connects with this status.
+	// Nil accepts them.
+	ConnectAckStatus []byte
+	// SilentConnect makes the courier never answer connects.
+	SilentConnect bool
+	// SendAckStatus makes the courier reject outgoing messages with this
+	// status. Nil acks every message as delivered.
+	SendAckStatus []byte
+
+	listener net.Listener
+	certPool *x509.CertPool
+
+	mu       sync.Mutex
+	conns    map[net.Conn]*sync.Mutex
+	received []*apns.Payload
+	consumed map[int]bool
+	notify   chan struct{}
+	closed   bool
+	wg       sync.WaitGroup
+}
+
+// NewServer starts a courier on a random localhost port.
+func NewServer() (*Server, error) {
+	cert, pool, err := selfSignedCert()
+	if err != nil {
+		return nil, err
+	}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{"apns-security-v3"},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen: %w", err)
+	}
+	s := &Server{
+		Token:            []byte("apnstest-push-token-0123456789ab"),
+		MaxMessageSize:   4 * 1024,
+		LargeMessageSize: 15 * 1024,
+		listener:         listener,
+		certPool:         pool,
+		conns:            make(map[net.Conn]*sync.Mutex),
+		consumed:         make(map[int]bool),
+		notify:           make(chan struct{}),
+	}
+	s.wg.Add(1)
+	go s.acceptLoop()
+	return s, nil
+}
+
+// Addr returns the address the courier listens on.
+func (s *Server) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// ClientTLSConfig returns a TLS config that trusts the courier's certificate.
+func (s *Server) ClientTLSConfig() *tls.Config {
+	return &tls.Config{
+		RootCAs:    s.certPool,
+		ServerName: "127.0.0.1",
+		NextProtos: []string{"apns-security-v3"},
+		MinVersion: tls.VersionTLS12,
+	}
+}
+
+// Configure points conn at this courier.
+func (s *Server) Configure(conn *apns.Connection) {
+	conn.Addr = s.Addr()
+	conn.TLSConfig = s.ClientTLSConfig()
+}
+
+// Inject delivers a message on topic to every connected client.
+func (s *Server) Inject(topic apns.Topic, payload []byte) error {
+	return s.InjectWithID(topic, payload, apns.NewMessageID())
+}
+
+// InjectWithID delivers a message with the given message ID, such as one
+// delivered before, to every connected client.
+func (s *Server) InjectWithID(topic apns.Topic, payload, messageID []byte) error {
+	msg := &apns.IncomingSendMessageCommand{
+		Token:     s.Token,
+		Topic:     topic.Hash(),
+		Payload:   payload,
+		MessageID: messageID,
+		Timestamp: binary.BigEndian.AppendUint64(nil, uint64(time.Now().UnixNano())),
+	}
+	return s.broadcast(msg.ToPayload())
+}
+
+// SendKeepAlive sends a keep-alive to every connected client.
+func (s *Server) SendKeepAlive() error {
+	return s.broadcast((&apns.KeepAliveCommand{}).ToPayload())
+}
+
+// SendPayload sends an arbitrary command to every connected client, such
+// as one the client doesn't know.
+func (s *Server) SendPayload(payload *apns.Payload) error {
+	return s.broadcast(payload)
+}
+
+// Received returns every payload received from clients so far.
+func (s *Server) Received() []*apns.Payload {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*apns.Payload(nil), s.received...)
+}
+
+// WaitFor returns the oldest received payload with the given command that
+// hasn't been returned by WaitFor before.
+func (s *Server) WaitFor(ctx context.Context, id apns.CommandID) (*apns.Payload, error) {
+	for {
+		s.mu.Lock()
+		for i, payload := range s.received {
+			if payload.ID == id && !s.consumed[i] {
+				s.consumed[i] = true
+				s.mu.Unlock()
+				return payload, nil
+			}
+		}
+		notify := s.notify
+		s.mu.Unlock()
+
+		select {
+		case <-notify:
+		case <-ctx.Done():
+			return nil, fmt.Errorf("waiting for command %d: %w", id, ctx.Err())
+		}
+	}
+}
+
+// DropConnections disconnects all clients, as a courier going away would,
+// while still accepting new connections.
+func (s *Server) DropConnections() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn := range s.conns {
+		_ = conn.Close()
+	}
+}
+
+// Close stops the courier and disconnects all clients.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	for conn := range s.conns {
+		_ = conn.Close()
+	}
+	s.mu.Unlock()
+	err := s.listener.Close()
+	s.wg.Wait()
+	return err
+}
+
+func (s *Server) acceptLoop() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			_ = conn.Close()
+			return
+		}
+		s.conns[conn] = &sync.Mutex{}
+		s.mu.Unlock()
+		s.wg.Add(1)
+		go s.serve(conn)
+	}
+}
+
+func (s *Server) serve(conn net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		_ = conn.Close()
+	}()
+	for {
+		payload := &apns.Payload{}
+		if err := payload.UnmarshalBinaryStream(conn); err != nil {
+			return
+		}
+		s.record(payload)
+		if reply := s.reply(payload); reply != nil {
+			if err := s.write(conn, reply); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// reply returns the courier's response to a client command, if any.
+func (s *Server) reply(payload *apns.Payload) *apns.Payload {
+	switch payload.ID {
+	case apns.CommandConnect:
+		if s.SilentConnect {
+			return nil
+		}
+		status := s.ConnectAckStatus
+		if status == nil {
+			status = []byte{0}
+		}
+		return (&apns.ConnectAckCommand{
+			Status:           status,
+			Token:            s.Token,
+			MaxMessageSize:   s.MaxMessageSize,
+			LargeMessageSize: s.LargeMessageSize,
+			ServerTimestamp:  uint64(time.Now().UnixMilli()),
+		}).ToPayload()
+	case apns.CommandFilterTopics:
+		return &apns.Payload{ID: apns.CommandFilterTopicsAck}
+	case apns.CommandKeepAlive:
+		return &apns.Payload{ID: apns.CommandKeepAliveAck}
+	case apns.CommandSendMessage:
+		messageID := payload.Field(apns.FieldOutgoingMessageID)
+		if s.SendAckStatus == nil {
+			return (&apns.SendMessageAckCommand{Token: s.Token, MessageID: messageID}).ToPayload()
+		}
+		// Failed acks carry a status instead of the null byte
+		return &apns.Payload{ID: apns.CommandSendMessageAck, Fields: []apns.Field{
+			{ID: apns.FieldSendMessageAckToken, Value: s.Token},
+			{ID: apns.FieldSendMessageAckMessageID, Value: messageID},
+			{ID: apns.FieldSendMessageAckStatus, Value: s.SendAckStatus},
+		}}
+	default:
+		return nil
+	}
+}
+
+func (s *Server) record(payload *apns.Payload) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.received = append(s.received, payload)
+	close(s.notify)
+	s.notify = make(chan struct{})
+}
+
+func (s *Server) broadcast(payload *apns.Payload) error {
+	s.mu.Lock()
+	conns := make([]net.Conn, 0, len(s.conns))
+	for conn := range s.conns {
+		conns = append(conns, conn)
+	}
+	s.mu.Unlock()
+	if len(conns) == 0 {
+		return errors.New("no clients connected")
+	}
+	var errs []error
+	for _, conn := range conns {
+		errs = append(errs, s.write(conn, payload))
+	}
+	return errors.Join(errs...)
+}
+
+func (s *Server) write(conn net.Conn, payload *apns.Payload) error {
+	s.mu.Lock()
+	lock, ok := s.conns[conn]
+	s.mu.Unlock()
+	if !ok {
+		return net.ErrClosed
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	_, err := conn.Write(payload.ToBytes())
+	return err
+}
+
+func selfSignedCert() (tls.Certificate, *x509.CertPool, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "apnstest courier"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	parsed, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(parsed)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool, nil
+}
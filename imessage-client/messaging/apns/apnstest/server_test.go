@@ -0,0 +1,364 @@
+package apnstest
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	"imessage-client/messaging/apns"
+)
+
+func newTestConnection(t *testing.T, server *Server) *apns.Connection {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "push"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := apns.NewConnection(key, cert, []byte("initial-token"))
+	conn.NoAutoFlush = true
+	server.Configure(conn)
+	return conn
+}
+
+func TestConnectFilterAndMessages(t *testing.T) {
+	server, err := NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn := newTestConnection(t, server)
+	if err := conn.Connect(ctx); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	defer conn.Close()
+	if conn.MaxLargeMessageSize() != int(server.LargeMessageSize) {
+		t.Errorf("large message size = %d, want %d", conn.MaxLargeMessageSize(), server.LargeMessageSize)
+	}
+
+	received := make(chan *apns.SendMessagePayload, 1)
+	conn.SetMessageHandler(func(ctx context.Context, payload *apns.SendMessagePayload) error {
+		received <- payload
+		return nil
+	})
+	go conn.ReadLoop(ctx)
+
+	if err := conn.Filter(apns.TopicMadrid); err != nil {
+		t.Fatalf("Filter: %v", err)
+	}
+	filter, err := server.WaitFor(ctx, apns.CommandFilterTopics)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(filter.Field(apns.FieldFilterTopicsTopic), apns.TopicMadrid.Hash()) {
+		t.Errorf("filtered topic = %x, want madrid", filter.Field(apns.FieldFilterTopicsTopic))
+	}
+
+	if err := server.Inject(apns.TopicMadrid, []byte("hello")); err != nil {
+		t.Fatalf("Inject: %v", err)
+	}
+	select {
+	case msg := <-received:
+		if !bytes.Equal(msg.Payload, []byte("hello")) {
+			t.Errorf("payload = %q, want hello", msg.Payload)
+		}
+	case <-ctx.Done():
+		t.Fatal("timed out waiting for injected message")
+	}
+
+	if _, err := conn.SendTopic(ctx, apns.TopicMadrid, []byte("outgoing")); err != nil {
+		t.Fatalf("SendTopic: %v", err)
+	}
+	sent, err := server.WaitFor(ctx, apns.CommandSendMessage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(sent.Field(apns.FieldOutgoingPayload), []byte("outgoing")) {
+		t.Errorf("sent payload = %q, want outgoing", sent.Field(apns.FieldOutgoingPayload))
+	}
+}
+
+func TestSendLargeMessage(t *testing.T) {
+	server, err := NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn := newTestConnection(t, server)
+	if err := conn.Connect(ctx); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	defer conn.Close()
+	go conn.ReadLoop(ctx)
+
+	for _, tt := range []struct {
+		size  int
+		large bool
+	}{
+		{100, false},
+		{int(server.MaxMessageSize), true},
+	} {
+		if _, err := conn.SendTopic(ctx, apns.TopicMadrid, make([]byte, tt.size)); err != nil {
+			t.Fatalf("SendTopic %d bytes: %v", tt.size, err)
+		}
+		sent, err := server.WaitFor(ctx, apns.CommandSendMessage)
+		if err != nil {
+			t.Fatal(err)
+		}
+		flags := sent.Field(apns.FieldOutgoingFlags)
+		if large := len(flags) == 1 && flags[0]&apns.OutgoingFlagLarge != 0; large != tt.large {
+			t.Errorf("%d byte payload sent with flags %x, want large %v", tt.size, flags, tt.large)
+		}
+	}
+
+	_, err = conn.SendTopic(ctx, apns.TopicMadrid, make([]byte, server.LargeMessageSize))
+	if !errors.Is(err, apns.ErrPayloadTooLarge) {
+		t.Errorf("oversized send err = %v, want ErrPayloadTooLarge", err)
+	}
+}
+
+func TestSendRejected(t *testing.T) {
+	server, err := NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	server.SendAckStatus = []byte{2}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn := newTestConnection(t, server)
+	if err := conn.Connect(ctx); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	defer conn.Close()
+	go conn.ReadLoop(ctx)
+
+	_, err = conn.SendTopic(ctx, apns.TopicMadrid, []byte("x"))
+	if err == nil {
+		t.Fatal("expected send to be rejected")
+	}
+}
+
+func TestConnectFailureLeavesDisconnected(t *testing.T) {
+	server, err := NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	server.ConnectAckStatus = []byte{2}
+	conn := newTestConnection(t, server)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := conn.Connect(ctx); err == nil {
+		t.Fatal("expected connect to be rejected")
+	}
+	if conn.Connected() {
+		t.Error("connected after a rejected connect")
+	}
+
+	// A courier that never acks times out instead of hanging
+	server.ConnectAckStatus = nil
+	server.SilentConnect = true
+	ctx, cancel = context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := conn.Connect(ctx); err == nil {
+		t.Fatal("expected connect without an ack to fail")
+	}
+	if took := time.Since(start); took > 5*time.Second {
+		t.Errorf("connect waited %v for an ack", took)
+	}
+	if conn.Connected() {
+		t.Error("connected without an ack")
+	}
+}
+
+func TestKeepAliveAndReadTimeout(t *testing.T) {
+	server, err := NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Keep-alive acks count as traffic, so the read timeout never fires
+	conn := newTestConnection(t, server)
+	conn.KeepAliveInterval = 20 * time.Millisecond
+	conn.ReadTimeout = 200 * time.Millisecond
+	if err := conn.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	loopCtx, stop := context.WithCancel(ctx)
+	loopDone := make(chan error, 1)
+	go func() { loopDone <- conn.ReadLoop(loopCtx) }()
+	for i := 0; i < 3; i++ {
+		if _, err := server.WaitFor(ctx, apns.CommandKeepAlive); err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case err := <-loopDone:
+		t.Fatalf("read loop ended with keep-alives flowing: %v", err)
+	case <-time.After(300 * time.Millisecond):
+	}
+	stop()
+	conn.Close()
+	<-loopDone
+
+	// Without keep-alives a silent connection times out
+	quiet := newTestConnection(t, server)
+	quiet.ReadTimeout = 50 * time.Millisecond
+	if err := quiet.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer quiet.Close()
+	if err := quiet.ReadLoop(ctx); err == nil || ctx.Err() != nil {
+		t.Errorf("read loop = %v, want a read timeout", err)
+	}
+}
+
+func TestDuplicatePushesHandledOnce(t *testing.T) {
+	server, err := NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn := newTestConnection(t, server)
+	received := make(chan string, 10)
+	conn.SetMessageHandler(func(ctx context.Context, payload *apns.SendMessagePayload) error {
+		received <- string(payload.Payload)
+		return nil
+	})
+	if err := conn.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	go conn.ReadLoop(ctx)
+
+	expect := func(want string) {
+		t.Helper()
+		select {
+		case got := <-received:
+			if got != want {
+				t.Fatalf("handled %q, want %q", got, want)
+			}
+		case <-ctx.Done():
+			t.Fatalf("timed out waiting for %q", want)
+		}
+	}
+	expectAck := func(id []byte) {
+		t.Helper()
+		ack, err := server.WaitFor(ctx, apns.CommandSendMessageAck)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := ack.Field(apns.FieldSendMessageAckMessageID); !bytes.Equal(got, id) {
+			t.Fatalf("acked %x, want %x", got, id)
+		}
+	}
+
+	first, second := apns.NewMessageID(), apns.NewMessageID()
+	for _, msg := range []struct {
+		id      []byte
+		payload string
+	}{{first, "one"}, {first, "one again"}, {second, "two"}} {
+		if err := server.InjectWithID(apns.TopicMadrid, []byte(msg.payload), msg.id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The redelivery on the same connection is neither handled nor acked
+	expect("one")
+	expect("two")
+	expectAck(first)
+	expectAck(second)
+
+	// After a reconnect the courier evidently lost the ack, so it's acked
+	// again, but still not handled
+	conn.Close()
+	if err := conn.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go conn.ReadLoop(ctx)
+	// The server may still be writing to the closed connection too
+	_ = server.InjectWithID(apns.TopicMadrid, []byte("one again"), first)
+	_ = server.Inject(apns.TopicMadrid, []byte("three"))
+	expect("three")
+	expectAck(first)
+	select {
+	case got := <-received:
+		t.Errorf("handled %q after the duplicate", got)
+	default:
+	}
+}
+
+func TestUnknownCommand(t *testing.T) {
+	server, err := NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn := newTestConnection(t, server)
+	unknown := make(chan *apns.Payload, 1)
+	conn.SetUnknownCommandHandler(func(payload *apns.Payload) {
+		unknown <- payload
+	})
+	if err := conn.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go conn.ReadLoop(ctx)
+
+	sent := &apns.Payload{ID: 99, Fields: []apns.Field{{ID: 1, Value: []byte{0xca, 0xfe}}, {ID: 7, Value: bytes.Repeat([]byte{1}, 300)}}}
+	if err := server.SendPayload(sent); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case got := <-unknown:
+		if got.ID != 99 || len(got.Fields) != 2 || !bytes.Equal(got.Field(1), []byte{0xca, 0xfe}) || len(got.Field(7)) != 300 {
+			t.Errorf("unknown command = %+v", got)
+		}
+	case <-ctx.Done():
+		t.Fatal("timed out waiting for the unknown command")
+	}
+}
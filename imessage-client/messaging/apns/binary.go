@@ -4,6 +4,19 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
+	"sync"
+
+	"imessage-client/messaging/wire"
+)
+
+// MaxFrameSize bounds the length of a single APNS frame. Couriers limit
+// messages to a few KiB, so anything near this is corrupt or hostile.
+const MaxFrameSize = 1 << 20
+
+// Parse errors, re-exported so callers don't need to import wire.
+var (
+	ErrTruncatedBody = wire.ErrTruncatedBody
+	ErrInvalidField  = wire.ErrInvalidField
 )
 
 // CommandID identifies different APNS commands.
@@ -37,26 +50,38 @@ type Payload struct {
 }
 
 // FindField returns the value of a field by ID, or nil if not found.
+//
+// Deprecated: use Field with a named FieldID constant.
 func (p *Payload) FindField(fieldID uint8) []byte {
+	return p.Field(FieldID(fieldID))
+}
+
+// Size returns the serialized length of the payload.
+func (p *Payload) Size() int {
+	length := 5 // 1 byte cmd + 4 bytes length
 	for _, field := range p.Fields {
-		if field.ID == FieldID(fieldID) {
-			return field.Value
-		}
+		length += 3 + len(field.Value) // 1 byte ID + 2 bytes length + value
 	}
-	return nil
+	return length
 }
 
 // ToBytes serializes the payload to binary format.
 // Format: [CommandID:1][Length:4][Fields...]
 // Each field: [FieldID:1][FieldLength:2][FieldValue...]
 func (p *Payload) ToBytes() []byte {
-	// Calculate total length
-	length := 5 // 1 byte cmd + 4 bytes length
-	for _, field := range p.Fields {
-		length += 3 + len(field.Value) // 1 byte ID + 2 bytes length + value
-	}
+	return p.AppendBytes(make([]byte, 0, p.Size()))
+}
 
-	payload := make([]byte, length)
+// AppendBytes appends the serialized payload to dst and returns the extended slice.
+func (p *Payload) AppendBytes(dst []byte) []byte {
+	length := p.Size()
+	start := len(dst)
+	if cap(dst)-start < length {
+		grown := make([]byte, start, start+length)
+		copy(grown, dst)
+		dst = grown
+	}
+	payload := dst[start : start+length]
 	payload[0] = byte(p.ID)
 	binary.BigEndian.PutUint32(payload[1:5], uint32(length-5))
 
@@ -68,7 +93,78 @@ func (p *Payload) ToBytes() []byte {
 		ptr += 3 + len(field.Value)
 	}
 
-	return payload
+	return dst[:start+length]
+}
+
+// defaultBufferSize covers the regular APNS message size limit.
+const defaultBufferSize = 4 * 1024
+
+// maxPooledBufferSize stops oversized buffers from being kept in the pool.
+const maxPooledBufferSize = 64 * 1024
+
+var bufferPool = sync.Pool{
+	New: func() any {
+		buf := make([]byte, 0, defaultBufferSize)
+		return &buf
+	},
+}
+
+func getBuffer() *[]byte {
+	buf := bufferPool.Get().(*[]byte)
+	*buf = (*buf)[:0]
+	return buf
+}
+
+func putBuffer(buf *[]byte) {
+	if cap(*buf) > maxPooledBufferSize {
+		return
+	}
+	bufferPool.Put(buf)
+}
+
+// Reader decodes payloads from a stream, reusing its buffers between frames.
+// The payload returned by Next, including field values, is only valid until
+// the next call to Next.
+type Reader struct {
+	r       io.Reader
+	header  [5]byte
+	buf     []byte
+	payload Payload
+}
+
+// NewReader creates a Reader over r.
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: r, buf: make([]byte, 0, defaultBufferSize)}
+}
+
+// Next reads the next payload from the stream.
+func (r *Reader) Next() (*Payload, error) {
+	r.payload.Fields = r.payload.Fields[:0]
+	if _, err := io.ReadFull(r.r, r.header[:1]); err != nil {
+		return nil, err
+	}
+	r.payload.ID = CommandID(r.header[0])
+	if r.payload.ID == 0 {
+		return &r.payload, nil
+	}
+	if _, err := io.ReadFull(r.r, r.header[1:5]); err != nil {
+		return nil, err
+	}
+	length, err := checkFrameLength(binary.BigEndian.Uint32(r.header[1:5]))
+	if err != nil {
+		return nil, err
+	}
+	if cap(r.buf) < length {
+		r.buf = make([]byte, length)
+	}
+	data := r.buf[:length]
+	if _, err := io.ReadFull(r.r, data); err != nil {
+		return nil, err
+	}
+	if err := r.payload.unmarshalFieldsFromBytes(data); err != nil {
+		return nil, err
+	}
+	return &r.payload, nil
 }
 
 // UnmarshalBinaryStream reads a payload from a stream.
@@ -87,7 +183,10 @@ func (p *Payload) UnmarshalBinaryStream(reader io.Reader) error {
 	if _, err := io.ReadFull(reader, readBuf); err != nil {
 		return err
 	}
-	length := binary.BigEndian.Uint32(readBuf)
+	length, err := checkFrameLength(binary.BigEndian.Uint32(readBuf))
+	if err != nil {
+		return err
+	}
 
 	// Read full payload
 	data := make([]byte, length)
@@ -98,37 +197,60 @@ func (p *Payload) UnmarshalBinaryStream(reader io.Reader) error {
 	return p.unmarshalFieldsFromBytes(data)
 }
 
-// UnmarshalBinary deserializes a payload from binary format.
+// UnmarshalBinary deserializes a payload from binary format. Field values
+// alias data.
 func (p *Payload) UnmarshalBinary(data []byte) error {
-	if len(data) == 0 {
-		return fmt.Errorf("empty payload")
+	r := wire.NewReader(data)
+	id, err := r.Byte("command")
+	if err != nil {
+		return err
 	}
-	p.ID = CommandID(data[0])
+	p.ID = CommandID(id)
 	if p.ID == 0 {
 		return nil
 	}
-	if len(data) < 5 {
-		return fmt.Errorf("invalid payload length")
+	rawLength, err := r.Uint32("payload length")
+	if err != nil {
+		return err
+	}
+	length, err := checkFrameLength(rawLength)
+	if err != nil {
+		return err
+	}
+	fields, err := r.Bytes(length, "payload")
+	if err != nil {
+		return err
 	}
-	length := binary.BigEndian.Uint32(data[1:5])
-	return p.unmarshalFieldsFromBytes(data[5 : 5+length])
+	return p.unmarshalFieldsFromBytes(fields)
 }
 
-// unmarshalFieldsFromBytes parses TLV fields from bytes.
+// checkFrameLength rejects frame lengths no courier would send before
+// anything is allocated for them.
+func checkFrameLength(length uint32) (int, error) {
+	if length > MaxFrameSize {
+		return 0, wire.InvalidFieldError{Field: "payload length", Reason: fmt.Sprintf("%d exceeds %d", length, MaxFrameSize)}
+	}
+	return int(length), nil
+}
+
+// unmarshalFieldsFromBytes parses TLV fields from bytes. Every byte must
+// belong to a field; trailing garbage is reported as ErrTruncatedBody.
 func (p *Payload) unmarshalFieldsFromBytes(data []byte) error {
-	i := 0
-	for i+3 <= len(data) {
-		var field Field
-		field.ID = FieldID(data[i])
-		fieldLength := int(binary.BigEndian.Uint16(data[i+1 : i+3]))
-
-		if i+3+fieldLength > len(data) {
-			return fmt.Errorf("invalid field length")
+	r := wire.NewReader(data)
+	for r.Len() > 0 {
+		id, err := r.Byte("field ID")
+		if err != nil {
+			return err
 		}
-
-		field.Value = data[i+3 : i+3+fieldLength]
-		i += 3 + fieldLength
-		p.Fields = append(p.Fields, field)
+		length, err := r.Uint16("field length")
+		if err != nil {
+			return err
+		}
+		value, err := r.Bytes(int(length), fmt.Sprintf("field %d", id))
+		if err != nil {
+			return err
+		}
+		p.Fields = append(p.Fields, Field{ID: FieldID(id), Value: value})
 	}
 	return nil
 }
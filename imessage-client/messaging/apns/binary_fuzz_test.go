@@ -0,0 +1,48 @@
+package apns
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func FuzzUnmarshalBinary(f *testing.F) {
+	f.Add((&Payload{ID: CommandKeepAlive}).ToBytes())
+	f.Add((&Payload{ID: CommandSendMessage, Fields: []Field{
+		StringField(FieldIncomingTopic, "topic"),
+		{ID: FieldIncomingPayload, Value: []byte{1, 2, 3}},
+	}}).ToBytes())
+	f.Add([]byte{byte(CommandSendMessage), 0xff, 0xff, 0xff, 0xff})
+	f.Add([]byte{byte(CommandSendMessage), 0, 0, 0, 2, 1, 0})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var p Payload
+		err := p.UnmarshalBinary(data)
+		if err != nil {
+			if !errors.Is(err, ErrTruncatedBody) && !errors.Is(err, ErrInvalidField) {
+				t.Fatalf("untyped error: %v", err)
+			}
+			return
+		}
+		if p.ID == 0 {
+			return
+		}
+		// A successfully parsed payload must re-encode to the bytes it came from
+		encoded := p.ToBytes()
+		if !bytes.Equal(encoded, data[:len(encoded)]) {
+			t.Fatalf("round trip mismatch: %x != %x", encoded, data[:len(encoded)])
+		}
+
+		var streamed Payload
+		if err := streamed.UnmarshalBinaryStream(bytes.NewReader(data)); err != nil {
+			t.Fatalf("stream parse failed where UnmarshalBinary succeeded: %v", err)
+		}
+		next, err := NewReader(bytes.NewReader(data)).Next()
+		if err != nil {
+			t.Fatalf("Reader failed where UnmarshalBinary succeeded: %v", err)
+		}
+		if !bytes.Equal(next.ToBytes(), encoded) {
+			t.Fatal("Reader result differs from UnmarshalBinary")
+		}
+	})
+}
@@ -0,0 +1,131 @@
+package apns
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestPayloadRoundTrip(t *testing.T) {
+	orig := &Payload{
+		ID: CommandSendMessage,
+		Fields: []Field{
+			StringField(FieldIncomingTopic, "topic"),
+			{ID: FieldIncomingPayload, Value: []byte{1, 2, 3}},
+			Uint32Field(FieldIncomingExpiration, 0xffffffff),
+			Uint64Field(FieldIncomingTimestamp, 1700000000123456789),
+		},
+	}
+	data := orig.ToBytes()
+	if len(data) != orig.Size() {
+		t.Fatalf("ToBytes length %d, Size %d", len(data), orig.Size())
+	}
+
+	var parsed Payload
+	if err := parsed.UnmarshalBinary(data); err != nil {
+		t.Fatalf("UnmarshalBinary: %v", err)
+	}
+	assertPayloadEqual(t, orig, &parsed)
+
+	var streamed Payload
+	if err := streamed.UnmarshalBinaryStream(bytes.NewReader(data)); err != nil {
+		t.Fatalf("UnmarshalBinaryStream: %v", err)
+	}
+	assertPayloadEqual(t, orig, &streamed)
+}
+
+func TestReaderReusesBuffers(t *testing.T) {
+	first := &Payload{ID: CommandKeepAlive}
+	second := &Payload{ID: CommandSetState, Fields: []Field{
+		Uint8Field(FieldSetStateState, 1),
+		Uint32Field(FieldSetStateFieldTwo, 0x7fffffff),
+	}}
+	stream := append(first.ToBytes(), second.ToBytes()...)
+
+	r := NewReader(bytes.NewReader(stream))
+	got, err := r.Next()
+	if err != nil {
+		t.Fatalf("Next: %v", err)
+	}
+	assertPayloadEqual(t, first, got)
+	got, err = r.Next()
+	if err != nil {
+		t.Fatalf("Next: %v", err)
+	}
+	assertPayloadEqual(t, second, got)
+}
+
+func TestAppendBytes(t *testing.T) {
+	p := &Payload{ID: CommandKeepAlive, Fields: []Field{StringField(1, "x")}}
+	prefix := []byte{0xaa}
+	out := p.AppendBytes(prefix)
+	if out[0] != 0xaa || !bytes.Equal(out[1:], p.ToBytes()) {
+		t.Fatalf("AppendBytes produced %x", out)
+	}
+}
+
+func TestTypedGetters(t *testing.T) {
+	p := &Payload{Fields: []Field{
+		Uint8Field(1, 7),
+		Uint16Field(2, 4096),
+		Uint32Field(3, 0xdeadbeef),
+		Uint64Field(4, 1700000000000),
+		StringField(5, "hello"),
+	}}
+	if v, ok := p.GetUint8(1); !ok || v != 7 {
+		t.Errorf("GetUint8 = %d, %v", v, ok)
+	}
+	if v, ok := p.GetUint16(2); !ok || v != 4096 {
+		t.Errorf("GetUint16 = %d, %v", v, ok)
+	}
+	if v, ok := p.GetUint32(3); !ok || v != 0xdeadbeef {
+		t.Errorf("GetUint32 = %x, %v", v, ok)
+	}
+	if v, ok := p.GetString(5); !ok || v != "hello" {
+		t.Errorf("GetString = %q, %v", v, ok)
+	}
+	ts, ok := p.GetTimestamp(4, time.Millisecond)
+	if !ok || !ts.Equal(time.UnixMilli(1700000000000)) {
+		t.Errorf("GetTimestamp = %v, %v", ts, ok)
+	}
+	if _, ok := p.GetUint64(5); ok {
+		t.Error("GetUint64 accepted a short field")
+	}
+	if _, ok := p.GetString(9); ok {
+		t.Error("GetString found a missing field")
+	}
+}
+
+func TestConnectAckFromPayload(t *testing.T) {
+	p := &Payload{ID: CommandConnectAck, Fields: []Field{
+		Uint8Field(FieldConnectAckStatus, 0),
+		{ID: FieldConnectAckToken, Value: []byte("token")},
+		Uint16Field(FieldConnectAckMaxMessageSize, 4096),
+		Uint16Field(FieldConnectAckLargeMessageSize, 15360),
+		Uint64Field(FieldConnectAckServerTimestamp, 1234),
+	}}
+	var parsed Payload
+	if err := parsed.UnmarshalBinary(p.ToBytes()); err != nil {
+		t.Fatalf("UnmarshalBinary: %v", err)
+	}
+	var ack ConnectAckCommand
+	ack.FromPayload(&parsed)
+	if string(ack.Token) != "token" || ack.MaxMessageSize != 4096 || ack.LargeMessageSize != 15360 || ack.ServerTimestamp != 1234 {
+		t.Fatalf("unexpected ack: %+v", ack)
+	}
+}
+
+func assertPayloadEqual(t *testing.T, want, got *Payload) {
+	t.Helper()
+	if want.ID != got.ID {
+		t.Fatalf("command ID: want %d, got %d", want.ID, got.ID)
+	}
+	if len(want.Fields) != len(got.Fields) {
+		t.Fatalf("field count: want %d, got %d", len(want.Fields), len(got.Fields))
+	}
+	for i := range want.Fields {
+		if want.Fields[i].ID != got.Fields[i].ID || !bytes.Equal(want.Fields[i].Value, got.Fields[i].Value) {
+			t.Fatalf("field %d: want %d=%x, got %d=%x", i, want.Fields[i].ID, want.Fields[i].Value, got.Fields[i].ID, got.Fields[i].Value)
+		}
+	}
+}
@@ -1,5 +1,11 @@
 package apns
 
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
 // ConnectCommand is sent to establish APNS connection.
 type ConnectCommand struct {
 	DeviceToken []byte
@@ -15,12 +21,12 @@ func (c *ConnectCommand) ToPayload() *Payload {
 	return &Payload{
 		ID: CommandConnect,
 		Fields: []Field{
-			{ID: 1, Value: c.DeviceToken},
-			{ID: 2, Value: c.State},
-			{ID: 5, Value: c.Flags.ToBytes()},
-			{ID: 12, Value: c.Cert},
-			{ID: 13, Value: c.Nonce},
-			{ID: 14, Value: c.Signature},
+			{ID: FieldConnectDeviceToken, Value: c.DeviceToken},
+			{ID: FieldConnectState, Value: c.State},
+			{ID: FieldConnectFlags, Value: c.Flags.ToBytes()},
+			{ID: FieldConnectCert, Value: c.Cert},
+			{ID: FieldConnectNonce, Value: c.Nonce},
+			{ID: FieldConnectSignature, Value: c.Signature},
 		},
 	}
 }
@@ -38,67 +44,119 @@ type ConnectAckCommand struct {
 
 // FromPayload parses ConnectAckCommand from payload.
 func (c *ConnectAckCommand) FromPayload(p *Payload) {
-	c.Status = p.FindField(1)
-	c.Token = p.FindField(3)
-	if val := p.FindField(4); len(val) >= 2 {
-		c.MaxMessageSize = uint16(val[0])<<8 | uint16(val[1])
+	c.Status = p.Field(FieldConnectAckStatus)
+	c.Token = p.Field(FieldConnectAckToken)
+	c.MaxMessageSize, _ = p.GetUint16(FieldConnectAckMaxMessageSize)
+	c.Unknown5 = p.Field(FieldConnectAckUnknown5)
+	c.Capabilities = p.Field(FieldConnectAckCapabilities)
+	c.LargeMessageSize, _ = p.GetUint16(FieldConnectAckLargeMessageSize)
+	c.ServerTimestamp, _ = p.GetUint64(FieldConnectAckServerTimestamp)
+}
+
+// ToPayload converts ConnectAckCommand to binary payload.
+func (c *ConnectAckCommand) ToPayload() *Payload {
+	p := &Payload{ID: CommandConnectAck}
+	p.Fields = append(p.Fields, Field{ID: FieldConnectAckStatus, Value: c.Status})
+	if c.Token != nil {
+		p.Fields = append(p.Fields, Field{ID: FieldConnectAckToken, Value: c.Token})
+	}
+	if c.MaxMessageSize > 0 {
+		p.Fields = append(p.Fields, Uint16Field(FieldConnectAckMaxMessageSize, c.MaxMessageSize))
 	}
-	c.Unknown5 = p.FindField(5)
-	c.Capabilities = p.FindField(6)
-	if val := p.FindField(8); len(val) >= 2 {
-		c.LargeMessageSize = uint16(val[0])<<8 | uint16(val[1])
+	if c.LargeMessageSize > 0 {
+		p.Fields = append(p.Fields, Uint16Field(FieldConnectAckLargeMessageSize, c.LargeMessageSize))
 	}
-	if val := p.FindField(10); len(val) >= 8 {
-		c.ServerTimestamp = uint64(val[0])<<56 | uint64(val[1])<<48 |
-			uint64(val[2])<<40 | uint64(val[3])<<32 |
-			uint64(val[4])<<24 | uint64(val[5])<<16 |
-			uint64(val[6])<<8 | uint64(val[7])
+	if c.ServerTimestamp > 0 {
+		p.Fields = append(p.Fields, Uint64Field(FieldConnectAckServerTimestamp, c.ServerTimestamp))
 	}
+	return p
 }
 
-// FilterTopicsCommand subscribes to specific APNS topics.
+// FilterTopicsCommand tells the courier which topics to deliver. All lists
+// hold SHA1 hashes of topic strings.
 type FilterTopicsCommand struct {
-	Token  []byte
-	Topics [][]byte // SHA1 hashes of topic strings
+	Token         []byte
+	Topics        [][]byte // enabled: delivered immediately
+	Ignored       [][]byte // never delivered
+	Opportunistic [][]byte // delivered when the connection is already awake
+	Paused        [][]byte // held by the courier until re-enabled
 }
 
 // ToPayload converts FilterTopicsCommand to binary payload.
 func (f *FilterTopicsCommand) ToPayload() *Payload {
 	fields := []Field{
-		{ID: 1, Value: f.Token},
-	}
-	for _, topic := range f.Topics {
-		fields = append(fields, Field{ID: 2, Value: topic})
+		{ID: FieldFilterTopicsToken, Value: f.Token},
 	}
+	fields = appendTopicFields(fields, FieldFilterTopicsTopic, f.Topics)
+	fields = appendTopicFields(fields, FieldFilterTopicsIgnored, f.Ignored)
+	fields = appendTopicFields(fields, FieldFilterTopicsOpportunistic, f.Opportunistic)
+	fields = appendTopicFields(fields, FieldFilterTopicsPaused, f.Paused)
 	return &Payload{
 		ID:     CommandFilterTopics,
 		Fields: fields,
 	}
 }
 
+func appendTopicFields(fields []Field, id FieldID, topics [][]byte) []Field {
+	for _, topic := range topics {
+		fields = append(fields, Field{ID: id, Value: topic})
+	}
+	return fields
+}
+
+// ConnectionState tells the courier how eagerly to deliver to this connection.
+type ConnectionState uint8
+
+const (
+	// StateActive is a foreground client that wants every push immediately.
+	StateActive ConnectionState = 1
+	// StateBackground lets the courier batch or hold low-priority pushes (uncertain).
+	StateBackground ConnectionState = 2
+)
+
+func (s ConnectionState) String() string {
+	switch s {
+	case StateActive:
+		return "active"
+	case StateBackground:
+		return "background"
+	default:
+		return fmt.Sprintf("unknown(%d)", uint8(s))
+	}
+}
+
+// DefaultStateFieldTwo is the value Apple clients send in SetState field 2.
+// Its meaning is unknown.
+const DefaultStateFieldTwo uint32 = 0x7fffffff
+
 // SetStateCommand sets connection state.
 type SetStateCommand struct {
-	State    uint8
+	State    ConnectionState
 	FieldTwo uint32
 }
 
 // ToPayload converts SetStateCommand to binary payload.
 func (s *SetStateCommand) ToPayload() *Payload {
-	fieldTwo := make([]byte, 4)
-	fieldTwo[0] = byte(s.FieldTwo >> 24)
-	fieldTwo[1] = byte(s.FieldTwo >> 16)
-	fieldTwo[2] = byte(s.FieldTwo >> 8)
-	fieldTwo[3] = byte(s.FieldTwo)
-
+	fieldTwo := s.FieldTwo
+	if fieldTwo == 0 {
+		fieldTwo = DefaultStateFieldTwo
+	}
 	return &Payload{
 		ID: CommandSetState,
 		Fields: []Field{
-			{ID: 1, Value: []byte{s.State}},
-			{ID: 2, Value: fieldTwo},
+			Uint8Field(FieldSetStateState, uint8(s.State)),
+			Uint32Field(FieldSetStateFieldTwo, fieldTwo),
 		},
 	}
 }
 
+// FromPayload parses SetStateCommand from payload.
+func (s *SetStateCommand) FromPayload(p *Payload) {
+	state, _ := p.GetUint8(FieldSetStateState)
+	s.State = ConnectionState(state)
+	s.FieldTwo, _ = p.GetUint32(FieldSetStateFieldTwo)
+}
+
 // IncomingSendMessageCommand is received when a message arrives.
 type IncomingSendMessageCommand struct {
 	MessageID  []byte
@@ -112,13 +170,54 @@ type IncomingSendMessageCommand struct {
 
 // FromPayload parses IncomingSendMessageCommand from payload.
 func (i *IncomingSendMessageCommand) FromPayload(p *Payload) {
-	i.Token = p.FindField(1)
-	i.Topic = p.FindField(2)
-	i.Payload = p.FindField(3)
-	i.MessageID = p.FindField(4)
-	i.Expiration = p.FindField(5)
-	i.Timestamp = p.FindField(6)
-	i.Unknown7 = p.FindField(7)
+	i.Token = p.Field(FieldIncomingToken)
+	i.Topic = p.Field(FieldIncomingTopic)
+	i.Payload = p.Field(FieldIncomingPayload)
+	i.MessageID = p.Field(FieldIncomingMessageID)
+	i.Expiration = p.Field(FieldIncomingExpiration)
+	i.Timestamp = p.Field(FieldIncomingTimestamp)
+	i.Unknown7 = p.Field(FieldIncomingUnknown7)
+}
+
+// ExpiresAt returns when the courier considers the message stale. It's zero
+// if the courier didn't say or the message never expires.
+func (i *IncomingSendMessageCommand) ExpiresAt() time.Time {
+	if len(i.Expiration) != 4 {
+		return time.Time{}
+	}
+	secs := binary.BigEndian.Uint32(i.Expiration)
+	if secs == 0 || secs == 0xffffffff {
+		return time.Time{}
+	}
+	return time.Unix(int64(secs), 0)
+}
+
+// ToPayload converts IncomingSendMessageCommand to binary payload, as the
+// courier would send it.
+func (i *IncomingSendMessageCommand) ToPayload() *Payload {
+	p := &Payload{ID: CommandSendMessage}
+	for _, field := range []Field{
+		{ID: FieldIncomingToken, Value: i.Token},
+		{ID: FieldIncomingTopic, Value: i.Topic},
+		{ID: FieldIncomingPayload, Value: i.Payload},
+		{ID: FieldIncomingMessageID, Value: i.MessageID},
+		{ID: FieldIncomingExpiration, Value: i.Expiration},
+		{ID: FieldIncomingTimestamp, Value: i.Timestamp},
+		{ID: FieldIncomingUnknown7, Value: i.Unknown7},
+	} {
+		if field.Value != nil {
+			p.Fields = append(p.Fields, field)
+		}
+	}
+	return p
+}
+
+// SentAt returns the server timestamp of the message, if present.
+func (i *IncomingSendMessageCommand) SentAt() (time.Time, bool) {
+	if len(i.Timestamp) < 8 {
+		return time.Time{}, false
+	}
+	return time.Unix(0, int64(binary.BigEndian.Uint64(i.Timestamp))), true
 }
 
 // KeepAliveCommand is sent/received to maintain connection.
@@ -1,6 +1,7 @@
 package apns
 
 import (
+	"bytes"
 	"context"
 	"crypto"
 	"crypto/rand"
@@ -10,11 +11,18 @@ import (
 	"crypto/x509"
 	"errors"
 	"fmt"
-	mathrand "math/rand"
+	"log/slog"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
+
+	"imessage-client/messaging/trace"
 )
 
+// connectTimeout bounds sending the connect command and waiting for its ack.
+const connectTimeout = 30 * time.Second
+
 var (
 	ErrNotConnected = errors.New("not connected to APNS")
 	ErrNoToken      = errors.New("no push token available")
@@ -27,6 +35,19 @@ type MessageHandler func(ctx context.Context, payload *SendMessagePayload) error
 type SendMessagePayload struct {
 	Topic   string
 	Payload []byte
+	// Expiration is when the courier considers the payload stale. Zero if
+	// it never expires.
+	Expiration time.Time
+}
+
+// TopicName returns the name of the topic the payload was pushed on.
+func (p *SendMessagePayload) TopicName() string {
+	return TopicName([]byte(p.Topic))
+}
+
+// Expired reports whether the payload's expiration has passed at now.
+func (p *SendMessagePayload) Expired(now time.Time) bool {
+	return !p.Expiration.IsZero() && now.After(p.Expiration)
 }
 
 // Connection represents an APNS courier connection for iMessage.
@@ -35,11 +56,63 @@ type Connection struct {
 	deviceCert *x509.Certificate
 	token      []byte
 
+	// NoAutoFlush disables flushing the offline queue after filtering topics
+	// and when the courier asks for it.
+	NoAutoFlush bool
+
+	// Addr overrides the courier address, e.g. to connect to a test courier.
+	// By default a random Apple courier host is used.
+	Addr string
+	// TLSConfig overrides the TLS configuration used to dial the courier.
+	TLSConfig *tls.Config
+	// Ports selects the courier ports to try when Addr isn't set.
+	Ports PortPolicy
+	// ParallelDials is how many courier hosts are raced when Addr isn't
+	// set. Defaults to DefaultParallelDials.
+	ParallelDials int
+	// Couriers, if set, receives connect and keep-alive round trip times
+	// and steers Connect towards the fastest courier hosts.
+	Couriers *CourierStats
+
+	// KeepAliveInterval is how often ReadLoop sends a keep-alive. Zero
+	// leaves it to the courier.
+	KeepAliveInterval time.Duration
+	// ReadTimeout fails ReadLoop if nothing arrives for this long, so a
+	// connection that died silently is noticed. It should be longer than
+	// KeepAliveInterval, whose acks count as traffic. Zero waits forever.
+	ReadTimeout time.Duration
+	// DuplicateWindow is how long incoming message IDs are remembered so a
+	// redelivered message isn't handled twice. Defaults to
+	// DefaultDuplicateWindow; negative turns it off.
+	DuplicateWindow time.Duration
+
+	// settingsLock guards the settings Configure changes, which a read loop
+	// from an earlier connect may still be reading.
+	settingsLock sync.Mutex
+
 	conn           net.Conn
+	host           string
+	reader         *Reader
+	writeLock      sync.Mutex
 	messageHandler MessageHandler
+	unknownHandler UnknownCommandHandler
+
+	pendingAcks map[uint32]chan *SendMessageAckCommand
+	acksLock    sync.Mutex
+
+	state     ConnectionState
+	stateLock sync.Mutex
 
 	maxMessageSize      int
 	maxLargeMessageSize int
+
+	// keepAliveSent is when the unanswered keep-alive was sent, in Unix
+	// nanoseconds, or zero.
+	keepAliveSent atomic.Int64
+
+	recent recentPushes
+
+	tracer *trace.Recorder
 }
 
 // NewConnection creates a new APNS connection.
@@ -48,6 +121,7 @@ func NewConnection(privateKey *rsa.PrivateKey, deviceCert *x509.Certificate, tok
 		privateKey:          privateKey,
 		deviceCert:          deviceCert,
 		token:               token,
+		pendingAcks:         make(map[uint32]chan *SendMessageAckCommand),
 		maxMessageSize:      4 * 1024,
 		maxLargeMessageSize: 15 * 1024,
 	}
@@ -58,6 +132,25 @@ func (c *Connection) SetMessageHandler(handler MessageHandler) {
 	c.messageHandler = handler
 }
 
+// Configure sets KeepAliveInterval, ReadTimeout, Ports and Couriers. Unlike
+// setting the fields directly, it's safe while the read loop of an earlier
+// connect is still winding down; the settings apply from the next Connect.
+func (c *Connection) Configure(keepAlive, readTimeout time.Duration, ports PortPolicy, couriers *CourierStats) {
+	c.settingsLock.Lock()
+	defer c.settingsLock.Unlock()
+	c.KeepAliveInterval = keepAlive
+	c.ReadTimeout = readTimeout
+	c.Ports = ports
+	c.Couriers = couriers
+}
+
+// loopSettings returns the settings a read loop runs with.
+func (c *Connection) loopSettings() (keepAlive, readTimeout time.Duration, couriers *CourierStats) {
+	c.settingsLock.Lock()
+	defer c.settingsLock.Unlock()
+	return c.KeepAliveInterval, c.ReadTimeout, c.Couriers
+}
+
 // Connect establishes a TLS connection to Apple's push courier.
 func (c *Connection) Connect(ctx context.Context) error {
 	if c.privateKey == nil || c.deviceCert == nil {
@@ -67,29 +160,26 @@ func (c *Connection) Connect(ctx context.Context) error {
 		return ErrNoToken
 	}
 
-	// Get courier hostname (randomly select from 1-50)
-	hostNum := mathrand.Intn(CourierHostCount) + 1
-	host := fmt.Sprintf("%d-%s", hostNum, CourierHostname)
-	addr := fmt.Sprintf("%s:%d", host, CourierPort)
-
 	// Setup TLS config
-	tlsConfig := &tls.Config{
-		ServerName: CourierHostname,
-		NextProtos: []string{"apns-security-v3"},
-		MinVersion: tls.VersionTLS12,
+	tlsConfig := c.TLSConfig
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{
+			ServerName: CourierHostname,
+			NextProtos: []string{"apns-security-v3"},
+			MinVersion: tls.VersionTLS12,
+		}
 	}
 
-	// Connect with TLS
-	dialer := &tls.Dialer{Config: tlsConfig}
-	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	// Connect with TLS, falling back to port 443 if allowed
+	conn, host, err := c.dialCourier(ctx, tlsConfig)
 	if err != nil {
 		return fmt.Errorf("failed to dial APNS: %w", err)
 	}
-	c.conn = conn
 
 	// Send connect command with signed nonce
 	nonce := make([]byte, 20)
 	if _, err := rand.Read(nonce); err != nil {
+		conn.Close()
 		return fmt.Errorf("failed to generate nonce: %w", err)
 	}
 	nonce[0] = 0 // First byte must be 0
@@ -97,6 +187,7 @@ func (c *Connection) Connect(ctx context.Context) error {
 	sum := sha1.Sum(nonce)
 	signature, err := rsa.SignPKCS1v15(nil, c.privateKey, crypto.SHA1, sum[:])
 	if err != nil {
+		conn.Close()
 		return fmt.Errorf("failed to sign nonce: %w", err)
 	}
 
@@ -110,18 +201,15 @@ func (c *Connection) Connect(ctx context.Context) error {
 		Signature:   append([]byte{0x1, 0x1}, signature...),
 	}
 
-	// Send connect
-	if err := c.write(connectCmd.ToPayload().ToBytes()); err != nil {
-		return fmt.Errorf("failed to send connect command: %w", err)
-	}
-
-	// Wait for connect ack
-	payload, err := c.readPayload()
+	// Send connect and wait for the ack before anyone else can use conn
+	payload, err := c.connectHandshake(ctx, conn, connectCmd.ToPayload())
 	if err != nil {
-		return fmt.Errorf("failed to read connect ack: %w", err)
+		conn.Close()
+		return err
 	}
 
 	if payload.ID != CommandConnectAck {
+		conn.Close()
 		return fmt.Errorf("unexpected response to connect: command %d", payload.ID)
 	}
 
@@ -130,6 +218,7 @@ func (c *Connection) Connect(ctx context.Context) error {
 
 	// Check status (0 = success, 2 = error)
 	if len(ack.Status) > 0 && ack.Status[0] != 0 {
+		conn.Close()
 		return fmt.Errorf("connection rejected by APNS, status: %x", ack.Status)
 	}
 
@@ -144,45 +233,80 @@ func (c *Connection) Connect(ctx context.Context) error {
 		c.maxLargeMessageSize = int(ack.LargeMessageSize)
 	}
 
+	c.writeLock.Lock()
+	c.conn = conn
+	c.host = host
+	c.writeLock.Unlock()
+	c.keepAliveSent.Store(0)
+	c.reader = NewReader(conn)
+
 	return nil
 }
 
 // Filter subscribes to specific APNS topics.
 func (c *Connection) Filter(topics ...Topic) error {
-	if c.conn == nil {
-		return ErrNotConnected
-	}
+	return c.FilterTopics(TopicFilter{Enabled: topics})
+}
 
-	sha1Topics := make([][]byte, len(topics))
-	for i, topic := range topics {
-		hashed := sha1.Sum([]byte(topic))
-		sha1Topics[i] = hashed[:]
+// FilterTopics sends the full topic filter, replacing any previous one.
+func (c *Connection) FilterTopics(filter TopicFilter) error {
+	if !c.Connected() {
+		return ErrNotConnected
 	}
 
 	cmd := &FilterTopicsCommand{
-		Token:  c.token,
-		Topics: sha1Topics,
+		Token:         c.token,
+		Topics:        hashTopics(filter.Enabled),
+		Ignored:       hashTopics(filter.Ignored),
+		Opportunistic: hashTopics(filter.Opportunistic),
+		Paused:        hashTopics(filter.Paused),
 	}
 
-	return c.write(cmd.ToPayload().ToBytes())
+	return c.writePayload(cmd.ToPayload())
 }
 
 // SetState sets the connection state.
-func (c *Connection) SetState(state uint8) error {
-	if c.conn == nil {
+func (c *Connection) SetState(state ConnectionState) error {
+	if !c.Connected() {
 		return ErrNotConnected
 	}
 
-	cmd := &SetStateCommand{
-		State:    state,
-		FieldTwo: 0x7fffffff,
+	cmd := &SetStateCommand{State: state}
+	if err := c.writePayload(cmd.ToPayload()); err != nil {
+		return err
 	}
+	c.stateLock.Lock()
+	c.state = state
+	c.stateLock.Unlock()
+	return nil
+}
 
-	return c.write(cmd.ToPayload().ToBytes())
+// State returns the last state sent with SetState, or 0 if none was sent.
+func (c *Connection) State() ConnectionState {
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+	return c.state
 }
 
 // ReadLoop continuously reads and processes incoming messages.
+// Frames are decoded into reused buffers, so anything handed to the
+// message handler is copied out first.
 func (c *Connection) ReadLoop(ctx context.Context) error {
+	// Keep reading the connection this loop was started for, even if Close
+	// and Connect swap in a new one
+	reader := c.reader
+	c.writeLock.Lock()
+	conn := c.conn
+	c.writeLock.Unlock()
+	if reader == nil || conn == nil {
+		return ErrNotConnected
+	}
+	keepAliveInterval, readTimeout, couriers := c.loopSettings()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if keepAliveInterval > 0 {
+		go c.keepAlive(ctx, conn, keepAliveInterval)
+	}
 	for {
 		select {
 		case <-ctx.Done():
@@ -190,51 +314,163 @@ func (c *Connection) ReadLoop(ctx context.Context) error {
 		default:
 		}
 
-		payload, err := c.readPayload()
+		if readTimeout > 0 {
+			if err := conn.SetReadDeadline(time.Now().Add(readTimeout)); err != nil {
+				return fmt.Errorf("failed to set read deadline: %w", err)
+			}
+		}
+		payload, err := reader.Next()
 		if err != nil {
 			return fmt.Errorf("failed to read payload: %w", err)
 		}
+		c.traceFrame(trace.In, payload)
 
 		switch payload.ID {
 		case CommandSendMessage:
+			var msg IncomingSendMessageCommand
+			msg.FromPayload(payload)
+			if !c.NoAutoFlush && isFlushRequest(&msg) {
+				// SendMessage waits for an ack read by this loop, so don't block it
+				go c.flushQueue()
+			}
+			window := c.duplicateWindow()
+			if window > 0 && len(msg.MessageID) > 0 {
+				if ackedOn, ok := c.recent.lookup(msg.MessageID, window, time.Now()); ok {
+					slog.Debug("Dropping duplicate push", "topic", TopicName(msg.Topic), "message_id", fmt.Sprintf("%x", msg.MessageID))
+					// The ack is still on its way unless the courier
+					// redelivered after a reconnect, meaning it never arrived
+					if ackedOn != conn {
+						if err := c.ackIncoming(&msg); err != nil {
+							return fmt.Errorf("failed to ack message: %w", err)
+						}
+						c.recent.add(msg.MessageID, conn, window, time.Now())
+					}
+					continue
+				}
+				// Remembered before handling, so a message whose ack was
+				// lost with the connection isn't handled again either
+				c.recent.add(msg.MessageID, nil, window, time.Now())
+			}
 			if c.messageHandler != nil {
-				var msg IncomingSendMessageCommand
-				msg.FromPayload(payload)
 
 				msgPayload := &SendMessagePayload{
-					Topic:   string(msg.Topic),
-					Payload: msg.Payload,
+					Topic:      string(msg.Topic),
+					Payload:    bytes.Clone(msg.Payload),
+					Expiration: msg.ExpiresAt(),
 				}
 
 				if err := c.messageHandler(ctx, msgPayload); err != nil {
-					fmt.Printf("Error handling message: %v\n", err)
+					slog.Warn("Error handling message", "err", err)
 				}
 			}
+			// Unacked messages are delivered again on the next connect
+			if err := c.ackIncoming(&msg); err != nil {
+				return fmt.Errorf("failed to ack message: %w", err)
+			}
+			if window > 0 && len(msg.MessageID) > 0 {
+				c.recent.add(msg.MessageID, conn, window, time.Now())
+			}
 
 		case CommandKeepAlive:
 			keepAlive := &KeepAliveCommand{}
-			if err := c.write(keepAlive.ToPayload().ToBytes()); err != nil {
+			if err := c.writePayload(keepAlive.ToPayload()); err != nil {
 				return fmt.Errorf("failed to respond to keep-alive: %w", err)
 			}
 
-		case CommandConnectAck, CommandFilterTopicsAck, CommandSendMessageAck, CommandKeepAliveAck:
+		case CommandSendMessageAck:
+			c.handleSendMessageAck(payload)
+
+		case CommandFilterTopicsAck:
+			if !c.NoAutoFlush {
+				go c.flushQueue()
+			}
+
+		case CommandKeepAliveAck:
+			c.recordKeepAliveRTT(couriers)
+
+		case CommandConnectAck:
 			// Responses we expect, ignore for now
 
 		default:
-			fmt.Printf("Received unknown command: %d\n", payload.ID)
+			c.handleUnknown(payload)
+		}
+	}
+}
+
+// keepAlive sends keep-alives on conn every interval until ctx is done or
+// conn is replaced.
+func (c *Connection) keepAlive(ctx context.Context, conn net.Conn, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		c.writeLock.Lock()
+		current := c.conn
+		c.writeLock.Unlock()
+		if current != conn {
+			return
+		}
+		c.keepAliveSent.Store(time.Now().UnixNano())
+		if err := c.writePayload((&KeepAliveCommand{}).ToPayload()); err != nil {
+			// The read loop notices the broken connection
+			return
 		}
 	}
 }
 
-// Close closes the APNS connection.
+// recordKeepAliveRTT reports the round trip of the keep-alive just acked
+// to couriers.
+func (c *Connection) recordKeepAliveRTT(couriers *CourierStats) {
+	sent := c.keepAliveSent.Swap(0)
+	if sent == 0 || couriers == nil {
+		return
+	}
+	c.writeLock.Lock()
+	host := c.host
+	c.writeLock.Unlock()
+	if host != "" && c.Addr == "" {
+		couriers.Record(host, time.Since(time.Unix(0, sent)))
+	}
+}
+
+// ackIncoming tells the courier an incoming message was received, so it
+// drops the message from the queue it keeps for us.
+func (c *Connection) ackIncoming(msg *IncomingSendMessageCommand) error {
+	if len(msg.MessageID) == 0 {
+		return nil
+	}
+	ack := &SendMessageAckCommand{Token: c.token, MessageID: msg.MessageID}
+	return c.writePayload(ack.ToPayload())
+}
+
+// Close closes the APNS connection. The Connection can be connected again
+// afterwards with the same credentials.
 func (c *Connection) Close() error {
-	if c.conn != nil {
-		return c.conn.Close()
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	conn := c.conn
+	c.conn = nil
+	if conn != nil {
+		return conn.Close()
 	}
 	return nil
 }
 
+// Connected reports whether the connection is open. It goes false once
+// Close is called, e.g. after the read loop fails.
+func (c *Connection) Connected() bool {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	return c.conn != nil
+}
+
 func (c *Connection) write(data []byte) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
 	if c.conn == nil {
 		return ErrNotConnected
 	}
@@ -245,13 +481,42 @@ func (c *Connection) write(data []byte) error {
 	return err
 }
 
-func (c *Connection) readPayload() (*Payload, error) {
-	if c.conn == nil {
-		return nil, ErrNotConnected
+// writePayload serializes p into a pooled buffer and writes it.
+func (c *Connection) writePayload(p *Payload) error {
+	c.traceFrame(trace.Out, p)
+	buf := getBuffer()
+	defer putBuffer(buf)
+	*buf = p.AppendBytes(*buf)
+	return c.write(*buf)
+}
+
+// connectHandshake writes the connect command straight to conn and reads
+// the courier's reply, giving up after connectTimeout or at ctx's deadline,
+// whichever comes first.
+func (c *Connection) connectHandshake(ctx context.Context, conn net.Conn, p *Payload) (*Payload, error) {
+	deadline := time.Now().Add(connectTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	if err := conn.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+
+	c.traceFrame(trace.Out, p)
+	buf := getBuffer()
+	defer putBuffer(buf)
+	*buf = p.AppendBytes(*buf)
+	if _, err := conn.Write(*buf); err != nil {
+		return nil, fmt.Errorf("failed to send connect command: %w", err)
 	}
 
 	payload := &Payload{}
-	if err := payload.UnmarshalBinaryStream(c.conn); err != nil {
+	if err := payload.UnmarshalBinaryStream(conn); err != nil {
+		return nil, fmt.Errorf("failed to read connect ack: %w", err)
+	}
+	c.traceFrame(trace.In, payload)
+
+	if err := conn.SetDeadline(time.Time{}); err != nil {
 		return nil, err
 	}
 	return payload, nil
@@ -0,0 +1,110 @@
+package apns
+
+import (
+	"cmp"
+	"fmt"
+	"maps"
+	mathrand "math/rand"
+	"slices"
+	"sync"
+	"time"
+)
+
+// CourierStat is the latency measured for one courier host.
+type CourierStat struct {
+	// RTT is the smoothed round trip time of connects and keep-alives.
+	RTT     time.Duration
+	Samples int
+	// Failures counts dials that failed since the last success.
+	Failures int
+	Updated  time.Time
+}
+
+// score orders hosts for selection, lower is better.
+func (s CourierStat) score() time.Duration {
+	return s.RTT * time.Duration(1+s.Failures)
+}
+
+// CourierStats tracks per-host courier latency so Connect can prefer fast
+// couriers. It is safe for concurrent use.
+type CourierStats struct {
+	mu    sync.Mutex
+	hosts map[string]CourierStat
+}
+
+// NewCourierStats returns a tracker seeded with previously saved stats.
+func NewCourierStats(saved map[string]CourierStat) *CourierStats {
+	hosts := maps.Clone(saved)
+	if hosts == nil {
+		hosts = make(map[string]CourierStat)
+	}
+	return &CourierStats{hosts: hosts}
+}
+
+// Snapshot returns a copy of the stats, keyed by host, for persisting.
+func (s *CourierStats) Snapshot() map[string]CourierStat {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return maps.Clone(s.hosts)
+}
+
+// Record adds an RTT sample for host and clears its failures.
+func (s *CourierStats) Record(host string, rtt time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stat := s.hosts[host]
+	if stat.Samples == 0 {
+		stat.RTT = rtt
+	} else {
+		// Same smoothing as TCP's SRTT, with a gain of 1/8
+		stat.RTT += (rtt - stat.RTT) / 8
+	}
+	stat.Samples++
+	stat.Failures = 0
+	stat.Updated = time.Now()
+	s.hosts[host] = stat
+}
+
+// RecordFailure notes a failed dial to host.
+func (s *CourierStats) RecordFailure(host string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stat := s.hosts[host]
+	stat.Failures++
+	stat.Updated = time.Now()
+	s.hosts[host] = stat
+}
+
+// pick returns n distinct courier hosts, fastest known first. When more than
+// one host is wanted, the last is always a random one so unmeasured or
+// recovered hosts keep getting a chance.
+func (s *CourierStats) pick(n int) []string {
+	n = max(1, min(n, CourierHostCount))
+	s.mu.Lock()
+	var known []string
+	for host, stat := range s.hosts {
+		if stat.Samples > 0 {
+			known = append(known, host)
+		}
+	}
+	slices.SortFunc(known, func(a, b string) int {
+		return cmp.Compare(s.hosts[a].score(), s.hosts[b].score())
+	})
+	s.mu.Unlock()
+
+	best := n
+	if n > 1 {
+		best = n - 1
+	}
+	hosts := known[:min(best, len(known))]
+	for _, num := range mathrand.Perm(CourierHostCount) {
+		if len(hosts) == n {
+			break
+		}
+		host := fmt.Sprintf("%d-%s", num+1, CourierHostname)
+		if !slices.Contains(hosts, host) {
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts
+}
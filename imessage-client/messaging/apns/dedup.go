@@ -0,0 +1,83 @@
+package apns
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// The courier delivers a message again if it didn't get our ack, which
+// happens whenever the connection drops between the two. ReadLoop remembers
+// the IDs of recent messages so a redelivery doesn't reach the handler
+// twice, on top of the message UUIDs the session deduplicates by.
+const (
+	DefaultDuplicateWindow = 10 * time.Minute
+	// maxRecentPushes bounds the remembered IDs during a flood of messages.
+	maxRecentPushes = 4096
+)
+
+// recentPushes remembers the IDs of incoming messages for a while, along
+// with the connection each was acked on.
+type recentPushes struct {
+	mu    sync.Mutex
+	seen  map[string]net.Conn
+	order []recentPush
+}
+
+type recentPush struct {
+	id string
+	at time.Time
+}
+
+// lookup reports whether id was seen within window of now, and the
+// connection it was acked on, if any.
+func (r *recentPushes) lookup(id []byte, window time.Duration, now time.Time) (net.Conn, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.expire(window, now)
+	conn, ok := r.seen[string(id)]
+	return conn, ok
+}
+
+// add remembers id at now, and that it was acked on conn unless that's nil.
+func (r *recentPushes) add(id []byte, conn net.Conn, window time.Duration, now time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.expire(window, now)
+	if r.seen == nil {
+		r.seen = make(map[string]net.Conn)
+	}
+	if _, ok := r.seen[string(id)]; !ok {
+		if len(r.order) >= maxRecentPushes {
+			delete(r.seen, r.order[0].id)
+			r.order = r.order[1:]
+		}
+		r.order = append(r.order, recentPush{id: string(id), at: now})
+	}
+	r.seen[string(id)] = conn
+}
+
+// expire forgets the IDs older than window. IDs are added in time order, so
+// they're the front of order.
+func (r *recentPushes) expire(window time.Duration, now time.Time) {
+	n := 0
+	for n < len(r.order) && now.Sub(r.order[n].at) > window {
+		delete(r.seen, r.order[n].id)
+		n++
+	}
+	if n > 0 {
+		r.order = append(r.order[:0], r.order[n:]...)
+	}
+}
+
+// duplicateWindow returns how long message IDs are remembered, or 0 if
+// they aren't.
+func (c *Connection) duplicateWindow() time.Duration {
+	if c.DuplicateWindow < 0 {
+		return 0
+	}
+	if c.DuplicateWindow == 0 {
+		return DefaultDuplicateWindow
+	}
+	return c.DuplicateWindow
+}
@@ -0,0 +1,216 @@
+package apns
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	mathrand "math/rand"
+	"net"
+	"time"
+)
+
+// PortPolicy selects which courier ports Connect tries.
+type PortPolicy int
+
+const (
+	// PortAuto tries CourierPort and falls back to CourierFallbackPort.
+	PortAuto PortPolicy = iota
+	// PortStandard only uses CourierPort.
+	PortStandard
+	// PortHTTPS only uses CourierFallbackPort.
+	PortHTTPS
+)
+
+func (p PortPolicy) String() string {
+	switch p {
+	case PortAuto:
+		return "auto"
+	case PortStandard:
+		return fmt.Sprint(CourierPort)
+	case PortHTTPS:
+		return fmt.Sprint(CourierFallbackPort)
+	default:
+		return fmt.Sprintf("PortPolicy(%d)", int(p))
+	}
+}
+
+// ParsePortPolicy parses "auto", "5223" or "443".
+func ParsePortPolicy(s string) (PortPolicy, error) {
+	for _, p := range []PortPolicy{PortAuto, PortStandard, PortHTTPS} {
+		if s == p.String() {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown courier port %q (want auto, %d or %d)", s, CourierPort, CourierFallbackPort)
+}
+
+func (p PortPolicy) ports() []int {
+	switch p {
+	case PortStandard:
+		return []int{CourierPort}
+	case PortHTTPS:
+		return []int{CourierFallbackPort}
+	default:
+		return []int{CourierPort, CourierFallbackPort}
+	}
+}
+
+// fallbackDialTimeout bounds a dial that has another port to fall back to,
+// since a blocked port usually drops packets rather than refusing.
+const fallbackDialTimeout = 10 * time.Second
+
+// Parallel dialing: ParallelDials courier hosts are raced, each started
+// dialStagger after the previous one unless that one already failed.
+const (
+	DefaultParallelDials = 3
+	dialStagger          = 250 * time.Millisecond
+	// dualStackFallback is how long an IPv6 dial gets before IPv4 is tried
+	// in parallel (RFC 8305).
+	dualStackFallback = 300 * time.Millisecond
+)
+
+// courierHosts picks n distinct random courier hosts.
+func courierHosts(n int) []string {
+	n = max(1, min(n, CourierHostCount))
+	hosts := make([]string, n)
+	for i, num := range mathrand.Perm(CourierHostCount)[:n] {
+		hosts[i] = fmt.Sprintf("%d-%s", num+1, CourierHostname)
+	}
+	return hosts
+}
+
+// courierAddrs returns the addresses Connect races, one group per port in
+// the order the ports are tried.
+func (c *Connection) courierAddrs() [][]string {
+	if c.Addr != "" {
+		return [][]string{{c.Addr}}
+	}
+	parallel := c.ParallelDials
+	if parallel <= 0 {
+		parallel = DefaultParallelDials
+	}
+	var hosts []string
+	if c.Couriers != nil {
+		hosts = c.Couriers.pick(parallel)
+	} else {
+		hosts = courierHosts(parallel)
+	}
+	var groups [][]string
+	for _, port := range c.Ports.ports() {
+		addrs := make([]string, len(hosts))
+		for i, host := range hosts {
+			addrs[i] = net.JoinHostPort(host, fmt.Sprint(port))
+		}
+		groups = append(groups, addrs)
+	}
+	return groups
+}
+
+// dialCourier opens a TLS connection to whichever courier answers first,
+// trying the next port if none does. It returns the connection and the
+// courier host it reached.
+func (c *Connection) dialCourier(ctx context.Context, tlsConfig *tls.Config) (net.Conn, string, error) {
+	dialer := &tls.Dialer{
+		NetDialer: &net.Dialer{FallbackDelay: dualStackFallback},
+		Config:    tlsConfig,
+	}
+	groups := c.courierAddrs()
+	var errs []error
+	for i, addrs := range groups {
+		dialCtx := ctx
+		if i < len(groups)-1 {
+			var cancel context.CancelFunc
+			dialCtx, cancel = context.WithTimeout(ctx, fallbackDialTimeout)
+			defer cancel()
+		}
+		conn, addr, err := raceDials(dialCtx, dialer, addrs, c.observeDial)
+		if err == nil {
+			host, _, _ := net.SplitHostPort(addr)
+			return conn, host, nil
+		}
+		errs = append(errs, err)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, "", errors.Join(errs...)
+}
+
+// observeDial feeds a finished dial into Couriers. Dials cut short because
+// another courier won the race say nothing about the host and are skipped.
+func (c *Connection) observeDial(ctx context.Context, addr string, rtt time.Duration, err error) {
+	if c.Couriers == nil || c.Addr != "" {
+		return
+	}
+	host, _, _ := net.SplitHostPort(addr)
+	switch {
+	case err == nil:
+		c.Couriers.Record(host, rtt)
+	case ctx.Err() == nil:
+		c.Couriers.RecordFailure(host)
+	}
+}
+
+type dialResult struct {
+	conn net.Conn
+	addr string
+	err  error
+}
+
+// raceDials dials addrs with staggered starts and returns the first
+// connection established and its address. The others are cancelled or
+// closed. observe, if set, is called with every dial's outcome and time.
+func raceDials(ctx context.Context, dialer *tls.Dialer, addrs []string, observe func(ctx context.Context, addr string, rtt time.Duration, err error)) (net.Conn, string, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan dialResult, len(addrs))
+	dial := func(addr string) {
+		start := time.Now()
+		conn, err := dialer.DialContext(ctx, "tcp", addr)
+		if observe != nil {
+			observe(ctx, addr, time.Since(start), err)
+		}
+		results <- dialResult{conn, addr, err}
+	}
+
+	started, pending := 0, 0
+	var errs []error
+	stagger := time.NewTimer(0)
+	defer stagger.Stop()
+	for {
+		var next <-chan time.Time
+		if started < len(addrs) {
+			next = stagger.C
+		} else if pending == 0 {
+			return nil, "", errors.Join(errs...)
+		}
+		select {
+		case <-next:
+			go dial(addrs[started])
+			started++
+			pending++
+			stagger.Reset(dialStagger)
+		case res := <-results:
+			pending--
+			if res.err != nil {
+				errs = append(errs, res.err)
+				// Don't wait out the stagger after a failure
+				if started < len(addrs) {
+					stagger.Reset(0)
+				}
+				continue
+			}
+			cancel()
+			// Close connections that lose the race
+			go func(n int) {
+				for ; n > 0; n-- {
+					if late := <-results; late.conn != nil {
+						late.conn.Close()
+					}
+				}
+			}(pending)
+			return res.conn, res.addr, nil
+		}
+	}
+}
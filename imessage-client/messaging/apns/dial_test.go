@@ -0,0 +1,155 @@
+package apns
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCourierAddrsFollowPortPolicy(t *testing.T) {
+	tests := []struct {
+		policy string
+		ports  []string
+	}{
+		{"auto", []string{":5223", ":443"}},
+		{"5223", []string{":5223"}},
+		{"443", []string{":443"}},
+	}
+	for _, tt := range tests {
+		policy, err := ParsePortPolicy(tt.policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		groups := (&Connection{Ports: policy}).courierAddrs()
+		if len(groups) != len(tt.ports) {
+			t.Fatalf("%s: addrs = %v", tt.policy, groups)
+		}
+		for i, addrs := range groups {
+			if len(addrs) != DefaultParallelDials {
+				t.Errorf("%s: racing %d hosts, want %d", tt.policy, len(addrs), DefaultParallelDials)
+			}
+			for _, addr := range addrs {
+				if !strings.HasSuffix(addr, CourierHostname+tt.ports[i]) {
+					t.Errorf("%s: addr %s in group %d, want port %s", tt.policy, addr, i, tt.ports[i])
+				}
+			}
+		}
+	}
+	if _, err := ParsePortPolicy("80"); err == nil {
+		t.Error("unknown port accepted")
+	}
+	if groups := (&Connection{Addr: "127.0.0.1:1"}).courierAddrs(); len(groups) != 1 || len(groups[0]) != 1 || groups[0][0] != "127.0.0.1:1" {
+		t.Errorf("Addr override ignored: %v", groups)
+	}
+	if hosts := courierHosts(CourierHostCount + 5); len(hosts) != CourierHostCount {
+		t.Errorf("got %d hosts, want %d", len(hosts), CourierHostCount)
+	}
+}
+
+func TestRaceDialsSkipsSlowAndDeadCouriers(t *testing.T) {
+	good := httptest.NewTLSServer(http.NotFoundHandler())
+	defer good.Close()
+
+	// Accepts TCP but never completes the TLS handshake
+	slow, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slow.Close()
+	go func() {
+		for {
+			conn, err := slow.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadAddr := dead.Addr().String()
+	dead.Close()
+
+	dialer := &tls.Dialer{Config: good.Client().Transport.(*http.Transport).TLSClientConfig}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	start := time.Now()
+	var mu sync.Mutex
+	var failed []string
+	observe := func(ctx context.Context, addr string, rtt time.Duration, err error) {
+		if err != nil && ctx.Err() == nil {
+			mu.Lock()
+			failed = append(failed, addr)
+			mu.Unlock()
+		}
+	}
+	conn, addr, err := raceDials(ctx, dialer, []string{slow.Addr().String(), deadAddr, good.Listener.Addr().String()}, observe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if addr != good.Listener.Addr().String() || conn.RemoteAddr().String() != addr {
+		t.Errorf("connected to %s (%s)", addr, conn.RemoteAddr())
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(failed) != 1 || failed[0] != deadAddr {
+		t.Errorf("failed dials = %v, want only %s", failed, deadAddr)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("race took %v", elapsed)
+	}
+
+	if _, _, err := raceDials(ctx, dialer, []string{deadAddr, deadAddr}, nil); err == nil {
+		t.Error("expected an error when every dial fails")
+	}
+}
+
+func TestCourierStatsPreferFastHosts(t *testing.T) {
+	host := func(n int) string { return fmt.Sprintf("%d-%s", n, CourierHostname) }
+	stats := NewCourierStats(map[string]CourierStat{
+		host(1): {RTT: 200 * time.Millisecond, Samples: 3},
+		host(2): {RTT: 20 * time.Millisecond, Samples: 3},
+		host(3): {RTT: 50 * time.Millisecond, Samples: 3},
+	})
+
+	hosts := stats.pick(3)
+	if len(hosts) != 3 || hosts[0] != host(2) || hosts[1] != host(3) {
+		t.Fatalf("picked %v, want the two fastest first", hosts)
+	}
+	if hosts[2] == host(2) || hosts[2] == host(3) {
+		t.Errorf("exploration slot repeated a host: %v", hosts)
+	}
+
+	// Failures push a host back until it succeeds again
+	stats.RecordFailure(host(2))
+	stats.RecordFailure(host(2))
+	if hosts := stats.pick(2); hosts[0] != host(3) {
+		t.Errorf("picked %v after failures, want %s first", hosts, host(3))
+	}
+	stats.Record(host(2), 20*time.Millisecond)
+	if hosts := stats.pick(1); hosts[0] != host(2) {
+		t.Errorf("picked %v after recovery, want %s", hosts, host(2))
+	}
+
+	// Samples are smoothed rather than replacing the estimate
+	stats.Record(host(3), 850*time.Millisecond)
+	if rtt := stats.Snapshot()[host(3)].RTT; rtt != 150*time.Millisecond {
+		t.Errorf("smoothed RTT = %v, want 150ms", rtt)
+	}
+
+	groups := (&Connection{Couriers: stats, Ports: PortStandard}).courierAddrs()
+	if want := net.JoinHostPort(host(2), "5223"); groups[0][0] != want {
+		t.Errorf("first address = %s, want %s", groups[0][0], want)
+	}
+}
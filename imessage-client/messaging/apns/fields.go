@@ -0,0 +1,178 @@
+package apns
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+// Connect command fields.
+const (
+	FieldConnectDeviceToken FieldID = 1
+	FieldConnectState       FieldID = 2
+	FieldConnectFlags       FieldID = 5
+	FieldConnectCert        FieldID = 12
+	FieldConnectNonce       FieldID = 13
+	FieldConnectSignature   FieldID = 14
+)
+
+// ConnectAck command fields.
+const (
+	FieldConnectAckStatus           FieldID = 1 // 0 for success, 2 for error
+	FieldConnectAckToken            FieldID = 3
+	FieldConnectAckMaxMessageSize   FieldID = 4 // uint16, usually 4 KiB
+	FieldConnectAckUnknown5         FieldID = 5
+	FieldConnectAckCapabilities     FieldID = 6
+	FieldConnectAckLargeMessageSize FieldID = 8  // uint16, usually 15 KiB
+	FieldConnectAckServerTimestamp  FieldID = 10 // uint64, unix milliseconds
+)
+
+// FilterTopics command fields. Each topic list field is repeated once per topic hash.
+const (
+	FieldFilterTopicsToken         FieldID = 1
+	FieldFilterTopicsTopic         FieldID = 2 // enabled topics
+	FieldFilterTopicsIgnored       FieldID = 3
+	FieldFilterTopicsOpportunistic FieldID = 4
+	FieldFilterTopicsPaused        FieldID = 5
+)
+
+// SetState command fields.
+const (
+	FieldSetStateState    FieldID = 1
+	FieldSetStateFieldTwo FieldID = 2
+)
+
+// Incoming SendMessage command fields.
+const (
+	FieldIncomingToken      FieldID = 1
+	FieldIncomingTopic      FieldID = 2
+	FieldIncomingPayload    FieldID = 3
+	FieldIncomingMessageID  FieldID = 4
+	FieldIncomingExpiration FieldID = 5 // uint32, seconds
+	FieldIncomingTimestamp  FieldID = 6 // uint64, unix nanoseconds
+	FieldIncomingUnknown7   FieldID = 7
+)
+
+// Outgoing SendMessage command fields. Note that topic and token are swapped
+// compared to incoming messages.
+const (
+	FieldOutgoingTopic      FieldID = 1
+	FieldOutgoingToken      FieldID = 2
+	FieldOutgoingPayload    FieldID = 3
+	FieldOutgoingMessageID  FieldID = 4
+	FieldOutgoingExpiration FieldID = 5  // uint32, unix seconds
+	FieldOutgoingFlags      FieldID = 15 // uint8 bitfield, uncertain
+)
+
+// OutgoingFlagLarge is set in FieldOutgoingFlags on messages over the
+// courier's normal size limit, sending them on the large-message path
+// (uncertain).
+const OutgoingFlagLarge uint8 = 1
+
+// SendMessageAck command fields.
+const (
+	FieldSendMessageAckToken     FieldID = 1
+	FieldSendMessageAckMessageID FieldID = 4
+	FieldSendMessageAckStatus    FieldID = 6 // error code, only present on failure (uncertain)
+	FieldSendMessageAckNullByte  FieldID = 8 // single 0 byte on success
+)
+
+// Field returns the value of the first field with the given ID, or nil if not found.
+func (p *Payload) Field(id FieldID) []byte {
+	for _, field := range p.Fields {
+		if field.ID == id {
+			return field.Value
+		}
+	}
+	return nil
+}
+
+// FieldValues returns the values of every field with the given ID, in order.
+func (p *Payload) FieldValues(id FieldID) [][]byte {
+	var values [][]byte
+	for _, field := range p.Fields {
+		if field.ID == id {
+			values = append(values, field.Value)
+		}
+	}
+	return values
+}
+
+// GetUint8 returns a single-byte field.
+func (p *Payload) GetUint8(id FieldID) (uint8, bool) {
+	val := p.Field(id)
+	if len(val) < 1 {
+		return 0, false
+	}
+	return val[0], true
+}
+
+// GetUint16 returns a big-endian uint16 field.
+func (p *Payload) GetUint16(id FieldID) (uint16, bool) {
+	val := p.Field(id)
+	if len(val) < 2 {
+		return 0, false
+	}
+	return binary.BigEndian.Uint16(val), true
+}
+
+// GetUint32 returns a big-endian uint32 field.
+func (p *Payload) GetUint32(id FieldID) (uint32, bool) {
+	val := p.Field(id)
+	if len(val) < 4 {
+		return 0, false
+	}
+	return binary.BigEndian.Uint32(val), true
+}
+
+// GetUint64 returns a big-endian uint64 field.
+func (p *Payload) GetUint64(id FieldID) (uint64, bool) {
+	val := p.Field(id)
+	if len(val) < 8 {
+		return 0, false
+	}
+	return binary.BigEndian.Uint64(val), true
+}
+
+// GetString returns a field as a string.
+func (p *Payload) GetString(id FieldID) (string, bool) {
+	val := p.Field(id)
+	if val == nil {
+		return "", false
+	}
+	return string(val), true
+}
+
+// GetTimestamp returns a uint64 field counting units since the Unix epoch
+// (e.g. time.Millisecond for ConnectAck, time.Nanosecond for SendMessage).
+func (p *Payload) GetTimestamp(id FieldID, unit time.Duration) (time.Time, bool) {
+	val, ok := p.GetUint64(id)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(0, int64(val)*int64(unit)), true
+}
+
+// Uint8Field creates a single-byte field.
+func Uint8Field(id FieldID, val uint8) Field {
+	return Field{ID: id, Value: []byte{val}}
+}
+
+// Uint16Field creates a big-endian uint16 field.
+func Uint16Field(id FieldID, val uint16) Field {
+	return Field{ID: id, Value: binary.BigEndian.AppendUint16(nil, val)}
+}
+
+// Uint32Field creates a big-endian uint32 field.
+func Uint32Field(id FieldID, val uint32) Field {
+	return Field{ID: id, Value: binary.BigEndian.AppendUint32(nil, val)}
+}
+
+// Uint64Field creates a big-endian uint64 field.
+func Uint64Field(id FieldID, val uint64) Field {
+	return Field{ID: id, Value: binary.BigEndian.AppendUint64(nil, val)}
+}
+
+// StringField creates a string field.
+func StringField(id FieldID, val string) Field {
+	return Field{ID: id, Value: []byte(val)}
+}
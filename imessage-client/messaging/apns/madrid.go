@@ -0,0 +1,190 @@
+package apns
+
+import (
+	"fmt"
+	"time"
+
+	"howett.net/plist"
+)
+
+// MessageType is the "c" command of a payload on the madrid topic.
+type MessageType uint64
+
+const (
+	MessageTypeIMessage            MessageType = 100
+	MessageTypeDeliveryReceipt     MessageType = 101
+	MessageTypeReadReceipt         MessageType = 102
+	MessageTypeIMessageAsync       MessageType = 104
+	MessageTypePlayedReceipt       MessageType = 105
+	MessageTypeReflectedDelivery   MessageType = 107
+	MessageTypeMarkUnread          MessageType = 111
+	MessageTypeIMessageEdit        MessageType = 118
+	MessageTypeDeliveryFailure     MessageType = 120
+	MessageTypePeerCacheInvalidate MessageType = 130
+	MessageTypeSMS                 MessageType = 140 // relayed from the iPhone
+	MessageTypeMMS                 MessageType = 141
+	MessageTypeReflectedSMS        MessageType = 143 // sent from the iPhone
+	MessageTypeReflectedMMS        MessageType = 144
+	MessageTypeFlushQueue          MessageType = 160 // officially known as OfflineMessagePendingStorageCheck
+	MessageTypeIMessageAck         MessageType = 255
+)
+
+func (mt MessageType) String() string {
+	switch mt {
+	case MessageTypeIMessage:
+		return "IMessage"
+	case MessageTypeDeliveryReceipt:
+		return "DeliveryReceipt"
+	case MessageTypeReadReceipt:
+		return "ReadReceipt"
+	case MessageTypeIMessageAsync:
+		return "IMessageAsync"
+	case MessageTypePlayedReceipt:
+		return "PlayedReceipt"
+	case MessageTypeReflectedDelivery:
+		return "ReflectedDelivery"
+	case MessageTypeMarkUnread:
+		return "MarkUnread"
+	case MessageTypeIMessageEdit:
+		return "IMessageEdit"
+	case MessageTypeDeliveryFailure:
+		return "DeliveryFailure"
+	case MessageTypePeerCacheInvalidate:
+		return "PeerCacheInvalidate"
+	case MessageTypeSMS:
+		return "SMS"
+	case MessageTypeMMS:
+		return "MMS"
+	case MessageTypeReflectedSMS:
+		return "ReflectedSMS"
+	case MessageTypeReflectedMMS:
+		return "ReflectedMMS"
+	case MessageTypeFlushQueue:
+		return "FlushQueue"
+	case MessageTypeIMessageAck:
+		return "IMessageAck"
+	default:
+		return fmt.Sprintf("MessageType(%d)", uint64(mt))
+	}
+}
+
+// IsSMS reports whether the type carries an SMS or MMS relayed through the
+// user's iPhone.
+func (mt MessageType) IsSMS() bool {
+	switch mt {
+	case MessageTypeSMS, MessageTypeMMS, MessageTypeReflectedSMS, MessageTypeReflectedMMS:
+		return true
+	}
+	return false
+}
+
+// IsReflected reports whether the type carries an SMS or MMS the user sent
+// from their iPhone, reflected to their other devices.
+func (mt MessageType) IsReflected() bool {
+	return mt == MessageTypeReflectedSMS || mt == MessageTypeReflectedMMS
+}
+
+// MadridPayload is the plist envelope carried in the APNS payload field on
+// the madrid topic. Trimmed from beeper/imessage apns.SendMessagePayload.
+type MadridPayload struct {
+	Command           MessageType     `plist:"c,omitempty"`
+	EncryptionType    string          `plist:"E,omitempty"`
+	Payload           []byte          `plist:"P,omitempty"`
+	MessageID         uint32          `plist:"i,omitempty"`
+	MessageUUID       []byte          `plist:"U,omitempty"`
+	Timestamp         int64           `plist:"e,omitempty"` // unix nanoseconds
+	IsTrustedSender   bool            `plist:"htu,omitempty"`
+	SenderID          string          `plist:"sP,omitempty"`
+	Token             []byte          `plist:"t,omitempty"`
+	SessionToken      []byte          `plist:"sT,omitempty"`
+	DestinationID     string          `plist:"tP,omitempty"`
+	Version           int             `plist:"v,omitempty"`
+	DeliveryStatus    *bool           `plist:"D,omitempty"`
+	ExpirationSeconds *int            `plist:"eX,omitempty"`
+	NoResponseNeeded  *bool           `plist:"nr,omitempty"`
+	UserAgent         string          `plist:"ua,omitempty"`
+	FanoutChunkNumber int             `plist:"fcn,omitempty"`
+	DTL               []MadridPayload `plist:"dtl,omitempty"`
+}
+
+// ParseMadridPayload decodes a madrid plist envelope.
+func ParseMadridPayload(data []byte) (*MadridPayload, error) {
+	var payload MadridPayload
+	if _, err := plist.Unmarshal(data, &payload); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal madrid payload: %w", err)
+	}
+	return &payload, nil
+}
+
+// Marshal encodes the payload as a binary plist.
+func (m *MadridPayload) Marshal() ([]byte, error) {
+	return plist.Marshal(m, plist.BinaryFormat)
+}
+
+// SetNoStorage marks the payload as ephemeral: Apple won't queue it for
+// devices that are offline. Used for typing indicators and similar.
+func (m *MadridPayload) SetNoStorage() {
+	zero := 0
+	m.ExpirationSeconds = &zero
+}
+
+// IsNoStorage reports whether the payload was sent as ephemeral.
+func (m *MadridPayload) IsNoStorage() bool {
+	return m.ExpirationSeconds != nil && *m.ExpirationSeconds == 0
+}
+
+// Lifetimes requested for outgoing payloads. The courier drops a payload it
+// couldn't deliver within its lifetime.
+const (
+	// EphemeralLifetime is for no-storage payloads like typing indicators,
+	// which mean nothing once they're stale.
+	EphemeralLifetime = 30 * time.Second
+	// MessageLifetime is for messages and receipts, which Apple keeps for
+	// offline devices for up to 30 days.
+	MessageLifetime = 30 * 24 * time.Hour
+)
+
+// Lifetime returns how long the courier should keep trying to deliver the
+// payload.
+func (m *MadridPayload) Lifetime() time.Duration {
+	if m.IsNoStorage() {
+		return EphemeralLifetime
+	}
+	return MessageLifetime
+}
+
+// IsStale reports whether an incoming no-storage payload is too old to act
+// on: its APNS expiration has passed, or it was sent more than
+// EphemeralLifetime ago. Other payloads are never stale.
+func (m *MadridPayload) IsStale(expiration, now time.Time) bool {
+	if !m.IsNoStorage() {
+		return false
+	}
+	if !expiration.IsZero() && now.After(expiration) {
+		return true
+	}
+	return m.Timestamp != 0 && now.Sub(time.Unix(0, m.Timestamp)) > EphemeralLifetime
+}
+
+// NewDeliveryReceipt builds the c:101 payload telling the sender's device
+// that incoming was delivered. The session token is only known after an IDS
+// lookup of the sender, so callers fill in SessionToken from theirs.
+func NewDeliveryReceipt(incoming *MadridPayload, userAgent string) *MadridPayload {
+	noResponseNeeded := true
+	return &MadridPayload{
+		Command:          MessageTypeDeliveryReceipt,
+		MessageUUID:      incoming.MessageUUID,
+		SenderID:         incoming.DestinationID,
+		DestinationID:    incoming.SenderID,
+		Token:            incoming.Token,
+		Version:          8,
+		NoResponseNeeded: &noResponseNeeded,
+		UserAgent:        userAgent,
+	}
+}
+
+// WantsDeliveryReceipt reports whether the sender asked for a delivery receipt.
+func (m *MadridPayload) WantsDeliveryReceipt() bool {
+	return m.Command == MessageTypeIMessage && m.DeliveryStatus != nil && *m.DeliveryStatus &&
+		m.SenderID != "" && len(m.MessageUUID) > 0
+}
@@ -0,0 +1,44 @@
+package apns
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIncomingExpiration(t *testing.T) {
+	at := time.Unix(1700000000, 0)
+	msg := &IncomingSendMessageCommand{Expiration: Uint32Field(FieldIncomingExpiration, uint32(at.Unix())).Value}
+	if got := msg.ExpiresAt(); !got.Equal(at) {
+		t.Errorf("ExpiresAt = %v, want %v", got, at)
+	}
+	never := &IncomingSendMessageCommand{Expiration: Uint32Field(FieldIncomingExpiration, 0xffffffff).Value}
+	if got := never.ExpiresAt(); !got.IsZero() {
+		t.Errorf("ExpiresAt = %v, want zero for a message that never expires", got)
+	}
+}
+
+func TestStaleEphemeralPayloads(t *testing.T) {
+	now := time.Now()
+	typing := &MadridPayload{Command: MessageTypeIMessage, Timestamp: now.UnixNano()}
+	typing.SetNoStorage()
+	if typing.Lifetime() != EphemeralLifetime {
+		t.Errorf("ephemeral lifetime = %s", typing.Lifetime())
+	}
+	if typing.IsStale(now.Add(time.Second), now) {
+		t.Error("fresh typing indicator reported stale")
+	}
+	if !typing.IsStale(now.Add(-time.Second), now) {
+		t.Error("expired typing indicator not reported stale")
+	}
+	if !typing.IsStale(time.Time{}, now.Add(2*EphemeralLifetime)) {
+		t.Error("old typing indicator without expiration not reported stale")
+	}
+
+	message := &MadridPayload{Command: MessageTypeIMessage, Timestamp: now.Add(-time.Hour).UnixNano()}
+	if message.Lifetime() != MessageLifetime {
+		t.Errorf("message lifetime = %s", message.Lifetime())
+	}
+	if message.IsStale(now.Add(-time.Second), now) {
+		t.Error("stored message reported stale")
+	}
+}
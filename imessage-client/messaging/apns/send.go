@@ -0,0 +1,233 @@
+package apns
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// OutgoingSendMessageCommand pushes a payload to another device.
+type OutgoingSendMessageCommand struct {
+	Topic     []byte // SHA1 hash of the topic
+	Token     []byte // our own push token; destinations are inside the payload
+	Payload   []byte
+	MessageID []byte // 4 bytes, echoed back in the SendMessageAck
+	// Expiration is when the courier may drop the message. Zero omits the field.
+	Expiration time.Time
+	Flags      uint8
+}
+
+// ToPayload converts OutgoingSendMessageCommand to binary payload.
+func (o *OutgoingSendMessageCommand) ToPayload() *Payload {
+	fields := []Field{
+		{ID: FieldOutgoingTopic, Value: o.Topic},
+		{ID: FieldOutgoingToken, Value: o.Token},
+		{ID: FieldOutgoingPayload, Value: o.Payload},
+		{ID: FieldOutgoingMessageID, Value: o.MessageID},
+	}
+	if !o.Expiration.IsZero() {
+		fields = append(fields, Uint32Field(FieldOutgoingExpiration, uint32(o.Expiration.Unix())))
+	}
+	if o.Flags != 0 {
+		fields = append(fields, Uint8Field(FieldOutgoingFlags, o.Flags))
+	}
+	return &Payload{ID: CommandSendMessage, Fields: fields}
+}
+
+// SendMessageAckCommand is received in response to an outgoing SendMessage,
+// and sent by us to acknowledge incoming ones.
+type SendMessageAckCommand struct {
+	Token     []byte
+	MessageID []byte
+	Status    []byte
+	NullByte  []byte
+}
+
+// FromPayload parses SendMessageAckCommand from payload.
+func (s *SendMessageAckCommand) FromPayload(p *Payload) {
+	s.Token = p.Field(FieldSendMessageAckToken)
+	s.MessageID = p.Field(FieldSendMessageAckMessageID)
+	s.Status = p.Field(FieldSendMessageAckStatus)
+	s.NullByte = p.Field(FieldSendMessageAckNullByte)
+}
+
+// ToPayload converts SendMessageAckCommand to binary payload.
+func (s *SendMessageAckCommand) ToPayload() *Payload {
+	fields := []Field{
+		{ID: FieldSendMessageAckToken, Value: s.Token},
+		{ID: FieldSendMessageAckMessageID, Value: s.MessageID},
+	}
+	if s.Status != nil {
+		fields = append(fields, Field{ID: FieldSendMessageAckStatus, Value: s.Status})
+	}
+	nullByte := s.NullByte
+	if nullByte == nil {
+		nullByte = []byte{0}
+	}
+	fields = append(fields, Field{ID: FieldSendMessageAckNullByte, Value: nullByte})
+	return &Payload{ID: CommandSendMessageAck, Fields: fields}
+}
+
+// OK reports whether the ack indicates success.
+func (s *SendMessageAckCommand) OK() bool {
+	return len(s.NullByte) == 1 && s.NullByte[0] == 0
+}
+
+var ErrSendRejected = errors.New("courier rejected message")
+
+// SendRejectedError is returned when the courier acks a message with a non-zero status.
+type SendRejectedError struct {
+	Status []byte
+}
+
+func (e SendRejectedError) Error() string {
+	return fmt.Sprintf("%s: status %x", ErrSendRejected, e.Status)
+}
+
+func (e SendRejectedError) Is(other error) bool {
+	return other == ErrSendRejected
+}
+
+// NewMessageID returns a random 4-byte message ID.
+func NewMessageID() []byte {
+	id := make([]byte, 4)
+	_, _ = rand.Read(id)
+	return id
+}
+
+func messageIDKey(id []byte) (uint32, bool) {
+	if len(id) != 4 {
+		return 0, false
+	}
+	return binary.BigEndian.Uint32(id), true
+}
+
+// SendMessage writes an outgoing message and waits for the courier's ack
+// with the same message ID. ReadLoop must be running to receive the ack.
+// Payloads over MaxMessageSize are flagged for the large-message path.
+func (c *Connection) SendMessage(ctx context.Context, cmd *OutgoingSendMessageCommand) (*SendMessageAckCommand, error) {
+	if !c.Connected() {
+		return nil, ErrNotConnected
+	}
+	if len(cmd.MessageID) == 0 {
+		cmd.MessageID = NewMessageID()
+	}
+	key, ok := messageIDKey(cmd.MessageID)
+	if !ok {
+		return nil, fmt.Errorf("message ID must be 4 bytes, got %d", len(cmd.MessageID))
+	}
+	if cmd.Token == nil {
+		cmd.Token = c.token
+	}
+	large, err := c.isLargePayload(len(cmd.Payload))
+	if err != nil {
+		return nil, err
+	}
+	if large {
+		cmd.Flags |= OutgoingFlagLarge
+	}
+
+	ackCh := make(chan *SendMessageAckCommand, 1)
+	c.acksLock.Lock()
+	c.pendingAcks[key] = ackCh
+	c.acksLock.Unlock()
+	defer func() {
+		c.acksLock.Lock()
+		delete(c.pendingAcks, key)
+		c.acksLock.Unlock()
+	}()
+
+	if err := c.writePayload(cmd.ToPayload()); err != nil {
+		return nil, fmt.Errorf("failed to send message: %w", err)
+	}
+
+	select {
+	case ack := <-ackCh:
+		if !ack.OK() {
+			status := ack.Status
+			if status == nil {
+				status = ack.NullByte
+			}
+			return ack, SendRejectedError{Status: status}
+		}
+		return ack, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// SendTopic sends a payload on topic from this connection and waits for the ack.
+func (c *Connection) SendTopic(ctx context.Context, topic Topic, payload []byte) (*SendMessageAckCommand, error) {
+	return c.SendMessage(ctx, &OutgoingSendMessageCommand{
+		Topic:   topic.Hash(),
+		Payload: payload,
+	})
+}
+
+// SendMadrid marshals and sends a madrid payload. If the payload has a
+// MessageID, the APNS message uses the same ID, as Apple's clients do. The
+// APNS expiration follows the payload's Lifetime.
+func (c *Connection) SendMadrid(ctx context.Context, payload *MadridPayload) (*SendMessageAckCommand, error) {
+	data, err := payload.Marshal()
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal madrid payload: %w", err)
+	}
+	cmd := &OutgoingSendMessageCommand{
+		Topic:      TopicMadrid.Hash(),
+		Payload:    data,
+		Expiration: time.Now().Add(payload.Lifetime()),
+	}
+	if payload.MessageID != 0 {
+		cmd.MessageID = binary.BigEndian.AppendUint32(nil, payload.MessageID)
+	}
+	return c.SendMessage(ctx, cmd)
+}
+
+// flushQueue asks the courier to deliver messages it stored while we were offline.
+func (c *Connection) flushQueue() {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if _, err := c.SendMadrid(ctx, &MadridPayload{Command: MessageTypeFlushQueue}); err != nil {
+		slog.Warn("Failed to flush APNS queue", "err", err)
+	}
+}
+
+// isFlushRequest reports whether an incoming message is a madrid c:160
+// asking us to flush the offline queue.
+func isFlushRequest(msg *IncomingSendMessageCommand) bool {
+	if !bytes.Equal(msg.Topic, TopicMadrid.Hash()) {
+		return false
+	}
+	payload, err := ParseMadridPayload(msg.Payload)
+	return err == nil && payload.Command == MessageTypeFlushQueue
+}
+
+// handleSendMessageAck routes an ack to the SendMessage call waiting for it.
+func (c *Connection) handleSendMessageAck(payload *Payload) {
+	var ack SendMessageAckCommand
+	ack.FromPayload(payload)
+	key, ok := messageIDKey(ack.MessageID)
+	if !ok {
+		return
+	}
+	c.acksLock.Lock()
+	ackCh, ok := c.pendingAcks[key]
+	c.acksLock.Unlock()
+	if !ok {
+		return
+	}
+	// The payload buffer is reused by the reader, so copy before handing it off.
+	ack.Token = bytes.Clone(ack.Token)
+	ack.MessageID = bytes.Clone(ack.MessageID)
+	ack.Status = bytes.Clone(ack.Status)
+	ack.NullByte = bytes.Clone(ack.NullByte)
+	select {
+	case ackCh <- &ack:
+	default:
+	}
+}
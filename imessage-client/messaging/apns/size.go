@@ -0,0 +1,50 @@
+package apns
+
+import (
+	"errors"
+	"fmt"
+)
+
+// SendMessageOverhead approximates the framing added around an outgoing payload:
+// 32 bytes of push token, 20 byte topic hash, 4 byte message ID, 5 bytes of
+// command header and 3 bytes per field.
+const SendMessageOverhead = 32 + 20 + 4 + 5 + 4*3
+
+var ErrPayloadTooLarge = errors.New("payload exceeds APNS large message size")
+
+// PayloadTooLargeError reports the size of a payload that can't be sent even
+// via the large-message path.
+type PayloadTooLargeError struct {
+	Size  int
+	Limit int
+}
+
+func (e PayloadTooLargeError) Error() string {
+	return fmt.Sprintf("%s: %d bytes (limit %d)", ErrPayloadTooLarge, e.Size, e.Limit)
+}
+
+func (e PayloadTooLargeError) Is(other error) bool {
+	return other == ErrPayloadTooLarge
+}
+
+// MaxMessageSize returns the regular message size limit negotiated in ConnectAck.
+func (c *Connection) MaxMessageSize() int {
+	return c.maxMessageSize
+}
+
+// MaxLargeMessageSize returns the large message size limit negotiated in ConnectAck.
+func (c *Connection) MaxLargeMessageSize() int {
+	return c.maxLargeMessageSize
+}
+
+// isLargePayload reports whether a payload of the given size (excluding
+// framing) is over the regular message size limit, so it has to take the
+// large-message path. One that doesn't fit the large message limit either
+// is reported as PayloadTooLargeError.
+func (c *Connection) isLargePayload(size int) (bool, error) {
+	total := size + SendMessageOverhead
+	if total > c.maxLargeMessageSize {
+		return false, PayloadTooLargeError{Size: total, Limit: c.maxLargeMessageSize}
+	}
+	return total > c.maxMessageSize, nil
+}
@@ -0,0 +1,27 @@
+package apns
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestIsLargePayload(t *testing.T) {
+	c := &Connection{maxMessageSize: 500, maxLargeMessageSize: 1000}
+	for _, tt := range []struct {
+		size  int
+		large bool
+	}{
+		{500 - SendMessageOverhead, false},
+		{501 - SendMessageOverhead, true},
+		{1000 - SendMessageOverhead, true},
+	} {
+		if large, err := c.isLargePayload(tt.size); err != nil || large != tt.large {
+			t.Errorf("%d byte payload: large %v, err %v; want %v", tt.size, large, err, tt.large)
+		}
+	}
+	_, err := c.isLargePayload(1001 - SendMessageOverhead)
+	var tooLarge PayloadTooLargeError
+	if !errors.Is(err, ErrPayloadTooLarge) || !errors.As(err, &tooLarge) || tooLarge.Size != 1001 || tooLarge.Limit != 1000 {
+		t.Errorf("payload over the limit: %v", err)
+	}
+}
@@ -1,5 +1,11 @@
 package apns
 
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"sync"
+)
+
 // Topic represents an APNS topic for iMessage services.
 type Topic string
 
@@ -16,9 +22,93 @@ const (
 	TopicIDS                          Topic = "com.apple.private.ids"
 )
 
+// MadridSubServices are the alloy topics registered alongside com.apple.madrid.
+var MadridSubServices = []Topic{
+	TopicAlloyGamecenteriMessage,
+	TopicAlloySafetyMonitor,
+	TopicAlloyBiz,
+	TopicAlloySMS,
+	TopicAlloySafetyMonitorOwnAccount,
+	TopicAlloyGelato,
+	TopicAlloyAskTo,
+}
+
+// KnownTopics are the topics named in logs and traces without registering
+// them with RegisterTopics.
+var KnownTopics = append([]Topic{TopicMadrid, TopicIDS}, MadridSubServices...)
+
+var (
+	topicNamesMu sync.RWMutex
+	topicNames   = hashNames(KnownTopics)
+)
+
+func hashNames(topics []Topic) map[string]Topic {
+	names := make(map[string]Topic, len(topics))
+	for _, topic := range topics {
+		names[string(topic.Hash())] = topic
+	}
+	return names
+}
+
+// RegisterTopics adds topics beyond KnownTopics for TopicForHash to name,
+// such as ones pushed by services this client doesn't handle yet.
+func RegisterTopics(topics ...Topic) {
+	topicNamesMu.Lock()
+	defer topicNamesMu.Unlock()
+	for _, topic := range topics {
+		topicNames[string(topic.Hash())] = topic
+	}
+}
+
+// TopicForHash returns the known or registered topic with the given hash.
+func TopicForHash(hash []byte) (Topic, bool) {
+	topicNamesMu.RLock()
+	defer topicNamesMu.RUnlock()
+	topic, ok := topicNames[string(hash)]
+	return topic, ok
+}
+
+// TopicName returns the name of the topic with the given hash for display,
+// or the hash in hex if the topic isn't known.
+func TopicName(hash []byte) string {
+	if topic, ok := TopicForHash(hash); ok {
+		return string(topic)
+	}
+	return hex.EncodeToString(hash)
+}
+
+// Hash returns the SHA1 hash the courier uses to identify the topic.
+func (t Topic) Hash() []byte {
+	hashed := sha1.Sum([]byte(t))
+	return hashed[:]
+}
+
+// TopicFilter sorts topics into the courier's filter lists.
+type TopicFilter struct {
+	Enabled       []Topic
+	Ignored       []Topic
+	Opportunistic []Topic
+	Paused        []Topic
+}
+
+func hashTopics(topics []Topic) [][]byte {
+	if len(topics) == 0 {
+		return nil
+	}
+	hashes := make([][]byte, len(topics))
+	for i, topic := range topics {
+		hashes[i] = topic.Hash()
+	}
+	return hashes
+}
+
 // APNS courier connection parameters.
 const (
 	CourierHostCount = 50
 	CourierHostname  = "courier.push.apple.com"
 	CourierPort      = 5223
+	// CourierFallbackPort is tried when CourierPort is blocked, as Apple's
+	// devices do on restrictive networks. The courier tells APNS apart from
+	// HTTPS on it by ALPN.
+	CourierFallbackPort = 443
 )
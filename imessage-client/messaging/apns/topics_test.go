@@ -0,0 +1,43 @@
+package apns
+
+import (
+	"encoding/hex"
+	"reflect"
+	"testing"
+
+	"imessage-client/messaging/trace"
+)
+
+func TestTopicNames(t *testing.T) {
+	for _, topic := range KnownTopics {
+		if got := TopicName(topic.Hash()); got != string(topic) {
+			t.Errorf("TopicName(%s hash) = %q", topic, got)
+		}
+	}
+
+	extra := Topic("com.apple.private.alloy.example")
+	if got, want := TopicName(extra.Hash()), hex.EncodeToString(extra.Hash()); got != want {
+		t.Errorf("unknown topic named %q, want hex %q", got, want)
+	}
+	t.Cleanup(func() {
+		topicNamesMu.Lock()
+		delete(topicNames, string(extra.Hash()))
+		topicNamesMu.Unlock()
+	})
+	RegisterTopics(extra)
+	if topic, ok := TopicForHash(extra.Hash()); !ok || topic != extra {
+		t.Errorf("TopicForHash after RegisterTopics = %q, %v", topic, ok)
+	}
+
+	filter := (&FilterTopicsCommand{
+		Topics:        hashTopics([]Topic{TopicMadrid}),
+		Opportunistic: hashTopics([]Topic{TopicAlloySMS}),
+	}).ToPayload()
+	if got, want := frameTopics(trace.Out, filter), []string{string(TopicMadrid), string(TopicAlloySMS)}; !reflect.DeepEqual(got, want) {
+		t.Errorf("filter frame topics = %v, want %v", got, want)
+	}
+	incoming := (&IncomingSendMessageCommand{Topic: extra.Hash(), MessageID: NewMessageID()}).ToPayload()
+	if got := frameTopics(trace.In, incoming); !reflect.DeepEqual(got, []string{string(extra)}) {
+		t.Errorf("incoming frame topics = %v", got)
+	}
+}
@@ -0,0 +1,86 @@
+package apns
+
+import (
+	"bytes"
+
+	"imessage-client/messaging/trace"
+)
+
+// tracedSecrets lists the fields that are redacted from traces, per command.
+var tracedSecrets = map[CommandID]map[FieldID]bool{
+	CommandConnect: {
+		FieldConnectDeviceToken: true,
+		FieldConnectCert:        true,
+		FieldConnectNonce:       true,
+		FieldConnectSignature:   true,
+	},
+	CommandConnectAck: {
+		FieldConnectAckToken: true,
+	},
+	CommandFilterTopics: {
+		FieldFilterTopicsToken: true,
+	},
+	CommandSendMessageAck: {
+		FieldSendMessageAckToken: true,
+	},
+}
+
+// tracedMessageSecrets lists the SendMessage fields that are redacted, which
+// keep the push token in a different field each way.
+var tracedMessageSecrets = map[trace.Direction]map[FieldID]bool{
+	trace.In:  {FieldIncomingToken: true},
+	trace.Out: {FieldOutgoingToken: true},
+}
+
+// SetTracer records every frame sent and received on the connection.
+func (c *Connection) SetTracer(recorder *trace.Recorder) {
+	c.tracer = recorder
+}
+
+func (c *Connection) traceFrame(direction trace.Direction, p *Payload) {
+	if c.tracer == nil {
+		return
+	}
+	secrets := tracedSecrets[p.ID]
+	if p.ID == CommandSendMessage {
+		secrets = tracedMessageSecrets[direction]
+	}
+	fields := make([]trace.Field, 0, len(p.Fields))
+	for _, field := range p.Fields {
+		if secrets[field.ID] {
+			fields = append(fields, trace.Field{ID: uint8(field.ID), Redacted: true})
+		} else {
+			fields = append(fields, trace.Field{ID: uint8(field.ID), Value: bytes.Clone(field.Value)})
+		}
+	}
+	c.tracer.Record(trace.Entry{
+		Source:    trace.SourceAPNS,
+		Direction: direction,
+		Command:   uint8(p.ID),
+		Fields:    fields,
+		Topics:    frameTopics(direction, p),
+	})
+}
+
+// frameTopics names the topic hashes in a frame. Incoming and outgoing
+// messages keep the topic in different fields.
+func frameTopics(direction trace.Direction, p *Payload) []string {
+	var hashes [][]byte
+	switch {
+	case p.ID == CommandSendMessage && direction == trace.In:
+		hashes = p.FieldValues(FieldIncomingTopic)
+	case p.ID == CommandSendMessage:
+		hashes = p.FieldValues(FieldOutgoingTopic)
+	case p.ID == CommandFilterTopics:
+		for _, field := range p.Fields {
+			if field.ID >= FieldFilterTopicsTopic && field.ID <= FieldFilterTopicsPaused {
+				hashes = append(hashes, field.Value)
+			}
+		}
+	}
+	var names []string
+	for _, hash := range hashes {
+		names = append(names, TopicName(hash))
+	}
+	return names
+}
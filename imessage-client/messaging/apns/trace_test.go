@@ -0,0 +1,53 @@
+package apns
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"imessage-client/messaging/trace"
+)
+
+func TestTraceRedactsPushToken(t *testing.T) {
+	token := []byte("secret-push-token-0123456789abcd")
+	frames := []struct {
+		direction trace.Direction
+		payload   *Payload
+	}{
+		{trace.Out, (&ConnectCommand{DeviceToken: token}).ToPayload()},
+		{trace.In, (&ConnectAckCommand{Token: token}).ToPayload()},
+		{trace.Out, (&FilterTopicsCommand{Token: token, Topics: hashTopics([]Topic{TopicMadrid})}).ToPayload()},
+		{trace.Out, (&OutgoingSendMessageCommand{Topic: TopicMadrid.Hash(), Token: token, MessageID: NewMessageID()}).ToPayload()},
+		{trace.In, (&IncomingSendMessageCommand{Token: token, Topic: TopicMadrid.Hash(), MessageID: NewMessageID()}).ToPayload()},
+		{trace.In, (&SendMessageAckCommand{Token: token, MessageID: NewMessageID()}).ToPayload()},
+		{trace.Out, (&SendMessageAckCommand{Token: token, MessageID: NewMessageID()}).ToPayload()},
+	}
+
+	var buf bytes.Buffer
+	c := &Connection{}
+	c.SetTracer(trace.NewRecorder(&buf))
+	for _, frame := range frames {
+		c.traceFrame(frame.direction, frame.payload)
+	}
+
+	n := 0
+	err := trace.ReadEntries(&buf, func(entry trace.Entry) error {
+		for _, field := range entry.Fields {
+			if bytes.Contains(field.Value, token) {
+				t.Errorf("command %d field %d has the push token in clear", entry.Command, field.ID)
+			}
+		}
+		// Topics are still named
+		if entry.Command == uint8(CommandSendMessage) && !strings.Contains(strings.Join(entry.Topics, ","), string(TopicMadrid)) {
+			t.Errorf("send message topics = %v", entry.Topics)
+		}
+		n++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(frames) {
+		t.Errorf("traced %d frames, want %d", n, len(frames))
+	}
+}
@@ -0,0 +1,47 @@
+package apns
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"strings"
+)
+
+// maxUnknownDump bounds how much of an unknown frame is logged.
+const maxUnknownDump = 128
+
+// UnknownCommandHandler is called with commands ReadLoop doesn't know, so
+// new protocol features can be spotted. The payload is a copy the handler
+// may keep.
+type UnknownCommandHandler func(payload *Payload)
+
+// SetUnknownCommandHandler sets the handler for unknown commands.
+func (c *Connection) SetUnknownCommandHandler(handler UnknownCommandHandler) {
+	c.unknownHandler = handler
+}
+
+// handleUnknown logs an unknown command with its field IDs and lengths and
+// the start of the frame, and passes it on to the handler.
+func (c *Connection) handleUnknown(p *Payload) {
+	fields := make([]string, len(p.Fields))
+	for i, field := range p.Fields {
+		fields[i] = fmt.Sprintf("%d:%d", field.ID, len(field.Value))
+	}
+	frame := p.ToBytes()
+	dump := hex.EncodeToString(frame[:min(len(frame), maxUnknownDump)])
+	if len(frame) > maxUnknownDump {
+		dump += fmt.Sprintf("... (%d bytes)", len(frame))
+	}
+	slog.Debug("Received unknown command", "command", p.ID, "fields", strings.Join(fields, " "), "hexdump", dump)
+
+	if c.unknownHandler == nil {
+		return
+	}
+	// Frames are decoded into reused buffers
+	clone := &Payload{ID: p.ID, Fields: make([]Field, len(p.Fields))}
+	for i, field := range p.Fields {
+		clone.Fields[i] = Field{ID: field.ID, Value: bytes.Clone(field.Value)}
+	}
+	c.unknownHandler(clone)
+}
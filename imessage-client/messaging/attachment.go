@@ -0,0 +1,204 @@
+package messaging
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"strings"
+
+	"imessage-client/messaging/apns"
+)
+
+// MaxInlineAttachmentSize is the largest attachment embedded directly in the
+// message payload. Anything bigger has to go through MMCS.
+const MaxInlineAttachmentSize = 10 * 1024
+
+// inlineAttachmentKeys are the payload keys of the inline attachment slots.
+var inlineAttachmentKeys = []string{"ia-0", "ia-1"}
+
+// attachmentPlaceholder marks an attachment's position in the message text.
+const attachmentPlaceholder = "\ufffc"
+
+var (
+	ErrAttachmentTooLargeForInline = errors.New("attachment too large to send inline")
+	ErrTooManyInlineAttachments    = errors.New("too many attachments to send inline")
+)
+
+// Attachment is a file attached to a message.
+type Attachment struct {
+	FileName string `json:"file_name"`
+	MimeType string `json:"mime_type,omitempty"`
+	UTIType  string `json:"uti_type,omitempty"`
+	FileSize int    `json:"file_size,omitempty"`
+	// Width and Height are the pixel dimensions of images, or zero.
+	Width  int `json:"width,omitempty"`
+	Height int `json:"height,omitempty"`
+
+	// InlineData is set for attachments embedded in the payload.
+	InlineData []byte `json:"inline_data,omitempty"`
+}
+
+// attachmentXML is the <FILE> element describing an attachment in the message XML.
+type attachmentXML struct {
+	Name             string `xml:"name,attr,omitempty"`
+	Width            int    `xml:"width,attr"`
+	Height           int    `xml:"height,attr"`
+	Datasize         int    `xml:"datasize,attr,omitempty"`
+	MimeType         string `xml:"mime-type,attr,omitempty"`
+	UTIType          string `xml:"uti-type,attr,omitempty"`
+	FileSize         int    `xml:"file-size,attr,omitempty"`
+	MessagePart      int    `xml:"message-part,attr"`
+	MMCSSignatureHex string `xml:"mmcs-signature-hex,attr,omitempty"`
+	MMCSURL          string `xml:"mmcs-url,attr,omitempty"`
+	MMCSOwner        string `xml:"mmcs-owner,attr,omitempty"`
+	DecryptionKey    string `xml:"decryption-key,attr,omitempty"`
+	InlineAttachment string `xml:"inline-attachment,attr,omitempty"`
+}
+
+type messagePartXML struct {
+	PartIdx int    `xml:"message-part,attr"`
+	Value   string `xml:",innerxml"`
+}
+
+// messageXML is the HTML-ish body Apple clients send alongside attachments.
+type messageXML struct {
+	XMLName     xml.Name          `xml:"html"`
+	Attachments []*attachmentXML  `xml:"body>FILE"`
+	Text        []*messagePartXML `xml:"body>span"`
+}
+
+// SetInlineAttachment embeds att in the payload, with an optional caption.
+func (p *IMessagePayload) SetInlineAttachment(att Attachment, caption string) error {
+	return p.SetInlineAttachments([]Attachment{att}, caption)
+}
+
+// SetInlineAttachments embeds atts in the payload in order, followed by an
+// optional caption.
+func (p *IMessagePayload) SetInlineAttachments(atts []Attachment, caption string) error {
+	return p.setInlineAttachments(atts, PlainText(caption))
+}
+
+func (p *IMessagePayload) setInlineAttachments(atts []Attachment, caption RichText) error {
+	if len(atts) == 0 {
+		return errors.New("no attachments")
+	}
+	if len(atts) > len(inlineAttachmentKeys) {
+		return fmt.Errorf("%w: %d (limit %d)", ErrTooManyInlineAttachments, len(atts), len(inlineAttachmentKeys))
+	}
+	var body messageXML
+	var text strings.Builder
+	for i, att := range atts {
+		if len(att.InlineData) == 0 {
+			return fmt.Errorf("attachment %q has no data", att.FileName)
+		}
+		if len(att.InlineData) > MaxInlineAttachmentSize {
+			return fmt.Errorf("%w: %q is %d bytes (limit %d)", ErrAttachmentTooLargeForInline, att.FileName, len(att.InlineData), MaxInlineAttachmentSize)
+		}
+		body.Attachments = append(body.Attachments, &attachmentXML{
+			Name:             att.FileName,
+			Width:            att.Width,
+			Height:           att.Height,
+			MimeType:         att.MimeType,
+			UTIType:          att.UTIType,
+			FileSize:         len(att.InlineData),
+			Datasize:         len(att.InlineData),
+			MessagePart:      i,
+			InlineAttachment: inlineAttachmentKeys[i],
+		})
+		text.WriteString(attachmentPlaceholder)
+	}
+	if caption.Text != "" {
+		body.Text = []*messagePartXML{{PartIdx: len(atts), Value: caption.HTML()}}
+	}
+	encoded, err := xml.Marshal(&body)
+	if err != nil {
+		return fmt.Errorf("failed to encode message XML: %w", err)
+	}
+	p.XML = string(encoded)
+	p.Text = text.String() + caption.Text
+	p.InlineAttachment0 = atts[0].InlineData
+	p.InlineAttachment1 = nil
+	if len(atts) > 1 {
+		p.InlineAttachment1 = atts[1].InlineData
+	}
+	return nil
+}
+
+// SetRichText sets the message text, describing its formatting in the
+// payload XML and attributed body. Clients that don't render formatting show
+// the plain text.
+func (p *IMessagePayload) SetRichText(text RichText) error {
+	p.Text = text.Text
+	if !text.Styled() {
+		return nil
+	}
+	body := messageXML{Text: []*messagePartXML{{PartIdx: 0, Value: text.HTML()}}}
+	encoded, err := xml.Marshal(&body)
+	if err != nil {
+		return fmt.Errorf("failed to encode message XML: %w", err)
+	}
+	attributed, err := EncodeAttributedBody(text)
+	if err != nil {
+		return fmt.Errorf("failed to encode attributed body: %w", err)
+	}
+	p.XML = string(encoded)
+	p.AttributedBody = attributed
+	return nil
+}
+
+// checkAttachmentsFit reports whether atts and caption fit in one message.
+func (s *Session) checkAttachmentsFit(atts []Attachment, caption RichText) error {
+	payload := &IMessagePayload{}
+	if err := payload.setInlineAttachments(atts, caption); err != nil {
+		return err
+	}
+	body, err := encodeOutgoing(payload)
+	if err != nil {
+		return fmt.Errorf("failed to encode message: %w", err)
+	}
+	if limit := s.maxBodySize(); len(body) > limit {
+		return apns.PayloadTooLargeError{Size: len(body), Limit: limit}
+	}
+	return nil
+}
+
+// Attachments decodes the attachments described in the payload XML. Inline
+// attachment data is filled in; MMCS attachments are returned without data.
+func (p *IMessagePayload) Attachments() ([]Attachment, error) {
+	if p.XML == "" {
+		return nil, nil
+	}
+	var body messageXML
+	if err := xml.Unmarshal([]byte(p.XML), &body); err != nil {
+		return nil, fmt.Errorf("failed to decode message XML: %w", err)
+	}
+	attachments := make([]Attachment, 0, len(body.Attachments))
+	for _, att := range body.Attachments {
+		converted := Attachment{
+			FileName: att.Name,
+			MimeType: att.MimeType,
+			UTIType:  att.UTIType,
+			FileSize: att.FileSize,
+			Width:    att.Width,
+			Height:   att.Height,
+		}
+		if att.InlineAttachment != "" {
+			converted.InlineData = p.inlineAttachment(att.InlineAttachment)
+			if converted.InlineData == nil {
+				return nil, fmt.Errorf("inline attachment %q not found", att.InlineAttachment)
+			}
+		}
+		attachments = append(attachments, converted)
+	}
+	return attachments, nil
+}
+
+func (p *IMessagePayload) inlineAttachment(name string) []byte {
+	switch name {
+	case inlineAttachmentKeys[0]:
+		return p.InlineAttachment0
+	case inlineAttachmentKeys[1]:
+		return p.InlineAttachment1
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package messaging
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"imessage-client/messaging/apns"
+	"imessage-client/messaging/apns/apnstest"
+)
+
+func TestSendWithAttachments(t *testing.T) {
+	server, err := apnstest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	me := newTestDevice(t, "me")
+	theirPhone := newTestDevice(t, "their-phone")
+	session := testSendSession(t, me, map[string][]*testDevice{
+		"tel:+15555550123":      {theirPhone},
+		"mailto:me@example.com": {me},
+	})
+	session.state.APNSConn = testAPNSConnection(t, server)
+
+	atts := []Attachment{
+		{FileName: "a.png", MimeType: "image/png", UTIType: "public.png", Width: 2, Height: 3, InlineData: []byte("png data")},
+		{FileName: "b.txt", MimeType: "text/plain", UTIType: "public.plain-text", InlineData: []byte("text data")},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := session.Send(ctx, "tel:+15555550123", "caption", SendOptions{Attachments: atts}); err != nil {
+		t.Fatal(err)
+	}
+
+	sent, err := server.WaitFor(ctx, apns.CommandSendMessage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	madrid, err := apns.ParseMadridPayload(sent.Field(apns.FieldOutgoingPayload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := DecryptMessage(theirPhone.key, madrid.DTL[0].Payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Text != attachmentPlaceholder+attachmentPlaceholder+"caption" {
+		t.Errorf("text = %q", msg.Text)
+	}
+	got, err := msg.Attachments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("got %d attachments, want 2", len(got))
+	}
+	for i, att := range got {
+		if att.FileName != atts[i].FileName || att.MimeType != atts[i].MimeType || !bytes.Equal(att.InlineData, atts[i].InlineData) {
+			t.Errorf("attachment %d = %+v, want %+v", i, att, atts[i])
+		}
+	}
+	if got[0].Width != 2 || got[0].Height != 3 {
+		t.Errorf("dimensions = %dx%d, want 2x3", got[0].Width, got[0].Height)
+	}
+
+	tooMany := append(atts, atts[0])
+	if _, err := session.Send(ctx, "tel:+15555550123", "", SendOptions{Attachments: tooMany}); !errors.Is(err, ErrTooManyInlineAttachments) {
+		t.Errorf("err = %v, want ErrTooManyInlineAttachments", err)
+	}
+}
@@ -0,0 +1,200 @@
+package messaging
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"unicode/utf16"
+
+	"imessage-client/messaging/nskeyed"
+)
+
+var ErrInvalidAttributedBody = errors.New("invalid attributed body")
+
+// Attribute names Apple clients use in attributed message bodies.
+const (
+	attrMessagePart = "__kIMMessagePartAttributeName"
+	attrBold        = "__kIMTextBoldAttributeName"
+	attrItalic      = "__kIMTextItalicAttributeName"
+	attrUnderline   = "__kIMTextUnderlineAttributeName"
+	attrLink        = "__kIMLinkAttributeName"
+	attrMention     = "__kIMMentionConfirmedMention"
+)
+
+// DecodeAttributedBody decodes an archived NSAttributedString into rich
+// text. Attributes other than formatting, links and mentions are ignored.
+func DecodeAttributedBody(data []byte) (RichText, error) {
+	root, err := nskeyed.Unarchive(data)
+	if err != nil {
+		return RichText{}, err
+	}
+	obj, ok := root.(*nskeyed.Object)
+	if !ok || (obj.Class != "NSAttributedString" && obj.Class != "NSMutableAttributedString") {
+		return RichText{}, fmt.Errorf("%w: root is %T, not an attributed string", ErrInvalidAttributedBody, root)
+	}
+	text, ok := obj.Fields["NSString"].(string)
+	if !ok {
+		return RichText{}, fmt.Errorf("%w: no string", ErrInvalidAttributedBody)
+	}
+	units := len(utf16.Encode([]rune(text)))
+
+	// One attribute dictionary covers the whole string; several come with
+	// NSAttributeInfo listing (length, dictionary index) pairs
+	var dicts []interface{}
+	switch attrs := obj.Fields["NSAttributes"].(type) {
+	case nil:
+		return PlainText(text), nil
+	case map[string]interface{}:
+		return richTextFromRuns(text, []attributeRun{{Length: units, Attrs: attrs}}), nil
+	case []interface{}:
+		dicts = attrs
+	default:
+		return RichText{}, fmt.Errorf("%w: attributes are %T", ErrInvalidAttributedBody, attrs)
+	}
+	info, _ := obj.Fields["NSAttributeInfo"].([]byte)
+	var runs []attributeRun
+	remaining := uint64(units)
+	for len(info) > 0 {
+		length, n := binary.Uvarint(info)
+		if n <= 0 || length > remaining {
+			return RichText{}, fmt.Errorf("%w: bad attribute info", ErrInvalidAttributedBody)
+		}
+		remaining -= length
+		info = info[n:]
+		index, n := binary.Uvarint(info)
+		if n <= 0 || index >= uint64(len(dicts)) {
+			return RichText{}, fmt.Errorf("%w: bad attribute info", ErrInvalidAttributedBody)
+		}
+		info = info[n:]
+		attrs, _ := dicts[index].(map[string]interface{})
+		runs = append(runs, attributeRun{Length: int(length), Attrs: attrs})
+	}
+	return richTextFromRuns(text, runs), nil
+}
+
+// EncodeAttributedBody archives rich text as an NSMutableAttributedString,
+// the attributed body Apple clients read styled text and mentions from.
+func EncodeAttributedBody(text RichText) ([]byte, error) {
+	units := len(utf16.Encode([]rune(text.Text)))
+	var runs []TextStyle
+	var info []byte
+	addRun := func(length int, style TextStyle) {
+		if length <= 0 {
+			return
+		}
+		index := len(runs)
+		for i, existing := range runs {
+			if existing == style {
+				index = i
+				break
+			}
+		}
+		if index == len(runs) {
+			runs = append(runs, style)
+		}
+		info = binary.AppendUvarint(info, uint64(length))
+		info = binary.AppendUvarint(info, uint64(index))
+	}
+	pos := 0
+	for _, rng := range text.Ranges {
+		if rng.Start < pos || rng.Start+rng.Length > units {
+			return nil, fmt.Errorf("range %d+%d doesn't fit in %d characters", rng.Start, rng.Length, units)
+		}
+		addRun(rng.Start-pos, TextStyle{})
+		addRun(rng.Length, rng.Style)
+		pos = rng.Start + rng.Length
+	}
+	addRun(units-pos, TextStyle{})
+
+	fields := map[string]interface{}{"NSString": text.Text}
+	switch len(runs) {
+	case 0:
+	case 1:
+		// A single run covering the whole string needs no run lengths
+		fields["NSAttributes"] = attributesFromStyle(runs[0])
+	default:
+		dicts := make([]interface{}, len(runs))
+		for i, style := range runs {
+			dicts[i] = attributesFromStyle(style)
+		}
+		fields["NSAttributes"] = dicts
+		fields["NSAttributeInfo"] = info
+	}
+	return nskeyed.Archive(&nskeyed.Object{
+		Class:   "NSMutableAttributedString",
+		Classes: []string{"NSMutableAttributedString", "NSAttributedString", "NSObject"},
+		Fields:  fields,
+	})
+}
+
+func attributesFromStyle(style TextStyle) map[string]interface{} {
+	attrs := map[string]interface{}{attrMessagePart: uint64(0)}
+	if style.Bold {
+		attrs[attrBold] = uint64(1)
+	}
+	if style.Italic {
+		attrs[attrItalic] = uint64(1)
+	}
+	if style.Underline {
+		attrs[attrUnderline] = uint64(1)
+	}
+	if style.Link != "" {
+		attrs[attrLink] = nskeyed.URL(style.Link)
+	}
+	if style.Mention != "" {
+		attrs[attrMention] = style.Mention
+	}
+	return attrs
+}
+
+// attributeRun is a run of an attributed string sharing one set of
+// attributes. Length counts UTF-16 code units.
+type attributeRun struct {
+	Length int
+	Attrs  map[string]interface{}
+}
+
+func richTextFromRuns(text string, runs []attributeRun) RichText {
+	units := utf16.Encode([]rune(text))
+	var b richTextBuilder
+	pos := 0
+	for _, run := range runs {
+		if run.Length < 0 {
+			continue
+		}
+		end := pos + run.Length
+		if end > len(units) || end < pos {
+			end = len(units)
+		}
+		b.write(string(utf16.Decode(units[pos:end])), styleFromAttributes(run.Attrs))
+		pos = end
+	}
+	b.write(string(utf16.Decode(units[pos:])), TextStyle{})
+	return RichText{Text: b.text.String(), Ranges: b.ranges}
+}
+
+func styleFromAttributes(attrs map[string]interface{}) TextStyle {
+	var style TextStyle
+	style.Bold = attributeSet(attrs[attrBold])
+	style.Italic = attributeSet(attrs[attrItalic])
+	style.Underline = attributeSet(attrs[attrUnderline])
+	style.Link, _ = attrs[attrLink].(string)
+	style.Mention, _ = attrs[attrMention].(string)
+	return style
+}
+
+// attributeSet reports whether a boolean attribute, archived as an NSNumber,
+// is on.
+func attributeSet(v interface{}) bool {
+	switch v := v.(type) {
+	case bool:
+		return v
+	case uint64:
+		return v != 0
+	case int64:
+		return v != 0
+	case float64:
+		return v != 0
+	}
+	return false
+}
@@ -0,0 +1,30 @@
+package messaging
+
+import (
+	"encoding/binary"
+	"testing"
+	"unicode/utf16"
+)
+
+func FuzzDecodeAttributedBody(f *testing.F) {
+	f.Add(testAttributedBody(f))
+	f.Add(attributedBodyWithInfo(f, binary.AppendUvarint([]byte{1, 0}, 1<<63)))
+	if data, err := EncodeAttributedBody(ParseMarkdown("**bold** and [a link](https://example.com)")); err == nil {
+		f.Add(data)
+	}
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		rich, err := DecodeAttributedBody(data)
+		if err != nil {
+			return
+		}
+		// Every range must fit in the decoded text
+		units := len(utf16.Encode([]rune(rich.Text)))
+		for _, rng := range rich.Ranges {
+			if rng.Start < 0 || rng.Length < 0 || rng.Start+rng.Length > units {
+				t.Fatalf("range %d+%d outside %d units", rng.Start, rng.Length, units)
+			}
+		}
+	})
+}
@@ -0,0 +1,111 @@
+package messaging
+
+import (
+	"encoding/binary"
+	"errors"
+	"reflect"
+	"testing"
+
+	"howett.net/plist"
+)
+
+// testAttributedBody archives "Hi @Bob, bold" with a mention and a bold run
+// the way Foundation lays it out.
+func testAttributedBody(t testing.TB) []byte {
+	// (3, plain), (4, mention), (2, plain), (4, bold)
+	return attributedBodyWithInfo(t, []byte{3, 0, 4, 1, 2, 0, 4, 2})
+}
+
+// attributedBodyWithInfo is testAttributedBody with its run lengths and
+// dictionary indexes replaced by info.
+func attributedBodyWithInfo(t testing.TB, info []byte) []byte {
+	t.Helper()
+	objects := []interface{}{
+		"$null",
+		map[string]interface{}{
+			"$class":          plist.UID(7),
+			"NSString":        plist.UID(2),
+			"NSAttributes":    plist.UID(4),
+			"NSAttributeInfo": plist.UID(13),
+		},
+		map[string]interface{}{"$class": plist.UID(3), "NS.string": "Hi @Bob, bold"},
+		map[string]interface{}{"$classname": "NSMutableString", "$classes": []interface{}{"NSMutableString", "NSString", "NSObject"}},
+		map[string]interface{}{"$class": plist.UID(5), "NS.objects": []interface{}{plist.UID(6), plist.UID(9), plist.UID(12)}},
+		map[string]interface{}{"$classname": "NSArray", "$classes": []interface{}{"NSArray", "NSObject"}},
+		map[string]interface{}{"$class": plist.UID(8), "NS.keys": []interface{}{}, "NS.objects": []interface{}{}},
+		map[string]interface{}{"$classname": "NSMutableAttributedString", "$classes": []interface{}{"NSMutableAttributedString", "NSAttributedString", "NSObject"}},
+		map[string]interface{}{"$classname": "NSDictionary", "$classes": []interface{}{"NSDictionary", "NSObject"}},
+		map[string]interface{}{"$class": plist.UID(8), "NS.keys": []interface{}{plist.UID(10)}, "NS.objects": []interface{}{plist.UID(11)}},
+		attrMention,
+		"tel:+15555550123",
+		map[string]interface{}{"$class": plist.UID(8), "NS.keys": []interface{}{plist.UID(14)}, "NS.objects": []interface{}{uint64(1)}},
+		info,
+		attrBold,
+	}
+	data, err := plist.Marshal(map[string]interface{}{
+		"$archiver": "NSKeyedArchiver",
+		"$version":  100000,
+		"$top":      map[string]interface{}{"root": plist.UID(1)},
+		"$objects":  objects,
+	}, plist.BinaryFormat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestDecodeAttributedBody(t *testing.T) {
+	rich, err := DecodeAttributedBody(testAttributedBody(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := RichText{
+		Text: "Hi @Bob, bold",
+		Ranges: []TextRange{
+			{Start: 3, Length: 4, Style: TextStyle{Mention: "tel:+15555550123"}},
+			{Start: 9, Length: 4, Style: TextStyle{Bold: true}},
+		},
+	}
+	if !reflect.DeepEqual(rich, want) {
+		t.Errorf("got %+v, want %+v", rich, want)
+	}
+
+	// The archive fills in the text when the plain text field is missing
+	msg := newIncomingMessage(&IMessagePayload{Participants: []string{"tel:+15555550123"}, AttributedBody: testAttributedBody(t)}, nil, "", nil)
+	if msg.Text != want.Text || !reflect.DeepEqual(msg.Formatting, want.Ranges) {
+		t.Errorf("message text %q formatting %+v", msg.Text, msg.Formatting)
+	}
+}
+
+func TestEncodeAttributedBodyRoundTrip(t *testing.T) {
+	tests := []RichText{
+		PlainText("plain"),
+		{Text: "all bold", Ranges: []TextRange{{Start: 0, Length: 8, Style: TextStyle{Bold: true}}}},
+		ParseMarkdown("😀 **hi** [there](https://example.com) _you_ **too**"),
+		{Text: "hey Bob", Ranges: []TextRange{{Start: 4, Length: 3, Style: TextStyle{Mention: "mailto:bob@example.com"}}}},
+	}
+	for _, want := range tests {
+		data, err := EncodeAttributedBody(want)
+		if err != nil {
+			t.Fatalf("%q: %v", want.Text, err)
+		}
+		got, err := DecodeAttributedBody(data)
+		if err != nil {
+			t.Fatalf("%q: %v", want.Text, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("got %+v, want %+v", got, want)
+		}
+	}
+}
+
+func TestDecodeAttributedBodyRejectsLongRuns(t *testing.T) {
+	for name, info := range map[string][]byte{
+		"past the end": {3, 0, 20, 1},
+		"overflowing":  binary.AppendUvarint([]byte{1, 0}, 1<<63),
+	} {
+		if _, err := DecodeAttributedBody(attributedBodyWithInfo(t, info)); !errors.Is(err, ErrInvalidAttributedBody) {
+			t.Errorf("%s: err = %v, want ErrInvalidAttributedBody", name, err)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package messaging
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// HandshakeTimings is how long each phase of bringing up a session took.
+type HandshakeTimings struct {
+	// Keygen is generating the IDS, push and auth keys.
+	Keygen time.Duration
+	// Register is the IDS register request.
+	Register time.Duration
+	// APNSConnect is connecting to the courier and subscribing to topics.
+	APNSConnect time.Duration
+	// Total also counts building requests and parsing responses.
+	Total time.Duration
+}
+
+// TimeHandshake runs the session's handshake and connects to the courier,
+// timing each phase. The session must not have done its handshake yet.
+func (s *Session) TimeHandshake(ctx context.Context) (HandshakeTimings, error) {
+	var timings HandshakeTimings
+	if s.state != nil {
+		return timings, errors.New("session has already done its handshake")
+	}
+	if h, ok := s.handshaker.(RealHandshaker); ok {
+		h.Timings = &timings
+		s.handshaker = h
+	}
+	start := time.Now()
+	if err := s.ensureHandshake(); err != nil {
+		return timings, err
+	}
+	connectStart := time.Now()
+	if err := s.ensureAPNS(ctx); err != nil {
+		return timings, err
+	}
+	timings.APNSConnect = time.Since(connectStart)
+	timings.Total = time.Since(start)
+	return timings, nil
+}
+
+// TimeHandshake opens a new session with the client's settings, separate
+// from the one other calls reuse, and times its handshake. The session is
+// closed before returning.
+func (c *Client) TimeHandshake(ctx context.Context) (HandshakeTimings, error) {
+	c.sessionMu.Lock()
+	session, err := c.newSession(ctx)
+	c.sessionMu.Unlock()
+	if err != nil {
+		return HandshakeTimings{}, err
+	}
+	defer session.Close()
+	return session.TimeHandshake(ctx)
+}
@@ -0,0 +1,48 @@
+package messaging
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// DefaultCertWarningThreshold is how long before the ID certificate expires
+// a CertExpiringEvent is emitted.
+const DefaultCertWarningThreshold = 72 * time.Hour
+
+// CertExpiry returns when the ID certificate expires. Before the handshake
+// it falls back to the expiry recorded in the store by an earlier session.
+func (s *Session) CertExpiry() time.Time {
+	if s.state != nil && s.state.IDSConfig != nil {
+		if expiry := s.state.IDSConfig.IDCertExpiry(); !expiry.IsZero() {
+			return expiry
+		}
+	}
+	return s.store.IDCertExpiry()
+}
+
+// SetCertWarningThreshold changes how long before expiry a
+// CertExpiringEvent is emitted. Zero disables the warning.
+func (s *Session) SetCertWarningThreshold(threshold time.Duration) {
+	s.certWarningThreshold = threshold
+}
+
+// checkCertExpiry records the ID certificate expiry after a handshake and
+// warns if it's close.
+func (s *Session) checkCertExpiry() {
+	expiry := s.CertExpiry()
+	if expiry.IsZero() {
+		return
+	}
+	if err := s.store.SetIDCertExpiry(expiry); err != nil {
+		slog.Warn("Failed to save ID certificate expiry", "err", err)
+	}
+	remaining := time.Until(expiry)
+	if remaining <= 0 {
+		s.alert(AlertCertExpired, fmt.Errorf("ID certificate expired at %s", expiry.Format(time.RFC3339)))
+		return
+	}
+	if s.certWarningThreshold > 0 && remaining < s.certWarningThreshold {
+		s.emit(CertExpiringEvent{Expiry: expiry, Remaining: remaining})
+	}
+}
@@ -0,0 +1,114 @@
+package messaging
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+var ErrInvalidChatID = errors.New("invalid chat identifier")
+
+// ChatID identifies a chat in one canonical form, so the same chat is never
+// stored under two keys. A DM is the other side's handle as a URI, with phone
+// numbers stripped of formatting ("tel:+15555550123") and email addresses in
+// lower case ("mailto:user@example.com"). A group is its GUID in upper case.
+type ChatID string
+
+// ParseChatID canonicalizes a chat given as a handle URI, a bare phone number
+// or email address, a group GUID, or an Apple chat GUID like
+// "iMessage;-;+15555550123".
+func ParseChatID(s string) (ChatID, error) {
+	s = strings.TrimSpace(s)
+	if _, rest, ok := cutChatGUID(s); ok {
+		s = rest
+	}
+	lower := strings.ToLower(s)
+	switch {
+	case strings.HasPrefix(lower, "mailto:"):
+		return parseEmailChat(s[len("mailto:"):])
+	case strings.HasPrefix(lower, "tel:"):
+		return parsePhoneChat(s[len("tel:"):])
+	case strings.Contains(s, "@"):
+		return parseEmailChat(s)
+	}
+	if id, err := uuid.Parse(s); err == nil {
+		return ChatID(strings.ToUpper(id.String())), nil
+	}
+	if strings.HasPrefix(lower, "chat") && len(s) > len("chat") && isDigits(s[len("chat"):]) {
+		// Groups created by older clients have a numeric chat ID
+		return ChatID(lower), nil
+	}
+	if id, err := parsePhoneChat(s); err == nil {
+		return id, nil
+	}
+	return "", fmt.Errorf("%w %q (want a phone number, email address or group ID)", ErrInvalidChatID, s)
+}
+
+// IsGroup reports whether the chat is a group rather than a DM.
+func (c ChatID) IsGroup() bool {
+	return !strings.HasPrefix(string(c), "tel:") && !strings.HasPrefix(string(c), "mailto:")
+}
+
+func (c ChatID) String() string {
+	return string(c)
+}
+
+// canonicalChat returns the canonical form of chat, or chat unchanged if it
+// can't be parsed, so placeholders like "unknown-chat" pass through.
+func canonicalChat(chat string) string {
+	id, err := ParseChatID(chat)
+	if err != nil {
+		return chat
+	}
+	return id.String()
+}
+
+// cutChatGUID splits an Apple chat GUID into its service and identifier.
+func cutChatGUID(s string) (service, rest string, ok bool) {
+	for _, sep := range []string{";-;", ";+;"} {
+		if service, rest, ok = strings.Cut(s, sep); ok && service != "" && !strings.Contains(service, ":") {
+			return service, rest, true
+		}
+	}
+	return "", "", false
+}
+
+func parseEmailChat(s string) (ChatID, error) {
+	local, domain, ok := strings.Cut(s, "@")
+	if !ok || local == "" || domain == "" || strings.ContainsAny(s, " \t") {
+		return "", fmt.Errorf("%w: bad email address %q", ErrInvalidChatID, s)
+	}
+	return ChatID("mailto:" + strings.ToLower(s)), nil
+}
+
+func parsePhoneChat(s string) (ChatID, error) {
+	var b strings.Builder
+	for i, r := range s {
+		switch {
+		case r >= '0' && r <= '9':
+			b.WriteRune(r)
+		case r == '+' && i == 0:
+			b.WriteRune(r)
+		case strings.ContainsRune(" -().", r):
+			// Formatting
+		default:
+			return "", fmt.Errorf("%w: bad phone number %q", ErrInvalidChatID, s)
+		}
+	}
+	digits := strings.TrimPrefix(b.String(), "+")
+	if len(digits) < 3 {
+		return "", fmt.Errorf("%w: bad phone number %q", ErrInvalidChatID, s)
+	}
+	return ChatID("tel:" + b.String()), nil
+}
+
+func isDigits(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
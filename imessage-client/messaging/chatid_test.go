@@ -0,0 +1,83 @@
+package messaging
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseChatID(t *testing.T) {
+	tests := []struct {
+		in   string
+		want ChatID
+	}{
+		{"tel:+15555550123", "tel:+15555550123"},
+		{"+1 (555) 555-0123", "tel:+15555550123"},
+		{"TEL:+1.555.555.0123", "tel:+15555550123"},
+		{"User@Example.com", "mailto:user@example.com"},
+		{"mailto:User@Example.com", "mailto:user@example.com"},
+		{"iMessage;-;+15555550123", "tel:+15555550123"},
+		{"SMS;-;+15555550123", "tel:+15555550123"},
+		{"6e2b1f0a-2d2c-4c33-9a5e-0c1e2d3f4a5b", "6E2B1F0A-2D2C-4C33-9A5E-0C1E2D3F4A5B"},
+		{"iMessage;+;6e2b1f0a-2d2c-4c33-9a5e-0c1e2d3f4a5b", "6E2B1F0A-2D2C-4C33-9A5E-0C1E2D3F4A5B"},
+		{"chat123456789", "chat123456789"},
+	}
+	for _, tt := range tests {
+		got, err := ParseChatID(tt.in)
+		if err != nil || got != tt.want {
+			t.Errorf("ParseChatID(%q) = %q, %v; want %q", tt.in, got, err, tt.want)
+		}
+	}
+	for _, bad := range []string{"", "bob", "tel:abc", "mailto:@example.com", "12"} {
+		if _, err := ParseChatID(bad); !errors.Is(err, ErrInvalidChatID) {
+			t.Errorf("ParseChatID(%q) err = %v, want ErrInvalidChatID", bad, err)
+		}
+	}
+	if id, _ := ParseChatID("+15555550123"); id.IsGroup() {
+		t.Error("DM is a group")
+	}
+	if id, _ := ParseChatID("chat123"); !id.IsGroup() {
+		t.Error("group is not a group")
+	}
+}
+
+func TestFileStoreMigratesChatIDs(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	old := `{
+  "version": 2,
+  "chats": {
+    "+15555550123": {"last_seen": "2024-05-01T10:00:00Z", "last_message_id": "A", "counter": 2},
+    "tel:+1 555 555 0123": {"last_seen": "2024-05-01T11:00:00Z", "last_message_id": "B", "counter": 1}
+  },
+  "messages": {"B": {"chat": "tel:+1 555 555 0123", "delivered": "2024-05-01T11:00:00Z"}}
+}`
+	if err := os.WriteFile(path, []byte(old), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	store, err := NewFileStoreWithFlushInterval(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chats := store.Chats(); len(chats) != 1 || chats[0] != "tel:+15555550123" {
+		t.Fatalf("chats = %v", chats)
+	}
+	cursor := store.Cursor("tel:+15555550123")
+	if cursor.LastMessageID != "B" || cursor.Counter != 3 {
+		t.Errorf("merged cursor = %+v", cursor)
+	}
+	if status, _ := store.MessageStatus("B"); status.Chat != "tel:+15555550123" {
+		t.Errorf("status chat = %q", status.Chat)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chats := reopened.Chats(); len(chats) != 1 || chats[0] != "tel:+15555550123" {
+		t.Errorf("chats after reopening = %v", chats)
+	}
+}
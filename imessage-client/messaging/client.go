@@ -2,24 +2,50 @@ package messaging
 
 import (
 	"context"
+	"fmt"
+	"sync"
 	"time"
 
 	"imessage-client/config"
+	"imessage-client/messaging/apns"
+	"imessage-client/messaging/trace"
 )
 
 type MessageSummary struct {
-	Sender    string
-	Preview   string
-	Timestamp time.Time
+	Sender    string    `json:"sender"`
+	Chat      string    `json:"chat,omitempty"`
+	Preview   string    `json:"preview"`
+	Timestamp time.Time `json:"timestamp"`
+	Service   string    `json:"service,omitempty"`
+	// Muted is set for messages in chats muted with Mute, which notifiers
+	// leave out.
+	Muted bool `json:"muted,omitempty"`
 }
 
 type Client struct {
 	registration *config.RegistrationData
 	store        Store
+	eventHandler EventHandler
+	tracer       *trace.Recorder
+	lookupCache  *LookupCache
+
+	identityPolicy  IdentityPolicy
+	deliveryTimeout time.Duration
+	smsFallback     SMSFallback
+	offlineQueue    bool
+	power           config.PowerProfile
+	ports           apns.PortPolicy
+
+	refreshRegistration RegistrationRefresher
+	validationMargin    time.Duration
+
+	// session is reused across calls so the handshake runs once
+	sessionMu sync.Mutex
+	session   *Session
 }
 
 func NewClient(reg *config.RegistrationData) *Client {
-	return &Client{registration: reg, store: NewMemoryStore()}
+	return NewClientWithStore(reg, nil)
 }
 
 // NewClientWithStore allows the caller to provide a persistent Store implementation.
@@ -27,13 +53,131 @@ func NewClientWithStore(reg *config.RegistrationData, store Store) *Client {
 	if store == nil {
 		store = NewMemoryStore()
 	}
-	return &Client{registration: reg, store: store}
+	return &Client{
+		registration:     reg,
+		store:            store,
+		lookupCache:      NewLookupCache(DefaultLookupTTL),
+		deliveryTimeout:  DefaultDeliveryTimeout,
+		offlineQueue:     true,
+		validationMargin: DefaultValidationMargin,
+		power:            config.PowerProfiles[config.DefaultPowerProfile],
+	}
 }
 
-func (c *Client) PollUnread(ctx context.Context) ([]MessageSummary, error) {
+// OnEvent sets the handler that receives events from the client's sessions.
+func (c *Client) OnEvent(handler EventHandler) {
+	c.sessionMu.Lock()
+	defer c.sessionMu.Unlock()
+	c.eventHandler = handler
+	if c.session != nil {
+		c.session.OnEvent(handler)
+	}
+}
+
+// SetPowerProfile sets the power profile of the client's sessions.
+func (c *Client) SetPowerProfile(profile config.PowerProfile) {
+	c.power = profile
+}
+
+// SetCourierPorts selects the courier ports the client's sessions try.
+func (c *Client) SetCourierPorts(policy apns.PortPolicy) {
+	c.ports = policy
+}
+
+// SetTracer records protocol traffic of the client's sessions.
+func (c *Client) SetTracer(recorder *trace.Recorder) {
+	c.tracer = recorder
+}
+
+// SetRegistration replaces the client's registration data, such as with a
+// freshly generated file. The current session picks it up too if it hasn't
+// done its handshake yet.
+func (c *Client) SetRegistration(reg *config.RegistrationData) {
+	c.sessionMu.Lock()
+	defer c.sessionMu.Unlock()
+	c.registration = reg
+	if c.session != nil {
+		c.session.handshakeMu.Lock()
+		if c.session.state == nil {
+			c.session.registration = reg
+		}
+		c.session.handshakeMu.Unlock()
+	}
+}
+
+// connect returns the client's session, opening one wired up with the
+// client's event handler on first use. The session and its handshake are
+// reused by later calls until Close, so repeated polls don't register again
+// or drop messages the courier queued between them. Registration data is
+// only needed until the handshake, so it's checked again until then.
+func (c *Client) connect(ctx context.Context) (*Session, error) {
+	c.sessionMu.Lock()
+	defer c.sessionMu.Unlock()
+	if c.session != nil {
+		if c.session.handshakeState() == nil && c.refreshRegistration == nil && c.registration.IsExpired() {
+			return nil, ErrRegistrationExpired
+		}
+		return c.session, nil
+	}
+	session, err := c.newSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c.session = session
+	return session, nil
+}
+
+// newSession opens a session configured with the client's settings. The
+// caller must hold sessionMu.
+func (c *Client) newSession(ctx context.Context) (*Session, error) {
+	if c.refreshRegistration != nil && c.registration.IsExpired() {
+		reg, err := c.refreshRegistration(ctx, c.registration)
+		if err != nil {
+			return nil, fmt.Errorf("failed to refresh validation data: %w", err)
+		}
+		c.registration = reg
+	}
 	session, err := Connect(ctx, c.registration, c.store)
 	if err != nil {
 		return nil, err
 	}
+	session.OnEvent(c.eventHandler)
+	session.SetTracer(c.tracer)
+	session.SetLookupCache(c.lookupCache)
+	session.SetIdentityPolicy(c.identityPolicy)
+	session.SetDeliveryTimeout(c.deliveryTimeout)
+	session.SetSMSFallback(c.smsFallback)
+	session.SetOfflineQueue(c.offlineQueue)
+	session.SetPowerProfile(c.power)
+	session.SetCourierPorts(c.ports)
+	session.SetRegistrationRefresher(c.refreshRegistration)
+	session.SetValidationMargin(c.validationMargin)
+	return session, nil
+}
+
+// Handshake registers with Apple now rather than on first use, so
+// credential problems surface up front.
+func (c *Client) Handshake(ctx context.Context) error {
+	session, err := c.connect(ctx)
+	if err != nil {
+		return err
+	}
+	return session.ensureHandshake()
+}
+
+// Close closes the client's session. A later call opens a new one.
+func (c *Client) Close() error {
+	c.sessionMu.Lock()
+	session := c.session
+	c.session = nil
+	c.sessionMu.Unlock()
+	return session.Close()
+}
+
+func (c *Client) PollUnread(ctx context.Context) ([]MessageSummary, error) {
+	session, err := c.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
 	return session.FetchUnread(ctx)
 }
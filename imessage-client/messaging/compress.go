@@ -0,0 +1,33 @@
+package messaging
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+)
+
+// GZipThreshold is the smallest outgoing body MaybeGZip compresses. Below it
+// the gzip header and trailer outweigh anything compression saves.
+const GZipThreshold = 128
+
+// MaybeGZip compresses an outgoing body if it's at least GZipThreshold bytes
+// and compressing makes it smaller, and returns it unchanged otherwise. The
+// receiving side tells the two apart by the gzip magic number, like
+// MaybeGUnzip does.
+func MaybeGZip(data []byte) ([]byte, error) {
+	if len(data) < GZipThreshold {
+		return data, nil
+	}
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, fmt.Errorf("failed to compress: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return nil, fmt.Errorf("failed to compress: %w", err)
+	}
+	if buf.Len() >= len(data) {
+		return data, nil
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,41 @@
+package messaging
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestMaybeGZipRoundTrip(t *testing.T) {
+	data := []byte(strings.Repeat("compressible ", 100))
+	compressed, err := MaybeGZip(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isGzip(compressed) || len(compressed) >= len(data) {
+		t.Fatalf("got %d bytes (gzip %v) from %d", len(compressed), isGzip(compressed), len(data))
+	}
+	decompressed, err := MaybeGUnzip(compressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decompressed, data) {
+		t.Error("round trip changed the data")
+	}
+}
+
+func TestMaybeGZipLeavesSmallOrIncompressibleData(t *testing.T) {
+	small := []byte("hi")
+	if out, _ := MaybeGZip(small); !bytes.Equal(out, small) {
+		t.Error("small body was compressed")
+	}
+
+	// A run of distinct bytes doesn't shrink
+	random := make([]byte, 256)
+	for i := range random {
+		random[i] = byte(i*73 + 41)
+	}
+	if out, _ := MaybeGZip(random); !bytes.Equal(out, random) {
+		t.Error("incompressible body was replaced")
+	}
+}
@@ -1,17 +1,21 @@
 package messaging
 
 import (
+	"bufio"
+	"bytes"
 	"compress/gzip"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha1"
-	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 
 	"howett.net/plist"
+
+	"imessage-client/messaging/wire"
 )
 
 var normalIV = []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
@@ -23,30 +27,39 @@ type ParsedBody struct {
 	Signature []byte
 }
 
+// Parse errors from ParseBody.
+var (
+	ErrTruncatedBody = wire.ErrTruncatedBody
+	ErrInvalidField  = wire.ErrInvalidField
+)
+
 // ParseBody parses the encrypted payload structure.
 // Format: [tag:1byte][bodyLen:2bytes][body:bodyLen][sigLen:1byte][signature:sigLen]
 func ParseBody(payload []byte) (ParsedBody, error) {
-	if len(payload) < 4 {
-		return ParsedBody{}, fmt.Errorf("too short payload (missing header, expected >4, got %d)", len(payload))
+	r := wire.NewReader(payload)
+	tag, err := r.Byte("tag")
+	if err != nil {
+		return ParsedBody{}, err
 	}
-
-	tag := payload[0]
-	bodyLength := binary.BigEndian.Uint16(payload[1:3])
-
-	expectedLength := int(3 + bodyLength + 1)
-	if len(payload) < expectedLength {
-		return ParsedBody{}, fmt.Errorf("too short payload (missing body, expected >%d, got %d)", expectedLength, len(payload))
+	bodyLength, err := r.Uint16("body length")
+	if err != nil {
+		return ParsedBody{}, err
 	}
-
-	body := payload[3 : 3+bodyLength]
-	signatureLength := payload[3+bodyLength]
-
-	expectedLength = int(3 + bodyLength + 1 + uint16(signatureLength))
-	if len(payload) < expectedLength {
-		return ParsedBody{}, fmt.Errorf("too short payload (missing signature, expected %d, got %d)", expectedLength, len(payload))
+	body, err := r.Bytes(int(bodyLength), "body")
+	if err != nil {
+		return ParsedBody{}, err
+	}
+	signatureLength, err := r.Byte("signature length")
+	if err != nil {
+		return ParsedBody{}, err
+	}
+	signature, err := r.Bytes(int(signatureLength), "signature")
+	if err != nil {
+		return ParsedBody{}, err
+	}
+	if r.Len() > 0 {
+		return ParsedBody{}, wire.InvalidFieldError{Field: "signature", Reason: fmt.Sprintf("%d trailing bytes", r.Len())}
 	}
-
-	signature := payload[3+bodyLength+1:]
 
 	return ParsedBody{
 		Tag:       tag,
@@ -57,6 +70,16 @@ func ParseBody(payload []byte) (ParsedBody, error) {
 
 // DecryptPairPayload decrypts a "pair" encrypted message using RSA+AES.
 func DecryptPairPayload(privateKey *rsa.PrivateKey, body ParsedBody) ([]byte, error) {
+	r, err := NewPairDecryptReader(privateKey, body)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+// NewPairDecryptReader decrypts a "pair" encrypted message as it's read,
+// so the plaintext never has to be held in memory as a whole.
+func NewPairDecryptReader(privateKey *rsa.PrivateKey, body ParsedBody) (io.Reader, error) {
 	if len(body.Body) < 160 {
 		return nil, fmt.Errorf("too short payload (missing encryption key, expected >160, got %d)", len(body.Body))
 	}
@@ -71,6 +94,9 @@ func DecryptPairPayload(privateKey *rsa.PrivateKey, body ParsedBody) ([]byte, er
 	if err != nil {
 		return nil, fmt.Errorf("failed to decrypt encryption key: %w", err)
 	}
+	if len(decryptedEncryptionKey) < 16 {
+		return nil, fmt.Errorf("decrypted encryption key too short (%d bytes)", len(decryptedEncryptionKey))
+	}
 
 	// AES key is first 16 bytes, then comes the first part of encrypted payload
 	block, err := aes.NewCipher(decryptedEncryptionKey[:16])
@@ -78,25 +104,23 @@ func DecryptPairPayload(privateKey *rsa.PrivateKey, body ParsedBody) ([]byte, er
 		return nil, fmt.Errorf("failed to create AES cipher: %w", err)
 	}
 
-	// Combine the decrypted first part with the rest
-	decryptionInput := append(decryptedEncryptionKey[16:], actualEncryptedMessage...)
-
-	// Decrypt using AES-CTR
-	cipher.NewCTR(block, normalIV).XORKeyStream(decryptionInput, decryptionInput)
-
-	return decryptionInput, nil
+	// Decrypt the first part followed by the rest using AES-CTR
+	return &cipher.StreamReader{
+		S: cipher.NewCTR(block, normalIV),
+		R: io.MultiReader(bytes.NewReader(decryptedEncryptionKey[16:]), bytes.NewReader(actualEncryptedMessage)),
+	}, nil
 }
 
 // MaybeGUnzip attempts to decompress gzipped data, or returns original if not gzipped.
 func MaybeGUnzip(data []byte) ([]byte, error) {
 	// Check for gzip magic number
-	if len(data) < 2 || data[0] != 0x1f || data[1] != 0x8b {
+	if !isGzip(data) {
 		// Not gzipped, return as-is
 		return data, nil
 	}
 
 	// Decompress
-	r, err := gzip.NewReader(io.NopCloser(&readerWrapper{data: data}))
+	r, err := gzip.NewReader(bytes.NewReader(data))
 	if err != nil {
 		return nil, fmt.Errorf("failed to create gzip reader: %w", err)
 	}
@@ -110,19 +134,26 @@ func MaybeGUnzip(data []byte) ([]byte, error) {
 	return decompressed, nil
 }
 
-// readerWrapper wraps a byte slice as io.Reader
-type readerWrapper struct {
-	data []byte
-	pos  int
+// NewMaybeGUnzipReader decompresses r as it's read if it starts with the
+// gzip magic number, and passes it through unchanged otherwise.
+func NewMaybeGUnzipReader(r io.Reader) (io.Reader, error) {
+	buffered := bufio.NewReader(r)
+	magic, err := buffered.Peek(2)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	if !isGzip(magic) {
+		return buffered, nil
+	}
+	gz, err := gzip.NewReader(buffered)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create gzip reader: %w", err)
+	}
+	return gz, nil
 }
 
-func (r *readerWrapper) Read(p []byte) (n int, err error) {
-	if r.pos >= len(r.data) {
-		return 0, io.EOF
-	}
-	n = copy(p, r.data[r.pos:])
-	r.pos += n
-	return n, nil
+func isGzip(data []byte) bool {
+	return len(data) >= 2 && data[0] == 0x1f && data[1] == 0x8b
 }
 
 // IMessagePayload represents the decrypted iMessage payload structure.
@@ -134,13 +165,36 @@ type IMessagePayload struct {
 
 	// Metadata
 	GroupID     string `plist:"gid,omitempty"` // Group chat ID
+	GroupName   string `plist:"n,omitempty"`   // Group chat name
 	Version     int    `plist:"v,omitempty"`   // Protocol version
 	MessageUUID string `plist:"r,omitempty"`   // Message UUID (reply-to)
+	ThreadRoot  string `plist:"tg,omitempty"`  // "r:<part>:<length>:<UUID>" of the message replied to
+
+	// Archived NSAttributedString with the styled text, mentions and edits.
+	// Some messages carry their text only here.
+	AttributedBody []byte `plist:"ab,omitempty"`
+
+	// Attachments
+	XML               string `plist:"x,omitempty"`    // Message body XML describing attachments
+	InlineAttachment0 []byte `plist:"ia-0,omitempty"` // Inline attachment data
+	InlineAttachment1 []byte `plist:"ia-1,omitempty"` // Second inline attachment
+
+	// Tapbacks
+	AssociatedMessageType  int    `plist:"amt,omitempty"`   // Tapback type
+	AssociatedMessageGUID  string `plist:"amk,omitempty"`   // "p:<part>/<UUID>" of the target
+	AssociatedMessageEmoji string `plist:"ame,omitempty"`   // Emoji of an emoji tapback
+	AssociatedRangeStart   int    `plist:"amrlc,omitempty"` // Reacted text range
+	AssociatedRangeLength  int    `plist:"amrln,omitempty"`
 
 	// Additional fields can be added as needed
 	// See imessage/imessage/direct/decrypt.go for full structure
 }
 
+// StreamingDecryptThreshold is the payload size above which DecryptMessage
+// decrypts and decompresses in a single streaming pass instead of buffering
+// each stage. Large-message payloads are the ones that cross it.
+const StreamingDecryptThreshold = 4 * 1024
+
 // DecryptMessage decrypts and parses an iMessage from APNS payload.
 func DecryptMessage(privateKey *rsa.PrivateKey, payload []byte) (*IMessagePayload, error) {
 	// Step 1: Parse the encrypted body structure
@@ -149,16 +203,25 @@ func DecryptMessage(privateKey *rsa.PrivateKey, payload []byte) (*IMessagePayloa
 		return nil, fmt.Errorf("failed to parse body: %w", err)
 	}
 
-	// Step 2: Decrypt using RSA+AES (pair encryption)
-	decrypted, err := DecryptPairPayload(privateKey, parsed)
-	if err != nil {
-		return nil, fmt.Errorf("failed to decrypt: %w", err)
-	}
-
-	// Step 3: Decompress if gzipped
-	decompressed, err := MaybeGUnzip(decrypted)
-	if err != nil {
-		return nil, fmt.Errorf("failed to decompress: %w", err)
+	var decompressed []byte
+	if len(payload) > StreamingDecryptThreshold {
+		// Steps 2 and 3 chained, so only the decompressed output is buffered
+		decompressed, err = decryptStreaming(privateKey, parsed)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		// Step 2: Decrypt using RSA+AES (pair encryption)
+		decrypted, err := DecryptPairPayload(privateKey, parsed)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt: %w", err)
+		}
+
+		// Step 3: Decompress if gzipped
+		decompressed, err = MaybeGUnzip(decrypted)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress: %w", err)
+		}
 	}
 
 	// Step 4: Parse plist
@@ -169,3 +232,19 @@ func DecryptMessage(privateKey *rsa.PrivateKey, payload []byte) (*IMessagePayloa
 
 	return &msg, nil
 }
+
+func decryptStreaming(privateKey *rsa.PrivateKey, parsed ParsedBody) ([]byte, error) {
+	decrypted, err := NewPairDecryptReader(privateKey, parsed)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt: %w", err)
+	}
+	decompressing, err := NewMaybeGUnzipReader(decrypted)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress: %w", err)
+	}
+	decompressed, err := io.ReadAll(decompressing)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress: %w", err)
+	}
+	return decompressed, nil
+}
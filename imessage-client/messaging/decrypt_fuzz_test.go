@@ -0,0 +1,35 @@
+package messaging
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func FuzzParseBody(f *testing.F) {
+	f.Add([]byte{2, 0, 3, 'a', 'b', 'c', 2, 's', 'g'})
+	f.Add([]byte{2, 0xff, 0xff, 0})
+	f.Add([]byte{2, 0, 0, 0})
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		parsed, err := ParseBody(data)
+		if err != nil {
+			if !errors.Is(err, ErrTruncatedBody) && !errors.Is(err, ErrInvalidField) {
+				t.Fatalf("untyped error: %v", err)
+			}
+			return
+		}
+		// Reassemble and compare: the parse must account for every byte
+		var rebuilt bytes.Buffer
+		rebuilt.WriteByte(parsed.Tag)
+		rebuilt.WriteByte(byte(len(parsed.Body) >> 8))
+		rebuilt.WriteByte(byte(len(parsed.Body)))
+		rebuilt.Write(parsed.Body)
+		rebuilt.WriteByte(byte(len(parsed.Signature)))
+		rebuilt.Write(parsed.Signature)
+		if !bytes.Equal(rebuilt.Bytes(), data) {
+			t.Fatalf("reassembled %x, want %x", rebuilt.Bytes(), data)
+		}
+	})
+}
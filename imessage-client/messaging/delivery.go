@@ -0,0 +1,269 @@
+package messaging
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"imessage-client/messaging/apns"
+	"imessage-client/messaging/ids"
+)
+
+// DeliveryState is the outcome of a sent message.
+type DeliveryState int
+
+const (
+	// DeliveryDelivered means the recipient's device sent a delivery receipt.
+	DeliveryDelivered DeliveryState = iota + 1
+	// DeliveryFailed means the send failed or Apple reported a delivery failure.
+	DeliveryFailed
+	// DeliveryUnconfirmed means no receipt arrived within the session's
+	// delivery timeout, so the message was possibly not delivered.
+	DeliveryUnconfirmed
+)
+
+func (d DeliveryState) String() string {
+	switch d {
+	case DeliveryDelivered:
+		return "delivered"
+	case DeliveryFailed:
+		return "failed"
+	case DeliveryUnconfirmed:
+		return "unconfirmed"
+	default:
+		return "unknown"
+	}
+}
+
+// Delivery is the confirmed outcome of a sent message.
+type Delivery struct {
+	State DeliveryState
+	At    time.Time
+	// Err is set when State is DeliveryFailed.
+	Err error
+	// SMSFallback is set when an unconfirmed message was sent again through
+	// the session's SMS fallback, or was sent by SMS in the first place.
+	SMSFallback bool
+}
+
+// SendResult describes a message passed to Send.
+type SendResult struct {
+	// MessageUUID identifies the message, and can be passed back in
+	// SendOptions to retry it safely.
+	MessageUUID string
+	// Duplicate is set when the UUID had already been sent, so nothing new
+	// was sent this time.
+	Duplicate bool
+	// Queued is set when the courier was unreachable, so the message was
+	// queued to be sent once it's back.
+	Queued bool
+	// Service is the service the message was sent with, ServiceSMS if it
+	// was sent through the session's SMS fallback. Empty if it wasn't sent
+	// this time.
+	Service string
+	// Parts lists the messages a long text was split into, in the order they
+	// were sent. The first part has the message's own UUID. Empty if the text
+	// was sent as one message.
+	Parts []*SendResult
+
+	delivery <-chan Delivery
+}
+
+// Delivered returns a channel that receives the message's delivery outcome
+// once it's confirmed, or DeliveryUnconfirmed if no receipt arrives within
+// the session's delivery timeout. With the timeout disabled it never
+// receives anything if no receipt arrives.
+func (r *SendResult) Delivered() <-chan Delivery {
+	return r.delivery
+}
+
+// Wait blocks until delivery is confirmed or ctx is done.
+func (r *SendResult) Wait(ctx context.Context) (Delivery, error) {
+	select {
+	case d := <-r.delivery:
+		return d, nil
+	case <-ctx.Done():
+		return Delivery{}, ctx.Err()
+	}
+}
+
+// combineDeliveries resolves once every part is delivered, or as soon as
+// one of them fails.
+func combineDeliveries(parts []*SendResult) <-chan Delivery {
+	ch := make(chan Delivery, 1)
+	go func() {
+		var last Delivery
+		for _, part := range parts {
+			last = <-part.delivery
+			if last.State == DeliveryFailed {
+				break
+			}
+		}
+		ch <- last
+	}()
+	return ch
+}
+
+// watchDelivery returns a channel resolved when the outcome of message id is
+// known. A message already marked delivered in the store resolves at once.
+func (s *Session) watchDelivery(id string) <-chan Delivery {
+	ch := make(chan Delivery, 1)
+	if status, ok := s.store.MessageStatus(id); ok && !status.Delivered.IsZero() {
+		ch <- Delivery{State: DeliveryDelivered, At: status.Delivered}
+		return ch
+	}
+	s.deliveryMu.Lock()
+	defer s.deliveryMu.Unlock()
+	if s.deliveryWaiters == nil {
+		s.deliveryWaiters = make(map[string][]chan Delivery)
+	}
+	s.deliveryWaiters[id] = append(s.deliveryWaiters[id], ch)
+	return ch
+}
+
+// resolveDelivery hands the outcome of message id to everyone waiting for it.
+func (s *Session) resolveDelivery(id string, d Delivery) {
+	s.deliveryMu.Lock()
+	waiters := s.deliveryWaiters[id]
+	delete(s.deliveryWaiters, id)
+	if sent, ok := s.sentMessages[id]; ok && sent.timer != nil {
+		sent.timer.Stop()
+	}
+	delete(s.sentMessages, id)
+	s.deliveryMu.Unlock()
+	for _, ch := range waiters {
+		ch <- d
+	}
+}
+
+// handleReceipt resolves deliveries from incoming delivery receipts and
+// failures. It reports whether payload was one of those.
+func (s *Session) handleReceipt(payload *apns.MadridPayload) bool {
+	var state DeliveryState
+	switch payload.Command {
+	case apns.MessageTypeDeliveryReceipt:
+		state = DeliveryDelivered
+	case apns.MessageTypeDeliveryFailure:
+		state = DeliveryFailed
+	default:
+		return false
+	}
+	parsed, err := uuid.FromBytes(payload.MessageUUID)
+	if err != nil {
+		return true
+	}
+	id := strings.ToUpper(parsed.String())
+	status, _ := s.store.MessageStatus(id)
+
+	d := Delivery{State: state, At: time.Now()}
+	if state == DeliveryDelivered {
+		if err := MarkDelivered(s.store, id, status.Chat, true, d.At); err != nil {
+			slog.Warn("Failed to record delivery", "id", id, "err", err)
+		}
+	} else {
+		if s.retryFailedDelivery(id, payload) {
+			// Resent with fresh keys; the failure is only final if it fails again
+			return true
+		}
+		d.Err = fmt.Errorf("apple reported delivery failure to %s", payload.SenderID)
+	}
+	s.resolveDelivery(id, d)
+	return true
+}
+
+// DefaultDeliveryTimeout is how long a sent message waits for a delivery
+// receipt before it's reported as possibly undelivered.
+const DefaultDeliveryTimeout = 5 * time.Minute
+
+// SMSFallback sends text by SMS to phone, a number such as "+15555550123",
+// e.g. through a paired phone.
+type SMSFallback func(ctx context.Context, phone, text string) error
+
+// DeliveryTimeoutEvent is emitted when a sent message got no delivery
+// receipt within the delivery timeout.
+type DeliveryTimeoutEvent struct {
+	MessageUUID string
+	Chat        string
+	Sent        time.Time
+	// SMSFallback is set if the text was sent again by SMS. SMSErr is set if
+	// that failed.
+	SMSFallback bool
+	SMSErr      error
+}
+
+func (DeliveryTimeoutEvent) isEvent() {}
+
+// SetDeliveryTimeout sets how long sent messages wait for a delivery receipt
+// before they're marked unconfirmed. Zero disables the timeout.
+func (s *Session) SetDeliveryTimeout(timeout time.Duration) {
+	s.deliveryMu.Lock()
+	defer s.deliveryMu.Unlock()
+	s.deliveryTimeout = timeout
+}
+
+// SetSMSFallback sets how messages to phone numbers are sent again when
+// their delivery times out. Nil disables the fallback.
+func (s *Session) SetSMSFallback(fallback SMSFallback) {
+	s.deliveryMu.Lock()
+	defer s.deliveryMu.Unlock()
+	s.smsFallback = fallback
+}
+
+// startDeliveryTimerLocked arms the delivery timeout of sent message id.
+// Caller must hold deliveryMu.
+func (s *Session) startDeliveryTimerLocked(id string, sent *sentMessage) {
+	if s.deliveryTimeout <= 0 {
+		return
+	}
+	sent.timer = time.AfterFunc(s.deliveryTimeout, func() { s.deliveryTimedOut(id) })
+}
+
+// deliveryTimedOut marks message id unconfirmed, tries the SMS fallback if
+// the recipient is a phone number, and resolves the delivery.
+func (s *Session) deliveryTimedOut(id string) {
+	select {
+	case <-s.closing:
+		return
+	default:
+	}
+	s.deliveryMu.Lock()
+	sent, ok := s.sentMessages[id]
+	fallback := s.smsFallback
+	s.deliveryMu.Unlock()
+	if !ok {
+		return
+	}
+	status, _ := s.store.MessageStatus(id)
+	if !status.Delivered.IsZero() {
+		return
+	}
+	now := time.Now()
+	if err := MarkUnconfirmed(s.store, id, sent.Chat, now); err != nil {
+		slog.Warn("Failed to record unconfirmed message", "id", id, "err", err)
+	}
+
+	evt := DeliveryTimeoutEvent{MessageUUID: id, Chat: sent.Chat, Sent: status.Sent}
+	if uri, err := ids.ParseURI(sent.Chat); fallback != nil && err == nil && uri.Scheme == ids.SchemeTel {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		evt.SMSFallback = true
+		evt.SMSErr = fallback(ctx, uri.Identifier, sent.Text)
+		cancel()
+	}
+	s.emit(evt)
+	s.resolveDelivery(id, Delivery{State: DeliveryUnconfirmed, At: now, SMSFallback: evt.SMSFallback && evt.SMSErr == nil})
+}
+
+// SetDeliveryTimeout sets how long messages sent by the client's sessions
+// wait for a delivery receipt.
+func (c *Client) SetDeliveryTimeout(timeout time.Duration) {
+	c.deliveryTimeout = timeout
+}
+
+// SetSMSFallback sets the SMS fallback of the client's sessions.
+func (c *Client) SetSMSFallback(fallback SMSFallback) {
+	c.smsFallback = fallback
+}
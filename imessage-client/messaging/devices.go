@@ -0,0 +1,49 @@
+package messaging
+
+import (
+	"context"
+)
+
+// Device is another device registered to the same Apple ID.
+type Device struct {
+	Name                 string
+	Model                string
+	PushTokenFingerprint string
+	Handles              []string
+}
+
+// Devices lists the devices registered to the account.
+func (s *Session) Devices(ctx context.Context) ([]Device, error) {
+	if err := s.ensureHandshake(); err != nil {
+		return nil, err
+	}
+	if s.state.IDSConfig == nil {
+		return nil, ErrHandshakeNotImplemented
+	}
+	resp, err := s.idsClient.GetDependentRegistrations(ctx, s.state.IDSConfig, s.state.IDSConfig.ProfileID)
+	if err != nil {
+		return nil, err
+	}
+	devices := make([]Device, 0, len(resp.Registrations))
+	for _, reg := range resp.Registrations {
+		device := Device{
+			Name:                 reg.DeviceName,
+			Model:                reg.HardwareVersion,
+			PushTokenFingerprint: reg.PushTokenFingerprint(),
+		}
+		for _, identity := range reg.Identities {
+			device.Handles = append(device.Handles, identity.URI)
+		}
+		devices = append(devices, device)
+	}
+	return devices, nil
+}
+
+// Devices lists the devices registered to the account.
+func (c *Client) Devices(ctx context.Context) ([]Device, error) {
+	session, err := c.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return session.Devices(ctx)
+}
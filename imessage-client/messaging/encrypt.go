@@ -0,0 +1,72 @@
+package messaging
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+
+	"imessage-client/messaging/ids"
+)
+
+// pairTag marks a body as "pair" encrypted.
+const pairTag = 0x02
+
+// pairSplitPoint is how much ciphertext rides along with the AES key inside
+// the RSA block.
+const pairSplitPoint = 100
+
+// Bytes serializes the body in the format ParseBody reads.
+func (b ParsedBody) Bytes() []byte {
+	out := make([]byte, 0, 3+len(b.Body)+1+len(b.Signature))
+	out = append(out, b.Tag)
+	out = binary.BigEndian.AppendUint16(out, uint16(len(b.Body)))
+	out = append(out, b.Body...)
+	out = append(out, byte(len(b.Signature)))
+	return append(out, b.Signature...)
+}
+
+// EncryptPairPayload encrypts payload for one recipient device with "pair"
+// encryption (RSA+AES) and signs it with our signing key, the inverse of
+// DecryptPairPayload. Ported from beeper/imessage EncryptSignPairPayload.
+func EncryptPairPayload(signingKey *ecdsa.PrivateKey, self, recipient *ids.UserIdentity, payload []byte) ([]byte, error) {
+	// The AES key is a random seed plus an HMAC tying it to both identities
+	seed := make([]byte, 11)
+	if _, err := rand.Read(seed); err != nil {
+		return nil, fmt.Errorf("failed to generate key seed: %w", err)
+	}
+	mac := hmac.New(sha256.New, seed)
+	mac.Write(payload)
+	mac.Write([]byte{pairTag})
+	mac.Write(self.Hash())
+	mac.Write(recipient.Hash())
+	aesKey := append(seed, mac.Sum(nil)[:5]...)
+
+	block, err := aes.NewCipher(aesKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create AES cipher: %w", err)
+	}
+	ciphertext := make([]byte, len(payload))
+	cipher.NewCTR(block, normalIV).XORKeyStream(ciphertext, payload)
+
+	split := min(pairSplitPoint, len(ciphertext))
+	rsaBlock, err := rsa.EncryptOAEP(sha1.New(), rand.Reader, recipient.EncryptionKey, append(aesKey, ciphertext[:split]...), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt encryption key: %w", err)
+	}
+
+	body := append(rsaBlock, ciphertext[split:]...)
+	hash := sha1.Sum(body)
+	signature, err := signingKey.Sign(rand.Reader, hash[:], crypto.SHA1)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign payload: %w", err)
+	}
+	return ParsedBody{Tag: pairTag, Body: body, Signature: signature}.Bytes(), nil
+}
@@ -7,4 +7,7 @@ var (
 	ErrRegistrationExpired     = errors.New("registration expired")
 	ErrInvalidRegistrationData = errors.New("registration data missing required fields")
 	ErrHandshakeNotImplemented = errors.New("handshake not implemented")
+	ErrNotOnIMessage           = errors.New("recipient is not on iMessage")
+	ErrOffline                 = errors.New("APNS courier unreachable")
+	ErrUnknownMessage          = errors.New("message not found in the store")
 )
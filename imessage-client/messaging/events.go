@@ -0,0 +1,97 @@
+package messaging
+
+import (
+	"fmt"
+	"time"
+
+	"imessage-client/messaging/apns"
+	"imessage-client/messaging/ids"
+)
+
+// Event is emitted by a Session for noteworthy state changes that aren't
+// tied to a single call.
+type Event interface {
+	isEvent()
+}
+
+// EventHandler receives session events. It's called synchronously, so it
+// must not block for long.
+type EventHandler func(Event)
+
+// CertExpiringEvent is emitted when the ID certificate will expire within
+// the session's warning threshold.
+type CertExpiringEvent struct {
+	Expiry    time.Time
+	Remaining time.Duration
+}
+
+func (CertExpiringEvent) isEvent() {}
+
+// HandleChangedEvent is emitted when the handles registered for the account
+// differ from the ones seen by the previous session.
+type HandleChangedEvent struct {
+	Added   []string
+	Removed []string
+	// Inactive handles were reported by IDS with a non-success status,
+	// e.g. because they were deregistered from another device.
+	Inactive map[string]ids.IDSStatus
+	Current  []string
+}
+
+func (HandleChangedEvent) isEvent() {}
+
+// UnknownCommandEvent is emitted when the courier sends a command this
+// client doesn't know, which may be a new protocol feature.
+type UnknownCommandEvent struct {
+	Command apns.CommandID
+	Fields  []apns.Field
+}
+
+func (UnknownCommandEvent) isEvent() {}
+
+// OnEvent sets the handler that receives session events.
+func (s *Session) OnEvent(handler EventHandler) {
+	s.eventMu.Lock()
+	defer s.eventMu.Unlock()
+	s.eventHandler = handler
+}
+
+func (s *Session) emit(evt Event) {
+	s.eventMu.RLock()
+	handler := s.eventHandler
+	s.eventMu.RUnlock()
+	if handler != nil {
+		handler(evt)
+	}
+}
+
+// AlertKind identifies a critical failure that needs operator attention.
+type AlertKind string
+
+const (
+	AlertRegistrationRejected AlertKind = "registration_rejected"
+	AlertCertExpired          AlertKind = "cert_expired"
+	AlertAPNSDisconnected     AlertKind = "apns_disconnected"
+	AlertDecryptionFailed     AlertKind = "decryption_key_mismatch"
+)
+
+// AlertEvent is emitted for failures an unattended client can't recover
+// from on its own.
+type AlertEvent struct {
+	Kind AlertKind
+	Err  error
+	Time time.Time
+}
+
+func (AlertEvent) isEvent() {}
+
+func (e AlertEvent) String() string {
+	if e.Err == nil {
+		return string(e.Kind)
+	}
+	return fmt.Sprintf("%s: %v", e.Kind, e.Err)
+}
+
+func (s *Session) alert(kind AlertKind, err error) {
+	s.emit(AlertEvent{Kind: kind, Err: err, Time: time.Now()})
+}
@@ -0,0 +1,174 @@
+package messaging
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/google/uuid"
+
+	"imessage-client/messaging/apns"
+	"imessage-client/messaging/ids"
+)
+
+// MaxFanoutChunk is the most devices a single APNS command is addressed to.
+// Commands with more devices than fit in the large message limit are split
+// further.
+const MaxFanoutChunk = 20
+
+// buildDTL encrypts body for every device registered to the recipients, and
+// to our own other devices so they show the sent message too. Each device
+// gets its own copy in the destination list (DTL) of the outgoing command.
+// Devices whose keys can't be used are reported as errStaleKeys, unless
+// skipStale is set, in which case they're left out; if that leaves none of
+// the recipients' devices, it's still errStaleKeys. Recipients' keys are
+// checked against their pins first. A nil body lists the devices without a
+// payload, for commands like typing indicators.
+func (s *Session) buildDTL(ctx context.Context, cfg *ids.Config, recipients []ids.ParsedURI, body []byte, skipStale bool) ([]apns.MadridPayload, error) {
+	self := cfg.DefaultHandle
+	handles := make([]string, 0, len(recipients)+1)
+	for _, recipient := range recipients {
+		handles = append(handles, recipient.String())
+	}
+	handles = append(handles, self.String())
+	results, err := s.Lookup(ctx, handles)
+	if err != nil {
+		return nil, err
+	}
+
+	ourIdentity := &ids.UserIdentity{
+		SigningKey:    &cfg.IDSSigningKey.PublicKey,
+		EncryptionKey: &cfg.IDSEncryptionKey.PublicKey,
+	}
+	var dtl []apns.MadridPayload
+	var notFound []string
+	var stale, skipped errStaleKeys
+	reached := false
+	// A device registered to several handles only gets one copy, addressed
+	// to whichever handle comes first (recipients before ourselves)
+	seen := make(map[string]bool)
+	for _, handle := range handles {
+		result := results[handle]
+		isSelf := handle == self.String()
+		if !isSelf && (result == nil || len(result.Identities) == 0) {
+			notFound = append(notFound, handle)
+			continue
+		} else if result == nil {
+			continue
+		}
+		if !isSelf {
+			if err := s.checkIdentityPins(handle, result); err != nil {
+				return nil, err
+			}
+		}
+		for _, ident := range result.Identities {
+			if bytes.Equal(ident.PushToken, cfg.PushToken) || seen[string(ident.PushToken)] {
+				continue
+			}
+			if body == nil {
+				// Nothing to encrypt, the command itself is the message
+				seen[string(ident.PushToken)] = true
+				reached = reached || !isSelf
+				dtl = append(dtl, apns.MadridPayload{
+					Token:         ident.PushToken,
+					SessionToken:  ident.SessionToken,
+					DestinationID: handle,
+				})
+				continue
+			}
+			identity, err := ident.IdentityKey()
+			var encrypted []byte
+			if err == nil {
+				encrypted, err = EncryptPairPayload(cfg.IDSSigningKey, ourIdentity, identity, body)
+			}
+			if err != nil {
+				if skipStale {
+					slog.Warn("Skipping device", "handle", handle, "err", err)
+					if !isSelf {
+						skipped.Handles = appendHandle(skipped.Handles, handle)
+						skipped.Err = err
+					}
+					continue
+				}
+				stale.Handles = appendHandle(stale.Handles, handle)
+				stale.Err = err
+				continue
+			}
+			seen[string(ident.PushToken)] = true
+			reached = reached || !isSelf
+			// Only the recipients' devices send delivery receipts
+			deliveryStatus := !isSelf
+			dtl = append(dtl, apns.MadridPayload{
+				EncryptionType: "pair",
+				Payload:        encrypted,
+				Token:          ident.PushToken,
+				SessionToken:   ident.SessionToken,
+				DestinationID:  handle,
+				DeliveryStatus: &deliveryStatus,
+			})
+		}
+	}
+	if len(stale.Handles) > 0 {
+		return nil, stale
+	}
+	if len(notFound) == len(recipients) {
+		return nil, fmt.Errorf("%w: %s", ErrNotOnIMessage, strings.Join(notFound, ", "))
+	}
+	if !reached && len(skipped.Handles) > 0 {
+		// Sending would only reach our own devices
+		return nil, skipped
+	}
+	return dtl, nil
+}
+
+// appendHandle adds handle to handles unless it's already the last one, as
+// it is for each further device of the same handle.
+func appendHandle(handles []string, handle string) []string {
+	if len(handles) == 0 || handles[len(handles)-1] != handle {
+		handles = append(handles, handle)
+	}
+	return handles
+}
+
+// splitDTL wraps the destination list in as few commands as fit in the large
+// message limit, at most MaxFanoutChunk devices each.
+func (s *Session) splitDTL(cfg *ids.Config, messageUUID string, dtl []apns.MadridPayload) ([]*apns.MadridPayload, error) {
+	parsed, err := uuid.Parse(messageUUID)
+	if err != nil {
+		return nil, fmt.Errorf("%w %q: %v", ErrInvalidMessageUUID, messageUUID, err)
+	}
+	limit := s.largeMessageSize()
+	chunkSize := min(MaxFanoutChunk, len(dtl))
+	var commands []*apns.MadridPayload
+	for start := 0; start < len(dtl); {
+		end := min(start+chunkSize, len(dtl))
+		cmd := &apns.MadridPayload{
+			Command:           apns.MessageTypeIMessage,
+			MessageID:         binary.BigEndian.Uint32(apns.NewMessageID()),
+			MessageUUID:       parsed[:],
+			SenderID:          cfg.DefaultHandle.String(),
+			Version:           8,
+			UserAgent:         cfg.CombinedVersion(),
+			FanoutChunkNumber: len(commands) + 1,
+			DTL:               dtl[start:end],
+		}
+		data, err := cmd.Marshal()
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal madrid payload: %w", err)
+		}
+		if size := len(data) + apns.SendMessageOverhead; size > limit {
+			if chunkSize > 1 {
+				// Too big, try again with fewer devices per command
+				chunkSize--
+				continue
+			}
+			return nil, apns.PayloadTooLargeError{Size: size, Limit: limit}
+		}
+		commands = append(commands, cmd)
+		start = end
+	}
+	return commands, nil
+}
@@ -0,0 +1,210 @@
+package messaging
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"imessage-client/messaging/apns"
+	"imessage-client/messaging/apns/apnstest"
+	"imessage-client/messaging/ids"
+)
+
+type testDevice struct {
+	token    []byte
+	key      *rsa.PrivateKey
+	signing  *ecdsa.PrivateKey
+	identity *ids.UserIdentity
+	ident    ids.LookupIdentity
+}
+
+func newTestDevice(t *testing.T, name string) *testDevice {
+	t.Helper()
+	encryptionKey, err := rsa.GenerateKey(rand.Reader, 1280)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signingKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	identity := &ids.UserIdentity{SigningKey: &signingKey.PublicKey, EncryptionKey: &encryptionKey.PublicKey}
+	token := []byte(fmt.Sprintf("%-32s", name))
+	return &testDevice{
+		token:    token,
+		key:      encryptionKey,
+		signing:  signingKey,
+		identity: identity,
+		ident: ids.LookupIdentity{
+			ClientData:   map[string]any{"public-message-identity-key": identity.ToBytes()},
+			PushToken:    token,
+			SessionToken: []byte("session-" + name),
+		},
+	}
+}
+
+// testSendSession returns a session that's handshaken as ourselves, with
+// lookups answered from the cache.
+func testSendSession(t *testing.T, self *testDevice, lookups map[string][]*testDevice) *Session {
+	t.Helper()
+	session := testSession(t)
+	signingKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session.state = &handshakeState{IDSConfig: &ids.Config{
+		IDSEncryptionKey: self.key,
+		IDSSigningKey:    signingKey,
+		PushToken:        self.token,
+		DefaultHandle:    ids.ParsedURI{Scheme: ids.SchemeEmail, Identifier: "me@example.com"},
+	}}
+	for handle, devices := range lookups {
+		result := &ids.LookupResult{Time: time.Now()}
+		for _, device := range devices {
+			result.Identities = append(result.Identities, device.ident)
+		}
+		session.lookupCache.Put(handle, result)
+	}
+	return session
+}
+
+func TestBuildDTLFansOutToEveryDevice(t *testing.T) {
+	me := newTestDevice(t, "me")
+	myPhone := newTestDevice(t, "my-phone")
+	theirPhone := newTestDevice(t, "their-phone")
+	theirMac := newTestDevice(t, "their-mac")
+	const them = "tel:+15555550123"
+	session := testSendSession(t, me, map[string][]*testDevice{
+		them:                    {theirPhone, theirMac},
+		"mailto:me@example.com": {me, myPhone},
+	})
+	cfg := session.state.IDSConfig
+
+	body, err := encodeOutgoing(&IMessagePayload{Text: "hello"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	recipient, _ := ids.ParseURI(them)
+	dtl, err := session.buildDTL(context.Background(), cfg, []ids.ParsedURI{recipient}, body, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Our own device is skipped, everything else gets a copy only it can read
+	devices := []*testDevice{theirPhone, theirMac, myPhone}
+	if len(dtl) != len(devices) {
+		t.Fatalf("got %d DTL entries, want %d", len(dtl), len(devices))
+	}
+	for i, device := range devices {
+		entry := dtl[i]
+		if string(entry.Token) != string(device.token) {
+			t.Errorf("entry %d token = %q, want %q", i, entry.Token, device.token)
+		}
+		if want := device != myPhone; *entry.DeliveryStatus != want {
+			t.Errorf("entry %d delivery status = %v, want %v", i, *entry.DeliveryStatus, want)
+		}
+		msg, err := DecryptMessage(device.key, entry.Payload)
+		if err != nil {
+			t.Errorf("entry %d: %v", i, err)
+		} else if msg.Text != "hello" {
+			t.Errorf("entry %d text = %q", i, msg.Text)
+		}
+	}
+	if _, err := DecryptMessage(theirMac.key, dtl[0].Payload); err == nil {
+		t.Error("another device could decrypt the phone's copy")
+	}
+}
+
+func TestBuildDTLRecipientNotOnIMessage(t *testing.T) {
+	me := newTestDevice(t, "me")
+	session := testSendSession(t, me, map[string][]*testDevice{
+		"tel:+15555550123":      nil,
+		"mailto:me@example.com": {me},
+	})
+	recipient, _ := ids.ParseURI("tel:+15555550123")
+	_, err := session.buildDTL(context.Background(), session.state.IDSConfig, []ids.ParsedURI{recipient}, []byte("body"), false)
+	if !errors.Is(err, ErrNotOnIMessage) {
+		t.Errorf("err = %v, want ErrNotOnIMessage", err)
+	}
+}
+
+func TestSplitDTLFitsLargeMessageLimit(t *testing.T) {
+	me := newTestDevice(t, "me")
+	session := testSendSession(t, me, nil)
+	dtl := make([]apns.MadridPayload, 50)
+	for i := range dtl {
+		dtl[i] = apns.MadridPayload{Payload: make([]byte, 1000), Token: make([]byte, 32)}
+	}
+	commands, err := session.splitDTL(session.state.IDSConfig, "0F8E6A52-3C1D-4B7E-9A2F-5D6C7B8A9E01", dtl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	total := 0
+	for i, cmd := range commands {
+		data, err := cmd.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(data)+apns.SendMessageOverhead > DefaultLargeMessageSize {
+			t.Errorf("command %d is %d bytes", i, len(data))
+		}
+		if cmd.FanoutChunkNumber != i+1 {
+			t.Errorf("command %d has chunk number %d", i, cmd.FanoutChunkNumber)
+		}
+		total += len(cmd.DTL)
+	}
+	if total != len(dtl) {
+		t.Errorf("commands cover %d devices, want %d", total, len(dtl))
+	}
+}
+
+func TestSendDeliversOverAPNS(t *testing.T) {
+	server, err := apnstest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	me := newTestDevice(t, "me")
+	theirPhone := newTestDevice(t, "their-phone")
+	session := testSendSession(t, me, map[string][]*testDevice{
+		"tel:+15555550123":      {theirPhone},
+		"mailto:me@example.com": {me},
+	})
+	session.state.APNSConn = testAPNSConnection(t, server)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	result, err := session.Send(ctx, "tel:+15555550123", "hello", SendOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status, _ := session.store.MessageStatus(result.MessageUUID); status.Sent.IsZero() {
+		t.Error("message not marked as sent")
+	}
+
+	sent, err := server.WaitFor(ctx, apns.CommandSendMessage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	madrid, err := apns.ParseMadridPayload(sent.Field(apns.FieldOutgoingPayload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(madrid.DTL) != 1 || madrid.DTL[0].DestinationID != "tel:+15555550123" {
+		t.Fatalf("DTL = %+v", madrid.DTL)
+	}
+	msg, err := DecryptMessage(theirPhone.key, madrid.DTL[0].Payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Text != "hello" {
+		t.Errorf("text = %q", msg.Text)
+	}
+}
@@ -0,0 +1,69 @@
+package messaging
+
+import (
+	"log/slog"
+	"sort"
+)
+
+// Handles returns the handles currently registered for the account.
+func (s *Session) Handles() []string {
+	if s.state == nil || s.state.IDSConfig == nil {
+		handles, _ := s.store.Handles()
+		return handles
+	}
+	handles := make([]string, 0, len(s.state.IDSConfig.Handles))
+	for _, handle := range s.state.IDSConfig.Handles {
+		handles = append(handles, handle.String())
+	}
+	return handles
+}
+
+// checkHandles compares the handles from the register response with the
+// ones recorded by the previous session, emitting a HandleChangedEvent and
+// updating the store if they differ. Inactive handles aren't among the
+// current ones, so a handle that became inactive shows up as removed; one
+// that stays inactive isn't reported again.
+func (s *Session) checkHandles() {
+	if s.state.IDSConfig == nil {
+		return
+	}
+	current := s.Handles()
+	previous, known := s.store.Handles()
+
+	added, removed := diffHandles(previous, current)
+	if known && (len(added) > 0 || len(removed) > 0) {
+		s.emit(HandleChangedEvent{
+			Added:    added,
+			Removed:  removed,
+			Inactive: s.state.InactiveHandles,
+			Current:  current,
+		})
+	}
+	if !known || len(added) > 0 || len(removed) > 0 {
+		if err := s.store.SetHandles(current); err != nil {
+			slog.Warn("Failed to save handles", "err", err)
+		}
+	}
+}
+
+func diffHandles(previous, current []string) (added, removed []string) {
+	prevSet := make(map[string]bool, len(previous))
+	for _, handle := range previous {
+		prevSet[handle] = true
+	}
+	curSet := make(map[string]bool, len(current))
+	for _, handle := range current {
+		curSet[handle] = true
+		if !prevSet[handle] {
+			added = append(added, handle)
+		}
+	}
+	for _, handle := range previous {
+		if !curSet[handle] {
+			removed = append(removed, handle)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	return added, removed
+}
@@ -0,0 +1,66 @@
+package messaging
+
+import (
+	"path/filepath"
+	"testing"
+
+	"imessage-client/messaging/ids"
+)
+
+func TestCheckHandlesReportsOnlyChanges(t *testing.T) {
+	session := testSession(t)
+	var events []HandleChangedEvent
+	session.OnEvent(func(evt Event) {
+		if evt, ok := evt.(HandleChangedEvent); ok {
+			events = append(events, evt)
+		}
+	})
+	me := ids.ParsedURI{Scheme: ids.SchemeEmail, Identifier: "me@example.com"}
+	phone := ids.ParsedURI{Scheme: ids.SchemeTel, Identifier: "+15555550123"}
+	handshake := func(inactive map[string]ids.IDSStatus, handles ...ids.ParsedURI) {
+		session.state = &handshakeState{IDSConfig: &ids.Config{Handles: handles}, InactiveHandles: inactive}
+		session.checkHandles()
+	}
+
+	// The first session only records the handles
+	handshake(nil, me, phone)
+	if len(events) != 0 {
+		t.Fatalf("first session reported %+v", events)
+	}
+
+	// The phone number is deregistered from another device
+	inactive := map[string]ids.IDSStatus{phone.String(): 5051}
+	handshake(inactive, me)
+	if len(events) != 1 || len(events[0].Removed) != 1 || events[0].Removed[0] != phone.String() || len(events[0].Inactive) != 1 {
+		t.Fatalf("deregistered handle reported as %+v", events)
+	}
+
+	// Staying inactive isn't a change
+	handshake(inactive, me)
+	handshake(inactive, me)
+	if len(events) != 1 {
+		t.Errorf("unchanged handles reported %d more times", len(events)-1)
+	}
+}
+
+func TestFileStoreKeepsEmptyHandles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	store, err := NewFileStoreWithFlushInterval(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, known := store.Handles(); known {
+		t.Error("new store knows its handles")
+	}
+	if err := store.SetHandles(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := NewFileStoreWithFlushInterval(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if handles, known := reopened.Handles(); !known || len(handles) != 0 {
+		t.Errorf("reopened store has handles %v, known %v; want none, known", handles, known)
+	}
+}
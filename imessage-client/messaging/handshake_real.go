@@ -2,11 +2,16 @@ package messaging
 
 import (
 	"context"
+	"crypto"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/x509"
+	"errors"
 	"fmt"
+	"log/slog"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
@@ -14,11 +19,22 @@ import (
 	"imessage-client/config"
 	"imessage-client/messaging/apns"
 	"imessage-client/messaging/ids"
+	"imessage-client/messaging/trace"
 )
 
 // RealHandshaker implements NAC/IDS handshake using validation data.
 type RealHandshaker struct {
 	// TODO: add nacserv client when ready
+
+	// HTTPClient is used for IDS requests. Defaults to ids.NewHTTPClient().
+	HTTPClient *ids.HTTPClient
+	// Trace records IDS requests made during the handshake, if set.
+	Trace *trace.Recorder
+	// Timings is filled in with how long each phase took, if set.
+	Timings *HandshakeTimings
+	// Store keeps the device keys between handshakes, if set. Without it
+	// every handshake registers as a new device.
+	Store Store
 }
 
 func (h RealHandshaker) Handshake(ctx context.Context, reg *config.RegistrationData) (*handshakeState, error) {
@@ -26,39 +42,31 @@ func (h RealHandshaker) Handshake(ctx context.Context, reg *config.RegistrationD
 		return nil, ErrInvalidRegistrationData
 	}
 
-	// Step 1: Generate IDS keypairs (ECDSA P256 for signing)
-	idsSigningKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
-	if err != nil {
-		return nil, fmt.Errorf("failed to generate IDS signing key: %w", err)
-	}
-
-	// RSA 1280 for encryption (Apple uses shorter keys for IDS)
-	idsEncryptionKey, err := rsa.GenerateKey(rand.Reader, 1280)
-	if err != nil {
-		return nil, fmt.Errorf("failed to generate IDS encryption key: %w", err)
-	}
-
-	// Step 2: Generate push keypairs (RSA 1280)
-	pushKey, err := rsa.GenerateKey(rand.Reader, 1280)
+	keygenStart := time.Now()
+	// Step 1-3: Load the IDS, push and auth keypairs, generating missing ones
+	keys, saved := h.loadKeys()
+	generated, err := keys.generateMissing()
 	if err != nil {
-		return nil, fmt.Errorf("failed to generate push key: %w", err)
+		return nil, err
 	}
-
-	// Step 3: Generate auth private key (RSA 2048)
-	authPrivateKey, err := rsa.GenerateKey(rand.Reader, 2048)
-	if err != nil {
-		return nil, fmt.Errorf("failed to generate auth private key: %w", err)
+	idsSigningKey, idsEncryptionKey, pushKey, authPrivateKey := keys.idsSigning, keys.idsEncryption, keys.push, keys.auth
+	if h.Timings != nil {
+		h.Timings.Keygen = time.Since(keygenStart)
 	}
+	slog.Debug("Loaded device keys", "generated", generated, "took", time.Since(keygenStart))
 
 	// Step 4: Initialize IDS config with device info from registration
-	// Use the device UUID from registration data if available, otherwise generate new one
-	deviceUUID := uuid.New()
-	if reg.DeviceInfo.UniqueDeviceID != "" {
-		parsedUUID, err := uuid.Parse(reg.DeviceInfo.UniqueDeviceID)
-		if err == nil {
-			deviceUUID = parsedUUID
+	// Use the device UUID from registration data if available, otherwise
+	// the one we registered with before, otherwise generate a new one
+	deviceUUID, err := uuid.Parse(reg.DeviceInfo.UniqueDeviceID)
+	if err != nil {
+		if deviceUUID, err = uuid.Parse(saved.DeviceUUID); err != nil {
+			deviceUUID = uuid.New()
 		}
 	}
+	if generated || saved.DeviceUUID != deviceUUID.String() {
+		h.saveKeys(keys, deviceUUID)
+	}
 	
 	idsConfig := &ids.Config{
 		IDSEncryptionKey: idsEncryptionKey,
@@ -74,6 +82,7 @@ func (h RealHandshaker) Handshake(ctx context.Context, reg *config.RegistrationD
 	idsConfig.SoftwareVersion = reg.DeviceInfo.SoftwareVersion
 	idsConfig.SoftwareName = reg.DeviceInfo.SoftwareName
 	idsConfig.SoftwareBuildID = reg.DeviceInfo.SoftwareBuildID
+	idsConfig.DeviceName = reg.DeviceInfo.DeviceName
 
 	// Default to macOS if not specified
 	if idsConfig.HardwareVersion == "" {
@@ -88,15 +97,36 @@ func (h RealHandshaker) Handshake(ctx context.Context, reg *config.RegistrationD
 	if idsConfig.SoftwareBuildID == "" {
 		idsConfig.SoftwareBuildID = "22F82"
 	}
+	if idsConfig.DeviceName == "" {
+		idsConfig.DeviceName = ids.DefaultDeviceName
+	}
+
+	deviceInfo := config.DeviceInfo{
+		HardwareVersion: idsConfig.HardwareVersion,
+		SoftwareName:    idsConfig.SoftwareName,
+		SoftwareVersion: idsConfig.SoftwareVersion,
+		SoftwareBuildID: idsConfig.SoftwareBuildID,
+	}
+	if err := deviceInfo.Validate(); err != nil {
+		return nil, err
+	}
 
 	// Step 5: Register with IDS using validation_data
-	httpClient := ids.NewHTTPClient()
+	httpClient := h.HTTPClient
+	if httpClient == nil {
+		httpClient = ids.NewHTTPClient()
+		httpClient.SetTracer(h.Trace)
+	}
 
 	// Build registration request
 	registerReq := h.buildRegisterRequest(reg, idsConfig, idsEncryptionKey, idsSigningKey)
 
 	// Send registration request
+	registerStart := time.Now()
 	registerResp, err := httpClient.Register(ctx, registerReq, pushKey)
+	if h.Timings != nil {
+		h.Timings.Register = time.Since(registerStart)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("IDS registration failed: %w", err)
 	}
@@ -134,19 +164,134 @@ func (h RealHandshaker) Handshake(ctx context.Context, reg *config.RegistrationD
 		IDCert: idCert,
 	}
 	idsConfig.ProfileID = user.UserID
+	idsConfig.Handles = user.ActiveHandles()
+	if len(idsConfig.Handles) > 0 {
+		idsConfig.DefaultHandle = idsConfig.Handles[0]
+	}
+	slog.Debug("Registered with IDS", "profile", user.UserID, "handles", len(idsConfig.Handles), "cert_expiry", idCert.NotAfter)
 
 	// Step 7: Create APNS connection with push key
 	// Note: Push token will be received during APNS connect handshake
 	apnsConn := apns.NewConnection(pushKey, nil, pushToken)
+	apnsConn.SetTracer(h.Trace)
 
 	return &handshakeState{
-		ValidationData: reg.ValidationData,
-		DeviceInfo:     reg.DeviceInfo,
-		IDSConfig:      idsConfig,
-		APNSConn:       apnsConn,
+		ValidationData:  reg.ValidationData,
+		DeviceInfo:      reg.DeviceInfo,
+		IDSConfig:       idsConfig,
+		APNSConn:        apnsConn,
+		InactiveHandles: user.InactiveHandles(),
 	}, nil
 }
 
+// handshakeKeys are the keypairs a handshake registers with.
+type handshakeKeys struct {
+	// idsSigning is ECDSA P256; idsEncryption is RSA 1280, since Apple
+	// uses shorter keys for IDS.
+	idsSigning    *ecdsa.PrivateKey
+	idsEncryption *rsa.PrivateKey
+	push          *rsa.PrivateKey
+	auth          *rsa.PrivateKey
+}
+
+// loadKeys returns the keys saved in the store, leaving out any that are
+// missing or can't be parsed, along with what was saved.
+func (h RealHandshaker) loadKeys() (*handshakeKeys, DeviceKeys) {
+	var keys handshakeKeys
+	if h.Store == nil {
+		return &keys, DeviceKeys{}
+	}
+	saved, ok := h.Store.DeviceKeys()
+	if !ok {
+		return &keys, saved
+	}
+	parse := func(name string, der []byte) crypto.PrivateKey {
+		if len(der) == 0 {
+			return nil
+		}
+		key, err := x509.ParsePKCS8PrivateKey(der)
+		if err != nil {
+			slog.Warn("Failed to load saved key, generating a new one", "key", name, "err", err)
+			return nil
+		}
+		return key
+	}
+	keys.idsSigning, _ = parse("IDS signing key", saved.IDSSigning).(*ecdsa.PrivateKey)
+	keys.idsEncryption, _ = parse("IDS encryption key", saved.IDSEncryption).(*rsa.PrivateKey)
+	keys.push, _ = parse("push key", saved.Push).(*rsa.PrivateKey)
+	keys.auth, _ = parse("auth private key", saved.Auth).(*rsa.PrivateKey)
+	return &keys, saved
+}
+
+// saveKeys saves keys to the store for the next handshake. Failing to is
+// reported but not fatal, since the keys work for this session.
+func (h RealHandshaker) saveKeys(keys *handshakeKeys, deviceUUID uuid.UUID) {
+	if h.Store == nil {
+		return
+	}
+	saved := DeviceKeys{DeviceUUID: deviceUUID.String()}
+	var err error
+	for _, k := range []struct {
+		der *[]byte
+		key crypto.PrivateKey
+	}{
+		{&saved.IDSSigning, keys.idsSigning},
+		{&saved.IDSEncryption, keys.idsEncryption},
+		{&saved.Push, keys.push},
+		{&saved.Auth, keys.auth},
+	} {
+		if *k.der, err = x509.MarshalPKCS8PrivateKey(k.key); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = h.Store.SetDeviceKeys(saved)
+	}
+	if err != nil {
+		slog.Warn("Failed to save device keys", "err", err)
+	}
+}
+
+// generateMissing generates the keys that weren't loaded, concurrently,
+// since RSA generation dominates the handshake's CPU time and the keys don't
+// depend on each other. It reports whether anything was generated.
+func (keys *handshakeKeys) generateMissing() (bool, error) {
+	var wg sync.WaitGroup
+	errs := make([]error, 4)
+	generated := false
+	generate := func(i int, name string, missing bool, fn func() error) {
+		if !missing {
+			return
+		}
+		generated = true
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := fn(); err != nil {
+				errs[i] = fmt.Errorf("failed to generate %s: %w", name, err)
+			}
+		}()
+	}
+	generate(0, "IDS signing key", keys.idsSigning == nil, func() (err error) {
+		keys.idsSigning, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		return err
+	})
+	generate(1, "IDS encryption key", keys.idsEncryption == nil, func() (err error) {
+		keys.idsEncryption, err = rsa.GenerateKey(rand.Reader, 1280)
+		return err
+	})
+	generate(2, "push key", keys.push == nil, func() (err error) {
+		keys.push, err = rsa.GenerateKey(rand.Reader, 1280)
+		return err
+	})
+	generate(3, "auth private key", keys.auth == nil, func() (err error) {
+		keys.auth, err = rsa.GenerateKey(rand.Reader, 2048)
+		return err
+	})
+	wg.Wait()
+	return generated, errors.Join(errs...)
+}
+
 // buildRegisterRequest constructs the IDS registration request.
 func (h RealHandshaker) buildRegisterRequest(
 	reg *config.RegistrationData,
@@ -161,7 +306,7 @@ func (h RealHandshaker) buildRegisterRequest(
 	}
 
 	return &ids.RegisterReq{
-		DeviceName:      ids.DeviceName,
+		DeviceName:      cfg.DeviceName,
 		HardwareVersion: cfg.HardwareVersion,
 		Language:        "en-US",
 		OSVersion:       cfg.IDSOSVersion(),
@@ -0,0 +1,42 @@
+package messaging
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestHandshakeReusesSavedKeys(t *testing.T) {
+	store := NewMemoryStore()
+	h := RealHandshaker{Store: store}
+
+	keys, _ := h.loadKeys()
+	if generated, err := keys.generateMissing(); err != nil || !generated {
+		t.Fatalf("first handshake generated = %v, err = %v", generated, err)
+	}
+	deviceUUID := uuid.New()
+	h.saveKeys(keys, deviceUUID)
+
+	loaded, saved := h.loadKeys()
+	if generated, err := loaded.generateMissing(); err != nil || generated {
+		t.Fatalf("second handshake generated = %v, err = %v", generated, err)
+	}
+	if saved.DeviceUUID != deviceUUID.String() {
+		t.Errorf("device UUID = %q, want %s", saved.DeviceUUID, deviceUUID)
+	}
+	if !loaded.push.Equal(keys.push) || !loaded.auth.Equal(keys.auth) || !loaded.idsSigning.Equal(keys.idsSigning) || !loaded.idsEncryption.Equal(keys.idsEncryption) {
+		t.Error("loaded keys differ from the saved ones")
+	}
+
+	// A key that can't be parsed is replaced, keeping the rest
+	broken, _ := store.DeviceKeys()
+	broken.Push = []byte("garbage")
+	_ = store.SetDeviceKeys(broken)
+	partial, _ := h.loadKeys()
+	if partial.push != nil || partial.auth == nil {
+		t.Fatalf("loaded push = %v, auth = %v", partial.push != nil, partial.auth != nil)
+	}
+	if generated, err := partial.generateMissing(); err != nil || !generated || partial.push == nil {
+		t.Errorf("regenerating push key: generated = %v, err = %v", generated, err)
+	}
+}
@@ -0,0 +1,61 @@
+package messaging
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+
+	"imessage-client/messaging/ids"
+)
+
+// identityTextPrefix starts the text encoding of an OwnIdentity.
+const identityTextPrefix = "imessage-identity:"
+
+// OwnIdentity is this client's public identity, for correspondents to
+// verify out of band.
+type OwnIdentity struct {
+	Handle               string
+	PushTokenFingerprint string
+	// Fingerprint is IdentityFingerprint of this device's keys alone.
+	Fingerprint string
+	// KeyHash is the hex SHA-256 of the keys, as pinned by other clients.
+	KeyHash   string
+	PublicKey []byte
+}
+
+// Text encodes the identity as a single line, e.g. for a QR code:
+// "imessage-identity:<handle>:<base64url public key>".
+func (o *OwnIdentity) Text() string {
+	return identityTextPrefix + o.Handle + ":" + base64.RawURLEncoding.EncodeToString(o.PublicKey)
+}
+
+// OwnIdentity returns the public identity the session registered.
+func (s *Session) OwnIdentity() (*OwnIdentity, error) {
+	if err := s.ensureHandshake(); err != nil {
+		return nil, err
+	}
+	cfg := s.state.IDSConfig
+	if cfg == nil || cfg.IDSEncryptionKey == nil || cfg.IDSSigningKey == nil {
+		return nil, ErrHandshakeNotImplemented
+	}
+	identity := &ids.UserIdentity{
+		SigningKey:    &cfg.IDSSigningKey.PublicKey,
+		EncryptionKey: &cfg.IDSEncryptionKey.PublicKey,
+	}
+	return &OwnIdentity{
+		Handle:               cfg.DefaultHandle.String(),
+		PushTokenFingerprint: ids.TokenFingerprint(cfg.PushToken),
+		Fingerprint:          IdentityFingerprint([]*ids.UserIdentity{identity}),
+		KeyHash:              hex.EncodeToString(identity.Hash()),
+		PublicKey:            identity.ToBytes(),
+	}, nil
+}
+
+// OwnIdentity returns the public identity the client registered.
+func (c *Client) OwnIdentity(ctx context.Context) (*OwnIdentity, error) {
+	session, err := c.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return session.OwnIdentity()
+}
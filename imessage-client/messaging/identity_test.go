@@ -0,0 +1,37 @@
+package messaging
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"imessage-client/messaging/ids"
+)
+
+func TestOwnIdentityMatchesWhatOthersPin(t *testing.T) {
+	me := newTestDevice(t, "me")
+	session := testSendSession(t, me, nil)
+	own, err := session.OwnIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if own.Handle != "mailto:me@example.com" {
+		t.Errorf("handle = %q", own.Handle)
+	}
+
+	text, ok := strings.CutPrefix(own.Text(), identityTextPrefix+own.Handle+":")
+	if !ok {
+		t.Fatalf("unexpected text %q", own.Text())
+	}
+	key, err := base64.RawURLEncoding.DecodeString(text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	identity, err := ids.ParseUserIdentity(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := IdentityFingerprint([]*ids.UserIdentity{identity}); own.Fingerprint != want {
+		t.Errorf("fingerprint = %q, want %q", own.Fingerprint, want)
+	}
+}
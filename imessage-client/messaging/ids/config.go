@@ -29,6 +29,7 @@ type Config struct {
 	DefaultHandle ParsedURI
 
 	DeviceUUID      uuid.UUID
+	DeviceName      string
 	LoggedInAt      time.Time
 	HardwareVersion string
 	SoftwareName    string
@@ -36,6 +37,15 @@ type Config struct {
 	SoftwareBuildID string
 }
 
+// IDCertExpiry returns when the ID certificate of the active profile expires.
+func (c *Config) IDCertExpiry() time.Time {
+	pair, ok := c.AuthIDCertPairs[c.ProfileID]
+	if !ok || pair.IDCert == nil {
+		return time.Time{}
+	}
+	return pair.IDCert.NotAfter
+}
+
 type AuthIDCertPair struct {
 	Added    time.Time
 	AuthCert *x509.Certificate
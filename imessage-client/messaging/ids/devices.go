@@ -0,0 +1,120 @@
+package ids
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"howett.net/plist"
+)
+
+// DependentRegistration is a device registered to the same account.
+type DependentRegistration struct {
+	DeviceName         string         `plist:"device-name"`
+	HardwareVersion    string         `plist:"hardware-version"`
+	Identities         []Identity     `plist:"identities"`
+	IsHSATrustedDevice bool           `plist:"is-hsa-trusted-device"`
+	PrivateDeviceData  map[string]any `plist:"private-device-data"`
+	PushToken          []byte         `plist:"push-token"`
+	SelfHandle         string         `plist:"self-handle"`
+	Service            string         `plist:"service"`
+	SubServices        []string       `plist:"sub-services"`
+	// Phone number URIs for iPhones that have registered a phone number
+	LinkedUserURI []string `plist:"linked-user-uri"`
+}
+
+// Identity is a handle registered by a dependent device.
+type Identity struct {
+	URI string `plist:"uri"`
+}
+
+// PushTokenFingerprint returns a short, stable identifier for the device's
+// push token without exposing the token itself.
+func (d *DependentRegistration) PushTokenFingerprint() string {
+	return TokenFingerprint(d.PushToken)
+}
+
+// TokenFingerprint returns a short, stable identifier for a push token
+// without exposing the token itself.
+func TokenFingerprint(token []byte) string {
+	if len(token) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256(token)
+	parts := make([]string, 8)
+	for i := range parts {
+		parts[i] = hex.EncodeToString(sum[i : i+1])
+	}
+	return strings.Join(parts, ":")
+}
+
+// DependentRegistrationsResp lists every device registered to an account.
+type DependentRegistrationsResp struct {
+	ExpiryEpochMillis int64                   `plist:"expiry-epoch-milli-sec"`
+	Status            IDSStatus               `plist:"status"`
+	Registrations     []DependentRegistration `plist:"registrations"`
+}
+
+// Expiry returns when the listing should be considered stale.
+func (r *DependentRegistrationsResp) Expiry() time.Time {
+	return time.UnixMilli(r.ExpiryEpochMillis)
+}
+
+type dependentRegistrationsReq struct {
+	RetryCount int `plist:"retry-count"`
+}
+
+// GetDependentRegistrations lists the devices registered to profileID.
+// The config must hold a push certificate and an auth certificate for the profile.
+func (c *HTTPClient) GetDependentRegistrations(ctx context.Context, cfg *Config, profileID string) (*DependentRegistrationsResp, error) {
+	certs, ok := cfg.AuthIDCertPairs[profileID]
+	if !ok {
+		return nil, fmt.Errorf("no auth id cert pair for %s", profileID)
+	}
+
+	body, err := plist.Marshal(&dependentRegistrationsReq{}, plist.XMLFormat)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal dependent registrations request: %w", err)
+	}
+
+	status, respBody, err := c.do(ctx, func(ctx context.Context) (*http.Request, error) {
+		httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, idsGetDependentRegistrationsURL, bytes.NewReader(body))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create HTTP request: %w", err)
+		}
+		httpReq.Header.Set("Content-Type", "application/x-apple-plist")
+		httpReq.Header.Set("X-Protocol-Version", ProtocolVersion)
+		httpReq.Header.Set("X-Auth-User-ID", profileID)
+		httpReq.Header.Set("User-Agent", fmt.Sprintf("com.apple.invitation-registration %s", cfg.CombinedVersion()))
+
+		// Signed per attempt so every retry carries a fresh nonce
+		signingPayload := cfg.bagSigningPayload("id-get-dependent-registrations", "", body)
+		if err := cfg.addPushHeaders(httpReq, signingPayload); err != nil {
+			return nil, fmt.Errorf("failed to sign request: %w", err)
+		}
+		if err := cfg.addAuthHeaders(httpReq, signingPayload, certs.AuthCert); err != nil {
+			return nil, fmt.Errorf("failed to sign request: %w", err)
+		}
+		return httpReq, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to send dependent registrations request: %w", err)
+	}
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("dependent registrations request failed with status %d", status)
+	}
+
+	var depResp DependentRegistrationsResp
+	if _, err := plist.Unmarshal(respBody, &depResp); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal dependent registrations response: %w", err)
+	}
+	if depResp.Status != IDSStatusSuccess {
+		return nil, IDSError{ErrorCode: depResp.Status}
+	}
+	return &depResp, nil
+}
@@ -0,0 +1,45 @@
+package ids
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ParseURI splits a handle URI such as "mailto:user@example.com" or
+// "tel:+15555550123" into scheme and identifier.
+func ParseURI(uri string) (ParsedURI, error) {
+	scheme, identifier, ok := strings.Cut(uri, ":")
+	if !ok || scheme == "" || identifier == "" {
+		return EmptyURI, fmt.Errorf("invalid handle URI %q", uri)
+	}
+	return ParsedURI{Scheme: scheme, Identifier: identifier}, nil
+}
+
+// ActiveHandles returns the handles the register response reports as
+// successfully registered.
+func (u *RegisterRespServiceUser) ActiveHandles() []ParsedURI {
+	var handles []ParsedURI
+	for _, handle := range u.URIs {
+		if handle.Status != IDSStatusSuccess {
+			continue
+		}
+		parsed, err := ParseURI(handle.URI)
+		if err != nil {
+			continue
+		}
+		handles = append(handles, parsed)
+	}
+	return handles
+}
+
+// InactiveHandles returns the handles the register response rejected or
+// deregistered, along with their status.
+func (u *RegisterRespServiceUser) InactiveHandles() map[string]IDSStatus {
+	inactive := make(map[string]IDSStatus)
+	for _, handle := range u.URIs {
+		if handle.Status != IDSStatusSuccess {
+			inactive[handle.URI] = handle.Status
+		}
+	}
+	return inactive
+}
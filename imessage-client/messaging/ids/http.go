@@ -6,96 +6,99 @@ import (
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha1"
-	"crypto/tls"
 	"crypto/x509"
 	"encoding/base64"
 	"fmt"
-	"io"
 	"net/http"
-	"time"
 
 	"howett.net/plist"
+
+	"imessage-client/messaging/trace"
+	"imessage-client/messaging/transport"
 )
 
 // HTTPClient wraps HTTP operations for IDS endpoints.
 type HTTPClient struct {
-	client *http.Client
+	client  *http.Client
+	options RequestOptions
+	breaker *circuitBreaker
 }
 
-// NewHTTPClient creates a new IDS HTTP client.
+// NewHTTPClient creates a new IDS HTTP client on the shared transport, so
+// connections are reused with every other client talking to Apple.
 func NewHTTPClient() *HTTPClient {
-	// Load system CA certificates
-	certPool, err := x509.SystemCertPool()
-	if err != nil {
-		// If system pool fails, create empty pool (will use built-in certs)
-		certPool = x509.NewCertPool()
-	}
+	// Timeouts come from RequestOptions so they can cover body reads and be
+	// changed per request.
+	return NewHTTPClientWithClient(transport.NewClient())
+}
 
-	// Note: Some systems may have issues verifying Apple's certificates
-	// If you encounter "certificate signed by unknown authority" errors:
-	// 1. Update ca-certificates: sudo pacman -S ca-certificates (or apt/yum equivalent)
-	// 2. Or temporarily disable verification (INSECURE - only for testing):
-	//    InsecureSkipVerify: true
-	
-	tlsConfig := &tls.Config{
-		RootCAs:    certPool,
-		MinVersion: tls.VersionTLS12,
-		// TEMPORARY: Skip verification if system CA bundle doesn't include Apple's root CA
-		// This is a workaround for systems where Apple's certificates aren't trusted
-		// TODO: Remove this once CA certificates are properly configured
-		InsecureSkipVerify: true,
+// NewHTTPClientWithClient creates an IDS client that sends requests through
+// client, e.g. one pointed at an idstest server.
+func NewHTTPClientWithClient(client *http.Client) *HTTPClient {
+	return &HTTPClient{
+		client:  client,
+		options: DefaultRequestOptions,
+		breaker: newCircuitBreaker(DefaultCircuitBreakerOptions),
 	}
+}
 
-	return &HTTPClient{
-		client: &http.Client{
-			Timeout: 30 * time.Second,
-			Transport: &http.Transport{
-				TLSClientConfig: tlsConfig,
-			},
-		},
+// SetRequestOptions sets the timeout and retry policy for all requests.
+// Use WithRequestOptions to override it for a single call.
+func (c *HTTPClient) SetRequestOptions(opts RequestOptions) {
+	c.options = opts
+}
+
+// SetCircuitBreaker replaces the client's circuit breaker, resetting the
+// failure counts of every endpoint.
+func (c *HTTPClient) SetCircuitBreaker(opts CircuitBreakerOptions) {
+	c.breaker = newCircuitBreaker(opts)
+}
+
+// SetTracer records every request and response made by the client.
+func (c *HTTPClient) SetTracer(recorder *trace.Recorder) {
+	if recorder == nil {
+		return
 	}
+	// Copy so a client shared through NewHTTPClientWithClient isn't modified
+	client := *c.client
+	client.Transport = &trace.Transport{Base: client.Transport, Recorder: recorder}
+	c.client = &client
 }
 
 // Register sends a registration request to Apple's IDS service.
 // Returns the parsed response containing push token and certificates.
+// A request missing required fields fails with ErrInvalidRegisterRequest
+// without being sent.
 func (c *HTTPClient) Register(ctx context.Context, req *RegisterReq, pushKey *rsa.PrivateKey) (*RegisterResp, error) {
-	// Marshal request to plist
-	body, err := plist.Marshal(req, plist.XMLFormat)
+	body, err := MarshalRegisterReq(req)
 	if err != nil {
-		return nil, fmt.Errorf("failed to marshal register request: %w", err)
-	}
-
-	// Create HTTP request
-	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, idsRegisterURL, bytes.NewReader(body))
-	if err != nil {
-		return nil, fmt.Errorf("failed to create HTTP request: %w", err)
-	}
-
-	// Set headers
-	httpReq.Header.Set("Content-Type", "application/x-apple-plist")
-	httpReq.Header.Set("X-Protocol-Version", ProtocolVersion)
-	httpReq.Header.Set("User-Agent", fmt.Sprintf("com.apple.invitation-registration [%s]", req.SoftwareVersion))
-
-	// Sign request with push key
-	if err := c.signRequest(httpReq, body, pushKey); err != nil {
-		return nil, fmt.Errorf("failed to sign request: %w", err)
-	}
-
-	// Send request
-	resp, err := c.client.Do(httpReq)
+		return nil, err
+	}
+
+	status, respBody, err := c.do(ctx, func(ctx context.Context) (*http.Request, error) {
+		// Create HTTP request
+		httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, idsRegisterURL, bytes.NewReader(body))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create HTTP request: %w", err)
+		}
+
+		// Set headers
+		httpReq.Header.Set("Content-Type", "application/x-apple-plist")
+		httpReq.Header.Set("X-Protocol-Version", ProtocolVersion)
+		httpReq.Header.Set("User-Agent", fmt.Sprintf("com.apple.invitation-registration [%s]", req.SoftwareVersion))
+
+		// Sign request with push key
+		if err := c.signRequest(httpReq, body, pushKey); err != nil {
+			return nil, fmt.Errorf("failed to sign request: %w", err)
+		}
+		return httpReq, nil
+	})
 	if err != nil {
 		return nil, fmt.Errorf("failed to send register request: %w", err)
 	}
-	defer resp.Body.Close()
-
-	// Parse response
-	respBody, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read response body: %w", err)
-	}
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("register request failed with status %d: %s", resp.StatusCode, string(respBody))
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("register request failed with status %d: %s", status, string(respBody))
 	}
 
 	var registerResp RegisterResp
@@ -152,31 +155,24 @@ func (c *HTTPClient) AuthenticateDevice(ctx context.Context, req *DeviceAuthReq)
 		return nil, fmt.Errorf("failed to marshal auth request: %w", err)
 	}
 
-	// Create HTTP request
-	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, idsAuthDevURL, bytes.NewReader(body))
-	if err != nil {
-		return nil, fmt.Errorf("failed to create HTTP request: %w", err)
-	}
-
-	httpReq.Header.Set("Content-Type", "application/x-apple-plist")
-	httpReq.Header.Set("X-Protocol-Version", ProtocolVersion)
-	httpReq.Header.Set("User-Agent", "imessage-client")
+	status, respBody, err := c.do(ctx, func(ctx context.Context) (*http.Request, error) {
+		// Create HTTP request
+		httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, idsAuthDevURL, bytes.NewReader(body))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create HTTP request: %w", err)
+		}
 
-	// Send request
-	resp, err := c.client.Do(httpReq)
+		httpReq.Header.Set("Content-Type", "application/x-apple-plist")
+		httpReq.Header.Set("X-Protocol-Version", ProtocolVersion)
+		httpReq.Header.Set("User-Agent", "imessage-client")
+		return httpReq, nil
+	})
 	if err != nil {
 		return nil, fmt.Errorf("failed to send auth request: %w", err)
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("auth request failed with status %d", resp.StatusCode)
-	}
-
-	// Parse response
-	respBody, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read response body: %w", err)
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("auth request failed with status %d", status)
 	}
 
 	var authResp DeviceAuthResp
@@ -4,8 +4,10 @@ import (
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/x509"
 	"encoding/asn1"
+	"fmt"
 )
 
 // UserIdentity represents a user's public identity for iMessage.
@@ -41,3 +43,35 @@ func (i *UserIdentity) ToBytes() []byte {
 	}
 	return out
 }
+
+// Hash identifies the identity in the HMAC that derives pair encryption keys.
+func (i *UserIdentity) Hash() []byte {
+	h := sha256.New()
+	h.Write(i.marshalSigningKey())
+	h.Write(i.marshalEncryptionKey())
+	return h.Sum(nil)
+}
+
+// ParseUserIdentity parses an identity serialized by ToBytes, as returned
+// in lookup results.
+func ParseUserIdentity(data []byte) (*UserIdentity, error) {
+	var raw asnIdentity
+	if _, err := asn1.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal identity: %w", err)
+	}
+	if len(raw.SigningKey) < 2 || len(raw.EncryptionKey) < 2 {
+		return nil, fmt.Errorf("identity keys too short")
+	}
+	x, y := elliptic.Unmarshal(elliptic.P256(), raw.SigningKey[2:])
+	if x == nil {
+		return nil, fmt.Errorf("invalid signing key")
+	}
+	encryptionKey, err := x509.ParsePKCS1PublicKey(raw.EncryptionKey[2:])
+	if err != nil {
+		return nil, fmt.Errorf("invalid encryption key: %w", err)
+	}
+	return &UserIdentity{
+		SigningKey:    &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y},
+		EncryptionKey: encryptionKey,
+	}, nil
+}
@@ -0,0 +1,175 @@
+// Package idstest provides a mock IDS server that serves canned plist
+// responses, for handshake tests and fixture-driven tests of request
+// construction.
+package idstest
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+
+	"howett.net/plist"
+
+	"imessage-client/messaging/ids"
+)
+
+// Endpoint is the URL path of an IDS endpoint.
+type Endpoint string
+
+const (
+	EndpointRegister               Endpoint = "/WebObjects/TDIdentityService.woa/wa/register"
+	EndpointAuthenticateDevice     Endpoint = "/WebObjects/TDIdentityService.woa/wa/authenticateDevice"
+	EndpointDependentRegistrations Endpoint = "/WebObjects/TDIdentityService.woa/wa/getDependentRegistrations"
+	EndpointGetHandles             Endpoint = "/WebObjects/VCProfileService.woa/wa/idsGetHandles"
+	EndpointLookup                 Endpoint = "/WebObjects/QueryService.woa/wa/query"
+)
+
+// Request is a request received by the server.
+type Request struct {
+	Endpoint Endpoint
+	Method   string
+	Host     string
+	Header   http.Header
+	Body     []byte
+}
+
+// Decode unmarshals the plist request body into v.
+func (r Request) Decode(v any) error {
+	if _, err := plist.Unmarshal(r.Body, v); err != nil {
+		return fmt.Errorf("failed to decode %s request: %w", r.Endpoint, err)
+	}
+	return nil
+}
+
+type response struct {
+	status int
+	body   []byte
+}
+
+// Server is a mock IDS server. Endpoints without a configured response
+// return 404.
+type Server struct {
+	srv *httptest.Server
+
+	mu        sync.Mutex
+	responses map[Endpoint]response
+	requests  []Request
+}
+
+// NewServer starts a mock IDS server on a local TLS listener.
+func NewServer() *Server {
+	s := &Server{responses: make(map[Endpoint]response)}
+	s.srv = httptest.NewTLSServer(http.HandlerFunc(s.handle))
+	return s
+}
+
+// Respond makes endpoint return v, encoded as an XML plist, with status 200.
+func (s *Server) Respond(endpoint Endpoint, v any) error {
+	return s.RespondStatus(endpoint, http.StatusOK, v)
+}
+
+// RespondStatus makes endpoint return v, encoded as an XML plist, with the
+// given HTTP status.
+func (s *Server) RespondStatus(endpoint Endpoint, status int, v any) error {
+	body, err := plist.Marshal(v, plist.XMLFormat)
+	if err != nil {
+		return fmt.Errorf("failed to encode %s response: %w", endpoint, err)
+	}
+	s.RespondRaw(endpoint, status, body)
+	return nil
+}
+
+// RespondFile makes endpoint return the contents of a fixture file.
+func (s *Server) RespondFile(endpoint Endpoint, path string) error {
+	body, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	s.RespondRaw(endpoint, http.StatusOK, body)
+	return nil
+}
+
+// RespondRaw makes endpoint return body verbatim.
+func (s *Server) RespondRaw(endpoint Endpoint, status int, body []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.responses[endpoint] = response{status: status, body: body}
+}
+
+// Requests returns the requests received for endpoint, oldest first.
+func (s *Server) Requests(endpoint Endpoint) []Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out []Request
+	for _, req := range s.requests {
+		if req.Endpoint == endpoint {
+			out = append(out, req)
+		}
+	}
+	return out
+}
+
+// Client returns an http.Client that sends every request to this server,
+// whatever host it was addressed to.
+func (s *Server) Client() *http.Client {
+	return &http.Client{Transport: &redirectTransport{
+		base: s.srv.Client().Transport,
+		host: s.srv.Listener.Addr().String(),
+	}}
+}
+
+// HTTPClient returns an IDS client that talks to this server.
+func (s *Server) HTTPClient() *ids.HTTPClient {
+	return ids.NewHTTPClientWithClient(s.Client())
+}
+
+// Close shuts the server down.
+func (s *Server) Close() {
+	s.srv.Close()
+}
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	endpoint := Endpoint(r.URL.Path)
+
+	s.mu.Lock()
+	s.requests = append(s.requests, Request{
+		Endpoint: endpoint,
+		Method:   r.Method,
+		Host:     r.Header.Get("X-Original-Host"),
+		Header:   r.Header.Clone(),
+		Body:     body,
+	})
+	resp, ok := s.responses[endpoint]
+	s.mu.Unlock()
+
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-apple-plist")
+	w.WriteHeader(resp.status)
+	_, _ = w.Write(resp.body)
+}
+
+// redirectTransport rewrites requests to go to the test server.
+type redirectTransport struct {
+	base http.RoundTripper
+	host string
+}
+
+func (t *redirectTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("X-Original-Host", req.URL.Host)
+	req.URL.Scheme = "https"
+	req.URL.Host = t.host
+	req.Host = ""
+	return t.base.RoundTrip(req)
+}
@@ -0,0 +1,288 @@
+package idstest
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"testing"
+	"time"
+
+	"imessage-client/config"
+	"imessage-client/messaging"
+	"imessage-client/messaging/ids"
+)
+
+func testCert(t *testing.T) []byte {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "id cert"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(30 * 24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+func TestHandshakeAgainstMockServer(t *testing.T) {
+	server := NewServer()
+	defer server.Close()
+
+	err := server.Respond(EndpointRegister, &ids.RegisterResp{
+		Services: []ids.RegisterRespService{{
+			Service: "com.apple.madrid",
+			Users: []ids.RegisterRespServiceUser{{
+				UserID: "D:123",
+				Cert:   testCert(t),
+				URIs: []ids.RespHandle{
+					{URI: "mailto:user@example.com"},
+					{URI: "tel:+15555550123", Status: 6005},
+				},
+			}},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reg := &config.RegistrationData{
+		ValidationData: []byte("validation"),
+		ValidUntil:     time.Now().Add(time.Hour),
+		DeviceInfo: config.DeviceInfo{
+			HardwareVersion: "Macmini9,1",
+			SoftwareName:    "macOS",
+			SoftwareVersion: "13.4.1",
+			SoftwareBuildID: "22F82",
+			DeviceName:      "Test Mac",
+		},
+	}
+	handshaker := messaging.RealHandshaker{HTTPClient: server.HTTPClient()}
+	if _, err := handshaker.Handshake(context.Background(), reg); err != nil {
+		t.Fatalf("Handshake: %v", err)
+	}
+
+	requests := server.Requests(EndpointRegister)
+	if len(requests) != 1 {
+		t.Fatalf("got %d register requests, want 1", len(requests))
+	}
+	req := requests[0]
+	if req.Host != "identity.ess.apple.com" {
+		t.Errorf("register sent to %q", req.Host)
+	}
+	if req.Header.Get("X-Push-Sig") == "" {
+		t.Error("register request isn't signed")
+	}
+	var body ids.RegisterReq
+	if err := req.Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if body.DeviceName != "Test Mac" {
+		t.Errorf("device name = %q, want Test Mac", body.DeviceName)
+	}
+	if body.HardwareVersion != "Macmini9,1" {
+		t.Errorf("hardware version = %q, want Macmini9,1", body.HardwareVersion)
+	}
+	if string(body.ValidationData) != "validation" {
+		t.Errorf("validation data = %q", body.ValidationData)
+	}
+}
+
+func TestUnconfiguredEndpoint(t *testing.T) {
+	server := NewServer()
+	defer server.Close()
+
+	_, err := server.HTTPClient().AuthenticateDevice(context.Background(), &ids.DeviceAuthReq{})
+	if err == nil {
+		t.Fatal("expected error for unconfigured endpoint")
+	}
+	if len(server.Requests(EndpointAuthenticateDevice)) != 1 {
+		t.Error("request wasn't recorded")
+	}
+
+	if err := server.RespondStatus(EndpointAuthenticateDevice, http.StatusOK, &ids.DeviceAuthResp{Cert: []byte{1}}); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := server.HTTPClient().AuthenticateDevice(context.Background(), &ids.DeviceAuthReq{})
+	if err != nil {
+		t.Fatalf("AuthenticateDevice: %v", err)
+	}
+	if len(resp.Cert) != 1 {
+		t.Errorf("cert = %x", resp.Cert)
+	}
+}
+
+// testLookupConfig returns a config with the certificates and keys lookups
+// are signed with. The RSA key is also returned to use as an identity key.
+func testLookupConfig(t *testing.T) (*ids.Config, *rsa.PrivateKey) {
+	t.Helper()
+	cert, err := x509.ParseCertificate(testCert(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &ids.Config{
+		ProfileID:       "D:123",
+		AuthPrivateKey:  rsaKey,
+		AuthIDCertPairs: map[string]*ids.AuthIDCertPair{"D:123": {IDCert: cert}},
+		PushKey:         rsaKey,
+		PushCert:        cert,
+	}, rsaKey
+}
+
+func TestLookupAgainstMockServer(t *testing.T) {
+	server := NewServer()
+	defer server.Close()
+
+	cfg, rsaKey := testLookupConfig(t)
+	cfg.PushToken = []byte{9, 9}
+	signingKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	identity := &ids.UserIdentity{SigningKey: &signingKey.PublicKey, EncryptionKey: &rsaKey.PublicKey}
+
+	err = server.Respond(EndpointLookup, map[string]any{
+		"status": 0,
+		"results": map[string]any{
+			"mailto:friend@example.com": map[string]any{
+				"status": 0,
+				"identities": []any{map[string]any{
+					"push-token":  []byte{1, 2, 3},
+					"client-data": map[string]any{"public-message-identity-key": identity.ToBytes()},
+				}},
+			},
+			"tel:+15555550199": map[string]any{"status": 0, "identities": []any{}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	self := ids.ParsedURI{Scheme: ids.SchemeEmail, Identifier: "user@example.com"}
+	handles := []ids.ParsedURI{
+		{Scheme: ids.SchemeEmail, Identifier: "friend@example.com"},
+		{Scheme: ids.SchemeTel, Identifier: "+15555550199"},
+	}
+	results, err := server.HTTPClient().Lookup(context.Background(), cfg, self, handles)
+	if err != nil {
+		t.Fatalf("Lookup: %v", err)
+	}
+
+	friend := results[handles[0]]
+	if friend == nil || friend.FindIdentity([]byte{1, 2, 3}) == nil {
+		t.Fatalf("missing identity for %s: %+v", handles[0], friend)
+	}
+	key, err := friend.Identities[0].IdentityKey()
+	if err != nil {
+		t.Fatalf("IdentityKey: %v", err)
+	}
+	if !key.EncryptionKey.Equal(&rsaKey.PublicKey) || !key.SigningKey.Equal(&signingKey.PublicKey) {
+		t.Error("identity key didn't round trip")
+	}
+	if other := results[handles[1]]; other == nil || len(other.Identities) != 0 {
+		t.Errorf("result for %s = %+v, want no identities", handles[1], other)
+	}
+
+	reqs := server.Requests(EndpointLookup)
+	if len(reqs) != 1 {
+		t.Fatalf("got %d lookup requests", len(reqs))
+	}
+	if got := reqs[0].Header.Get("X-ID-Self-URI"); got != self.String() {
+		t.Errorf("X-ID-Self-URI = %q", got)
+	}
+	if reqs[0].Header.Get("X-ID-Sig") == "" || reqs[0].Header.Get("X-Push-Sig") == "" {
+		t.Error("lookup request isn't signed")
+	}
+	var body struct {
+		URIs []string `plist:"uris"`
+	}
+	if err := reqs[0].Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if len(body.URIs) != 2 || body.URIs[0] != "mailto:friend@example.com" {
+		t.Errorf("uris = %v", body.URIs)
+	}
+}
+
+func TestLookupBatching(t *testing.T) {
+	server := NewServer()
+	defer server.Close()
+
+	cfg, _ := testLookupConfig(t)
+
+	handles := make([]ids.ParsedURI, ids.MaxLookupBatch+5)
+	responseResults := make(map[string]any)
+	for i := range handles {
+		handles[i] = ids.ParsedURI{Scheme: ids.SchemeEmail, Identifier: fmt.Sprintf("user%d@example.com", i)}
+		responseResults[handles[i].String()] = map[string]any{"status": 0, "identities": []any{}}
+	}
+	if err := server.Respond(EndpointLookup, map[string]any{"status": 0, "results": responseResults}); err != nil {
+		t.Fatal(err)
+	}
+
+	results, err := server.HTTPClient().Lookup(context.Background(), cfg, ids.ParsedURI{Scheme: ids.SchemeEmail, Identifier: "me@example.com"}, handles)
+	if err != nil {
+		t.Fatalf("Lookup: %v", err)
+	}
+	if len(results) != len(handles) {
+		t.Errorf("got %d results, want %d", len(results), len(handles))
+	}
+
+	reqs := server.Requests(EndpointLookup)
+	if len(reqs) != 2 {
+		t.Fatalf("got %d lookup requests, want 2", len(reqs))
+	}
+	for i, want := range []int{ids.MaxLookupBatch, 5} {
+		var body struct {
+			URIs []string `plist:"uris"`
+		}
+		if err := reqs[i].Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		if len(body.URIs) != want {
+			t.Errorf("request %d has %d handles, want %d", i, len(body.URIs), want)
+		}
+	}
+}
+
+func TestLookupSplitsOversizedResponses(t *testing.T) {
+	server := NewServer()
+	defer server.Close()
+
+	cfg, _ := testLookupConfig(t)
+	// Every query is "too large", even single-handle ones
+	if err := server.Respond(EndpointLookup, map[string]any{"status": int(ids.IDSStatusWebTunnelServiceResponseTooLarge)}); err != nil {
+		t.Fatal(err)
+	}
+
+	handles := []ids.ParsedURI{
+		{Scheme: ids.SchemeEmail, Identifier: "a@example.com"},
+		{Scheme: ids.SchemeEmail, Identifier: "b@example.com"},
+	}
+	_, err := server.HTTPClient().Lookup(context.Background(), cfg, ids.ParsedURI{Scheme: ids.SchemeEmail, Identifier: "me@example.com"}, handles)
+	if !errors.Is(err, ids.IDSError{ErrorCode: ids.IDSStatusWebTunnelServiceResponseTooLarge}) {
+		t.Fatalf("err = %v", err)
+	}
+	// One query for both, then one for the first half which can't be split further
+	if n := len(server.Requests(EndpointLookup)); n != 2 {
+		t.Errorf("got %d lookup requests, want 2", n)
+	}
+}
@@ -0,0 +1,182 @@
+package ids
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"time"
+
+	"howett.net/plist"
+)
+
+// LookupIdentity is one device registered to a looked up handle.
+type LookupIdentity struct {
+	ClientData                 map[string]any `plist:"client-data"`
+	PushToken                  []byte         `plist:"push-token"`
+	SessionToken               []byte         `plist:"session-token"`
+	SessionTokenExpiresSeconds int            `plist:"session-token-expires-seconds"`
+	SessionTokenRefreshSeconds int            `plist:"session-token-refresh-seconds"`
+}
+
+// IdentityKey returns the public keys messages to this device are encrypted
+// and verified with.
+func (l *LookupIdentity) IdentityKey() (*UserIdentity, error) {
+	raw, ok := l.ClientData["public-message-identity-key"].([]byte)
+	if !ok {
+		return nil, fmt.Errorf("lookup identity has no public message identity key")
+	}
+	return ParseUserIdentity(raw)
+}
+
+// LookupResult lists the devices registered to a handle. A handle that isn't
+// on iMessage has no identities.
+type LookupResult struct {
+	Identities []LookupIdentity `plist:"identities"`
+	Status     IDSStatus        `plist:"status"`
+
+	// Time is when the result was received.
+	Time time.Time `plist:"-"`
+}
+
+// FindIdentity returns the identity registered with pushToken, or nil.
+func (r *LookupResult) FindIdentity(pushToken []byte) *LookupIdentity {
+	for i := range r.Identities {
+		if bytes.Equal(r.Identities[i].PushToken, pushToken) {
+			return &r.Identities[i]
+		}
+	}
+	return nil
+}
+
+type lookupReq struct {
+	URIs []string `plist:"uris"`
+}
+
+type lookupResp struct {
+	Results map[string]*LookupResult `plist:"results"`
+	Status  IDSStatus                `plist:"status"`
+}
+
+// MaxLookupBatch is the most handles IDS accepts in a single query.
+const MaxLookupBatch = 20
+
+// Lookup asks IDS which devices the handles are registered on, signing as
+// self. Handles missing from the response aren't in the returned map.
+// Any number of handles may be passed: they are sent in batches of
+// MaxLookupBatch, and batches IDS rejects as too large are split further.
+func (c *HTTPClient) Lookup(ctx context.Context, cfg *Config, self ParsedURI, handles []ParsedURI) (map[ParsedURI]*LookupResult, error) {
+	results := make(map[ParsedURI]*LookupResult, len(handles))
+	for start := 0; start < len(handles); start += MaxLookupBatch {
+		end := min(start+MaxLookupBatch, len(handles))
+		if err := c.lookupSplitting(ctx, cfg, self, handles[start:end], results); err != nil {
+			return nil, err
+		}
+	}
+	return results, nil
+}
+
+// lookupSplitting looks up one batch into results, halving it when the
+// response would be too large.
+func (c *HTTPClient) lookupSplitting(ctx context.Context, cfg *Config, self ParsedURI, handles []ParsedURI, results map[ParsedURI]*LookupResult) error {
+	batch, err := c.lookupBatch(ctx, cfg, self, handles)
+	if errors.Is(err, IDSError{ErrorCode: IDSStatusWebTunnelServiceResponseTooLarge}) && len(handles) > 1 {
+		half := len(handles) / 2
+		if err := c.lookupSplitting(ctx, cfg, self, handles[:half], results); err != nil {
+			return err
+		}
+		return c.lookupSplitting(ctx, cfg, self, handles[half:], results)
+	} else if err != nil {
+		return err
+	}
+	maps.Copy(results, batch)
+	return nil
+}
+
+func (c *HTTPClient) lookupBatch(ctx context.Context, cfg *Config, self ParsedURI, handles []ParsedURI) (map[ParsedURI]*LookupResult, error) {
+	certs, ok := cfg.AuthIDCertPairs[cfg.ProfileID]
+	if self.Scheme == SchemeTel {
+		if pair, found := cfg.AuthIDCertPairs["P:"+self.Identifier]; found {
+			certs, ok = pair, true
+		}
+	}
+	if !ok {
+		return nil, fmt.Errorf("no ID certificate for %s", self)
+	}
+
+	req := lookupReq{URIs: make([]string, len(handles))}
+	for i, handle := range handles {
+		req.URIs[i] = handle.String()
+	}
+	body, err := plist.Marshal(&req, plist.XMLFormat)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal lookup request: %w", err)
+	}
+
+	status, respBody, err := c.do(ctx, func(ctx context.Context) (*http.Request, error) {
+		httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, idsQueryURL, bytes.NewReader(body))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create HTTP request: %w", err)
+		}
+		httpReq.Header.Set("Content-Type", "application/x-apple-plist")
+		httpReq.Header.Set("X-Protocol-Version", ProtocolVersion)
+		httpReq.Header.Set("X-ID-Self-URI", self.String())
+		httpReq.Header.Set("User-Agent", fmt.Sprintf("com.apple.madrid-lookup %s", cfg.CombinedVersion()))
+
+		signingPayload := cfg.bagSigningPayload("id-query", "", body)
+		if err := cfg.addPushHeaders(httpReq, signingPayload); err != nil {
+			return nil, fmt.Errorf("failed to sign request: %w", err)
+		}
+		if err := cfg.addIDHeaders(httpReq, signingPayload, certs.IDCert); err != nil {
+			return nil, fmt.Errorf("failed to sign request: %w", err)
+		}
+		return httpReq, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to send lookup request: %w", err)
+	}
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("lookup request failed with status %d", status)
+	}
+
+	respBody, err = maybeGUnzip(respBody)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress lookup response: %w", err)
+	}
+	var resp lookupResp
+	if _, err := plist.Unmarshal(respBody, &resp); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal lookup response: %w", err)
+	}
+	if resp.Status != IDSStatusSuccess {
+		return nil, IDSError{ErrorCode: resp.Status}
+	}
+
+	now := time.Now()
+	results := make(map[ParsedURI]*LookupResult, len(resp.Results))
+	for uri, result := range resp.Results {
+		handle, err := ParseURI(uri)
+		if err != nil {
+			continue
+		}
+		result.Time = now
+		results[handle] = result
+	}
+	return results, nil
+}
+
+// maybeGUnzip decompresses lookup responses, which IDS may gzip.
+func maybeGUnzip(data []byte) ([]byte, error) {
+	if len(data) < 2 || data[0] != 0x1f || data[1] != 0x8b {
+		return data, nil
+	}
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
@@ -10,8 +10,8 @@ import (
 // AppleEpoch is the reference time for Apple timestamps (2001-01-01 00:00 UTC).
 var AppleEpoch = time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
 
-// DeviceName is the default device name for registrations.
-const DeviceName = "imessage-client"
+// DefaultDeviceName is the device name used when none is configured.
+const DefaultDeviceName = "Mac"
 
 // ProtocolVersion is the IDS protocol version to use.
 const ProtocolVersion = "1640"
@@ -21,6 +21,9 @@ const (
 	idsRegisterURL   = "https://identity.ess.apple.com/WebObjects/TDIdentityService.woa/wa/register"
 	idsAuthDevURL    = "https://identity.ess.apple.com/WebObjects/TDIdentityService.woa/wa/authenticateDevice"
 	idsGetHandlesURL = "https://profile.ess.apple.com/WebObjects/VCProfileService.woa/wa/idsGetHandles"
+
+	idsGetDependentRegistrationsURL = "https://identity.ess.apple.com/WebObjects/TDIdentityService.woa/wa/getDependentRegistrations"
+	idsQueryURL                     = "https://query.ess.apple.com/WebObjects/QueryService.woa/wa/query"
 )
 
 // RegisterReq is the main IDS registration request payload.
@@ -176,5 +179,5 @@ func (c *Config) IDSOSVersion() string {
 
 // CombinedVersion returns the combined software version string.
 func (c *Config) CombinedVersion() string {
-	return "macOS,13.4.1,22F82"
+	return c.IDSOSVersion()
 }
@@ -0,0 +1,228 @@
+package ids
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// RequestOptions controls how long IDS requests may take and how failed
+// attempts are retried.
+type RequestOptions struct {
+	// Timeout bounds each attempt, including reading the response body.
+	// Zero leaves the attempt bounded only by the caller's context.
+	Timeout time.Duration
+	// MaxRetries is how many more attempts are made after a network error,
+	// a timed out attempt, or a 429/5xx response.
+	MaxRetries int
+	// RetryBackoff is the delay before the first retry. It doubles for each
+	// retry after that.
+	RetryBackoff time.Duration
+}
+
+// DefaultRequestOptions are used by clients that haven't been configured otherwise.
+var DefaultRequestOptions = RequestOptions{
+	Timeout:      30 * time.Second,
+	MaxRetries:   2,
+	RetryBackoff: 500 * time.Millisecond,
+}
+
+type requestOptionsKey struct{}
+
+// WithRequestOptions overrides the client's request options for calls made with ctx.
+func WithRequestOptions(ctx context.Context, opts RequestOptions) context.Context {
+	return context.WithValue(ctx, requestOptionsKey{}, opts)
+}
+
+// CircuitBreakerOptions controls when requests to a failing endpoint start
+// failing fast instead of being sent.
+type CircuitBreakerOptions struct {
+	// Threshold is the number of consecutive failed attempts that opens the
+	// circuit. Zero disables the breaker.
+	Threshold int
+	// Cooldown is how long the circuit stays open before a single request is
+	// let through to probe the endpoint.
+	Cooldown time.Duration
+}
+
+// DefaultCircuitBreakerOptions are used by clients that haven't been configured otherwise.
+var DefaultCircuitBreakerOptions = CircuitBreakerOptions{
+	Threshold: 5,
+	Cooldown:  30 * time.Second,
+}
+
+var ErrCircuitOpen = errors.New("IDS endpoint circuit open")
+
+// CircuitOpenError is returned without sending a request when an endpoint
+// has failed too many times in a row.
+type CircuitOpenError struct {
+	Endpoint string
+	RetryAt  time.Time
+}
+
+func (e CircuitOpenError) Error() string {
+	return fmt.Sprintf("%s: %s (retry after %s)", ErrCircuitOpen, e.Endpoint, e.RetryAt.Format(time.RFC3339))
+}
+
+func (e CircuitOpenError) Is(other error) bool {
+	return other == ErrCircuitOpen
+}
+
+type circuitState struct {
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+type circuitBreaker struct {
+	opts CircuitBreakerOptions
+
+	mu        sync.Mutex
+	endpoints map[string]*circuitState
+}
+
+func newCircuitBreaker(opts CircuitBreakerOptions) *circuitBreaker {
+	return &circuitBreaker{opts: opts, endpoints: make(map[string]*circuitState)}
+}
+
+// allow reports whether a request to endpoint may be sent now.
+func (b *circuitBreaker) allow(endpoint string, now time.Time) error {
+	if b.opts.Threshold <= 0 {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	state, ok := b.endpoints[endpoint]
+	if !ok || state.failures < b.opts.Threshold {
+		return nil
+	}
+	if now.Before(state.openUntil) || state.probing {
+		return CircuitOpenError{Endpoint: endpoint, RetryAt: state.openUntil}
+	}
+	// Half-open: let this one request through and hold the rest until it finishes
+	state.probing = true
+	return nil
+}
+
+// record updates the endpoint's state with the outcome of an attempt.
+func (b *circuitBreaker) record(endpoint string, ok bool, now time.Time) {
+	if b.opts.Threshold <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ok {
+		delete(b.endpoints, endpoint)
+		return
+	}
+	state, exists := b.endpoints[endpoint]
+	if !exists {
+		state = &circuitState{}
+		b.endpoints[endpoint] = state
+	}
+	state.failures++
+	state.probing = false
+	if state.failures >= b.opts.Threshold {
+		state.openUntil = now.Add(b.opts.Cooldown)
+	}
+}
+
+// release ends a probe without an outcome, e.g. when the caller gave up on it.
+func (b *circuitBreaker) release(endpoint string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if state, ok := b.endpoints[endpoint]; ok {
+		state.probing = false
+	}
+}
+
+// permanentError marks a failure that retrying can't fix.
+type permanentError struct{ err error }
+
+func (e permanentError) Error() string { return e.err.Error() }
+func (e permanentError) Unwrap() error { return e.err }
+
+func retryableStatus(status int) bool {
+	return status == http.StatusTooManyRequests || status >= 500
+}
+
+// do sends the request built by newRequest and reads the whole response body,
+// retrying according to the client's request options. newRequest is called
+// once per attempt so that bodies and signatures are fresh. A non-retryable
+// or final HTTP status is returned to the caller rather than as an error.
+func (c *HTTPClient) do(ctx context.Context, newRequest func(ctx context.Context) (*http.Request, error)) (int, []byte, error) {
+	opts := c.options
+	if override, ok := ctx.Value(requestOptionsKey{}).(RequestOptions); ok {
+		opts = override
+	}
+
+	backoff := opts.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		status, body, err := c.attempt(ctx, opts.Timeout, newRequest)
+		var permanent permanentError
+		if errors.As(err, &permanent) {
+			return 0, nil, permanent.err
+		}
+		retryable := (err != nil && !errors.Is(err, ErrCircuitOpen)) || retryableStatus(status)
+		if ctx.Err() != nil {
+			return 0, nil, ctx.Err()
+		}
+		if !retryable || attempt >= opts.MaxRetries {
+			return status, body, err
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return 0, nil, ctx.Err()
+		}
+		backoff *= 2
+	}
+}
+
+func (c *HTTPClient) attempt(parent context.Context, timeout time.Duration, newRequest func(ctx context.Context) (*http.Request, error)) (int, []byte, error) {
+	ctx := parent
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	req, err := newRequest(ctx)
+	if err != nil {
+		return 0, nil, permanentError{err}
+	}
+	endpoint := req.URL.Host + req.URL.Path
+	if err := c.breaker.allow(endpoint, time.Now()); err != nil {
+		return 0, nil, err
+	}
+	failed := func() {
+		// Cancellation by the caller says nothing about the endpoint's health
+		if parent.Err() != nil {
+			c.breaker.release(endpoint)
+		} else {
+			c.breaker.record(endpoint, false, time.Now())
+		}
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		failed()
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+
+	// The body is read under the same context, so a stalled response is cut
+	// off by the timeout rather than hanging the caller.
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		failed()
+		return 0, nil, fmt.Errorf("failed to read response body: %w", err)
+	}
+	c.breaker.record(endpoint, !retryableStatus(resp.StatusCode), time.Now())
+	return resp.StatusCode, body, nil
+}
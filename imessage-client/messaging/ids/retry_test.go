@@ -0,0 +1,137 @@
+package ids
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func testRequest(url string) func(ctx context.Context) (*http.Request, error) {
+	return func(ctx context.Context) (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	}
+}
+
+func TestDoRetriesServerErrors(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+
+	c := NewHTTPClientWithClient(srv.Client())
+	c.SetRequestOptions(RequestOptions{MaxRetries: 2, RetryBackoff: time.Millisecond})
+	status, body, err := c.do(context.Background(), testRequest(srv.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusOK || string(body) != "ok" {
+		t.Errorf("got %d %q", status, body)
+	}
+	if calls.Load() != 3 {
+		t.Errorf("calls = %d, want 3", calls.Load())
+	}
+}
+
+func TestDoDoesNotRetryClientErrors(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer srv.Close()
+
+	c := NewHTTPClientWithClient(srv.Client())
+	c.SetRequestOptions(RequestOptions{MaxRetries: 3, RetryBackoff: time.Millisecond})
+	status, _, err := c.do(context.Background(), testRequest(srv.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusBadRequest || calls.Load() != 1 {
+		t.Errorf("status = %d, calls = %d", status, calls.Load())
+	}
+}
+
+func TestDoTimesOutBodyRead(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("partial"))
+		w.(http.Flusher).Flush()
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	c := NewHTTPClientWithClient(srv.Client())
+	ctx := WithRequestOptions(context.Background(), RequestOptions{Timeout: 50 * time.Millisecond})
+	_, _, err := c.do(ctx, testRequest(srv.URL))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("err = %v, want deadline exceeded", err)
+	}
+}
+
+func TestDoCancelled(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	c := NewHTTPClientWithClient(srv.Client())
+	c.SetRequestOptions(RequestOptions{MaxRetries: 10, RetryBackoff: time.Hour})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, _, err := c.do(ctx, testRequest(srv.URL))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("err = %v, want deadline exceeded", err)
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	var calls atomic.Int32
+	var healthy atomic.Bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if !healthy.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer srv.Close()
+
+	c := NewHTTPClientWithClient(srv.Client())
+	c.SetRequestOptions(RequestOptions{})
+	c.SetCircuitBreaker(CircuitBreakerOptions{Threshold: 2, Cooldown: 50 * time.Millisecond})
+
+	for i := 0; i < 2; i++ {
+		if status, _, _ := c.do(context.Background(), testRequest(srv.URL)); status != http.StatusInternalServerError {
+			t.Fatalf("status = %d", status)
+		}
+	}
+	_, _, err := c.do(context.Background(), testRequest(srv.URL))
+	if !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("err = %v, want circuit open", err)
+	}
+	if calls.Load() != 2 {
+		t.Errorf("calls = %d, open circuit still sent a request", calls.Load())
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	healthy.Store(true)
+	if status, _, err := c.do(context.Background(), testRequest(srv.URL)); err != nil || status != http.StatusOK {
+		t.Fatalf("probe: %d %v", status, err)
+	}
+	if _, _, err := c.do(context.Background(), testRequest(srv.URL)); err != nil {
+		t.Errorf("circuit didn't close after successful probe: %v", err)
+	}
+}
@@ -0,0 +1,99 @@
+package ids
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// nonceLength is the size of the nonce prepended to signed payloads:
+// 1 version byte, 8 bytes of unix milliseconds and 8 random bytes.
+const nonceLength = 17
+
+func generateNonce() []byte {
+	nonce := make([]byte, nonceLength)
+	nonce[0] = 0x01
+	binary.BigEndian.PutUint64(nonce[1:9], uint64(time.Now().UnixMilli()))
+	_, _ = rand.Read(nonce[9:])
+	return nonce
+}
+
+// bagSigningPayload builds the payload signed for bag-key based IDS requests:
+// length-prefixed bag key, query string, body and push token.
+func (c *Config) bagSigningPayload(bagKey, queryString string, body []byte) []byte {
+	var buf bytes.Buffer
+	_ = binary.Write(&buf, binary.BigEndian, uint32(len(bagKey)))
+	buf.WriteString(bagKey)
+	_ = binary.Write(&buf, binary.BigEndian, uint32(len(queryString)))
+	buf.WriteString(queryString)
+	_ = binary.Write(&buf, binary.BigEndian, uint32(len(body)))
+	buf.Write(body)
+	_ = binary.Write(&buf, binary.BigEndian, uint32(len(c.PushToken)))
+	buf.Write(c.PushToken)
+	return buf.Bytes()
+}
+
+func signNonced(key *rsa.PrivateKey, payload []byte) (nonce, signature []byte, err error) {
+	nonce = generateNonce()
+	sum := sha1.Sum(append(append([]byte{}, nonce...), payload...))
+	sig, err := rsa.SignPKCS1v15(nil, key, crypto.SHA1, sum[:])
+	if err != nil {
+		return nil, nil, err
+	}
+	return nonce, append([]byte{0x01, 0x01}, sig...), nil
+}
+
+// addPushHeaders signs the payload with the push key.
+func (c *Config) addPushHeaders(req *http.Request, payload []byte) error {
+	if c.PushKey == nil || c.PushCert == nil {
+		return errors.New("missing push certificate or key")
+	}
+	nonce, sig, err := signNonced(c.PushKey, payload)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Push-Nonce", base64.StdEncoding.EncodeToString(nonce))
+	req.Header.Set("X-Push-Cert", base64.StdEncoding.EncodeToString(c.PushCert.Raw))
+	req.Header.Set("X-Push-Token", base64.StdEncoding.EncodeToString(c.PushToken))
+	req.Header.Set("X-Push-Sig", base64.StdEncoding.EncodeToString(sig))
+	return nil
+}
+
+// addAuthHeaders signs the payload with the auth key and certificate.
+func (c *Config) addAuthHeaders(req *http.Request, payload []byte, authCert *x509.Certificate) error {
+	if authCert == nil || c.AuthPrivateKey == nil {
+		return errors.New("missing auth certificate")
+	}
+	nonce, sig, err := signNonced(c.AuthPrivateKey, payload)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Auth-Nonce", base64.StdEncoding.EncodeToString(nonce))
+	req.Header.Set("X-Auth-Cert", base64.StdEncoding.EncodeToString(authCert.Raw))
+	req.Header.Set("X-Auth-Sig", base64.StdEncoding.EncodeToString(sig))
+	return nil
+}
+
+// addIDHeaders signs the payload with the auth key on behalf of the ID
+// certificate, as lookups require.
+func (c *Config) addIDHeaders(req *http.Request, payload []byte, idCert *x509.Certificate) error {
+	if idCert == nil || c.AuthPrivateKey == nil {
+		return errors.New("missing identity certificate")
+	}
+	nonce, sig, err := signNonced(c.AuthPrivateKey, payload)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-ID-Nonce", base64.StdEncoding.EncodeToString(nonce))
+	req.Header.Set("X-ID-Cert", base64.StdEncoding.EncodeToString(idCert.Raw))
+	req.Header.Set("X-ID-Sig", base64.StdEncoding.EncodeToString(sig))
+	return nil
+}
@@ -0,0 +1,130 @@
+package ids
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/google/uuid"
+	"howett.net/plist"
+)
+
+// ErrInvalidRegisterRequest is returned by Register for a request that
+// doesn't match what a real Mac sends, before it's sent. IDS only answers
+// those with a bare 6xxx status.
+var ErrInvalidRegisterRequest = errors.New("invalid register request")
+
+// The keys of each dictionary in a register request from a real Mac. The
+// encoder writes them in sorted order, which is the order Apple's own
+// requests use, so these are kept sorted too.
+var (
+	registerReqKeys = []string{
+		"device-name", "hardware-version", "language", "os-version",
+		"private-device-data", "services", "software-version", "validation-data",
+	}
+	registerServiceKeys = []string{"capabilities", "service", "sub-services", "users"}
+	registerUserKeys    = []string{"client-data", "uris", "user-id"}
+)
+
+// MarshalRegisterReq serializes req the way Register sends it, after
+// checking it with ValidateRegisterReq.
+func MarshalRegisterReq(req *RegisterReq) ([]byte, error) {
+	if err := ValidateRegisterReq(req); err != nil {
+		return nil, err
+	}
+	body, err := plist.Marshal(req, plist.XMLFormat)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal register request: %w", err)
+	}
+	if err := checkRegisterKeys(body); err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+// ValidateRegisterReq checks that req has every field IDS requires, listing
+// each one that's missing or malformed. The push token isn't part of the
+// body, and the URIs are assigned by Apple on a first registration, so only
+// the URIs that are given are checked.
+func ValidateRegisterReq(req *RegisterReq) error {
+	var problems []string
+	missing := func(field string, empty bool) {
+		if empty {
+			problems = append(problems, "missing "+field)
+		}
+	}
+	missing("validation-data", len(req.ValidationData) == 0)
+	missing("device-name", req.DeviceName == "")
+	missing("hardware-version", req.HardwareVersion == "")
+	missing("language", req.Language == "")
+	missing("os-version", req.OSVersion == "")
+	missing("software-version", req.SoftwareVersion == "")
+
+	device := req.PrivateDeviceData
+	missing("private-device-data.u", device.UUID.UUID == uuid.Nil)
+	missing("private-device-data.dt", device.DT == 0)
+	missing("private-device-data.pb", device.SoftwareBuild == "")
+	missing("private-device-data.pn", device.SoftwareName == "")
+	missing("private-device-data.pv", device.SoftwareVersion == "")
+
+	missing("services", len(req.Services) == 0)
+	for i, service := range req.Services {
+		prefix := fmt.Sprintf("services[%d].", i)
+		missing(prefix+"service", service.Service == "")
+		missing(prefix+"capabilities", len(service.Capabilities) == 0)
+		missing(prefix+"users", len(service.Users) == 0)
+		for j, user := range service.Users {
+			prefix := fmt.Sprintf("%susers[%d].", prefix, j)
+			key, _ := user.ClientData["public-message-identity-key"].([]byte)
+			missing(prefix+"client-data.public-message-identity-key", len(key) == 0)
+			_, ok := user.ClientData["public-message-identity-version"]
+			missing(prefix+"client-data.public-message-identity-version", !ok)
+			for k, handle := range user.URIs {
+				uri := handle.URI
+				if (uri.Scheme != SchemeTel && uri.Scheme != SchemeEmail) || uri.Identifier == "" {
+					problems = append(problems, fmt.Sprintf("malformed %suris[%d] %q", prefix, k, uri.String()))
+				}
+			}
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%w: %s", ErrInvalidRegisterRequest, strings.Join(problems, ", "))
+	}
+	return nil
+}
+
+// checkRegisterKeys checks that the dictionaries in a serialized register
+// request have exactly the keys a real Mac's do.
+func checkRegisterKeys(body []byte) error {
+	var req map[string]any
+	if _, err := plist.Unmarshal(body, &req); err != nil {
+		return fmt.Errorf("failed to decode register request: %w", err)
+	}
+	var problems []string
+	check := func(path string, dict map[string]any, want []string) {
+		keys := make([]string, 0, len(dict))
+		for key := range dict {
+			keys = append(keys, key)
+		}
+		slices.Sort(keys)
+		if !slices.Equal(keys, want) {
+			problems = append(problems, fmt.Sprintf("%skeys %v, want %v", path, keys, want))
+		}
+	}
+	check("", req, registerReqKeys)
+	services, _ := req["services"].([]any)
+	for i, s := range services {
+		service, _ := s.(map[string]any)
+		check(fmt.Sprintf("services[%d] ", i), service, registerServiceKeys)
+		users, _ := service["users"].([]any)
+		for j, u := range users {
+			user, _ := u.(map[string]any)
+			check(fmt.Sprintf("services[%d].users[%d] ", i, j), user, registerUserKeys)
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%w: %s", ErrInvalidRegisterRequest, strings.Join(problems, ", "))
+	}
+	return nil
+}
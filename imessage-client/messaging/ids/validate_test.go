@@ -0,0 +1,73 @@
+package ids
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func testRegisterReq() *RegisterReq {
+	return &RegisterReq{
+		DeviceName:      "Mac",
+		HardwareVersion: "Macmini9,1",
+		Language:        "en-US",
+		OSVersion:       "macOS,13.4.1,22F82",
+		SoftwareVersion: "22F82",
+		PrivateDeviceData: PrivateDeviceData{
+			DT:              1,
+			SoftwareBuild:   "22F82",
+			SoftwareName:    "macOS",
+			SoftwareVersion: "13.4.1",
+			UUID:            UUID{UUID: uuid.New()},
+		},
+		Services: []RegisterService{{
+			Capabilities: []RegisterServiceCapabilities{{Flags: 1, Name: "Messenger", Version: 1}},
+			Service:      "com.apple.madrid",
+			Users: []RegisterServiceUser{{
+				ClientData: map[string]any{
+					"public-message-identity-key":     []byte{1},
+					"public-message-identity-version": 2,
+				},
+			}},
+		}},
+		ValidationData: []byte("validation"),
+	}
+}
+
+func TestMarshalRegisterReq(t *testing.T) {
+	body, err := MarshalRegisterReq(testRegisterReq())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Keys come out sorted, as in Apple's requests
+	if i, j := strings.Index(string(body), "<key>services</key>"), strings.Index(string(body), "<key>software-version</key>"); i < 0 || i > j {
+		t.Errorf("keys out of order in %s", body)
+	}
+}
+
+func TestValidateRegisterReqMissingFields(t *testing.T) {
+	req := testRegisterReq()
+	req.ValidationData = nil
+	req.Services[0].Users[0].ClientData = map[string]any{"public-message-identity-version": 2}
+	req.Services[0].Users[0].URIs = []Handle{{URI: ParsedURI{Scheme: SchemeTel}}}
+
+	err := ValidateRegisterReq(req)
+	if !errors.Is(err, ErrInvalidRegisterRequest) {
+		t.Fatalf("err = %v, want ErrInvalidRegisterRequest", err)
+	}
+	for _, want := range []string{
+		"missing validation-data",
+		"missing services[0].users[0].client-data.public-message-identity-key",
+		"malformed services[0].users[0].uris[0]",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q doesn't mention %q", err, want)
+		}
+	}
+
+	if err := ValidateRegisterReq(&RegisterReq{}); !strings.Contains(err.Error(), "missing services") {
+		t.Errorf("empty request: %v", err)
+	}
+}
@@ -0,0 +1,146 @@
+package messaging
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"imessage-client/messaging/apns"
+	"imessage-client/messaging/ids"
+)
+
+var ErrBadSignature = errors.New("message signature verification failed")
+
+// errStaleKeys is returned by buildDTL when some device's keys from the
+// lookup couldn't be used, which usually means the cached lookup is stale.
+type errStaleKeys struct {
+	Handles []string
+	Err     error
+}
+
+func (e errStaleKeys) Error() string {
+	return fmt.Sprintf("unusable keys for %v: %v", e.Handles, e.Err)
+}
+
+func (e errStaleKeys) Unwrap() error {
+	return e.Err
+}
+
+// VerifyPairSignature checks the sender's signature on a "pair" encrypted
+// payload as produced by EncryptPairPayload.
+func VerifyPairSignature(sender *ids.UserIdentity, payload []byte) error {
+	parsed, err := ParseBody(payload)
+	if err != nil {
+		return fmt.Errorf("failed to parse body: %w", err)
+	}
+	hash := sha1.Sum(parsed.Body)
+	if !ecdsa.VerifyASN1(sender.SigningKey, hash[:], parsed.Signature) {
+		return ErrBadSignature
+	}
+	return nil
+}
+
+// verifyTimeout bounds the lookups verifySender makes. It runs in the APNS
+// read loop before the message is acked, so a slow lookup holds up every
+// other push.
+var verifyTimeout = 5 * time.Second
+
+// verifySender checks the signature of an incoming message against the
+// sending device's identity from the lookup cache. If the signature doesn't
+// match (or the device isn't known), the cached lookup is thrown away and the
+// check retried once with fresh keys. Failing lookups, including ones that
+// take longer than verifyTimeout, aren't treated as bad signatures: the
+// message is accepted unverified.
+func (s *Session) verifySender(ctx context.Context, madrid *apns.MadridPayload) error {
+	if madrid.SenderID == "" || len(madrid.Token) == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, verifyTimeout)
+	defer cancel()
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		if attempt > 0 {
+			s.InvalidateLookup(madrid.SenderID)
+		}
+		var results map[string]*ids.LookupResult
+		results, err = s.Lookup(ctx, []string{madrid.SenderID})
+		if err != nil {
+			slog.Warn("Couldn't look up sender to verify their message", "sender", madrid.SenderID, "err", err)
+			return nil
+		}
+		err = verifyDevice(results[madrid.SenderID], madrid)
+		if err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func verifyDevice(result *ids.LookupResult, madrid *apns.MadridPayload) error {
+	if result == nil {
+		return fmt.Errorf("%w: %s isn't on iMessage", ErrBadSignature, madrid.SenderID)
+	}
+	ident := result.FindIdentity(madrid.Token)
+	if ident == nil {
+		return fmt.Errorf("%w: sending device isn't registered to %s", ErrBadSignature, madrid.SenderID)
+	}
+	identity, err := ident.IdentityKey()
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrBadSignature, err)
+	}
+	return VerifyPairSignature(identity, madrid.Payload)
+}
+
+// sentMessage is a message we sent that may be sent again once if a
+// recipient's device reports it couldn't decrypt it.
+type sentMessage struct {
+	OutgoingMessage
+	retried bool
+	// timer fires when the delivery timeout runs out
+	timer *time.Timer
+}
+
+// rememberSent keeps what's needed to resend message id until its delivery
+// is resolved.
+func (s *Session) rememberSent(msg OutgoingMessage) {
+	s.deliveryMu.Lock()
+	defer s.deliveryMu.Unlock()
+	if s.sentMessages == nil {
+		s.sentMessages = make(map[string]*sentMessage)
+	}
+	sent := &sentMessage{OutgoingMessage: msg}
+	s.sentMessages[msg.ID] = sent
+	s.startDeliveryTimerLocked(msg.ID, sent)
+}
+
+// retryFailedDelivery handles a delivery failure reported by a recipient's
+// device. The first failure of a message invalidates the cached keys of the
+// handle that reported it and sends the message again. It reports whether
+// a retry was started, in which case the failure isn't final yet.
+func (s *Session) retryFailedDelivery(id string, failed *apns.MadridPayload) bool {
+	s.deliveryMu.Lock()
+	sent, ok := s.sentMessages[id]
+	if !ok || sent.retried {
+		s.deliveryMu.Unlock()
+		return false
+	}
+	sent.retried = true
+	s.deliveryMu.Unlock()
+
+	if failed.SenderID != "" {
+		s.InvalidateLookup(failed.SenderID)
+	}
+	s.InvalidateLookup(sent.Chat)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		if err := s.send(ctx, sent.OutgoingMessage); err != nil {
+			s.resolveDelivery(id, Delivery{State: DeliveryFailed, At: time.Now(), Err: err})
+		}
+	}()
+	return true
+}
@@ -0,0 +1,299 @@
+package messaging
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io"
+	"math/big"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"howett.net/plist"
+
+	"imessage-client/messaging/apns"
+	"imessage-client/messaging/apns/apnstest"
+	"imessage-client/messaging/ids"
+)
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// fakeLookups answers the session's IDS lookups with the devices in
+// lookups, and returns a counter of lookup requests.
+func fakeLookups(t *testing.T, session *Session, lookups map[string][]*testDevice) *atomic.Int32 {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "id cert"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := session.state.IDSConfig
+	cfg.ProfileID = "D:123"
+	cfg.AuthPrivateKey = key
+	cfg.AuthIDCertPairs = map[string]*ids.AuthIDCertPair{"D:123": {IDCert: cert}}
+	cfg.PushKey = key
+	cfg.PushCert = cert
+
+	results := make(map[string]any)
+	for handle, devices := range lookups {
+		identities := []any{}
+		for _, device := range devices {
+			identities = append(identities, map[string]any{
+				"push-token":  device.token,
+				"client-data": device.ident.ClientData,
+			})
+		}
+		results[handle] = map[string]any{"status": 0, "identities": identities}
+	}
+	body, err := plist.Marshal(map[string]any{"status": 0, "results": results}, plist.XMLFormat)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var count atomic.Int32
+	session.SetIDSClient(ids.NewHTTPClientWithClient(&http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		count.Add(1)
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       io.NopCloser(bytes.NewReader(body)),
+			Request:    req,
+		}, nil
+	})}))
+	return &count
+}
+
+// staleIdentity is a lookup identity for device's push token with keys that
+// can't be used.
+func staleIdentity(device *testDevice) *testDevice {
+	stale := *device
+	stale.ident.ClientData = map[string]any{"public-message-identity-key": []byte("garbage")}
+	return &stale
+}
+
+func TestVerifyPairSignature(t *testing.T) {
+	sender := newTestDevice(t, "sender")
+	receiver := newTestDevice(t, "receiver")
+	payload, err := EncryptPairPayload(sender.signing, sender.identity, receiver.identity, []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyPairSignature(sender.identity, payload); err != nil {
+		t.Errorf("valid signature: %v", err)
+	}
+	if err := VerifyPairSignature(receiver.identity, payload); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("wrong key err = %v, want ErrBadSignature", err)
+	}
+}
+
+func TestSendRefreshesStaleRecipientKeys(t *testing.T) {
+	server, err := apnstest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	me := newTestDevice(t, "me")
+	theirPhone := newTestDevice(t, "their-phone")
+	const them = "tel:+15555550123"
+	session := testSendSession(t, me, map[string][]*testDevice{
+		them:                    {staleIdentity(theirPhone)},
+		"mailto:me@example.com": {me},
+	})
+	session.state.APNSConn = testAPNSConnection(t, server)
+	lookups := fakeLookups(t, session, map[string][]*testDevice{them: {theirPhone}})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := session.Send(ctx, them, "hello", SendOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if n := lookups.Load(); n != 1 {
+		t.Errorf("looked up %d times, want 1", n)
+	}
+	sent, err := server.WaitFor(ctx, apns.CommandSendMessage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	madrid, err := apns.ParseMadridPayload(sent.Field(apns.FieldOutgoingPayload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(madrid.DTL) != 1 {
+		t.Fatalf("DTL has %d entries", len(madrid.DTL))
+	}
+	if _, err := DecryptMessage(theirPhone.key, madrid.DTL[0].Payload); err != nil {
+		t.Errorf("recipient can't decrypt: %v", err)
+	}
+}
+
+func TestSendFailsWhenEveryRecipientDeviceIsStale(t *testing.T) {
+	server, err := apnstest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	me := newTestDevice(t, "me")
+	myMac := newTestDevice(t, "my-mac")
+	theirPhone := newTestDevice(t, "their-phone")
+	const them = "tel:+15555550123"
+	session := testSendSession(t, me, map[string][]*testDevice{
+		them:                    {staleIdentity(theirPhone)},
+		"mailto:me@example.com": {me, myMac},
+	})
+	session.state.APNSConn = testAPNSConnection(t, server)
+	// Looking them up again still gives unusable keys
+	fakeLookups(t, session, map[string][]*testDevice{
+		them:                    {staleIdentity(theirPhone)},
+		"mailto:me@example.com": {me, myMac},
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err = session.Send(ctx, them, "hello", SendOptions{})
+	var stale errStaleKeys
+	if !errors.As(err, &stale) {
+		t.Fatalf("err = %v, want errStaleKeys", err)
+	}
+	if n := countCommands(server, apns.CommandSendMessage); n != 0 {
+		t.Errorf("sent %d commands to our own devices only", n)
+	}
+}
+
+func TestVerifySenderRefreshesChangedKeys(t *testing.T) {
+	me := newTestDevice(t, "me")
+	theirPhone := newTestDevice(t, "their-phone")
+	impostor := newTestDevice(t, "their-phone")
+	const them = "tel:+15555550123"
+
+	payload, err := EncryptPairPayload(theirPhone.signing, theirPhone.identity, me.identity, []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	madrid := &apns.MadridPayload{SenderID: them, Token: theirPhone.token, Payload: payload}
+
+	// The cached identity is outdated, the fresh lookup has the real one
+	session := testSendSession(t, me, map[string][]*testDevice{them: {impostor}})
+	lookups := fakeLookups(t, session, map[string][]*testDevice{them: {theirPhone}})
+	if err := session.verifySender(context.Background(), madrid); err != nil {
+		t.Errorf("verify with refreshed keys: %v", err)
+	}
+	if n := lookups.Load(); n != 1 {
+		t.Errorf("looked up %d times, want 1", n)
+	}
+
+	// Still the wrong key after looking up again
+	session = testSendSession(t, me, map[string][]*testDevice{them: {impostor}})
+	fakeLookups(t, session, map[string][]*testDevice{them: {impostor}})
+	if err := session.verifySender(context.Background(), madrid); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("err = %v, want ErrBadSignature", err)
+	}
+}
+
+func TestVerifySenderFailsOpenOnSlowLookup(t *testing.T) {
+	me := newTestDevice(t, "me")
+	theirPhone := newTestDevice(t, "their-phone")
+	const them = "tel:+15555550123"
+	payload, err := EncryptPairPayload(theirPhone.signing, theirPhone.identity, me.identity, []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	madrid := &apns.MadridPayload{SenderID: them, Token: theirPhone.token, Payload: payload}
+
+	old := verifyTimeout
+	verifyTimeout = 50 * time.Millisecond
+	t.Cleanup(func() { verifyTimeout = old })
+
+	session := testSendSession(t, me, map[string][]*testDevice{})
+	fakeLookups(t, session, nil)
+	session.SetIDSClient(ids.NewHTTPClientWithClient(&http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		<-req.Context().Done()
+		return nil, req.Context().Err()
+	})}))
+
+	start := time.Now()
+	if err := session.verifySender(context.Background(), madrid); err != nil {
+		t.Errorf("err = %v, want the message accepted unverified", err)
+	}
+	if took := time.Since(start); took > time.Second {
+		t.Errorf("verify took %v with a hanging lookup", took)
+	}
+}
+
+func TestDeliveryFailureResendsOnce(t *testing.T) {
+	server, err := apnstest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	me := newTestDevice(t, "me")
+	theirPhone := newTestDevice(t, "their-phone")
+	const them = "tel:+15555550123"
+	session := testSendSession(t, me, map[string][]*testDevice{
+		them:                    {theirPhone},
+		"mailto:me@example.com": {me},
+	})
+	session.state.APNSConn = testAPNSConnection(t, server)
+	lookups := fakeLookups(t, session, map[string][]*testDevice{them: {theirPhone}})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	result, err := session.Send(ctx, them, "hello", SendOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := uuid.MustParse(result.MessageUUID)
+	failure := &apns.MadridPayload{Command: apns.MessageTypeDeliveryFailure, MessageUUID: id[:], SenderID: them}
+
+	session.handleReceipt(failure)
+	select {
+	case d := <-result.Delivered():
+		t.Fatalf("first failure resolved delivery: %+v", d)
+	case <-time.After(100 * time.Millisecond):
+	}
+	// The resend looks the recipient up again and sends a second copy
+	deadline := time.Now().Add(5 * time.Second)
+	for countCommands(server, apns.CommandSendMessage) < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := countCommands(server, apns.CommandSendMessage); n != 2 {
+		t.Errorf("sent %d times, want 2", n)
+	}
+	if n := lookups.Load(); n != 1 {
+		t.Errorf("looked up %d times, want 1", n)
+	}
+
+	session.handleReceipt(failure)
+	d, err := result.Wait(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.State != DeliveryFailed {
+		t.Errorf("state = %s, want failed", d.State)
+	}
+}
@@ -0,0 +1,157 @@
+package messaging
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"imessage-client/messaging/ids"
+)
+
+// DefaultLookupTTL is how long an IDS lookup result is reused before the
+// handle is looked up again.
+const DefaultLookupTTL = time.Hour
+
+// LookupCache holds IDS lookup results (identity keys and push tokens of a
+// handle's devices) keyed by handle, so messages to the same person don't
+// each need a lookup round trip.
+type LookupCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[string]*ids.LookupResult
+}
+
+// NewLookupCache creates a cache whose entries expire after ttl.
+// A ttl of zero disables caching.
+func NewLookupCache(ttl time.Duration) *LookupCache {
+	return &LookupCache{ttl: ttl, entries: make(map[string]*ids.LookupResult)}
+}
+
+// SetTTL changes how long entries are reused, including ones already cached.
+func (c *LookupCache) SetTTL(ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ttl = ttl
+}
+
+// Get returns the cached result for handle if it hasn't expired.
+func (c *LookupCache) Get(handle string) (*ids.LookupResult, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	result, ok := c.entries[handle]
+	if !ok {
+		return nil, false
+	}
+	if time.Since(result.Time) >= c.ttl {
+		delete(c.entries, handle)
+		return nil, false
+	}
+	return result, true
+}
+
+// Put caches result for handle. Results without a time are stamped now.
+func (c *LookupCache) Put(handle string, result *ids.LookupResult) {
+	if result.Time.IsZero() {
+		result.Time = time.Now()
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ttl <= 0 {
+		return
+	}
+	c.entries[handle] = result
+}
+
+// Invalidate drops the cached result for handle, e.g. after a send to one of
+// its devices failed and its keys or tokens may have changed.
+func (c *LookupCache) Invalidate(handle string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, handle)
+}
+
+// Clear drops every cached result.
+func (c *LookupCache) Clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	clear(c.entries)
+}
+
+// SetLookupCache replaces the session's lookup cache, so several sessions
+// can share one.
+func (s *Session) SetLookupCache(cache *LookupCache) {
+	if cache != nil {
+		s.lookupCache = cache
+	}
+}
+
+// InvalidateLookup drops the cached lookup result for handle. Call it when a
+// send to handle fails so the next send looks it up again.
+func (s *Session) InvalidateLookup(handle string) {
+	s.lookupCache.Invalidate(handle)
+}
+
+// Lookup returns the devices registered to each handle, from the cache where
+// possible. Handles that aren't on iMessage map to a result without
+// identities. Uncached handles are looked up together in as few IDS queries
+// as possible, so this should be preferred over one call per recipient.
+func (s *Session) Lookup(ctx context.Context, handles []string) (map[string]*ids.LookupResult, error) {
+	results := make(map[string]*ids.LookupResult, len(handles))
+	var missing []ids.ParsedURI
+	for _, handle := range handles {
+		if _, seen := results[handle]; seen {
+			continue
+		}
+		if result, ok := s.lookupCache.Get(handle); ok {
+			results[handle] = result
+			continue
+		}
+		uri, err := ids.ParseURI(handle)
+		if err != nil {
+			return nil, err
+		}
+		// Placeholder so duplicates are only looked up once
+		results[handle] = nil
+		missing = append(missing, uri)
+	}
+	if len(missing) == 0 {
+		return results, nil
+	}
+
+	if err := s.ensureHandshake(); err != nil {
+		return nil, err
+	}
+	if s.state.IDSConfig == nil {
+		return nil, ErrHandshakeNotImplemented
+	}
+	serverResults, err := s.idsClient.Lookup(ctx, s.state.IDSConfig, s.state.IDSConfig.DefaultHandle, missing)
+	if err != nil {
+		return nil, fmt.Errorf("IDS lookup failed: %w", err)
+	}
+	for _, uri := range missing {
+		result, ok := serverResults[uri]
+		if !ok {
+			// Cache the absence too, so unknown handles aren't looked up every time
+			result = &ids.LookupResult{Time: time.Now()}
+		}
+		s.lookupCache.Put(uri.String(), result)
+		results[uri.String()] = result
+	}
+	return results, nil
+}
+
+// Lookup returns the devices registered to each handle.
+func (c *Client) Lookup(ctx context.Context, handles []string) (map[string]*ids.LookupResult, error) {
+	session, err := c.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return session.Lookup(ctx, handles)
+}
+
+// SetLookupTTL changes how long lookup results are reused across the
+// client's sessions.
+func (c *Client) SetLookupTTL(ttl time.Duration) {
+	c.lookupCache.SetTTL(ttl)
+}
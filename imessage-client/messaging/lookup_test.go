@@ -0,0 +1,33 @@
+package messaging
+
+import (
+	"testing"
+	"time"
+
+	"imessage-client/messaging/ids"
+)
+
+func TestLookupCache(t *testing.T) {
+	cache := NewLookupCache(time.Hour)
+
+	cache.Put("mailto:fresh@example.com", &ids.LookupResult{})
+	cache.Put("mailto:stale@example.com", &ids.LookupResult{Time: time.Now().Add(-2 * time.Hour)})
+
+	if _, ok := cache.Get("mailto:fresh@example.com"); !ok {
+		t.Error("fresh result not cached")
+	}
+	if _, ok := cache.Get("mailto:stale@example.com"); ok {
+		t.Error("expired result returned")
+	}
+
+	cache.Invalidate("mailto:fresh@example.com")
+	if _, ok := cache.Get("mailto:fresh@example.com"); ok {
+		t.Error("invalidated result returned")
+	}
+
+	cache.SetTTL(0)
+	cache.Put("mailto:fresh@example.com", &ids.LookupResult{})
+	if _, ok := cache.Get("mailto:fresh@example.com"); ok {
+		t.Error("result cached with caching disabled")
+	}
+}
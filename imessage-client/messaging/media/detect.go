@@ -0,0 +1,64 @@
+package media
+
+import (
+	"bytes"
+	"image"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// Info describes a file about to be attached.
+type Info struct {
+	MimeType string
+	UTIType  string
+	// Width and Height are the pixel dimensions of images Go can decode, or
+	// zero.
+	Width  int
+	Height int
+}
+
+// utiTypes maps MIME types to the uniform type identifiers Apple clients
+// expect next to them.
+var utiTypes = map[string]string{
+	"image/jpeg":      "public.jpeg",
+	"image/png":       "public.png",
+	"image/gif":       "com.compuserve.gif",
+	"image/heic":      "public.heic",
+	"image/heif":      "public.heif",
+	"image/webp":      "org.webmproject.webp",
+	"video/mp4":       "public.mpeg-4",
+	"video/quicktime": "com.apple.quicktime-movie",
+	"audio/mpeg":      "public.mp3",
+	"audio/mp4":       "public.mpeg-4-audio",
+	"audio/x-m4a":     "com.apple.m4a-audio",
+	"application/pdf": "com.adobe.pdf",
+	"text/plain":      "public.plain-text",
+	"text/vcard":      "public.vcard",
+	"text/x-vcard":    "public.vcard",
+}
+
+// Detect works out the MIME type, UTI and image dimensions of a file from
+// its name and contents. The extension wins when it's known, since content
+// sniffing can't tell e.g. HEIC or vCards apart from generic data.
+func Detect(name string, data []byte) Info {
+	mimeType := mime.TypeByExtension(strings.ToLower(filepath.Ext(name)))
+	if mimeType == "" || mimeType == "application/octet-stream" {
+		mimeType = http.DetectContentType(data)
+	}
+	if parsed, _, err := mime.ParseMediaType(mimeType); err == nil {
+		// Drop parameters like "; charset=utf-8"
+		mimeType = parsed
+	}
+	info := Info{MimeType: mimeType, UTIType: "public.data"}
+	if uti, ok := utiTypes[mimeType]; ok {
+		info.UTIType = uti
+	}
+	if strings.HasPrefix(mimeType, "image/") {
+		if cfg, _, err := image.DecodeConfig(bytes.NewReader(data)); err == nil {
+			info.Width, info.Height = cfg.Width, cfg.Height
+		}
+	}
+	return info
+}
@@ -0,0 +1,36 @@
+//go:build libheif
+
+package media
+
+import (
+	"fmt"
+	"image"
+
+	"github.com/strukturag/libheif/go/heif"
+)
+
+// CanConvertHEIF reports whether this build can decode HEIC/HEIF images.
+const CanConvertHEIF = true
+
+func decodeHEIF(data []byte) (image.Image, error) {
+	ctx, err := heif.NewContext()
+	if err != nil {
+		return nil, fmt.Errorf("can't create context: %w", err)
+	}
+	if err = ctx.ReadFromMemory(data); err != nil {
+		return nil, fmt.Errorf("can't read from memory: %w", err)
+	}
+	handle, err := ctx.GetPrimaryImageHandle()
+	if err != nil {
+		return nil, fmt.Errorf("can't read primary image: %w", err)
+	}
+	heifImg, err := handle.DecodeImage(heif.ColorspaceUndefined, heif.ChromaUndefined, nil)
+	if err != nil {
+		return nil, fmt.Errorf("can't decode image: %w", err)
+	}
+	img, err := heifImg.GetImage()
+	if err != nil {
+		return nil, fmt.Errorf("can't convert image: %w", err)
+	}
+	return img, nil
+}
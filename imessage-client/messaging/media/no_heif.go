@@ -0,0 +1,15 @@
+//go:build !libheif
+
+package media
+
+import (
+	"errors"
+	"image"
+)
+
+// CanConvertHEIF reports whether this build can decode HEIC/HEIF images.
+const CanConvertHEIF = false
+
+func decodeHEIF(_ []byte) (image.Image, error) {
+	return nil, errors.New("imessage-client was compiled without libheif")
+}
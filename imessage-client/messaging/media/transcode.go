@@ -0,0 +1,138 @@
+// Package media prepares outgoing attachments before upload.
+package media
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"strings"
+
+	"golang.org/x/image/draw"
+)
+
+// DefaultJPEGQuality is used when TranscodeOptions.JPEGQuality is unset.
+const DefaultJPEGQuality = 85
+
+// TranscodeOptions controls how outgoing images are rewritten.
+type TranscodeOptions struct {
+	// ConvertHEIC re-encodes HEIC/HEIF images as JPEG. Requires the libheif build tag.
+	ConvertHEIC bool
+	// MaxDimension downscales images whose width or height exceeds it. Zero disables scaling.
+	MaxDimension int
+	// JPEGQuality is the quality (1-100) for re-encoded JPEGs.
+	JPEGQuality int
+}
+
+// Enabled reports whether any transcoding was requested.
+func (o TranscodeOptions) Enabled() bool {
+	return o.ConvertHEIC || o.MaxDimension > 0
+}
+
+func (o TranscodeOptions) quality() int {
+	if o.JPEGQuality <= 0 || o.JPEGQuality > 100 {
+		return DefaultJPEGQuality
+	}
+	return o.JPEGQuality
+}
+
+// IsHEIF reports whether the MIME type is a HEIC/HEIF image.
+func IsHEIF(mimeType string) bool {
+	switch strings.ToLower(mimeType) {
+	case "image/heic", "image/heif", "image/heic-sequence", "image/heif-sequence":
+		return true
+	default:
+		return false
+	}
+}
+
+// Transcode applies opts to an image attachment and returns the new data and
+// MIME type. Non-image data, GIFs (which may be animated), and images that
+// need no changes are returned as-is. PNGs with transparency stay PNGs;
+// everything else is re-encoded as JPEG, with any EXIF orientation applied.
+func Transcode(data []byte, mimeType string, opts TranscodeOptions) ([]byte, string, error) {
+	if !opts.Enabled() || !strings.HasPrefix(strings.ToLower(mimeType), "image/") {
+		return data, mimeType, nil
+	}
+
+	var img image.Image
+	var format string
+	var err error
+	heif := IsHEIF(mimeType)
+	switch {
+	case heif && opts.ConvertHEIC:
+		if img, err = decodeHEIF(data); err != nil {
+			return nil, "", fmt.Errorf("failed to decode HEIF: %w", err)
+		}
+	case heif:
+		// HEIF can't be scaled without converting it.
+		return data, mimeType, nil
+	default:
+		var cfg image.Config
+		cfg, format, err = image.DecodeConfig(bytes.NewReader(data))
+		if err != nil || format == "gif" || !needsScaling(cfg.Width, cfg.Height, opts.MaxDimension) {
+			// Unknown formats, GIFs and small images are passed through untouched.
+			return data, mimeType, nil
+		}
+		if img, _, err = image.Decode(bytes.NewReader(data)); err != nil {
+			return nil, "", fmt.Errorf("failed to decode image: %w", err)
+		}
+	}
+
+	bounds := img.Bounds()
+	if needsScaling(bounds.Dx(), bounds.Dy(), opts.MaxDimension) {
+		img = scale(img, opts.MaxDimension)
+	}
+	if format == "jpeg" {
+		img = orient(img, jpegOrientation(data))
+	}
+
+	var out bytes.Buffer
+	if format == "png" && !opaque(img) {
+		if err = png.Encode(&out, img); err != nil {
+			return nil, "", fmt.Errorf("failed to encode PNG: %w", err)
+		}
+		return out.Bytes(), "image/png", nil
+	}
+	if err = jpeg.Encode(&out, img, &jpeg.Options{Quality: opts.quality()}); err != nil {
+		return nil, "", fmt.Errorf("failed to encode JPEG: %w", err)
+	}
+	return out.Bytes(), "image/jpeg", nil
+}
+
+// opaque reports whether img has no transparent pixels. Images that can't
+// say are assumed to have some.
+func opaque(img image.Image) bool {
+	if o, ok := img.(interface{ Opaque() bool }); ok {
+		return o.Opaque()
+	}
+	return false
+}
+
+func needsScaling(width, height, maxDimension int) bool {
+	return maxDimension > 0 && (width > maxDimension || height > maxDimension)
+}
+
+// scale resizes img so its longest side is maxDimension, keeping the aspect ratio.
+func scale(img image.Image, maxDimension int) image.Image {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width >= height {
+		height = height * maxDimension / width
+		width = maxDimension
+	} else {
+		width = width * maxDimension / height
+		height = maxDimension
+	}
+	if width < 1 {
+		width = 1
+	}
+	if height < 1 {
+		height = 1
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, bounds, draw.Src, nil)
+	return dst
+}
@@ -0,0 +1,179 @@
+package media
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+// testImage is white with a red top row, fully opaque unless alpha is set.
+func testImage(width, height int, alpha uint8) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			c := color.NRGBA{R: 255, G: 255, B: 255, A: alpha}
+			if y == 0 {
+				c.G, c.B = 0, 0
+			}
+			img.Set(x, y, c)
+		}
+	}
+	return img
+}
+
+func testPNG(t *testing.T, width, height int) []byte {
+	t.Helper()
+	img := testImage(width, height, 255)
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestTranscodeDownscales(t *testing.T) {
+	data := testPNG(t, 200, 100)
+	out, mimeType, err := Transcode(data, "image/png", TranscodeOptions{MaxDimension: 50})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mimeType != "image/jpeg" {
+		t.Errorf("MIME type %q, want image/jpeg", mimeType)
+	}
+	cfg, err := jpeg.DecodeConfig(bytes.NewReader(out))
+	if err != nil {
+		t.Fatalf("output isn't a JPEG: %v", err)
+	}
+	if cfg.Width != 50 || cfg.Height != 25 {
+		t.Errorf("scaled to %dx%d, want 50x25", cfg.Width, cfg.Height)
+	}
+}
+
+func TestTranscodePassesThrough(t *testing.T) {
+	small := testPNG(t, 40, 20)
+	for _, tt := range []struct {
+		name     string
+		data     []byte
+		mimeType string
+		opts     TranscodeOptions
+	}{
+		{"disabled", small, "image/png", TranscodeOptions{}},
+		{"small image", small, "image/png", TranscodeOptions{MaxDimension: 50}},
+		{"not an image", []byte("hello"), "text/plain", TranscodeOptions{MaxDimension: 50}},
+		{"undecodable image", []byte("not a png"), "image/png", TranscodeOptions{MaxDimension: 50}},
+		{"HEIC without converting", []byte("heic"), "image/heic", TranscodeOptions{MaxDimension: 50}},
+	} {
+		out, mimeType, err := Transcode(tt.data, tt.mimeType, tt.opts)
+		if err != nil || mimeType != tt.mimeType || !bytes.Equal(out, tt.data) {
+			t.Errorf("%s: changed to %q, err %v", tt.name, mimeType, err)
+		}
+	}
+}
+
+func TestTranscodeHEICWithoutLibheif(t *testing.T) {
+	if CanConvertHEIF {
+		t.Skip("built with libheif")
+	}
+	if _, _, err := Transcode([]byte("heic"), "image/heic", TranscodeOptions{ConvertHEIC: true}); err == nil {
+		t.Error("converted HEIC without libheif")
+	}
+}
+
+func TestTranscodePassesGIFThrough(t *testing.T) {
+	img := image.NewPaletted(image.Rect(0, 0, 200, 100), color.Palette{color.White, color.Black})
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, &gif.GIF{Image: []*image.Paletted{img, img}, Delay: []int{10, 10}}); err != nil {
+		t.Fatal(err)
+	}
+	out, mimeType, err := Transcode(buf.Bytes(), "image/gif", TranscodeOptions{MaxDimension: 50})
+	if err != nil || mimeType != "image/gif" || !bytes.Equal(out, buf.Bytes()) {
+		t.Errorf("GIF changed to %q, err %v", mimeType, err)
+	}
+}
+
+func TestTranscodeKeepsTransparentPNG(t *testing.T) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, testImage(200, 100, 128)); err != nil {
+		t.Fatal(err)
+	}
+	out, mimeType, err := Transcode(buf.Bytes(), "image/png", TranscodeOptions{MaxDimension: 50})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mimeType != "image/png" {
+		t.Errorf("MIME type %q, want image/png", mimeType)
+	}
+	img, err := png.Decode(bytes.NewReader(out))
+	if err != nil {
+		t.Fatalf("output isn't a PNG: %v", err)
+	}
+	if b := img.Bounds(); b.Dx() != 50 || b.Dy() != 25 {
+		t.Errorf("scaled to %dx%d, want 50x25", b.Dx(), b.Dy())
+	}
+	if _, _, _, a := img.At(25, 12).RGBA(); a == 0xffff {
+		t.Error("transparency lost")
+	}
+}
+
+// withOrientation inserts an EXIF segment with the given orientation after
+// the JPEG's start-of-image marker.
+func withOrientation(jpg []byte, orientation uint16) []byte {
+	tiff := []byte("MM\x00\x2a\x00\x00\x00\x08\x00\x01")
+	entry := make([]byte, 12)
+	binary.BigEndian.PutUint16(entry[0:], 0x0112)
+	binary.BigEndian.PutUint16(entry[2:], 3) // SHORT
+	binary.BigEndian.PutUint32(entry[4:], 1)
+	binary.BigEndian.PutUint16(entry[8:], orientation)
+	tiff = append(tiff, entry...)
+	tiff = append(tiff, 0, 0, 0, 0) // no next IFD
+	segment := append([]byte("Exif\x00\x00"), tiff...)
+
+	out := []byte{0xFF, 0xD8, 0xFF, 0xE1, 0, 0}
+	binary.BigEndian.PutUint16(out[4:], uint16(len(segment)+2))
+	out = append(out, segment...)
+	return append(out, jpg[2:]...)
+}
+
+func TestTranscodeAppliesEXIFOrientation(t *testing.T) {
+	img := testImage(200, 100, 255)
+	for y := 1; y < 40; y++ {
+		for x := 0; x < 200; x++ {
+			img.Set(x, y, color.NRGBA{R: 255, A: 255})
+		}
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, nil); err != nil {
+		t.Fatal(err)
+	}
+	// Stored landscape, but the camera was turned: it displays rotated
+	// clockwise, so the red top ends up on the right
+	data := withOrientation(buf.Bytes(), 6)
+	if o := jpegOrientation(data); o != 6 {
+		t.Fatalf("read orientation %d, want 6", o)
+	}
+	out, mimeType, err := Transcode(data, "image/jpeg", TranscodeOptions{MaxDimension: 50})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mimeType != "image/jpeg" {
+		t.Errorf("MIME type %q, want image/jpeg", mimeType)
+	}
+	rotated, err := jpeg.Decode(bytes.NewReader(out))
+	if err != nil {
+		t.Fatalf("output isn't a JPEG: %v", err)
+	}
+	if b := rotated.Bounds(); b.Dx() != 25 || b.Dy() != 50 {
+		t.Fatalf("output is %dx%d, want 25x50", b.Dx(), b.Dy())
+	}
+	if r, g, _, _ := rotated.At(24, 25).RGBA(); r < 0x8000 || g > 0x8000 {
+		t.Error("right edge isn't red after rotating")
+	}
+	if _, g, _, _ := rotated.At(0, 25).RGBA(); g < 0x8000 {
+		t.Error("left edge isn't white after rotating")
+	}
+}
@@ -1,22 +1,95 @@
 package messaging
 
-import "time"
+import (
+	"strings"
+	"time"
+
+	"imessage-client/messaging/apns"
+)
+
+// Services a message can come in on.
+const (
+	ServiceIMessage = "iMessage"
+	// ServiceSMS is an SMS or MMS relayed through the user's iPhone.
+	ServiceSMS = "SMS"
+)
 
 // Message is a simplified iMessage payload representation for the CLI.
 type Message struct {
-	ID        string
-	Chat      string
-	Sender    string
-	Text      string
-	Timestamp time.Time
-	Service   string
+	ID        string    `json:"id"`
+	Chat      string    `json:"chat"`
+	Sender    string    `json:"sender"`
+	Text      string    `json:"text,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+	Service   string    `json:"service,omitempty"`
+
+	// Participants are the handles in the chat, ours included.
+	Participants []string `json:"participants,omitempty"`
+	// ChatGUID is Apple's identifier for the chat, like
+	// "iMessage;-;+15555550123" or "iMessage;+;chat123".
+	ChatGUID  string `json:"chat_guid,omitempty"`
+	GroupName string `json:"group_name,omitempty"`
+	// IsFromMe is set for messages sent from our other devices.
+	IsFromMe bool `json:"is_from_me,omitempty"`
+	// ReplyToID is the UUID of the message this one replies to.
+	ReplyToID string `json:"reply_to_id,omitempty"`
+
+	Attachments []Attachment `json:"attachments,omitempty"`
+	// Formatting is the styled runs of Text, from the attributed body.
+	Formatting []TextRange `json:"formatting,omitempty"`
+
+	// Sequence is the local arrival order. Unlike Timestamp it is strictly
+	// increasing, so it is used for ordering, and subscribers resume from
+	// it with SubscribeOptions.After. It grows by one per message within a
+	// session and keeps increasing across sessions.
+	Sequence uint64 `json:"sequence"`
 }
 
 // ToSummary converts a full message to a MessageSummary for notifier output.
 func (m Message) ToSummary() MessageSummary {
 	return MessageSummary{
 		Sender:    m.Sender,
+		Chat:      m.Chat,
 		Preview:   m.Text,
 		Timestamp: m.Timestamp,
+		Service:   m.Service,
+	}
+}
+
+// messageService works out which service a message came in on from the
+// topic hash it was pushed on and its madrid command.
+func messageService(topic string, madrid *apns.MadridPayload) string {
+	if topic == string(apns.TopicAlloySMS.Hash()) || (madrid != nil && madrid.Command.IsSMS()) {
+		return ServiceSMS
+	}
+	return ServiceIMessage
+}
+
+// chatGUID builds Apple's identifier for a chat on service: the group ID for
+// groups, or the other side's handle without its tel:/mailto: prefix for DMs.
+func chatGUID(service, chat string, group bool) string {
+	if group {
+		return service + ";+;" + chat
+	}
+	handle := strings.TrimPrefix(strings.TrimPrefix(chat, "tel:"), "mailto:")
+	return service + ";-;" + handle
+}
+
+// replyToID returns the UUID of the message this one replies to, if any.
+func (p *IMessagePayload) replyToID() string {
+	if p.ThreadRoot == "" {
+		return ""
+	}
+	parts := strings.Split(p.ThreadRoot, ":")
+	return strings.ToUpper(parts[len(parts)-1])
+}
+
+// containsHandle reports whether handles includes handle, ignoring case.
+func containsHandle(handles []string, handle string) bool {
+	for _, h := range handles {
+		if strings.EqualFold(h, handle) {
+			return true
+		}
 	}
+	return false
 }
@@ -0,0 +1,88 @@
+package messaging
+
+import (
+	"testing"
+	"time"
+
+	"imessage-client/messaging/apns"
+)
+
+func TestNewIncomingMessageContext(t *testing.T) {
+	self := []string{"mailto:me@example.com"}
+
+	// A DM from someone else
+	msg := newIncomingMessage(&IMessagePayload{
+		Text:         "hi",
+		Participants: []string{"mailto:me@example.com", "tel:+15555550123"},
+		ThreadRoot:   "r:0:2:1f5a0d2e-6f43-4c59-9b63-2c4c5b6a7e10",
+	}, &apns.MadridPayload{SenderID: "tel:+15555550123"}, "", self)
+	if msg.Chat != "tel:+15555550123" || msg.Sender != "tel:+15555550123" || msg.IsFromMe {
+		t.Errorf("chat %q sender %q from me %v", msg.Chat, msg.Sender, msg.IsFromMe)
+	}
+	if msg.ChatGUID != "iMessage;-;+15555550123" {
+		t.Errorf("chat GUID = %q", msg.ChatGUID)
+	}
+	if msg.ReplyToID != "1F5A0D2E-6F43-4C59-9B63-2C4C5B6A7E10" {
+		t.Errorf("reply to = %q", msg.ReplyToID)
+	}
+	if len(msg.Participants) != 2 {
+		t.Errorf("participants = %v", msg.Participants)
+	}
+
+	// The same chat, sent from our other device
+	msg = newIncomingMessage(&IMessagePayload{
+		Text:         "hello",
+		Participants: []string{"tel:+15555550123", "mailto:me@example.com"},
+	}, &apns.MadridPayload{SenderID: "mailto:me@example.com"}, "", self)
+	if msg.Chat != "tel:+15555550123" || !msg.IsFromMe {
+		t.Errorf("chat %q from me %v", msg.Chat, msg.IsFromMe)
+	}
+
+	// An SMS sent from the iPhone's own number, reflected to us
+	sent := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	msg = newIncomingMessage(&IMessagePayload{
+		Text:         "on my way",
+		Participants: []string{"tel:+15555550199", "tel:+15555550123"},
+	}, &apns.MadridPayload{Command: apns.MessageTypeReflectedSMS, SenderID: "tel:+15555550199", Timestamp: sent.UnixNano()}, "", self)
+	if msg.Chat != "tel:+15555550123" || !msg.IsFromMe || msg.Service != ServiceSMS {
+		t.Errorf("reflected SMS: chat %q from me %v service %q", msg.Chat, msg.IsFromMe, msg.Service)
+	}
+	if !msg.Timestamp.Equal(sent) {
+		t.Errorf("reflected SMS timestamp = %v, want when it was sent", msg.Timestamp)
+	}
+
+	// A named group
+	msg = newIncomingMessage(&IMessagePayload{
+		GroupID:      "6E2B1F0A-2D2C-4C33-9A5E-0C1E2D3F4A5B",
+		GroupName:    "Climbing",
+		Participants: []string{"tel:+15555550123", "mailto:a@example.com", "mailto:me@example.com"},
+	}, &apns.MadridPayload{SenderID: "mailto:a@example.com"}, "", self)
+	if msg.ChatGUID != "iMessage;+;6E2B1F0A-2D2C-4C33-9A5E-0C1E2D3F4A5B" || msg.GroupName != "Climbing" {
+		t.Errorf("chat GUID %q name %q", msg.ChatGUID, msg.GroupName)
+	}
+}
+
+func TestMessageService(t *testing.T) {
+	self := []string{"mailto:me@example.com"}
+	relayed := &apns.MadridPayload{Command: apns.MessageTypeSMS, SenderID: "tel:+15555550123"}
+	msg := newIncomingMessage(&IMessagePayload{Text: "sms"}, relayed, "", self)
+	if msg.Service != ServiceSMS || msg.ChatGUID != "SMS;-;+15555550123" {
+		t.Errorf("service %q chat GUID %q", msg.Service, msg.ChatGUID)
+	}
+	msg = newIncomingMessage(&IMessagePayload{Text: "sms"}, &apns.MadridPayload{SenderID: "tel:+15555550123"}, string(apns.TopicAlloySMS.Hash()), self)
+	if msg.Service != ServiceSMS {
+		t.Errorf("service on the SMS topic = %q", msg.Service)
+	}
+	msg = newIncomingMessage(&IMessagePayload{Text: "hi"}, &apns.MadridPayload{SenderID: "tel:+15555550123"}, string(apns.TopicMadrid.Hash()), self)
+	if msg.Service != ServiceIMessage {
+		t.Errorf("service on madrid = %q", msg.Service)
+	}
+
+	store := NewMemoryStore()
+	if err := MarkReceived(store, *msg); err != nil {
+		t.Fatal(err)
+	}
+	if status, _ := store.MessageStatus(msg.ID); status.Service != ServiceIMessage {
+		t.Errorf("stored service = %q", status.Service)
+	}
+}
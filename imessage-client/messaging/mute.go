@@ -0,0 +1,41 @@
+package messaging
+
+import "time"
+
+// MuteForever is the MutedUntil of a chat muted until it's unmuted.
+var MuteForever = time.Date(9999, 12, 31, 0, 0, 0, 0, time.UTC)
+
+// Mute silences notifications for chat until until, or for good if until is
+// MuteForever. Its messages are still received and counted as unread by the
+// store; notifiers leave them out.
+func Mute(store Store, chat string, until time.Time) error {
+	chat = canonicalChat(chat)
+	cursor := store.Cursor(chat)
+	cursor.MutedUntil = until
+	return store.SetCursor(chat, cursor)
+}
+
+// Unmute ends a mute of chat early.
+func Unmute(store Store, chat string) error {
+	return Mute(store, chat, time.Time{})
+}
+
+// IsMuted reports whether chat is muted at now.
+func IsMuted(store Store, chat string, now time.Time) bool {
+	return now.Before(store.Cursor(chat).MutedUntil)
+}
+
+// Mute silences notifications for chat in the session's store.
+func (s *Session) Mute(chat string, until time.Time) error {
+	return Mute(s.store, chat, until)
+}
+
+// Unmute ends a mute of chat in the session's store.
+func (s *Session) Unmute(chat string) error {
+	return Unmute(s.store, chat)
+}
+
+// IsMuted reports whether chat is muted in the session's store.
+func (s *Session) IsMuted(chat string) bool {
+	return IsMuted(s.store, chat, time.Now())
+}
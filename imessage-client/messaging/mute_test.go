@@ -0,0 +1,42 @@
+package messaging
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMute(t *testing.T) {
+	store := NewMemoryStore()
+	const chat = "tel:+15555550123"
+	_ = MarkRead(store, "m1", chat, false, time.Now())
+	status, _ := store.MessageStatus("m1")
+	status.Read = time.Time{}
+	_ = store.SetMessageStatus("m1", status)
+
+	now := time.Now()
+	if err := Mute(store, chat, now.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if !IsMuted(store, chat, now) {
+		t.Error("chat not muted")
+	}
+	if IsMuted(store, chat, now.Add(2*time.Hour)) {
+		t.Error("chat still muted after the mute ended")
+	}
+	if unread := Unread(store); len(unread) != 1 || !unread[0].Muted || unread[0].Count != 1 {
+		t.Errorf("unread = %v, want one muted chat with one message", unread)
+	}
+
+	if err := Mute(store, chat, MuteForever); err != nil {
+		t.Fatal(err)
+	}
+	if !IsMuted(store, chat, now.AddDate(100, 0, 0)) {
+		t.Error("permanent mute ended")
+	}
+	if err := Unmute(store, chat); err != nil {
+		t.Fatal(err)
+	}
+	if IsMuted(store, chat, now) {
+		t.Error("chat still muted after unmute")
+	}
+}
@@ -0,0 +1,128 @@
+// Package nacserv fetches validation data from registration relays, which
+// forward the request to a registration provider running on a Mac.
+package nacserv
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"imessage-client/messaging/transport"
+)
+
+// ErrProviderNotReachable is returned when the relay doesn't know the token
+// or the provider behind it is offline.
+var ErrProviderNotReachable = errors.New("invalid registration code or provider not reachable")
+
+// Versions describes the Mac the validation data was generated on. IDS
+// rejects validation data registered with a different hardware version.
+type Versions struct {
+	HardwareVersion string `json:"hardware_version"`
+	SoftwareName    string `json:"software_name"`
+	SoftwareVersion string `json:"software_version"`
+	SoftwareBuildID string `json:"software_build_id"`
+	SerialNumber    string `json:"serial_number,omitempty"`
+	UniqueDeviceID  string `json:"unique_device_id,omitempty"`
+}
+
+// Response is what a relay returns for both of its commands.
+type Response struct {
+	Name       string    `json:"name"`
+	Data       []byte    `json:"data"`
+	ValidUntil time.Time `json:"valid_until"`
+	Versions   *Versions `json:"versions"`
+	Error      string    `json:"error"`
+}
+
+// Relay is one registration relay and the registration code of the
+// provider to reach through it.
+type Relay struct {
+	URL   string `json:"url"`
+	Token string `json:"token"`
+
+	// HTTPClient defaults to one using the shared transport.
+	HTTPClient *http.Client `json:"-"`
+}
+
+// LoadRelays reads a JSON list of relays, like
+// [{"url": "https://relay.example.com", "token": "ABCD-1234"}].
+func LoadRelays(path string) ([]*Relay, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read relays: %w", err)
+	}
+	var relays []*Relay
+	if err := json.Unmarshal(data, &relays); err != nil {
+		return nil, fmt.Errorf("failed to parse relays: %w", err)
+	}
+	for i, relay := range relays {
+		if relay.URL == "" || relay.Token == "" {
+			return nil, fmt.Errorf("relay %d needs both a url and a token", i+1)
+		}
+		relay.URL = strings.TrimSuffix(relay.URL, "/")
+	}
+	return relays, nil
+}
+
+// FetchValidationData asks the provider to generate fresh validation data.
+func (r *Relay) FetchValidationData(ctx context.Context) (*Response, error) {
+	return r.fetch(ctx, "get-validation-data")
+}
+
+// FetchVersions asks the provider which Mac it runs on. It's cheap, so it
+// doubles as a health check.
+func (r *Relay) FetchVersions(ctx context.Context) (*Versions, error) {
+	resp, err := r.fetch(ctx, "get-version-info")
+	if err != nil {
+		return nil, err
+	}
+	if resp.Versions == nil {
+		return nil, errors.New("relay response has no versions")
+	}
+	return resp.Versions, nil
+}
+
+func (r *Relay) fetch(ctx context.Context, command string) (*Response, error) {
+	url := fmt.Sprintf("%s/api/v1/bridge/%s", r.URL, command)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader([]byte("{}")))
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+r.Token)
+
+	client := r.HTTPClient
+	if client == nil {
+		client = transport.NewClient()
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrProviderNotReachable
+	} else if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected response status %d", resp.StatusCode)
+	}
+
+	var respData Response
+	if err := json.Unmarshal(data, &respData); err != nil {
+		return nil, fmt.Errorf("failed to parse response: %w", err)
+	}
+	if respData.Error != "" {
+		return nil, errors.New(respData.Error)
+	}
+	return &respData, nil
+}
@@ -0,0 +1,177 @@
+package nacserv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// DefaultRetryAfter is how long a relay that failed is passed over before
+// it's tried again.
+const DefaultRetryAfter = 5 * time.Minute
+
+// DefaultHealthInterval is how often MonitorHealth checks the relays.
+const DefaultHealthInterval = 10 * time.Minute
+
+// Pool fetches validation data from the first relay that works. It sticks
+// with that relay until it fails, then moves on to the next one in order.
+// Relays that failed recently are only tried once every other relay has
+// failed too.
+type Pool struct {
+	relays     []*Relay
+	retryAfter time.Duration
+
+	mu        sync.Mutex
+	current   int
+	downUntil []time.Time
+	lastErr   []error
+}
+
+// RelayStatus is the health of one relay in a Pool.
+type RelayStatus struct {
+	URL string
+	// Current is set for the relay the pool is sticking with.
+	Current bool
+	// Err is why the relay last failed, if it's being passed over.
+	Err error
+}
+
+// NewPool returns a pool of relays, tried in the given order.
+func NewPool(relays []*Relay) *Pool {
+	return &Pool{
+		relays:     relays,
+		retryAfter: DefaultRetryAfter,
+		downUntil:  make([]time.Time, len(relays)),
+		lastErr:    make([]error, len(relays)),
+	}
+}
+
+// Fetch returns fresh validation data along with the versions of the Mac it
+// was generated on.
+func (p *Pool) Fetch(ctx context.Context) (*Response, error) {
+	if len(p.relays) == 0 {
+		return nil, errors.New("no relays configured")
+	}
+	var errs []error
+	for _, i := range p.order() {
+		relay := p.relays[i]
+		resp, err := fetchWithVersions(ctx, relay)
+		if err == nil {
+			p.markUp(i, true)
+			slog.Debug("Fetched validation data", "relay", relay.URL, "valid_until", resp.ValidUntil)
+			return resp, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		slog.Warn("Relay failed to provide validation data", "relay", relay.URL, "err", err)
+		p.markDown(i, err)
+		errs = append(errs, fmt.Errorf("%s: %w", relay.URL, err))
+	}
+	return nil, fmt.Errorf("no relay could provide validation data: %w", errors.Join(errs...))
+}
+
+func fetchWithVersions(ctx context.Context, relay *Relay) (*Response, error) {
+	resp, err := relay.FetchValidationData(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Data) == 0 {
+		return nil, errors.New("relay response has no validation data")
+	}
+	if resp.Versions == nil {
+		if resp.Versions, err = relay.FetchVersions(ctx); err != nil {
+			return nil, err
+		}
+	}
+	return resp, nil
+}
+
+// order lists relay indexes starting at the current one and wrapping
+// around, with relays that are passed over moved to the end.
+func (p *Pool) order() []int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	up := make([]int, 0, len(p.relays))
+	var down []int
+	for n := range p.relays {
+		i := (p.current + n) % len(p.relays)
+		if now.Before(p.downUntil[i]) {
+			down = append(down, i)
+		} else {
+			up = append(up, i)
+		}
+	}
+	return append(up, down...)
+}
+
+func (p *Pool) markUp(i int, stick bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.downUntil[i] = time.Time{}
+	p.lastErr[i] = nil
+	if stick {
+		p.current = i
+	}
+}
+
+func (p *Pool) markDown(i int, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.downUntil[i] = time.Now().Add(p.retryAfter)
+	p.lastErr[i] = err
+}
+
+// CheckHealth asks every relay for its provider's versions, so a relay that
+// went down is passed over before a fetch has to wait for it, and one that
+// came back is tried again. It doesn't change which relay is current.
+func (p *Pool) CheckHealth(ctx context.Context) {
+	var wg sync.WaitGroup
+	for i, relay := range p.relays {
+		wg.Add(1)
+		go func(i int, relay *Relay) {
+			defer wg.Done()
+			if _, err := relay.FetchVersions(ctx); err != nil {
+				if ctx.Err() == nil {
+					p.markDown(i, err)
+				}
+				return
+			}
+			p.markUp(i, false)
+		}(i, relay)
+	}
+	wg.Wait()
+}
+
+// MonitorHealth runs CheckHealth every interval until ctx is done.
+func (p *Pool) MonitorHealth(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			p.CheckHealth(ctx)
+		}
+	}
+}
+
+// Status reports the health of each relay, in order.
+func (p *Pool) Status() []RelayStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	statuses := make([]RelayStatus, len(p.relays))
+	for i, relay := range p.relays {
+		statuses[i] = RelayStatus{URL: relay.URL, Current: i == p.current}
+		if now.Before(p.downUntil[i]) {
+			statuses[i].Err = p.lastErr[i]
+		}
+	}
+	return statuses
+}
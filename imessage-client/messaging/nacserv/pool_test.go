@@ -0,0 +1,72 @@
+package nacserv
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestRelay(t *testing.T, name string, up *atomic.Bool) *Relay {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer code" || !up.Load() {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		resp := Response{Name: name}
+		switch r.URL.Path {
+		case "/api/v1/bridge/get-validation-data":
+			resp.Data = []byte(name)
+			resp.ValidUntil = time.Now().Add(10 * time.Minute)
+		case "/api/v1/bridge/get-version-info":
+			resp.Versions = &Versions{HardwareVersion: "Mac14,2"}
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(resp)
+	}))
+	t.Cleanup(server.Close)
+	return &Relay{URL: server.URL, Token: "code"}
+}
+
+func TestPoolFailsOverAndSticks(t *testing.T) {
+	var firstUp, secondUp atomic.Bool
+	secondUp.Store(true)
+	pool := NewPool([]*Relay{newTestRelay(t, "first", &firstUp), newTestRelay(t, "second", &secondUp)})
+	ctx := context.Background()
+
+	resp, err := pool.Fetch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Name != "second" || resp.Versions == nil || resp.Versions.HardwareVersion != "Mac14,2" {
+		t.Fatalf("response = %+v", resp)
+	}
+	if status := pool.Status(); status[0].Err == nil || !status[1].Current {
+		t.Errorf("status = %+v", status)
+	}
+
+	// The first relay coming back doesn't move the pool off the second
+	firstUp.Store(true)
+	pool.CheckHealth(ctx)
+	if status := pool.Status(); status[0].Err != nil {
+		t.Errorf("recovered relay still down: %+v", status[0])
+	}
+	if resp, err := pool.Fetch(ctx); err != nil || resp.Name != "second" {
+		t.Fatalf("sticky fetch = %+v, %v", resp, err)
+	}
+
+	secondUp.Store(false)
+	if resp, err := pool.Fetch(ctx); err != nil || resp.Name != "first" {
+		t.Fatalf("failover fetch = %+v, %v", resp, err)
+	}
+
+	firstUp.Store(false)
+	if _, err := pool.Fetch(ctx); err == nil {
+		t.Fatal("fetch succeeded with every relay down")
+	}
+}
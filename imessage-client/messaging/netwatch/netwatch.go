@@ -0,0 +1,124 @@
+// Package netwatch notices when the network under a long-lived connection
+// has changed: interfaces or addresses came and went (a Wi-Fi switch, VPN,
+// cable), or the machine was suspended. A connection that survives either
+// is usually dead without knowing it yet.
+package netwatch
+
+import (
+	"context"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DefaultInterval is how often interfaces are checked.
+const DefaultInterval = 5 * time.Second
+
+// Reason says what changed.
+type Reason string
+
+const (
+	// ReasonAddresses means the set of up interfaces or their addresses changed.
+	ReasonAddresses Reason = "addresses"
+	// ReasonResume means the wall clock jumped ahead of the interval, which
+	// happens when the machine sleeps.
+	ReasonResume Reason = "resume"
+)
+
+// Change is reported by Watch.
+type Change struct {
+	Reason Reason
+	At     time.Time
+}
+
+// Watcher polls the network configuration.
+type Watcher struct {
+	Interval time.Duration
+	// Addrs returns the current addresses; defaults to the addresses of all
+	// up, non-loopback interfaces.
+	Addrs func() ([]string, error)
+}
+
+// Watch reports changes until ctx is done, then closes the channel.
+func (w *Watcher) Watch(ctx context.Context) <-chan Change {
+	interval := w.Interval
+	if interval <= 0 {
+		interval = DefaultInterval
+	}
+	addrs := w.Addrs
+	if addrs == nil {
+		addrs = interfaceAddrs
+	}
+	changes := make(chan Change, 1)
+	go func() {
+		defer close(changes)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		last := snapshot(addrs)
+		// Round strips the monotonic reading, which stops during suspend on
+		// Linux, so wall clock jumps show up
+		lastTick := time.Now().Round(0)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			now := time.Now().Round(0)
+			var change *Change
+			if now.Sub(lastTick) > 3*interval {
+				change = &Change{Reason: ReasonResume, At: now}
+			}
+			lastTick = now
+			current := snapshot(addrs)
+			if current != last {
+				last = current
+				if change == nil {
+					change = &Change{Reason: ReasonAddresses, At: now}
+				}
+			}
+			if change == nil {
+				continue
+			}
+			select {
+			case changes <- *change:
+			default:
+				// One pending change is as good as several
+			}
+		}
+	}()
+	return changes
+}
+
+// snapshot returns a comparable form of the current addresses. Errors count
+// as having no addresses, so a failing lookup after a working one is a change.
+func snapshot(addrs func() ([]string, error)) string {
+	list, err := addrs()
+	if err != nil {
+		return ""
+	}
+	sort.Strings(list)
+	return strings.Join(list, ",")
+}
+
+func interfaceAddrs() ([]string, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	var list []string
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			list = append(list, iface.Name+"="+addr.String())
+		}
+	}
+	return list, nil
+}
@@ -0,0 +1,41 @@
+package netwatch
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWatchReportsAddressChanges(t *testing.T) {
+	var addr atomic.Value
+	addr.Store("wlan0=192.168.1.2/24")
+	w := &Watcher{
+		Interval: 5 * time.Millisecond,
+		Addrs: func() ([]string, error) {
+			return []string{addr.Load().(string)}, nil
+		},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	changes := w.Watch(ctx)
+
+	select {
+	case change := <-changes:
+		t.Fatalf("got %+v before anything changed", change)
+	case <-time.After(30 * time.Millisecond):
+	}
+	addr.Store("wlan0=10.0.0.5/24")
+	select {
+	case change := <-changes:
+		if change.Reason != ReasonAddresses {
+			t.Errorf("reason = %s, want %s", change.Reason, ReasonAddresses)
+		}
+	case <-ctx.Done():
+		t.Fatal("change not reported")
+	}
+
+	cancel()
+	for range changes {
+	}
+}
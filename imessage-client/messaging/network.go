@@ -0,0 +1,49 @@
+package messaging
+
+import (
+	"context"
+	"time"
+
+	"imessage-client/messaging/netwatch"
+)
+
+// NetworkChangedEvent is emitted after the session reconnected to the
+// courier because the network changed. Err is set if reconnecting failed;
+// sends are then queued until a later attempt succeeds.
+type NetworkChangedEvent struct {
+	Reason netwatch.Reason
+	Err    error
+}
+
+func (NetworkChangedEvent) isEvent() {}
+
+// ResetConnection drops the courier connection and connects again at once,
+// e.g. because the network changed under it. It does nothing before the
+// handshake.
+func (s *Session) ResetConnection(ctx context.Context) error {
+	s.reconnectMu.Lock()
+	if s.state == nil || s.state.APNSConn == nil {
+		s.reconnectMu.Unlock()
+		return nil
+	}
+	// Stop the read loop first so the dropped connection isn't reported
+	// as a failure
+	if s.readLoopCancel != nil {
+		s.readLoopCancel()
+	}
+	s.state.APNSConn.Close()
+	s.reconnectMu.Unlock()
+	return s.reconnectAPNS(ctx)
+}
+
+// WatchNetwork reconnects to the courier whenever watcher reports a
+// change, rather than waiting for reads on the dead connection to time out.
+// It returns when ctx is done.
+func (s *Session) WatchNetwork(ctx context.Context, watcher *netwatch.Watcher) {
+	for change := range watcher.Watch(ctx) {
+		reconnectCtx, cancel := context.WithTimeout(ctx, time.Minute)
+		err := s.ResetConnection(reconnectCtx)
+		cancel()
+		s.emit(NetworkChangedEvent{Reason: change.Reason, Err: err})
+	}
+}
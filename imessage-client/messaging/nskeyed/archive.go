@@ -0,0 +1,9 @@
+package nskeyed
+
+const (
+	archiverName = "NSKeyedArchiver"
+	// archiverVersion is the $version Foundation writes.
+	archiverVersion = 100000
+	// nullObject is the first entry of $objects, which nil references use.
+	nullObject = "$null"
+)
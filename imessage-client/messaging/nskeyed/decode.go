@@ -0,0 +1,232 @@
+// Package nskeyed reads and writes NSKeyedArchiver archives, the format
+// Apple clients use for attributedBody and other rich message content.
+package nskeyed
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"howett.net/plist"
+)
+
+var ErrInvalidArchive = errors.New("invalid keyed archive")
+
+// referenceDate is the epoch of NSDate.
+var referenceDate = time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// Object is an archived instance of a class Unarchive doesn't convert to a
+// plain Go value.
+type Object struct {
+	// Class is the object's class; Classes is its class hierarchy, most
+	// derived first.
+	Class   string
+	Classes []string
+	Fields  map[string]interface{}
+}
+
+// Unarchive decodes the root object of an archive. Foundation types become
+// Go values: strings, numbers, []byte for NSData, time.Time for NSDate,
+// []interface{} for arrays and sets, map[string]interface{} for
+// dictionaries and a string for NSURL. Other classes are returned as
+// *Object with their fields decoded the same way.
+func Unarchive(data []byte) (interface{}, error) {
+	var top struct {
+		Archiver string                 `plist:"$archiver"`
+		Objects  []interface{}          `plist:"$objects"`
+		Top      map[string]interface{} `plist:"$top"`
+	}
+	if _, err := plist.Unmarshal(data, &top); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidArchive, err)
+	}
+	if top.Archiver != archiverName {
+		return nil, fmt.Errorf("%w: archiver is %q", ErrInvalidArchive, top.Archiver)
+	}
+	root, ok := top.Top["root"]
+	if !ok {
+		return nil, fmt.Errorf("%w: no root object", ErrInvalidArchive)
+	}
+	a := &unarchiver{
+		objects:  top.Objects,
+		decoded:  make(map[uint64]interface{}),
+		visiting: make(map[uint64]bool),
+	}
+	return a.resolve(root)
+}
+
+type unarchiver struct {
+	objects  []interface{}
+	decoded  map[uint64]interface{}
+	visiting map[uint64]bool
+}
+
+// resolve decodes a field value, following object references.
+func (a *unarchiver) resolve(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case plist.UID:
+		return a.object(uint64(v))
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, item := range v {
+			resolved, err := a.resolve(item)
+			if err != nil {
+				return nil, err
+			}
+			out[i] = resolved
+		}
+		return out, nil
+	default:
+		return v, nil
+	}
+}
+
+func (a *unarchiver) object(uid uint64) (interface{}, error) {
+	if uid >= uint64(len(a.objects)) {
+		return nil, fmt.Errorf("%w: reference %d out of range", ErrInvalidArchive, uid)
+	}
+	if v, ok := a.decoded[uid]; ok {
+		return v, nil
+	}
+	if a.visiting[uid] {
+		return nil, fmt.Errorf("%w: object %d refers to itself", ErrInvalidArchive, uid)
+	}
+	a.visiting[uid] = true
+	defer delete(a.visiting, uid)
+
+	var v interface{}
+	var err error
+	switch obj := a.objects[uid].(type) {
+	case string:
+		if obj != nullObject {
+			v = obj
+		}
+	case map[string]interface{}:
+		v, err = a.instance(obj)
+	default:
+		v = obj
+	}
+	if err != nil {
+		return nil, err
+	}
+	a.decoded[uid] = v
+	return v, nil
+}
+
+// instance decodes an archived object according to its class.
+func (a *unarchiver) instance(fields map[string]interface{}) (interface{}, error) {
+	classes, err := a.classes(fields["$class"])
+	if err != nil {
+		return nil, err
+	}
+	field := func(key string) (interface{}, error) {
+		return a.resolve(fields[key])
+	}
+	switch classes[0] {
+	case "NSString", "NSMutableString":
+		if s, ok := fields["NS.string"].(string); ok {
+			return s, nil
+		}
+		if b, ok := fields["NS.bytes"].([]byte); ok {
+			return string(b), nil
+		}
+		return nil, fmt.Errorf("%w: %s without contents", ErrInvalidArchive, classes[0])
+	case "NSData", "NSMutableData":
+		b, _ := fields["NS.data"].([]byte)
+		return b, nil
+	case "NSDate":
+		seconds, ok := fields["NS.time"].(float64)
+		if !ok {
+			return nil, fmt.Errorf("%w: NSDate without time", ErrInvalidArchive)
+		}
+		return referenceDate.Add(time.Duration(seconds * float64(time.Second))), nil
+	case "NSURL":
+		relative, err := field("NS.relative")
+		if err != nil {
+			return nil, err
+		}
+		base, err := field("NS.base")
+		if err != nil {
+			return nil, err
+		}
+		if base, ok := base.(string); ok && base != "" {
+			return base + fmt.Sprint(relative), nil
+		}
+		s, _ := relative.(string)
+		return s, nil
+	case "NSArray", "NSMutableArray", "NSSet", "NSMutableSet", "NSOrderedSet", "NSMutableOrderedSet":
+		items, err := field("NS.objects")
+		if err != nil {
+			return nil, err
+		}
+		list, _ := items.([]interface{})
+		return list, nil
+	case "NSDictionary", "NSMutableDictionary":
+		return a.dictionary(fields)
+	}
+
+	obj := &Object{Class: classes[0], Classes: classes, Fields: make(map[string]interface{}, len(fields))}
+	for key := range fields {
+		if key == "$class" {
+			continue
+		}
+		v, err := field(key)
+		if err != nil {
+			return nil, err
+		}
+		obj.Fields[key] = v
+	}
+	return obj, nil
+}
+
+func (a *unarchiver) classes(ref interface{}) ([]string, error) {
+	uid, ok := ref.(plist.UID)
+	if !ok || uint64(uid) >= uint64(len(a.objects)) {
+		return nil, fmt.Errorf("%w: object without a class", ErrInvalidArchive)
+	}
+	class, ok := a.objects[uid].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%w: class %d is not a class", ErrInvalidArchive, uid)
+	}
+	name, _ := class["$classname"].(string)
+	if name == "" {
+		return nil, fmt.Errorf("%w: class %d has no name", ErrInvalidArchive, uid)
+	}
+	classes := []string{name}
+	if list, ok := class["$classes"].([]interface{}); ok && len(list) > 0 {
+		classes = classes[:0]
+		for _, c := range list {
+			if s, ok := c.(string); ok {
+				classes = append(classes, s)
+			}
+		}
+		if len(classes) == 0 {
+			return nil, fmt.Errorf("%w: class %d lists no class names", ErrInvalidArchive, uid)
+		}
+	}
+	return classes, nil
+}
+
+func (a *unarchiver) dictionary(fields map[string]interface{}) (map[string]interface{}, error) {
+	keys, _ := fields["NS.keys"].([]interface{})
+	values, _ := fields["NS.objects"].([]interface{})
+	if len(keys) != len(values) {
+		return nil, fmt.Errorf("%w: dictionary has %d keys and %d values", ErrInvalidArchive, len(keys), len(values))
+	}
+	dict := make(map[string]interface{}, len(keys))
+	for i := range keys {
+		key, err := a.resolve(keys[i])
+		if err != nil {
+			return nil, err
+		}
+		value, err := a.resolve(values[i])
+		if err != nil {
+			return nil, err
+		}
+		name, ok := key.(string)
+		if !ok {
+			name = fmt.Sprint(key)
+		}
+		dict[name] = value
+	}
+	return dict, nil
+}
@@ -0,0 +1,98 @@
+package nskeyed
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"howett.net/plist"
+)
+
+func marshalArchive(t *testing.T, objects []interface{}) []byte {
+	t.Helper()
+	data, err := plist.Marshal(map[string]interface{}{
+		"$archiver": archiverName,
+		"$version":  archiverVersion,
+		"$top":      map[string]interface{}{"root": plist.UID(1)},
+		"$objects":  objects,
+	}, plist.BinaryFormat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func class(name string, supers ...string) map[string]interface{} {
+	classes := []interface{}{name}
+	for _, s := range supers {
+		classes = append(classes, s)
+	}
+	return map[string]interface{}{"$classname": name, "$classes": classes}
+}
+
+func TestUnarchive(t *testing.T) {
+	data := marshalArchive(t, []interface{}{
+		nullObject,
+		// 1: root, a custom object
+		map[string]interface{}{
+			"$class": plist.UID(2),
+			"title":  plist.UID(3),
+			"tags":   plist.UID(4),
+			"extra":  plist.UID(6),
+			"none":   plist.UID(0),
+			"count":  uint64(3),
+		},
+		class("IMThing", "NSObject"),
+		"hello",
+		map[string]interface{}{"$class": plist.UID(5), "NS.objects": []interface{}{plist.UID(3), plist.UID(8)}},
+		class("NSArray", "NSObject"),
+		map[string]interface{}{"$class": plist.UID(7), "NS.keys": []interface{}{plist.UID(3)}, "NS.objects": []interface{}{plist.UID(8)}},
+		class("NSDictionary", "NSObject"),
+		map[string]interface{}{"$class": plist.UID(9), "NS.string": "mutable"},
+		class("NSMutableString", "NSString", "NSObject"),
+	})
+	root, err := Unarchive(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj, ok := root.(*Object)
+	if !ok {
+		t.Fatalf("root is %T", root)
+	}
+	want := &Object{
+		Class:   "IMThing",
+		Classes: []string{"IMThing", "NSObject"},
+		Fields: map[string]interface{}{
+			"title": "hello",
+			"tags":  []interface{}{"hello", "mutable"},
+			"extra": map[string]interface{}{"hello": "mutable"},
+			"none":  nil,
+			"count": uint64(3),
+		},
+	}
+	if !reflect.DeepEqual(obj, want) {
+		t.Errorf("got %+v, want %+v", obj, want)
+	}
+}
+
+func TestUnarchiveRejectsCycles(t *testing.T) {
+	data := marshalArchive(t, []interface{}{
+		nullObject,
+		map[string]interface{}{"$class": plist.UID(2), "NS.objects": []interface{}{plist.UID(1)}},
+		class("NSArray", "NSObject"),
+	})
+	if _, err := Unarchive(data); !errors.Is(err, ErrInvalidArchive) {
+		t.Errorf("err = %v, want ErrInvalidArchive", err)
+	}
+}
+
+func TestUnarchiveRejectsEmptyClassList(t *testing.T) {
+	data := marshalArchive(t, []interface{}{
+		nullObject,
+		map[string]interface{}{"$class": plist.UID(2)},
+		map[string]interface{}{"$classname": "NSArray", "$classes": []interface{}{uint64(1)}},
+	})
+	if _, err := Unarchive(data); !errors.Is(err, ErrInvalidArchive) {
+		t.Errorf("err = %v, want ErrInvalidArchive", err)
+	}
+}
@@ -0,0 +1,167 @@
+package nskeyed
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"howett.net/plist"
+)
+
+// URL is archived as an NSURL. Unarchive returns NSURLs as plain strings.
+type URL string
+
+// builtinClasses are the class hierarchies of the Foundation types Archive
+// writes for plain Go values.
+var builtinClasses = map[string][]string{
+	"NSArray":      {"NSArray", "NSObject"},
+	"NSDictionary": {"NSDictionary", "NSObject"},
+	"NSDate":       {"NSDate", "NSObject"},
+	"NSURL":        {"NSURL", "NSObject"},
+}
+
+// Archive encodes root as a binary keyed archive. It takes the values
+// Unarchive returns: strings, numbers, bools, []byte, time.Time,
+// []interface{}, map[string]interface{} and *Object, plus URL for NSURLs.
+// Strings and classes used more than once are stored once.
+func Archive(root interface{}) ([]byte, error) {
+	a := &archiver{
+		objects: []interface{}{nullObject},
+		strings: make(map[string]plist.UID),
+		classes: make(map[string]plist.UID),
+	}
+	ref, err := a.ref(root)
+	if err != nil {
+		return nil, err
+	}
+	return plist.Marshal(map[string]interface{}{
+		"$archiver": archiverName,
+		"$version":  archiverVersion,
+		"$top":      map[string]interface{}{"root": ref},
+		"$objects":  a.objects,
+	}, plist.BinaryFormat)
+}
+
+type archiver struct {
+	objects []interface{}
+	strings map[string]plist.UID
+	classes map[string]plist.UID
+}
+
+func (a *archiver) add(v interface{}) plist.UID {
+	a.objects = append(a.objects, v)
+	return plist.UID(len(a.objects) - 1)
+}
+
+// ref stores v as an object and returns its reference.
+func (a *archiver) ref(v interface{}) (plist.UID, error) {
+	switch v := v.(type) {
+	case nil:
+		return 0, nil
+	case string:
+		if uid, ok := a.strings[v]; ok {
+			return uid, nil
+		}
+		uid := a.add(v)
+		a.strings[v] = uid
+		return uid, nil
+	case bool, int, int64, uint64, float64, []byte:
+		return a.add(v), nil
+	case URL:
+		relative, err := a.ref(string(v))
+		if err != nil {
+			return 0, err
+		}
+		return a.instance("NSURL", map[string]interface{}{"NS.base": plist.UID(0), "NS.relative": relative}), nil
+	case time.Time:
+		return a.instance("NSDate", map[string]interface{}{"NS.time": v.Sub(referenceDate).Seconds()}), nil
+	case []interface{}:
+		items, err := a.refs(v)
+		if err != nil {
+			return 0, err
+		}
+		return a.instance("NSArray", map[string]interface{}{"NS.objects": items}), nil
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		// Sorted so the same dictionary always archives the same way
+		sort.Strings(keys)
+		values := make([]interface{}, len(keys))
+		for i, key := range keys {
+			values[i] = v[key]
+		}
+		keyRefs, err := a.refs(stringValues(keys))
+		if err != nil {
+			return 0, err
+		}
+		valueRefs, err := a.refs(values)
+		if err != nil {
+			return 0, err
+		}
+		return a.instance("NSDictionary", map[string]interface{}{"NS.keys": keyRefs, "NS.objects": valueRefs}), nil
+	case *Object:
+		fields := make(map[string]interface{}, len(v.Fields)+1)
+		for key, field := range v.Fields {
+			switch field.(type) {
+			case bool, int, int64, uint64, float64:
+				// Scalars are encoded in place, like encodeInt:forKey:
+				fields[key] = field
+			default:
+				uid, err := a.ref(field)
+				if err != nil {
+					return 0, fmt.Errorf("field %s of %s: %w", key, v.Class, err)
+				}
+				fields[key] = uid
+			}
+		}
+		classes := v.Classes
+		if len(classes) == 0 {
+			classes = []string{v.Class, "NSObject"}
+		}
+		fields["$class"] = a.class(v.Class, classes)
+		return a.add(fields), nil
+	default:
+		return 0, fmt.Errorf("can't archive %T", v)
+	}
+}
+
+func (a *archiver) refs(values []interface{}) ([]interface{}, error) {
+	refs := make([]interface{}, len(values))
+	for i, v := range values {
+		uid, err := a.ref(v)
+		if err != nil {
+			return nil, err
+		}
+		refs[i] = uid
+	}
+	return refs, nil
+}
+
+// instance stores an object of a Foundation class.
+func (a *archiver) instance(class string, fields map[string]interface{}) plist.UID {
+	fields["$class"] = a.class(class, builtinClasses[class])
+	return a.add(fields)
+}
+
+func (a *archiver) class(name string, hierarchy []string) plist.UID {
+	if uid, ok := a.classes[name]; ok {
+		return uid
+	}
+	classes := make([]interface{}, len(hierarchy))
+	for i, c := range hierarchy {
+		classes[i] = c
+	}
+	uid := a.add(map[string]interface{}{"$classname": name, "$classes": classes})
+	a.classes[name] = uid
+	return uid
+}
+
+func stringValues(keys []string) []interface{} {
+	values := make([]interface{}, len(keys))
+	for i, key := range keys {
+		values[i] = key
+	}
+	return values
+}
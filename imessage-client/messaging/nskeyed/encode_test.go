@@ -0,0 +1,37 @@
+package nskeyed
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestArchiveRoundTrip(t *testing.T) {
+	when := referenceDate.Add(1e9 * time.Second)
+	obj := &Object{
+		Class:   "NSMutableAttributedString",
+		Classes: []string{"NSMutableAttributedString", "NSAttributedString", "NSObject"},
+		Fields: map[string]interface{}{
+			"NSString": "hello",
+			"NSAttributes": []interface{}{
+				map[string]interface{}{"a": uint64(1), "b": "hello"},
+				map[string]interface{}{"when": when, "link": URL("https://example.com")},
+			},
+			"NSAttributeInfo": []byte{2, 0, 3, 1},
+			"flag":            true,
+		},
+	}
+	data, err := Archive(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := Unarchive(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// NSURLs come back as strings
+	obj.Fields["NSAttributes"].([]interface{})[1].(map[string]interface{})["link"] = "https://example.com"
+	if !reflect.DeepEqual(got, obj) {
+		t.Errorf("got %+v, want %+v", got, obj)
+	}
+}
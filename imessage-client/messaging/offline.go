@@ -0,0 +1,134 @@
+package messaging
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+)
+
+// OutgoingMessage is a message queued to be sent once the courier is
+// reachable again.
+type OutgoingMessage struct {
+	ID     string    `json:"id"`
+	Chat   string    `json:"chat"`
+	Text   string    `json:"text"`
+	Queued time.Time `json:"queued"`
+
+	Attachments []Attachment `json:"attachments,omitempty"`
+	Reaction    *Reaction    `json:"reaction,omitempty"`
+	// Markdown formats Text with ParseMarkdown.
+	Markdown bool `json:"markdown,omitempty"`
+}
+
+// SetOfflineQueue sets whether sends that fail because the courier is
+// unreachable are queued in the store and sent on reconnect, instead of
+// failing with ErrOffline. Enabled by default.
+func (s *Session) SetOfflineQueue(enabled bool) {
+	s.offlineMu.Lock()
+	defer s.offlineMu.Unlock()
+	s.offlineQueue = enabled
+}
+
+// offline reports whether queued messages are waiting for the courier, in
+// which case new ones queue up behind them.
+func (s *Session) offline() bool {
+	s.offlineMu.Lock()
+	defer s.offlineMu.Unlock()
+	return s.offlineQueue && s.offlineFlushing
+}
+
+// queueOutgoing stores msg to be sent on reconnect and makes sure
+// something is trying to reconnect. It reports whether the message was
+// queued.
+func (s *Session) queueOutgoing(msg OutgoingMessage) bool {
+	s.offlineMu.Lock()
+	defer s.offlineMu.Unlock()
+	if !s.offlineQueue {
+		return false
+	}
+	msg.Queued = time.Now()
+	if err := s.store.QueueOutgoing(msg); err != nil {
+		slog.Warn("Failed to queue message", "id", msg.ID, "err", err)
+		return false
+	}
+	s.startReconnectLocked()
+	return true
+}
+
+// startReconnect starts reconnectLoop unless it's already running.
+func (s *Session) startReconnect() {
+	s.offlineMu.Lock()
+	defer s.offlineMu.Unlock()
+	s.startReconnectLocked()
+}
+
+func (s *Session) startReconnectLocked() {
+	if !s.offlineFlushing {
+		s.offlineFlushing = true
+		go s.reconnectLoop()
+	}
+}
+
+// reconnectLoop retries the courier with the power profile's backoff until
+// it's reachable. The successful reconnect flushes the queue.
+func (s *Session) reconnectLoop() {
+	s.stateMu.Lock()
+	delay, maxDelay := s.power.ReconnectMin, s.power.ReconnectMax
+	s.stateMu.Unlock()
+	if delay <= 0 {
+		delay = time.Second
+	}
+	maxDelay = max(maxDelay, delay)
+	for {
+		select {
+		case <-s.closing:
+			return
+		case <-time.After(delay):
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		err := s.ensureAPNS(ctx)
+		cancel()
+		if err == nil {
+			s.flushOutgoing()
+			return
+		}
+		delay = min(delay*2, maxDelay)
+	}
+}
+
+// flushOutgoing sends the queued messages in order. Messages that can't be
+// sent because the courier went away again are queued again.
+func (s *Session) flushOutgoing() {
+	s.offlineMu.Lock()
+	s.offlineFlushing = false
+	s.offlineMu.Unlock()
+	queued, err := s.store.TakeQueuedOutgoing()
+	if err != nil {
+		slog.Warn("Failed to load queued messages", "err", err)
+		return
+	}
+	for i, msg := range queued {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		_, err := s.sendPart(ctx, msg)
+		cancel()
+		if errors.Is(err, ErrOutboxClosed) {
+			// The session closed under us; keep the rest for the next one
+			for _, rest := range queued[i:] {
+				if err := s.store.QueueOutgoing(rest); err != nil {
+					slog.Warn("Failed to queue message", "id", rest.ID, "err", err)
+				}
+			}
+			return
+		}
+		if err != nil {
+			slog.Warn("Failed to send queued message", "id", msg.ID, "err", err)
+		}
+	}
+}
+
+// SetOfflineQueue sets whether the client's sessions queue sends while the
+// courier is unreachable.
+func (c *Client) SetOfflineQueue(enabled bool) {
+	c.offlineQueue = enabled
+}
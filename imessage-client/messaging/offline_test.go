@@ -0,0 +1,76 @@
+package messaging
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"imessage-client/messaging/apns"
+	"imessage-client/messaging/apns/apnstest"
+)
+
+func TestSendQueuesWhileOffline(t *testing.T) {
+	down, err := apnstest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	me := newTestDevice(t, "me")
+	theirPhone := newTestDevice(t, "their-phone")
+	session := testSendSession(t, me, map[string][]*testDevice{
+		"tel:+15555550123":      {theirPhone},
+		"mailto:me@example.com": {me},
+	})
+	session.state.APNSConn = testAPNSConnection(t, down)
+	down.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	first, err := session.Send(ctx, "tel:+15555550123", "first", SendOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !first.Queued {
+		t.Fatal("send while offline wasn't queued")
+	}
+	// Queued behind the first one without trying the courier again
+	second, err := session.Send(ctx, "tel:+15555550123", "second", SendOptions{})
+	if err != nil || !second.Queued {
+		t.Fatalf("second send: queued = %v, err = %v", second.Queued, err)
+	}
+	if status, _ := session.store.MessageStatus(first.MessageUUID); !status.Sent.IsZero() {
+		t.Error("queued message marked as sent")
+	}
+
+	up, err := apnstest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer up.Close()
+	up.Configure(session.state.APNSConn)
+	if err := session.ensureAPNS(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	var texts []string
+	for len(texts) < 2 {
+		sent, err := up.WaitFor(ctx, apns.CommandSendMessage)
+		if err != nil {
+			t.Fatal(err)
+		}
+		madrid, err := apns.ParseMadridPayload(sent.Field(apns.FieldOutgoingPayload))
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg, err := DecryptMessage(theirPhone.key, madrid.DTL[0].Payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		texts = append(texts, msg.Text)
+	}
+	if texts[0] != "first" || texts[1] != "second" {
+		t.Errorf("flushed %q, want first then second", texts)
+	}
+	if queued, _ := session.store.TakeQueuedOutgoing(); len(queued) != 0 {
+		t.Errorf("%d messages still queued", len(queued))
+	}
+}
@@ -0,0 +1,191 @@
+package messaging
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"imessage-client/messaging/apns"
+)
+
+// Priority orders payloads waiting in the outbox. Lower values are sent first.
+type Priority int
+
+const (
+	// PriorityMessage is for messages the user just sent.
+	PriorityMessage Priority = iota
+	// PriorityRetry is for messages being resent after a failed attempt,
+	// which yield to fresh sends.
+	PriorityRetry
+	// PriorityStatus is for typing indicators and delivery/read receipts,
+	// which must never delay actual messages.
+	PriorityStatus
+
+	numPriorities
+)
+
+func (p Priority) String() string {
+	switch p {
+	case PriorityMessage:
+		return "message"
+	case PriorityRetry:
+		return "retry"
+	case PriorityStatus:
+		return "status"
+	default:
+		return "unknown"
+	}
+}
+
+// DefaultOutboxRetries is how many times a message is resent after a failed
+// attempt. Status payloads are never resent.
+const DefaultOutboxRetries = 2
+
+var ErrOutboxClosed = errors.New("outbox closed")
+
+// OutboxSendFunc delivers one payload.
+type OutboxSendFunc func(ctx context.Context, payload *apns.MadridPayload) error
+
+type outboxItem struct {
+	ctx      context.Context
+	payload  *apns.MadridPayload
+	priority Priority
+	attempts int
+	done     chan error
+}
+
+// Outbox sends payloads one at a time, highest priority lane first and in
+// order within a lane.
+type Outbox struct {
+	send       OutboxSendFunc
+	maxRetries int
+
+	mu      sync.Mutex
+	lanes   [numPriorities][]*outboxItem
+	closed  bool
+	started bool
+	wake    chan struct{}
+	stop    chan struct{}
+}
+
+// NewOutbox creates an outbox that delivers payloads with send. The worker
+// starts with the first Enqueue.
+func NewOutbox(send OutboxSendFunc) *Outbox {
+	return &Outbox{
+		send:       send,
+		maxRetries: DefaultOutboxRetries,
+		wake:       make(chan struct{}, 1),
+		stop:       make(chan struct{}),
+	}
+}
+
+// SetMaxRetries changes how many times a failed message is resent.
+func (o *Outbox) SetMaxRetries(retries int) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.maxRetries = retries
+}
+
+// Enqueue queues payload in the lane for priority. The returned channel
+// receives the outcome of the final attempt, or ctx's error if it's done
+// before the payload is sent.
+func (o *Outbox) Enqueue(ctx context.Context, priority Priority, payload *apns.MadridPayload) <-chan error {
+	item := &outboxItem{ctx: ctx, payload: payload, priority: priority, done: make(chan error, 1)}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.closed {
+		item.done <- ErrOutboxClosed
+		return item.done
+	}
+	if !o.started {
+		o.started = true
+		go o.run()
+	}
+	o.pushLocked(item)
+	return item.done
+}
+
+// Len returns the number of payloads waiting in the lane for priority.
+func (o *Outbox) Len(priority Priority) int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return len(o.lanes[priority])
+}
+
+// Close stops the worker and fails everything still queued with ErrOutboxClosed.
+func (o *Outbox) Close() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.closed {
+		return
+	}
+	o.closed = true
+	close(o.stop)
+	for i, lane := range o.lanes {
+		for _, item := range lane {
+			item.done <- ErrOutboxClosed
+		}
+		o.lanes[i] = nil
+	}
+}
+
+func (o *Outbox) pushLocked(item *outboxItem) {
+	o.lanes[item.priority] = append(o.lanes[item.priority], item)
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+}
+
+// next pops the first item of the highest priority non-empty lane.
+func (o *Outbox) next() *outboxItem {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for i, lane := range o.lanes {
+		if len(lane) > 0 {
+			item := lane[0]
+			lane[0] = nil
+			o.lanes[i] = lane[1:]
+			return item
+		}
+	}
+	return nil
+}
+
+func (o *Outbox) run() {
+	for {
+		item := o.next()
+		if item == nil {
+			select {
+			case <-o.wake:
+				continue
+			case <-o.stop:
+				return
+			}
+		}
+		o.deliver(item)
+	}
+}
+
+func (o *Outbox) deliver(item *outboxItem) {
+	if err := item.ctx.Err(); err != nil {
+		item.done <- err
+		return
+	}
+	err := o.send(item.ctx, item.payload)
+	item.attempts++
+	if err == nil || item.ctx.Err() != nil || item.priority == PriorityStatus {
+		item.done <- err
+		return
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.closed || item.attempts > o.maxRetries {
+		item.done <- err
+		return
+	}
+	// Back of the retry lane, behind anything the user sent meanwhile
+	item.priority = PriorityRetry
+	o.pushLocked(item)
+}
@@ -0,0 +1,86 @@
+package messaging
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"imessage-client/messaging/apns"
+)
+
+func TestOutboxPriorityOrder(t *testing.T) {
+	release := make(chan struct{})
+	sent := make(chan string, 10)
+	var failedOnce bool
+	outbox := NewOutbox(func(ctx context.Context, payload *apns.MadridPayload) error {
+		if payload.UserAgent == "blocker" {
+			<-release
+		}
+		if payload.UserAgent == "flaky" && !failedOnce {
+			failedOnce = true
+			return errors.New("transient")
+		}
+		sent <- payload.UserAgent
+		return nil
+	})
+	defer outbox.Close()
+
+	ctx := context.Background()
+	outbox.Enqueue(ctx, PriorityMessage, &apns.MadridPayload{UserAgent: "blocker"})
+	// Wait for the worker to pick up the blocker so the rest queue behind it
+	for outbox.Len(PriorityMessage) != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	receipt := outbox.Enqueue(ctx, PriorityStatus, &apns.MadridPayload{UserAgent: "receipt"})
+	flaky := outbox.Enqueue(ctx, PriorityMessage, &apns.MadridPayload{UserAgent: "flaky"})
+	fresh := outbox.Enqueue(ctx, PriorityMessage, &apns.MadridPayload{UserAgent: "fresh"})
+	close(release)
+
+	for _, done := range []<-chan error{receipt, flaky, fresh} {
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(sent)
+	var order []string
+	for name := range sent {
+		order = append(order, name)
+	}
+	// The failed message is retried after the fresh one but before the receipt
+	want := []string{"blocker", "fresh", "flaky", "receipt"}
+	if len(order) != len(want) {
+		t.Fatalf("order = %v, want %v", order, want)
+	}
+	for i := range want {
+		if order[i] != want[i] {
+			t.Fatalf("order = %v, want %v", order, want)
+		}
+	}
+}
+
+func TestOutboxGivesUp(t *testing.T) {
+	attempts := 0
+	errSend := errors.New("rejected")
+	outbox := NewOutbox(func(ctx context.Context, payload *apns.MadridPayload) error {
+		attempts++
+		return errSend
+	})
+	defer outbox.Close()
+	outbox.SetMaxRetries(1)
+
+	if err := <-outbox.Enqueue(context.Background(), PriorityMessage, &apns.MadridPayload{}); !errors.Is(err, errSend) {
+		t.Fatalf("err = %v", err)
+	}
+	if attempts != 2 {
+		t.Errorf("attempts = %d, want 2", attempts)
+	}
+
+	attempts = 0
+	if err := <-outbox.Enqueue(context.Background(), PriorityStatus, &apns.MadridPayload{}); !errors.Is(err, errSend) {
+		t.Fatalf("err = %v", err)
+	}
+	if attempts != 1 {
+		t.Errorf("status payload attempted %d times, want 1", attempts)
+	}
+}
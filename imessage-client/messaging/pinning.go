@@ -0,0 +1,338 @@
+package messaging
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"time"
+
+	"imessage-client/messaging/ids"
+)
+
+// IdentityPin is the identity key first seen for one of a handle's devices.
+type IdentityPin struct {
+	// Fingerprint is the hex SHA-256 of the device's identity keys.
+	Fingerprint string
+	FirstSeen   time.Time
+}
+
+// IdentityPolicy decides what happens when a recipient's identity keys
+// differ from the pinned ones.
+type IdentityPolicy int
+
+const (
+	// IdentityChangeWarn emits an IdentityChangedEvent and pins the new keys.
+	IdentityChangeWarn IdentityPolicy = iota
+	// IdentityChangeRefuse fails sends to the handle with an
+	// IdentityChangedError until the new keys are trusted with TrustIdentity.
+	IdentityChangeRefuse
+)
+
+func (p IdentityPolicy) String() string {
+	switch p {
+	case IdentityChangeWarn:
+		return "warn"
+	case IdentityChangeRefuse:
+		return "refuse"
+	default:
+		return fmt.Sprintf("IdentityPolicy(%d)", int(p))
+	}
+}
+
+// ParseIdentityPolicy parses "warn" or "refuse".
+func ParseIdentityPolicy(s string) (IdentityPolicy, error) {
+	switch s {
+	case "warn":
+		return IdentityChangeWarn, nil
+	case "refuse":
+		return IdentityChangeRefuse, nil
+	default:
+		return 0, fmt.Errorf("unknown identity change policy %q (want warn or refuse)", s)
+	}
+}
+
+var ErrIdentityChanged = errors.New("recipient identity keys changed")
+
+// IdentityChangedError is returned by sends refused under
+// IdentityChangeRefuse. Changed and Added list push token fingerprints.
+type IdentityChangedError struct {
+	Handle  string
+	Changed []string
+	Added   []string
+}
+
+func (e IdentityChangedError) Error() string {
+	return fmt.Sprintf("%s for %s (%d changed, %d new devices); run verify to compare and trust them",
+		ErrIdentityChanged, e.Handle, len(e.Changed), len(e.Added))
+}
+
+func (e IdentityChangedError) Is(other error) bool {
+	return other == ErrIdentityChanged
+}
+
+// IdentityChangedEvent is emitted when a recipient's devices no longer match
+// their pinned identity keys. Changed devices have new keys under a known
+// push token; Added devices weren't seen before. Both list push token
+// fingerprints.
+type IdentityChangedEvent struct {
+	Handle  string
+	Changed []string
+	Added   []string
+	// Refused is set if the send that noticed the change was refused.
+	Refused bool
+}
+
+func (IdentityChangedEvent) isEvent() {}
+
+// PinStatus describes how a device's current keys compare to its pin.
+type PinStatus string
+
+const (
+	PinMatches PinStatus = "pinned"
+	PinNew     PinStatus = "new"
+	PinChanged PinStatus = "changed"
+)
+
+// DeviceIdentity is one of a handle's devices as shown by VerifyIdentity.
+type DeviceIdentity struct {
+	PushTokenFingerprint string
+	Fingerprint          string
+	Status               PinStatus
+	// FirstSeen is when the device's pinned keys were first seen, if pinned.
+	FirstSeen time.Time
+}
+
+// IdentityVerification is the current identity of a handle.
+type IdentityVerification struct {
+	Handle string
+	// Fingerprint covers the keys of all of the handle's devices. Both sides
+	// see the same digits when nothing has been tampered with.
+	Fingerprint string
+	Devices     []DeviceIdentity
+}
+
+// Changed reports whether any device differs from the pinned keys.
+func (v *IdentityVerification) Changed() bool {
+	for _, device := range v.Devices {
+		if device.Status != PinMatches {
+			return true
+		}
+	}
+	return false
+}
+
+// IdentityFingerprint returns a comparable fingerprint of a set of device
+// identities: 12 groups of 5 digits derived from the sorted key hashes, so
+// it doesn't depend on device order.
+func IdentityFingerprint(identities []*ids.UserIdentity) string {
+	hashes := make([][]byte, 0, len(identities))
+	for _, identity := range identities {
+		hashes = append(hashes, identity.Hash())
+	}
+	sort.Slice(hashes, func(i, j int) bool {
+		return bytes.Compare(hashes[i], hashes[j]) < 0
+	})
+	sum := sha512.Sum512(bytes.Join(hashes, nil))
+	groups := make([]string, 12)
+	for i := range groups {
+		var chunk [8]byte
+		copy(chunk[3:], sum[i*5:i*5+5])
+		groups[i] = fmt.Sprintf("%05d", binary.BigEndian.Uint64(chunk[:])%100000)
+	}
+	return strings.Join(groups, " ")
+}
+
+// SetIdentityPolicy sets what happens when a recipient's identity keys
+// change. Defaults to IdentityChangeWarn.
+func (s *Session) SetIdentityPolicy(policy IdentityPolicy) {
+	s.pinMu.Lock()
+	defer s.pinMu.Unlock()
+	s.identityPolicy = policy
+}
+
+// currentIdentities returns the identity of each device in result, keyed by
+// hex push token. Devices with unusable keys are left out.
+func currentIdentities(result *ids.LookupResult) map[string]*ids.UserIdentity {
+	current := make(map[string]*ids.UserIdentity)
+	if result == nil {
+		return current
+	}
+	for _, ident := range result.Identities {
+		identity, err := ident.IdentityKey()
+		if err != nil {
+			continue
+		}
+		current[hex.EncodeToString(ident.PushToken)] = identity
+	}
+	return current
+}
+
+func tokenFingerprint(hexToken string) string {
+	token, _ := hex.DecodeString(hexToken)
+	return ids.TokenFingerprint(token)
+}
+
+func pinStatus(pins map[string]IdentityPin, token string, identity *ids.UserIdentity) PinStatus {
+	pin, ok := pins[token]
+	switch {
+	case !ok:
+		return PinNew
+	case pin.Fingerprint != hex.EncodeToString(identity.Hash()):
+		return PinChanged
+	default:
+		return PinMatches
+	}
+}
+
+// checkIdentityPins compares handle's devices in result with their pins.
+// A handle seen for the first time is pinned as is. Otherwise changed or new
+// devices either refuse the send or, by default, are reported with an
+// IdentityChangedEvent and pinned.
+func (s *Session) checkIdentityPins(handle string, result *ids.LookupResult) error {
+	s.pinMu.Lock()
+	defer s.pinMu.Unlock()
+	current := currentIdentities(result)
+	if len(current) == 0 {
+		return nil
+	}
+	pins := s.store.IdentityPins(handle)
+	if len(pins) == 0 {
+		s.pinIdentitiesLocked(handle, pins, current)
+		return nil
+	}
+	var changed, added []string
+	for token, identity := range current {
+		switch pinStatus(pins, token, identity) {
+		case PinChanged:
+			changed = append(changed, tokenFingerprint(token))
+		case PinNew:
+			added = append(added, tokenFingerprint(token))
+		}
+	}
+	if len(changed) == 0 && len(added) == 0 {
+		return nil
+	}
+	sort.Strings(changed)
+	sort.Strings(added)
+	refuse := s.identityPolicy == IdentityChangeRefuse
+	s.emit(IdentityChangedEvent{Handle: handle, Changed: changed, Added: added, Refused: refuse})
+	if refuse {
+		return IdentityChangedError{Handle: handle, Changed: changed, Added: added}
+	}
+	s.pinIdentitiesLocked(handle, pins, current)
+	return nil
+}
+
+// pinIdentitiesLocked replaces handle's pins with the current devices,
+// keeping when unchanged keys were first seen. Caller must hold pinMu.
+func (s *Session) pinIdentitiesLocked(handle string, pins map[string]IdentityPin, current map[string]*ids.UserIdentity) {
+	now := time.Now()
+	updated := make(map[string]IdentityPin, len(current))
+	for token, identity := range current {
+		fingerprint := hex.EncodeToString(identity.Hash())
+		if pin, ok := pins[token]; ok && pin.Fingerprint == fingerprint {
+			updated[token] = pin
+			continue
+		}
+		updated[token] = IdentityPin{Fingerprint: fingerprint, FirstSeen: now}
+	}
+	if err := s.store.SetIdentityPins(handle, updated); err != nil {
+		slog.Warn("Failed to save identity pins", "handle", handle, "err", err)
+	}
+}
+
+// lookupIdentity looks handle up without using the cache. It returns the
+// handle in the form its pins are stored under.
+func (s *Session) lookupIdentity(ctx context.Context, handle string) (string, map[string]*ids.UserIdentity, error) {
+	if err := s.ensureHandshake(); err != nil {
+		return "", nil, err
+	}
+	if s.state.IDSConfig == nil {
+		return "", nil, ErrHandshakeNotImplemented
+	}
+	uri, err := ids.ParseURI(handle)
+	if err != nil {
+		return "", nil, err
+	}
+	handle = uri.String()
+	s.InvalidateLookup(handle)
+	results, err := s.Lookup(ctx, []string{handle})
+	if err != nil {
+		return "", nil, err
+	}
+	current := currentIdentities(results[handle])
+	if len(current) == 0 {
+		return "", nil, fmt.Errorf("%w: %s", ErrNotOnIMessage, handle)
+	}
+	return handle, current, nil
+}
+
+// VerifyIdentity looks up handle's current identity keys and compares them
+// with the pinned ones. It doesn't change any pins.
+func (s *Session) VerifyIdentity(ctx context.Context, handle string) (*IdentityVerification, error) {
+	handle, current, err := s.lookupIdentity(ctx, handle)
+	if err != nil {
+		return nil, err
+	}
+	pins := s.store.IdentityPins(handle)
+	verification := &IdentityVerification{Handle: handle}
+	identities := make([]*ids.UserIdentity, 0, len(current))
+	for token, identity := range current {
+		identities = append(identities, identity)
+		verification.Devices = append(verification.Devices, DeviceIdentity{
+			PushTokenFingerprint: tokenFingerprint(token),
+			Fingerprint:          hex.EncodeToString(identity.Hash()),
+			Status:               pinStatus(pins, token, identity),
+			FirstSeen:            pins[token].FirstSeen,
+		})
+	}
+	sort.Slice(verification.Devices, func(i, j int) bool {
+		return verification.Devices[i].PushTokenFingerprint < verification.Devices[j].PushTokenFingerprint
+	})
+	verification.Fingerprint = IdentityFingerprint(identities)
+	return verification, nil
+}
+
+// TrustIdentity pins handle's current identity keys, e.g. after comparing
+// the fingerprint from VerifyIdentity out of band.
+func (s *Session) TrustIdentity(ctx context.Context, handle string) error {
+	handle, current, err := s.lookupIdentity(ctx, handle)
+	if err != nil {
+		return err
+	}
+	s.pinMu.Lock()
+	defer s.pinMu.Unlock()
+	s.pinIdentitiesLocked(handle, s.store.IdentityPins(handle), current)
+	return nil
+}
+
+// SetIdentityPolicy sets what the client's sessions do when a recipient's
+// identity keys change.
+func (c *Client) SetIdentityPolicy(policy IdentityPolicy) {
+	c.identityPolicy = policy
+}
+
+// VerifyIdentity compares handle's current identity keys with the pinned ones.
+func (c *Client) VerifyIdentity(ctx context.Context, handle string) (*IdentityVerification, error) {
+	session, err := c.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return session.VerifyIdentity(ctx, handle)
+}
+
+// TrustIdentity pins handle's current identity keys.
+func (c *Client) TrustIdentity(ctx context.Context, handle string) error {
+	session, err := c.connect(ctx)
+	if err != nil {
+		return err
+	}
+	return session.TrustIdentity(ctx, handle)
+}
@@ -0,0 +1,88 @@
+package messaging
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"imessage-client/messaging/ids"
+)
+
+func TestIdentityPinning(t *testing.T) {
+	me := newTestDevice(t, "me")
+	theirPhone := newTestDevice(t, "their-phone")
+	const them = "tel:+15555550123"
+	session := testSendSession(t, me, map[string][]*testDevice{
+		them:                    {theirPhone},
+		"mailto:me@example.com": {me},
+	})
+	var events []IdentityChangedEvent
+	session.OnEvent(func(evt Event) {
+		if evt, ok := evt.(IdentityChangedEvent); ok {
+			events = append(events, evt)
+		}
+	})
+	recipient, _ := ids.ParseURI(them)
+	buildDTL := func() error {
+		_, err := session.buildDTL(context.Background(), session.state.IDSConfig, []ids.ParsedURI{recipient}, []byte("body"), false)
+		return err
+	}
+
+	// First contact pins the keys silently
+	if err := buildDTL(); err != nil {
+		t.Fatal(err)
+	}
+	if pins := session.store.IdentityPins(them); len(pins) != 1 {
+		t.Fatalf("got %d pins, want 1", len(pins))
+	}
+	if len(events) != 0 {
+		t.Fatalf("got %d events on first contact", len(events))
+	}
+
+	// The same token with new keys is refused under IdentityChangeRefuse
+	rotated := newTestDevice(t, "their-phone")
+	session.lookupCache.Put(them, &ids.LookupResult{Time: time.Now(), Identities: []ids.LookupIdentity{rotated.ident}})
+	session.SetIdentityPolicy(IdentityChangeRefuse)
+	err := buildDTL()
+	var changed IdentityChangedError
+	if !errors.As(err, &changed) || !errors.Is(err, ErrIdentityChanged) {
+		t.Fatalf("err = %v, want IdentityChangedError", err)
+	}
+	if len(changed.Changed) != 1 || len(changed.Added) != 0 {
+		t.Errorf("changed = %v, added = %v", changed.Changed, changed.Added)
+	}
+	if len(events) != 1 || !events[0].Refused {
+		t.Fatalf("events = %+v, want one refused change", events)
+	}
+
+	// Warning instead pins the new keys, so the next send goes through quietly
+	session.SetIdentityPolicy(IdentityChangeWarn)
+	if err := buildDTL(); err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 || events[1].Refused {
+		t.Fatalf("events = %+v, want a second, unrefused change", events)
+	}
+	if err := buildDTL(); err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 {
+		t.Errorf("got %d events after the new keys were pinned", len(events))
+	}
+}
+
+func TestIdentityFingerprintIgnoresDeviceOrder(t *testing.T) {
+	a := newTestDevice(t, "a").identity
+	b := newTestDevice(t, "b").identity
+	ab := IdentityFingerprint([]*ids.UserIdentity{a, b})
+	if ba := IdentityFingerprint([]*ids.UserIdentity{b, a}); ab != ba {
+		t.Errorf("fingerprint depends on order: %q != %q", ab, ba)
+	}
+	if len(ab) != 12*5+11 {
+		t.Errorf("fingerprint %q has unexpected length", ab)
+	}
+	if IdentityFingerprint([]*ids.UserIdentity{a}) == ab {
+		t.Error("fingerprint didn't change with the device set")
+	}
+}
@@ -0,0 +1,81 @@
+package messaging
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// Defaults for polling mode.
+const (
+	// DefaultPollQuiet is how long the courier must stay quiet before the
+	// queue it kept for us counts as drained.
+	DefaultPollQuiet = 3 * time.Second
+	// maxPollDrain caps how long one poll stays connected.
+	maxPollDrain = time.Minute
+)
+
+// Disconnect closes the courier connection without reconnecting. Later
+// sends and fetches connect again on demand.
+func (s *Session) Disconnect() error {
+	s.reconnectMu.Lock()
+	defer s.reconnectMu.Unlock()
+	if s.state == nil || s.state.APNSConn == nil {
+		return nil
+	}
+	if s.readLoopCancel != nil {
+		s.readLoopCancel()
+	}
+	return s.state.APNSConn.Close()
+}
+
+// Poll connects to the courier, receives and acks everything it queued
+// while we were away, and disconnects again. The queue counts as drained
+// once nothing has arrived for quiet.
+func (s *Session) Poll(ctx context.Context, quiet time.Duration) error {
+	if err := s.ensureHandshake(); err != nil {
+		return err
+	}
+	if err := s.ensureAPNS(ctx); err != nil {
+		return err
+	}
+	defer s.Disconnect()
+
+	start := time.Now()
+	deadline := start.Add(maxPollDrain)
+	for {
+		last := start
+		if nanos := s.lastIncoming.Load(); nanos > last.UnixNano() {
+			last = time.Unix(0, nanos)
+		}
+		wait := time.Until(last.Add(quiet))
+		if wait <= 0 || time.Now().After(deadline) {
+			return nil
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-s.closing:
+			return nil
+		}
+	}
+}
+
+// RunPolling polls every interval instead of holding the connection open,
+// for hosts where a persistent connection costs too much battery or keeps
+// breaking. It returns when ctx is done.
+func (s *Session) RunPolling(ctx context.Context, interval, quiet time.Duration) {
+	for {
+		if err := s.Poll(ctx, quiet); err != nil && ctx.Err() == nil {
+			slog.Warn("Poll failed", "err", err)
+		}
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return
+		case <-s.closing:
+			return
+		}
+	}
+}
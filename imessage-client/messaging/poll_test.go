@@ -0,0 +1,49 @@
+package messaging
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"imessage-client/messaging/apns"
+	"imessage-client/messaging/apns/apnstest"
+)
+
+func TestPollDrainsAcksAndDisconnects(t *testing.T) {
+	server, err := apnstest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	session := testSession(t)
+	session.state = &handshakeState{APNSConn: testAPNSConnection(t, server)}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- session.Poll(ctx, 200*time.Millisecond) }()
+
+	if _, err := server.WaitFor(ctx, apns.CommandFilterTopics); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Inject(apns.TopicMadrid, []byte("queued while away")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.WaitFor(ctx, apns.CommandSendMessageAck); err != nil {
+		t.Fatalf("incoming message not acked: %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if session.state.APNSConn.Connected() {
+		t.Error("still connected after the poll")
+	}
+	messages, err := session.drainMessages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 1 {
+		t.Errorf("got %d messages, want 1", len(messages))
+	}
+}
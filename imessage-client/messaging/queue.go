@@ -0,0 +1,122 @@
+package messaging
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+)
+
+// DefaultMessageQueueSize is how many incoming messages a session buffers
+// for FetchMessages before its overflow policy applies.
+const DefaultMessageQueueSize = 256
+
+var ErrMessageQueueFull = errors.New("message queue full")
+
+// SetMessageQueue sets the capacity of the queue FetchMessages drains and
+// what happens when it's full. OverflowSpill moves messages that don't fit
+// into the store, where FetchMessages picks them up again. Messages already
+// queued are kept, even if they exceed the new capacity.
+func (s *Session) SetMessageQueue(capacity int, overflow OverflowPolicy) {
+	if capacity <= 0 {
+		capacity = DefaultMessageQueueSize
+	}
+	s.queueMu.Lock()
+	defer s.queueMu.Unlock()
+	old := s.messageChan
+	s.messageChan = make(chan *Message, max(capacity, len(old)))
+	s.queueOverflow = overflow
+	for len(old) > 0 {
+		s.messageChan <- <-old
+	}
+	s.signalQueueRoomLocked()
+}
+
+// signalQueueRoomLocked wakes producers waiting for room in the queue.
+// Caller must hold queueMu for writing.
+func (s *Session) signalQueueRoomLocked() {
+	close(s.queueRoom)
+	s.queueRoom = make(chan struct{})
+}
+
+// queueMessage adds msg to the FetchMessages queue according to the
+// session's overflow policy.
+func (s *Session) queueMessage(msg *Message) error {
+	for {
+		wait, err := s.tryQueueMessage(msg)
+		if wait == nil {
+			return err
+		}
+		// Wait for room without holding queueMu, so SetMessageQueue can't
+		// get stuck behind a blocked producer
+		select {
+		case <-wait:
+		case <-s.closing:
+			return ErrMessageQueueFull
+		}
+	}
+}
+
+// tryQueueMessage queues msg without blocking. Under OverflowBlock with a
+// full queue it returns a channel that's closed once there may be room.
+func (s *Session) tryQueueMessage(msg *Message) (wait <-chan struct{}, err error) {
+	s.queueMu.RLock()
+	defer s.queueMu.RUnlock()
+	select {
+	case s.messageChan <- msg:
+		return nil, nil
+	default:
+	}
+
+	switch s.queueOverflow {
+	case OverflowBlock:
+		return s.queueRoom, nil
+	case OverflowDropNewest:
+		return nil, ErrMessageQueueFull
+	case OverflowSpill:
+		if err := s.store.SpillMessage(*msg); err != nil {
+			return nil, fmt.Errorf("%w: failed to spill to store: %v", ErrMessageQueueFull, err)
+		}
+		return nil, nil
+	default:
+		for {
+			select {
+			case s.messageChan <- msg:
+				return nil, nil
+			default:
+			}
+			select {
+			case dropped := <-s.messageChan:
+				slog.Warn("Message queue full, dropped message", "id", dropped.ID)
+			default:
+			}
+		}
+	}
+}
+
+// drainMessages takes everything queued, followed by the newer messages
+// that were spilled to the store when the queue was full.
+func (s *Session) drainMessages() ([]Message, error) {
+	var messages []Message
+	s.queueMu.Lock()
+drain:
+	for {
+		select {
+		case msg := <-s.messageChan:
+			if msg != nil {
+				messages = append(messages, *msg)
+			}
+		default:
+			break drain
+		}
+	}
+	if len(messages) > 0 {
+		s.signalQueueRoomLocked()
+	}
+	s.queueMu.Unlock()
+
+	spilled, err := s.store.TakeSpilledMessages()
+	if err != nil {
+		return messages, fmt.Errorf("failed to load spilled messages: %w", err)
+	}
+	return append(messages, spilled...), nil
+}
@@ -0,0 +1,118 @@
+package messaging
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"imessage-client/config"
+)
+
+func TestMessageQueueOverflow(t *testing.T) {
+	session := testSession(t)
+	session.SetMessageQueue(2, OverflowDropOldest)
+	for _, id := range []string{"1", "2", "3"} {
+		if err := session.enqueue(&Message{ID: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	messages, err := session.drainMessages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 2 || messages[0].ID != "2" || messages[1].ID != "3" {
+		t.Errorf("drop-oldest kept %v", messages)
+	}
+
+	session.SetMessageQueue(1, OverflowDropNewest)
+	_ = session.enqueue(&Message{ID: "4"})
+	if err := session.enqueue(&Message{ID: "5"}); !errors.Is(err, ErrMessageQueueFull) {
+		t.Errorf("err = %v, want ErrMessageQueueFull", err)
+	}
+}
+
+func TestMessageQueueSpill(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	store, err := NewFileStoreWithFlushInterval(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg := &config.RegistrationData{ValidationData: []byte("v"), ValidUntil: time.Now().Add(time.Hour)}
+	session, err := Connect(context.Background(), reg, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	session.SetMessageQueue(1, OverflowSpill)
+
+	for _, id := range []string{"1", "2", "3"} {
+		if err := session.enqueue(&Message{ID: id, Chat: "c"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Spilled messages survive a restart
+	reopened, err := NewFileStoreWithFlushInterval(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spilled, _ := reopened.TakeSpilledMessages()
+	if len(spilled) != 2 {
+		t.Errorf("store has %d spilled messages, want 2", len(spilled))
+	}
+
+	messages, err := session.drainMessages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, msg := range messages {
+		ids = append(ids, msg.ID)
+	}
+	if len(ids) != 3 || ids[0] != "1" || ids[1] != "2" || ids[2] != "3" {
+		t.Errorf("drained %v, want [1 2 3]", ids)
+	}
+	if rest, _ := store.TakeSpilledMessages(); len(rest) != 0 {
+		t.Errorf("spilled messages not removed from store: %v", rest)
+	}
+}
+
+func TestMessageQueueBlockReleasesLock(t *testing.T) {
+	session := testSession(t)
+	session.SetMessageQueue(1, OverflowBlock)
+	if err := session.enqueue(&Message{ID: "1"}); err != nil {
+		t.Fatal(err)
+	}
+	queued := make(chan error, 1)
+	go func() { queued <- session.enqueue(&Message{ID: "2"}) }()
+	time.Sleep(50 * time.Millisecond)
+
+	// Resizing mustn't wait for the blocked producer, and makes room for it
+	resized := make(chan struct{})
+	go func() {
+		session.SetMessageQueue(2, OverflowBlock)
+		close(resized)
+	}()
+	select {
+	case <-resized:
+	case <-time.After(time.Second):
+		t.Fatal("SetMessageQueue deadlocked with a blocked producer")
+	}
+	select {
+	case err := <-queued:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("producer still blocked after the queue grew")
+	}
+	messages, err := session.drainMessages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 2 || messages[0].ID != "1" || messages[1].ID != "2" {
+		t.Errorf("drained %v", messages)
+	}
+}
@@ -0,0 +1,174 @@
+package messaging
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+
+	"imessage-client/messaging/apns"
+	"imessage-client/messaging/ids"
+)
+
+// ReadOptions customizes MarkRead.
+type ReadOptions struct {
+	// NoReceipt only updates the store, without telling the sender or our
+	// other devices.
+	NoReceipt bool
+}
+
+// MarkRead marks chat's incoming messages read up to and including
+// messageID, or all of them if messageID is empty, and sends a read receipt
+// for it to the chat and our other devices. It returns how many messages
+// were newly marked read.
+func (s *Session) MarkRead(ctx context.Context, chat, messageID string, opts ReadOptions) (int, error) {
+	chat = canonicalChat(chat)
+	if messageID == "" {
+		messageID = s.store.Cursor(chat).LastMessageID
+		if messageID == "" {
+			return 0, nil
+		}
+	} else {
+		id, err := normalizeMessageUUID(messageID)
+		if err != nil {
+			return 0, err
+		}
+		messageID = id
+	}
+	target, ok := s.store.MessageStatus(messageID)
+	if !ok || target.Chat != chat {
+		return 0, fmt.Errorf("%w: %s in %s", ErrUnknownMessage, messageID, chat)
+	}
+
+	now := time.Now()
+	marked := 0
+	for id, status := range s.store.ChatMessages(chat) {
+		if status.FromMe || !status.Read.IsZero() || status.Delivered.After(target.Time()) {
+			continue
+		}
+		if err := MarkRead(s.store, id, chat, false, now); err != nil {
+			return marked, err
+		}
+		marked++
+	}
+	if marked == 0 || opts.NoReceipt || target.FromMe {
+		return marked, nil
+	}
+	return marked, s.sendReadReceipt(ctx, chat, messageID)
+}
+
+// MarkAllRead marks every chat in the store read. It returns how many
+// messages were newly marked read.
+func (s *Session) MarkAllRead(ctx context.Context, opts ReadOptions) (int, error) {
+	total := 0
+	for _, chat := range s.store.Chats() {
+		marked, err := s.MarkRead(ctx, chat, "", opts)
+		total += marked
+		if err != nil {
+			return total, fmt.Errorf("failed to mark %s read: %w", chat, err)
+		}
+	}
+	return total, nil
+}
+
+// UnreadChat is a chat with incoming messages that haven't been read.
+type UnreadChat struct {
+	Chat  string
+	Count int
+	// Latest is when the newest unread message was delivered.
+	Latest time.Time
+	// Muted is set for chats muted with Mute.
+	Muted bool
+}
+
+// Unread lists the chats in store with unread incoming messages, most
+// recently active first, leaving out snoozed chats. It only reads the store,
+// so it's cheap enough for status bars to call every few seconds.
+func Unread(store Store) []UnreadChat {
+	now := time.Now()
+	var unread []UnreadChat
+	for _, chat := range store.Chats() {
+		if isSnoozed(store, chat, now) {
+			continue
+		}
+		entry := UnreadChat{Chat: chat, Muted: IsMuted(store, chat, now)}
+		for _, status := range store.ChatMessages(chat) {
+			if status.FromMe || !status.Read.IsZero() {
+				continue
+			}
+			entry.Count++
+			if status.Delivered.After(entry.Latest) {
+				entry.Latest = status.Delivered
+			}
+		}
+		if entry.Count > 0 {
+			unread = append(unread, entry)
+		}
+	}
+	sort.SliceStable(unread, func(i, j int) bool {
+		return unread[i].Latest.After(unread[j].Latest)
+	})
+	return unread
+}
+
+// sendReadReceipt tells the chat's devices and ours that messages up to
+// messageID were read.
+func (s *Session) sendReadReceipt(ctx context.Context, chat, messageID string) error {
+	if err := s.ensureHandshake(); err != nil {
+		return err
+	}
+	cfg := s.state.IDSConfig
+	if cfg == nil || cfg.IDSEncryptionKey == nil || cfg.IDSSigningKey == nil || cfg.DefaultHandle.IsEmpty() {
+		return ErrHandshakeNotImplemented
+	}
+	recipient, err := ids.ParseURI(chat)
+	if err != nil {
+		return err
+	}
+	readUpTo, err := uuid.Parse(messageID)
+	if err != nil {
+		return fmt.Errorf("%w %q: %v", ErrInvalidMessageUUID, messageID, err)
+	}
+	dtl, err := s.buildDTL(ctx, cfg, []ids.ParsedURI{recipient}, nil, true)
+	if err != nil {
+		return err
+	}
+	noResponseNeeded := true
+	receipt := &apns.MadridPayload{
+		Command:           apns.MessageTypeReadReceipt,
+		MessageID:         binary.BigEndian.Uint32(apns.NewMessageID()),
+		MessageUUID:       readUpTo[:],
+		Timestamp:         time.Now().UnixNano(),
+		SenderID:          cfg.DefaultHandle.String(),
+		Version:           8,
+		UserAgent:         cfg.CombinedVersion(),
+		NoResponseNeeded:  &noResponseNeeded,
+		FanoutChunkNumber: 1,
+		DTL:               dtl,
+	}
+	if err := <-s.outbox.Enqueue(ctx, PriorityStatus, receipt); err != nil {
+		return fmt.Errorf("failed to send read receipt: %w", err)
+	}
+	return nil
+}
+
+// MarkRead marks chat's messages read up to messageID, or all of them.
+func (c *Client) MarkRead(ctx context.Context, chat, messageID string, opts ReadOptions) (int, error) {
+	session, err := c.connect(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return session.MarkRead(ctx, chat, messageID, opts)
+}
+
+// MarkAllRead marks every chat in the client's store read.
+func (c *Client) MarkAllRead(ctx context.Context, opts ReadOptions) (int, error) {
+	session, err := c.connect(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return session.MarkAllRead(ctx, opts)
+}
@@ -0,0 +1,107 @@
+package messaging
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	"imessage-client/messaging/apns"
+	"imessage-client/messaging/apns/apnstest"
+)
+
+func TestMarkReadSendsReceiptUpToMessage(t *testing.T) {
+	server, err := apnstest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	me := newTestDevice(t, "me")
+	theirPhone := newTestDevice(t, "their-phone")
+	const chat = "tel:+15555550123"
+	session := testSendSession(t, me, map[string][]*testDevice{
+		chat:                    {theirPhone},
+		"mailto:me@example.com": {me},
+	})
+	session.state.APNSConn = testAPNSConnection(t, server)
+
+	base := time.Now().Add(-time.Hour)
+	ids := []string{
+		"0F5A0D2E-6F43-4C59-9B63-2C4C5B6A7E10",
+		"1F5A0D2E-6F43-4C59-9B63-2C4C5B6A7E10",
+		"2F5A0D2E-6F43-4C59-9B63-2C4C5B6A7E10",
+	}
+	for i, id := range ids {
+		if err := MarkDelivered(session.store, id, chat, false, base.Add(time.Duration(i)*time.Minute)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := session.store.SetCursor(chat, ChatCursor{LastMessageID: ids[2]}); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	marked, err := session.MarkRead(ctx, chat, ids[1], ReadOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if marked != 2 {
+		t.Errorf("marked %d, want 2", marked)
+	}
+	if status, _ := session.store.MessageStatus(ids[2]); !status.Read.IsZero() {
+		t.Error("message after the read marker was marked read")
+	}
+
+	sent, err := server.WaitFor(ctx, apns.CommandSendMessage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	receipt, err := apns.ParseMadridPayload(sent.Field(apns.FieldOutgoingPayload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if receipt.Command != apns.MessageTypeReadReceipt || uuid.UUID(receipt.MessageUUID).String() != "1f5a0d2e-6f43-4c59-9b63-2c4c5b6a7e10" {
+		t.Errorf("receipt = %v for %x", receipt.Command, receipt.MessageUUID)
+	}
+	if len(receipt.DTL) != 1 || receipt.DTL[0].DestinationID != chat {
+		t.Errorf("DTL = %+v", receipt.DTL)
+	}
+
+	// Without a message ID everything up to the cursor is marked, locally only
+	marked, err = session.MarkAllRead(ctx, ReadOptions{NoReceipt: true})
+	if err != nil || marked != 1 {
+		t.Errorf("MarkAllRead = %d, %v; want 1", marked, err)
+	}
+}
+
+func TestUnreadOrdersByLatest(t *testing.T) {
+	store := NewMemoryStore()
+	base := time.Now().Add(-time.Hour)
+	mark := func(id, chat string, fromMe bool, at time.Duration) {
+		t.Helper()
+		if err := MarkDelivered(store, id, chat, fromMe, base.Add(at)); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.SetCursor(chat, ChatCursor{LastMessageID: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mark("a1", "tel:+15555550123", false, 0)
+	mark("a2", "tel:+15555550123", false, time.Minute)
+	mark("b1", "mailto:b@example.com", false, 2*time.Minute)
+	mark("c1", "mailto:c@example.com", true, 3*time.Minute)
+
+	got := Unread(store)
+	if len(got) != 2 {
+		t.Fatalf("got %+v, want 2 chats", got)
+	}
+	if got[0].Chat != "mailto:b@example.com" || got[0].Count != 1 {
+		t.Errorf("first = %+v", got[0])
+	}
+	if got[1].Chat != "tel:+15555550123" || got[1].Count != 2 {
+		t.Errorf("second = %+v", got[1])
+	}
+}
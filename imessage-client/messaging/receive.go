@@ -2,54 +2,84 @@ package messaging
 
 import (
 	"context"
-	"time"
+	"log/slog"
+	"sort"
 )
 
-// FetchMessages drains accumulated messages from APNS.
+// FetchMessages drains accumulated messages from APNS, including any the
+// queue spilled to the store.
 func (s *Session) FetchMessages(ctx context.Context) ([]Message, error) {
 	if err := s.ensureHandshake(); err != nil {
 		return nil, err
 	}
-
-	// Drain all messages from the channel
-	var messages []Message
-	for {
-		select {
-		case msg := <-s.messageChan:
-			if msg != nil {
-				messages = append(messages, *msg)
-			}
-		default:
-			// No more messages
-			return messages, nil
-		}
+	if err := s.ensureAPNS(ctx); err != nil {
+		// Still hand out what arrived before the connection dropped
+		slog.Warn("Failed to reconnect to APNS, returning messages received so far", "err", err)
 	}
+	s.markActivity()
+
+	// Everything queued first, then the newer messages spilled to the store
+	return s.drainMessages()
 }
 
 // filterUnread compares fetched messages against store to emit only new ones.
+// Each chat's cursor records the last message UUID seen; messages up to and
+// including that UUID in this batch are considered read.
 func (s *Session) filterUnread(messages []Message) []Message {
+	ordered := make([]Message, len(messages))
+	copy(ordered, messages)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return ordered[i].Sequence < ordered[j].Sequence
+	})
+
+	// Find the position of each chat's last seen message in this batch.
+	seenUpTo := make(map[string]int)
+	for i, msg := range ordered {
+		cursor := s.store.Cursor(msg.Chat)
+		if cursor.LastMessageID != "" && msg.ID == cursor.LastMessageID {
+			seenUpTo[msg.Chat] = i
+		}
+	}
+
 	var unread []Message
-	for _, msg := range messages {
-		lastSeen := s.store.LastSeen(msg.Chat)
-		if msg.Timestamp.After(lastSeen) {
-			unread = append(unread, msg)
+	for i, msg := range ordered {
+		if idx, ok := seenUpTo[msg.Chat]; ok && i <= idx {
+			continue
 		}
+		unread = append(unread, msg)
 	}
 	return unread
 }
 
-// updateStore marks messages as seen per chat.
+// updateStore advances each chat's cursor to its newest message and records
+// the messages as delivered to us.
 func (s *Session) updateStore(messages []Message) error {
-	chatLatest := make(map[string]time.Time)
+	latest := make(map[string]Message)
+	counts := make(map[string]uint64)
 	for _, msg := range messages {
-		if existing, ok := chatLatest[msg.Chat]; !ok || msg.Timestamp.After(existing) {
-			chatLatest[msg.Chat] = msg.Timestamp
+		counts[msg.Chat]++
+		if existing, ok := latest[msg.Chat]; !ok || msg.Sequence > existing.Sequence {
+			latest[msg.Chat] = msg
 		}
 	}
-	for chat, ts := range chatLatest {
-		if err := s.store.SetLastSeen(chat, ts); err != nil {
+	for chat, msg := range latest {
+		cursor := s.store.Cursor(chat)
+		cursor.LastMessageID = msg.ID
+		cursor.Counter += counts[chat]
+		cursor.Timestamp = msg.Timestamp
+		if err := s.store.SetCursor(chat, cursor); err != nil {
 			return err
 		}
 	}
+	for _, msg := range messages {
+		if err := MarkReceived(s.store, msg); err != nil {
+			return err
+		}
+		if msg.IsFromMe {
+			if _, err := markReadBefore(s.store, msg.Chat, msg.Timestamp); err != nil {
+				return err
+			}
+		}
+	}
 	return nil
 }
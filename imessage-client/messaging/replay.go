@@ -0,0 +1,85 @@
+package messaging
+
+import (
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"io"
+
+	"howett.net/plist"
+
+	"imessage-client/messaging/apns"
+	"imessage-client/messaging/trace"
+)
+
+var ErrRedactedFrame = errors.New("frame has redacted fields")
+
+// ReplayResult is the outcome of feeding one traced entry back through the
+// parsing and decryption pipeline.
+type ReplayResult struct {
+	Index int
+	Entry trace.Entry
+
+	// Madrid is the decoded envelope of an incoming APNS message.
+	Madrid *apns.MadridPayload
+	// Message is set if the payload was decrypted.
+	Message *Message
+	Err     error
+}
+
+// ReplayTrace reads a trace recorded with --trace-file and runs every
+// incoming APNS message and IDS response through the same decoding used for
+// live traffic. Without a key, messages are only parsed, not decrypted.
+func ReplayTrace(r io.Reader, key *rsa.PrivateKey, fn func(ReplayResult)) error {
+	index := 0
+	return trace.ReadEntries(r, func(entry trace.Entry) error {
+		index++
+		if entry.Direction != trace.In {
+			return nil
+		}
+		result := ReplayResult{Index: index, Entry: entry}
+		switch entry.Source {
+		case trace.SourceAPNS:
+			if apns.CommandID(entry.Command) != apns.CommandSendMessage {
+				return nil
+			}
+			result.Madrid, result.Message, result.Err = replayAPNSMessage(entry, key)
+		case trace.SourceIDS:
+			if entry.Body != "" {
+				var parsed any
+				if _, err := plist.Unmarshal([]byte(entry.Body), &parsed); err != nil {
+					result.Err = fmt.Errorf("failed to parse IDS response: %w", err)
+				}
+			}
+		default:
+			return nil
+		}
+		fn(result)
+		return nil
+	})
+}
+
+func replayAPNSMessage(entry trace.Entry, key *rsa.PrivateKey) (*apns.MadridPayload, *Message, error) {
+	payload := &apns.Payload{ID: apns.CommandID(entry.Command)}
+	for _, field := range entry.Fields {
+		if field.Redacted {
+			return nil, nil, ErrRedactedFrame
+		}
+		payload.Fields = append(payload.Fields, apns.Field{ID: apns.FieldID(field.ID), Value: field.Value})
+	}
+	var msg apns.IncomingSendMessageCommand
+	msg.FromPayload(payload)
+
+	if key == nil {
+		madrid, err := apns.ParseMadridPayload(msg.Payload)
+		if err != nil {
+			return nil, nil, err
+		}
+		return madrid, nil, nil
+	}
+	imsg, madrid, err := decodeIncoming(key, msg.Payload)
+	if err != nil {
+		return madrid, nil, fmt.Errorf("decryption failed: %w", err)
+	}
+	return madrid, newIncomingMessage(imsg, madrid, string(msg.Topic), nil), nil
+}
@@ -0,0 +1,234 @@
+package messaging
+
+import (
+	"html"
+	"strings"
+	"unicode"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// TextStyle is the formatting of a run of text.
+type TextStyle struct {
+	Bold      bool   `json:"bold,omitempty"`
+	Italic    bool   `json:"italic,omitempty"`
+	Underline bool   `json:"underline,omitempty"`
+	Link      string `json:"link,omitempty"`
+	// Mention is the handle of the person mentioned by the text.
+	Mention string `json:"mention,omitempty"`
+}
+
+// TextRange is a run of text sharing one style. Start and Length count
+// UTF-16 code units, as NSRange does.
+type TextRange struct {
+	Start  int       `json:"start"`
+	Length int       `json:"length"`
+	Style  TextStyle `json:"style"`
+}
+
+// RichText is message text with formatting. Text is what clients that don't
+// render formatting show. Ranges are sorted, don't overlap, and only cover
+// styled text.
+type RichText struct {
+	Text   string      `json:"text"`
+	Ranges []TextRange `json:"ranges,omitempty"`
+}
+
+// PlainText is text without any formatting.
+func PlainText(text string) RichText {
+	return RichText{Text: text}
+}
+
+// Styled reports whether any of the text is formatted.
+func (r RichText) Styled() bool {
+	return len(r.Ranges) > 0
+}
+
+// HTML renders the text as the inner markup of a message XML part.
+func (r RichText) HTML() string {
+	units := utf16.Encode([]rune(r.Text))
+	segment := func(from, to int) string {
+		return html.EscapeString(string(utf16.Decode(units[from:to])))
+	}
+	var b strings.Builder
+	pos := 0
+	for _, rng := range r.Ranges {
+		b.WriteString(segment(pos, rng.Start))
+		open, closing := styleTags(rng.Style)
+		b.WriteString(open)
+		b.WriteString(segment(rng.Start, rng.Start+rng.Length))
+		b.WriteString(closing)
+		pos = rng.Start + rng.Length
+	}
+	b.WriteString(segment(pos, len(units)))
+	return b.String()
+}
+
+func styleTags(style TextStyle) (open, closing string) {
+	tag := func(o, c string) {
+		open += o
+		closing = c + closing
+	}
+	if style.Link != "" {
+		tag(`<a href="`+html.EscapeString(style.Link)+`">`, "</a>")
+	}
+	if style.Bold {
+		tag("<b>", "</b>")
+	}
+	if style.Italic {
+		tag("<i>", "</i>")
+	}
+	if style.Underline {
+		tag("<u>", "</u>")
+	}
+	return open, closing
+}
+
+// richTextBuilder collects runs of text, merging neighbors of the same style.
+type richTextBuilder struct {
+	text   strings.Builder
+	units  int
+	ranges []TextRange
+}
+
+func (b *richTextBuilder) write(s string, style TextStyle) {
+	if s == "" {
+		return
+	}
+	n := len(utf16.Encode([]rune(s)))
+	b.text.WriteString(s)
+	start := b.units
+	b.units += n
+	if style == (TextStyle{}) {
+		return
+	}
+	if last := len(b.ranges) - 1; last >= 0 && b.ranges[last].Style == style && b.ranges[last].Start+b.ranges[last].Length == start {
+		b.ranges[last].Length += n
+		return
+	}
+	b.ranges = append(b.ranges, TextRange{Start: start, Length: n, Style: style})
+}
+
+// ParseMarkdown converts a small markdown subset to rich text: **bold**,
+// *italic* or _italic_, __underline__ and [text](url) links. A backslash
+// escapes a marker. Markers that aren't closed, or that sit inside a word
+// like snake_case, are kept as literal text.
+func ParseMarkdown(src string) RichText {
+	var b richTextBuilder
+	parseInline(&b, src, TextStyle{})
+	return RichText{Text: b.text.String(), Ranges: b.ranges}
+}
+
+func parseInline(b *richTextBuilder, src string, style TextStyle) {
+	var literal strings.Builder
+	flush := func() {
+		b.write(literal.String(), style)
+		literal.Reset()
+	}
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == '\\' && i+1 < len(src) && isMarker(src[i+1]):
+			literal.WriteByte(src[i+1])
+			i += 2
+			continue
+		case c == '[':
+			if text, url, n, ok := parseLink(src[i:]); ok && style.Link == "" {
+				flush()
+				inner := style
+				inner.Link = url
+				parseInline(b, text, inner)
+				i += n
+				continue
+			}
+		case c == '*' || c == '_':
+			marker := src[i : i+1]
+			if strings.HasPrefix(src[i:], marker+marker) {
+				marker += marker
+			}
+			if inner, n, ok := delimited(src, i, marker); ok {
+				flush()
+				next := style
+				switch marker {
+				case "**":
+					next.Bold = true
+				case "__":
+					next.Underline = true
+				default:
+					next.Italic = true
+				}
+				parseInline(b, inner, next)
+				i += n
+				continue
+			}
+		}
+		_, size := utf8.DecodeRuneInString(src[i:])
+		literal.WriteString(src[i : i+size])
+		i += size
+	}
+	flush()
+}
+
+func isMarker(c byte) bool {
+	return strings.IndexByte(`\*_[]()`, c) >= 0
+}
+
+// delimited finds the text between the marker at src[at:] and its closing
+// marker. The opening marker must start a word and the closing one end it,
+// and the text between them can't start or end with a space.
+func delimited(src string, at int, marker string) (inner string, n int, ok bool) {
+	if wordBefore(src, at) {
+		return "", 0, false
+	}
+	start := at + len(marker)
+	for j := start; j+len(marker) <= len(src); j++ {
+		if src[j] == '\\' {
+			j++
+			continue
+		}
+		if !strings.HasPrefix(src[j:], marker) {
+			continue
+		}
+		end := j + len(marker)
+		if j == start || (end < len(src) && (wordAt(src, end) || src[end] == marker[0])) {
+			continue
+		}
+		inner = src[start:j]
+		first, _ := utf8.DecodeRuneInString(inner)
+		last, _ := utf8.DecodeLastRuneInString(inner)
+		if unicode.IsSpace(first) || unicode.IsSpace(last) {
+			continue
+		}
+		return inner, end - at, true
+	}
+	return "", 0, false
+}
+
+// wordBefore reports whether a letter or digit ends s[:i].
+func wordBefore(s string, i int) bool {
+	r, size := utf8.DecodeLastRuneInString(s[:i])
+	return size > 0 && (unicode.IsLetter(r) || unicode.IsDigit(r))
+}
+
+// wordAt reports whether a letter or digit starts s[i:].
+func wordAt(s string, i int) bool {
+	r, size := utf8.DecodeRuneInString(s[i:])
+	return size > 0 && (unicode.IsLetter(r) || unicode.IsDigit(r))
+}
+
+// parseLink parses "[text](url)" at the start of src.
+func parseLink(src string) (text, url string, n int, ok bool) {
+	closeText := strings.Index(src, "](")
+	if closeText <= 1 {
+		return "", "", 0, false
+	}
+	closeURL := strings.IndexByte(src[closeText+2:], ')')
+	if closeURL <= 0 {
+		return "", "", 0, false
+	}
+	url = src[closeText+2 : closeText+2+closeURL]
+	if strings.ContainsAny(url, " \n") {
+		return "", "", 0, false
+	}
+	return src[1:closeText], url, closeText + 3 + closeURL, true
+}
@@ -0,0 +1,64 @@
+package messaging
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseMarkdown(t *testing.T) {
+	bold := TextStyle{Bold: true}
+	tests := []struct {
+		src    string
+		text   string
+		ranges []TextRange
+		html   string
+	}{
+		{"plain", "plain", nil, "plain"},
+		{"a **b** c", "a b c", []TextRange{{2, 1, bold}}, "a <b>b</b> c"},
+		{"*it* and __un__", "it and un", []TextRange{{0, 2, TextStyle{Italic: true}}, {7, 2, TextStyle{Underline: true}}}, "<i>it</i> and <u>un</u>"},
+		{"**_both_**", "both", []TextRange{{0, 4, TextStyle{Bold: true, Italic: true}}}, "<b><i>both</i></b>"},
+		{"see [docs](https://x.test/?a=1&b=2)", "see docs", []TextRange{{4, 4, TextStyle{Link: "https://x.test/?a=1&b=2"}}}, `see <a href="https://x.test/?a=1&amp;b=2">docs</a>`},
+		{"snake_case_name", "snake_case_name", nil, "snake_case_name"},
+		{"2 * 3 * 4", "2 * 3 * 4", nil, "2 * 3 * 4"},
+		{`\*not\*`, "*not*", nil, "*not*"},
+		{"**unclosed", "**unclosed", nil, "**unclosed"},
+		{"😀 **<b>**", "😀 <b>", []TextRange{{3, 3, bold}}, "😀 <b>&lt;b&gt;</b>"},
+	}
+	for _, tt := range tests {
+		got := ParseMarkdown(tt.src)
+		if got.Text != tt.text || !reflect.DeepEqual(got.Ranges, tt.ranges) {
+			t.Errorf("ParseMarkdown(%q) = %+v, want %q %+v", tt.src, got, tt.text, tt.ranges)
+		}
+		if html := got.HTML(); html != tt.html {
+			t.Errorf("ParseMarkdown(%q).HTML() = %q, want %q", tt.src, html, tt.html)
+		}
+	}
+}
+
+func TestSetRichText(t *testing.T) {
+	var payload IMessagePayload
+	if err := payload.SetRichText(ParseMarkdown("hi **there**")); err != nil {
+		t.Fatal(err)
+	}
+	if payload.Text != "hi there" {
+		t.Errorf("text = %q", payload.Text)
+	}
+	want := `<html><body><span message-part="0">hi <b>there</b></span></body></html>`
+	if payload.XML != want {
+		t.Errorf("XML = %s, want %s", payload.XML, want)
+	}
+	if rich, err := DecodeAttributedBody(payload.AttributedBody); err != nil || rich.Text != "hi there" {
+		t.Errorf("attributed body = %+v, %v", rich, err)
+	}
+
+	payload = IMessagePayload{}
+	if err := payload.SetRichText(PlainText("plain")); err != nil {
+		t.Fatal(err)
+	}
+	if payload.XML != "" {
+		t.Errorf("plain text has XML %s", payload.XML)
+	}
+	if payload.AttributedBody != nil {
+		t.Error("plain text has an attributed body")
+	}
+}
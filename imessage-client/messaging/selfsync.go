@@ -0,0 +1,33 @@
+package messaging
+
+import "time"
+
+// Our other devices get a copy of every message we send (see buildDTL), and
+// we get a copy of theirs, with IsFromMe set. Those copies aren't new to the
+// user, so they're recorded but never shown as unread, and replying from
+// another device means the chat was read there.
+
+// markReadBefore marks chat's incoming messages delivered up to at read,
+// without sending a receipt: the device that replied already did. It returns
+// how many messages were newly marked read.
+func markReadBefore(store Store, chat string, at time.Time) (int, error) {
+	marked := 0
+	for id, status := range store.ChatMessages(chat) {
+		if status.FromMe || !status.Read.IsZero() || status.Delivered.After(at) {
+			continue
+		}
+		if err := MarkRead(store, id, chat, false, at); err != nil {
+			return marked, err
+		}
+		marked++
+	}
+	return marked, nil
+}
+
+// isOwnEcho reports whether msg is a message of ours already recorded:
+// one this client sent, which our other devices have no reason to send back,
+// or one from another device delivered again.
+func isOwnEcho(store Store, msg *Message) bool {
+	status, ok := store.MessageStatus(msg.ID)
+	return ok && status.FromMe && !status.Sent.IsZero()
+}
@@ -0,0 +1,47 @@
+package messaging
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMessagesFromOtherDevices(t *testing.T) {
+	session := testSession(t)
+	store := session.store
+	const chat = "tel:+15555550123"
+	delivered := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	incoming := Message{ID: "m1", Chat: chat, Sender: chat, Timestamp: delivered}
+	later := Message{ID: "m3", Chat: chat, Sender: chat, Timestamp: delivered.Add(2 * time.Minute), Sequence: 2}
+	reply := Message{ID: "m2", Chat: chat, Sender: "mailto:me@example.com", Timestamp: delivered.Add(time.Minute), IsFromMe: true, Sequence: 1}
+
+	if err := session.updateStore([]Message{incoming}); err != nil {
+		t.Fatal(err)
+	}
+	if err := session.updateStore([]Message{reply, later}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Replying from the phone read the chat up to the reply
+	if status, _ := store.MessageStatus("m1"); status.Read.IsZero() {
+		t.Error("message before the reply still unread")
+	}
+	if status, _ := store.MessageStatus("m2"); !status.FromMe || !status.Read.IsZero() {
+		t.Errorf("reply recorded as %+v", status)
+	}
+	if unread := Unread(store); len(unread) != 1 || unread[0].Count != 1 {
+		t.Errorf("unread = %v, want only the message after the reply", unread)
+	}
+
+	if status, _ := store.MessageStatus("m2"); !status.Sent.Equal(reply.Timestamp) || !status.Delivered.IsZero() {
+		t.Errorf("reply recorded as delivered %v sent %v, want sent at %v", status.Delivered, status.Sent, reply.Timestamp)
+	}
+	if isOwnEcho(store, &Message{ID: "m5", Chat: chat, IsFromMe: true}) {
+		t.Error("new message from another device taken for a copy")
+	}
+	if err := MarkSent(store, "m4", chat, delivered); err != nil {
+		t.Fatal(err)
+	}
+	if !isOwnEcho(store, &Message{ID: "m4", Chat: chat, IsFromMe: true}) {
+		t.Error("copy of our own message not recognized")
+	}
+}
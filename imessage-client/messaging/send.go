@@ -1,16 +1,244 @@
 package messaging
 
-import "context"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
 
-// Send sends a message to the given chat/recipient. Currently a stub.
-func (c *Client) Send(ctx context.Context, chat string, text string) error {
-	session, err := Connect(ctx, c.registration, c.store)
+	"github.com/google/uuid"
+
+	"imessage-client/messaging/ids"
+)
+
+var ErrInvalidMessageUUID = errors.New("invalid message UUID")
+
+// SendOptions customizes a send.
+type SendOptions struct {
+	// MessageUUID identifies the message. Sending again with the UUID of a
+	// message that was already sent returns the earlier result without
+	// sending a second copy, so callers can retry safely. A random UUID is
+	// used if empty.
+	MessageUUID string
+	// NoSplit fails a text that's too long for one message instead of
+	// sending it as several parts.
+	NoSplit bool
+	// Attachments are sent in the same message, with the text as their
+	// caption. Messages with attachments are never split.
+	Attachments []Attachment
+	// Markdown formats the text with ParseMarkdown. The markers are removed
+	// from the plain text shown by clients that don't render formatting.
+	Markdown bool
+}
+
+// pendingSend is a send in progress, which duplicate sends wait for.
+type pendingSend struct {
+	done chan struct{}
+	err  error
+}
+
+// sendTracker deduplicates concurrent sends of the same message UUID.
+type sendTracker struct {
+	mu      sync.Mutex
+	pending map[string]*pendingSend
+}
+
+// normalizeMessageUUID validates id, or generates one if it's empty. Apple
+// uses upper case UUIDs, so that's the canonical form.
+func normalizeMessageUUID(id string) (string, error) {
+	if id == "" {
+		return strings.ToUpper(uuid.New().String()), nil
+	}
+	parsed, err := uuid.Parse(id)
+	if err != nil {
+		return "", fmt.Errorf("%w %q: %v", ErrInvalidMessageUUID, id, err)
+	}
+	return strings.ToUpper(parsed.String()), nil
+}
+
+// Send sends a text, and any attachments in opts, to the given chat/recipient.
+// A text too long for one message is sent as several parts in order, unless
+// opts.NoSplit is set or there are attachments. Once the message has a UUID,
+// the result is returned even when err is non-nil, so callers can retry the
+// send with the same MessageUUID.
+func (s *Session) Send(ctx context.Context, chat, text string, opts SendOptions) (*SendResult, error) {
+	chat = canonicalChat(chat)
+	id, err := normalizeMessageUUID(opts.MessageUUID)
+	if err != nil {
+		return nil, err
+	}
+	if len(opts.Attachments) > 0 {
+		caption := PlainText(text)
+		if opts.Markdown {
+			caption = ParseMarkdown(text)
+		}
+		if err := s.checkAttachmentsFit(opts.Attachments, caption); err != nil {
+			return nil, err
+		}
+		return s.sendPart(ctx, OutgoingMessage{ID: id, Chat: chat, Text: text, Attachments: opts.Attachments, Markdown: opts.Markdown})
+	}
+	parts, err := s.splitForSend(text, opts.NoSplit, opts.Markdown)
+	if err != nil {
+		return nil, err
+	}
+	if len(parts) == 1 {
+		return s.sendPart(ctx, OutgoingMessage{ID: id, Chat: chat, Text: text, Markdown: opts.Markdown})
+	}
+
+	result := &SendResult{MessageUUID: id, Duplicate: true}
+	for i, part := range parts {
+		partResult, err := s.sendPart(ctx, OutgoingMessage{ID: partUUID(id, i), Chat: chat, Text: part, Markdown: opts.Markdown})
+		result.Parts = append(result.Parts, partResult)
+		result.Duplicate = result.Duplicate && partResult.Duplicate
+		result.Queued = result.Queued || partResult.Queued
+		result.Service = partResult.Service
+		if err != nil {
+			// Later parts would arrive out of context, so stop here
+			result.Duplicate = false
+			result.delivery = combineDeliveries(result.Parts)
+			return result, err
+		}
+	}
+	result.delivery = combineDeliveries(result.Parts)
+	return result, nil
+}
+
+// sendPart sends a single message, skipping it if msg.ID was already sent.
+func (s *Session) sendPart(ctx context.Context, msg OutgoingMessage) (*SendResult, error) {
+	id, chat := msg.ID, msg.Chat
+	result := &SendResult{MessageUUID: id, delivery: s.watchDelivery(id)}
+	if status, ok := s.store.MessageStatus(id); ok && status.FromMe && !status.Sent.IsZero() {
+		// Already accepted by the courier in an earlier attempt
+		result.Duplicate = true
+		return result, nil
+	}
+
+	s.sends.mu.Lock()
+	if s.sends.pending == nil {
+		s.sends.pending = make(map[string]*pendingSend)
+	}
+	if pending, ok := s.sends.pending[id]; ok {
+		s.sends.mu.Unlock()
+		result.Duplicate = true
+		select {
+		case <-pending.done:
+			return result, pending.err
+		case <-ctx.Done():
+			return result, ctx.Err()
+		}
+	}
+	pending := &pendingSend{done: make(chan struct{})}
+	s.sends.pending[id] = pending
+	s.sends.mu.Unlock()
+
+	var service string
+	if s.offline() && ChatService(s.store, chat) != ServiceSMS {
+		// Stay behind the messages queued before this one
+		pending.err = ErrOffline
+	} else {
+		service, pending.err = s.sendWithService(ctx, msg)
+	}
+	switch {
+	case errors.Is(pending.err, ErrOffline) && s.queueOutgoing(msg):
+		result.Queued = true
+		pending.err = nil
+	case pending.err == nil:
+		// The message clears the recipient's typing indicator
+		s.clearTyping(chat)
+		result.Service = service
+		if service != ServiceSMS {
+			s.rememberSent(msg)
+		}
+		if err := markSent(s.store, msg, service, time.Now()); err != nil {
+			slog.Warn("Failed to record sent message", "id", id, "err", err)
+		}
+	default:
+		s.resolveDelivery(id, Delivery{State: DeliveryFailed, At: time.Now(), Err: pending.err})
+	}
+	s.sends.mu.Lock()
+	delete(s.sends.pending, id)
+	s.sends.mu.Unlock()
+	close(pending.done)
+	return result, pending.err
+}
+
+// send encrypts msg for every device of the recipient and our own other
+// devices, and sends it through the outbox.
+func (s *Session) send(ctx context.Context, msg OutgoingMessage) error {
+	if err := s.ensureHandshake(); err != nil {
+		return err
+	}
+	cfg := s.state.IDSConfig
+	if cfg == nil || cfg.IDSEncryptionKey == nil || cfg.IDSSigningKey == nil || cfg.DefaultHandle.IsEmpty() {
+		return ErrHandshakeNotImplemented
+	}
+	recipient, err := ids.ParseURI(msg.Chat)
 	if err != nil {
 		return err
 	}
-	if err := session.ensureHandshake(); err != nil {
+
+	payload := &IMessagePayload{
+		Participants: []string{recipient.String(), cfg.DefaultHandle.String()},
+		Version:      1,
+	}
+	text := PlainText(msg.Text)
+	if msg.Markdown {
+		text = ParseMarkdown(msg.Text)
+	}
+	if len(msg.Attachments) > 0 {
+		err = payload.setInlineAttachments(msg.Attachments, text)
+	} else {
+		err = payload.SetRichText(text)
+	}
+	if err != nil {
 		return err
 	}
-	// TODO: implement actual send using APNS/IDS
-	return ErrNotImplemented
+	if msg.Reaction != nil {
+		msg.Reaction.apply(payload)
+	}
+	body, err := encodeOutgoing(payload)
+	if err != nil {
+		return fmt.Errorf("failed to encode message: %w", err)
+	}
+	recipients := []ids.ParsedURI{recipient}
+	dtl, err := s.buildDTL(ctx, cfg, recipients, body, false)
+	var stale errStaleKeys
+	if errors.As(err, &stale) {
+		// Look the devices up again once before giving up on them
+		for _, handle := range stale.Handles {
+			s.InvalidateLookup(handle)
+		}
+		dtl, err = s.buildDTL(ctx, cfg, recipients, body, true)
+	}
+	if err != nil {
+		return err
+	}
+	commands, err := s.splitDTL(cfg, msg.ID, dtl)
+	if err != nil {
+		return err
+	}
+	s.markActivity()
+	for _, cmd := range commands {
+		if err := <-s.outbox.Enqueue(ctx, PriorityMessage, cmd); err != nil {
+			return fmt.Errorf("failed to send message: %w", err)
+		}
+	}
+	return nil
+}
+
+// Send sends a message to the given chat/recipient with a random message UUID.
+func (c *Client) Send(ctx context.Context, chat string, text string) (*SendResult, error) {
+	return c.SendWithOptions(ctx, chat, text, SendOptions{})
+}
+
+// SendWithOptions sends a message to the given chat/recipient.
+func (c *Client) SendWithOptions(ctx context.Context, chat, text string, opts SendOptions) (*SendResult, error) {
+	session, err := c.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return session.Send(ctx, chat, text, opts)
 }
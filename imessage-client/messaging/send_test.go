@@ -0,0 +1,156 @@
+package messaging
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	"imessage-client/config"
+	"imessage-client/messaging/apns"
+)
+
+func TestSendDeduplicatesByUUID(t *testing.T) {
+	store := NewMemoryStore()
+	reg := &config.RegistrationData{ValidationData: []byte("v"), ValidUntil: time.Now().Add(time.Hour)}
+	session, err := Connect(context.Background(), reg, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	session.handshaker = nil
+
+	const id = "0f8e6a52-3c1d-4b7e-9a2f-5d6c7b8a9e01"
+	if err := MarkSent(store, "0F8E6A52-3C1D-4B7E-9A2F-5D6C7B8A9E01", "tel:+15555550123", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	// Already sent, so nothing is attempted (and the missing handshaker isn't hit)
+	result, err := session.Send(context.Background(), "tel:+15555550123", "hi", SendOptions{MessageUUID: id})
+	if err != nil {
+		t.Errorf("duplicate send: %v", err)
+	} else if !result.Duplicate {
+		t.Error("result not marked as duplicate")
+	}
+
+	result, err = session.Send(context.Background(), "tel:+15555550123", "hi", SendOptions{})
+	if !errors.Is(err, ErrHandshakeNotImplemented) {
+		t.Errorf("fresh send err = %v, want it to be attempted", err)
+	}
+	if delivery := <-result.Delivered(); delivery.State != DeliveryFailed {
+		t.Errorf("failed send resolved as %s", delivery.State)
+	}
+
+	_, err = session.Send(context.Background(), "tel:+15555550123", "hi", SendOptions{MessageUUID: "not-a-uuid"})
+	if !errors.Is(err, ErrInvalidMessageUUID) {
+		t.Errorf("err = %v, want ErrInvalidMessageUUID", err)
+	}
+}
+
+func TestDeliveryReceiptResolvesSend(t *testing.T) {
+	store := NewMemoryStore()
+	reg := &config.RegistrationData{ValidationData: []byte("v"), ValidUntil: time.Now().Add(time.Hour)}
+	session, err := Connect(context.Background(), reg, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+
+	id := uuid.New()
+	delivered := session.watchDelivery(strings.ToUpper(id.String()))
+	receipt := &apns.MadridPayload{Command: apns.MessageTypeDeliveryReceipt, MessageUUID: id[:]}
+	if !session.handleReceipt(receipt) {
+		t.Fatal("receipt not handled")
+	}
+	select {
+	case d := <-delivered:
+		if d.State != DeliveryDelivered {
+			t.Errorf("state = %s", d.State)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("delivery not resolved")
+	}
+	if status, _ := store.MessageStatus(strings.ToUpper(id.String())); status.Delivered.IsZero() {
+		t.Error("delivery not recorded in store")
+	}
+}
+
+func TestDeliveryTimeoutFallsBackToSMS(t *testing.T) {
+	store := NewMemoryStore()
+	reg := &config.RegistrationData{ValidationData: []byte("v"), ValidUntil: time.Now().Add(time.Hour)}
+	session, err := Connect(context.Background(), reg, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	session.SetDeliveryTimeout(10 * time.Millisecond)
+	var smsTo, smsText string
+	session.SetSMSFallback(func(ctx context.Context, phone, text string) error {
+		smsTo, smsText = phone, text
+		return nil
+	})
+	events := make(chan DeliveryTimeoutEvent, 1)
+	session.OnEvent(func(evt Event) {
+		if evt, ok := evt.(DeliveryTimeoutEvent); ok {
+			events <- evt
+		}
+	})
+
+	const id = "0F8E6A52-3C1D-4B7E-9A2F-5D6C7B8A9E01"
+	delivered := session.watchDelivery(id)
+	session.rememberSent(OutgoingMessage{ID: id, Chat: "tel:+15555550123", Text: "hi"})
+	select {
+	case d := <-delivered:
+		if d.State != DeliveryUnconfirmed || !d.SMSFallback {
+			t.Errorf("delivery = %+v, want unconfirmed with SMS fallback", d)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("delivery didn't time out")
+	}
+	if evt := <-events; evt.MessageUUID != id || !evt.SMSFallback || evt.SMSErr != nil {
+		t.Errorf("event = %+v", evt)
+	}
+	if smsTo != "+15555550123" || smsText != "hi" {
+		t.Errorf("SMS sent to %q with %q", smsTo, smsText)
+	}
+	if status, _ := store.MessageStatus(id); status.Unconfirmed.IsZero() || status.Indicator() != "?" {
+		t.Errorf("status = %+v, want it marked unconfirmed", status)
+	}
+}
+
+func TestDeliveryReceiptCarriesSessionToken(t *testing.T) {
+	me := newTestDevice(t, "me")
+	theirPhone := newTestDevice(t, "their-phone")
+	theirMac := newTestDevice(t, "their-mac")
+	const them = "tel:+15555550123"
+	session := testSendSession(t, me, map[string][]*testDevice{them: {theirMac, theirPhone}})
+	sent := make(chan *apns.MadridPayload, 1)
+	session.outbox.Close()
+	session.outbox = NewOutbox(func(ctx context.Context, payload *apns.MadridPayload) error {
+		sent <- payload
+		return nil
+	})
+	t.Cleanup(session.outbox.Close)
+
+	id := uuid.New()
+	session.sendDeliveryReceipt(&apns.MadridPayload{
+		Command:       apns.MessageTypeIMessage,
+		MessageUUID:   id[:],
+		SenderID:      them,
+		DestinationID: "mailto:me@example.com",
+		Token:         theirPhone.token,
+	})
+	select {
+	case receipt := <-sent:
+		if receipt.Command != apns.MessageTypeDeliveryReceipt || receipt.DestinationID != them {
+			t.Errorf("sent %+v, want a delivery receipt to %s", receipt, them)
+		}
+		if string(receipt.SessionToken) != "session-their-phone" {
+			t.Errorf("receipt session token %q, want the sending device's", receipt.SessionToken)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no delivery receipt sent")
+	}
+}
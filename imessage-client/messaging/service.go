@@ -0,0 +1,108 @@
+package messaging
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"imessage-client/messaging/ids"
+)
+
+var (
+	ErrUnknownService = errors.New("unknown service (want iMessage, SMS or auto)")
+	// ErrSMSUnavailable is returned for messages that can't go by SMS: no
+	// SMS fallback is set, the chat isn't a phone number, or the message
+	// has attachments or is a tapback.
+	ErrSMSUnavailable = errors.New("can't send this message by SMS")
+)
+
+// ParseService parses a service name as given on the command line:
+// "imessage", "sms", or "auto" (or "") for automatic selection.
+func ParseService(name string) (string, error) {
+	switch strings.ToLower(name) {
+	case "imessage":
+		return ServiceIMessage, nil
+	case "sms":
+		return ServiceSMS, nil
+	case "auto", "":
+		return "", nil
+	default:
+		return "", fmt.Errorf("%w: %q", ErrUnknownService, name)
+	}
+}
+
+// SetChatService sets the service messages to chat are sent with,
+// ServiceIMessage or ServiceSMS, or "" to send by iMessage and fall back to
+// SMS when the recipient isn't on iMessage.
+func SetChatService(store Store, chat, service string) error {
+	if service != "" && service != ServiceIMessage && service != ServiceSMS {
+		return fmt.Errorf("%w: %q", ErrUnknownService, service)
+	}
+	chat = canonicalChat(chat)
+	cursor := store.Cursor(chat)
+	cursor.Service = service
+	return store.SetCursor(chat, cursor)
+}
+
+// ChatService returns the service set for chat with SetChatService, or ""
+// if it's picked automatically.
+func ChatService(store Store, chat string) string {
+	return store.Cursor(canonicalChat(chat)).Service
+}
+
+// SetChatService sets the service of chat in the session's store.
+func (s *Session) SetChatService(chat, service string) error {
+	return SetChatService(s.store, chat, service)
+}
+
+// ChatService returns the service of chat in the session's store.
+func (s *Session) ChatService(chat string) string {
+	return ChatService(s.store, chat)
+}
+
+// sendWithService sends msg over its chat's service, falling back to SMS
+// when the chat has none set and the recipient isn't on iMessage. It
+// returns the service used.
+func (s *Session) sendWithService(ctx context.Context, msg OutgoingMessage) (string, error) {
+	switch ChatService(s.store, msg.Chat) {
+	case ServiceSMS:
+		return ServiceSMS, s.sendSMS(ctx, msg)
+	case ServiceIMessage:
+		return ServiceIMessage, s.send(ctx, msg)
+	}
+	err := s.send(ctx, msg)
+	if errors.Is(err, ErrNotOnIMessage) {
+		smsErr := s.sendSMS(ctx, msg)
+		if smsErr == nil {
+			slog.Info("Recipient isn't on iMessage, sent by SMS instead", "chat", msg.Chat)
+		}
+		if !errors.Is(smsErr, ErrSMSUnavailable) {
+			return ServiceSMS, smsErr
+		}
+	}
+	return ServiceIMessage, err
+}
+
+// sendSMS sends msg through the session's SMS fallback.
+func (s *Session) sendSMS(ctx context.Context, msg OutgoingMessage) error {
+	s.deliveryMu.Lock()
+	fallback := s.smsFallback
+	s.deliveryMu.Unlock()
+	uri, err := ids.ParseURI(msg.Chat)
+	if fallback == nil || err != nil || uri.Scheme != ids.SchemeTel || len(msg.Attachments) > 0 || msg.Reaction != nil {
+		return ErrSMSUnavailable
+	}
+	text := msg.Text
+	if msg.Markdown {
+		text = ParseMarkdown(text).Text
+	}
+	if err := fallback(ctx, uri.Identifier, text); err != nil {
+		return fmt.Errorf("failed to send SMS: %w", err)
+	}
+	// No delivery receipt comes back for an SMS
+	s.resolveDelivery(msg.ID, Delivery{State: DeliveryUnconfirmed, At: time.Now(), SMSFallback: true})
+	return nil
+}
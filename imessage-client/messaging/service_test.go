@@ -0,0 +1,58 @@
+package messaging
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestSendFallsBackToSMS(t *testing.T) {
+	me := newTestDevice(t, "me")
+	const them = "tel:+15555550123"
+	session := testSendSession(t, me, map[string][]*testDevice{
+		them:                    nil,
+		"mailto:me@example.com": {me},
+	})
+	var sms []string
+	session.SetSMSFallback(func(ctx context.Context, phone, text string) error {
+		sms = append(sms, phone+": "+text)
+		return nil
+	})
+	ctx := context.Background()
+
+	// Not on iMessage, so it goes by SMS
+	result, err := session.Send(ctx, them, "**hi**", SendOptions{Markdown: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Service != ServiceSMS || len(sms) != 1 || sms[0] != "+15555550123: hi" {
+		t.Fatalf("service %q, SMS sent %q", result.Service, sms)
+	}
+	if status, _ := session.store.MessageStatus(result.MessageUUID); status.Service != ServiceSMS || status.Sent.IsZero() {
+		t.Errorf("recorded %+v", status)
+	}
+	if d := <-result.Delivered(); d.State != DeliveryUnconfirmed || !d.SMSFallback {
+		t.Errorf("delivery = %+v", d)
+	}
+
+	// A chat set to iMessage never falls back
+	if err := session.SetChatService(them, ServiceIMessage); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := session.Send(ctx, them, "again", SendOptions{}); !errors.Is(err, ErrNotOnIMessage) || len(sms) != 1 {
+		t.Errorf("send to an iMessage chat = %v, %d SMS sent", err, len(sms))
+	}
+
+	// Nor do attachments, which SMS can't carry
+	if err := session.SetChatService(them, ""); err != nil {
+		t.Fatal(err)
+	}
+	_, err = session.Send(ctx, them, "", SendOptions{Attachments: []Attachment{{FileName: "b.txt", MimeType: "text/plain", UTIType: "public.plain-text", InlineData: []byte("x")}}})
+	if !errors.Is(err, ErrNotOnIMessage) {
+		t.Errorf("attachment send = %v, want not on iMessage", err)
+	}
+
+	if err := session.SetChatService(them, "carrier pigeon"); !errors.Is(err, ErrUnknownService) {
+		t.Errorf("SetChatService with an unknown service = %v", err)
+	}
+}
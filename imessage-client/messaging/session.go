@@ -1,29 +1,101 @@
 package messaging
 
 import (
+	"bytes"
 	"context"
+	"crypto/rsa"
 	"errors"
 	"fmt"
+	"log/slog"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/google/uuid"
+
 	"imessage-client/config"
 	"imessage-client/messaging/apns"
 	"imessage-client/messaging/ids"
+	"imessage-client/messaging/trace"
 )
 
 // Session represents an authenticated connection to Apple's iMessage services.
 type Session struct {
 	registration *config.RegistrationData
 	store        Store
-	state        *handshakeState
-	handshaker   Handshaker
+	// handshakeMu guards state and registration until the handshake is
+	// done, and makes concurrent callers wait for one handshake
+	handshakeMu sync.Mutex
+	state       *handshakeState
+	handshaker  Handshaker
 
 	// APNS message accumulation
-	messageChan    chan *Message
-	readLoopCtx    context.Context
+	queueMu       sync.RWMutex
+	messageChan   chan *Message
+	queueOverflow OverflowPolicy
+	// queueRoom is closed and replaced whenever the queue may have room
+	// again, waking OverflowBlock producers
+	queueRoom chan struct{}
+	closing   chan struct{}
+	closeOnce sync.Once
+	// reconnectMu guards readLoopCancel and serializes connects
+	reconnectMu    sync.Mutex
 	readLoopCancel context.CancelFunc
+	// lastIncoming is when the courier last pushed something, in unix nanoseconds
+	lastIncoming atomic.Int64
+
+	// APNS foreground/background state
+	stateMu     sync.Mutex
+	active      bool
+	idleTimeout time.Duration
+	idleTimer   *time.Timer
+	power       config.PowerProfile
+	ports       apns.PortPolicy
+	couriers    *apns.CourierStats
+
+	eventMu              sync.RWMutex
+	eventHandler         EventHandler
+	certWarningThreshold time.Duration
+	// noDeliveryReceipts is read by the read loop, so it's set atomically
+	noDeliveryReceipts atomic.Bool
+	tracer             *trace.Recorder
+	idsClient          *ids.HTTPClient
+	lookupCache        *LookupCache
+	outbox             *Outbox
+	sends              sendTracker
+
+	typingMu sync.Mutex
+	typing   map[string]*time.Timer
+
+	pinMu          sync.Mutex
+	identityPolicy IdentityPolicy
+
+	deliveryMu      sync.Mutex
+	deliveryWaiters map[string][]chan Delivery
+	sentMessages    map[string]*sentMessage
+	deliveryTimeout time.Duration
+	smsFallback     SMSFallback
+
+	offlineMu       sync.Mutex
+	offlineQueue    bool
+	offlineFlushing bool
+
+	// subsMu also guards sequence and history, so subscribers see messages
+	// in sequence order and a resuming subscriber misses none
+	subsMu      sync.RWMutex
+	subs        map[*Subscription]struct{}
+	sequence    uint64
+	history     []Message
+	historySize int
+
+	refreshRegistration RegistrationRefresher
+	validationMargin    time.Duration
 }
 
+// DefaultIdleTimeout is how long a session stays active after the last
+// activity before telling the courier it's in the background.
+const DefaultIdleTimeout = 5 * time.Minute
+
 // Connect validates registration data and establishes a session (stubbed for now).
 func Connect(_ context.Context, reg *config.RegistrationData, store Store) (*Session, error) {
 	if reg == nil {
@@ -39,7 +111,34 @@ func Connect(_ context.Context, reg *config.RegistrationData, store Store) (*Ses
 		store = NewMemoryStore()
 	}
 	// Use RealHandshaker instead of stub
-	return &Session{registration: reg, store: store, handshaker: RealHandshaker{}}, nil
+	s := &Session{
+		registration: reg,
+		store:        store,
+		handshaker:   RealHandshaker{Store: store},
+		active:       true,
+		idleTimeout:  DefaultIdleTimeout,
+		power:        config.PowerProfiles[config.DefaultPowerProfile],
+		couriers:     apns.NewCourierStats(store.CourierStats()),
+
+		certWarningThreshold: DefaultCertWarningThreshold,
+		deliveryTimeout:      DefaultDeliveryTimeout,
+		offlineQueue:         true,
+		validationMargin:     DefaultValidationMargin,
+		lookupCache:          NewLookupCache(DefaultLookupTTL),
+		// Starting from the clock keeps sequences increasing across
+		// restarts, so a subscriber resuming from an earlier session's
+		// sequence is told it missed messages
+		sequence:    uint64(time.Now().UnixMicro()),
+		historySize: DefaultHistorySize,
+		// Kept for the life of the session, so retry and circuit breaker
+		// state carries across requests
+		idsClient: ids.NewHTTPClient(),
+	}
+	s.outbox = NewOutbox(s.sendMadrid)
+	s.closing = make(chan struct{})
+	s.messageChan = make(chan *Message, DefaultMessageQueueSize)
+	s.queueRoom = make(chan struct{})
+	return s, nil
 }
 
 // FetchUnread will retrieve unread messages once the transport is implemented.
@@ -65,13 +164,23 @@ func (s *Session) FetchUnread(ctx context.Context) ([]MessageSummary, error) {
 		return nil, err
 	}
 
-	// Convert to summaries
+	// Convert to summaries, leaving out snoozed chats until they resurface
+	now := time.Now()
 	var summaries []MessageSummary
+	shown := make(map[string]bool, len(unread))
 	for _, msg := range unread {
+		if msg.IsFromMe || isSnoozed(s.store, msg.Chat, now) {
+			continue
+		}
 		summaries = append(summaries, msg.ToSummary())
+		shown[msg.ID] = true
 	}
-
-	return summaries, nil
+	resurfaced, err := resurfaceSnoozed(s.store, now, shown)
+	summaries = append(summaries, resurfaced...)
+	for i := range summaries {
+		summaries[i].Muted = IsMuted(s.store, summaries[i].Chat, now)
+	}
+	return summaries, err
 }
 
 // Close cleans up session resources.
@@ -80,12 +189,32 @@ func (s *Session) Close() error {
 		return nil
 	}
 
-	// Stop APNS read loop
+	s.stateMu.Lock()
+	if s.idleTimer != nil {
+		s.idleTimer.Stop()
+		s.idleTimer = nil
+	}
+	s.stateMu.Unlock()
+	s.typingMu.Lock()
+	for chat, timer := range s.typing {
+		timer.Stop()
+		delete(s.typing, chat)
+	}
+	s.typingMu.Unlock()
+
+	s.closeOnce.Do(func() { close(s.closing) })
+	s.outbox.Close()
+	s.closeSubscriptions()
+
+	// Stop APNS read loop and close the connection, waiting out a reconnect
+	s.reconnectMu.Lock()
+	defer s.reconnectMu.Unlock()
 	if s.readLoopCancel != nil {
 		s.readLoopCancel()
 	}
 
-	// Close APNS connection
+	s.saveCourierStats()
+
 	if s.state != nil && s.state.APNSConn != nil {
 		return s.state.APNSConn.Close()
 	}
@@ -96,113 +225,467 @@ func (s *Session) Close() error {
 // startAPNS connects to APNS and starts the message read loop.
 func (s *Session) startAPNS(ctx context.Context) error {
 	conn := s.state.APNSConn
+	s.stateMu.Lock()
+	conn.Configure(s.power.KeepAlive, s.power.ReadTimeout, s.ports, s.couriers)
+	s.stateMu.Unlock()
 
 	// TODO: Get actual push token from certificate generation
 	// For now, this will fail with ErrNoToken - that's expected until
 	// we implement the full NAC authentication flow
 
-	// Connect to APNS
-	if err := conn.Connect(ctx); err != nil {
+	// Connect to APNS, keeping what the dials taught us about the couriers
+	err := conn.Connect(ctx)
+	s.saveCourierStats()
+	if err != nil {
 		return err
 	}
 
 	// Set message handler to accumulate messages
 	conn.SetMessageHandler(s.handleAPNSMessage)
-
-	// Subscribe to iMessage topics
-	if err := conn.Filter(apns.TopicMadrid); err != nil {
+	conn.SetUnknownCommandHandler(func(payload *apns.Payload) {
+		s.emit(UnknownCommandEvent{Command: payload.ID, Fields: payload.Fields})
+	})
+
+	// Subscribe to iMessage, leaving the alloy sub-services for when we're awake anyway
+	if err := conn.FilterTopics(apns.TopicFilter{
+		Enabled:       []apns.Topic{apns.TopicMadrid},
+		Opportunistic: apns.MadridSubServices,
+	}); err != nil {
 		return err
 	}
 
-	// Set connection to active state
-	if err := conn.SetState(1); err != nil {
+	// Tell the courier whether we're in the foreground
+	s.stateMu.Lock()
+	state := s.apnsState()
+	s.stateMu.Unlock()
+	if err := conn.SetState(state); err != nil {
 		return err
 	}
 
 	// Start read loop in background
-	s.readLoopCtx, s.readLoopCancel = context.WithCancel(context.Background())
+	loopCtx, cancel := context.WithCancel(context.Background())
+	s.readLoopCancel = cancel
 	go func() {
-		if err := conn.ReadLoop(s.readLoopCtx); err != nil {
-			fmt.Printf("APNS read loop ended: %v\n", err)
+		if err := conn.ReadLoop(loopCtx); err != nil {
+			slog.Info("APNS read loop ended", "err", err)
+			if loopCtx.Err() == nil {
+				// Mark the connection dead and keep trying to get it back, so
+				// an idle session doesn't stop receiving
+				conn.Close()
+				s.alert(AlertAPNSDisconnected, err)
+				s.startReconnect()
+			}
 		}
 	}()
 
 	return nil
 }
 
+// saveCourierStats persists the courier latencies measured so far.
+func (s *Session) saveCourierStats() {
+	if s.couriers == nil {
+		return
+	}
+	if err := s.store.SetCourierStats(s.couriers.Snapshot()); err != nil {
+		slog.Warn("Failed to save courier stats", "err", err)
+	}
+}
+
+// reconnectAPNS connects to the courier again with the push credentials from
+// the handshake. Nothing is re-registered, so the session keeps its identity.
+func (s *Session) reconnectAPNS(ctx context.Context) error {
+	s.reconnectMu.Lock()
+	defer s.reconnectMu.Unlock()
+	state := s.handshakeState()
+	if state == nil || state.APNSConn == nil {
+		return apns.ErrNotConnected
+	}
+	select {
+	case <-s.closing:
+		return errors.New("session is closed")
+	default:
+	}
+	if state.APNSConn.Connected() {
+		// Someone else reconnected while we waited for the lock
+		return nil
+	}
+	if s.readLoopCancel != nil {
+		s.readLoopCancel()
+	}
+	slog.Debug("Reconnecting to APNS")
+	if err := s.startAPNS(ctx); err != nil {
+		state.APNSConn.Close()
+		return fmt.Errorf("failed to reconnect to APNS: %w", err)
+	}
+	go s.flushOutgoing()
+	return nil
+}
+
+// ensureAPNS reconnects to the courier if the connection was lost.
+func (s *Session) ensureAPNS(ctx context.Context) error {
+	if s.state == nil || s.state.APNSConn == nil || s.state.APNSConn.Connected() {
+		return nil
+	}
+	return s.reconnectAPNS(ctx)
+}
+
 // handleAPNSMessage processes incoming APNS messages and accumulates them.
 func (s *Session) handleAPNSMessage(ctx context.Context, payload *apns.SendMessagePayload) error {
+	s.lastIncoming.Store(time.Now().UnixNano())
+	slog.Debug("Received push", "topic", payload.TopicName(), "bytes", len(payload.Payload))
+	if madrid, err := apns.ParseMadridPayload(payload.Payload); err == nil {
+		if madrid.IsStale(payload.Expiration, time.Now()) {
+			// A typing indicator or similar that arrived too late to matter
+			return nil
+		}
+		if s.handleReceipt(madrid) {
+			return nil
+		}
+		if madrid.Command == apns.MessageTypePeerCacheInvalidate {
+			// The sender's keys changed, so our cached lookup is stale
+			if madrid.SenderID != "" {
+				s.InvalidateLookup(madrid.SenderID)
+			}
+			return nil
+		}
+	}
+
 	// Try to decrypt the message
 	if s.state == nil || s.state.IDSConfig == nil || s.state.IDSConfig.IDSEncryptionKey == nil {
 		// No encryption key available, create stub
 		msg := &Message{
-			ID:        fmt.Sprintf("msg-%d", time.Now().Unix()),
+			ID:        uuid.New().String(),
 			Chat:      "unknown-chat",
 			Sender:    "unknown-sender",
-			Text:      fmt.Sprintf("[Encrypted] %d bytes from %s", len(payload.Payload), payload.Topic),
+			Text:      fmt.Sprintf("[Encrypted] %d bytes from %s", len(payload.Payload), payload.TopicName()),
 			Timestamp: time.Now(),
 		}
-
-		select {
-		case s.messageChan <- msg:
-			return nil
-		default:
-			return fmt.Errorf("message channel full")
-		}
+		return s.enqueue(msg)
 	}
 
-	// Attempt decryption
-	imsg, err := DecryptMessage(s.state.IDSConfig.IDSEncryptionKey, payload.Payload)
+	imsg, madrid, err := decodeIncoming(s.state.IDSConfig.IDSEncryptionKey, payload.Payload)
 	if err != nil {
 		// Decryption failed, still accumulate as encrypted message
 		msg := &Message{
-			ID:        fmt.Sprintf("msg-%d", time.Now().Unix()),
+			ID:        uuid.New().String(),
 			Chat:      "unknown-chat",
 			Sender:    "unknown-sender",
 			Text:      fmt.Sprintf("[Decrypt failed: %s] %d bytes", err.Error(), len(payload.Payload)),
 			Timestamp: time.Now(),
 		}
+		if errors.Is(err, rsa.ErrDecryption) {
+			// The sender encrypted to a key we don't have
+			s.alert(AlertDecryptionFailed, err)
+		}
+		if enqueueErr := s.enqueue(msg); enqueueErr != nil {
+			return enqueueErr
+		}
+		return fmt.Errorf("decryption failed: %w", err)
+	}
 
-		select {
-		case s.messageChan <- msg:
-			return fmt.Errorf("decryption failed: %w", err)
-		default:
-			return fmt.Errorf("message channel full")
+	if madrid != nil {
+		if err := s.verifySender(ctx, madrid); err != nil {
+			msg := &Message{
+				ID:        uuid.New().String(),
+				Chat:      "unknown-chat",
+				Sender:    madrid.SenderID,
+				Text:      fmt.Sprintf("[Signature verification failed: %s] %d bytes", err.Error(), len(payload.Payload)),
+				Timestamp: time.Now(),
+			}
+			if enqueueErr := s.enqueue(msg); enqueueErr != nil {
+				return enqueueErr
+			}
+			return err
 		}
 	}
 
-	// Successfully decrypted!
+	msg := newIncomingMessage(imsg, madrid, payload.Topic, s.Handles())
+	if msg.IsFromMe && isOwnEcho(s.store, msg) {
+		slog.Debug("Dropping copy of a message we sent", "id", msg.ID)
+		return nil
+	}
+	if err := s.enqueue(msg); err != nil {
+		return err
+	}
+	if madrid != nil && madrid.WantsDeliveryReceipt() && !s.noDeliveryReceipts.Load() {
+		// Sending waits for the courier's ack, which the read loop delivers
+		go s.sendDeliveryReceipt(madrid)
+	}
+	return nil
+}
+
+// decodeIncoming unwraps the madrid envelope of an incoming APNS payload, if
+// there is one, and decrypts the message inside. The envelope is nil for
+// payloads that aren't madrid plists.
+func decodeIncoming(key *rsa.PrivateKey, raw []byte) (*IMessagePayload, *apns.MadridPayload, error) {
+	encrypted := raw
+	madrid, err := apns.ParseMadridPayload(raw)
+	if err == nil && len(madrid.Payload) > 0 {
+		encrypted = madrid.Payload
+	} else {
+		madrid = nil
+	}
+	imsg, err := DecryptMessage(key, encrypted)
+	if err != nil {
+		return nil, madrid, err
+	}
+	return imsg, madrid, nil
+}
+
+// newIncomingMessage converts a decrypted payload that came in on topic into
+// a Message. The envelope, if there is one, names the sender; self lists our
+// own handles so messages from our other devices are recognized.
+func newIncomingMessage(imsg *IMessagePayload, madrid *apns.MadridPayload, topic string, self []string) *Message {
+	sender := "unknown"
+	if madrid != nil && madrid.SenderID != "" {
+		sender = canonicalChat(madrid.SenderID)
+	} else if len(imsg.Participants) > 0 {
+		sender = canonicalChat(imsg.Participants[0])
+	}
+	// The iPhone reflects the SMS it sends from its own number, which needn't
+	// be one of our handles
+	fromMe := containsHandle(self, sender) || (madrid != nil && madrid.Command.IsReflected())
+
 	chat := "direct"
 	if imsg.GroupID != "" {
-		chat = imsg.GroupID
-	} else if len(imsg.Participants) > 0 {
-		chat = imsg.Participants[0]
+		chat = canonicalChat(imsg.GroupID)
+	} else if !fromMe && sender != "unknown" {
+		chat = sender
+	} else {
+		// A DM from our other devices belongs to the chat with the other side
+		for _, participant := range imsg.Participants {
+			if !containsHandle(self, participant) && canonicalChat(participant) != sender {
+				chat = canonicalChat(participant)
+				break
+			}
+		}
 	}
 
-	sender := "unknown"
-	if len(imsg.Participants) > 0 {
-		sender = imsg.Participants[0]
+	timestamp := time.Now()
+	if fromMe && madrid != nil && madrid.Timestamp > 0 {
+		// Recorded as sent when our other device sent it, not when the copy
+		// reached us
+		timestamp = time.Unix(0, madrid.Timestamp)
 	}
 
 	msgID := imsg.MessageUUID
 	if msgID == "" {
-		msgID = fmt.Sprintf("msg-%d", time.Now().Unix())
+		msgID = uuid.New().String()
 	}
 
-	msg := &Message{
-		ID:        msgID,
-		Chat:      chat,
-		Sender:    sender,
-		Text:      imsg.Text,
-		Timestamp: time.Now(),
+	attachments, err := imsg.Attachments()
+	if err != nil {
+		slog.Warn("Failed to decode attachments", "err", err)
 	}
 
-	select {
-	case s.messageChan <- msg:
+	text := imsg.Text
+	var formatting []TextRange
+	if len(imsg.AttributedBody) > 0 {
+		rich, err := DecodeAttributedBody(imsg.AttributedBody)
+		if err != nil {
+			slog.Warn("Failed to decode attributed body", "err", err)
+		} else if text == "" || text == rich.Text {
+			text, formatting = rich.Text, rich.Ranges
+		}
+	}
+
+	service := messageService(topic, madrid)
+	var guid string
+	if chat != "direct" {
+		guid = chatGUID(service, chat, imsg.GroupID != "")
+	}
+
+	return &Message{
+		ID:           msgID,
+		Chat:         chat,
+		Sender:       sender,
+		Text:         text,
+		Timestamp:    timestamp,
+		Service:      service,
+		Attachments:  attachments,
+		Formatting:   formatting,
+		Participants: imsg.Participants,
+		ChatGUID:     guid,
+		GroupName:    imsg.GroupName,
+		IsFromMe:     fromMe,
+		ReplyToID:    imsg.replyToID(),
+	}
+}
+
+// SetTracer records the session's APNS frames and IDS requests. It must be
+// called before the handshake.
+func (s *Session) SetTracer(recorder *trace.Recorder) {
+	s.tracer = recorder
+	s.idsClient.SetTracer(recorder)
+	if h, ok := s.handshaker.(RealHandshaker); ok {
+		h.Trace = recorder
+		s.handshaker = h
+	}
+}
+
+// SetIDSClient replaces the client used for IDS requests after the
+// handshake, such as lookups. It must be called before the handshake.
+func (s *Session) SetIDSClient(client *ids.HTTPClient) {
+	client.SetTracer(s.tracer)
+	s.idsClient = client
+}
+
+// SetDeliveryReceipts controls whether senders are told when their
+// messages reach this client. Enabled by default.
+func (s *Session) SetDeliveryReceipts(enabled bool) {
+	s.noDeliveryReceipts.Store(!enabled)
+}
+
+func (s *Session) sendDeliveryReceipt(incoming *apns.MadridPayload) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	receipt := apns.NewDeliveryReceipt(incoming, s.state.IDSConfig.CombinedVersion())
+	receipt.SessionToken = s.senderSessionToken(ctx, incoming)
+	if err := <-s.outbox.Enqueue(ctx, PriorityStatus, receipt); err != nil {
+		slog.Warn("Failed to send delivery receipt", "err", err)
+	}
+}
+
+// senderSessionToken returns the session token of the device that sent
+// incoming, from the IDS lookup of its sender that verifySender has usually
+// cached already. The sender's device ignores receipts without it.
+func (s *Session) senderSessionToken(ctx context.Context, incoming *apns.MadridPayload) []byte {
+	results, err := s.Lookup(ctx, []string{incoming.SenderID})
+	if err != nil {
+		slog.Debug("Failed to look up sender for delivery receipt", "sender", incoming.SenderID, "err", err)
+		return nil
+	}
+	if result := results[incoming.SenderID]; result != nil {
+		for _, ident := range result.Identities {
+			if bytes.Equal(ident.PushToken, incoming.Token) {
+				return ident.SessionToken
+			}
+		}
+	}
+	return nil
+}
+
+// sendMadrid delivers a payload from the outbox over the APNS connection,
+// reconnecting first if the connection was lost.
+func (s *Session) sendMadrid(ctx context.Context, payload *apns.MadridPayload) error {
+	state := s.handshakeState()
+	if state == nil || state.APNSConn == nil {
+		return apns.ErrNotConnected
+	}
+	_, err := state.APNSConn.SendMadrid(ctx, payload)
+	if errors.Is(err, apns.ErrNotConnected) {
+		if err := s.reconnectAPNS(ctx); err != nil {
+			return fmt.Errorf("%w: %w", ErrOffline, err)
+		}
+		_, err = state.APNSConn.SendMadrid(ctx, payload)
+	}
+	return err
+}
+
+// Outbox returns the queue outgoing payloads are sent through.
+func (s *Session) Outbox() *Outbox {
+	return s.outbox
+}
+
+// enqueue stamps msg with the next arrival sequence, hands it to subscribers
+// and queues it for FetchMessages.
+func (s *Session) enqueue(msg *Message) error {
+	s.publish(msg)
+	return s.queueMessage(msg)
+}
+
+// SetActive switches the APNS connection between the active and background
+// states. It can be called before connecting; the state is applied once the
+// connection is up.
+func (s *Session) SetActive(active bool) error {
+	s.stateMu.Lock()
+	defer s.stateMu.Unlock()
+	return s.setActiveLocked(active)
+}
+
+// IsActive reports whether the session is in the active state.
+func (s *Session) IsActive() bool {
+	s.stateMu.Lock()
+	defer s.stateMu.Unlock()
+	return s.active
+}
+
+// SetPowerProfile sets how often the courier connection is kept alive and
+// how hard a lost one is chased. It applies from the next connect.
+func (s *Session) SetPowerProfile(profile config.PowerProfile) {
+	s.stateMu.Lock()
+	defer s.stateMu.Unlock()
+	s.power = profile
+}
+
+// SetCourierPorts selects the courier ports tried when connecting. It
+// applies from the next connect.
+func (s *Session) SetCourierPorts(policy apns.PortPolicy) {
+	s.stateMu.Lock()
+	defer s.stateMu.Unlock()
+	s.ports = policy
+}
+
+// SetIdleTimeout changes how long the session waits without activity before
+// going to the background. Zero disables idle tracking.
+func (s *Session) SetIdleTimeout(timeout time.Duration) {
+	s.stateMu.Lock()
+	defer s.stateMu.Unlock()
+	s.idleTimeout = timeout
+	if timeout <= 0 && s.idleTimer != nil {
+		s.idleTimer.Stop()
+		s.idleTimer = nil
+	}
+}
+
+// markActivity moves an idle session back to active and restarts the idle timer.
+func (s *Session) markActivity() {
+	s.stateMu.Lock()
+	defer s.stateMu.Unlock()
+	if !s.active {
+		if err := s.setActiveLocked(true); err != nil {
+			slog.Warn("Failed to set APNS state", "err", err)
+		}
+	}
+	if s.idleTimeout <= 0 {
+		return
+	}
+	if s.idleTimer != nil {
+		s.idleTimer.Reset(s.idleTimeout)
+	} else {
+		s.idleTimer = time.AfterFunc(s.idleTimeout, s.goIdle)
+	}
+}
+
+func (s *Session) goIdle() {
+	s.stateMu.Lock()
+	defer s.stateMu.Unlock()
+	s.idleTimer = nil
+	if err := s.setActiveLocked(false); err != nil {
+		slog.Warn("Failed to set APNS state", "err", err)
+	}
+}
+
+func (s *Session) setActiveLocked(active bool) error {
+	if s.active == active {
+		return nil
+	}
+	s.active = active
+	if s.state == nil || s.state.APNSConn == nil {
+		return nil
+	}
+	err := s.state.APNSConn.SetState(s.apnsState())
+	if errors.Is(err, apns.ErrNotConnected) {
 		return nil
-	default:
-		return fmt.Errorf("message channel full")
 	}
+	return err
+}
+
+func (s *Session) apnsState() apns.ConnectionState {
+	if s.active {
+		return apns.StateActive
+	}
+	return apns.StateBackground
 }
 
 // handshakeState will hold derived keys/session tokens once the IDS/NAC flow is ported.
@@ -211,19 +694,58 @@ type handshakeState struct {
 	DeviceInfo     config.DeviceInfo
 	IDSConfig      *ids.Config
 	APNSConn       *apns.Connection
+
+	// InactiveHandles are handles the register response didn't accept.
+	InactiveHandles map[string]ids.IDSStatus
 }
 
 func (s *Session) ensureHandshake() error {
+	s.handshakeMu.Lock()
 	if s.state != nil {
+		s.handshakeMu.Unlock()
 		return nil
 	}
-	if s.handshaker == nil {
-		return ErrHandshakeNotImplemented
+	state, rejected, err := s.handshakeLocked()
+	if err == nil {
+		s.state = state
 	}
-	state, err := s.handshaker.Handshake(context.Background(), s.registration)
+	s.handshakeMu.Unlock()
 	if err != nil {
+		// Alerted without the lock, since the event handler may use the session
+		if rejected {
+			s.alert(AlertRegistrationRejected, err)
+		}
 		return err
 	}
-	s.state = state
+	s.checkCertExpiry()
+	s.checkHandles()
+	// Send what an earlier session queued while offline
+	go s.flushOutgoing()
 	return nil
 }
+
+// handshakeLocked registers with the validation data, refreshing it first
+// if it's about to expire. rejected reports a failure worth alerting on.
+// The caller must hold handshakeMu.
+func (s *Session) handshakeLocked() (state *handshakeState, rejected bool, err error) {
+	if s.handshaker == nil {
+		return nil, false, ErrHandshakeNotImplemented
+	}
+	if err := s.ensureFreshRegistration(context.Background()); err != nil {
+		return nil, false, err
+	}
+	state, err = s.handshaker.Handshake(context.Background(), s.registration)
+	if err != nil {
+		rejected = !errors.Is(err, ErrInvalidRegistrationData) && !errors.Is(err, ErrHandshakeNotImplemented)
+		return nil, rejected, err
+	}
+	return state, false, nil
+}
+
+// handshakeState returns the state of the finished handshake, or nil if
+// there hasn't been one yet.
+func (s *Session) handshakeState() *handshakeState {
+	s.handshakeMu.Lock()
+	defer s.handshakeMu.Unlock()
+	return s.state
+}
@@ -0,0 +1,221 @@
+package messaging
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"imessage-client/config"
+	"imessage-client/messaging/apns"
+	"imessage-client/messaging/apns/apnstest"
+)
+
+func testAPNSConnection(t *testing.T, server *apnstest.Server) *apns.Connection {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "push"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := apns.NewConnection(key, cert, []byte("initial-token"))
+	conn.NoAutoFlush = true
+	server.Configure(conn)
+	return conn
+}
+
+func countCommands(server *apnstest.Server, id apns.CommandID) int {
+	n := 0
+	for _, payload := range server.Received() {
+		if payload.ID == id {
+			n++
+		}
+	}
+	return n
+}
+
+func TestSendReconnectsLostAPNSConnection(t *testing.T) {
+	server, err := apnstest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	session := testSession(t)
+	session.state = &handshakeState{APNSConn: testAPNSConnection(t, server)}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	payload := &apns.MadridPayload{Command: apns.MessageTypeFlushQueue}
+
+	// Never connected, so the first send connects
+	if err := session.sendMadrid(ctx, payload); err != nil {
+		t.Fatalf("first send: %v", err)
+	}
+	// Drop the connection as a failed read loop would
+	session.state.APNSConn.Close()
+	if err := session.sendMadrid(ctx, payload); err != nil {
+		t.Fatalf("send after disconnect: %v", err)
+	}
+
+	if n := countCommands(server, apns.CommandConnect); n != 2 {
+		t.Errorf("connected %d times, want 2", n)
+	}
+	if n := countCommands(server, apns.CommandSendMessage); n != 2 {
+		t.Errorf("sent %d messages, want 2", n)
+	}
+}
+
+func TestReadLoopEndReconnects(t *testing.T) {
+	server, err := apnstest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	session := testSession(t)
+	session.SetPowerProfile(config.PowerProfile{ReconnectMin: 10 * time.Millisecond, ReconnectMax: 10 * time.Millisecond})
+	session.state = &handshakeState{APNSConn: testAPNSConnection(t, server)}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := session.ensureAPNS(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// The courier going away ends the read loop; nothing is sent afterwards
+	server.DropConnections()
+	for countCommands(server, apns.CommandConnect) < 2 {
+		select {
+		case <-ctx.Done():
+			t.Fatal("session didn't reconnect after the courier dropped it")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func TestClientReusesSession(t *testing.T) {
+	reg := &config.RegistrationData{ValidationData: []byte("v"), ValidUntil: time.Now().Add(time.Hour)}
+	client := NewClient(reg)
+	first, err := client.connect(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := client.connect(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first != second {
+		t.Error("second call opened a new session")
+	}
+
+	if err := client.Close(); err != nil {
+		t.Fatal(err)
+	}
+	third, err := client.connect(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if third == first {
+		t.Error("closed session was reused")
+	}
+
+	// Until the handshake, the registration has to stay fresh
+	client.SetRegistration(&config.RegistrationData{ValidationData: []byte("v"), ValidUntil: time.Now().Add(-time.Minute)})
+	if _, err := client.connect(context.Background()); !errors.Is(err, ErrRegistrationExpired) {
+		t.Errorf("expired registration: err = %v", err)
+	}
+	fresh := &config.RegistrationData{ValidationData: []byte("w"), ValidUntil: time.Now().Add(time.Hour)}
+	client.SetRegistration(fresh)
+	fourth, err := client.connect(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fourth != third || fourth.registration != fresh {
+		t.Error("session didn't pick up the new registration")
+	}
+}
+
+// countingHandshaker counts handshakes, taking a while over each.
+type countingHandshaker struct {
+	count *atomic.Int32
+}
+
+func (h countingHandshaker) Handshake(ctx context.Context, reg *config.RegistrationData) (*handshakeState, error) {
+	h.count.Add(1)
+	time.Sleep(50 * time.Millisecond)
+	return &handshakeState{ValidationData: reg.ValidationData}, nil
+}
+
+func TestConcurrentCallsShareOneHandshake(t *testing.T) {
+	session := testSession(t)
+	var count atomic.Int32
+	session.handshaker = countingHandshaker{count: &count}
+
+	errs := make(chan error, 8)
+	for i := 0; i < cap(errs); i++ {
+		go func() { errs <- session.ensureHandshake() }()
+	}
+	for i := 0; i < cap(errs); i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := count.Load(); n != 1 {
+		t.Errorf("ran %d handshakes, want 1", n)
+	}
+}
+
+func TestResetConnectionReconnects(t *testing.T) {
+	server, err := apnstest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	session := testSession(t)
+	session.state = &handshakeState{APNSConn: testAPNSConnection(t, server)}
+	var alerts atomic.Int32
+	session.OnEvent(func(evt Event) {
+		if _, ok := evt.(AlertEvent); ok {
+			alerts.Add(1)
+		}
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := session.ensureAPNS(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := session.ResetConnection(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !session.state.APNSConn.Connected() {
+		t.Error("not connected after reset")
+	}
+	if n := countCommands(server, apns.CommandConnect); n != 2 {
+		t.Errorf("connected %d times, want 2", n)
+	}
+	if n := alerts.Load(); n != 0 {
+		t.Errorf("reset raised %d alerts", n)
+	}
+}
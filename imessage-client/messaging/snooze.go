@@ -0,0 +1,89 @@
+package messaging
+
+import (
+	"fmt"
+	"time"
+)
+
+// Snooze hides chat until until: new messages in it are recorded but left
+// out of FetchUnread and Unread, and once it's over the chat resurfaces in
+// FetchUnread with its unread count. If everything in the chat was read, its
+// newest incoming message is marked unread again so there's something to
+// come back to. It returns how many messages were marked unread.
+func Snooze(store Store, chat string, until time.Time) (int, error) {
+	chat = canonicalChat(chat)
+	var newestID string
+	var newest MessageStatus
+	for id, status := range store.ChatMessages(chat) {
+		if status.FromMe {
+			continue
+		}
+		if status.Read.IsZero() {
+			newestID = ""
+			break
+		}
+		if newestID == "" || status.Delivered.After(newest.Delivered) {
+			newestID, newest = id, status
+		}
+	}
+	marked := 0
+	if newestID != "" {
+		newest.Read = time.Time{}
+		if err := store.SetMessageStatus(newestID, newest); err != nil {
+			return 0, err
+		}
+		marked++
+	}
+
+	cursor := store.Cursor(chat)
+	cursor.SnoozedUntil = until
+	return marked, store.SetCursor(chat, cursor)
+}
+
+// Snooze hides chat in the session's store until until.
+func (s *Session) Snooze(chat string, until time.Time) (int, error) {
+	return Snooze(s.store, chat, until)
+}
+
+// isSnoozed reports whether chat is hidden by Snooze at now.
+func isSnoozed(store Store, chat string, now time.Time) bool {
+	return now.Before(store.Cursor(chat).SnoozedUntil)
+}
+
+// resurfaceSnoozed ends the snoozes that are over at now, returning a
+// summary of the unread messages waiting in each chat. Messages in shown are
+// being shown on their own, so they aren't counted.
+func resurfaceSnoozed(store Store, now time.Time, shown map[string]bool) ([]MessageSummary, error) {
+	var summaries []MessageSummary
+	for _, chat := range store.Chats() {
+		cursor := store.Cursor(chat)
+		if cursor.SnoozedUntil.IsZero() || now.Before(cursor.SnoozedUntil) {
+			continue
+		}
+		cursor.SnoozedUntil = time.Time{}
+		if err := store.SetCursor(chat, cursor); err != nil {
+			return summaries, err
+		}
+		count, latest, service := 0, time.Time{}, ""
+		for id, status := range store.ChatMessages(chat) {
+			if status.FromMe || !status.Read.IsZero() || shown[id] {
+				continue
+			}
+			count++
+			if status.Delivered.After(latest) {
+				latest, service = status.Delivered, status.Service
+			}
+		}
+		if count == 0 {
+			continue
+		}
+		summaries = append(summaries, MessageSummary{
+			Sender:    chat,
+			Chat:      chat,
+			Preview:   fmt.Sprintf("(snoozed) %d unread message(s)", count),
+			Timestamp: latest,
+			Service:   service,
+		})
+	}
+	return summaries, nil
+}
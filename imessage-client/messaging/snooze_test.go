@@ -0,0 +1,48 @@
+package messaging
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSnoozeResurfaces(t *testing.T) {
+	store := NewMemoryStore()
+	const chat = "tel:+15555550123"
+	delivered := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	_ = store.SetCursor(chat, ChatCursor{LastMessageID: "m2"})
+	_ = MarkRead(store, "m1", chat, false, delivered)
+	_ = MarkRead(store, "m2", chat, false, delivered.Add(time.Minute))
+	_ = MarkSent(store, "m3", chat, delivered.Add(2*time.Minute))
+
+	until := time.Now().Add(time.Hour)
+	marked, err := Snooze(store, chat, until)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if marked != 1 {
+		t.Fatalf("marked %d unread, want 1", marked)
+	}
+	if status, _ := store.MessageStatus("m2"); !status.Read.IsZero() {
+		t.Error("newest incoming message still read")
+	}
+	if unread := Unread(store); len(unread) != 0 {
+		t.Errorf("snoozed chat counted as unread: %v", unread)
+	}
+	if resurfaced, _ := resurfaceSnoozed(store, time.Now(), nil); len(resurfaced) != 0 {
+		t.Errorf("resurfaced before the snooze ended: %v", resurfaced)
+	}
+
+	resurfaced, err := resurfaceSnoozed(store, until.Add(time.Second), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resurfaced) != 1 || resurfaced[0].Chat != chat {
+		t.Fatalf("resurfaced = %v", resurfaced)
+	}
+	if cursor := store.Cursor(chat); !cursor.SnoozedUntil.IsZero() || cursor.LastMessageID != "m2" {
+		t.Errorf("cursor after snooze = %+v", cursor)
+	}
+	if unread := Unread(store); len(unread) != 1 || unread[0].Count != 1 {
+		t.Errorf("unread after snooze = %v", unread)
+	}
+}
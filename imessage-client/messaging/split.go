@@ -0,0 +1,162 @@
+package messaging
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+	"howett.net/plist"
+
+	"imessage-client/messaging/apns"
+)
+
+// DefaultLargeMessageSize is the courier's large message limit before
+// ConnectAck tells us the real one.
+const DefaultLargeMessageSize = 15 * 1024
+
+// encryptionOverhead approximates what pair encryption and the madrid
+// envelope add to an encoded message body: the RSA-wrapped AES key, the
+// signature and the per-device plist keys.
+const encryptionOverhead = 512
+
+// encodeOutgoing serializes a message body the way it's encrypted for
+// each recipient device, compressed when that makes it smaller.
+func encodeOutgoing(payload *IMessagePayload) ([]byte, error) {
+	body, err := plist.Marshal(payload, plist.BinaryFormat)
+	if err != nil {
+		return nil, err
+	}
+	return MaybeGZip(body)
+}
+
+// largeMessageSize returns the courier's large message limit, which bounds
+// a whole APNS command.
+func (s *Session) largeMessageSize() int {
+	if s.state != nil && s.state.APNSConn != nil && s.state.APNSConn.Connected() {
+		return s.state.APNSConn.MaxLargeMessageSize()
+	}
+	return DefaultLargeMessageSize
+}
+
+// maxBodySize returns how large an encoded message body may be.
+func (s *Session) maxBodySize() int {
+	return s.largeMessageSize() - apns.SendMessageOverhead - encryptionOverhead
+}
+
+// encodeText encodes the body of a message with only text, formatted with
+// ParseMarkdown if markdown is set.
+func encodeText(text string, markdown bool) ([]byte, error) {
+	rich := PlainText(text)
+	if markdown {
+		rich = ParseMarkdown(text)
+	}
+	payload := &IMessagePayload{}
+	if err := payload.SetRichText(rich); err != nil {
+		return nil, err
+	}
+	body, err := encodeOutgoing(payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode message: %w", err)
+	}
+	return body, nil
+}
+
+// splitText breaks text into parts whose encoded bodies fit in limit bytes.
+// Parts end at whitespace where possible so words aren't cut in half.
+func splitText(text string, limit int, markdown bool) ([]string, error) {
+	fits := func(part string) (bool, error) {
+		body, err := encodeText(part, markdown)
+		if err != nil {
+			return false, err
+		}
+		return len(body) <= limit, nil
+	}
+
+	if text == "" {
+		return []string{text}, nil
+	}
+	var parts []string
+	for text != "" {
+		if ok, err := fits(text); err != nil {
+			return nil, err
+		} else if ok {
+			return append(parts, text), nil
+		}
+		// Binary search for the longest prefix that fits, in runes
+		runes := []rune(text)
+		lo, hi := 0, len(runes)
+		for lo < hi {
+			mid := (lo + hi + 1) / 2
+			ok, err := fits(string(runes[:mid]))
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				lo = mid
+			} else {
+				hi = mid - 1
+			}
+		}
+		// Prefer breaking after whitespace in the second half of the part.
+		// Compressed size doesn't grow strictly with length, so every
+		// candidate is checked again once trimmed.
+		var candidates []int
+		for i := lo; i > lo/2; i-- {
+			if unicode.IsSpace(runes[i-1]) {
+				candidates = append(candidates, i)
+			}
+		}
+		for i := lo; i > 0; i-- {
+			candidates = append(candidates, i)
+		}
+		cut := 0
+		var part string
+		for _, candidate := range candidates {
+			part = strings.TrimRightFunc(string(runes[:candidate]), unicode.IsSpace)
+			ok, err := fits(part)
+			if err != nil {
+				return nil, err
+			}
+			if ok && part != "" {
+				cut = candidate
+				break
+			}
+		}
+		if cut == 0 {
+			return nil, apns.PayloadTooLargeError{Size: utf8.RuneLen(runes[0]), Limit: limit}
+		}
+		parts = append(parts, part)
+		text = strings.TrimLeftFunc(string(runes[cut:]), unicode.IsSpace)
+	}
+	return parts, nil
+}
+
+// splitForSend returns the parts text is sent as. Without splitting, a text
+// that's too long is reported as apns.PayloadTooLargeError.
+func (s *Session) splitForSend(text string, noSplit, markdown bool) ([]string, error) {
+	limit := s.maxBodySize()
+	if !noSplit {
+		return splitText(text, limit, markdown)
+	}
+	body, err := encodeText(text, markdown)
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > limit {
+		return nil, apns.PayloadTooLargeError{Size: len(body), Limit: limit}
+	}
+	return []string{text}, nil
+}
+
+// partUUID derives the UUID of part n (counting from 0) of a split message.
+// The first part keeps the message's own UUID. Derivation is deterministic,
+// so retrying a split message with the same UUID skips the parts already sent.
+func partUUID(id string, n int) string {
+	if n == 0 {
+		return id
+	}
+	base := uuid.MustParse(id)
+	return strings.ToUpper(uuid.NewSHA1(base, []byte(fmt.Sprintf("part %d", n))).String())
+}
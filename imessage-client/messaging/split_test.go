@@ -0,0 +1,124 @@
+package messaging
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+
+	"imessage-client/messaging/apns"
+)
+
+// randomWords returns n words of random letters, which gzip can't shrink
+// much, so the tests need several parts even after compression.
+func randomWords(n int) string {
+	rng := rand.New(rand.NewSource(1))
+	words := make([]string, n)
+	for i := range words {
+		word := make([]byte, 3+rng.Intn(6))
+		for j := range word {
+			word[j] = byte('a' + rng.Intn(26))
+		}
+		words[i] = string(word)
+	}
+	return strings.Join(words, " ")
+}
+
+func TestSplitTextShortTextIsOnePart(t *testing.T) {
+	parts, err := splitText("hello", 1024, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parts) != 1 || parts[0] != "hello" {
+		t.Errorf("parts = %q", parts)
+	}
+}
+
+func TestSplitTextBreaksAtWhitespace(t *testing.T) {
+	text := randomWords(1000)
+	const limit = 1024
+	parts, err := splitText(text, limit, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parts) < 2 {
+		t.Fatalf("got %d parts, want several", len(parts))
+	}
+	for i, part := range parts {
+		body, err := encodeOutgoing(&IMessagePayload{Text: part})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(body) > limit {
+			t.Errorf("part %d encodes to %d bytes, over %d", i, len(body), limit)
+		}
+		if strings.HasPrefix(part, " ") || strings.HasSuffix(part, " ") {
+			t.Errorf("part %d has untrimmed whitespace: %q", i, part)
+		}
+	}
+	if joined := strings.Join(parts, " "); joined != text {
+		t.Error("parts don't add up to the original text")
+	}
+}
+
+func TestSplitTextWithoutWhitespace(t *testing.T) {
+	// Non-ASCII so the plist encodes it as UTF-16
+	text := strings.ReplaceAll(randomWords(300), " ", "日本語")
+	parts, err := splitText(text, 1024, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(parts, "") != text {
+		t.Error("parts don't add up to the original text")
+	}
+}
+
+func TestSendNoSplitRejectsLongText(t *testing.T) {
+	session := testSession(t)
+	session.handshaker = nil
+	text := randomWords(DefaultLargeMessageSize / 4)
+	_, err := session.Send(context.Background(), "tel:+15555550123", text, SendOptions{NoSplit: true})
+	if !errors.Is(err, apns.ErrPayloadTooLarge) {
+		t.Errorf("err = %v, want ErrPayloadTooLarge", err)
+	}
+}
+
+func TestSendSplitPartsDeduplicate(t *testing.T) {
+	session := testSession(t)
+	session.handshaker = nil
+
+	const id = "0F8E6A52-3C1D-4B7E-9A2F-5D6C7B8A9E01"
+	text := randomWords(DefaultLargeMessageSize / 4)
+	parts, err := session.splitForSend(text, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parts) < 2 {
+		t.Fatalf("got %d parts, want several", len(parts))
+	}
+	for i := range parts {
+		if err := MarkSent(session.store, partUUID(id, i), "tel:+15555550123", time.Now()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Every part was sent before, so the missing handshaker is never hit
+	result, err := session.Send(context.Background(), "tel:+15555550123", text, SendOptions{MessageUUID: id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Duplicate {
+		t.Error("result not marked as duplicate")
+	}
+	if len(result.Parts) != len(parts) {
+		t.Fatalf("got %d parts, want %d", len(result.Parts), len(parts))
+	}
+	if result.Parts[0].MessageUUID != id {
+		t.Errorf("first part UUID = %s, want %s", result.Parts[0].MessageUUID, id)
+	}
+	if partUUID(id, 1) != result.Parts[1].MessageUUID || partUUID(id, 1) == id {
+		t.Errorf("second part UUID = %s", result.Parts[1].MessageUUID)
+	}
+}
@@ -0,0 +1,109 @@
+package messaging
+
+import (
+	"sort"
+	"time"
+)
+
+// Stats summarizes the messages recorded in a store.
+type Stats struct {
+	Sent     int `json:"sent"`
+	Received int `json:"received"`
+	// Chats are sorted by message count, busiest first.
+	Chats []ChatStats `json:"chats"`
+	// Hours counts messages by hour of day, in the location Stats was asked
+	// for.
+	Hours [24]int `json:"hours"`
+	// Senders are the senders of incoming messages, most messages first.
+	Senders         []SenderStats `json:"senders"`
+	Attachments     int           `json:"attachments"`
+	AttachmentBytes int64         `json:"attachment_bytes"`
+}
+
+// ChatStats counts the messages in one chat.
+type ChatStats struct {
+	Chat            string `json:"chat"`
+	Sent            int    `json:"sent"`
+	Received        int    `json:"received"`
+	Attachments     int    `json:"attachments"`
+	AttachmentBytes int64  `json:"attachment_bytes"`
+}
+
+// Messages is the chat's total message count.
+func (c ChatStats) Messages() int {
+	return c.Sent + c.Received
+}
+
+// SenderStats counts the incoming messages from one sender.
+type SenderStats struct {
+	Sender   string `json:"sender"`
+	Messages int    `json:"messages"`
+}
+
+// BusiestHours returns the hours of day with messages, most messages first.
+func (s *Stats) BusiestHours() []int {
+	var hours []int
+	for hour, count := range s.Hours {
+		if count > 0 {
+			hours = append(hours, hour)
+		}
+	}
+	sort.SliceStable(hours, func(i, j int) bool {
+		return s.Hours[hours[i]] > s.Hours[hours[j]]
+	})
+	return hours
+}
+
+// ComputeStats summarizes the messages recorded in store since since (all
+// of them if it's zero), bucketing hours in loc. Messages recorded before
+// senders were kept count toward the chat in DMs and no sender in groups.
+func ComputeStats(store Store, since time.Time, loc *time.Location) *Stats {
+	stats := &Stats{Chats: []ChatStats{}, Senders: []SenderStats{}}
+	senders := make(map[string]int)
+	for _, chat := range store.Chats() {
+		cs := ChatStats{Chat: chat}
+		for _, status := range store.ChatMessages(chat) {
+			at := status.Time()
+			if at.IsZero() || at.Before(since) {
+				continue
+			}
+			if status.FromMe {
+				cs.Sent++
+			} else {
+				cs.Received++
+				sender := status.Sender
+				if sender == "" && !ChatID(chat).IsGroup() {
+					sender = chat
+				}
+				if sender != "" {
+					senders[canonicalChat(sender)]++
+				}
+			}
+			cs.Attachments += status.Attachments
+			cs.AttachmentBytes += status.AttachmentBytes
+			stats.Hours[at.In(loc).Hour()]++
+		}
+		if cs.Messages() == 0 {
+			continue
+		}
+		stats.Sent += cs.Sent
+		stats.Received += cs.Received
+		stats.Attachments += cs.Attachments
+		stats.AttachmentBytes += cs.AttachmentBytes
+		stats.Chats = append(stats.Chats, cs)
+	}
+	sort.SliceStable(stats.Chats, func(i, j int) bool {
+		return stats.Chats[i].Messages() > stats.Chats[j].Messages()
+	})
+	for sender, count := range senders {
+		stats.Senders = append(stats.Senders, SenderStats{Sender: sender, Messages: count})
+	}
+	sort.Slice(stats.Senders, func(i, j int) bool {
+		a, b := stats.Senders[i], stats.Senders[j]
+		if a.Messages != b.Messages {
+			return a.Messages > b.Messages
+		}
+		return a.Sender < b.Sender
+	})
+	return stats
+}
@@ -0,0 +1,38 @@
+package messaging
+
+import (
+	"testing"
+	"time"
+)
+
+func TestComputeStats(t *testing.T) {
+	store := NewMemoryStore()
+	const dm, group = "tel:+15555550123", "chat123"
+	at := time.Date(2024, 5, 1, 9, 30, 0, 0, time.UTC)
+	_ = store.SetCursor(dm, ChatCursor{})
+	_ = store.SetCursor(group, ChatCursor{})
+	_ = MarkReceived(store, Message{ID: "m1", Chat: dm, Sender: dm, Timestamp: at,
+		Attachments: []Attachment{{FileSize: 1000}, {FileSize: 500}}})
+	_ = MarkReceived(store, Message{ID: "m2", Chat: dm, Timestamp: at.Add(time.Minute)})
+	_ = markSent(store, OutgoingMessage{ID: "m3", Chat: dm, Attachments: []Attachment{{FileSize: 10}}}, ServiceIMessage, at.Add(2*time.Hour))
+	_ = MarkReceived(store, Message{ID: "m4", Chat: group, Sender: "mailto:A@example.com", Timestamp: at.Add(3 * time.Hour)})
+	_ = MarkReceived(store, Message{ID: "m5", Chat: group, Sender: "mailto:a@example.com", Timestamp: at.Add(-48 * time.Hour)})
+
+	stats := ComputeStats(store, at.Add(-time.Hour), time.UTC)
+	if stats.Sent != 1 || stats.Received != 3 {
+		t.Errorf("sent %d, received %d, want 1 and 3", stats.Sent, stats.Received)
+	}
+	if len(stats.Chats) != 2 || stats.Chats[0].Chat != dm || stats.Chats[0].Messages() != 3 {
+		t.Errorf("chats = %+v", stats.Chats)
+	}
+	if stats.Attachments != 3 || stats.AttachmentBytes != 1510 {
+		t.Errorf("attachments %d (%d bytes), want 3 (1510 bytes)", stats.Attachments, stats.AttachmentBytes)
+	}
+	want := []SenderStats{{dm, 2}, {"mailto:a@example.com", 1}}
+	if len(stats.Senders) != len(want) || stats.Senders[0] != want[0] || stats.Senders[1] != want[1] {
+		t.Errorf("senders = %+v, want %+v", stats.Senders, want)
+	}
+	if hours := stats.BusiestHours(); len(hours) != 3 || hours[0] != 9 || stats.Hours[9] != 2 {
+		t.Errorf("busiest hours = %v (%v)", hours, stats.Hours)
+	}
+}
@@ -2,30 +2,254 @@ package messaging
 
 import (
 	"errors"
+	"maps"
+	"sort"
 	"sync"
 	"time"
+
+	"imessage-client/messaging/apns"
 )
 
+// ChatCursor records the newest message seen in a chat. Counter is a
+// monotonic count of messages seen in the chat, so it never goes backwards
+// even if clocks skew or timestamps collide.
+type ChatCursor struct {
+	LastMessageID string
+	Counter       uint64
+	Timestamp     time.Time
+	// SnoozedUntil hides the chat's messages until then; see Snooze.
+	SnoozedUntil time.Time
+	// MutedUntil silences notifications for the chat until then, or for good
+	// if it's MuteForever; see Mute.
+	MutedUntil time.Time
+	// Service is the service messages to the chat are sent with, or "" to
+	// pick one per message; see SetChatService.
+	Service string
+}
+
+// MessageStatus records delivery and read markers for a single message.
+// For messages sent by us (FromMe) the times are the remote party's receipts;
+// for incoming messages they record when we received and read the message.
+type MessageStatus struct {
+	Chat   string
+	FromMe bool
+	// Service is ServiceIMessage or ServiceSMS, if known.
+	Service string
+	// Sender is who sent an incoming message, which differs from Chat in
+	// groups.
+	Sender string
+	// Attachments counts the message's attachments, and AttachmentBytes
+	// their total size as far as it's known.
+	Attachments     int
+	AttachmentBytes int64
+	// Sent is when the courier acked a message sent by us.
+	Sent      time.Time
+	Delivered time.Time
+	Read      time.Time
+	// Unconfirmed is when a message sent by us was given up on because no
+	// delivery receipt arrived in time.
+	Unconfirmed time.Time
+}
+
+// Time returns when a message sent by us was sent, or when an incoming
+// one was delivered, whichever is known.
+func (m MessageStatus) Time() time.Time {
+	if m.FromMe && !m.Sent.IsZero() {
+		return m.Sent
+	}
+	return m.Delivered
+}
+
+// Indicator returns a short ✓/✓✓/? marker suitable for history listings.
+func (m MessageStatus) Indicator() string {
+	switch {
+	case !m.Read.IsZero():
+		return "✓✓"
+	case !m.Delivered.IsZero():
+		return "✓"
+	case !m.Unconfirmed.IsZero():
+		return "?"
+	default:
+		return ""
+	}
+}
+
+// DeviceKeys are the private keys a device registered with, PKCS #8 DER
+// encoded, and the device UUID it registered under. Reusing them keeps
+// earlier registrations valid and messages encrypted to the old keys
+// readable.
+type DeviceKeys struct {
+	IDSSigning    []byte `json:"ids_signing,omitempty"`
+	IDSEncryption []byte `json:"ids_encryption,omitempty"`
+	Push          []byte `json:"push,omitempty"`
+	Auth          []byte `json:"auth,omitempty"`
+	DeviceUUID    string `json:"device_uuid,omitempty"`
+}
+
 // Store tracks last seen message IDs or timestamps to filter unread results.
 type Store interface {
 	LastSeen(chat string) time.Time
 	SetLastSeen(chat string, ts time.Time) error
+	Cursor(chat string) ChatCursor
+	SetCursor(chat string, cursor ChatCursor) error
+	MessageStatus(id string) (MessageStatus, bool)
+	SetMessageStatus(id string, status MessageStatus) error
+	// Chats lists the chats that have a cursor.
+	Chats() []string
+	// ChatMessages returns the statuses recorded for chat's messages, keyed
+	// by message ID.
+	ChatMessages(chat string) map[string]MessageStatus
+	IDCertExpiry() time.Time
+	SetIDCertExpiry(expiry time.Time) error
+	// Handles returns the handles recorded by the last session, and whether
+	// any were recorded at all.
+	Handles() ([]string, bool)
+	SetHandles(handles []string) error
+	// SpillMessage keeps an incoming message that didn't fit in the session's
+	// queue until TakeSpilledMessages returns and forgets it.
+	SpillMessage(msg Message) error
+	TakeSpilledMessages() ([]Message, error)
+	// QueueOutgoing keeps a message that couldn't be sent while offline
+	// until TakeQueuedOutgoing returns and forgets it.
+	QueueOutgoing(msg OutgoingMessage) error
+	TakeQueuedOutgoing() ([]OutgoingMessage, error)
+	// IdentityPins returns the identity keys pinned for handle's devices,
+	// keyed by hex push token.
+	IdentityPins(handle string) map[string]IdentityPin
+	SetIdentityPins(handle string, pins map[string]IdentityPin) error
+	// CourierStats returns the latency measured for each courier host.
+	CourierStats() map[string]apns.CourierStat
+	SetCourierStats(stats map[string]apns.CourierStat) error
+	// DeviceKeys returns the keys saved by an earlier handshake, and whether
+	// any were saved.
+	DeviceKeys() (DeviceKeys, bool)
+	SetDeviceKeys(keys DeviceKeys) error
+}
+
+// MarkSent records that a message we sent was accepted by the courier.
+func MarkSent(store Store, id, chat string, at time.Time) error {
+	return markSent(store, OutgoingMessage{ID: id, Chat: chat}, "", at)
+}
+
+// markSent is MarkSent for a whole message, so its attachments are
+// recorded too, along with the service it was sent with if that's known.
+func markSent(store Store, msg OutgoingMessage, service string, at time.Time) error {
+	status, _ := store.MessageStatus(msg.ID)
+	status.Chat = msg.Chat
+	status.FromMe = true
+	if service != "" {
+		status.Service = service
+	}
+	if status.Sent.IsZero() {
+		status.Sent = at
+	}
+	if len(msg.Attachments) > 0 {
+		status.Attachments, status.AttachmentBytes = attachmentVolume(msg.Attachments)
+	}
+	return store.SetMessageStatus(msg.ID, status)
+}
+
+// MarkDelivered records that a message was delivered at the given time,
+// keeping any existing read marker.
+func MarkDelivered(store Store, id, chat string, fromMe bool, at time.Time) error {
+	status, _ := store.MessageStatus(id)
+	status.Chat = chat
+	status.FromMe = fromMe
+	if status.Delivered.IsZero() {
+		status.Delivered = at
+	}
+	return store.SetMessageStatus(id, status)
+}
+
+// MarkReceived records that an incoming message was delivered, along with
+// the service it came in on, its sender and its attachments. A message from
+// our other devices is recorded as sent by us instead.
+func MarkReceived(store Store, msg Message) error {
+	status, _ := store.MessageStatus(msg.ID)
+	status.Chat = msg.Chat
+	if msg.Service != "" {
+		status.Service = msg.Service
+	}
+	if msg.Sender != "" {
+		status.Sender = msg.Sender
+	}
+	if len(msg.Attachments) > 0 {
+		status.Attachments, status.AttachmentBytes = attachmentVolume(msg.Attachments)
+	}
+	if msg.IsFromMe {
+		// Sent from our other device; whether it was delivered is for that
+		// device to know
+		status.FromMe = true
+		if status.Sent.IsZero() {
+			status.Sent = msg.Timestamp
+		}
+	} else if status.Delivered.IsZero() {
+		status.Delivered = msg.Timestamp
+	}
+	return store.SetMessageStatus(msg.ID, status)
+}
+
+func attachmentVolume(attachments []Attachment) (int, int64) {
+	var size int64
+	for _, att := range attachments {
+		size += int64(att.FileSize)
+	}
+	return len(attachments), size
+}
+
+// MarkUnconfirmed records that no delivery receipt arrived in time for a
+// message we sent.
+func MarkUnconfirmed(store Store, id, chat string, at time.Time) error {
+	status, _ := store.MessageStatus(id)
+	status.Chat = chat
+	status.FromMe = true
+	if status.Unconfirmed.IsZero() {
+		status.Unconfirmed = at
+	}
+	return store.SetMessageStatus(id, status)
+}
+
+// MarkRead records that a message was read at the given time. A read
+// message is implicitly delivered.
+func MarkRead(store Store, id, chat string, fromMe bool, at time.Time) error {
+	status, _ := store.MessageStatus(id)
+	status.Chat = chat
+	status.FromMe = fromMe
+	if status.Delivered.IsZero() {
+		status.Delivered = at
+	}
+	if status.Read.IsZero() {
+		status.Read = at
+	}
+	return store.SetMessageStatus(id, status)
 }
 
 // MemoryStore is a simple in-memory implementation suitable for short-lived sessions.
 type MemoryStore struct {
-	mu   sync.RWMutex
-	seen map[string]time.Time
+	mu       sync.RWMutex
+	cursors  map[string]ChatCursor
+	statuses map[string]MessageStatus
+	certExp  time.Time
+	handles  []string
+	spilled  []Message
+	outgoing []OutgoingMessage
+	pins     map[string]map[string]IdentityPin
+	couriers map[string]apns.CourierStat
+	keys     *DeviceKeys
 }
 
 func NewMemoryStore() *MemoryStore {
-	return &MemoryStore{seen: make(map[string]time.Time)}
+	return &MemoryStore{
+		cursors:  make(map[string]ChatCursor),
+		statuses: make(map[string]MessageStatus),
+		pins:     make(map[string]map[string]IdentityPin),
+	}
 }
 
 func (s *MemoryStore) LastSeen(chat string) time.Time {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
-	return s.seen[chat]
+	return s.cursors[chat].Timestamp
 }
 
 func (s *MemoryStore) SetLastSeen(chat string, ts time.Time) error {
@@ -34,6 +258,170 @@ func (s *MemoryStore) SetLastSeen(chat string, ts time.Time) error {
 	}
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	s.seen[chat] = ts
+	cursor := s.cursors[chat]
+	cursor.Timestamp = ts
+	s.cursors[chat] = cursor
+	return nil
+}
+
+func (s *MemoryStore) Cursor(chat string) ChatCursor {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.cursors[chat]
+}
+
+func (s *MemoryStore) SetCursor(chat string, cursor ChatCursor) error {
+	if chat == "" {
+		return errors.New("chat identifier is empty")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cursors[chat] = cursor
+	return nil
+}
+
+func (s *MemoryStore) MessageStatus(id string) (MessageStatus, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	status, ok := s.statuses[id]
+	return status, ok
+}
+
+func (s *MemoryStore) SetMessageStatus(id string, status MessageStatus) error {
+	if id == "" {
+		return errors.New("message identifier is empty")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.statuses[id] = status
+	return nil
+}
+
+func (s *MemoryStore) Chats() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	chats := make([]string, 0, len(s.cursors))
+	for chat := range s.cursors {
+		chats = append(chats, chat)
+	}
+	sort.Strings(chats)
+	return chats
+}
+
+func (s *MemoryStore) ChatMessages(chat string) map[string]MessageStatus {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return chatMessages(s.statuses, chat)
+}
+
+// chatMessages picks chat's messages out of statuses.
+func chatMessages(statuses map[string]MessageStatus, chat string) map[string]MessageStatus {
+	messages := make(map[string]MessageStatus)
+	for id, status := range statuses {
+		if status.Chat == chat {
+			messages[id] = status
+		}
+	}
+	return messages
+}
+
+func (s *MemoryStore) IDCertExpiry() time.Time {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.certExp
+}
+
+func (s *MemoryStore) SetIDCertExpiry(expiry time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.certExp = expiry
+	return nil
+}
+
+func (s *MemoryStore) Handles() ([]string, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]string(nil), s.handles...), s.handles != nil
+}
+
+func (s *MemoryStore) SetHandles(handles []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.handles = append([]string{}, handles...)
+	return nil
+}
+
+func (s *MemoryStore) SpillMessage(msg Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.spilled = append(s.spilled, msg)
+	return nil
+}
+
+func (s *MemoryStore) TakeSpilledMessages() ([]Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	spilled := s.spilled
+	s.spilled = nil
+	return spilled, nil
+}
+
+func (s *MemoryStore) QueueOutgoing(msg OutgoingMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.outgoing = append(s.outgoing, msg)
+	return nil
+}
+
+func (s *MemoryStore) TakeQueuedOutgoing() ([]OutgoingMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	outgoing := s.outgoing
+	s.outgoing = nil
+	return outgoing, nil
+}
+
+func (s *MemoryStore) IdentityPins(handle string) map[string]IdentityPin {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return maps.Clone(s.pins[handle])
+}
+
+func (s *MemoryStore) SetIdentityPins(handle string, pins map[string]IdentityPin) error {
+	if handle == "" {
+		return errors.New("handle is empty")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pins[handle] = maps.Clone(pins)
+	return nil
+}
+
+func (s *MemoryStore) CourierStats() map[string]apns.CourierStat {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return maps.Clone(s.couriers)
+}
+
+func (s *MemoryStore) SetCourierStats(stats map[string]apns.CourierStat) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.couriers = maps.Clone(stats)
+	return nil
+}
+
+func (s *MemoryStore) DeviceKeys() (DeviceKeys, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.keys == nil {
+		return DeviceKeys{}, false
+	}
+	return *s.keys, true
+}
+
+func (s *MemoryStore) SetDeviceKeys(keys DeviceKeys) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys = &keys
 	return nil
 }
@@ -0,0 +1,343 @@
+package messaging
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"imessage-client/messaging/apns"
+)
+
+// Buckets of a BoltStore. Values use the same JSON encodings as FileStore.
+var (
+	boltChats    = []byte("chats")
+	boltMessages = []byte("messages")
+	boltMeta     = []byte("meta")
+	boltSpilled  = []byte("spilled")
+	boltOutgoing = []byte("outgoing")
+	boltPins     = []byte("identity_pins")
+
+	boltBuckets = [][]byte{boltChats, boltMessages, boltMeta, boltSpilled, boltOutgoing, boltPins}
+)
+
+// Keys in the meta bucket.
+var (
+	boltCertExpiryKey = []byte("id_cert_expiry")
+	boltHandlesKey    = []byte("handles")
+	boltCouriersKey   = []byte("couriers")
+	boltKeysKey       = []byte("device_keys")
+)
+
+// DefaultBoltLockTimeout is how long NewBoltStore waits for another process
+// holding the database, such as a running daemon.
+const DefaultBoltLockTimeout = 2 * time.Second
+
+// BoltStore keeps state in a single bbolt database file. Every change is its
+// own transaction, so nothing is lost if the process dies, and no cgo is
+// needed. Only one process can have the file open at a time.
+type BoltStore struct {
+	db *bolt.DB
+}
+
+// NewBoltStore opens or creates the database at path.
+func NewBoltStore(path string) (*BoltStore, error) {
+	if path == "" {
+		return nil, errors.New("store path is empty")
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: DefaultBoltLockTimeout})
+	if errors.Is(err, bolt.ErrTimeout) {
+		return nil, fmt.Errorf("store %s is in use by another process", path)
+	} else if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range boltBuckets {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltStore{db: db}, nil
+}
+
+// Close closes the database file.
+func (b *BoltStore) Close() error {
+	return b.db.Close()
+}
+
+// get decodes the JSON value at key into v, reporting whether it was there.
+func (b *BoltStore) get(bucket, key []byte, v interface{}) bool {
+	found := false
+	err := b.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(bucket).Get(key)
+		if data == nil {
+			return nil
+		}
+		found = true
+		return json.Unmarshal(data, v)
+	})
+	return found && err == nil
+}
+
+func (b *BoltStore) put(bucket, key []byte, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucket).Put(key, data)
+	})
+}
+
+func (b *BoltStore) LastSeen(chat string) time.Time {
+	return b.Cursor(chat).Timestamp
+}
+
+func (b *BoltStore) SetLastSeen(chat string, ts time.Time) error {
+	if chat == "" {
+		return errors.New("chat identifier is empty")
+	}
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltChats)
+		var state fileChatState
+		if data := bucket.Get([]byte(chat)); data != nil {
+			if err := json.Unmarshal(data, &state); err != nil {
+				return err
+			}
+		}
+		state.LastSeen = formatStoreTime(ts)
+		data, err := json.Marshal(state)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(chat), data)
+	})
+}
+
+func (b *BoltStore) Cursor(chat string) ChatCursor {
+	var state fileChatState
+	b.get(boltChats, []byte(chat), &state)
+	return state.toCursor()
+}
+
+func (b *BoltStore) SetCursor(chat string, cursor ChatCursor) error {
+	if chat == "" {
+		return errors.New("chat identifier is empty")
+	}
+	return b.put(boltChats, []byte(chat), newFileChatState(cursor))
+}
+
+func (b *BoltStore) MessageStatus(id string) (MessageStatus, bool) {
+	var status fileMessageStatus
+	if !b.get(boltMessages, []byte(id), &status) {
+		return MessageStatus{}, false
+	}
+	return status.toStatus(), true
+}
+
+func (b *BoltStore) SetMessageStatus(id string, status MessageStatus) error {
+	if id == "" {
+		return errors.New("message identifier is empty")
+	}
+	return b.put(boltMessages, []byte(id), newFileMessageStatus(status))
+}
+
+func (b *BoltStore) Chats() []string {
+	var chats []string
+	b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltChats).ForEach(func(k, _ []byte) error {
+			chats = append(chats, string(k))
+			return nil
+		})
+	})
+	// Keys come out in byte order already; sort anyway to match the other stores
+	sort.Strings(chats)
+	return chats
+}
+
+func (b *BoltStore) ChatMessages(chat string) map[string]MessageStatus {
+	messages := make(map[string]MessageStatus)
+	b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltMessages).ForEach(func(k, v []byte) error {
+			var status fileMessageStatus
+			if err := json.Unmarshal(v, &status); err == nil && status.Chat == chat {
+				messages[string(k)] = status.toStatus()
+			}
+			return nil
+		})
+	})
+	return messages
+}
+
+func (b *BoltStore) IDCertExpiry() time.Time {
+	var expiry string
+	b.get(boltMeta, boltCertExpiryKey, &expiry)
+	return parseStoreTime(expiry)
+}
+
+func (b *BoltStore) SetIDCertExpiry(expiry time.Time) error {
+	return b.put(boltMeta, boltCertExpiryKey, formatStoreTime(expiry))
+}
+
+func (b *BoltStore) Handles() ([]string, bool) {
+	var handles []string
+	if !b.get(boltMeta, boltHandlesKey, &handles) {
+		return nil, false
+	}
+	if handles == nil {
+		handles = []string{}
+	}
+	return handles, true
+}
+
+func (b *BoltStore) SetHandles(handles []string) error {
+	return b.put(boltMeta, boltHandlesKey, append([]string{}, handles...))
+}
+
+// appendSequenced adds v under the bucket's next sequence number, so the
+// bucket reads back in insertion order.
+func (b *BoltStore) appendSequenced(bucket []byte, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket(bucket)
+		seq, err := bkt.NextSequence()
+		if err != nil {
+			return err
+		}
+		return bkt.Put(binary.BigEndian.AppendUint64(nil, seq), data)
+	})
+}
+
+// takeSequenced decodes and deletes every value in the bucket, oldest first.
+func (b *BoltStore) takeSequenced(bucket []byte, decode func([]byte) error) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket(bucket)
+		var keys [][]byte
+		err := bkt.ForEach(func(k, v []byte) error {
+			keys = append(keys, append([]byte(nil), k...))
+			return decode(v)
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range keys {
+			if err := bkt.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (b *BoltStore) SpillMessage(msg Message) error {
+	return b.appendSequenced(boltSpilled, msg)
+}
+
+func (b *BoltStore) TakeSpilledMessages() ([]Message, error) {
+	var spilled []Message
+	err := b.takeSequenced(boltSpilled, func(data []byte) error {
+		var msg Message
+		if err := json.Unmarshal(data, &msg); err != nil {
+			return err
+		}
+		spilled = append(spilled, msg)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return spilled, nil
+}
+
+func (b *BoltStore) QueueOutgoing(msg OutgoingMessage) error {
+	return b.appendSequenced(boltOutgoing, msg)
+}
+
+func (b *BoltStore) TakeQueuedOutgoing() ([]OutgoingMessage, error) {
+	var outgoing []OutgoingMessage
+	err := b.takeSequenced(boltOutgoing, func(data []byte) error {
+		var msg OutgoingMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			return err
+		}
+		outgoing = append(outgoing, msg)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return outgoing, nil
+}
+
+func (b *BoltStore) IdentityPins(handle string) map[string]IdentityPin {
+	var stored map[string]fileIdentityPin
+	if !b.get(boltPins, []byte(handle), &stored) {
+		return nil
+	}
+	pins := make(map[string]IdentityPin, len(stored))
+	for token, pin := range stored {
+		pins[token] = pin.toPin()
+	}
+	return pins
+}
+
+func (b *BoltStore) SetIdentityPins(handle string, pins map[string]IdentityPin) error {
+	if handle == "" {
+		return errors.New("handle is empty")
+	}
+	stored := make(map[string]fileIdentityPin, len(pins))
+	for token, pin := range pins {
+		stored[token] = newFileIdentityPin(pin)
+	}
+	return b.put(boltPins, []byte(handle), stored)
+}
+
+func (b *BoltStore) CourierStats() map[string]apns.CourierStat {
+	var stored map[string]fileCourierStat
+	if !b.get(boltMeta, boltCouriersKey, &stored) {
+		return nil
+	}
+	stats := make(map[string]apns.CourierStat, len(stored))
+	for host, stat := range stored {
+		stats[host] = stat.toStat()
+	}
+	return stats
+}
+
+func (b *BoltStore) SetCourierStats(stats map[string]apns.CourierStat) error {
+	stored := make(map[string]fileCourierStat, len(stats))
+	for host, stat := range stats {
+		stored[host] = newFileCourierStat(stat)
+	}
+	return b.put(boltMeta, boltCouriersKey, stored)
+}
+
+func (b *BoltStore) DeviceKeys() (DeviceKeys, bool) {
+	var keys DeviceKeys
+	if !b.get(boltMeta, boltKeysKey, &keys) {
+		return DeviceKeys{}, false
+	}
+	return keys, true
+}
+
+func (b *BoltStore) SetDeviceKeys(keys DeviceKeys) error {
+	return b.put(boltMeta, boltKeysKey, keys)
+}
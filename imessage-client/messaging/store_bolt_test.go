@@ -0,0 +1,72 @@
+package messaging
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBoltStoreReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.db")
+	store, err := NewBoltStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	delivered := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	if err := store.SetCursor("tel:+15555550123", ChatCursor{Timestamp: delivered, LastMessageID: "m1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SetMessageStatus("m1", MessageStatus{Chat: "tel:+15555550123", Delivered: delivered}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SetMessageStatus("m2", MessageStatus{Chat: "mailto:a@example.com", FromMe: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SetHandles([]string{"tel:+15555550100"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"1", "2"} {
+		if err := store.SpillMessage(Message{ID: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Another open waits for the lock instead of corrupting the file
+	if _, err := NewBoltStore(path); err == nil {
+		t.Fatal("second open succeeded while the store was in use")
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := NewBoltStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	if cursor := reopened.Cursor("tel:+15555550123"); !cursor.Timestamp.Equal(delivered) || cursor.LastMessageID != "m1" {
+		t.Errorf("cursor = %+v", cursor)
+	}
+	if chats := reopened.Chats(); len(chats) != 1 || chats[0] != "tel:+15555550123" {
+		t.Errorf("chats = %v", chats)
+	}
+	if messages := reopened.ChatMessages("tel:+15555550123"); len(messages) != 1 || !messages["m1"].Delivered.Equal(delivered) {
+		t.Errorf("chat messages = %v", messages)
+	}
+	if _, ok := reopened.MessageStatus("m3"); ok {
+		t.Error("unknown message has a status")
+	}
+	if handles, ok := reopened.Handles(); !ok || len(handles) != 1 {
+		t.Errorf("handles = %v, %v", handles, ok)
+	}
+	spilled, err := reopened.TakeSpilledMessages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(spilled) != 2 || spilled[0].ID != "1" || spilled[1].ID != "2" {
+		t.Errorf("spilled = %v, want [1 2]", spilled)
+	}
+	if rest, _ := reopened.TakeSpilledMessages(); len(rest) != 0 {
+		t.Errorf("spilled messages not removed: %v", rest)
+	}
+}
@@ -0,0 +1,322 @@
+package messaging
+
+import (
+	"errors"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"imessage-client/messaging/apns"
+)
+
+// CachedStore puts a write-behind cache in front of another Store. Cursors
+// and message statuses, which are written for every message, are served from
+// memory once read and written back in batches after flushInterval, or
+// immediately on Flush/Close. Everything else is rare and goes straight to
+// the backend.
+type CachedStore struct {
+	backend Store
+
+	mu       sync.RWMutex
+	cursors  map[string]ChatCursor
+	statuses map[string]MessageStatus
+	// known records IDs looked up in the backend and not found, so misses
+	// are cached too.
+	known           map[string]bool
+	pendingCursors  map[string]bool
+	pendingStatuses map[string]bool
+
+	flushInterval time.Duration
+	flushMu       sync.Mutex
+	flushTimer    *time.Timer
+	flushErr      error
+	closed        bool
+}
+
+// NewCachedStore wraps backend with a cache that flushes every interval. An
+// interval of zero writes through on every change.
+func NewCachedStore(backend Store, interval time.Duration) *CachedStore {
+	return &CachedStore{
+		backend:         backend,
+		cursors:         make(map[string]ChatCursor),
+		statuses:        make(map[string]MessageStatus),
+		known:           make(map[string]bool),
+		pendingCursors:  make(map[string]bool),
+		pendingStatuses: make(map[string]bool),
+		flushInterval:   interval,
+	}
+}
+
+func (c *CachedStore) LastSeen(chat string) time.Time {
+	return c.Cursor(chat).Timestamp
+}
+
+func (c *CachedStore) SetLastSeen(chat string, ts time.Time) error {
+	if chat == "" {
+		return errors.New("chat identifier is empty")
+	}
+	cursor := c.Cursor(chat)
+	cursor.Timestamp = ts
+	return c.SetCursor(chat, cursor)
+}
+
+func (c *CachedStore) Cursor(chat string) ChatCursor {
+	c.mu.RLock()
+	cursor, ok := c.cursors[chat]
+	c.mu.RUnlock()
+	if ok {
+		return cursor
+	}
+	cursor = c.backend.Cursor(chat)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if cached, ok := c.cursors[chat]; ok {
+		// Set while we were reading the backend
+		return cached
+	}
+	c.cursors[chat] = cursor
+	return cursor
+}
+
+func (c *CachedStore) SetCursor(chat string, cursor ChatCursor) error {
+	if chat == "" {
+		return errors.New("chat identifier is empty")
+	}
+	c.mu.Lock()
+	c.cursors[chat] = cursor
+	c.pendingCursors[chat] = true
+	c.mu.Unlock()
+	return c.markDirty()
+}
+
+func (c *CachedStore) MessageStatus(id string) (MessageStatus, bool) {
+	c.mu.RLock()
+	status, ok := c.statuses[id]
+	seen := c.known[id]
+	c.mu.RUnlock()
+	if ok || seen {
+		return status, ok
+	}
+	status, ok = c.backend.MessageStatus(id)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if cached, found := c.statuses[id]; found {
+		return cached, true
+	}
+	c.known[id] = true
+	if ok {
+		c.statuses[id] = status
+	}
+	return status, ok
+}
+
+func (c *CachedStore) SetMessageStatus(id string, status MessageStatus) error {
+	if id == "" {
+		return errors.New("message identifier is empty")
+	}
+	c.mu.Lock()
+	c.statuses[id] = status
+	c.known[id] = true
+	c.pendingStatuses[id] = true
+	c.mu.Unlock()
+	return c.markDirty()
+}
+
+func (c *CachedStore) Chats() []string {
+	chats := c.backend.Chats()
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	seen := make(map[string]bool, len(chats))
+	for _, chat := range chats {
+		seen[chat] = true
+	}
+	for chat := range c.pendingCursors {
+		if !seen[chat] {
+			chats = append(chats, chat)
+		}
+	}
+	sort.Strings(chats)
+	return chats
+}
+
+func (c *CachedStore) ChatMessages(chat string) map[string]MessageStatus {
+	messages := c.backend.ChatMessages(chat)
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for id := range c.pendingStatuses {
+		// Pending changes may have moved a message into or out of chat
+		if status := c.statuses[id]; status.Chat == chat {
+			messages[id] = status
+		} else {
+			delete(messages, id)
+		}
+	}
+	return messages
+}
+
+func (c *CachedStore) IDCertExpiry() time.Time {
+	return c.backend.IDCertExpiry()
+}
+
+func (c *CachedStore) SetIDCertExpiry(expiry time.Time) error {
+	return c.backend.SetIDCertExpiry(expiry)
+}
+
+func (c *CachedStore) Handles() ([]string, bool) {
+	return c.backend.Handles()
+}
+
+func (c *CachedStore) SetHandles(handles []string) error {
+	return c.backend.SetHandles(handles)
+}
+
+func (c *CachedStore) SpillMessage(msg Message) error {
+	return c.backend.SpillMessage(msg)
+}
+
+func (c *CachedStore) TakeSpilledMessages() ([]Message, error) {
+	return c.backend.TakeSpilledMessages()
+}
+
+func (c *CachedStore) QueueOutgoing(msg OutgoingMessage) error {
+	return c.backend.QueueOutgoing(msg)
+}
+
+func (c *CachedStore) TakeQueuedOutgoing() ([]OutgoingMessage, error) {
+	return c.backend.TakeQueuedOutgoing()
+}
+
+func (c *CachedStore) IdentityPins(handle string) map[string]IdentityPin {
+	return c.backend.IdentityPins(handle)
+}
+
+func (c *CachedStore) SetIdentityPins(handle string, pins map[string]IdentityPin) error {
+	return c.backend.SetIdentityPins(handle, pins)
+}
+
+func (c *CachedStore) CourierStats() map[string]apns.CourierStat {
+	return c.backend.CourierStats()
+}
+
+func (c *CachedStore) SetCourierStats(stats map[string]apns.CourierStat) error {
+	return c.backend.SetCourierStats(stats)
+}
+
+func (c *CachedStore) DeviceKeys() (DeviceKeys, bool) {
+	return c.backend.DeviceKeys()
+}
+
+func (c *CachedStore) SetDeviceKeys(keys DeviceKeys) error {
+	return c.backend.SetDeviceKeys(keys)
+}
+
+// Flush writes pending changes to the backend immediately. It also reports
+// errors from earlier background flushes.
+func (c *CachedStore) Flush() error {
+	c.flushMu.Lock()
+	defer c.flushMu.Unlock()
+	if c.flushTimer != nil {
+		c.flushTimer.Stop()
+		c.flushTimer = nil
+	}
+	return c.flushLocked()
+}
+
+// Close flushes pending changes and closes the backend.
+func (c *CachedStore) Close() error {
+	c.flushMu.Lock()
+	if c.flushTimer != nil {
+		c.flushTimer.Stop()
+		c.flushTimer = nil
+	}
+	c.closed = true
+	err := c.flushLocked()
+	c.flushMu.Unlock()
+	if closer, ok := c.backend.(io.Closer); ok {
+		if closeErr := closer.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// markDirty schedules a flush of pending changes.
+func (c *CachedStore) markDirty() error {
+	c.flushMu.Lock()
+	defer c.flushMu.Unlock()
+	if c.flushInterval <= 0 || c.closed {
+		return c.flushLocked()
+	}
+	if c.flushTimer == nil {
+		c.flushTimer = time.AfterFunc(c.flushInterval, c.backgroundFlush)
+	}
+	return nil
+}
+
+func (c *CachedStore) backgroundFlush() {
+	c.flushMu.Lock()
+	defer c.flushMu.Unlock()
+	c.flushTimer = nil
+	if err := c.flushLocked(); err != nil {
+		// Keep the error so the next Flush/Close can surface it.
+		c.flushErr = err
+	}
+}
+
+// flushLocked writes pending changes to the backend. Changes stay pending
+// until written, so reads see them even while a flush is in progress and a
+// failed write is retried by the next flush. Caller must hold flushMu.
+func (c *CachedStore) flushLocked() error {
+	prevErr := c.flushErr
+	c.flushErr = nil
+
+	c.mu.RLock()
+	cursors := make(map[string]ChatCursor, len(c.pendingCursors))
+	for chat := range c.pendingCursors {
+		cursors[chat] = c.cursors[chat]
+	}
+	statuses := make(map[string]MessageStatus, len(c.pendingStatuses))
+	for id := range c.pendingStatuses {
+		statuses[id] = c.statuses[id]
+	}
+	c.mu.RUnlock()
+
+	var err error
+	for chat, cursor := range cursors {
+		if setErr := c.backend.SetCursor(chat, cursor); setErr != nil {
+			err = setErr
+			delete(cursors, chat)
+		}
+	}
+	for id, status := range statuses {
+		if setErr := c.backend.SetMessageStatus(id, status); setErr != nil {
+			err = setErr
+			delete(statuses, id)
+		}
+	}
+
+	c.mu.Lock()
+	for chat, cursor := range cursors {
+		// Leave anything changed during the flush for the next one
+		if c.cursors[chat] == cursor {
+			delete(c.pendingCursors, chat)
+		}
+	}
+	for id, status := range statuses {
+		if c.statuses[id] == status {
+			delete(c.pendingStatuses, id)
+		}
+	}
+	c.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+	if flusher, ok := c.backend.(interface{ Flush() error }); ok {
+		if err := flusher.Flush(); err != nil {
+			return err
+		}
+	}
+	return prevErr
+}
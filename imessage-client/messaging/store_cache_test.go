@@ -0,0 +1,51 @@
+package messaging
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCachedStoreWritesBehind(t *testing.T) {
+	backend := NewMemoryStore()
+	_ = backend.SetMessageStatus("old", MessageStatus{Chat: "tel:+15555550123"})
+	store := NewCachedStore(backend, time.Hour)
+
+	if _, ok := store.MessageStatus("old"); !ok {
+		t.Fatal("status in backend not read through")
+	}
+	delivered := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	if err := MarkDelivered(store, "new", "tel:+15555550123", false, delivered); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SetCursor("tel:+15555550123", ChatCursor{LastMessageID: "new"}); err != nil {
+		t.Fatal(err)
+	}
+	// Moving a message out of a chat hides it there before it's flushed
+	_ = store.SetMessageStatus("old", MessageStatus{Chat: "mailto:a@example.com"})
+
+	if _, ok := backend.MessageStatus("new"); ok {
+		t.Error("write reached the backend before a flush")
+	}
+	if status, ok := store.MessageStatus("new"); !ok || !status.Delivered.Equal(delivered) {
+		t.Errorf("pending status = %+v, %v", status, ok)
+	}
+	if chats := store.Chats(); len(chats) != 1 || chats[0] != "tel:+15555550123" {
+		t.Errorf("chats = %v", chats)
+	}
+	if messages := store.ChatMessages("tel:+15555550123"); len(messages) != 1 || messages["new"].Chat == "" {
+		t.Errorf("chat messages = %v", messages)
+	}
+
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if status, ok := backend.MessageStatus("new"); !ok || !status.Delivered.Equal(delivered) {
+		t.Errorf("flushed status = %+v, %v", status, ok)
+	}
+	if status, _ := backend.MessageStatus("old"); status.Chat != "mailto:a@example.com" {
+		t.Errorf("flushed status chat = %q", status.Chat)
+	}
+	if cursor := backend.Cursor("tel:+15555550123"); cursor.LastMessageID != "new" {
+		t.Errorf("flushed cursor = %+v", cursor)
+	}
+}
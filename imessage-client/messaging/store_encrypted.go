@@ -0,0 +1,393 @@
+package messaging
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/scrypt"
+
+	"imessage-client/messaging/apns"
+)
+
+var ErrWrongPassphrase = errors.New("wrong store passphrase")
+
+// sealedPrefix marks a value encrypted by EncryptedStore. Values without it
+// were written before encryption was turned on and are read as they are.
+const sealedPrefix = "enc:"
+
+// storeKeyCheck is encrypted into the key file so a wrong passphrase is
+// caught before anything is written with it.
+const storeKeyCheck = "imessage-client store key"
+
+// scrypt cost for new key files. Existing files keep the cost they were
+// created with.
+const (
+	storeKeyScryptN = 1 << 15
+	storeKeyScryptR = 8
+	storeKeyScryptP = 1
+)
+
+// storeKeyFile is kept next to an encrypted store. It holds the salt and
+// cost the key is derived with, but not the key.
+type storeKeyFile struct {
+	Version int    `json:"version"`
+	Salt    []byte `json:"salt"`
+	N       int    `json:"n"`
+	R       int    `json:"r"`
+	P       int    `json:"p"`
+	Check   string `json:"check"`
+}
+
+// OpenStoreKey derives the key for an encrypted store from passphrase, using
+// the key file at path, or creating one with a new salt if there isn't one.
+// It returns ErrWrongPassphrase if the key file was made with a different
+// passphrase.
+func OpenStoreKey(path, passphrase string) ([]byte, error) {
+	if passphrase == "" {
+		return nil, errors.New("store passphrase is empty")
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return createStoreKey(path, passphrase)
+	} else if err != nil {
+		return nil, err
+	}
+	var kf storeKeyFile
+	if err := json.Unmarshal(data, &kf); err != nil {
+		return nil, fmt.Errorf("failed to parse store key file %s: %w", path, err)
+	}
+	key, err := scrypt.Key([]byte(passphrase), kf.Salt, kf.N, kf.R, kf.P, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid store key file %s: %w", path, err)
+	}
+	sealer, err := newStoreSealer(key)
+	if err != nil {
+		return nil, err
+	}
+	if check, err := sealer.open(kf.Check); err != nil || check != storeKeyCheck {
+		return nil, ErrWrongPassphrase
+	}
+	return key, nil
+}
+
+func createStoreKey(path, passphrase string) ([]byte, error) {
+	kf := storeKeyFile{
+		Version: 1,
+		Salt:    make([]byte, 16),
+		N:       storeKeyScryptN,
+		R:       storeKeyScryptR,
+		P:       storeKeyScryptP,
+	}
+	if _, err := io.ReadFull(rand.Reader, kf.Salt); err != nil {
+		return nil, err
+	}
+	key, err := scrypt.Key([]byte(passphrase), kf.Salt, kf.N, kf.R, kf.P, 32)
+	if err != nil {
+		return nil, err
+	}
+	sealer, err := newStoreSealer(key)
+	if err != nil {
+		return nil, err
+	}
+	kf.Check = sealer.seal(storeKeyCheck)
+	data, err := json.MarshalIndent(kf, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		return nil, fmt.Errorf("failed to write store key file: %w", err)
+	}
+	return key, nil
+}
+
+// storeSealer encrypts strings deterministically, so an encrypted chat ID
+// can still be used as a key in the backend. The nonce is an HMAC of the
+// plaintext; the same plaintext always encrypts to the same value, which
+// reveals only that two values are equal.
+type storeSealer struct {
+	aead     cipher.AEAD
+	nonceKey []byte
+}
+
+func newStoreSealer(key []byte) (*storeSealer, error) {
+	subkey := func(label string) []byte {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(label))
+		return mac.Sum(nil)
+	}
+	block, err := aes.NewCipher(subkey("encrypt"))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &storeSealer{aead: aead, nonceKey: subkey("nonce")}, nil
+}
+
+func (s *storeSealer) seal(plaintext string) string {
+	if plaintext == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, s.nonceKey)
+	mac.Write([]byte(plaintext))
+	nonce := mac.Sum(nil)[:s.aead.NonceSize()]
+	sealed := s.aead.Seal(nonce, nonce, []byte(plaintext), nil)
+	return sealedPrefix + base64.RawURLEncoding.EncodeToString(sealed)
+}
+
+func (s *storeSealer) open(value string) (string, error) {
+	encoded, ok := strings.CutPrefix(value, sealedPrefix)
+	if !ok {
+		return value, nil
+	}
+	sealed, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil || len(sealed) < s.aead.NonceSize() {
+		return "", errors.New("malformed encrypted store value")
+	}
+	n := s.aead.NonceSize()
+	plaintext, err := s.aead.Open(nil, sealed[:n], sealed[n:], nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt store value: %w", err)
+	}
+	return string(plaintext), nil
+}
+
+// EncryptedStore encrypts what another Store would reveal about contacts:
+// chat IDs, handles, and queued or spilled messages, as well as the device's
+// private keys. Timestamps, message IDs and courier stats are kept in the
+// clear.
+type EncryptedStore struct {
+	backend Store
+	sealer  *storeSealer
+}
+
+// NewEncryptedStore wraps backend, encrypting with a key from OpenStoreKey.
+func NewEncryptedStore(backend Store, key []byte) (*EncryptedStore, error) {
+	sealer, err := newStoreSealer(key)
+	if err != nil {
+		return nil, err
+	}
+	return &EncryptedStore{backend: backend, sealer: sealer}, nil
+}
+
+func (e *EncryptedStore) LastSeen(chat string) time.Time {
+	return e.backend.LastSeen(e.sealer.seal(chat))
+}
+
+func (e *EncryptedStore) SetLastSeen(chat string, ts time.Time) error {
+	return e.backend.SetLastSeen(e.sealer.seal(chat), ts)
+}
+
+func (e *EncryptedStore) Cursor(chat string) ChatCursor {
+	return e.backend.Cursor(e.sealer.seal(chat))
+}
+
+func (e *EncryptedStore) SetCursor(chat string, cursor ChatCursor) error {
+	return e.backend.SetCursor(e.sealer.seal(chat), cursor)
+}
+
+func (e *EncryptedStore) MessageStatus(id string) (MessageStatus, bool) {
+	status, ok := e.backend.MessageStatus(id)
+	if !ok {
+		return status, false
+	}
+	chat, err := e.sealer.open(status.Chat)
+	if err != nil {
+		return MessageStatus{}, false
+	}
+	status.Chat = chat
+	// A sender that can't be decrypted only costs the statistics
+	status.Sender, _ = e.sealer.open(status.Sender)
+	return status, true
+}
+
+func (e *EncryptedStore) SetMessageStatus(id string, status MessageStatus) error {
+	status.Chat = e.sealer.seal(status.Chat)
+	status.Sender = e.sealer.seal(status.Sender)
+	return e.backend.SetMessageStatus(id, status)
+}
+
+func (e *EncryptedStore) Chats() []string {
+	var chats []string
+	for _, sealed := range e.backend.Chats() {
+		if chat, err := e.sealer.open(sealed); err == nil {
+			chats = append(chats, chat)
+		}
+	}
+	sort.Strings(chats)
+	return chats
+}
+
+func (e *EncryptedStore) ChatMessages(chat string) map[string]MessageStatus {
+	messages := e.backend.ChatMessages(e.sealer.seal(chat))
+	for id, status := range messages {
+		status.Chat = chat
+		status.Sender, _ = e.sealer.open(status.Sender)
+		messages[id] = status
+	}
+	return messages
+}
+
+func (e *EncryptedStore) IDCertExpiry() time.Time {
+	return e.backend.IDCertExpiry()
+}
+
+func (e *EncryptedStore) SetIDCertExpiry(expiry time.Time) error {
+	return e.backend.SetIDCertExpiry(expiry)
+}
+
+func (e *EncryptedStore) Handles() ([]string, bool) {
+	sealed, ok := e.backend.Handles()
+	if !ok {
+		return nil, false
+	}
+	handles := make([]string, 0, len(sealed))
+	for _, s := range sealed {
+		if handle, err := e.sealer.open(s); err == nil {
+			handles = append(handles, handle)
+		}
+	}
+	return handles, true
+}
+
+func (e *EncryptedStore) SetHandles(handles []string) error {
+	sealed := make([]string, len(handles))
+	for i, handle := range handles {
+		sealed[i] = e.sealer.seal(handle)
+	}
+	return e.backend.SetHandles(sealed)
+}
+
+// SpillMessage stores msg as JSON in the Text of an otherwise empty message.
+func (e *EncryptedStore) SpillMessage(msg Message) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return e.backend.SpillMessage(Message{ID: msg.ID, Text: e.sealer.seal(string(data))})
+}
+
+func (e *EncryptedStore) TakeSpilledMessages() ([]Message, error) {
+	sealed, err := e.backend.TakeSpilledMessages()
+	if err != nil {
+		return nil, err
+	}
+	var spilled []Message
+	for _, envelope := range sealed {
+		if !strings.HasPrefix(envelope.Text, sealedPrefix) {
+			spilled = append(spilled, envelope)
+			continue
+		}
+		var msg Message
+		if err := e.openJSON(envelope.Text, &msg); err != nil {
+			return spilled, err
+		}
+		spilled = append(spilled, msg)
+	}
+	return spilled, nil
+}
+
+// QueueOutgoing stores msg as JSON in the Text of an otherwise empty message.
+func (e *EncryptedStore) QueueOutgoing(msg OutgoingMessage) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return e.backend.QueueOutgoing(OutgoingMessage{ID: msg.ID, Queued: msg.Queued, Text: e.sealer.seal(string(data))})
+}
+
+func (e *EncryptedStore) TakeQueuedOutgoing() ([]OutgoingMessage, error) {
+	sealed, err := e.backend.TakeQueuedOutgoing()
+	if err != nil {
+		return nil, err
+	}
+	var outgoing []OutgoingMessage
+	for _, envelope := range sealed {
+		if !strings.HasPrefix(envelope.Text, sealedPrefix) {
+			outgoing = append(outgoing, envelope)
+			continue
+		}
+		var msg OutgoingMessage
+		if err := e.openJSON(envelope.Text, &msg); err != nil {
+			return outgoing, err
+		}
+		outgoing = append(outgoing, msg)
+	}
+	return outgoing, nil
+}
+
+func (e *EncryptedStore) openJSON(sealed string, v interface{}) error {
+	data, err := e.sealer.open(sealed)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal([]byte(data), v)
+}
+
+func (e *EncryptedStore) IdentityPins(handle string) map[string]IdentityPin {
+	return e.backend.IdentityPins(e.sealer.seal(handle))
+}
+
+func (e *EncryptedStore) SetIdentityPins(handle string, pins map[string]IdentityPin) error {
+	return e.backend.SetIdentityPins(e.sealer.seal(handle), pins)
+}
+
+func (e *EncryptedStore) CourierStats() map[string]apns.CourierStat {
+	return e.backend.CourierStats()
+}
+
+func (e *EncryptedStore) SetCourierStats(stats map[string]apns.CourierStat) error {
+	return e.backend.SetCourierStats(stats)
+}
+
+func (e *EncryptedStore) DeviceKeys() (DeviceKeys, bool) {
+	keys, ok := e.backend.DeviceKeys()
+	if !ok {
+		return keys, false
+	}
+	for _, key := range []*[]byte{&keys.IDSSigning, &keys.IDSEncryption, &keys.Push, &keys.Auth} {
+		opened, err := e.sealer.open(string(*key))
+		if err != nil {
+			return DeviceKeys{}, false
+		}
+		*key = []byte(opened)
+	}
+	return keys, true
+}
+
+func (e *EncryptedStore) SetDeviceKeys(keys DeviceKeys) error {
+	for _, key := range []*[]byte{&keys.IDSSigning, &keys.IDSEncryption, &keys.Push, &keys.Auth} {
+		*key = []byte(e.sealer.seal(string(*key)))
+	}
+	return e.backend.SetDeviceKeys(keys)
+}
+
+// Flush flushes the backend, if it batches writes.
+func (e *EncryptedStore) Flush() error {
+	if flusher, ok := e.backend.(interface{ Flush() error }); ok {
+		return flusher.Flush()
+	}
+	return nil
+}
+
+// Close closes the backend.
+func (e *EncryptedStore) Close() error {
+	if closer, ok := e.backend.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package messaging
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEncryptedStoreHidesContacts(t *testing.T) {
+	keyPath := filepath.Join(t.TempDir(), "state.json.key")
+	key, err := OpenStoreKey(keyPath, "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenStoreKey(keyPath, "battery staple"); !errors.Is(err, ErrWrongPassphrase) {
+		t.Fatalf("wrong passphrase: err = %v", err)
+	}
+	again, err := OpenStoreKey(keyPath, "correct horse")
+	if err != nil || string(again) != string(key) {
+		t.Fatalf("reopened key differs: %v", err)
+	}
+
+	backend := NewMemoryStore()
+	store, err := NewEncryptedStore(backend, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const chat = "tel:+15555550123"
+	if err := store.SetCursor(chat, ChatCursor{LastMessageID: "m1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SetMessageStatus("m1", MessageStatus{Chat: chat}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.QueueOutgoing(OutgoingMessage{ID: "o1", Chat: chat, Text: "hello"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, stored := range backend.Chats() {
+		if strings.Contains(stored, "5555550123") {
+			t.Errorf("backend has chat %q in the clear", stored)
+		}
+	}
+	if status, _ := backend.MessageStatus("m1"); status.Chat == chat {
+		t.Error("backend has message chat in the clear")
+	}
+
+	if chats := store.Chats(); len(chats) != 1 || chats[0] != chat {
+		t.Errorf("chats = %v", chats)
+	}
+	if cursor := store.Cursor(chat); cursor.LastMessageID != "m1" {
+		t.Errorf("cursor = %+v", cursor)
+	}
+	if messages := store.ChatMessages(chat); len(messages) != 1 || messages["m1"].Chat != chat {
+		t.Errorf("chat messages = %v", messages)
+	}
+	outgoing, err := store.TakeQueuedOutgoing()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(outgoing) != 1 || outgoing[0].Chat != chat || outgoing[0].Text != "hello" {
+		t.Errorf("outgoing = %+v", outgoing)
+	}
+}
@@ -3,21 +3,57 @@ package messaging
 import (
 	"encoding/json"
 	"errors"
+	"maps"
 	"os"
 	"path/filepath"
+	"sort"
 	"sync"
 	"time"
+
+	"imessage-client/messaging/apns"
 )
 
-// FileStore persists last-seen timestamps to disk in a JSON map.
+// DefaultFlushInterval is how long FileStore batches writes before persisting them.
+const DefaultFlushInterval = 2 * time.Second
+
+// FileStore persists per-chat cursors and per-message statuses to disk as JSON.
+// Writes are batched: changes are kept in memory and flushed after
+// flushInterval, or immediately on Flush/Close.
 type FileStore struct {
-	path string
-	mu   sync.RWMutex
-	seen map[string]time.Time
+	path     string
+	mu       sync.RWMutex
+	cursors  map[string]ChatCursor
+	statuses map[string]MessageStatus
+	certExp  time.Time
+	handles  []string
+	spilled  []Message
+	outgoing []OutgoingMessage
+	pins     map[string]map[string]IdentityPin
+	couriers map[string]apns.CourierStat
+	keys     *DeviceKeys
+
+	flushInterval time.Duration
+	flushMu       sync.Mutex
+	flushTimer    *time.Timer
+	dirty         bool
+	flushErr      error
+	closed        bool
 }
 
 func NewFileStore(path string) (*FileStore, error) {
-	fs := &FileStore{path: path, seen: make(map[string]time.Time)}
+	return NewFileStoreWithFlushInterval(path, DefaultFlushInterval)
+}
+
+// NewFileStoreWithFlushInterval creates a FileStore that batches writes for the
+// given interval. An interval of zero writes through on every change.
+func NewFileStoreWithFlushInterval(path string, interval time.Duration) (*FileStore, error) {
+	fs := &FileStore{
+		path:          path,
+		cursors:       make(map[string]ChatCursor),
+		statuses:      make(map[string]MessageStatus),
+		pins:          make(map[string]map[string]IdentityPin),
+		flushInterval: interval,
+	}
 	if path == "" {
 		return nil, errors.New("store path is empty")
 	}
@@ -30,7 +66,7 @@ func NewFileStore(path string) (*FileStore, error) {
 func (f *FileStore) LastSeen(chat string) time.Time {
 	f.mu.RLock()
 	defer f.mu.RUnlock()
-	return f.seen[chat]
+	return f.cursors[chat].Timestamp
 }
 
 func (f *FileStore) SetLastSeen(chat string, ts time.Time) error {
@@ -38,9 +74,230 @@ func (f *FileStore) SetLastSeen(chat string, ts time.Time) error {
 		return errors.New("chat identifier is empty")
 	}
 	f.mu.Lock()
-	f.seen[chat] = ts
+	cursor := f.cursors[chat]
+	cursor.Timestamp = ts
+	f.cursors[chat] = cursor
+	f.mu.Unlock()
+	return f.markDirty()
+}
+
+func (f *FileStore) Cursor(chat string) ChatCursor {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.cursors[chat]
+}
+
+func (f *FileStore) SetCursor(chat string, cursor ChatCursor) error {
+	if chat == "" {
+		return errors.New("chat identifier is empty")
+	}
+	f.mu.Lock()
+	f.cursors[chat] = cursor
+	f.mu.Unlock()
+	return f.markDirty()
+}
+
+func (f *FileStore) MessageStatus(id string) (MessageStatus, bool) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	status, ok := f.statuses[id]
+	return status, ok
+}
+
+func (f *FileStore) SetMessageStatus(id string, status MessageStatus) error {
+	if id == "" {
+		return errors.New("message identifier is empty")
+	}
+	f.mu.Lock()
+	f.statuses[id] = status
+	f.mu.Unlock()
+	return f.markDirty()
+}
+
+func (f *FileStore) Chats() []string {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	chats := make([]string, 0, len(f.cursors))
+	for chat := range f.cursors {
+		chats = append(chats, chat)
+	}
+	sort.Strings(chats)
+	return chats
+}
+
+func (f *FileStore) ChatMessages(chat string) map[string]MessageStatus {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return chatMessages(f.statuses, chat)
+}
+
+func (f *FileStore) IDCertExpiry() time.Time {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.certExp
+}
+
+func (f *FileStore) SetIDCertExpiry(expiry time.Time) error {
+	f.mu.Lock()
+	f.certExp = expiry
+	f.mu.Unlock()
+	return f.markDirty()
+}
+
+func (f *FileStore) Handles() ([]string, bool) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return append([]string(nil), f.handles...), f.handles != nil
+}
+
+func (f *FileStore) SetHandles(handles []string) error {
+	f.mu.Lock()
+	f.handles = append([]string{}, handles...)
+	f.mu.Unlock()
+	return f.markDirty()
+}
+
+func (f *FileStore) SpillMessage(msg Message) error {
+	f.mu.Lock()
+	f.spilled = append(f.spilled, msg)
+	f.mu.Unlock()
+	return f.markDirty()
+}
+
+func (f *FileStore) TakeSpilledMessages() ([]Message, error) {
+	f.mu.Lock()
+	spilled := f.spilled
+	f.spilled = nil
+	f.mu.Unlock()
+	if len(spilled) == 0 {
+		return nil, nil
+	}
+	return spilled, f.markDirty()
+}
+
+func (f *FileStore) QueueOutgoing(msg OutgoingMessage) error {
+	f.mu.Lock()
+	f.outgoing = append(f.outgoing, msg)
+	f.mu.Unlock()
+	return f.markDirty()
+}
+
+func (f *FileStore) TakeQueuedOutgoing() ([]OutgoingMessage, error) {
+	f.mu.Lock()
+	outgoing := f.outgoing
+	f.outgoing = nil
 	f.mu.Unlock()
-	return f.save()
+	if len(outgoing) == 0 {
+		return nil, nil
+	}
+	return outgoing, f.markDirty()
+}
+
+func (f *FileStore) IdentityPins(handle string) map[string]IdentityPin {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return maps.Clone(f.pins[handle])
+}
+
+func (f *FileStore) SetIdentityPins(handle string, pins map[string]IdentityPin) error {
+	if handle == "" {
+		return errors.New("handle is empty")
+	}
+	f.mu.Lock()
+	f.pins[handle] = maps.Clone(pins)
+	f.mu.Unlock()
+	return f.markDirty()
+}
+
+func (f *FileStore) CourierStats() map[string]apns.CourierStat {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return maps.Clone(f.couriers)
+}
+
+func (f *FileStore) SetCourierStats(stats map[string]apns.CourierStat) error {
+	f.mu.Lock()
+	f.couriers = maps.Clone(stats)
+	f.mu.Unlock()
+	return f.markDirty()
+}
+
+func (f *FileStore) DeviceKeys() (DeviceKeys, bool) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if f.keys == nil {
+		return DeviceKeys{}, false
+	}
+	return *f.keys, true
+}
+
+func (f *FileStore) SetDeviceKeys(keys DeviceKeys) error {
+	f.mu.Lock()
+	f.keys = &keys
+	f.mu.Unlock()
+	return f.markDirty()
+}
+
+// Flush writes any pending changes to disk immediately. It also reports
+// errors from earlier background flushes.
+func (f *FileStore) Flush() error {
+	f.flushMu.Lock()
+	defer f.flushMu.Unlock()
+	if f.flushTimer != nil {
+		f.flushTimer.Stop()
+		f.flushTimer = nil
+	}
+	return f.flushLocked()
+}
+
+// Close flushes pending changes and stops background flushing.
+func (f *FileStore) Close() error {
+	f.flushMu.Lock()
+	defer f.flushMu.Unlock()
+	if f.flushTimer != nil {
+		f.flushTimer.Stop()
+		f.flushTimer = nil
+	}
+	f.closed = true
+	return f.flushLocked()
+}
+
+// markDirty records a pending change and schedules a flush.
+func (f *FileStore) markDirty() error {
+	f.flushMu.Lock()
+	defer f.flushMu.Unlock()
+	f.dirty = true
+	if f.flushInterval <= 0 || f.closed {
+		return f.flushLocked()
+	}
+	if f.flushTimer == nil {
+		f.flushTimer = time.AfterFunc(f.flushInterval, f.backgroundFlush)
+	}
+	return nil
+}
+
+func (f *FileStore) backgroundFlush() {
+	f.flushMu.Lock()
+	defer f.flushMu.Unlock()
+	f.flushTimer = nil
+	if err := f.flushLocked(); err != nil {
+		// Keep the error so the next Flush/Close can surface it.
+		f.flushErr = err
+	}
+}
+
+// flushLocked persists the store if dirty. Caller must hold flushMu.
+func (f *FileStore) flushLocked() error {
+	prevErr := f.flushErr
+	f.flushErr = nil
+	if !f.dirty {
+		return prevErr
+	}
+	if err := f.save(); err != nil {
+		return errors.Join(prevErr, err)
+	}
+	f.dirty = false
+	return prevErr
 }
 
 func (f *FileStore) load() error {
@@ -51,36 +308,316 @@ func (f *FileStore) load() error {
 		}
 		return err
 	}
-	var raw map[string]string
+	var header struct {
+		Version int `json:"version"`
+	}
+	if err := json.Unmarshal(data, &header); err != nil || header.Version == 0 {
+		return f.loadLegacy(data)
+	}
+	var state fileStoreState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+	for k, v := range state.Chats {
+		f.cursors[k] = v.toCursor()
+	}
+	for k, v := range state.Messages {
+		f.statuses[k] = v.toStatus()
+	}
+	if state.Version < 3 {
+		f.canonicalizeChats()
+	}
+	f.certExp = parseStoreTime(state.IDCertExpiry)
+	f.handles = state.Handles
+	f.spilled = state.Spilled
+	f.outgoing = state.Outgoing
+	f.keys = state.DeviceKeys
+	for handle, pins := range state.IdentityPins {
+		f.pins[handle] = make(map[string]IdentityPin, len(pins))
+		for token, pin := range pins {
+			f.pins[handle][token] = pin.toPin()
+		}
+	}
+	if len(state.Couriers) > 0 {
+		f.couriers = make(map[string]apns.CourierStat, len(state.Couriers))
+		for host, stat := range state.Couriers {
+			f.couriers[host] = stat.toStat()
+		}
+	}
+	return nil
+}
+
+// loadLegacy reads the original flat chat map format.
+func (f *FileStore) loadLegacy(data []byte) error {
+	var raw map[string]json.RawMessage
 	if err := json.Unmarshal(data, &raw); err != nil {
 		return err
 	}
 	for k, v := range raw {
-		if parsed, err := time.Parse(time.RFC3339Nano, v); err == nil {
-			f.seen[k] = parsed
+		var state fileChatState
+		var legacy string
+		if err := json.Unmarshal(v, &legacy); err == nil {
+			// Older state files stored only the last-seen timestamp.
+			state.LastSeen = legacy
+		} else if err := json.Unmarshal(v, &state); err != nil {
+			continue
 		}
+		f.cursors[k] = state.toCursor()
 	}
+	f.canonicalizeChats()
 	return nil
 }
 
+// canonicalizeChats migrates stores written before chats had a canonical
+// form, merging chats that were stored under several spellings. The result
+// is written out with the next flush.
+func (f *FileStore) canonicalizeChats() {
+	cursors := make(map[string]ChatCursor, len(f.cursors))
+	for chat, cursor := range f.cursors {
+		chat = canonicalChat(chat)
+		if existing, ok := cursors[chat]; ok {
+			cursor.Counter += existing.Counter
+			if existing.Timestamp.After(cursor.Timestamp) {
+				cursor.LastMessageID, cursor.Timestamp = existing.LastMessageID, existing.Timestamp
+			}
+		}
+		cursors[chat] = cursor
+	}
+	f.cursors = cursors
+	for id, status := range f.statuses {
+		if status.Chat != "" {
+			status.Chat = canonicalChat(status.Chat)
+			f.statuses[id] = status
+		}
+	}
+	f.dirty = true
+}
+
 func (f *FileStore) save() error {
 	f.mu.RLock()
 	defer f.mu.RUnlock()
 
-	tmp := make(map[string]string, len(f.seen))
-	for k, v := range f.seen {
-		tmp[k] = v.Format(time.RFC3339Nano)
+	tmp := fileStoreState{
+		Version:  fileStoreVersion,
+		Chats:    make(map[string]fileChatState, len(f.cursors)),
+		Messages: make(map[string]fileMessageStatus, len(f.statuses)),
+
+		IDCertExpiry: formatStoreTime(f.certExp),
+		Handles:      f.handles,
+		Spilled:      f.spilled,
+		Outgoing:     f.outgoing,
+		DeviceKeys:   f.keys,
+	}
+	if len(f.pins) > 0 {
+		tmp.IdentityPins = make(map[string]map[string]fileIdentityPin, len(f.pins))
+		for handle, pins := range f.pins {
+			tmp.IdentityPins[handle] = make(map[string]fileIdentityPin, len(pins))
+			for token, pin := range pins {
+				tmp.IdentityPins[handle][token] = newFileIdentityPin(pin)
+			}
+		}
+	}
+	if len(f.couriers) > 0 {
+		tmp.Couriers = make(map[string]fileCourierStat, len(f.couriers))
+		for host, stat := range f.couriers {
+			tmp.Couriers[host] = newFileCourierStat(stat)
+		}
+	}
+	for k, v := range f.cursors {
+		tmp.Chats[k] = newFileChatState(v)
+	}
+	for k, v := range f.statuses {
+		tmp.Messages[k] = newFileMessageStatus(v)
 	}
 
-	if err := os.MkdirAll(filepath.Dir(f.path), 0o755); err != nil {
+	// Write a new file and rename it over the old one, so a crash or full
+	// disk mid-write leaves the previous state rather than a truncated one
+	dir := filepath.Dir(f.path)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
 		return err
 	}
-	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	file, err := os.CreateTemp(dir, filepath.Base(f.path)+".*.tmp")
 	if err != nil {
 		return err
 	}
-	defer file.Close()
+	defer os.Remove(file.Name())
 	enc := json.NewEncoder(file)
 	enc.SetIndent("", "  ")
-	return enc.Encode(tmp)
+	if err := enc.Encode(tmp); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), f.path)
+}
+
+// fileStoreVersion 3 stores chats by their canonical ChatID.
+const fileStoreVersion = 3
+
+// fileStoreState is the on-disk layout of a FileStore.
+type fileStoreState struct {
+	Version  int                          `json:"version"`
+	Chats    map[string]fileChatState     `json:"chats"`
+	Messages map[string]fileMessageStatus `json:"messages,omitempty"`
+
+	IDCertExpiry string `json:"id_cert_expiry,omitempty"`
+	// Handles is null until a session records them, so an account with
+	// none is told apart from one never seen.
+	Handles []string  `json:"handles"`
+	Spilled []Message `json:"spilled,omitempty"`
+	// Outgoing are messages queued while offline, oldest first.
+	Outgoing []OutgoingMessage `json:"outgoing,omitempty"`
+
+	IdentityPins map[string]map[string]fileIdentityPin `json:"identity_pins,omitempty"`
+	Couriers     map[string]fileCourierStat            `json:"couriers,omitempty"`
+	DeviceKeys   *DeviceKeys                           `json:"device_keys,omitempty"`
+}
+
+// fileChatState is the on-disk form of a ChatCursor.
+type fileChatState struct {
+	LastSeen      string `json:"last_seen,omitempty"`
+	LastMessageID string `json:"last_message_id,omitempty"`
+	Counter       uint64 `json:"counter,omitempty"`
+	SnoozedUntil  string `json:"snoozed_until,omitempty"`
+	MutedUntil    string `json:"muted_until,omitempty"`
+	Service       string `json:"service,omitempty"`
+}
+
+func newFileChatState(c ChatCursor) fileChatState {
+	return fileChatState{
+		LastSeen:      formatStoreTime(c.Timestamp),
+		LastMessageID: c.LastMessageID,
+		Counter:       c.Counter,
+		SnoozedUntil:  formatStoreTime(c.SnoozedUntil),
+		MutedUntil:    formatStoreTime(c.MutedUntil),
+		Service:       c.Service,
+	}
+}
+
+func (s fileChatState) toCursor() ChatCursor {
+	return ChatCursor{
+		LastMessageID: s.LastMessageID,
+		Counter:       s.Counter,
+		Timestamp:     parseStoreTime(s.LastSeen),
+		SnoozedUntil:  parseStoreTime(s.SnoozedUntil),
+		MutedUntil:    parseStoreTime(s.MutedUntil),
+		Service:       s.Service,
+	}
+}
+
+// fileMessageStatus is the on-disk form of a MessageStatus.
+type fileMessageStatus struct {
+	Chat      string `json:"chat,omitempty"`
+	FromMe    bool   `json:"from_me,omitempty"`
+	Service   string `json:"service,omitempty"`
+	Sent      string `json:"sent,omitempty"`
+	Delivered string `json:"delivered,omitempty"`
+	Read      string `json:"read,omitempty"`
+
+	Unconfirmed string `json:"unconfirmed,omitempty"`
+
+	Sender          string `json:"sender,omitempty"`
+	Attachments     int    `json:"attachments,omitempty"`
+	AttachmentBytes int64  `json:"attachment_bytes,omitempty"`
+}
+
+func newFileMessageStatus(m MessageStatus) fileMessageStatus {
+	return fileMessageStatus{
+		Chat:      m.Chat,
+		FromMe:    m.FromMe,
+		Service:   m.Service,
+		Sent:      formatStoreTime(m.Sent),
+		Delivered: formatStoreTime(m.Delivered),
+		Read:      formatStoreTime(m.Read),
+
+		Unconfirmed: formatStoreTime(m.Unconfirmed),
+
+		Sender:          m.Sender,
+		Attachments:     m.Attachments,
+		AttachmentBytes: m.AttachmentBytes,
+	}
+}
+
+func (s fileMessageStatus) toStatus() MessageStatus {
+	return MessageStatus{
+		Chat:      s.Chat,
+		FromMe:    s.FromMe,
+		Service:   s.Service,
+		Sent:      parseStoreTime(s.Sent),
+		Delivered: parseStoreTime(s.Delivered),
+		Read:      parseStoreTime(s.Read),
+
+		Unconfirmed: parseStoreTime(s.Unconfirmed),
+
+		Sender:          s.Sender,
+		Attachments:     s.Attachments,
+		AttachmentBytes: s.AttachmentBytes,
+	}
+}
+
+// fileIdentityPin is the on-disk form of an IdentityPin.
+type fileIdentityPin struct {
+	Fingerprint string `json:"fingerprint"`
+	FirstSeen   string `json:"first_seen,omitempty"`
+}
+
+func newFileIdentityPin(p IdentityPin) fileIdentityPin {
+	return fileIdentityPin{
+		Fingerprint: p.Fingerprint,
+		FirstSeen:   formatStoreTime(p.FirstSeen),
+	}
+}
+
+func (p fileIdentityPin) toPin() IdentityPin {
+	return IdentityPin{
+		Fingerprint: p.Fingerprint,
+		FirstSeen:   parseStoreTime(p.FirstSeen),
+	}
+}
+
+// fileCourierStat is the on-disk form of an apns.CourierStat.
+type fileCourierStat struct {
+	RTTMicros int64  `json:"rtt_us"`
+	Samples   int    `json:"samples,omitempty"`
+	Failures  int    `json:"failures,omitempty"`
+	Updated   string `json:"updated,omitempty"`
+}
+
+func newFileCourierStat(s apns.CourierStat) fileCourierStat {
+	return fileCourierStat{
+		RTTMicros: s.RTT.Microseconds(),
+		Samples:   s.Samples,
+		Failures:  s.Failures,
+		Updated:   formatStoreTime(s.Updated),
+	}
+}
+
+func (s fileCourierStat) toStat() apns.CourierStat {
+	return apns.CourierStat{
+		RTT:      time.Duration(s.RTTMicros) * time.Microsecond,
+		Samples:  s.Samples,
+		Failures: s.Failures,
+		Updated:  parseStoreTime(s.Updated),
+	}
+}
+
+func formatStoreTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339Nano)
+}
+
+func parseStoreTime(s string) time.Time {
+	parsed, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return time.Time{}
+	}
+	return parsed
 }
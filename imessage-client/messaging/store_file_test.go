@@ -0,0 +1,74 @@
+package messaging
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileStoreSaveReplacesFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "state.json")
+	store, err := NewFileStoreWithFlushInterval(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SetHandles([]string{"mailto:me@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SetIDCertExpiry(time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "state.json" {
+		var names []string
+		for _, entry := range entries {
+			names = append(names, entry.Name())
+		}
+		t.Errorf("directory has %v, want only state.json", names)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0o600 {
+		t.Errorf("state file mode %o, want 600", perm)
+	}
+	reopened, err := NewFileStoreWithFlushInterval(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if handles, _ := reopened.Handles(); len(handles) != 1 {
+		t.Errorf("reopened store has handles %v", handles)
+	}
+}
+
+func TestFileStoreFlushKeepsEarlierError(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "state")
+	store, err := NewFileStoreWithFlushInterval(filepath.Join(dir, "state.json"), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A file where the store's directory should be makes saving fail
+	if err := os.WriteFile(dir, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	earlier := errors.New("earlier background flush failed")
+	store.flushErr = earlier
+	if err := store.SetHandles([]string{"mailto:me@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	err = store.Flush()
+	if !errors.Is(err, earlier) {
+		t.Errorf("err = %v, want the earlier error kept", err)
+	}
+	if err == earlier {
+		t.Errorf("err = %v, want this save's error too", err)
+	}
+}
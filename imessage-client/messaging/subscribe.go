@@ -0,0 +1,248 @@
+package messaging
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+// OverflowPolicy decides what happens to an incoming message when a
+// subscriber's buffer is full.
+type OverflowPolicy int
+
+const (
+	// OverflowDropOldest discards the oldest buffered message to make room.
+	OverflowDropOldest OverflowPolicy = iota
+	// OverflowDropNewest discards the incoming message.
+	OverflowDropNewest
+	// OverflowBlock waits for the subscriber to make room. A slow subscriber
+	// then holds up every other subscriber and the APNS read loop.
+	OverflowBlock
+	// OverflowSpill moves messages that don't fit into the store. It only
+	// applies to the session's message queue; subscriptions treat it as
+	// OverflowDropOldest.
+	OverflowSpill
+)
+
+func (p OverflowPolicy) String() string {
+	switch p {
+	case OverflowDropOldest:
+		return "drop-oldest"
+	case OverflowDropNewest:
+		return "drop-newest"
+	case OverflowBlock:
+		return "block"
+	case OverflowSpill:
+		return "spill"
+	default:
+		return "unknown"
+	}
+}
+
+// DefaultSubscriberBuffer is the buffer size of a subscription when none is given.
+const DefaultSubscriberBuffer = 64
+
+// DefaultHistorySize is how many recent messages a session keeps for
+// subscribers resuming with SubscribeOptions.After.
+const DefaultHistorySize = 1024
+
+// SubscribeOptions configures a subscription.
+type SubscribeOptions struct {
+	// Buffer is how many messages are held for the subscriber before
+	// Overflow applies. Defaults to DefaultSubscriberBuffer.
+	Buffer   int
+	Overflow OverflowPolicy
+	// After resumes a subscription: the session's recent messages with a
+	// higher Sequence are delivered first, in order, followed by new ones.
+	// Zero starts with new messages only.
+	After uint64
+}
+
+// Subscription receives every incoming message from the moment it's created.
+type Subscription struct {
+	session  *Session
+	ch       chan Message
+	overflow OverflowPolicy
+	done     chan struct{}
+	dropped  atomic.Uint64
+	once     sync.Once
+	gap      bool
+}
+
+// Subscribe registers a consumer of incoming messages. Each subscription has
+// its own buffer, so several consumers can read concurrently without taking
+// messages from each other or from FetchMessages.
+func (s *Session) Subscribe(opts SubscribeOptions) *Subscription {
+	if opts.Buffer <= 0 {
+		opts.Buffer = DefaultSubscriberBuffer
+	}
+	sub := &Subscription{
+		session:  s,
+		overflow: opts.Overflow,
+		done:     make(chan struct{}),
+	}
+	s.subsMu.Lock()
+	defer s.subsMu.Unlock()
+	var missed []Message
+	if opts.After > 0 {
+		for _, msg := range s.history {
+			if msg.Sequence > opts.After {
+				missed = append(missed, msg)
+			}
+		}
+		// Sequences grow by one, so anything between After and the oldest
+		// message kept was dropped from the history or came before it
+		oldest := s.sequence + 1
+		if len(s.history) > 0 {
+			oldest = s.history[0].Sequence
+		}
+		sub.gap = opts.After+1 < oldest
+	}
+	// Room for the replay on top of the buffer, so none of it is dropped
+	sub.ch = make(chan Message, opts.Buffer+len(missed))
+	for _, msg := range missed {
+		sub.ch <- msg
+	}
+	if s.subs == nil {
+		s.subs = make(map[*Subscription]struct{})
+	}
+	s.subs[sub] = struct{}{}
+	return sub
+}
+
+// SetHistorySize sets how many recent messages are kept for subscribers
+// resuming with SubscribeOptions.After.
+func (s *Session) SetHistorySize(n int) {
+	s.subsMu.Lock()
+	defer s.subsMu.Unlock()
+	s.historySize = n
+	s.trimHistory()
+}
+
+func (s *Session) trimHistory() {
+	if extra := len(s.history) - s.historySize; extra > 0 {
+		s.history = append(s.history[:0], s.history[extra:]...)
+	}
+}
+
+// Sequence returns the sequence of the newest message, which subscribers
+// can resume after.
+func (s *Session) Sequence() uint64 {
+	s.subsMu.RLock()
+	defer s.subsMu.RUnlock()
+	return s.sequence
+}
+
+// Subscribe connects the client's session to the courier, so messages start
+// arriving without polling, and returns a subscription to them.
+func (c *Client) Subscribe(ctx context.Context, opts SubscribeOptions) (*Subscription, error) {
+	session, err := c.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sub := session.Subscribe(opts)
+	if err := session.ensureHandshake(); err != nil {
+		sub.Close()
+		return nil, err
+	}
+	if err := session.ensureAPNS(ctx); err != nil {
+		sub.Close()
+		return nil, err
+	}
+	return sub, nil
+}
+
+// Messages returns the channel messages are delivered on. It's closed when
+// the subscription or the session is closed.
+func (sub *Subscription) Messages() <-chan Message {
+	return sub.ch
+}
+
+// Gap reports whether the subscription resumed from a sequence the session
+// no longer kept every message after, so some messages may have been missed.
+// That happens after a restart, or if the subscriber was away for more than
+// the history size's worth of messages.
+func (sub *Subscription) Gap() bool {
+	return sub.gap
+}
+
+// Dropped returns how many messages were discarded because the buffer was full.
+func (sub *Subscription) Dropped() uint64 {
+	return sub.dropped.Load()
+}
+
+// Close stops delivery and closes the Messages channel.
+func (sub *Subscription) Close() {
+	sub.once.Do(func() {
+		// Unblock a pending OverflowBlock send before waiting for the lock
+		close(sub.done)
+		sub.session.subsMu.Lock()
+		delete(sub.session.subs, sub)
+		sub.session.subsMu.Unlock()
+		close(sub.ch)
+	})
+}
+
+func (sub *Subscription) deliver(msg Message) {
+	switch sub.overflow {
+	case OverflowBlock:
+		select {
+		case sub.ch <- msg:
+		case <-sub.done:
+		}
+	case OverflowDropNewest:
+		select {
+		case sub.ch <- msg:
+		default:
+			sub.dropped.Add(1)
+		}
+	default:
+		for {
+			select {
+			case sub.ch <- msg:
+				return
+			default:
+			}
+			select {
+			case <-sub.ch:
+				sub.dropped.Add(1)
+			default:
+			}
+		}
+	}
+}
+
+// publish stamps msg with the next sequence, keeps it in the history and
+// fans it out to every subscriber. Subscribers can't be closed mid-delivery
+// because Close waits for the lock held here.
+func (s *Session) publish(msg *Message) {
+	s.subsMu.Lock()
+	defer s.subsMu.Unlock()
+	s.sequence++
+	msg.Sequence = s.sequence
+	if s.historySize > 0 {
+		s.history = append(s.history, *msg)
+		s.trimHistory()
+	}
+	for sub := range s.subs {
+		select {
+		case <-sub.done:
+			continue
+		default:
+		}
+		sub.deliver(*msg)
+	}
+}
+
+// closeSubscriptions closes every subscription of the session.
+func (s *Session) closeSubscriptions() {
+	s.subsMu.RLock()
+	subs := make([]*Subscription, 0, len(s.subs))
+	for sub := range s.subs {
+		subs = append(subs, sub)
+	}
+	s.subsMu.RUnlock()
+	for _, sub := range subs {
+		sub.Close()
+	}
+}
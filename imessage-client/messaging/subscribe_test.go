@@ -0,0 +1,130 @@
+package messaging
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"imessage-client/config"
+)
+
+func testSession(t *testing.T) *Session {
+	t.Helper()
+	reg := &config.RegistrationData{ValidationData: []byte("v"), ValidUntil: time.Now().Add(time.Hour)}
+	session, err := Connect(context.Background(), reg, NewMemoryStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { session.Close() })
+	return session
+}
+
+func TestSubscribeFanOut(t *testing.T) {
+	session := testSession(t)
+	a := session.Subscribe(SubscribeOptions{})
+	b := session.Subscribe(SubscribeOptions{})
+
+	_ = session.enqueue(&Message{ID: "1"})
+
+	for _, sub := range []*Subscription{a, b} {
+		select {
+		case msg := <-sub.Messages():
+			if msg.ID != "1" {
+				t.Errorf("got message %q", msg.ID)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("subscriber didn't receive message")
+		}
+	}
+
+	b.Close()
+	if _, ok := <-b.Messages(); ok {
+		t.Error("closed subscription still open")
+	}
+	_ = session.enqueue(&Message{ID: "2"})
+	if msg := <-a.Messages(); msg.ID != "2" {
+		t.Errorf("got message %q after another subscriber closed", msg.ID)
+	}
+}
+
+func TestSubscribeOverflow(t *testing.T) {
+	session := testSession(t)
+	oldest := session.Subscribe(SubscribeOptions{Buffer: 2, Overflow: OverflowDropOldest})
+	newest := session.Subscribe(SubscribeOptions{Buffer: 2, Overflow: OverflowDropNewest})
+
+	for _, id := range []string{"1", "2", "3"} {
+		_ = session.enqueue(&Message{ID: id})
+	}
+
+	check := func(sub *Subscription, want ...string) {
+		t.Helper()
+		for _, id := range want {
+			if msg := <-sub.Messages(); msg.ID != id {
+				t.Errorf("got %q, want %q", msg.ID, id)
+			}
+		}
+		if sub.Dropped() != 1 {
+			t.Errorf("dropped = %d, want 1", sub.Dropped())
+		}
+	}
+	check(oldest, "2", "3")
+	check(newest, "1", "2")
+}
+
+func TestSubscribeBlockUnblocksOnClose(t *testing.T) {
+	session := testSession(t)
+	sub := session.Subscribe(SubscribeOptions{Buffer: 1, Overflow: OverflowBlock})
+	_ = session.enqueue(&Message{ID: "1"})
+
+	done := make(chan struct{})
+	go func() {
+		_ = session.enqueue(&Message{ID: "2"})
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("enqueue didn't block on a full subscriber")
+	case <-time.After(20 * time.Millisecond):
+	}
+	sub.Close()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("enqueue still blocked after Close")
+	}
+}
+
+func TestSubscribeResume(t *testing.T) {
+	session := testSession(t)
+	session.SetHistorySize(3)
+	first := &Message{ID: "1"}
+	_ = session.enqueue(first)
+	for _, id := range []string{"2", "3", "4"} {
+		_ = session.enqueue(&Message{ID: id})
+	}
+	if session.Sequence() != first.Sequence+3 {
+		t.Fatalf("sequence %d, want %d", session.Sequence(), first.Sequence+3)
+	}
+
+	sub := session.Subscribe(SubscribeOptions{After: first.Sequence + 1})
+	defer sub.Close()
+	if sub.Gap() {
+		t.Error("gap reported though every message after the sequence was kept")
+	}
+	_ = session.enqueue(&Message{ID: "5"})
+	for _, want := range []string{"3", "4", "5"} {
+		if msg := <-sub.Messages(); msg.ID != want {
+			t.Fatalf("got message %q, want %q", msg.ID, want)
+		}
+	}
+
+	// Message 2 fell out of the history
+	late := session.Subscribe(SubscribeOptions{After: first.Sequence})
+	defer late.Close()
+	if !late.Gap() {
+		t.Error("no gap reported for a message that fell out of the history")
+	}
+	if msg := <-late.Messages(); msg.ID != "3" {
+		t.Errorf("got message %q, want 3", msg.ID)
+	}
+}
@@ -0,0 +1,147 @@
+package messaging
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Tapback is the associated message type of a reaction.
+type Tapback int
+
+const (
+	TapbackLove      Tapback = 2000
+	TapbackLike      Tapback = 2001
+	TapbackDislike   Tapback = 2002
+	TapbackLaugh     Tapback = 2003
+	TapbackEmphasize Tapback = 2004
+	TapbackQuestion  Tapback = 2005
+	TapbackEmoji     Tapback = 2006
+
+	// tapbackRemoval is added to a tapback's type to take it back.
+	tapbackRemoval = 1000
+)
+
+var tapbackNames = map[Tapback]string{
+	TapbackLove:      "love",
+	TapbackLike:      "like",
+	TapbackDislike:   "dislike",
+	TapbackLaugh:     "laugh",
+	TapbackEmphasize: "emphasize",
+	TapbackQuestion:  "question",
+	TapbackEmoji:     "emoji",
+}
+
+// tapbackVerbs start the fallback text shown by clients that don't render
+// tapbacks.
+var tapbackVerbs = map[Tapback]string{
+	TapbackLove:      "Loved",
+	TapbackLike:      "Liked",
+	TapbackDislike:   "Disliked",
+	TapbackLaugh:     "Laughed at",
+	TapbackEmphasize: "Emphasized",
+	TapbackQuestion:  "Questioned",
+}
+
+func (t Tapback) String() string {
+	if name, ok := tapbackNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("tapback(%d)", int(t))
+}
+
+// Reaction is a tapback on an earlier message.
+type Reaction struct {
+	// Target is the UUID of the message reacted to.
+	Target string  `json:"target"`
+	Type   Tapback `json:"type"`
+	// Emoji is set for TapbackEmoji.
+	Emoji string `json:"emoji,omitempty"`
+	// Remove takes back an earlier reaction of the same type.
+	Remove bool `json:"remove,omitempty"`
+}
+
+// ParseReaction parses a tapback name, or a single emoji for an emoji
+// tapback, into a reaction on target.
+func ParseReaction(target, tapback string) (Reaction, error) {
+	for t, name := range tapbackNames {
+		if t != TapbackEmoji && strings.EqualFold(tapback, name) {
+			return Reaction{Target: target, Type: t}, nil
+		}
+	}
+	if isEmoji(tapback) {
+		return Reaction{Target: target, Type: TapbackEmoji, Emoji: tapback}, nil
+	}
+	return Reaction{}, fmt.Errorf("unknown tapback %q (want love, like, dislike, laugh, emphasize, question or an emoji)", tapback)
+}
+
+// isEmoji loosely checks that s is one emoji: a short run of symbols,
+// modifiers and joiners with no letters, digits or spaces.
+func isEmoji(s string) bool {
+	if s == "" || utf8.RuneCountInString(s) > 16 {
+		return false
+	}
+	symbol := false
+	for _, r := range s {
+		switch {
+		case r < utf8.RuneSelf, unicode.IsLetter(r), unicode.IsDigit(r), unicode.IsSpace(r):
+			return false
+		case unicode.IsSymbol(r):
+			symbol = true
+		}
+	}
+	return symbol
+}
+
+// apply fills in the payload fields of the reaction.
+func (r Reaction) apply(p *IMessagePayload) {
+	p.AssociatedMessageType = int(r.Type)
+	if r.Remove {
+		p.AssociatedMessageType += tapbackRemoval
+	}
+	p.AssociatedMessageGUID = "p:0/" + r.Target
+	p.AssociatedMessageEmoji = r.Emoji
+	p.Text = r.summary()
+}
+
+// summary is the fallback text of the reaction.
+func (r Reaction) summary() string {
+	switch {
+	case r.Remove:
+		return "Removed a reaction from a message"
+	case r.Type == TapbackEmoji:
+		return "Reacted " + r.Emoji + " to a message"
+	default:
+		return tapbackVerbs[r.Type] + " a message"
+	}
+}
+
+// React sends a tapback on a message recorded in the store, in the chat the
+// message belongs to.
+func (s *Session) React(ctx context.Context, reaction Reaction, opts SendOptions) (*SendResult, error) {
+	target, err := normalizeMessageUUID(reaction.Target)
+	if err != nil || reaction.Target == "" {
+		return nil, fmt.Errorf("%w %q", ErrInvalidMessageUUID, reaction.Target)
+	}
+	reaction.Target = target
+	status, ok := s.store.MessageStatus(target)
+	if !ok || status.Chat == "" {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownMessage, target)
+	}
+	id, err := normalizeMessageUUID(opts.MessageUUID)
+	if err != nil {
+		return nil, err
+	}
+	return s.sendPart(ctx, OutgoingMessage{ID: id, Chat: status.Chat, Text: reaction.summary(), Reaction: &reaction})
+}
+
+// React sends a tapback on a message recorded in the client's store.
+func (c *Client) React(ctx context.Context, reaction Reaction, opts SendOptions) (*SendResult, error) {
+	session, err := c.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return session.React(ctx, reaction, opts)
+}
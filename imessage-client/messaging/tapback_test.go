@@ -0,0 +1,88 @@
+package messaging
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"imessage-client/messaging/apns"
+	"imessage-client/messaging/apns/apnstest"
+)
+
+func TestParseReaction(t *testing.T) {
+	tests := []struct {
+		in    string
+		want  Tapback
+		emoji string
+	}{
+		{"love", TapbackLove, ""},
+		{"Laugh", TapbackLaugh, ""},
+		{"question", TapbackQuestion, ""},
+		{"🎉", TapbackEmoji, "🎉"},
+		{"👍🏽", TapbackEmoji, "👍🏽"},
+	}
+	for _, tt := range tests {
+		r, err := ParseReaction("id", tt.in)
+		if err != nil {
+			t.Errorf("%q: %v", tt.in, err)
+			continue
+		}
+		if r.Type != tt.want || r.Emoji != tt.emoji {
+			t.Errorf("%q = %v %q, want %v %q", tt.in, r.Type, r.Emoji, tt.want, tt.emoji)
+		}
+	}
+	for _, bad := range []string{"", "emoji", "hug", "é"} {
+		if _, err := ParseReaction("id", bad); err == nil {
+			t.Errorf("%q accepted", bad)
+		}
+	}
+}
+
+func TestReactTargetsStoredMessage(t *testing.T) {
+	server, err := apnstest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	me := newTestDevice(t, "me")
+	theirPhone := newTestDevice(t, "their-phone")
+	session := testSendSession(t, me, map[string][]*testDevice{
+		"tel:+15555550123":      {theirPhone},
+		"mailto:me@example.com": {me},
+	})
+	session.state.APNSConn = testAPNSConnection(t, server)
+
+	const target = "0F5A0D2E-6F43-4C59-9B63-2C4C5B6A7E10"
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := session.React(ctx, Reaction{Target: target, Type: TapbackLove}, SendOptions{}); !errors.Is(err, ErrUnknownMessage) {
+		t.Fatalf("err = %v, want ErrUnknownMessage", err)
+	}
+
+	if err := MarkDelivered(session.store, target, "tel:+15555550123", false, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := session.React(ctx, Reaction{Target: target, Type: TapbackLove}, SendOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	sent, err := server.WaitFor(ctx, apns.CommandSendMessage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	madrid, err := apns.ParseMadridPayload(sent.Field(apns.FieldOutgoingPayload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := DecryptMessage(theirPhone.key, madrid.DTL[0].Payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.AssociatedMessageType != int(TapbackLove) || msg.AssociatedMessageGUID != "p:0/"+target {
+		t.Errorf("associated message = %d %q", msg.AssociatedMessageType, msg.AssociatedMessageGUID)
+	}
+	if msg.Text != "Loved a message" {
+		t.Errorf("text = %q", msg.Text)
+	}
+}
@@ -0,0 +1,103 @@
+package trace
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"howett.net/plist"
+)
+
+// DumpTransport wraps an http.RoundTripper and writes each request and
+// response to Out as readable text, with signature headers and secret plist
+// values redacted. Unlike a Recorder, it's meant to be read as it happens,
+// such as when working out why IDS answers with a 6xxx status.
+type DumpTransport struct {
+	Base http.RoundTripper
+	Out  io.Writer
+
+	mu sync.Mutex
+}
+
+func (t *DumpTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	reqBody, err := readBody(&req.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	resp, err := base.RoundTrip(req)
+	elapsed := time.Since(start).Round(time.Millisecond)
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "--> %s %s\n", req.Method, req.URL)
+	dumpMessage(&buf, req.Header, reqBody)
+	if err != nil {
+		fmt.Fprintf(&buf, "<-- %s %s failed after %s: %v\n\n", req.Method, req.URL, elapsed, err)
+		t.write(buf.Bytes())
+		return nil, err
+	}
+	respBody, readErr := readBody(&resp.Body)
+	fmt.Fprintf(&buf, "<-- %d %s %s (%s)\n", resp.StatusCode, req.Method, req.URL, elapsed)
+	dumpMessage(&buf, resp.Header, respBody)
+	t.write(buf.Bytes())
+	if readErr != nil {
+		return nil, readErr
+	}
+	return resp, nil
+}
+
+// write keeps the dumps of concurrent requests from interleaving.
+func (t *DumpTransport) write(data []byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	_, _ = t.Out.Write(data)
+}
+
+// readBody reads *body and replaces it with a copy, so it can still be sent
+// or read by the caller.
+func readBody(body *io.ReadCloser) ([]byte, error) {
+	if *body == nil || *body == http.NoBody {
+		return nil, nil
+	}
+	data, err := io.ReadAll(*body)
+	(*body).Close()
+	if err != nil {
+		return nil, err
+	}
+	*body = io.NopCloser(bytes.NewReader(data))
+	return data, nil
+}
+
+func dumpMessage(buf *bytes.Buffer, header http.Header, body []byte) {
+	headers := redactHeaders(header)
+	keys := make([]string, 0, len(headers))
+	for key := range headers {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(buf, "%s: %s\n", key, headers[key])
+	}
+	buf.WriteString("\n")
+	if len(body) == 0 {
+		return
+	}
+	if _, err := plist.Unmarshal(body, new(any)); err != nil {
+		// Anything that isn't a plist could hold secrets we can't find, so
+		// only its size is shown
+		fmt.Fprintf(buf, "<%d byte body>\n\n", len(body))
+		return
+	}
+	buf.WriteString(strings.TrimSpace(redactBody(body)))
+	buf.WriteString("\n\n")
+}
@@ -0,0 +1,144 @@
+package trace
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"howett.net/plist"
+)
+
+// redactedHeaders carry signatures, certificates and tokens.
+var redactedHeaders = map[string]bool{
+	"X-Push-Sig":    true,
+	"X-Push-Cert":   true,
+	"X-Push-Token":  true,
+	"X-Auth-Sig":    true,
+	"X-Auth-Cert":   true,
+	"X-Auth-Token":  true,
+	"X-ID-Sig":      true,
+	"X-ID-Cert":     true,
+	"Authorization": true,
+}
+
+// redactedKeys are plist keys whose values are secret or device-identifying.
+var redactedKeys = map[string]bool{
+	"validation-data": true,
+	"cert":            true,
+	"push-token":      true,
+	"sigs":            true,
+	"auth-token":      true,
+	"csr":             true,
+	"password":        true,
+}
+
+const redactedValue = "<redacted>"
+
+// Transport wraps an http.RoundTripper and records IDS requests and responses.
+type Transport struct {
+	Base     http.RoundTripper
+	Recorder *Recorder
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	if t.Recorder == nil {
+		return base.RoundTrip(req)
+	}
+
+	var reqBody []byte
+	if req.Body != nil {
+		var err error
+		reqBody, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		req.Body = io.NopCloser(bytes.NewReader(reqBody))
+	}
+	t.Recorder.Record(Entry{
+		Source:    SourceIDS,
+		Direction: Out,
+		Method:    req.Method,
+		URL:       req.URL.String(),
+		Headers:   redactHeaders(req.Header),
+		Body:      redactBody(reqBody),
+	})
+
+	resp, err := base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	respBody, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(respBody))
+	t.Recorder.Record(Entry{
+		Source:    SourceIDS,
+		Direction: In,
+		Method:    req.Method,
+		URL:       req.URL.String(),
+		Status:    resp.StatusCode,
+		Headers:   redactHeaders(resp.Header),
+		Body:      redactBody(respBody),
+	})
+	return resp, nil
+}
+
+func redactHeaders(header http.Header) map[string]string {
+	out := make(map[string]string, len(header))
+	for key, values := range header {
+		if redactedHeaders[http.CanonicalHeaderKey(key)] {
+			out[key] = redactedValue
+		} else {
+			out[key] = strings.Join(values, ", ")
+		}
+	}
+	return out
+}
+
+// redactBody returns plist bodies as XML with secrets removed. Other bodies
+// are base64 encoded.
+func redactBody(body []byte) string {
+	if len(body) == 0 {
+		return ""
+	}
+	var parsed any
+	if _, err := plist.Unmarshal(body, &parsed); err != nil {
+		return "base64:" + base64.StdEncoding.EncodeToString(body)
+	}
+	encoded, err := plist.MarshalIndent(redactValue(parsed), plist.XMLFormat, "\t")
+	if err != nil {
+		return fmt.Sprintf("<failed to encode redacted plist: %v>", err)
+	}
+	return string(encoded)
+}
+
+func redactValue(value any) any {
+	switch v := value.(type) {
+	case map[string]any:
+		for key, inner := range v {
+			if redactedKeys[key] {
+				v[key] = redactedValue
+			} else {
+				v[key] = redactValue(inner)
+			}
+		}
+		return v
+	case []any:
+		for i, inner := range v {
+			v[i] = redactValue(inner)
+		}
+		return v
+	default:
+		return v
+	}
+}
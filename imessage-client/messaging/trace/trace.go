@@ -0,0 +1,135 @@
+// Package trace records APNS frames and IDS HTTP exchanges to a JSON lines
+// file for debugging protocol issues. Secrets are redacted before anything
+// is written, so traces can be attached to bug reports.
+package trace
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Source says which protocol an entry belongs to.
+type Source string
+
+const (
+	SourceAPNS Source = "apns"
+	SourceIDS  Source = "ids"
+)
+
+// Direction says whether an entry was sent or received.
+type Direction string
+
+const (
+	Out Direction = "out"
+	In  Direction = "in"
+)
+
+// Field is a single APNS field. Redacted values are replaced by a
+// placeholder and have Redacted set.
+type Field struct {
+	ID       uint8  `json:"id"`
+	Value    []byte `json:"value,omitempty"`
+	Redacted bool   `json:"redacted,omitempty"`
+}
+
+// Entry is one line of a trace file.
+type Entry struct {
+	Time      time.Time `json:"time"`
+	Source    Source    `json:"source"`
+	Direction Direction `json:"direction"`
+
+	// APNS frames
+	Command uint8   `json:"command,omitempty"`
+	Fields  []Field `json:"fields,omitempty"`
+	// Topics names the topic hashes in the frame, so they can be told
+	// apart without hashing every topic by hand.
+	Topics []string `json:"topics,omitempty"`
+
+	// IDS requests and responses
+	Method  string            `json:"method,omitempty"`
+	URL     string            `json:"url,omitempty"`
+	Status  int               `json:"status,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    string            `json:"body,omitempty"`
+}
+
+// Recorder writes trace entries. A nil *Recorder discards everything, so
+// callers don't need to check whether tracing is enabled.
+type Recorder struct {
+	mu     sync.Mutex
+	enc    *json.Encoder
+	closer io.Closer
+	err    error
+}
+
+// NewRecorder writes entries to w.
+func NewRecorder(w io.Writer) *Recorder {
+	r := &Recorder{enc: json.NewEncoder(w)}
+	if closer, ok := w.(io.Closer); ok {
+		r.closer = closer
+	}
+	return r
+}
+
+// OpenFile creates or appends to a trace file at path.
+func OpenFile(path string) (*Recorder, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open trace file: %w", err)
+	}
+	return NewRecorder(file), nil
+}
+
+// Record writes an entry, stamping the time if it's unset. Write errors are
+// kept and reported by Close rather than interrupting the traced operation.
+func (r *Recorder) Record(entry Entry) {
+	if r == nil {
+		return
+	}
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil {
+		return
+	}
+	r.err = r.enc.Encode(&entry)
+}
+
+// Close closes the underlying writer and returns the first write error.
+func (r *Recorder) Close() error {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	err := r.err
+	if r.closer != nil {
+		if closeErr := r.closer.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// ReadEntries decodes a trace file, calling fn for every entry in order.
+func ReadEntries(r io.Reader, fn func(Entry) error) error {
+	dec := json.NewDecoder(r)
+	for {
+		var entry Entry
+		if err := dec.Decode(&entry); errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("failed to decode trace entry: %w", err)
+		}
+		if err := fn(entry); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,146 @@
+// Package transport provides the HTTP transport shared by every client that
+// talks to Apple's HTTPS endpoints (IDS registration and lookup, MMCS), so
+// that connections and TLS sessions are reused across them.
+package transport
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"imessage-client/messaging/trace"
+)
+
+// Options tunes the shared transport.
+type Options struct {
+	// MaxIdleConns limits idle connections across all hosts. Zero means no limit.
+	MaxIdleConns int
+	// MaxIdleConnsPerHost limits idle connections kept per host.
+	MaxIdleConnsPerHost int
+	// IdleConnTimeout is how long an idle connection is kept before closing.
+	IdleConnTimeout time.Duration
+	// DialTimeout bounds establishing the TCP connection.
+	DialTimeout time.Duration
+	// KeepAlive is the TCP keep-alive period. Negative disables keep-alives.
+	KeepAlive time.Duration
+	// TLSHandshakeTimeout bounds the TLS handshake.
+	TLSHandshakeTimeout time.Duration
+	// DisableHTTP2 forces HTTP/1.1.
+	DisableHTTP2 bool
+	// TLSConfig overrides the default TLS configuration.
+	TLSConfig *tls.Config
+}
+
+// DefaultOptions are used until Configure is called.
+var DefaultOptions = Options{
+	MaxIdleConns:        100,
+	MaxIdleConnsPerHost: 10,
+	IdleConnTimeout:     90 * time.Second,
+	DialTimeout:         10 * time.Second,
+	KeepAlive:           30 * time.Second,
+	TLSHandshakeTimeout: 10 * time.Second,
+}
+
+// DefaultTLSConfig returns the TLS configuration used for Apple's endpoints.
+func DefaultTLSConfig() *tls.Config {
+	// Load system CA certificates
+	certPool, err := x509.SystemCertPool()
+	if err != nil {
+		// If system pool fails, create empty pool (will use built-in certs)
+		certPool = x509.NewCertPool()
+	}
+
+	// Note: Some systems may have issues verifying Apple's certificates
+	// If you encounter "certificate signed by unknown authority" errors:
+	// 1. Update ca-certificates: sudo pacman -S ca-certificates (or apt/yum equivalent)
+	// 2. Or temporarily disable verification (INSECURE - only for testing):
+	//    InsecureSkipVerify: true
+	return &tls.Config{
+		RootCAs:    certPool,
+		MinVersion: tls.VersionTLS12,
+		// TEMPORARY: Skip verification if system CA bundle doesn't include Apple's root CA
+		// This is a workaround for systems where Apple's certificates aren't trusted
+		// TODO: Remove this once CA certificates are properly configured
+		InsecureSkipVerify: true,
+	}
+}
+
+// New builds a transport from opts.
+func New(opts Options) *http.Transport {
+	tlsConfig := opts.TLSConfig
+	if tlsConfig == nil {
+		tlsConfig = DefaultTLSConfig()
+	}
+	dialer := &net.Dialer{
+		Timeout:   opts.DialTimeout,
+		KeepAlive: opts.KeepAlive,
+	}
+	t := &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		DialContext:         dialer.DialContext,
+		TLSClientConfig:     tlsConfig,
+		MaxIdleConns:        opts.MaxIdleConns,
+		MaxIdleConnsPerHost: opts.MaxIdleConnsPerHost,
+		IdleConnTimeout:     opts.IdleConnTimeout,
+		TLSHandshakeTimeout: opts.TLSHandshakeTimeout,
+		// A custom TLS config or dialer turns off HTTP/2 unless asked for
+		ForceAttemptHTTP2: !opts.DisableHTTP2,
+	}
+	if opts.DisableHTTP2 {
+		// A non-nil empty map stops net/http from upgrading to HTTP/2
+		t.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	}
+	return t
+}
+
+var (
+	sharedLock  sync.Mutex
+	shared      *http.Transport
+	debugOutput io.Writer
+)
+
+// Shared returns the process-wide transport, creating it with DefaultOptions
+// on first use.
+func Shared() *http.Transport {
+	sharedLock.Lock()
+	defer sharedLock.Unlock()
+	if shared == nil {
+		shared = New(DefaultOptions)
+	}
+	return shared
+}
+
+// Configure replaces the shared transport. Clients created before the call
+// keep using the old one; its idle connections are closed.
+func Configure(opts Options) {
+	sharedLock.Lock()
+	defer sharedLock.Unlock()
+	if shared != nil {
+		shared.CloseIdleConnections()
+	}
+	shared = New(opts)
+}
+
+// SetDebugOutput dumps requests and responses of clients created by
+// NewClient afterwards to w, with secrets redacted. Nil turns it off.
+func SetDebugOutput(w io.Writer) {
+	sharedLock.Lock()
+	defer sharedLock.Unlock()
+	debugOutput = w
+}
+
+// NewClient returns an http.Client that uses the shared transport.
+func NewClient() *http.Client {
+	base := Shared()
+	sharedLock.Lock()
+	out := debugOutput
+	sharedLock.Unlock()
+	if out == nil {
+		return &http.Client{Transport: base}
+	}
+	return &http.Client{Transport: &trace.DumpTransport{Base: base, Out: out}}
+}
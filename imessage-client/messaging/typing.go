@@ -0,0 +1,142 @@
+package messaging
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"imessage-client/messaging/ids"
+)
+
+// DefaultTypingDuration is how long StartTyping shows the indicator when no
+// duration is given.
+const DefaultTypingDuration = 5 * time.Second
+
+// StartTyping shows a typing indicator in chat for up to duration, after
+// which it's taken down again. Sending a message to the chat ends it early,
+// as the message itself clears the indicator on the recipient's devices.
+func (s *Session) StartTyping(ctx context.Context, chat string, duration time.Duration) error {
+	if duration <= 0 {
+		duration = DefaultTypingDuration
+	}
+	chat = canonicalChat(chat)
+	if err := s.sendTyping(ctx, chat, true); err != nil {
+		return err
+	}
+	s.typingMu.Lock()
+	defer s.typingMu.Unlock()
+	if s.typing == nil {
+		s.typing = make(map[string]*time.Timer)
+	}
+	if timer, ok := s.typing[chat]; ok {
+		timer.Stop()
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(duration, func() {
+		s.typingMu.Lock()
+		current := s.typing[chat] == timer
+		if current {
+			delete(s.typing, chat)
+		}
+		s.typingMu.Unlock()
+		if !current {
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := s.sendTyping(ctx, chat, false); err != nil {
+			slog.Warn("Failed to stop typing", "chat", chat, "err", err)
+		}
+	})
+	s.typing[chat] = timer
+	return nil
+}
+
+// StopTyping takes down the typing indicator in chat.
+func (s *Session) StopTyping(ctx context.Context, chat string) error {
+	chat = canonicalChat(chat)
+	s.clearTyping(chat)
+	return s.sendTyping(ctx, chat, false)
+}
+
+// clearTyping forgets the typing indicator in chat without taking it down.
+func (s *Session) clearTyping(chat string) {
+	s.typingMu.Lock()
+	defer s.typingMu.Unlock()
+	if timer, ok := s.typing[chat]; ok {
+		timer.Stop()
+		delete(s.typing, chat)
+	}
+}
+
+// sendTyping sends a typing indicator, or the empty message that ends one.
+// Neither is stored for offline devices or answered with receipts.
+func (s *Session) sendTyping(ctx context.Context, chat string, typing bool) error {
+	if err := s.ensureHandshake(); err != nil {
+		return err
+	}
+	cfg := s.state.IDSConfig
+	if cfg == nil || cfg.IDSEncryptionKey == nil || cfg.IDSSigningKey == nil || cfg.DefaultHandle.IsEmpty() {
+		return ErrHandshakeNotImplemented
+	}
+	recipient, err := ids.ParseURI(chat)
+	if err != nil {
+		return err
+	}
+
+	// The indicator itself has no content; it ends with an empty message
+	var body []byte
+	if !typing {
+		body, err = encodeOutgoing(&IMessagePayload{
+			Participants: []string{recipient.String(), cfg.DefaultHandle.String()},
+			Version:      1,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to encode message: %w", err)
+		}
+	}
+	dtl, err := s.buildDTL(ctx, cfg, []ids.ParsedURI{recipient}, body, true)
+	if err != nil {
+		return err
+	}
+	for i := range dtl {
+		dtl[i].DeliveryStatus = nil
+	}
+	id, err := normalizeMessageUUID("")
+	if err != nil {
+		return err
+	}
+	commands, err := s.splitDTL(cfg, id, dtl)
+	if err != nil {
+		return err
+	}
+	noResponseNeeded := true
+	for _, cmd := range commands {
+		cmd.SetNoStorage()
+		cmd.NoResponseNeeded = &noResponseNeeded
+		if err := <-s.outbox.Enqueue(ctx, PriorityStatus, cmd); err != nil {
+			return fmt.Errorf("failed to send typing indicator: %w", err)
+		}
+	}
+	return nil
+}
+
+// StartTyping shows a typing indicator in chat for up to duration. The
+// indicator only outlives the call if the client stays open.
+func (c *Client) StartTyping(ctx context.Context, chat string, duration time.Duration) error {
+	session, err := c.connect(ctx)
+	if err != nil {
+		return err
+	}
+	return session.StartTyping(ctx, chat, duration)
+}
+
+// StopTyping takes down the typing indicator in chat.
+func (c *Client) StopTyping(ctx context.Context, chat string) error {
+	session, err := c.connect(ctx)
+	if err != nil {
+		return err
+	}
+	return session.StopTyping(ctx, chat)
+}
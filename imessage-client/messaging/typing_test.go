@@ -0,0 +1,79 @@
+package messaging
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"imessage-client/messaging/apns"
+	"imessage-client/messaging/apns/apnstest"
+)
+
+func TestTypingIndicator(t *testing.T) {
+	server, err := apnstest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	me := newTestDevice(t, "me")
+	theirPhone := newTestDevice(t, "their-phone")
+	const chat = "tel:+15555550123"
+	session := testSendSession(t, me, map[string][]*testDevice{
+		chat:                    {theirPhone},
+		"mailto:me@example.com": {me},
+	})
+	session.state.APNSConn = testAPNSConnection(t, server)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	nextMadrid := func() *apns.MadridPayload {
+		t.Helper()
+		sent, err := server.WaitFor(ctx, apns.CommandSendMessage)
+		if err != nil {
+			t.Fatal(err)
+		}
+		madrid, err := apns.ParseMadridPayload(sent.Field(apns.FieldOutgoingPayload))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return madrid
+	}
+
+	// The indicator is an ephemeral command without content
+	if err := session.StartTyping(ctx, chat, 50*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	start := nextMadrid()
+	if !start.IsNoStorage() || len(start.DTL) != 1 || start.DTL[0].Payload != nil {
+		t.Fatalf("typing command = %+v", start)
+	}
+
+	// It's taken down with an empty message once the duration passes
+	stop := nextMadrid()
+	if !stop.IsNoStorage() || len(stop.DTL) != 1 {
+		t.Fatalf("stop command = %+v", stop)
+	}
+	msg, err := DecryptMessage(theirPhone.key, stop.DTL[0].Payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Text != "" {
+		t.Errorf("stop message has text %q", msg.Text)
+	}
+
+	// Sending to the chat ends the indicator without a separate stop
+	if err := session.StartTyping(ctx, chat, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	nextMadrid()
+	if _, err := session.Send(ctx, chat, "reply", SendOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	nextMadrid()
+	session.typingMu.Lock()
+	pending := len(session.typing)
+	session.typingMu.Unlock()
+	if pending != 0 {
+		t.Errorf("%d typing indicators still pending after the send", pending)
+	}
+}
@@ -0,0 +1,64 @@
+package messaging
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"imessage-client/config"
+)
+
+// DefaultValidationMargin is how much longer validation data must stay
+// valid for a registration attempt to be made with it. It covers the IDS
+// round trip and clock skew with Apple.
+const DefaultValidationMargin = time.Minute
+
+// RegistrationRefresher returns a copy of reg with fresh validation data,
+// such as from a nacserv relay.
+type RegistrationRefresher func(ctx context.Context, reg *config.RegistrationData) (*config.RegistrationData, error)
+
+// SetRegistrationRefresher sets where the session gets fresh validation
+// data when its own is about to expire.
+func (s *Session) SetRegistrationRefresher(refresh RegistrationRefresher) {
+	s.refreshRegistration = refresh
+}
+
+// SetValidationMargin sets how long validation data must still be valid for
+// the session to register with it.
+func (s *Session) SetValidationMargin(margin time.Duration) {
+	s.validationMargin = margin
+}
+
+// ensureFreshRegistration makes sure the validation data will still be valid
+// when IDS sees it. Otherwise it fetches fresh data first, since a register
+// with stale data is rejected and only counts against the account.
+func (s *Session) ensureFreshRegistration(ctx context.Context) error {
+	remaining := time.Until(s.registration.ValidUntil)
+	if remaining >= s.validationMargin {
+		return nil
+	}
+	if s.refreshRegistration == nil {
+		return fmt.Errorf("%w: validation data is valid for %s, less than the %s margin", ErrRegistrationExpired, remaining.Round(time.Second), s.validationMargin)
+	}
+	reg, err := s.refreshRegistration(ctx, s.registration)
+	if err != nil {
+		return fmt.Errorf("failed to refresh validation data: %w", err)
+	}
+	if remaining := time.Until(reg.ValidUntil); remaining < s.validationMargin {
+		return fmt.Errorf("%w: fresh validation data is only valid for %s", ErrRegistrationExpired, remaining.Round(time.Second))
+	}
+	s.registration = reg
+	return nil
+}
+
+// SetRegistrationRefresher sets where the client's sessions get fresh
+// validation data when their own is about to expire.
+func (c *Client) SetRegistrationRefresher(refresh RegistrationRefresher) {
+	c.refreshRegistration = refresh
+}
+
+// SetValidationMargin sets how long validation data must still be valid for
+// the client's sessions to register with it.
+func (c *Client) SetValidationMargin(margin time.Duration) {
+	c.validationMargin = margin
+}
@@ -0,0 +1,41 @@
+package messaging
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"imessage-client/config"
+)
+
+func TestHandshakeRefreshesStaleValidationData(t *testing.T) {
+	stale := &config.RegistrationData{ValidationData: []byte("old"), ValidUntil: time.Now().Add(30 * time.Second)}
+	session, err := Connect(context.Background(), stale, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session.handshaker = DefaultHandshaker{}
+
+	if err := session.ensureHandshake(); !errors.Is(err, ErrRegistrationExpired) {
+		t.Fatalf("no refresher: err = %v", err)
+	}
+	if session.state != nil {
+		t.Fatal("registered with validation data inside the margin")
+	}
+
+	refreshes := 0
+	session.SetRegistrationRefresher(func(ctx context.Context, reg *config.RegistrationData) (*config.RegistrationData, error) {
+		refreshes++
+		fresh := *reg
+		fresh.ValidationData = []byte("new")
+		fresh.ValidUntil = time.Now().Add(10 * time.Minute)
+		return &fresh, nil
+	})
+	if err := session.ensureHandshake(); err != nil {
+		t.Fatal(err)
+	}
+	if refreshes != 1 || string(session.state.ValidationData) != "new" {
+		t.Errorf("refreshed %d times, registered with %q", refreshes, session.state.ValidationData)
+	}
+}
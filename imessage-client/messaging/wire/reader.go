@@ -0,0 +1,113 @@
+// Package wire provides a bounds-checked reader for the binary formats in
+// APNS frames and encrypted message bodies. These are parsed straight off
+// the network, so every read is checked instead of relying on index math.
+package wire
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrTruncatedBody = errors.New("truncated body")
+	ErrInvalidField  = errors.New("invalid field")
+)
+
+// TruncatedError reports a read past the end of the input.
+type TruncatedError struct {
+	What string
+	Need int
+	Have int
+}
+
+func (e TruncatedError) Error() string {
+	return fmt.Sprintf("%s: %s needs %d bytes, %d left", ErrTruncatedBody, e.What, e.Need, e.Have)
+}
+
+func (e TruncatedError) Is(other error) bool {
+	return other == ErrTruncatedBody
+}
+
+// InvalidFieldError reports a field whose value can't be valid.
+type InvalidFieldError struct {
+	Field  string
+	Reason string
+}
+
+func (e InvalidFieldError) Error() string {
+	return fmt.Sprintf("%s %s: %s", ErrInvalidField, e.Field, e.Reason)
+}
+
+func (e InvalidFieldError) Is(other error) bool {
+	return other == ErrInvalidField
+}
+
+// Reader reads big-endian values from a byte slice. Slices it returns alias
+// the input.
+type Reader struct {
+	data []byte
+	off  int
+}
+
+// NewReader creates a Reader over data.
+func NewReader(data []byte) *Reader {
+	return &Reader{data: data}
+}
+
+// Len returns the number of unread bytes.
+func (r *Reader) Len() int {
+	return len(r.data) - r.off
+}
+
+// Offset returns the number of bytes read so far.
+func (r *Reader) Offset() int {
+	return r.off
+}
+
+// Bytes reads the next n bytes. what names the value in errors.
+func (r *Reader) Bytes(n int, what string) ([]byte, error) {
+	if n < 0 {
+		return nil, InvalidFieldError{Field: what, Reason: fmt.Sprintf("negative length %d", n)}
+	}
+	if n > r.Len() {
+		return nil, TruncatedError{What: what, Need: n, Have: r.Len()}
+	}
+	out := r.data[r.off : r.off+n : r.off+n]
+	r.off += n
+	return out, nil
+}
+
+// Byte reads a single byte.
+func (r *Reader) Byte(what string) (byte, error) {
+	b, err := r.Bytes(1, what)
+	if err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+// Uint16 reads a big-endian uint16.
+func (r *Reader) Uint16(what string) (uint16, error) {
+	b, err := r.Bytes(2, what)
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint16(b), nil
+}
+
+// Uint32 reads a big-endian uint32.
+func (r *Reader) Uint32(what string) (uint32, error) {
+	b, err := r.Bytes(4, what)
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(b), nil
+}
+
+// Rest returns all unread bytes.
+func (r *Reader) Rest() []byte {
+	out := r.data[r.off:]
+	r.off = len(r.data)
+	return out
+}
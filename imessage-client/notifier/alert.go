@@ -0,0 +1,99 @@
+package notifier
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"time"
+
+	"imessage-client/messaging"
+)
+
+// Alerter delivers critical failure alerts somewhere an operator will see them.
+type Alerter interface {
+	Alert(ctx context.Context, evt messaging.AlertEvent) error
+}
+
+type alertBody struct {
+	Kind    messaging.AlertKind `json:"kind"`
+	Message string              `json:"message"`
+	Time    time.Time           `json:"time"`
+}
+
+func newAlertBody(evt messaging.AlertEvent) alertBody {
+	body := alertBody{Kind: evt.Kind, Time: evt.Time}
+	if evt.Err != nil {
+		body.Message = evt.Err.Error()
+	}
+	return body
+}
+
+// WebhookAlerter POSTs alerts as JSON to a URL. Failed posts are retried
+// as Retry allows, and alerts that still can't be delivered go to
+// DeadLetters if it's set.
+type WebhookAlerter struct {
+	URL         string
+	Client      *http.Client
+	Retry       RetryPolicy
+	DeadLetters *DeadLetterQueue
+}
+
+func (w WebhookAlerter) Alert(ctx context.Context, evt messaging.AlertEvent) error {
+	data, err := json.Marshal(newAlertBody(evt))
+	if err != nil {
+		return err
+	}
+	err = postJSON(ctx, w.Client, w.URL, data, w.Retry)
+	if err != nil && w.DeadLetters != nil {
+		letter := DeadLetter{URL: w.URL, Body: data, Time: time.Now(), Error: err.Error()}
+		if qerr := w.DeadLetters.Add(letter); qerr != nil {
+			return errors.Join(err, qerr)
+		}
+		return fmt.Errorf("%w (kept in %s for replay)", err, w.DeadLetters.Path)
+	}
+	return err
+}
+
+// CommandAlerter runs a shell command for each alert. The alert is passed in
+// the IMESSAGE_ALERT_KIND, IMESSAGE_ALERT_MESSAGE and IMESSAGE_ALERT_TIME
+// environment variables and as JSON on stdin.
+type CommandAlerter struct {
+	Command string
+}
+
+func (c CommandAlerter) Alert(ctx context.Context, evt messaging.AlertEvent) error {
+	body := newAlertBody(evt)
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	cmd := exec.CommandContext(ctx, "sh", "-c", c.Command)
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Env = append(os.Environ(),
+		"IMESSAGE_ALERT_KIND="+string(body.Kind),
+		"IMESSAGE_ALERT_MESSAGE="+body.Message,
+		"IMESSAGE_ALERT_TIME="+body.Time.Format(time.RFC3339),
+	)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("alert command failed: %w (output: %s)", err, bytes.TrimSpace(output))
+	}
+	return nil
+}
+
+// MultiAlerter sends each alert to every alerter, returning all failures.
+type MultiAlerter []Alerter
+
+func (m MultiAlerter) Alert(ctx context.Context, evt messaging.AlertEvent) error {
+	var errs []error
+	for _, alerter := range m {
+		if err := alerter.Alert(ctx, evt); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
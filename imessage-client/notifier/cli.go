@@ -5,6 +5,7 @@ import (
 	"io"
 	"time"
 
+	"imessage-client/config"
 	"imessage-client/messaging"
 )
 
@@ -16,6 +17,39 @@ func PrintSummaries(w io.Writer, summaries []messaging.MessageSummary) {
 
 	fmt.Fprintf(w, "You have %d new message(s):\n", len(summaries))
 	for _, msg := range summaries {
+		if msg.Service == messaging.ServiceSMS {
+			// Relayed through the iPhone, so replies go out as SMS too
+			fmt.Fprintf(w, "- %s [%s] (SMS): %s\n", msg.Sender, msg.Timestamp.Format(time.RFC3339), msg.Preview)
+			continue
+		}
 		fmt.Fprintf(w, "- %s [%s]: %s\n", msg.Sender, msg.Timestamp.Format(time.RFC3339), msg.Preview)
 	}
 }
+
+// FilterQuiet drops the messages quiet hours mute at now, returning the rest
+// and how many were muted. The messages themselves are already recorded in
+// the store; only the notification is skipped.
+func FilterQuiet(summaries []messaging.MessageSummary, quiet *config.QuietHours, now time.Time) ([]messaging.MessageSummary, int) {
+	if !quiet.Active(now) {
+		return summaries, 0
+	}
+	var loud []messaging.MessageSummary
+	for _, msg := range summaries {
+		if !quiet.Mutes(msg.Chat, msg.Sender, now) {
+			loud = append(loud, msg)
+		}
+	}
+	return loud, len(summaries) - len(loud)
+}
+
+// FilterMuted drops the messages in chats muted with messaging.Mute,
+// returning the rest and how many were dropped.
+func FilterMuted(summaries []messaging.MessageSummary) ([]messaging.MessageSummary, int) {
+	var loud []messaging.MessageSummary
+	for _, msg := range summaries {
+		if !msg.Muted {
+			loud = append(loud, msg)
+		}
+	}
+	return loud, len(summaries) - len(loud)
+}
@@ -0,0 +1,228 @@
+package notifier
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// RetryPolicy is how often a webhook is retried before giving up. The wait
+// doubles after each attempt, starting at Backoff and capped at MaxBackoff.
+type RetryPolicy struct {
+	Attempts   int
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+// DefaultRetryPolicy rides out a webhook receiver restarting, about half a
+// minute in all.
+var DefaultRetryPolicy = RetryPolicy{Attempts: 5, Backoff: time.Second, MaxBackoff: time.Minute}
+
+// Budget returns how long a webhook can take under the policy when each
+// attempt gives up after attempt, so callers bounding a whole delivery don't
+// cut its retries short.
+func (p RetryPolicy) Budget(attempt time.Duration) time.Duration {
+	total := time.Duration(max(p.Attempts, 1)) * attempt
+	backoff := p.Backoff
+	for i := 1; i < p.Attempts; i++ {
+		total += backoff
+		backoff *= 2
+		if p.MaxBackoff > 0 && backoff > p.MaxBackoff {
+			backoff = p.MaxBackoff
+		}
+	}
+	return total
+}
+
+// statusError is a webhook response that wasn't a success.
+type statusError struct {
+	code int
+}
+
+func (e statusError) Error() string {
+	return fmt.Sprintf("webhook returned status %d", e.code)
+}
+
+// retryable reports whether a failed webhook is worth trying again: the
+// receiver was unreachable, overloaded or broken, rather than refusing the
+// request itself.
+func retryable(err error) bool {
+	var status statusError
+	if errors.As(err, &status) {
+		return status.code >= 500 || status.code == http.StatusTooManyRequests
+	}
+	return true
+}
+
+// postJSON POSTs data to url, retrying as policy allows until ctx is done.
+func postJSON(ctx context.Context, client *http.Client, url string, data []byte, policy RetryPolicy) error {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	backoff := policy.Backoff
+	for attempt := 1; ; attempt++ {
+		err := postOnce(ctx, client, url, data)
+		if err == nil || attempt >= policy.Attempts || !retryable(err) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%w (gave up retrying: %v)", err, ctx.Err())
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if policy.MaxBackoff > 0 && backoff > policy.MaxBackoff {
+			backoff = policy.MaxBackoff
+		}
+	}
+}
+
+func postOnce(ctx context.Context, client *http.Client, url string, data []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("failed to create webhook request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send webhook: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return statusError{code: resp.StatusCode}
+	}
+	return nil
+}
+
+// DeadLetter is a webhook that failed for good, kept so it can be replayed.
+type DeadLetter struct {
+	URL   string          `json:"url"`
+	Body  json.RawMessage `json:"body"`
+	Time  time.Time       `json:"time"`
+	Error string          `json:"error"`
+}
+
+// DeadLetterQueue keeps failed webhooks in a file, one JSON line each, until
+// Replay delivers them.
+type DeadLetterQueue struct {
+	Path string
+
+	mu sync.Mutex
+}
+
+// Add appends a failed webhook to the queue.
+func (q *DeadLetterQueue) Add(letter DeadLetter) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.append([]DeadLetter{letter})
+}
+
+func (q *DeadLetterQueue) append(letters []DeadLetter) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, letter := range letters {
+		if err := enc.Encode(letter); err != nil {
+			return err
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(q.Path), 0o700); err != nil {
+		return fmt.Errorf("failed to create dead-letter queue directory: %w", err)
+	}
+	file, err := os.OpenFile(q.Path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to open dead-letter queue: %w", err)
+	}
+	defer file.Close()
+	if _, err := file.Write(buf.Bytes()); err != nil {
+		return fmt.Errorf("failed to write dead-letter queue: %w", err)
+	}
+	return nil
+}
+
+// Load returns the queued webhooks.
+func (q *DeadLetterQueue) Load() ([]DeadLetter, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return loadDeadLetters(q.Path)
+}
+
+func loadDeadLetters(path string) ([]DeadLetter, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to open dead-letter queue: %w", err)
+	}
+	defer file.Close()
+	var letters []DeadLetter
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 16<<20)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var letter DeadLetter
+		if err := json.Unmarshal(scanner.Bytes(), &letter); err != nil {
+			return nil, fmt.Errorf("dead-letter queue line %d: %w", line, err)
+		}
+		letters = append(letters, letter)
+	}
+	return letters, scanner.Err()
+}
+
+// Replay sends each queued webhook again, once, and queues the ones that
+// fail again. It returns how many were delivered. The queue is moved aside
+// while replaying, so a daemon adding to it meanwhile doesn't lose anything;
+// a replay that was interrupted is picked up by the next one.
+func (q *DeadLetterQueue) Replay(ctx context.Context, client *http.Client) (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	replaying := q.Path + ".replaying"
+	if _, err := os.Stat(replaying); errors.Is(err, os.ErrNotExist) {
+		if err := os.Rename(q.Path, replaying); errors.Is(err, os.ErrNotExist) {
+			return 0, nil
+		} else if err != nil {
+			return 0, fmt.Errorf("failed to move dead-letter queue aside: %w", err)
+		}
+	}
+	letters, err := loadDeadLetters(replaying)
+	if err != nil {
+		return 0, err
+	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+	var failed []DeadLetter
+	var errs []error
+	for _, letter := range letters {
+		if ctx.Err() != nil {
+			failed = append(failed, letter)
+			continue
+		}
+		if err := postOnce(ctx, client, letter.URL, letter.Body); err != nil {
+			letter.Error = err.Error()
+			failed = append(failed, letter)
+			errs = append(errs, err)
+		}
+	}
+	if len(failed) > 0 {
+		if err := q.append(failed); err != nil {
+			return 0, err
+		}
+	}
+	if err := os.Remove(replaying); err != nil {
+		return 0, fmt.Errorf("failed to remove replayed dead letters: %w", err)
+	}
+	if ctx.Err() != nil {
+		errs = append(errs, ctx.Err())
+	}
+	return len(letters) - len(failed), errors.Join(errs...)
+}
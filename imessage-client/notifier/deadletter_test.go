@@ -0,0 +1,88 @@
+package notifier
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"imessage-client/messaging"
+)
+
+func TestWebhookRetriesAndDeadLetters(t *testing.T) {
+	var calls, failures atomic.Int32
+	var status atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if failures.Add(-1) >= 0 {
+			w.WriteHeader(int(status.Load()))
+		}
+	}))
+	defer srv.Close()
+
+	queue := &DeadLetterQueue{Path: filepath.Join(t.TempDir(), "dead-letters.jsonl")}
+	alerter := WebhookAlerter{
+		URL:         srv.URL,
+		Retry:       RetryPolicy{Attempts: 3, Backoff: time.Millisecond},
+		DeadLetters: queue,
+	}
+	evt := messaging.AlertEvent{Kind: messaging.AlertCertExpired, Err: errors.New("expired"), Time: time.Now()}
+
+	// Two outages in a row are ridden out
+	status.Store(http.StatusServiceUnavailable)
+	failures.Store(2)
+	if err := alerter.Alert(context.Background(), evt); err != nil {
+		t.Fatalf("alert after retries: %v", err)
+	}
+	if calls.Load() != 3 {
+		t.Errorf("%d calls, want 3", calls.Load())
+	}
+
+	// A refused request isn't retried, and is queued
+	calls.Store(0)
+	status.Store(http.StatusBadRequest)
+	failures.Store(1)
+	if err := alerter.Alert(context.Background(), evt); err == nil {
+		t.Fatal("refused alert succeeded")
+	}
+	if calls.Load() != 1 {
+		t.Errorf("%d calls, want 1", calls.Load())
+	}
+	letters, err := queue.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(letters) != 1 || letters[0].URL != srv.URL {
+		t.Fatalf("queued %+v", letters)
+	}
+
+	// Replay fails once more, then delivers
+	failures.Store(1)
+	if sent, err := queue.Replay(context.Background(), nil); err == nil || sent != 0 {
+		t.Errorf("failing replay sent %d, err %v", sent, err)
+	}
+	if sent, err := queue.Replay(context.Background(), nil); err != nil || sent != 1 {
+		t.Errorf("replay sent %d, err %v; want 1", sent, err)
+	}
+	if letters, _ := queue.Load(); len(letters) != 0 {
+		t.Errorf("still queued after replay: %+v", letters)
+	}
+}
+
+func TestRetryPolicyBudget(t *testing.T) {
+	// Waits of 1s, 2s, 4s and 8s between five attempts of 10s each
+	if got, want := DefaultRetryPolicy.Budget(10*time.Second), 65*time.Second; got != want {
+		t.Errorf("default budget %v, want %v", got, want)
+	}
+	capped := RetryPolicy{Attempts: 4, Backoff: time.Second, MaxBackoff: 2 * time.Second}
+	if got, want := capped.Budget(0), 5*time.Second; got != want {
+		t.Errorf("capped budget %v, want %v", got, want)
+	}
+	if got, want := (RetryPolicy{}).Budget(time.Second), time.Second; got != want {
+		t.Errorf("no retries budget %v, want %v", got, want)
+	}
+}
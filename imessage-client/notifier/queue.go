@@ -0,0 +1,90 @@
+package notifier
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"imessage-client/messaging"
+)
+
+// ErrAlertQueueFull is returned by QueuedAlerter when an alert is dropped
+// because too many are waiting to be delivered.
+var ErrAlertQueueFull = errors.New("too many alerts waiting, dropped alert")
+
+// QueuedAlerter hands alerts to another Alerter from a background worker, so
+// raising one never blocks the caller. Session event handlers, which run on
+// the APNS read loop, must not wait on a slow webhook.
+type QueuedAlerter struct {
+	alerter Alerter
+	timeout time.Duration
+	onError func(messaging.AlertEvent, error)
+
+	queue chan messaging.AlertEvent
+	done  chan struct{}
+	once  sync.Once
+	mu    sync.RWMutex
+	shut  bool
+}
+
+// NewQueuedAlerter starts a worker delivering alerts to alerter one at a
+// time, giving each up to timeout. At most buffer alerts wait; more are
+// dropped. onError, if set, is called from the worker for alerts that
+// couldn't be delivered.
+func NewQueuedAlerter(alerter Alerter, buffer int, timeout time.Duration, onError func(messaging.AlertEvent, error)) *QueuedAlerter {
+	q := &QueuedAlerter{
+		alerter: alerter,
+		timeout: timeout,
+		onError: onError,
+		queue:   make(chan messaging.AlertEvent, buffer),
+		done:    make(chan struct{}),
+	}
+	go q.run()
+	return q
+}
+
+// Alert queues evt for delivery and returns at once. It returns
+// ErrAlertQueueFull if the alert was dropped.
+func (q *QueuedAlerter) Alert(ctx context.Context, evt messaging.AlertEvent) error {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	if q.shut {
+		return errors.New("alerter is shut down")
+	}
+	select {
+	case q.queue <- evt:
+		return nil
+	default:
+		return ErrAlertQueueFull
+	}
+}
+
+func (q *QueuedAlerter) run() {
+	defer close(q.done)
+	for evt := range q.queue {
+		ctx, cancel := context.WithTimeout(context.Background(), q.timeout)
+		err := q.alerter.Alert(ctx, evt)
+		cancel()
+		if err != nil && q.onError != nil {
+			q.onError(evt, err)
+		}
+	}
+}
+
+// Shutdown stops taking alerts and waits until the queued ones are
+// delivered or ctx is done.
+func (q *QueuedAlerter) Shutdown(ctx context.Context) error {
+	q.once.Do(func() {
+		q.mu.Lock()
+		q.shut = true
+		close(q.queue)
+		q.mu.Unlock()
+	})
+	select {
+	case <-q.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,56 @@
+package notifier
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"imessage-client/messaging"
+)
+
+type blockingAlerter struct {
+	release   chan struct{}
+	delivered chan messaging.AlertEvent
+}
+
+func (b blockingAlerter) Alert(ctx context.Context, evt messaging.AlertEvent) error {
+	<-b.release
+	b.delivered <- evt
+	return nil
+}
+
+func TestQueuedAlerterDoesNotBlock(t *testing.T) {
+	inner := blockingAlerter{release: make(chan struct{}), delivered: make(chan messaging.AlertEvent, 3)}
+	q := NewQueuedAlerter(inner, 1, time.Second, nil)
+
+	evt := messaging.AlertEvent{Kind: messaging.AlertAPNSDisconnected, Time: time.Now()}
+	// The first is taken by the worker, the second waits, the third is dropped
+	var errs []error
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		errs = append(errs, q.Alert(context.Background(), evt))
+		if i == 0 {
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+	if took := time.Since(start); took > time.Second {
+		t.Errorf("raising alerts took %v with a stuck alerter", took)
+	}
+	if errs[0] != nil || errs[1] != nil || !errors.Is(errs[2], ErrAlertQueueFull) {
+		t.Errorf("errs = %v, want the third dropped", errs)
+	}
+
+	close(inner.release)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := q.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(inner.delivered); n != 2 {
+		t.Errorf("delivered %d alerts, want 2", n)
+	}
+	if err := q.Alert(context.Background(), evt); err == nil {
+		t.Error("alert accepted after shutdown")
+	}
+}
@@ -0,0 +1,83 @@
+package notifier
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// soundPlayers are tried in order when Chime.Player isn't set.
+var soundPlayers = []string{"afplay", "paplay", "pw-play", "aplay"}
+
+// DefaultChimeGap is the least time between two chimes, so a burst of
+// messages (say, after reconnecting) doesn't ring once for each.
+const DefaultChimeGap = 2 * time.Second
+
+// Chime announces new messages audibly by ringing the terminal bell, playing
+// a sound file, or both. It's separate from desktop notifications.
+type Chime struct {
+	// Bell writes BEL to Terminal.
+	Bell     bool
+	Terminal io.Writer
+	// Sound is played with Player, a command the file name is appended to.
+	// Without Player, the first of afplay, paplay, pw-play and aplay found
+	// on PATH is used.
+	Sound  string
+	Player string
+	// Gap defaults to DefaultChimeGap.
+	Gap time.Duration
+
+	mu   sync.Mutex
+	last time.Time
+}
+
+// Ring chimes once, unless it already did within Gap.
+func (c *Chime) Ring(ctx context.Context) error {
+	gap := c.Gap
+	if gap <= 0 {
+		gap = DefaultChimeGap
+	}
+	c.mu.Lock()
+	now := time.Now()
+	if !c.last.IsZero() && now.Sub(c.last) < gap {
+		c.mu.Unlock()
+		return nil
+	}
+	c.last = now
+	c.mu.Unlock()
+
+	if c.Bell && c.Terminal != nil {
+		if _, err := io.WriteString(c.Terminal, "\a"); err != nil {
+			return fmt.Errorf("failed to ring bell: %w", err)
+		}
+	}
+	if c.Sound != "" {
+		return c.play(ctx)
+	}
+	return nil
+}
+
+func (c *Chime) play(ctx context.Context) error {
+	args := strings.Fields(c.Player)
+	if len(args) == 0 {
+		for _, player := range soundPlayers {
+			if _, err := exec.LookPath(player); err == nil {
+				args = []string{player}
+				break
+			}
+		}
+		if len(args) == 0 {
+			return fmt.Errorf("no sound player found (tried %s); set one with --sound-player", strings.Join(soundPlayers, ", "))
+		}
+	}
+	cmd := exec.CommandContext(ctx, args[0], append(args[1:], c.Sound)...)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to play %s: %w (output: %s)", c.Sound, err, bytes.TrimSpace(output))
+	}
+	return nil
+}
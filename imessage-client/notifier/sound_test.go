@@ -0,0 +1,39 @@
+package notifier
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestChimeBell(t *testing.T) {
+	var term bytes.Buffer
+	chime := &Chime{Bell: true, Terminal: &term, Gap: time.Hour}
+	for i := 0; i < 3; i++ {
+		if err := chime.Ring(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if term.String() != "\a" {
+		t.Errorf("terminal got %q, want one bell", term.String())
+	}
+}
+
+func TestChimeSound(t *testing.T) {
+	sound := filepath.Join(t.TempDir(), "ding.wav")
+	if err := os.WriteFile(sound, []byte("RIFF"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	// The file name is appended to the player command, so cp -t copies it
+	played := t.TempDir()
+	chime := &Chime{Sound: sound, Player: "cp -t " + played}
+	if err := chime.Ring(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(played, "ding.wav")); err != nil {
+		t.Errorf("sound was not played: %v", err)
+	}
+}
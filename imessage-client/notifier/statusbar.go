@@ -0,0 +1,97 @@
+package notifier
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"imessage-client/messaging"
+)
+
+// StatusBarFormats are the formats PrintUnreadCount accepts.
+var StatusBarFormats = []string{"text", "waybar", "i3blocks"}
+
+// DefaultTooltipChats is how many chats the tooltip lists.
+const DefaultTooltipChats = 5
+
+// waybarOutput is the JSON a waybar custom module with "return-type": "json"
+// reads.
+type waybarOutput struct {
+	Text    string `json:"text"`
+	Tooltip string `json:"tooltip"`
+	Class   string `json:"class"`
+	Alt     string `json:"alt"`
+}
+
+// PrintUnreadCount prints the unread total for a status bar: a bare number
+// for "text", a JSON line for waybar, or the full_text and short_text lines
+// of an i3blocks block. The tooltip lists up to maxChats of the most recent
+// chats. Chats muted with messaging.Mute are left out.
+func PrintUnreadCount(w io.Writer, unread []messaging.UnreadChat, format string, maxChats int) error {
+	unread = unmutedChats(unread)
+	total := 0
+	for _, chat := range unread {
+		total += chat.Count
+	}
+	switch format {
+	case "", "text":
+		_, err := fmt.Fprintln(w, total)
+		return err
+	case "waybar":
+		state := "read"
+		if total > 0 {
+			state = "unread"
+		}
+		out := waybarOutput{
+			Text:    fmt.Sprint(total),
+			Tooltip: unreadTooltip(unread, maxChats),
+			Class:   state,
+			Alt:     state,
+		}
+		data, err := json.Marshal(out)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "%s\n", data)
+		return err
+	case "i3blocks":
+		// i3blocks has no tooltips; the first line is full_text, the second short_text
+		full := fmt.Sprint(total)
+		if total > 0 && len(unread) > 0 {
+			full = fmt.Sprintf("%d (%s)", total, unread[0].Chat)
+		}
+		_, err := fmt.Fprintf(w, "%s\n%d\n", full, total)
+		return err
+	default:
+		return fmt.Errorf("unknown format %q (want %s)", format, strings.Join(StatusBarFormats, ", "))
+	}
+}
+
+func unreadTooltip(unread []messaging.UnreadChat, maxChats int) string {
+	if len(unread) == 0 {
+		return "No unread messages"
+	}
+	if maxChats <= 0 {
+		maxChats = DefaultTooltipChats
+	}
+	var lines []string
+	for i, chat := range unread {
+		if i == maxChats {
+			lines = append(lines, fmt.Sprintf("and %d more", len(unread)-i))
+			break
+		}
+		lines = append(lines, fmt.Sprintf("%s (%d)", chat.Chat, chat.Count))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func unmutedChats(unread []messaging.UnreadChat) []messaging.UnreadChat {
+	var loud []messaging.UnreadChat
+	for _, chat := range unread {
+		if !chat.Muted {
+			loud = append(loud, chat)
+		}
+	}
+	return loud
+}
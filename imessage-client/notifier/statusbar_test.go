@@ -0,0 +1,59 @@
+package notifier
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"imessage-client/messaging"
+)
+
+func TestPrintUnreadCountWaybar(t *testing.T) {
+	unread := []messaging.UnreadChat{
+		{Chat: "tel:+15555550123", Count: 2},
+		{Chat: "mailto:a@example.com", Count: 1},
+		{Chat: "mailto:b@example.com", Count: 1},
+	}
+	var buf bytes.Buffer
+	if err := PrintUnreadCount(&buf, unread, "waybar", 2); err != nil {
+		t.Fatal(err)
+	}
+	var got waybarOutput
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("output %q is not JSON: %v", buf.String(), err)
+	}
+	want := waybarOutput{
+		Text:    "4",
+		Tooltip: "tel:+15555550123 (2)\nmailto:a@example.com (1)\nand 1 more",
+		Class:   "unread",
+		Alt:     "unread",
+	}
+	if got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	buf.Reset()
+	if err := PrintUnreadCount(&buf, nil, "waybar", 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Text != "0" || got.Class != "read" {
+		t.Errorf("empty output = %+v", got)
+	}
+}
+
+func TestPrintUnreadCountSkipsMuted(t *testing.T) {
+	unread := []messaging.UnreadChat{
+		{Chat: "tel:+15555550123", Count: 2, Muted: true},
+		{Chat: "mailto:a@example.com", Count: 1},
+	}
+	var buf bytes.Buffer
+	if err := PrintUnreadCount(&buf, unread, "text", 0); err != nil {
+		t.Fatal(err)
+	}
+	if got := buf.String(); got != "1\n" {
+		t.Errorf("got %q, want 1", got)
+	}
+}
@@ -0,0 +1,77 @@
+package notifier
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"text/template"
+	"time"
+
+	"imessage-client/messaging"
+)
+
+// Template renders one line per message, for scripts and status bars. It is
+// either a Go template such as "{{.sender}}: {{.preview}}", or a format
+// string with {sender}-style placeholders. Both know the fields sender,
+// chat, preview, time (RFC 3339) and service; templates also get timestamp
+// as a time.Time for custom layouts.
+type Template struct {
+	tmpl   *template.Template
+	format string
+}
+
+// ParseTemplate parses text as a Go template if it contains "{{", and as a
+// format string otherwise.
+func ParseTemplate(text string) (*Template, error) {
+	if !strings.Contains(text, "{{") {
+		return &Template{format: text}, nil
+	}
+	tmpl, err := template.New("summary").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid output template: %w", err)
+	}
+	return &Template{tmpl: tmpl}, nil
+}
+
+// Render formats one message.
+func (t *Template) Render(msg messaging.MessageSummary) (string, error) {
+	fields := map[string]string{
+		"sender":  msg.Sender,
+		"chat":    msg.Chat,
+		"preview": msg.Preview,
+		"time":    msg.Timestamp.Format(time.RFC3339),
+		"service": msg.Service,
+	}
+	if t.tmpl == nil {
+		pairs := make([]string, 0, 2*len(fields))
+		for name, value := range fields {
+			pairs = append(pairs, "{"+name+"}", value)
+		}
+		return strings.NewReplacer(pairs...).Replace(t.format), nil
+	}
+	data := make(map[string]any, len(fields)+1)
+	for name, value := range fields {
+		data[name] = value
+	}
+	data["timestamp"] = msg.Timestamp
+	var out strings.Builder
+	if err := t.tmpl.Execute(&out, data); err != nil {
+		return "", fmt.Errorf("failed to render output template: %w", err)
+	}
+	return out.String(), nil
+}
+
+// PrintSummariesTemplate writes each message rendered with tmpl on its own
+// line. Unlike PrintSummaries it prints nothing when there are no messages.
+func PrintSummariesTemplate(w io.Writer, summaries []messaging.MessageSummary, tmpl *Template) error {
+	for _, msg := range summaries {
+		line, err := tmpl.Render(msg)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package notifier
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"imessage-client/messaging"
+)
+
+func TestTemplateRender(t *testing.T) {
+	msg := messaging.MessageSummary{
+		Sender:    "tel:+15555550123",
+		Chat:      "tel:+15555550123",
+		Preview:   "hello",
+		Timestamp: time.Date(2024, 5, 1, 12, 30, 0, 0, time.UTC),
+		Service:   "iMessage",
+	}
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"{{.sender}}: {{.preview}}", "tel:+15555550123: hello"},
+		{`{{.timestamp.Format "15:04"}} {{.service}}`, "12:30 iMessage"},
+		{"[{time}] {chat} {preview} {unknown}", "[2024-05-01T12:30:00Z] tel:+15555550123 hello {unknown}"},
+	}
+	for _, tt := range tests {
+		tmpl, err := ParseTemplate(tt.text)
+		if err != nil {
+			t.Fatalf("%q: %v", tt.text, err)
+		}
+		got, err := tmpl.Render(msg)
+		if err != nil {
+			t.Fatalf("%q: %v", tt.text, err)
+		}
+		if got != tt.want {
+			t.Errorf("%q rendered %q, want %q", tt.text, got, tt.want)
+		}
+	}
+
+	if _, err := ParseTemplate("{{.sender"); err == nil {
+		t.Error("malformed template accepted")
+	}
+	tmpl, _ := ParseTemplate("{{.nope}}")
+	if _, err := tmpl.Render(msg); err == nil {
+		t.Error("unknown field rendered without error")
+	}
+
+	var out bytes.Buffer
+	tmpl, _ = ParseTemplate("{sender}")
+	if err := PrintSummariesTemplate(&out, []messaging.MessageSummary{msg, msg}, tmpl); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "tel:+15555550123\ntel:+15555550123\n" {
+		t.Errorf("output = %q", out.String())
+	}
+}
@@ -6,7 +6,9 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"log/slog"
 	"os"
 	"time"
 
@@ -14,7 +16,13 @@ import (
 	"github.com/beeper/mac-registration-provider/versions"
 )
 
+// RegistrationVersion is the format version of the registration data. Bump
+// it, and teach imessage-client to upgrade the previous version, whenever
+// the format changes.
+const RegistrationVersion = 1
+
 type ReqSubmitValidationData struct {
+	Version        int               `json:"version"`
 	ValidationData []byte            `json:"validation_data"`
 	ValidUntil     time.Time         `json:"valid_until"`
 	NacservCommit  string            `json:"nacserv_commit"`
@@ -27,10 +35,17 @@ var (
 	jsonOutput         = flag.Bool("json", false, "Print JSON to stdout instead of writing a file")
 	outputPath         = flag.String("out", "registration-data.json", "Path to write registration data (use - for stdout)")
 	checkCompatibility = flag.Bool("check-compatibility", false, "Check if offsets for the current OS version are available and exit")
+	retries            = flag.Int("retries", 3, "How many times to retry fetching the certificate or generating data after a transient error")
+	retryDelay         = flag.Duration("retry-delay", 2*time.Second, "Delay before the first retry, doubled for each one after it")
+	verbose            = flag.Bool("verbose", false, "Log debug diagnostics too, such as the responses of failed requests")
+	logFile            = flag.String("log-file", "", "Append logs to this file instead of stderr")
 )
 
 func main() {
 	flag.Parse()
+	if err := setupLogging(); err != nil {
+		log.Fatal(err)
+	}
 	log.Printf("Starting mac-registration-provider %s", shortCommit())
 	log.Println("Loading identityservicesd")
 	err := nac.Load()
@@ -62,17 +77,26 @@ func main() {
 		}
 		return
 	}
+	ctx := context.Background()
 	log.Println("Fetching certificate...")
-	err = InitFetchCert(context.Background())
+	err = retry(ctx, "fetch certificate", *retries, *retryDelay, func() error {
+		return InitFetchCert(ctx)
+	})
 	if err != nil {
-		panic(err)
+		log.Fatalf("Giving up: %v", err)
 	}
 	log.Println("Generating registration data...")
-	validationData, validUntil, err := GenerateValidationData(context.Background())
+	var validationData []byte
+	var validUntil time.Time
+	err = retry(ctx, "generate registration data", *retries, *retryDelay, func() (err error) {
+		validationData, validUntil, err = GenerateValidationData(ctx)
+		return err
+	})
 	if err != nil {
-		panic(err)
+		log.Fatalf("Giving up: %v", err)
 	}
 	payload := &ReqSubmitValidationData{
+		Version:        RegistrationVersion,
 		ValidationData: validationData,
 		ValidUntil:     validUntil,
 		NacservCommit:  Commit,
@@ -84,6 +108,27 @@ func main() {
 	log.Println("Registration data ready")
 }
 
+// setupLogging sends logs to -log-file, or stderr, at debug level with
+// -verbose. The log package goes through the same handler, so log.Printf
+// calls end up there too.
+func setupLogging() error {
+	out := io.Writer(os.Stderr)
+	if *logFile != "" {
+		file, err := os.OpenFile(*logFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+		if err != nil {
+			return fmt.Errorf("failed to open log file: %w", err)
+		}
+		// Left open until exit, since log.Fatal skips deferred calls
+		out = file
+	}
+	level := slog.LevelInfo
+	if *verbose {
+		level = slog.LevelDebug
+	}
+	slog.SetDefault(slog.New(slog.NewTextHandler(out, &slog.HandlerOptions{Level: level})))
+	return nil
+}
+
 func shortCommit() string {
 	if len(Commit) >= 8 {
 		return Commit[:8]
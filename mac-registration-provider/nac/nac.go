@@ -91,6 +91,16 @@ func MeowMemory() func() {
 	}
 }
 
+// Error is a non-zero response from one of the NAC functions.
+type Error struct {
+	Op   string
+	Code int
+}
+
+func (err *Error) Error() string {
+	return fmt.Sprintf("%s failed with response %d", err.Op, err.Code)
+}
+
 func SanityCheck() error {
 	resp := int(C.nacInitProxy(nacInitAddr, nil, C.int(0), nil, nil, nil))
 	if resp != -44023 {
@@ -111,7 +121,7 @@ func Init(cert []byte) (validationCtx unsafe.Pointer, request []byte, err error)
 		&outputBytesLen,
 	))
 	if resp != 0 {
-		err = fmt.Errorf("NACInit failed with response %d", resp)
+		err = &Error{Op: "NACInit", Code: resp}
 		return
 	}
 	request = unsafe.Slice((*byte)(outputBytesPtr), int(outputBytesLen))
@@ -126,7 +136,7 @@ func KeyEstablishment(validationCtx unsafe.Pointer, response []byte) (err error)
 		C.int(len(response)),
 	))
 	if resp != 0 {
-		err = fmt.Errorf("NACKeyEstablishment failed with response %d", resp)
+		err = &Error{Op: "NACKeyEstablishment", Code: resp}
 		return
 	}
 	return
@@ -144,7 +154,7 @@ func Sign(validationCtx unsafe.Pointer) (validationData []byte, err error) {
 		&outputBytesLen,
 	))
 	if resp != 0 {
-		err = fmt.Errorf("NACSign failed with response %d", resp)
+		err = &Error{Op: "NACSign", Code: resp}
 		return
 	}
 	validationData = unsafe.Slice((*byte)(outputBytesPtr), int(outputBytesLen))
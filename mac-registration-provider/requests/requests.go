@@ -6,7 +6,7 @@ import (
 	"encoding/base64"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
 
 	"howett.net/plist"
@@ -21,6 +21,15 @@ const (
 	initializeValidationURL = "https://identity.ess.apple.com/WebObjects/TDIdentityService.woa/wa/initializeValidation"
 )
 
+// StatusError is a response with a status other than 200 OK.
+type StatusError struct {
+	StatusCode int
+}
+
+func (err *StatusError) Error() string {
+	return fmt.Sprintf("unexpected status code %d", err.StatusCode)
+}
+
 type CertResponse struct {
 	Cert []byte `plist:"cert"`
 }
@@ -53,10 +62,11 @@ func makeRequest(ctx context.Context, url string, body, output any) ([]byte, err
 		_ = resp.Body.Close()
 	}()
 	respData, err := io.ReadAll(resp.Body)
+	slog.Debug("Apple request finished", "method", method, "url", url, "status", resp.StatusCode, "bytes", len(respData))
 	if err != nil {
 		return nil, fmt.Errorf("failed to read body: %w", err)
 	} else if resp.StatusCode != http.StatusOK {
-		return respData, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+		return respData, &StatusError{StatusCode: resp.StatusCode}
 	}
 	return respData, nil
 }
@@ -92,9 +102,9 @@ func InitializeValidation(ctx context.Context, request []byte) (sessionInfo []by
 			var rawData map[string]any
 			_, plistErr := plist.Unmarshal(respData, &rawData)
 			if plistErr == nil {
-				log.Printf("Plist response data of errored request: %+v", rawData)
+				slog.Debug("Plist response data of errored request", "data", rawData)
 			} else {
-				log.Printf("Raw response data of errored request: %s", base64.StdEncoding.EncodeToString(respData))
+				slog.Debug("Raw response data of errored request", "data", base64.StdEncoding.EncodeToString(respData))
 			}
 		}
 	}()
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/beeper/mac-registration-provider/nac"
+	"github.com/beeper/mac-registration-provider/requests"
+)
+
+// maxRetryDelay caps the doubling delay between retries.
+const maxRetryDelay = time.Minute
+
+// isTransient reports whether err is worth retrying: network failures,
+// timeouts, server errors and rate limiting from Apple, and NAC failures,
+// since each attempt starts a fresh NAC session.
+func isTransient(err error) bool {
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+	var statusErr *requests.StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode >= 500 || statusErr.StatusCode == http.StatusTooManyRequests
+	}
+	var netErr net.Error
+	var nacErr *nac.Error
+	return errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) || errors.As(err, &nacErr)
+}
+
+// retry runs fn until it succeeds, fails with an error that isn't
+// transient, or has been retried retries times, waiting delay before the
+// first retry and twice as long before each one after that.
+func retry(ctx context.Context, what string, retries int, delay time.Duration, fn func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= retries || !isTransient(err) {
+			return err
+		}
+		log.Printf("Failed to %s (attempt %d of %d), retrying in %s: %v", what, attempt+1, retries+1, delay, err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return err
+		}
+		delay = min(delay*2, maxRetryDelay)
+	}
+}